@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+const (
+	// defaultAgentTimeout bounds one test on an agent when agent_timeout
+	// is not set.
+	defaultAgentTimeout = 10 * time.Minute
+	// agentPoll is how often a running test is asked after, or more often
+	// under a short agent_timeout.
+	agentPoll = time.Second
+)
+
+// errAgentBusy is returned by an agent running as many tests as it may.
+var errAgentBusy = errors.New("agent busy")
+
+// coordinator runs the urls on remote agents through their test API. Each
+// agent tests the urls one after another, as a local pass would, and the
+// agents test side by side.
+type coordinator struct {
+	agents  []perf.Agent
+	client  *http.Client
+	timeout time.Duration
+	slots   chan struct{}
+	runID   string
+}
+
+// newCoordinator returns the coordinator of config's agents, or nil when
+// there are none and urls are tested here.
+func newCoordinator(config perf.Config, runID string) *coordinator {
+	if len(config.Agents) == 0 {
+		return nil
+	}
+	c := &coordinator{
+		agents:  config.Agents,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		timeout: config.AgentTimeout,
+		runID:   runID,
+	}
+	if c.timeout == 0 {
+		c.timeout = defaultAgentTimeout
+	}
+	n := config.AgentConcurrency
+	if n == 0 {
+		n = len(c.agents)
+	}
+	c.slots = make(chan struct{}, n)
+	return c
+}
+
+// Run tests targets on every agent and sends the final result of each
+// test, labeled with its agent. An agent that cannot be reached fails its
+// own results only.
+func (c *coordinator) Run(ctx context.Context, targets []perf.Target) <-chan perf.Stats {
+	out := make(chan perf.Stats)
+	var wg sync.WaitGroup
+	for _, agent := range c.agents {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case c.slots <- struct{}{}:
+				defer func() { <-c.slots }()
+			case <-ctx.Done():
+			}
+			for _, target := range targets {
+				result := c.test(ctx, agent, target)
+				result.Agent, result.RunID, result.Sinks = agent.Label, c.runID, target.Sinks
+				out <- result
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// test runs target on agent and waits for its result, cancelling it on
+// the agent when ctx ends or agent_timeout passes first.
+func (c *coordinator) test(ctx context.Context, agent perf.Agent, target perf.Target) perf.Stats {
+	failed := perf.Stats{URL: target.URL, Name: target.Name, Group: target.Group, Direction: target.Direction()}
+	fail := func(err error) perf.Stats {
+		failed.Kind, failed.Error, failed.ErrorKind = perf.KindError, err, perf.Classify(err)
+		if ctx.Err() != nil {
+			failed.Kind, failed.Error, failed.ErrorKind, failed.Cancelled = perf.KindCancelled, nil, "", true
+		}
+		return failed
+	}
+	if ctx.Err() != nil {
+		return fail(ctx.Err())
+	}
+
+	testCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	ticker := time.NewTicker(min(agentPoll, c.timeout/4))
+	defer ticker.Stop()
+	timedOut := func() perf.Stats {
+		if ctx.Err() == nil {
+			return fail(fmt.Errorf("agent %s: no result after agent_timeout %v: %w", agent.Label, c.timeout, context.DeadlineExceeded))
+		}
+		return fail(ctx.Err())
+	}
+
+	// A busy agent is asked again until it has a slot free.
+	body, _ := json.Marshal(testRequest{URL: target.URL, Name: target.Name, MaxBytes: int64(target.MaxBytes), Streams: target.Streams})
+	var status testStatus
+	for {
+		err := c.call(testCtx, http.MethodPost, agent.URL+"/tests", body, http.StatusAccepted, &status)
+		if err == nil {
+			break
+		}
+		if testCtx.Err() != nil {
+			return timedOut()
+		}
+		if !errors.Is(err, errAgentBusy) {
+			return fail(fmt.Errorf("agent %s: %w", agent.Label, err))
+		}
+		select {
+		case <-testCtx.Done():
+			return timedOut()
+		case <-ticker.C:
+		}
+	}
+
+	for status.State == "running" {
+		select {
+		case <-testCtx.Done():
+			// The test is cancelled on the agent too, so it does not
+			// keep its slot.
+			stopCtx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+			c.call(stopCtx, http.MethodDelete, agent.URL+"/tests/"+status.ID, nil, http.StatusAccepted, nil)
+			stop()
+			return timedOut()
+		case <-ticker.C:
+		}
+		if err := c.call(testCtx, http.MethodGet, agent.URL+"/tests/"+status.ID, nil, http.StatusOK, &status); err != nil && testCtx.Err() == nil {
+			return fail(fmt.Errorf("agent %s: %w", agent.Label, err))
+		}
+	}
+	if status.Result == nil {
+		return fail(fmt.Errorf("agent %s: test %s %s without a result", agent.Label, status.ID, status.State))
+	}
+	return status.Result.stats()
+}
+
+// call sends a request to an agent's API and decodes its answer into v,
+// failing unless it has status want.
+func (c *coordinator) call(ctx context.Context, method, url string, body []byte, want int, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, strings.TrimSpace(string(msg)))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			err = fmt.Errorf("%w: %w", errAgentBusy, err)
+		}
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s %s: %w", method, url, err)
+	}
+	return nil
+}
+
+// stats turns a result an agent sent back into Stats, as far as its JSON
+// carries them.
+func (r jsonResult) stats() perf.Stats {
+	s := perf.Stats{
+		Kind:          perf.Kind(r.Kind),
+		URL:           r.URL,
+		ExpandedURL:   r.Expanded,
+		Name:          r.Name,
+		Group:         r.Group,
+		Direction:     perf.Direction(r.Direction),
+		SizeBytes:     r.SizeBytes,
+		Elapsed:       time.Duration(r.ElapsedMs) * time.Millisecond,
+		SpeedMbps:     r.SpeedMbps,
+		SpeedMBps:     r.SpeedMBps,
+		ExpectedBytes: r.Expected,
+		RemoteAddr:    r.Remote,
+		ConnectTo:     r.ConnectTo,
+		CacheMode:     r.CacheMode,
+		LatencyGrade:  r.Grade,
+		SweepSize:     r.SweepSize,
+		BidiPhase:     r.BidiPhase,
+		SoloMbps:      r.SoloMbps,
+		SampleOffset:  r.SampleOffset,
+		OffsetSamples: r.OffsetSamples,
+		SampleNote:    r.SampleNote,
+		Timestamp:     r.Timestamp,
+		RunOffset:     time.Duration(r.RunOffsetMs * float64(time.Millisecond)),
+		IPVersion:     r.IPVersion,
+		Streams:       r.Streams,
+		Attempt:       r.Attempts,
+		StatusCode:    r.Status,
+		Protocol:      r.Protocol,
+		TLSVersion:    r.TLS,
+		Truncated:     r.Truncated,
+		Reused:        r.Reused,
+		Resumes:       r.Resumes,
+		StalledTime:   time.Duration(r.StalledMs) * time.Millisecond,
+		LongestStall:  time.Duration(r.LongestMs) * time.Millisecond,
+		PeakMbps:      r.Peak,
+		TimeToPeak:    time.Duration(r.PeakMs) * time.Millisecond,
+		RampTime:      time.Duration(r.RampMs * float64(time.Millisecond)),
+		RampBytes:     r.RampBytes,
+		Host:          r.Host,
+		Labels:        r.Labels,
+		Done:          r.Kind == string(perf.KindFinal),
+		LinkDown:      r.LinkDown,
+		Cancelled:     r.Cancelled,
+		Skipped:       r.Skipped,
+		SkipReason:    r.SkipWhy,
+	}
+	if r.Error != "" {
+		s.Error, s.ErrorKind, s.TimeoutPhase = errors.New(r.Error), r.ErrorKind, r.TimeoutPhase
+	}
+	return s
+}
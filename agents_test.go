@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// newAgent serves the test API in process, as a remote yaperf with serve
+// set would, running up to concurrency tests with runner.
+func newAgent(t *testing.T, runner testRunner, concurrency int) (*apiServer, *httptest.Server) {
+	s := newTestAPI(t, runner, concurrency)
+	srv := httptest.NewServer(s.handler())
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func TestCoordinator(t *testing.T) {
+	data := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000*len(r.URL.Path)))
+	}))
+	defer data.Close()
+	tester := perf.New(perf.Options{ProgressInterval: -1})
+	_, east := newAgent(t, tester, 1)
+	_, west := newAgent(t, tester, 1)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	config := perf.Config{Agents: []perf.Agent{
+		{Label: "east", URL: east.URL},
+		{Label: "west", URL: west.URL},
+		{Label: "gone", URL: "http://" + l.Addr().String()},
+	}}
+	targets := []perf.Target{{URL: data.URL + "/a", Name: "a"}, {URL: data.URL + "/bb", Sinks: []string{"influx"}}}
+	coord := newCoordinator(config, "run-1")
+
+	collector := perf.NewCollector()
+	byAgent := map[string][]perf.Stats{}
+	for s := range coord.Run(context.Background(), targets) {
+		if s.RunID != "run-1" {
+			t.Errorf("%s result of run %q", s.Agent, s.RunID)
+		}
+		byAgent[s.Agent] = append(byAgent[s.Agent], s)
+		collector.Add(s)
+	}
+	// Each agent tests the urls in order, and only the one that cannot be
+	// reached fails.
+	for _, agent := range []string{"east", "west"} {
+		results := byAgent[agent]
+		if len(results) != 2 {
+			t.Fatalf("%s: %d results", agent, len(results))
+		}
+		for i, s := range results {
+			if s.Kind != perf.KindFinal || !s.Done || s.Error != nil || s.URL != targets[i].URL || s.SizeBytes != int64(1000*len(s.URL[len(data.URL):])) {
+				t.Errorf("%s: %s %s of %d bytes (%v)", agent, s.Kind, s.URL, s.SizeBytes, s.Error)
+			}
+		}
+		if results[0].Name != "a" || results[1].Sinks[0] != "influx" {
+			t.Errorf("%s: name %q, sinks %v", agent, results[0].Name, results[1].Sinks)
+		}
+	}
+	for _, s := range byAgent["gone"] {
+		if s.Kind != perf.KindError || s.ErrorKind != perf.ErrorConnect || !strings.HasPrefix(s.Error.Error(), "agent gone: ") {
+			t.Errorf("unreachable agent: %s %v (%s)", s.Kind, s.Error, s.ErrorKind)
+		}
+	}
+
+	// The summary has a row per url and agent.
+	summaries := collector.Summaries()
+	if len(summaries) != 6 {
+		t.Fatalf("%d summaries, want 6", len(summaries))
+	}
+	runs := map[string]int{}
+	for _, s := range summaries {
+		runs[s.Agent] += s.Runs
+	}
+	if runs["east"] != 2 || runs["west"] != 2 || runs["gone"] != 0 {
+		t.Errorf("runs by agent %v", runs)
+	}
+	targets[0].Thresholds = perf.Thresholds{MinSpeedMbps: 0.001}
+	checks := perf.Checks(targets, summaries, perf.LinkCapacity{})
+	if len(checks) != 3 {
+		t.Fatalf("%d checks, want one per agent", len(checks))
+	}
+	for _, c := range checks {
+		if want := map[string]perf.Status{"east": perf.StatusOK, "west": perf.StatusOK, "gone": perf.StatusCritical}[c.Agent]; c.Status != want {
+			t.Errorf("check on %s: %v %q", c.Agent, c.Status, c.Failures)
+		}
+	}
+}
+
+func TestCoordinatorBusyAgent(t *testing.T) {
+	runner := fakeRunner{release: make(chan struct{})}
+	s, srv := newAgent(t, runner, 1)
+	// Another client has the agent's one slot.
+	call(t, srv, "POST", "/tests", `{"url": "https://example.com/other"}`, nil)
+	coord := newCoordinator(perf.Config{Agents: []perf.Agent{{Label: "edge", URL: srv.URL}}, AgentTimeout: 2 * time.Second}, "run-1")
+	results := coord.Run(context.Background(), []perf.Target{{URL: "https://example.com/a"}})
+	time.Sleep(100 * time.Millisecond)
+	close(runner.release)
+	got := <-results
+	if got.Kind != perf.KindFinal || got.URL != "https://example.com/a" || got.SizeBytes != 1e6 {
+		t.Errorf("busy agent gave %s %s of %d bytes (%v)", got.Kind, got.URL, got.SizeBytes, got.Error)
+	}
+	s.wg.Wait()
+}
+
+func TestCoordinatorTimeout(t *testing.T) {
+	runner := fakeRunner{release: make(chan struct{})}
+	defer close(runner.release)
+	s, srv := newAgent(t, runner, 1)
+	coord := newCoordinator(perf.Config{Agents: []perf.Agent{{Label: "edge", URL: srv.URL}}, AgentTimeout: 200 * time.Millisecond}, "")
+	start := time.Now()
+	got := <-coord.Run(context.Background(), []perf.Target{{URL: "https://example.com/a"}})
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("timed out after %v", took)
+	}
+	if got.Kind != perf.KindError || got.ErrorKind != perf.ErrorTimeout || !errors.Is(got.Error, context.DeadlineExceeded) ||
+		got.Error.Error() != "agent edge: no result after agent_timeout 200ms: context deadline exceeded" {
+		t.Errorf("timed out test: %s %v (%s)", got.Kind, got.Error, got.ErrorKind)
+	}
+	// The test is cancelled on the agent too, freeing its slot.
+	s.wg.Wait()
+	var list []testStatus
+	call(t, srv, "GET", "/tests", "", &list)
+	if len(list) != 1 || list[0].State != "cancelled" {
+		t.Errorf("agent's tests %+v", list)
+	}
+
+	// A run cancelled here reports cancelled, not failed.
+	ctx, cancel := context.WithCancel(context.Background())
+	results := newCoordinator(perf.Config{Agents: []perf.Agent{{Label: "edge", URL: srv.URL}}}, "").Run(ctx, []perf.Target{{URL: "https://example.com/b"}})
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if got := <-results; got.Kind != perf.KindCancelled || !got.Cancelled || got.Error != nil {
+		t.Errorf("cancelled run: %s %v", got.Kind, got.Error)
+	}
+}
+
+func TestNewCoordinator(t *testing.T) {
+	if newCoordinator(perf.Config{}, "") != nil {
+		t.Error("coordinator without agents")
+	}
+	agents := []perf.Agent{{Label: "a", URL: "http://a"}, {Label: "b", URL: "http://b"}, {Label: "c", URL: "http://c"}}
+	c := newCoordinator(perf.Config{Agents: agents}, "")
+	if c.timeout != defaultAgentTimeout || cap(c.slots) != 3 {
+		t.Errorf("defaults: timeout %v, %d at once", c.timeout, cap(c.slots))
+	}
+	c = newCoordinator(perf.Config{Agents: agents, AgentTimeout: time.Minute, AgentConcurrency: 2}, "")
+	if c.timeout != time.Minute || cap(c.slots) != 2 {
+		t.Errorf("timeout %v, %d at once", c.timeout, cap(c.slots))
+	}
+}
+
+func TestAgentResultRoundTrip(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/a", Name: "a", Group: "cdn", Direction: perf.Download, Done: true,
+		SizeBytes: 1e6, Elapsed: 2 * time.Second, SpeedMbps: 4, SpeedMBps: 0.5, PeakMbps: 5, Streams: 2, Attempt: 1,
+		StatusCode: 200, Protocol: "HTTP/1.1", Host: "edge-1", Timestamp: at}
+	got := newJSONResult(s).stats()
+	got.Timestamp = at
+	if got.Kind != s.Kind || got.URL != s.URL || got.Name != s.Name || got.Group != s.Group || got.Direction != s.Direction || !got.Done ||
+		got.SizeBytes != s.SizeBytes || got.Elapsed != s.Elapsed || got.SpeedMbps != s.SpeedMbps || got.PeakMbps != s.PeakMbps ||
+		got.Streams != s.Streams || got.StatusCode != s.StatusCode || got.Protocol != s.Protocol || got.Host != s.Host {
+		t.Errorf("round trip\n%+v\nwant\n%+v", got, s)
+	}
+	failed := newJSONResult(perf.Stats{Kind: perf.KindError, URL: "https://example.com/a", Direction: perf.Download, Error: errors.New("reset"), ErrorKind: perf.ErrorRead}).stats()
+	if failed.Done || failed.Error == nil || failed.Error.Error() != "reset" || failed.ErrorKind != perf.ErrorRead {
+		t.Errorf("failed round trip %+v", failed)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// archiveStamp dates rotated archives; it sorts in the order they were
+// rotated.
+const archiveStamp = "20060102T150405.000Z"
+
+// checkArchivePath rejects compression the archive cannot write: only
+// gzip is.
+func checkArchivePath(path string) error {
+	for _, ext := range []string{".zst", ".xz", ".bz2", ".lz4"} {
+		if strings.HasSuffix(path, ext) {
+			return fmt.Errorf("%s compression is not supported, use .gz", ext)
+		}
+	}
+	return nil
+}
+
+// resultArchive appends every final result, and with progress every
+// progress snapshot, as one JSON line to path,
+// gzip-compressed when it ends in .gz. Once the file reaches rotateSize it
+// is renamed aside with the time in its name and a new one started; only
+// the newest keep of those are kept. The file in use is only ever renamed
+// whole, so a crash leaves it either in place or archived, never split.
+type resultArchive struct {
+	path       string
+	progress   bool
+	rotateSize int64
+	keep       int
+
+	mu sync.Mutex
+	f  *os.File
+	gz *gzip.Writer
+	w  io.Writer
+}
+
+// openResultArchive starts a fresh file at path. A file left by an earlier
+// run, perhaps cut short by a crash, is archived first rather than
+// appended to.
+func openResultArchive(path string, progress bool, rotateSize int64, keep int) (*resultArchive, error) {
+	if err := checkArchivePath(path); err != nil {
+		return nil, fmt.Errorf("results_file: %w", err)
+	}
+	a := &resultArchive{path: path, progress: progress, rotateSize: rotateSize, keep: keep}
+	if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+		if err := a.archive(); err != nil {
+			return nil, fmt.Errorf("results_file: %w", err)
+		}
+	}
+	if err := a.open(); err != nil {
+		return nil, fmt.Errorf("results_file: %w", err)
+	}
+	return a, nil
+}
+
+func (a *resultArchive) open() error {
+	// Appending is safe for gzip, which reads concatenated streams as one,
+	// and keeps the records of a file that failed to be archived.
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	a.f, a.w = f, f
+	if strings.HasSuffix(a.path, ".gz") {
+		a.gz = gzip.NewWriter(f)
+		a.w = a.gz
+	}
+	return nil
+}
+
+// close ends the compressed stream and syncs the file to disk.
+func (a *resultArchive) close() error {
+	var err error
+	if a.gz != nil {
+		err = a.gz.Close()
+		a.gz = nil
+	}
+	if syncErr := a.f.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := a.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (a *resultArchive) Write(result perf.Stats) error {
+	if !result.Final() && (!a.progress || result.Retrying) {
+		return nil
+	}
+	line, err := marshal(newJSONResult(result))
+	if err != nil {
+		return fmt.Errorf("results_file: %w", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("results_file: %w", err)
+	}
+	// Flushing every record keeps a crash from losing more than the last.
+	if a.gz != nil {
+		if err := a.gz.Flush(); err != nil {
+			return fmt.Errorf("results_file: %w", err)
+		}
+	}
+	info, err := a.f.Stat()
+	if err != nil {
+		return fmt.Errorf("results_file: %w", err)
+	}
+	if a.rotateSize > 0 && info.Size() >= a.rotateSize {
+		if err := a.rotate(); err != nil {
+			return fmt.Errorf("results_file: rotating: %w", err)
+		}
+	}
+	return nil
+}
+
+// OnRollup appends rollups to the archive as lines of their own.
+func (a *resultArchive) OnRollup(rollups []rollup) {
+	lines, err := rollupLines(rollups)
+	if err == nil {
+		a.mu.Lock()
+		_, err = a.w.Write(lines)
+		if err == nil && a.gz != nil {
+			err = a.gz.Flush()
+		}
+		a.mu.Unlock()
+	}
+	if err != nil {
+		slog.Error("results_file: writing rollup", "err", err)
+	}
+}
+
+// rotate archives the current file and starts a new one. When closing or
+// archiving it fails, writes carry on in the current file.
+func (a *resultArchive) rotate() error {
+	if err := a.close(); err != nil {
+		if openErr := a.open(); openErr != nil {
+			return errors.Join(err, openErr)
+		}
+		return err
+	}
+	err := a.archive()
+	if openErr := a.open(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+// archive renames the file at path to its dated name and prunes the
+// archives past keep.
+func (a *resultArchive) archive() error {
+	dir, stem, ext := a.split()
+	stamp := time.Now().UTC()
+	name := filepath.Join(dir, stem+"."+stamp.Format(archiveStamp)+ext)
+	// Never overwrite an archive rotated within the same millisecond.
+	for {
+		if _, err := os.Stat(name); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		stamp = stamp.Add(time.Millisecond)
+		name = filepath.Join(dir, stem+"."+stamp.Format(archiveStamp)+ext)
+	}
+	if err := os.Rename(a.path, name); err != nil {
+		return err
+	}
+	return a.prune()
+}
+
+// split breaks path into its directory, its name up to the first dot and
+// the extensions after it.
+func (a *resultArchive) split() (dir, stem, ext string) {
+	dir, base := filepath.Split(a.path)
+	stem, ext, _ = strings.Cut(base, ".")
+	if ext != "" {
+		ext = "." + ext
+	}
+	return dir, stem, ext
+}
+
+// prune removes the oldest archives until keep are left. Zero keeps all.
+func (a *resultArchive) prune() error {
+	if a.keep <= 0 {
+		return nil
+	}
+	dir, stem, ext := a.split()
+	matches, err := filepath.Glob(filepath.Join(dir, stem+".*"+ext))
+	if err != nil {
+		return err
+	}
+	var archives []string
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), stem+"."), ext)
+		if _, err := time.Parse(archiveStamp, stamp); err == nil {
+			archives = append(archives, m)
+		}
+	}
+	slices.Sort(archives)
+	for len(archives) > a.keep {
+		if err := os.Remove(archives[0]); err != nil {
+			return err
+		}
+		archives = archives[1:]
+	}
+	return nil
+}
+
+func (a *resultArchive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.close()
+}
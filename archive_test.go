@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"yaperf/pkg/perf"
+)
+
+// readArchive returns the records in the files of dir matching pattern,
+// decompressing the .gz ones.
+func readArchive(t *testing.T, dir, pattern string) (records []jsonResult, files int) {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range matches {
+		f, err := os.Open(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = f
+		if strings.HasSuffix(m, ".gz") {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatalf("%s: %v", m, err)
+			}
+			r = gz
+		}
+		lines := bufio.NewScanner(r)
+		for lines.Scan() {
+			var rec jsonResult
+			if err := json.Unmarshal(lines.Bytes(), &rec); err != nil {
+				t.Fatalf("%s: %q: %v", m, lines.Text(), err)
+			}
+			records = append(records, rec)
+		}
+		if err := lines.Err(); err != nil {
+			t.Fatalf("%s: %v", m, err)
+		}
+		f.Close()
+	}
+	return records, len(matches)
+}
+
+func archiveResult(i int) perf.Stats {
+	return perf.Stats{Kind: perf.KindFinal, URL: fmt.Sprintf("https://example.com/%d", i), Direction: perf.Download, Done: true, SizeBytes: int64(i), SpeedMbps: 12.5}
+}
+
+func TestResultArchiveRotation(t *testing.T) {
+	for _, name := range []string{"results.ndjson.gz", "results.ndjson"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, name)
+			a, err := openResultArchive(path, false, 4000, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Writers in parallel never interleave lines, and every record
+			// survives the rotations.
+			const writers, each = 4, 250
+			var wg sync.WaitGroup
+			for w := range writers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range each {
+						if err := a.Write(archiveResult(w*each + i)); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			// Progress is left out unless asked for.
+			a.Write(perf.Stats{URL: "https://example.com/progress", Direction: perf.Download, SizeBytes: 10})
+			if err := a.Close(); err != nil {
+				t.Fatal(err)
+			}
+			records, files := readArchive(t, dir, "results.*")
+			if files < 3 {
+				t.Errorf("%d files, want several rotations", files)
+			}
+			seen := map[int64]bool{}
+			for _, r := range records {
+				if r.URL != fmt.Sprintf("https://example.com/%d", r.SizeBytes) || seen[r.SizeBytes] {
+					t.Errorf("record %+v garbled or repeated", r)
+				}
+				seen[r.SizeBytes] = true
+			}
+			if len(seen) != writers*each {
+				t.Errorf("%d records archived, want %d", len(seen), writers*each)
+			}
+		})
+	}
+}
+
+func TestResultArchiveKeep(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "results.ndjson.gz")
+	// A file left by an earlier run is archived rather than appended to.
+	if err := os.WriteFile(path, gzipped(t, `{"kind":"final","url":"https://example.com/old"}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := openResultArchive(path, true, 1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 200 {
+		if err := a.Write(archiveResult(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Write(perf.Stats{URL: "https://example.com/progress", Direction: perf.Download, SizeBytes: 10})
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Only the newest two archives and the current file are left, and the
+	// records they hold are the latest ones.
+	records, files := readArchive(t, dir, "results.*.ndjson.gz")
+	if files != 2 {
+		t.Errorf("%d archives kept, want 2", files)
+	}
+	current, _ := readArchive(t, dir, "results.ndjson.gz")
+	records = append(records, current...)
+	if len(records) == 0 || records[len(records)-1].URL != "https://example.com/progress" {
+		t.Fatalf("archive ends with %+v, want the progress snapshot", records)
+	}
+	for _, r := range records {
+		if r.URL == "https://example.com/old" || r.URL == "https://example.com/0" {
+			t.Errorf("pruned record %s still archived", r.URL)
+		}
+	}
+}
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var b strings.Builder
+	gz := gzip.NewWriter(&b)
+	io.WriteString(gz, s)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return []byte(b.String())
+}
+
+func TestCheckArchivePath(t *testing.T) {
+	for path, want := range map[string]string{
+		"results.ndjson":     "",
+		"results.ndjson.gz":  "",
+		"results.ndjson.zst": ".zst compression is not supported, use .gz",
+		"results.ndjson.xz":  ".xz compression is not supported, use .gz",
+	} {
+		if got := fmt.Sprint(checkArchivePath(path)); (want == "" && got != "<nil>") || (want != "" && got != want) {
+			t.Errorf("checkArchivePath(%q) = %s, want %q", path, got, want)
+		}
+	}
+	if _, err := openResultArchive(filepath.Join(t.TempDir(), "r.ndjson.zst"), false, 0, 0); err == nil || !strings.HasPrefix(err.Error(), "results_file: ") {
+		t.Errorf("open .zst: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// baselineVersion is the format version written to baseline files. Files
+// of a later version are refused rather than misread.
+const baselineVersion = 1
+
+// exitRegression is the exit code of a run slower than its baseline.
+const exitRegression = 3
+
+// baseline is a run's mean speed and TTFB per URL, kept to compare later
+// runs against.
+type baseline struct {
+	Version    int               `json:"version"`
+	Created    time.Time         `json:"created"`
+	Host       string            `json:"host,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Iterations int               `json:"iterations"`
+	URLs       []baselineURL     `json:"urls"`
+}
+
+type baselineURL struct {
+	URL        string         `json:"url"`
+	Name       string         `json:"name,omitempty"`
+	Direction  perf.Direction `json:"direction"`
+	IP         string         `json:"ip,omitempty"`
+	Family     string         `json:"family,omitempty"`
+	Runs       int            `json:"runs"`
+	MeanMbps   float64        `json:"mean_mbps"`
+	MeanTTFBMs float64        `json:"mean_ttfb_ms"`
+}
+
+func (u baselineURL) key() string {
+	return fmt.Sprintf("%s %s %s %s", u.Direction, u.URL, u.IP, u.Family)
+}
+
+// newBaseline records summaries, leaving out URLs without a completed run.
+func newBaseline(summaries []perf.Summary, labels map[string]string, host string, iterations int) baseline {
+	b := baseline{Version: baselineVersion, Created: time.Now().UTC(), Host: host, Labels: labels, Iterations: iterations}
+	for _, s := range summaries {
+		if s.Runs == 0 {
+			continue
+		}
+		b.URLs = append(b.URLs, baselineURL{
+			URL: s.URL, Name: s.Name, Direction: s.Direction, IP: s.IP, Family: s.Family,
+			Runs: s.Runs, MeanMbps: s.MeanMbps, MeanTTFBMs: s.MeanTTFBMs,
+		})
+	}
+	return b
+}
+
+func writeBaseline(path string, b baseline) error {
+	raw, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeCache(path, append(raw, '\n'))
+}
+
+func readBaseline(path string) (baseline, error) {
+	var b baseline
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return b, err
+	}
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return b, fmt.Errorf("%s: %w", path, err)
+	}
+	if b.Version < 1 || b.Version > baselineVersion {
+		return b, fmt.Errorf("%s: unsupported baseline version %d, want %d", path, b.Version, baselineVersion)
+	}
+	return b, nil
+}
+
+// regression relates a URL's result in this run to its baseline. For
+// latency tests the TTFB is compared, for transfers the speed.
+type regression struct {
+	URL          string         `json:"url"`
+	Name         string         `json:"name,omitempty"`
+	Direction    perf.Direction `json:"direction"`
+	BaselineMbps float64        `json:"baseline_mbps"`
+	SpeedMbps    float64        `json:"speed_mbps"`
+	BaselineTTFB float64        `json:"baseline_ttfb_ms"`
+	TTFBMs       float64        `json:"ttfb_ms"`
+	// ChangePct is how much faster, positive, or slower, negative, the
+	// run was than the baseline.
+	ChangePct float64 `json:"change_pct"`
+	Regressed bool    `json:"regressed"`
+}
+
+// compare relates summaries to b. A URL is regressed when it is more than
+// tolerance percent slower than its baseline, or had no completed run.
+// URLs missing from the baseline are left out.
+func (b baseline) compare(summaries []perf.Summary, tolerance float64) []regression {
+	recorded := map[string]baselineURL{}
+	for _, u := range b.URLs {
+		recorded[u.key()] = u
+	}
+	var out []regression
+	for _, s := range summaries {
+		u, ok := recorded[baselineURL{URL: s.URL, Direction: s.Direction, IP: s.IP, Family: s.Family}.key()]
+		if !ok {
+			continue
+		}
+		r := regression{
+			URL: s.URL, Name: cmp.Or(s.Name, u.Name), Direction: s.Direction,
+			BaselineMbps: u.MeanMbps, SpeedMbps: s.MeanMbps, BaselineTTFB: u.MeanTTFBMs, TTFBMs: s.MeanTTFBMs,
+		}
+		switch {
+		case s.Direction == perf.Latency && u.MeanTTFBMs > 0:
+			r.ChangePct = (u.MeanTTFBMs - s.MeanTTFBMs) / u.MeanTTFBMs * 100
+		case s.Direction != perf.Latency && u.MeanMbps > 0:
+			r.ChangePct = (s.MeanMbps - u.MeanMbps) / u.MeanMbps * 100
+		}
+		r.Regressed = s.Runs == 0 || r.ChangePct < -tolerance
+		out = append(out, r)
+	}
+	return out
+}
+
+func printRegressions(output string, b baseline, regressions []regression, tolerance float64) {
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(struct {
+			Baseline []regression `json:"baseline"`
+		}{regressions}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	}
+
+	fmt.Printf("Compared with baseline of %s (tolerance %g%%)\n", b.Created.Local().Format("2006-01-02 15:04"), tolerance)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  \tURL\tBaseline (Mbps)\tNow (Mbps)\tBaseline TTFB (ms)\tNow TTFB (ms)\tChange")
+	for _, r := range regressions {
+		status := "ok"
+		if r.Regressed {
+			status = "REGRESSED"
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%.2f\t%.2f\t%.1f\t%.1f\t%+.1f%%\n", status, label(perf.Stats{URL: r.URL, Name: r.Name, Direction: r.Direction}),
+			r.BaselineMbps, r.SpeedMbps, r.BaselineTTFB, r.TTFBMs, r.ChangePct)
+	}
+	w.Flush()
+}
+
+// checkBaseline writes current to path when write is set, or else
+// compares summaries with the baseline at path. It returns exitRegression
+// when a URL regressed and status otherwise.
+func checkBaseline(path string, write bool, output string, current baseline, summaries []perf.Summary, tolerance float64, status int) int {
+	if write {
+		if err := writeBaseline(path, current); err != nil {
+			slog.Error("writing baseline", "err", err)
+			return max(status, int(perf.StatusCritical))
+		}
+		slog.Info("baseline written", "path", path, "urls", len(current.URLs))
+		return status
+	}
+	b, err := readBaseline(path)
+	if err != nil {
+		slog.Error("reading baseline", "err", err)
+		return max(status, int(perf.StatusCritical))
+	}
+	tolerance = cmp.Or(tolerance, 10)
+	regressions := b.compare(summaries, tolerance)
+	if len(regressions) == 0 {
+		slog.Warn("no url of the run is in the baseline", "path", path)
+		return status
+	}
+	printRegressions(output, b, regressions, tolerance)
+	for _, r := range regressions {
+		if r.Regressed {
+			return exitRegression
+		}
+	}
+	return status
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func TestBaselineFile(t *testing.T) {
+	summaries := []perf.Summary{
+		{URL: "https://example.com/a", Name: "mirror", Direction: perf.Download, Runs: 3, MeanMbps: 95.5, MeanTTFBMs: 12.5},
+		{URL: "https://example.com/a", Direction: perf.Upload, Runs: 3, MeanMbps: 20},
+		// A URL without a completed run has nothing to compare against.
+		{URL: "https://example.com/b", Direction: perf.Download, Errors: 3},
+	}
+	b := newBaseline(summaries, map[string]string{"site": "lab"}, "edge-1", 3)
+	if len(b.URLs) != 2 || b.Version != baselineVersion || b.Iterations != 3 || b.Host != "edge-1" || b.Labels["site"] != "lab" {
+		t.Fatalf("baseline %+v", b)
+	}
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	if err := writeBaseline(path, b); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readBaseline(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(read) != fmt.Sprint(b) {
+		t.Errorf("read back\n%+v\nwant\n%+v", read, b)
+	}
+
+	for name, body := range map[string]string{
+		"later version": `{"version": 2, "urls": []}`,
+		"no version":    `{"urls": []}`,
+		"not json":      `urls: []`,
+	} {
+		os.WriteFile(path, []byte(body), 0o644)
+		if _, err := readBaseline(path); err == nil || !strings.HasPrefix(err.Error(), path+": ") {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := readBaseline(filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestBaselineCompare(t *testing.T) {
+	b := baseline{Version: 1, URLs: []baselineURL{
+		{URL: "a", Direction: perf.Download, Runs: 1, MeanMbps: 100},
+		{URL: "b", Direction: perf.Download, Runs: 1, MeanMbps: 100},
+		{URL: "c", Direction: perf.Download, Runs: 1, MeanMbps: 100},
+		{URL: "d", Direction: perf.Latency, Runs: 1, MeanTTFBMs: 20},
+		{URL: "e", Direction: perf.Download, Runs: 1, MeanMbps: 100},
+		{URL: "f", Direction: perf.Download, IP: "192.0.2.1", Runs: 1, MeanMbps: 100},
+	}}
+	summaries := []perf.Summary{
+		{URL: "a", Direction: perf.Download, Runs: 1, MeanMbps: 120},
+		{URL: "b", Direction: perf.Download, Runs: 1, MeanMbps: 91},
+		{URL: "c", Direction: perf.Download, Runs: 1, MeanMbps: 89},
+		{URL: "d", Direction: perf.Latency, Runs: 1, MeanTTFBMs: 25},
+		{URL: "e", Direction: perf.Download, Errors: 1},
+		// Not in the baseline: a new URL, or one at another address.
+		{URL: "f", Direction: perf.Download, IP: "192.0.2.2", Runs: 1, MeanMbps: 1},
+		{URL: "g", Direction: perf.Download, Runs: 1, MeanMbps: 1},
+	}
+	var got []string
+	for _, r := range b.compare(summaries, 10) {
+		got = append(got, fmt.Sprintf("%s %+.0f %v", r.URL, r.ChangePct, r.Regressed))
+	}
+	want := "a +20 false, b -9 false, c -11 true, d -25 true, e -100 true"
+	if strings.Join(got, ", ") != want {
+		t.Errorf("compared %s, want %s", strings.Join(got, ", "), want)
+	}
+}
+
+func TestBaselineExit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 10000))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	url := srv.URL + "/a"
+	if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte("regression_tolerance: 20\nurls:\n  - "+url+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "baseline.json")
+	run := func(args ...string) (int, string) {
+		t.Helper()
+		var stdout, stderr strings.Builder
+		cmd := yaperf(dir, args...)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		return exitCode(t, cmd, time.Minute), stdout.String() + stderr.String()
+	}
+
+	if code, out := run("-baseline", path, "-write-baseline"); code != 0 {
+		t.Fatalf("writing: exit code %d\n%s", code, out)
+	}
+	written, err := readBaseline(path)
+	if err != nil || len(written.URLs) != 1 || written.URLs[0].URL != url || written.URLs[0].MeanMbps <= 0 || written.Iterations != 1 {
+		t.Fatalf("wrote %+v, %v", written, err)
+	}
+
+	// Against a far faster baseline the run regressed; against a far slower
+	// one it passed.
+	for _, tt := range []struct {
+		mbps float64
+		code int
+		want string
+	}{
+		{1e6, exitRegression, "REGRESSED"},
+		{0.001, 0, "ok"},
+	} {
+		written.URLs[0].MeanMbps = tt.mbps
+		raw, _ := json.Marshal(written)
+		os.WriteFile(path, raw, 0o644)
+		code, out := run("-baseline", path)
+		if code != tt.code || !strings.Contains(out, "(tolerance 20%)") || !strings.Contains(out, "  "+tt.want+"  "+url) {
+			t.Errorf("baseline of %v Mbps: exit code %d\n%s", tt.mbps, code, out)
+		}
+	}
+
+	if code, out := run("-format", "json", "-baseline", path); code != 0 || !strings.Contains(out, `{"baseline":[{"url":"`+url+`"`) {
+		t.Errorf("json: exit code %d\n%s", code, out)
+	}
+	if code, out := run("-baseline", filepath.Join(dir, "missing.json")); code != int(perf.StatusCritical) || !strings.Contains(out, "reading baseline") {
+		t.Errorf("missing baseline: exit code %d\n%s", code, out)
+	}
+	if code, out := run("-write-baseline"); code != 1 || !strings.Contains(out, "-write-baseline needs a -baseline file") {
+		t.Errorf("-write-baseline alone: exit code %d\n%s", code, out)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// dataBudget counts the bytes transferred each day against data_budget,
+// keeping the count in a state file so restarts carry on with it.
+type dataBudget struct {
+	mu    sync.Mutex
+	limit int64
+	loc   *time.Location
+	path  string
+	now   func() time.Time
+	state budgetState
+	// exhausted is whether the day's budget was found used up, so it is
+	// logged once a day.
+	exhausted bool
+}
+
+// budgetState is the state file: the day counted and the bytes used.
+type budgetState struct {
+	Day  time.Time `json:"day"`
+	Used int64     `json:"used_bytes"`
+}
+
+// openDataBudget reads the count of b's state file, which defaults to
+// budget.json in cacheDir, starting afresh when it is of an earlier day.
+func openDataBudget(b perf.DataBudget, cacheDir string, now time.Time) (*dataBudget, error) {
+	d := &dataBudget{limit: int64(b.PerDay), loc: time.Local, path: b.StateFile, now: time.Now}
+	if b.Timezone == perf.BudgetUTC {
+		d.loc = time.UTC
+	}
+	if d.path == "" {
+		if cacheDir == "" {
+			return nil, errors.New("data_budget needs a state_file when there is no cache directory")
+		}
+		d.path = filepath.Join(cacheDir, "budget.json")
+	}
+	raw, err := os.ReadFile(d.path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("data_budget: %w", err)
+	default:
+		if err := json.Unmarshal(raw, &d.state); err != nil {
+			return nil, fmt.Errorf("data_budget: reading %s: %w", d.path, err)
+		}
+	}
+	d.roll(now)
+	return d, nil
+}
+
+// day is the midnight that starts t's day.
+func (d *dataBudget) day(t time.Time) time.Time {
+	t = t.In(d.loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, d.loc)
+}
+
+// roll starts a new count once now is past the day counted.
+func (d *dataBudget) roll(now time.Time) {
+	if day := d.day(now); !day.Equal(d.state.Day) {
+		if d.state.Used > 0 {
+			slog.Info("new data budget day", "used_yesterday", perf.ByteSize(d.state.Used))
+		}
+		d.state = budgetState{Day: day}
+		d.exhausted = false
+	}
+}
+
+// add counts the bytes of result: final results, aborted ones and failed
+// attempts that are retried, but not the totals of concurrent runs, whose
+// bytes are counted by their transfers.
+func (d *dataBudget) add(result perf.Stats) {
+	if result.URL == perf.TotalURL || !result.Final() && !result.Retrying {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.roll(d.now())
+	d.state.Used += max(result.SizeBytes, result.WireBytes)
+}
+
+// allow reports whether a pass may start at now, logging when the day's
+// budget is first found used up.
+func (d *dataBudget) allow(now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.roll(now)
+	if d.state.Used < d.limit {
+		return true
+	}
+	if !d.exhausted {
+		d.exhausted = true
+		slog.Warn("data budget used up, holding passes until the next day",
+			"used", perf.ByteSize(d.state.Used), "per_day", perf.ByteSize(d.limit),
+			"resumes", d.state.Day.AddDate(0, 0, 1))
+	}
+	return false
+}
+
+// wait holds a pass back until the budget allows one, sleeping until the
+// day counted rolls over while it is used up. It reports false when ctx
+// ends first.
+func (d *dataBudget) wait(ctx context.Context) bool {
+	for !d.allow(d.now()) {
+		d.mu.Lock()
+		next := d.state.Day.AddDate(0, 0, 1)
+		d.mu.Unlock()
+		timer := time.NewTimer(next.Sub(d.now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+	return true
+}
+
+// remaining is how many bytes are left of the day's budget at now.
+func (d *dataBudget) remaining(now time.Time) int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.roll(now)
+	return max(d.limit-d.state.Used, 0)
+}
+
+// save writes the count to the state file.
+func (d *dataBudget) save() {
+	d.mu.Lock()
+	raw, err := json.Marshal(d.state)
+	d.mu.Unlock()
+	if err == nil {
+		err = writeCache(d.path, raw)
+	}
+	if err != nil {
+		slog.Error("saving data budget", "path", d.path, "err", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func newTestBudget(t *testing.T, perDay perf.ByteSize, now time.Time) *dataBudget {
+	t.Helper()
+	b := perf.DataBudget{PerDay: perDay, Timezone: perf.BudgetUTC, StateFile: filepath.Join(t.TempDir(), "budget.json")}
+	d, err := openDataBudget(b, "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.now = func() time.Time { return now }
+	return d
+}
+
+func TestDataBudgetCrossing(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	d := newTestBudget(t, 1000, now)
+	steps := []struct {
+		result perf.Stats
+		allow  bool
+		left   int64
+	}{
+		{perf.Stats{SizeBytes: 400, Done: true}, true, 600},
+		// Progress is counted by the final result it leads to.
+		{perf.Stats{SizeBytes: 300}, true, 600},
+		{perf.Stats{SizeBytes: 200, Retrying: true, Error: context.DeadlineExceeded}, true, 400},
+		{perf.Stats{URL: perf.TotalURL, SizeBytes: 900, Done: true}, true, 400},
+		// Wire bytes count when they are more, as with a compressed body.
+		{perf.Stats{SizeBytes: 100, WireBytes: 399, Done: true}, true, 1},
+		{perf.Stats{SizeBytes: 1, Cancelled: true}, false, 0},
+		{perf.Stats{SizeBytes: 50, Done: true}, false, 0},
+	}
+	for i, step := range steps {
+		d.add(step.result)
+		if got := d.allow(now); got != step.allow {
+			t.Errorf("step %d: allow = %v, want %v", i, got, step.allow)
+		}
+		if got := d.remaining(now); got != step.left {
+			t.Errorf("step %d: remaining = %d, want %d", i, got, step.left)
+		}
+	}
+}
+
+func TestDataBudgetRollover(t *testing.T) {
+	day := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+	d := newTestBudget(t, 1000, day)
+	d.add(perf.Stats{SizeBytes: 1000, Done: true})
+	d.save()
+
+	// A restart the same day carries on with the count.
+	again, err := openDataBudget(perf.DataBudget{PerDay: 1000, Timezone: perf.BudgetUTC, StateFile: d.path}, "", day.Add(30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.allow(day.Add(30 * time.Minute)) {
+		t.Error("budget allowed a pass after a restart on the day it was used up")
+	}
+	// The next day starts afresh, whether or not the process restarted.
+	next := day.Add(time.Hour)
+	if !again.allow(next) || again.remaining(next) != 1000 {
+		t.Errorf("next day: remaining %d, want 1000", again.remaining(next))
+	}
+	reopened, err := openDataBudget(perf.DataBudget{PerDay: 1000, Timezone: perf.BudgetUTC, StateFile: d.path}, "", next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.allow(next) {
+		t.Error("budget of yesterday still held after a restart the next day")
+	}
+}
+
+func TestDataBudgetWait(t *testing.T) {
+	// The clock runs from just before midnight, so the day rolls over
+	// within the test.
+	midnight := time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+	shift := midnight.Add(-100 * time.Millisecond).Sub(time.Now())
+	d := newTestBudget(t, 1000, midnight.Add(-time.Hour))
+	d.now = func() time.Time { return time.Now().Add(shift) }
+	d.add(perf.Stats{SizeBytes: 1000, Done: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if d.wait(ctx) {
+		t.Fatal("wait let a pass start on a used-up budget")
+	}
+	began := time.Now()
+	if !d.wait(context.Background()) {
+		t.Fatal("wait gave up")
+	}
+	if waited := time.Since(began); waited > time.Second {
+		t.Errorf("waited %v for a rollover due in under 100ms", waited)
+	}
+	if d.remaining(d.now()) != 1000 {
+		t.Error("the new day did not start a fresh count")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+
+	"yaperf/pkg/perf"
+)
+
+// runCheck implements "yaperf check": it validates a config and lists every
+// problem without running any tests.
+func runCheck(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	path := flags.String("config", "urls.yaml", "config file to check, or - for stdin")
+	flags.StringVar(&configFormat, "config-format", "", "format of the -config file: yaml, json or toml; by default its extension decides")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: yaperf check [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+	if err := checkConfigFormat(configFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	config, doc, err := loadConfig(*path, nil)
+	var typeErr *yaml.TypeError
+	if err != nil && !errors.As(err, &typeErr) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var bad int
+	if typeErr != nil {
+		// Fields that failed to decode keep their zero value, so the checks
+		// below still run on the rest.
+		for _, e := range typeErr.Errors {
+			fmt.Printf("%s: %s\n", *path, e)
+		}
+		bad += len(typeErr.Errors)
+	}
+	problems := append(config.Problems(), checkConfig(config)...)
+	problems.Locate(doc)
+	slices.SortStableFunc(problems, func(a, b perf.Problem) int { return cmp.Compare(a.Line, b.Line) })
+	for _, p := range problems {
+		fmt.Printf("%s: %v\n", *path, p)
+	}
+	bad += len(problems)
+	if bad > 0 {
+		fmt.Fprintf(os.Stderr, "%d problems found\n", bad)
+		return 1
+	}
+	fmt.Printf("%s: ok\n", *path)
+	if root := mapping(doc); root != nil && keyIndex(root, "defaults") >= 0 {
+		printEffectiveURLs(root)
+	}
+	return 0
+}
+
+// printEffectiveURLs prints the urls of root as they are once defaults
+// are applied, to show which setting each entry ends up with.
+func printEffectiveURLs(root *yaml.Node) {
+	i := keyIndex(root, "urls")
+	if i < 0 {
+		return
+	}
+	fmt.Println("\nurls with defaults applied:")
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(&yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{root.Content[i], root.Content[i+1]}}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	enc.Close()
+}
+
+// checkConfig reports the problems only the command can see: the schedule,
+// the reporters, the table sort, the templates and whether output files
+// can be written.
+func checkConfig(config perf.Config) perf.Problems {
+	var ps perf.Problems
+	if config.Interval >= 0 {
+		if _, err := newSchedule(config.Interval, config.Cron); err != nil {
+			path := "interval"
+			if config.Cron != "" {
+				path = "cron"
+			}
+			ps.Add(path, err)
+		}
+	}
+	if len(config.Reporters) == 0 && len(config.Outputs) == 0 {
+		_, err := newReporters([]string{config.Output}, false, false, false, nil)
+		ps.Add("output", err)
+	}
+	for i, name := range config.Reporters {
+		_, err := newReporters([]string{name}, false, false, false, nil)
+		ps.Add(fmt.Sprintf("reporters[%d]", i), err)
+	}
+	ps.Add("table_sort", checkTableSort(config.TableSort))
+	ps.Add("results_file", checkArchivePath(config.ResultsFile.Path))
+	if config.Template != "" {
+		_, err := parseResultTemplate(config.Template)
+		ps.Add("template", err)
+	}
+	if config.Webhook != nil && config.Webhook.Template != "" {
+		_, err := parseTemplate(config.Webhook.Template)
+		ps.Add("webhook.template", err)
+	}
+	files := []struct{ path, name string }{
+		{"csv_file", config.CSVFile},
+		{"samples_file", config.SamplesFile},
+		{"results_file", config.ResultsFile.Path},
+		{"history_db", config.HistoryDB},
+	}
+	for i, o := range config.Outputs {
+		if o.To != "" && o.To != perf.Stdout && o.To != perf.Stderr {
+			files = append(files, struct{ path, name string }{fmt.Sprintf("outputs[%d].to", i), o.To})
+		}
+	}
+	for _, name := range config.NamedSinks() {
+		def := config.Sinks[name]
+		if def.ResultsFile.Path != "" {
+			ps.Add("sinks."+name+".results_file", checkArchivePath(def.ResultsFile.Path))
+		}
+		if def.Webhook != nil && def.Webhook.Template != "" {
+			_, err := parseTemplate(def.Webhook.Template)
+			ps.Add("sinks."+name+".webhook.template", err)
+		}
+		files = append(files, struct{ path, name string }{"sinks." + name, def.File()})
+	}
+	for _, f := range files {
+		if f.name != "" {
+			ps.Add(f.path, writable(f.name))
+		}
+	}
+	return ps
+}
+
+// writable reports whether name can be opened for writing. A file that does
+// not exist yet is created and removed again.
+func writable(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			defer os.Remove(name)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
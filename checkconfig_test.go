@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckCommand(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer srv.Close()
+	tests := []struct {
+		name   string
+		config string
+		code   int
+		stdout string
+	}{
+		{"ok", "csv_file: out.csv\nurls:\n  - " + srv.URL + "/a\n", 0, "urls.yaml: ok\n"},
+		{"problems", "cron: \"* * *\"\nreporters: [console, xml]\ncsv_file: missing/out.csv\nurls:\n  - " + srv.URL + "/a\n  - url: " + srv.URL + "/b\n    max_duration: 5\n", 1,
+			"urls.yaml: line 1: cron: cron \"* * *\": want 5 fields, got 3\n" +
+				"urls.yaml: line 2: reporters[1]: unknown reporter \"xml\"\n" +
+				"urls.yaml: line 3: csv_file: open missing/out.csv: no such file or directory\n" +
+				"urls.yaml: line 7: urls[1].max_duration: invalid duration `5`, want one with a unit such as 30s or 1m30s\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(tt.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var stdout, stderr strings.Builder
+			cmd := yaperf(dir, "check")
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			if code := exitCode(t, cmd, time.Minute); code != tt.code {
+				t.Errorf("exit code %d, want %d: %s", code, tt.code, stderr.String())
+			}
+			if stdout.String() != tt.stdout {
+				t.Errorf("stdout\n%s\nwant\n%s", stdout.String(), tt.stdout)
+			}
+			// Checking leaves no files behind and downloads nothing.
+			if _, err := os.Stat(filepath.Join(dir, "out.csv")); err == nil {
+				t.Error("check left out.csv behind")
+			}
+		})
+	}
+	if requests.Load() != 0 {
+		t.Errorf("check made %d requests", requests.Load())
+	}
+}
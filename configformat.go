@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config file formats.
+const (
+	formatYAML = "yaml"
+	formatJSON = "json"
+	formatTOML = "toml"
+)
+
+// configFormat is the -config-format flag: the format of the config named
+// by -config, including stdin. Empty goes by the file extension.
+var configFormat string
+
+func checkConfigFormat(format string) error {
+	switch format {
+	case "", formatYAML, formatJSON, formatTOML:
+		return nil
+	}
+	return fmt.Errorf("-config-format must be yaml, json or toml, got %q", format)
+}
+
+// formatOf is the format of the config at path: the -config-format flag
+// for the top-level file, otherwise its extension, with YAML for any
+// other.
+func formatOf(path string, top bool) string {
+	if top && configFormat != "" {
+		return configFormat
+	}
+	if isRemote(path) {
+		if u, err := url.Parse(path); err == nil {
+			path = u.Path
+		}
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return formatJSON
+	case ".toml":
+		return formatTOML
+	}
+	return formatYAML
+}
+
+// parseConfig parses raw in format into a YAML document, so every format
+// goes through the same includes, defaults, decoding and checks.
+func parseConfig(raw []byte, format string) (*yaml.Node, error) {
+	switch format {
+	case formatJSON:
+		// JSON is YAML too, but its own decoder gives the clearer errors.
+		var v any
+		if err := json.Unmarshal(raw, &v); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				line, col := position(raw, syntaxErr.Offset)
+				return nil, fmt.Errorf("line %d, column %d: %w", line, col, err)
+			}
+			return nil, err
+		}
+	case formatTOML:
+		return parseTOML(raw)
+	}
+	doc := new(yaml.Node)
+	if err := yaml.Unmarshal(raw, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// position is the 1-based line and column of offset in raw.
+func position(raw []byte, offset int64) (int, int) {
+	offset = min(max(offset, 0), int64(len(raw)))
+	before := raw[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	return line, len(before) - bytes.LastIndexByte(before, '\n')
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+var csvHeader = []string{"timestamp", "url", "direction", "bytes", "elapsed_seconds", "speed_mbps", "error", "run_id", "host", "labels", "remote_addr", "protocol", "tls_version", "cipher", "alpn", "error_kind", "run_offset_ms"}
+
+// csvLog appends one row per finished transfer. Rows are written under a
+// lock and flushed immediately so concurrent results never interleave.
+type csvLog struct {
+	mu   sync.Mutex
+	name string
+	f    *os.File
+	w    *csv.Writer
+}
+
+func openCSVLog(path string) (*csvLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("csv_file: %w", err)
+	}
+	l, err := newCSVLog("csv_file", f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("csv_file: %w", err)
+	}
+	return l, nil
+}
+
+// newCSVLog logs rows to f for the setting name, starting with the header
+// when f is empty, as stdout is when it is not a file.
+func newCSVLog(name string, f *os.File) (*csvLog, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	l := &csvLog{name: name, f: f, w: csv.NewWriter(f)}
+	if info.Size() == 0 {
+		l.w.Write(csvHeader)
+		l.w.Flush()
+		if err := l.w.Error(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *csvLog) Write(result perf.Stats) error {
+	if !result.Final() {
+		return nil
+	}
+	errText := ""
+	if result.Error != nil {
+		errText = result.Error.Error()
+	}
+	if result.Skipped {
+		errText = "skipped"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write([]string{
+		stampedAt(result).UTC().Format(time.RFC3339),
+		result.URL,
+		string(result.Direction),
+		strconv.FormatInt(result.SizeBytes, 10),
+		strconv.FormatFloat(result.Elapsed.Seconds(), 'f', 3, 64),
+		strconv.FormatFloat(result.SpeedMbps, 'f', 2, 64),
+		errText,
+		result.RunID,
+		result.Host,
+		joinLabels(result.Labels),
+		result.RemoteAddr,
+		result.Protocol,
+		result.TLSVersion,
+		result.Cipher,
+		result.ALPN,
+		string(result.ErrorKind),
+		strconv.FormatFloat(ms(result.RunOffset), 'f', 3, 64),
+	})
+	l.w.Flush()
+	if err := l.w.Error(); err != nil {
+		return fmt.Errorf("%s: %w", l.name, err)
+	}
+	return nil
+}
+
+// joinLabels renders labels as k=v pairs separated by semicolons, sorted by
+// key.
+func joinLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+	return strings.Join(pairs, ";")
+}
+
+func (l *csvLog) Close() error {
+	return l.f.Close()
+}
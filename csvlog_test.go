@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func TestCSVLogAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.csv")
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	final := perf.Stats{
+		URL: "https://mirror.example.com/100MB.bin", Direction: perf.Download, Done: true, Timestamp: at,
+		SizeBytes: 100000000, Elapsed: 8123456789, SpeedMbps: 98.4567, RunID: "run-1", Host: "edge-1",
+		Labels: map[string]string{"site": "lab", "rack": "7"}, RemoteAddr: "192.0.2.1:443", Protocol: "HTTP/2.0",
+		TLSVersion: "TLS 1.3", Cipher: "TLS_AES_128_GCM_SHA256", ALPN: "h2", RunOffset: 1500 * time.Millisecond,
+	}
+	// Commas, quotes and newlines in an error are quoted, not new columns.
+	failed := perf.Stats{URL: "https://upload.example.com/", Direction: perf.Upload, Timestamp: at,
+		Error: errors.New("unexpected status 503: \"busy\",\nretry later"), ErrorKind: perf.ErrorHTTPStatus}
+	skipped := perf.Stats{URL: "https://mirror.example.com/b", Direction: perf.Download, Skipped: true, Timestamp: at}
+	progress := perf.Stats{URL: "https://mirror.example.com/100MB.bin", Direction: perf.Download, SizeBytes: 10, Timestamp: at}
+
+	for _, batch := range [][]perf.Stats{{final, progress}, {failed, skipped}} {
+		l, err := openCSVLog(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range batch {
+			if err := l.Write(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		csvHeader,
+		{"2024-05-01T12:00:00Z", "https://mirror.example.com/100MB.bin", "download", "100000000", "8.123", "98.46", "", "run-1", "edge-1", "rack=7;site=lab", "192.0.2.1:443", "HTTP/2.0", "TLS 1.3", "TLS_AES_128_GCM_SHA256", "h2", "", "1500.000"},
+		{"2024-05-01T12:00:00Z", "https://upload.example.com/", "upload", "0", "0.000", "0.00", "unexpected status 503: \"busy\",\nretry later", "", "", "", "", "", "", "", "", "http_status", "0.000"},
+		{"2024-05-01T12:00:00Z", "https://mirror.example.com/b", "download", "0", "0.000", "0.00", "skipped", "", "", "", "", "", "", "", "", "", "0.000"},
+	}
+	// The header is written once, when the file is new.
+	if fmt.Sprintf("%q", rows) != fmt.Sprintf("%q", want) {
+		t.Errorf("rows\n%q\nwant\n%q", rows, want)
+	}
+	for i, row := range rows {
+		if len(row) != len(csvHeader) {
+			t.Errorf("row %d has %d columns, want %d", i, len(row), len(csvHeader))
+		}
+	}
+}
+
+func TestOpenCSVLogError(t *testing.T) {
+	_, err := openCSVLog(filepath.Join(t.TempDir(), "missing", "results.csv"))
+	if err == nil || !strings.HasPrefix(err.Error(), "csv_file: ") {
+		t.Errorf("err = %v, want a csv_file error", err)
+	}
+}
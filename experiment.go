@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"yaperf/pkg/perf"
+)
+
+// experimentRun runs an experiment's passes and collects the speed of
+// every pass by arm.
+type experimentRun struct {
+	experiment perf.Experiment
+	arms       []string
+	speeds     map[string][]float64
+}
+
+// newExperimentRun schedules the passes of e, in an order that follows
+// seed or else a random one.
+func newExperimentRun(e perf.Experiment, seed *uint64) *experimentRun {
+	s := rand.Uint64()
+	if seed != nil {
+		s = *seed
+	}
+	arms := e.Schedule(s)
+	slog.Debug("experiment schedule", "order", e.Order, "seed", s, "arms", strings.Join(arms, ""))
+	return &experimentRun{experiment: e, arms: arms, speeds: map[string][]float64{}}
+}
+
+// passes is how many passes the experiment takes.
+func (x *experimentRun) passes() int {
+	return len(x.arms)
+}
+
+// targets are the targets of pass, 0-based.
+func (x *experimentRun) targets(pass int) []perf.Target {
+	return x.experiment.Arm(x.arms[pass])
+}
+
+// add records the final results of pass. A pass without a completed
+// transfer has no speed and is left out of the comparison.
+func (x *experimentRun) add(pass int, finals []perf.Stats) {
+	if speed, ok := perf.PassSpeed(finals); ok {
+		arm := x.arms[pass]
+		x.speeds[arm] = append(x.speeds[arm], speed)
+	}
+}
+
+func (x *experimentRun) result() perf.ExperimentResult {
+	return perf.Welch(x.speeds[perf.ArmA], x.speeds[perf.ArmB])
+}
+
+func printExperiment(output string, r perf.ExperimentResult) {
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(struct {
+			Experiment perf.ExperimentResult `json:"experiment"`
+		}{r}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	}
+
+	arms := []perf.ArmSummary{r.A, r.B}
+	u := columnUnit(arms, func(arm perf.ArmSummary) float64 { return arm.MeanMbps })
+	fmt.Printf("Experiment (%s per pass)\n", u)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Arm\tPasses\tMean\tStddev")
+	for _, arm := range arms {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", strings.ToUpper(arm.Arm), arm.Passes, u.number(arm.MeanMbps), u.number(arm.StddevMbps))
+	}
+	w.Flush()
+	verdict := "not significant"
+	if r.Significant {
+		verdict = "significant"
+	}
+	if r.A.Passes < 2 || r.B.Passes < 2 {
+		verdict = "too few passes to tell"
+	}
+	fmt.Printf("B vs A: %+.2f %s (%+.1f%%), Welch t %.2f, df %.1f, p %.3f, %s\n",
+		r.DiffMbps*u.perMbps, u, r.DiffPercent, r.T, r.DF, r.P, verdict)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"cmp"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// flentVersion is the version of flent's data format written.
+const flentVersion = 4
+
+// Series of a flent file, named as in flent's tcp_download, tcp_upload and
+// tcp_bidirectional tests so their plots pick them up. The round trips are
+// yaperf's HTTP probes, under the name flent gives its pings.
+const (
+	flentDownload = "TCP download"
+	flentUpload   = "TCP upload"
+	flentPing     = "Ping (ms) ICMP"
+)
+
+// flentSink keeps the final result of every transfer and, when closed,
+// writes their interval samples and loaded round trips to path as a flent
+// data file, gzipped when path ends in .gz.
+type flentSink struct {
+	path     string
+	meta     flentMeta
+	mu       sync.Mutex
+	results  []perf.Stats
+	finished bool
+}
+
+// flentMeta is what a flent file says about the run beyond its series.
+type flentMeta struct {
+	RunID, Host string
+	// RunStart is the wall time the run offsets of samples count from, and
+	// Step the spacing of the series.
+	RunStart time.Time
+	Step     time.Duration
+}
+
+// openFlentSink checks that path can be written, so a bad path fails at
+// startup.
+func openFlentSink(path string, meta flentMeta) (*flentSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("flent_output: %w", err)
+	}
+	f.Close()
+	return &flentSink{path: path, meta: meta}, nil
+}
+
+func (s *flentSink) Write(result perf.Stats) error {
+	if !result.Final() || result.Skipped || result.URL == perf.TotalURL || result.Direction == perf.Latency {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results = append(s.results, result)
+	return nil
+}
+
+func (s *flentSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return nil
+	}
+	s.finished = true
+	f, err := os.Create(s.path)
+	if err != nil {
+		return fmt.Errorf("flent_output: %w", err)
+	}
+	var out io.Writer = f
+	var gz *gzip.Writer
+	if strings.HasSuffix(s.path, ".gz") {
+		gz = gzip.NewWriter(f)
+		out = gz
+	}
+	err = json.NewEncoder(out).Encode(flentData(s.results, s.meta, filepath.Base(s.path)))
+	if gz != nil {
+		if closeErr := gz.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("flent_output: %w", err)
+	}
+	return nil
+}
+
+// flentDoc is a flent data file.
+type flentDoc struct {
+	Metadata  map[string]any          `json:"metadata"`
+	Version   int                     `json:"version"`
+	XValues   []float64               `json:"x_values"`
+	Results   map[string][]*float64   `json:"results"`
+	RawValues map[string][]flentPoint `json:"raw_values"`
+}
+
+// flentPoint is one raw measurement, at t in Unix seconds.
+type flentPoint struct {
+	T   float64 `json:"t"`
+	Val float64 `json:"val"`
+}
+
+// flentData maps results onto flent's layout: one value per step from the
+// start of the first sample, at the end of the step. The speed series hold
+// the bytes the samples of all transfers moved within the step, each
+// sample's bytes spread evenly over its interval, and the round trip
+// series the mean of those probed in it. A step that no sample or probe
+// falls in is null, as flent leaves gaps in its own series, rather than
+// zero.
+func flentData(results []perf.Stats, meta flentMeta, name string) flentDoc {
+	step := meta.Step
+	if step <= 0 {
+		step = time.Second
+	}
+	first, last := time.Duration(math.MaxInt64), time.Duration(0)
+	type probeKey struct{ at, rtt time.Duration }
+	seen := map[probeKey]bool{}
+	var probes []perf.LatencyProbe
+	directions := map[perf.Direction]bool{}
+	for _, r := range results {
+		for _, sample := range r.Samples {
+			first, last = min(first, sample.RunOffset-sample.Interval), max(last, sample.RunOffset)
+			directions[r.Direction] = true
+		}
+		if b := r.Bufferbloat; b != nil {
+			// Both directions of a bidirectional test carry the same probes.
+			for _, p := range b.LoadedProbes {
+				if key := (probeKey{p.RunOffset, p.RTT}); !seen[key] {
+					seen[key] = true
+					probes = append(probes, p)
+				}
+			}
+		}
+	}
+	slices.SortFunc(probes, func(a, b perf.LatencyProbe) int { return cmp.Compare(a.RunOffset, b.RunOffset) })
+	if first > last {
+		first = 0
+	}
+	n := max(int((last-first+step-1)/step), 1)
+	bin := func(at time.Duration) int {
+		return min(max(int((at-first)/step), 0), n-1)
+	}
+
+	doc := flentDoc{Version: flentVersion, Results: map[string][]*float64{}, RawValues: map[string][]flentPoint{}}
+	doc.XValues = make([]float64, n)
+	for i := range n {
+		doc.XValues[i] = (time.Duration(i+1) * step).Seconds()
+	}
+	series := func(name string) []*float64 {
+		if doc.Results[name] == nil {
+			doc.Results[name] = make([]*float64, n)
+		}
+		return doc.Results[name]
+	}
+	add := func(values []*float64, i int, v float64) {
+		if values[i] == nil {
+			values[i] = new(float64)
+		}
+		*values[i] += v
+	}
+	unix := func(at time.Duration) float64 {
+		return float64(meta.RunStart.Add(at).UnixNano()) / 1e9
+	}
+	for _, r := range results {
+		key := flentDownload
+		if r.Direction == perf.Upload {
+			key = flentUpload
+		}
+		values := series(key)
+		for _, sample := range r.Samples {
+			from, to := sample.RunOffset-sample.Interval-first, sample.RunOffset-first
+			for i := max(int(from/step), 0); i < n && time.Duration(i)*step < to; i++ {
+				overlap := min(to, time.Duration(i+1)*step) - max(from, time.Duration(i)*step)
+				if overlap > 0 {
+					add(values, i, float64(sample.Bytes*8)/1e6*(overlap.Seconds()/sample.Interval.Seconds())/step.Seconds())
+				}
+			}
+			doc.RawValues[key] = append(doc.RawValues[key], flentPoint{unix(sample.RunOffset), sample.Mbps})
+		}
+	}
+	if len(probes) > 0 {
+		values := series(flentPing)
+		counts := make([]int, n)
+		for _, p := range probes {
+			ms := float64(p.RTT) / float64(time.Millisecond)
+			i := bin(p.RunOffset)
+			add(values, i, ms)
+			counts[i]++
+			doc.RawValues[flentPing] = append(doc.RawValues[flentPing], flentPoint{unix(p.RunOffset), ms})
+		}
+		for i, v := range values {
+			if v != nil {
+				*v /= float64(counts[i])
+			}
+		}
+	}
+	for _, key := range []string{flentDownload, flentUpload} {
+		slices.SortFunc(doc.RawValues[key], func(a, b flentPoint) int { return cmp.Compare(a.T, b.T) })
+	}
+
+	test := "tcp_download"
+	switch {
+	case directions[perf.Download] && directions[perf.Upload]:
+		test = "tcp_bidirectional"
+	case directions[perf.Upload]:
+		test = "tcp_upload"
+	}
+	t0 := meta.RunStart.Add(first).UTC()
+	length := (last - first).Seconds()
+	doc.Metadata = map[string]any{
+		"NAME":          test,
+		"TITLE":         "yaperf run " + meta.RunID,
+		"NOTE":          "HTTP transfers and round trips measured by yaperf " + buildVersion(),
+		"TIME":          t0.Format(time.RFC3339Nano),
+		"T0":            t0.Format(time.RFC3339Nano),
+		"STEP_SIZE":     step.Seconds(),
+		"LENGTH":        length,
+		"TOTAL_LENGTH":  length,
+		"HOST":          meta.Host,
+		"HOSTS":         []string{meta.Host},
+		"LOCAL_HOST":    meta.Host,
+		"DATA_FILENAME": name,
+		"RUN_ID":        meta.RunID,
+		"SERIES_META":   map[string]any{},
+	}
+	return doc
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// flentResults is a bidirectional test: a download that stalls for its
+// third second, an upload, and the loaded round trips both carry.
+func flentResults() []perf.Stats {
+	sample := func(offset, interval time.Duration, bytes int64) perf.Sample {
+		return perf.Sample{RunOffset: offset, Interval: interval, Bytes: bytes, Mbps: float64(bytes*8) / 1e6 / interval.Seconds()}
+	}
+	bloat := &perf.Bufferbloat{LoadedProbes: []perf.LatencyProbe{
+		{RunOffset: 1500 * time.Millisecond, RTT: 40 * time.Millisecond},
+		{RunOffset: 1700 * time.Millisecond, RTT: 60 * time.Millisecond},
+		{RunOffset: 3200 * time.Millisecond, RTT: 90 * time.Millisecond},
+	}}
+	return []perf.Stats{
+		{
+			URL: "https://mirror.example.com/100MB.bin", Direction: perf.Download, Done: true, Bufferbloat: bloat,
+			Samples: []perf.Sample{
+				sample(time.Second, time.Second, 12500000),
+				sample(2*time.Second, time.Second, 10000000),
+				// A sample over a step and a half is split between them.
+				sample(4500*time.Millisecond, 1500*time.Millisecond, 7500000),
+			},
+		},
+		{
+			URL: "https://mirror.example.com/", Direction: perf.Upload, Done: true, Bufferbloat: bloat,
+			Samples: []perf.Sample{
+				sample(2500*time.Millisecond, time.Second, 2500000),
+				sample(3500*time.Millisecond, time.Second, 1250000),
+			},
+		},
+	}
+}
+
+func TestFlentGolden(t *testing.T) {
+	meta := flentMeta{RunID: "run-1", Host: "edge-1", RunStart: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Step: time.Second}
+	doc := flentData(flentResults(), meta, "run.flent.gz")
+	doc.Metadata["NOTE"] = strings.ReplaceAll(doc.Metadata["NOTE"].(string), buildVersion(), "VERSION")
+	got, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "flent.golden.json", append(got, '\n'))
+}
+
+func TestFlentData(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []perf.Stats
+		test    string
+		x       int
+	}{
+		{"download", flentResults()[:1], "tcp_download", 5},
+		{"upload", flentResults()[1:], "tcp_upload", 2},
+		{"both", flentResults(), "tcp_bidirectional", 5},
+		{"no samples", []perf.Stats{{URL: "https://mirror.example.com/", Direction: perf.Download, Done: true}}, "tcp_download", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No step set means one second.
+			doc := flentData(tt.results, flentMeta{RunID: "r"}, "run.flent")
+			if doc.Metadata["NAME"] != tt.test || len(doc.XValues) != tt.x || doc.Metadata["STEP_SIZE"] != 1.0 {
+				t.Errorf("%s with %d steps of %v, want %s with %d", doc.Metadata["NAME"], len(doc.XValues), doc.Metadata["STEP_SIZE"], tt.test, tt.x)
+			}
+			for name, values := range doc.Results {
+				if len(values) != len(doc.XValues) {
+					t.Errorf("%s has %d values for %d steps", name, len(values), len(doc.XValues))
+				}
+			}
+		})
+	}
+
+	// The stalled step is a gap, not a zero.
+	doc := flentData(flentResults()[:1], flentMeta{Step: time.Second}, "run.flent")
+	down := doc.Results[flentDownload]
+	if down[2] != nil {
+		t.Errorf("stalled step is %v, want null", *down[2])
+	}
+	if down[0] == nil || *down[0] != 100 {
+		t.Errorf("first step %v, want 100 Mbps", down[0])
+	}
+	// Both directions carry the probes; each is counted once.
+	if n := len(doc.RawValues[flentPing]); n != 3 {
+		t.Errorf("%d raw pings, want 3", n)
+	}
+	if both := flentData(flentResults(), flentMeta{Step: time.Second}, "run.flent"); len(both.RawValues[flentPing]) != 3 {
+		t.Errorf("%d raw pings across directions, want 3", len(both.RawValues[flentPing]))
+	}
+}
+
+func TestFlentSink(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"run.flent.gz", "run.flent"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			s, err := openFlentSink(path, flentMeta{RunID: "r", Step: time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+			results := flentResults()
+			progress := results[0]
+			progress.Done = false
+			skipped := perf.Stats{URL: "https://mirror.example.com/b", Direction: perf.Download, Skipped: true, Samples: results[1].Samples}
+			latency := perf.Stats{URL: "https://mirror.example.com/", Direction: perf.Latency, Done: true}
+			total := perf.Stats{URL: perf.TotalURL, Direction: perf.Download, Done: true, Samples: results[1].Samples}
+			for _, r := range []perf.Stats{progress, results[0], skipped, latency, total} {
+				if err := s.Write(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Close(); err != nil {
+				t.Errorf("second Close: %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasSuffix(name, ".gz") {
+				zr, err := gzip.NewReader(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("not gzipped: %v", err)
+				}
+				var buf bytes.Buffer
+				if _, err := buf.ReadFrom(zr); err != nil {
+					t.Fatal(err)
+				}
+				data = buf.Bytes()
+			}
+			var doc flentDoc
+			if err := json.Unmarshal(data, &doc); err != nil {
+				t.Fatal(err)
+			}
+			if doc.Version != flentVersion || doc.Metadata["NAME"] != "tcp_download" || doc.Metadata["DATA_FILENAME"] != name {
+				t.Errorf("metadata %v", doc.Metadata)
+			}
+			if _, ok := doc.Results[flentUpload]; ok || len(doc.RawValues[flentDownload]) != 3 {
+				t.Errorf("results %v, want the final download alone", doc.Results)
+			}
+		})
+	}
+	if _, err := openFlentSink(filepath.Join(dir, "missing", "run.flent"), flentMeta{}); err == nil {
+		t.Error("opened a flent file in a missing directory")
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+const (
+	// heatmapMaxColumns bounds the columns of a pass heatmap. Past it
+	// neighbouring columns are merged, halving the resolution, as the
+	// sample log of a long transfer does.
+	heatmapMaxColumns = 1024
+	// heatmapMaxRows bounds the rows of a pass heatmap; samples later into
+	// a transfer are left out of it.
+	heatmapMaxRows = 600
+	// heatmapSize is about the width and height of a heatmap image in
+	// pixels.
+	heatmapSize = 800
+)
+
+// heatCell sums the values that fell in one cell of a heatmap.
+type heatCell struct {
+	sum float64
+	n   int
+}
+
+func (c heatCell) mean() float64 {
+	if c.n == 0 {
+		return 0
+	}
+	return c.sum / float64(c.n)
+}
+
+// heatGrid is the heatmap of one URL, as columns of cells indexed by speed
+// row or by offset row. Samples are added to it as they come, so its size
+// never depends on how long the run is.
+type heatGrid struct {
+	file    string
+	columns [][]heatCell
+	// step is how fast a row of a time_of_day heatmap is in bits per
+	// second. transfers counts the transfers in a pass heatmap, and per is
+	// how many of them a column covers.
+	step      float64
+	transfers int
+	per       int
+}
+
+// heatmapSink draws the interval speeds of every URL into a heatmap and
+// writes it to a CSV and a PNG file after each of the URL's transfers, so
+// a soak that is stopped part way still leaves a picture of what it saw.
+type heatmapSink struct {
+	mu       sync.Mutex
+	config   perf.Heatmap
+	capacity perf.LinkCapacity
+	grids    map[string]*heatGrid
+}
+
+// newHeatmapSink creates the heatmap directory of h. Column and Row
+// default to 15m and 1s.
+func newHeatmapSink(h perf.Heatmap, capacity perf.LinkCapacity) (*heatmapSink, error) {
+	if err := os.MkdirAll(h.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("heatmap: %w", err)
+	}
+	if h.Layout == "" {
+		h.Layout = perf.HeatmapTimeOfDay
+	}
+	if h.Column == 0 {
+		h.Column = 15 * time.Minute
+	}
+	if h.Row == 0 {
+		h.Row = time.Second
+	}
+	return &heatmapSink{config: h, capacity: capacity, grids: map[string]*heatGrid{}}, nil
+}
+
+// dayColumns returns the empty columns of a time_of_day heatmap of
+// direction d and how fast each of their rows is in bits per second.
+func (h *heatmapSink) dayColumns(d perf.Direction) ([][]heatCell, float64) {
+	top := float64(h.config.MaxSpeed)
+	if top == 0 {
+		top = float64(h.capacity.For(d))
+	}
+	if top == 0 {
+		top = 1e9
+	}
+	step := float64(h.config.SpeedStep)
+	if step == 0 {
+		step = top / 50
+	}
+	rows := max(1, int(math.Ceil(top/step)))
+	columns := make([][]heatCell, int(24*time.Hour/h.config.Column))
+	for i := range columns {
+		columns[i] = make([]heatCell, rows)
+	}
+	return columns, step
+}
+
+func (h *heatmapSink) Write(result perf.Stats) error {
+	if result.Kind != perf.KindFinal || len(result.Samples) == 0 {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := result.Agent + "\x00" + result.DisplayName() + "\x00" + string(result.Direction)
+	grid := h.grids[key]
+	if grid == nil {
+		name := result.DisplayName() + "_" + string(result.Direction)
+		if result.Agent != "" {
+			name = result.Agent + "_" + name
+		}
+		grid = &heatGrid{file: filepath.Join(h.config.Dir, fileSafe(name)), per: 1}
+		if h.config.Layout == perf.HeatmapTimeOfDay {
+			grid.columns, grid.step = h.dayColumns(result.Direction)
+		}
+		h.grids[key] = grid
+	}
+	if h.config.Layout == perf.HeatmapPass {
+		h.addPass(grid, result.Samples)
+	} else {
+		h.addTimeOfDay(grid, result.Samples)
+	}
+	if err := h.writeGrid(grid); err != nil {
+		return fmt.Errorf("heatmap: %w", err)
+	}
+	return nil
+}
+
+// addTimeOfDay counts each sample in the column of the time of day it
+// was taken at and the row of its speed.
+func (h *heatmapSink) addTimeOfDay(grid *heatGrid, samples []perf.Sample) {
+	for _, s := range samples {
+		at := s.Time.Add(-s.Interval / 2).Local()
+		day := time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute + time.Duration(at.Second())*time.Second
+		col := grid.columns[int(day/h.config.Column)]
+		col[min(int(s.Mbps*1e6/grid.step), len(col)-1)].n++
+	}
+}
+
+// addPass adds the samples of a transfer to the next column, each in the
+// row of how far into the transfer it was taken. A URL is tested once a
+// pass, so its nth transfer is that of pass n.
+func (h *heatmapSink) addPass(grid *heatGrid, samples []perf.Sample) {
+	col := grid.transfers / grid.per
+	grid.transfers++
+	for col >= heatmapMaxColumns {
+		merged := make([][]heatCell, 0, heatmapMaxColumns)
+		for i := 0; i < len(grid.columns); i += 2 {
+			c := grid.columns[i]
+			if i+1 < len(grid.columns) {
+				c = mergeCells(c, grid.columns[i+1])
+			}
+			merged = append(merged, c)
+		}
+		grid.columns, grid.per = merged, grid.per*2
+		col = (grid.transfers - 1) / grid.per
+	}
+	for len(grid.columns) <= col {
+		grid.columns = append(grid.columns, nil)
+	}
+	start := samples[0].Time.Add(-samples[0].Interval)
+	cells := grid.columns[col]
+	for _, s := range samples {
+		row := int(s.Time.Add(-s.Interval/2).Sub(start) / h.config.Row)
+		if row >= heatmapMaxRows {
+			break
+		}
+		for len(cells) <= row {
+			cells = append(cells, heatCell{})
+		}
+		cells[row].sum += s.Mbps
+		cells[row].n++
+	}
+	grid.columns[col] = cells
+}
+
+// mergeCells adds the cells of b to those of a.
+func mergeCells(a, b []heatCell) []heatCell {
+	for len(a) < len(b) {
+		a = append(a, heatCell{})
+	}
+	for i, c := range b {
+		a[i].sum += c.sum
+		a[i].n += c.n
+	}
+	return a
+}
+
+// Close does nothing: every heatmap is written as it changes.
+func (h *heatmapSink) Close() error { return nil }
+
+// value is what a cell shows: its count of samples in a time_of_day
+// heatmap and its mean speed in a pass heatmap.
+func (h *heatmapSink) value(c heatCell) float64 {
+	if h.config.Layout == perf.HeatmapPass {
+		return c.mean()
+	}
+	return float64(c.n)
+}
+
+// writeGrid writes grid as CSV, its top row first, and as a PNG.
+func (h *heatmapSink) writeGrid(grid *heatGrid) error {
+	rows := 0
+	for _, c := range grid.columns {
+		rows = max(rows, len(c))
+	}
+	pass := h.config.Layout == perf.HeatmapPass
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	header := []string{"speed_mbps"}
+	if pass {
+		header[0] = "offset_s"
+	}
+	for i := range grid.columns {
+		switch {
+		case !pass:
+			at := time.Duration(i) * h.config.Column
+			header = append(header, fmt.Sprintf("%02d:%02d", int(at.Hours()), int(at.Minutes())%60))
+		case grid.per == 1:
+			header = append(header, fmt.Sprintf("pass %d", i+1))
+		default:
+			header = append(header, fmt.Sprintf("passes %d-%d", i*grid.per+1, (i+1)*grid.per))
+		}
+	}
+	w.Write(header)
+	for r := range rows {
+		// Speed rows are written fastest first, offset rows earliest first.
+		row := rows - 1 - r
+		first := strconv.FormatFloat(float64(row)*grid.step/1e6, 'f', -1, 64)
+		if pass {
+			row = r
+			first = strconv.FormatFloat((time.Duration(row) * h.config.Row).Seconds(), 'f', -1, 64)
+		}
+		record := []string{first}
+		for _, col := range grid.columns {
+			cell := ""
+			switch {
+			case row >= len(col) || col[row].n == 0:
+			case pass:
+				cell = strconv.FormatFloat(col[row].mean(), 'f', 2, 64)
+			default:
+				cell = strconv.Itoa(col[row].n)
+			}
+			record = append(record, cell)
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	if err := writeCache(grid.file+".csv", buf.Bytes()); err != nil {
+		return err
+	}
+
+	buf.Reset()
+	if err := png.Encode(&buf, h.render(grid, rows)); err != nil {
+		return err
+	}
+	return writeCache(grid.file+".png", buf.Bytes())
+}
+
+// heatRamp are the colors a cell goes through from the lowest value to the
+// highest; a cell without samples is white.
+var heatRamp = []color.RGBA{{255, 255, 204, 255}, {253, 141, 60, 255}, {189, 0, 38, 255}, {64, 0, 32, 255}}
+
+// render draws grid with the same rows as its CSV, scaling every cell to
+// the highest value in the grid.
+func (h *heatmapSink) render(grid *heatGrid, rows int) image.Image {
+	cols := max(len(grid.columns), 1)
+	rows = max(rows, 1)
+	cw, ch := max(1, heatmapSize/cols), max(1, heatmapSize/2/rows)
+	img := image.NewRGBA(image.Rect(0, 0, cols*cw, rows*ch))
+	top := 0.0
+	for _, col := range grid.columns {
+		for _, c := range col {
+			top = max(top, h.value(c))
+		}
+	}
+	pass := h.config.Layout == perf.HeatmapPass
+	for x, col := range grid.columns {
+		for row := range rows {
+			shade := color.RGBA{255, 255, 255, 255}
+			if row < len(col) && col[row].n > 0 && top > 0 {
+				shade = ramp(h.value(col[row]) / top)
+			}
+			y := rows - 1 - row
+			if pass {
+				y = row
+			}
+			for py := y * ch; py < (y+1)*ch; py++ {
+				for px := x * cw; px < (x+1)*cw; px++ {
+					img.SetRGBA(px, py, shade)
+				}
+			}
+		}
+	}
+	return img
+}
+
+// ramp picks the color of v, from 0 to 1, along heatRamp.
+func ramp(v float64) color.RGBA {
+	v = min(max(v, 0), 1) * float64(len(heatRamp)-1)
+	i := min(int(v), len(heatRamp)-2)
+	f := v - float64(i)
+	a, b := heatRamp[i], heatRamp[i+1]
+	mix := func(x, y uint8) uint8 { return uint8(float64(x) + (float64(y)-float64(x))*f) }
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), 255}
+}
+
+// fileSafe turns name into a file name, replacing what may not be in one.
+func fileSafe(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/csv"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// readHeatmap reads the CSV of the heatmap at base and decodes its PNG.
+func readHeatmap(t *testing.T, base string) ([][]string, image.Image) {
+	t.Helper()
+	f, err := os.Open(base + ".csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := os.Open(base + ".png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	img, err := png.Decode(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records, img
+}
+
+// hourOfSamples is a transfer of n one-second samples at mbps taken from
+// the start of hour h of day d.
+func hourOfSamples(d, h, n int, mbps float64) perf.Stats {
+	start := time.Date(2024, 5, 1+d, h, 0, 0, 0, time.Local)
+	s := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/a", Name: "cdn a", Direction: perf.Download, Done: true}
+	for i := range n {
+		s.Samples = append(s.Samples, perf.Sample{Time: start.Add(time.Duration(i+1) * time.Second), Interval: time.Second, Mbps: mbps})
+	}
+	return s
+}
+
+func TestHeatmapTimeOfDay(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "heat")
+	h, err := newHeatmapSink(perf.Heatmap{Dir: dir, Column: time.Hour, SpeedStep: 100e6, MaxSpeed: 1e9}, perf.LinkCapacity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Three days of a link that runs at 900 Mbps overnight and drops to
+	// 150 from 18:00 to 23:00, with a transfer every hour.
+	for d := range 3 {
+		for hour := range 24 {
+			mbps := 900.0
+			if hour >= 18 {
+				mbps = 150
+			}
+			if err := h.Write(hourOfSamples(d, hour, 10, mbps)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Samples past max_speed count in the top row.
+	h.Write(hourOfSamples(0, 3, 1, 1500))
+	// Progress and results without samples draw nothing.
+	progress := hourOfSamples(0, 4, 10, 900)
+	progress.Kind = perf.KindProgress
+	h.Write(progress)
+	h.Write(perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/b", Direction: perf.Download})
+
+	// The grid holds a cell per hour and speed step however many days
+	// fed it.
+	if len(h.grids) != 1 {
+		t.Fatalf("%d grids, want one for the url with samples", len(h.grids))
+	}
+	for _, grid := range h.grids {
+		if len(grid.columns) != 24 || len(grid.columns[0]) != 10 {
+			t.Errorf("grid of %d columns by %d rows, want 24 by 10", len(grid.columns), len(grid.columns[0]))
+		}
+	}
+	records, img := readHeatmap(t, filepath.Join(dir, "cdn_a_download"))
+	if len(records) != 11 || len(records[0]) != 25 || records[0][0] != "speed_mbps" || records[0][1] != "00:00" || records[0][24] != "23:00" {
+		t.Fatalf("CSV of %d records, header %v", len(records), records[0])
+	}
+	// Rows run from the fastest down: 900 Mbps is the first, 100 the
+	// ninth.
+	if records[1][0] != "900" || records[9][0] != "100" || records[10][0] != "0" {
+		t.Errorf("speed rows %v %v %v", records[1][0], records[9][0], records[10][0])
+	}
+	for hour := range 24 {
+		want := map[int]string{1: "30"}
+		if hour >= 18 {
+			want = map[int]string{9: "30"}
+		}
+		if hour == 3 {
+			want[1] = "31"
+		}
+		for row := 1; row <= 10; row++ {
+			if got := records[row][hour+1]; got != want[row] {
+				t.Errorf("%s at %s Mbps: %q samples, want %q", records[0][hour+1], records[row][0], got, want[row])
+			}
+		}
+	}
+
+	// The image has a cell per CSV cell, white where nothing was seen.
+	if b := img.Bounds(); b.Dx() != 24*(heatmapSize/24) || b.Dy() != 10*(heatmapSize/2/10) {
+		t.Errorf("image of %dx%d", b.Dx(), b.Dy())
+	}
+	cw, ch := heatmapSize/24, heatmapSize/2/10
+	at := func(hour, row int) color.RGBA {
+		r, g, b, a := img.At(hour*cw+cw/2, row*ch+ch/2).RGBA()
+		return color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+	}
+	white := color.RGBA{255, 255, 255, 255}
+	if at(2, 0) == white || at(20, 8) == white || at(20, 0) != white || at(2, 8) != white {
+		t.Errorf("cells drawn %v %v %v %v", at(2, 0), at(20, 8), at(20, 0), at(2, 8))
+	}
+	// The busiest cell is the darkest.
+	if at(3, 0) != heatRamp[len(heatRamp)-1] {
+		t.Errorf("busiest cell %v, want %v", at(3, 0), heatRamp[len(heatRamp)-1])
+	}
+}
+
+func TestHeatmapPass(t *testing.T) {
+	dir := t.TempDir()
+	h, err := newHeatmapSink(perf.Heatmap{Dir: dir, Layout: perf.HeatmapPass, Row: time.Second}, perf.LinkCapacity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each pass ramps up over half-second samples, the second pass twice
+	// as fast as the first.
+	for pass, scale := range []float64{1, 2} {
+		s := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/a", Direction: perf.Upload, Agent: "east"}
+		start := time.Now()
+		for i, mbps := range []float64{10, 20, 30, 50, 60} {
+			s.Samples = append(s.Samples, perf.Sample{Time: start.Add(time.Duration(i+1) * 500 * time.Millisecond), Interval: 500 * time.Millisecond, Mbps: mbps * scale})
+		}
+		if err := h.Write(s); err != nil {
+			t.Fatalf("pass %d: %v", pass+1, err)
+		}
+	}
+	records, img := readHeatmap(t, filepath.Join(dir, "east_https___example.com_a_upload"))
+	want := [][]string{
+		{"offset_s", "pass 1", "pass 2"},
+		{"0", "15.00", "30.00"},
+		{"1", "40.00", "80.00"},
+		{"2", "60.00", "120.00"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("CSV %v, want %v", records, want)
+	}
+	for i := range want {
+		for j := range want[i] {
+			if records[i][j] != want[i][j] {
+				t.Errorf("CSV %v, want %v", records, want)
+			}
+		}
+	}
+	if b := img.Bounds(); b.Dx() != 2*(heatmapSize/2) || b.Dy() != 3*(heatmapSize/2/3) {
+		t.Errorf("image of %dx%d", b.Dx(), b.Dy())
+	}
+}
+
+func TestHeatmapPassBounded(t *testing.T) {
+	h, err := newHeatmapSink(perf.Heatmap{Dir: t.TempDir(), Layout: perf.HeatmapPass}, perf.LinkCapacity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	grid := &heatGrid{per: 1}
+	start := time.Now()
+	long := make([]perf.Sample, heatmapMaxRows+100)
+	for i := range long {
+		long[i] = perf.Sample{Time: start.Add(time.Duration(i+1) * time.Second), Interval: time.Second, Mbps: 10}
+	}
+	// A transfer longer than the rows there are is cut short.
+	h.addPass(grid, long)
+	if len(grid.columns[0]) != heatmapMaxRows {
+		t.Errorf("%d rows, want %d", len(grid.columns[0]), heatmapMaxRows)
+	}
+	// Past the columns there are neighbouring passes are merged.
+	for range heatmapMaxColumns {
+		h.addPass(grid, long[:2])
+	}
+	if len(grid.columns) != heatmapMaxColumns/2+1 || grid.per != 2 || grid.transfers != heatmapMaxColumns+1 {
+		t.Fatalf("%d columns of %d passes after %d", len(grid.columns), grid.per, grid.transfers)
+	}
+	if c := grid.columns[0][0]; c.n != 2 || c.mean() != 10 {
+		t.Errorf("merged cell of %d samples at %v", c.n, c.mean())
+	}
+	grid.file = filepath.Join(t.TempDir(), "merged")
+	if err := h.writeGrid(grid); err != nil {
+		t.Fatal(err)
+	}
+	records, _ := readHeatmap(t, grid.file)
+	if header := records[0]; header[1] != "passes 1-2" || header[len(header)-1] != "passes 1025-1026" {
+		t.Errorf("header %v ... %v", header[:2], header[len(header)-1])
+	}
+}
+
+func TestNewHeatmapSink(t *testing.T) {
+	h, err := newHeatmapSink(perf.Heatmap{Dir: filepath.Join(t.TempDir(), "a", "b")}, perf.LinkCapacity{Up: 20e6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.config.Layout != perf.HeatmapTimeOfDay || h.config.Column != 15*time.Minute || h.config.Row != time.Second {
+		t.Errorf("defaults %+v", h.config)
+	}
+	// Speed rows are a fiftieth of the link, or of 1Gbps without one.
+	for _, tt := range []struct {
+		d    perf.Direction
+		cols int
+		step float64
+	}{{perf.Upload, 96, 400e3}, {perf.Download, 96, 20e6}} {
+		cols, step := h.dayColumns(tt.d)
+		if len(cols) != tt.cols || len(cols[0]) != 50 || step != tt.step {
+			t.Errorf("%s: %d columns of %d rows %v bps apart", tt.d, len(cols), len(cols[0]), step)
+		}
+	}
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0o644)
+	if _, err := newHeatmapSink(perf.Heatmap{Dir: filepath.Join(file, "heat")}, perf.LinkCapacity{}); err == nil {
+		t.Error("heatmap dir under a file")
+	}
+	if got := fileSafe("east_https://example.com/a?b=1_download"); got != "east_https___example.com_a_b_1_download" {
+		t.Errorf("fileSafe = %q", got)
+	}
+}
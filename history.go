@@ -0,0 +1,245 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"yaperf/pkg/perf"
+)
+
+// migrations are applied in order; PRAGMA user_version records how many
+// have run.
+var migrations = []string{
+	`CREATE TABLE results (
+		id          INTEGER PRIMARY KEY,
+		run_at      INTEGER NOT NULL,
+		finished_at INTEGER NOT NULL,
+		url         TEXT NOT NULL,
+		direction   TEXT NOT NULL,
+		bytes       INTEGER NOT NULL,
+		elapsed_ms  INTEGER NOT NULL,
+		speed_mbps  REAL NOT NULL,
+		latency_ms  REAL,
+		error       TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX results_url ON results (url, direction, run_at);`,
+	`ALTER TABLE results ADD COLUMN run_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE results ADD COLUMN host TEXT NOT NULL DEFAULT '';
+	ALTER TABLE results ADD COLUMN labels TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE results ADD COLUMN cache_mode TEXT NOT NULL DEFAULT '';`,
+}
+
+// history stores final results in SQLite. Every Write of one process shares
+// its run_at so a run can be compared against the one before it with the
+// same cacheMode.
+type history struct {
+	db        *sql.DB
+	runAt     time.Time
+	cacheMode string
+}
+
+func openHistory(path string) (*history, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("history_db: %w", err)
+	}
+	// A single connection serialises concurrent writers inside the process;
+	// the busy timeout covers other yaperf processes sharing the file.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`PRAGMA busy_timeout = 5000; PRAGMA journal_mode = WAL`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("history_db: %w", err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("history_db: %w", err)
+	}
+	return &history{db: db, runAt: time.Now()}, nil
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *history) Write(result perf.Stats) error {
+	if !result.Final() || result.Cancelled || result.Skipped {
+		return nil
+	}
+	var latency sql.NullFloat64
+	if result.Latency != nil {
+		latency = sql.NullFloat64{Float64: ms(result.Latency.Avg), Valid: true}
+	}
+	errText := ""
+	if result.Error != nil {
+		errText = result.Error.Error()
+	}
+	_, err := h.db.Exec(`INSERT INTO results
+		(run_at, finished_at, url, direction, bytes, elapsed_ms, speed_mbps, latency_ms, error, run_id, host, labels, cache_mode)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		h.runAt.UnixNano(), time.Now().UnixNano(), result.URL, string(result.Direction),
+		result.SizeBytes, result.Elapsed.Milliseconds(), result.SpeedMbps, latency, errText,
+		result.RunID, result.Host, joinLabels(result.Labels), result.CacheMode)
+	if err != nil {
+		return fmt.Errorf("history_db: %w", err)
+	}
+	return nil
+}
+
+func (h *history) Close() error {
+	return h.db.Close()
+}
+
+// comparison relates a URL's mean speed in this run to the previous run.
+type comparison struct {
+	URL          string         `json:"url"`
+	Direction    perf.Direction `json:"direction"`
+	SpeedMbps    float64        `json:"speed_mbps"`
+	PreviousMbps float64        `json:"previous_mbps"`
+	PreviousAt   time.Time      `json:"previous_at"`
+	ChangePct    float64        `json:"change_pct"`
+}
+
+// compare looks up the previous run of every summarised URL. URLs without
+// an earlier successful run are left out.
+func (h *history) compare(summaries []perf.Summary) ([]comparison, error) {
+	var out []comparison
+	for _, s := range summaries {
+		if s.Direction == perf.Latency || s.Runs == 0 {
+			continue
+		}
+		var runAt int64
+		var prev float64
+		err := h.db.QueryRow(`SELECT run_at, AVG(speed_mbps) FROM results
+			WHERE url = ? AND direction = ? AND run_at < ? AND error = '' AND cache_mode = ?
+			GROUP BY run_at ORDER BY run_at DESC LIMIT 1`,
+			s.URL, string(s.Direction), h.runAt.UnixNano(), h.cacheMode).Scan(&runAt, &prev)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("history_db: %w", err)
+		}
+		c := comparison{URL: s.URL, Direction: s.Direction, SpeedMbps: s.MeanMbps, PreviousMbps: prev, PreviousAt: time.Unix(0, runAt)}
+		if prev > 0 {
+			c.ChangePct = (s.MeanMbps - prev) / prev * 100
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+func printComparisons(output string, comparisons []comparison) {
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(struct {
+			Comparison []comparison `json:"comparison"`
+		}{comparisons}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	}
+
+	fmt.Println("Compared with last run")
+	for _, c := range comparisons {
+		arrow := "="
+		switch {
+		case c.ChangePct >= 0.5:
+			arrow = "↑"
+		case c.ChangePct <= -0.5:
+			arrow = "↓"
+		}
+		u := speedUnitFor(max(c.SpeedMbps, c.PreviousMbps))
+		fmt.Printf("  %s %.0f%% vs last run at %s  %s (%s vs %s %s)\n", arrow, math.Abs(c.ChangePct),
+			c.PreviousAt.Format("2006-01-02 15:04"), label(perf.Stats{URL: c.URL, Direction: c.Direction}), u.number(c.SpeedMbps), u.number(c.PreviousMbps), u)
+	}
+}
+
+// runHistory implements "yaperf history [-db path] [-n N] url".
+func runHistory(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	path := fs.String("db", "yaperf.db", "history database")
+	limit := fs.Int("n", 10, "number of results to show")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: yaperf history [flags] url")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if _, err := os.Stat(*path); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	h, err := openHistory(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer h.Close()
+
+	rows, err := h.db.Query(`SELECT finished_at, direction, cache_mode, bytes, elapsed_ms, speed_mbps, latency_ms, error
+		FROM results WHERE url = ? ORDER BY finished_at DESC LIMIT ?`, fs.Arg(0), *limit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Time\tDirection\tCache\tSize (MB)\tTime (s)\tSpeed (Mbps)\tLatency (ms)\tError")
+	for rows.Next() {
+		var finished, bytes, elapsed int64
+		var speed float64
+		var latency sql.NullFloat64
+		var direction, cacheMode, errText string
+		if err := rows.Scan(&finished, &direction, &cacheMode, &bytes, &elapsed, &speed, &latency, &errText); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		lat := ""
+		if latency.Valid {
+			lat = fmt.Sprintf("%.1f", latency.Float64)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.2f\t%.3f\t%.2f\t%s\t%s\n", time.Unix(0, finished).Format(time.DateTime),
+			direction, cmp.Or(cacheMode, "-"), float64(bytes)/1e6, float64(elapsed)/1000, speed, lat, errText)
+	}
+	w.Flush()
+	if err := rows.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
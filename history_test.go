@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func TestHistoryCompare(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "yaperf.db")
+	final := func(url string, mbps float64) perf.Stats {
+		return perf.Stats{URL: url, Direction: perf.Download, Done: true, SizeBytes: 1000, SpeedMbps: mbps, Elapsed: time.Second}
+	}
+	last, err := openHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last.runAt = time.Date(2024, 5, 1, 14, 2, 0, 0, time.UTC)
+	failed := final("https://example.com/a", 0)
+	failed.Error = errors.New("reset")
+	progress := final("https://example.com/a", 1)
+	progress.Done = false
+	for _, r := range []perf.Stats{final("https://example.com/a", 100), final("https://example.com/a", 120), failed, progress} {
+		if err := last.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last.Close()
+
+	// Reopening finds the schema in place.
+	h, err := openHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	var version int
+	if err := h.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil || version != len(migrations) {
+		t.Errorf("user_version %d, err %v, want %d", version, err, len(migrations))
+	}
+	comparisons, err := h.compare([]perf.Summary{
+		{URL: "https://example.com/a", Direction: perf.Download, Runs: 1, MeanMbps: 99},
+		// No earlier run to compare with.
+		{URL: "https://example.com/b", Direction: perf.Download, Runs: 1, MeanMbps: 50},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The failure is left out of the previous mean.
+	if len(comparisons) != 1 {
+		t.Fatalf("comparisons %+v, want one for a", comparisons)
+	}
+	if c := comparisons[0]; c.URL != "https://example.com/a" || c.PreviousMbps != 110 || !c.PreviousAt.Equal(last.runAt) || math.Abs(c.ChangePct+10) > 1e-9 {
+		t.Errorf("comparison %+v, want 99 against 110 at %v, -10%%", c, last.runAt)
+	}
+}
+
+func TestHistoryCacheMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "yaperf.db")
+	// A warm run, then a later cold one.
+	for i, mode := range []string{perf.CacheWarm, perf.CacheCold} {
+		h, err := openHistory(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.runAt = time.Date(2024, 5, 1, 14, i, 0, 0, time.UTC)
+		if err := h.Write(perf.Stats{URL: "https://example.com/a", Direction: perf.Download, Done: true, SpeedMbps: 100 - 60*float64(i), CacheMode: mode}); err != nil {
+			t.Fatal(err)
+		}
+		h.Close()
+	}
+	// Runs compare only with runs in the same mode.
+	for _, tt := range []struct {
+		mode string
+		prev float64
+	}{{perf.CacheWarm, 100}, {perf.CacheCold, 40}, {"", 0}} {
+		h, err := openHistory(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.runAt, h.cacheMode = time.Date(2024, 5, 1, 15, 0, 0, 0, time.UTC), tt.mode
+		comparisons, err := h.compare([]perf.Summary{{URL: "https://example.com/a", Direction: perf.Download, Runs: 1, MeanMbps: 80}})
+		h.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.prev == 0 && len(comparisons) != 0 || tt.prev > 0 && (len(comparisons) != 1 || comparisons[0].PreviousMbps != tt.prev) {
+			t.Errorf("mode %q compared with %+v, want %v", tt.mode, comparisons, tt.prev)
+		}
+	}
+}
+
+func TestHistoryConcurrentWrites(t *testing.T) {
+	h, err := openHistory(filepath.Join(t.TempDir(), "yaperf.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 25 {
+				if err := h.Write(perf.Stats{URL: fmt.Sprintf("https://example.com/%d", i), Direction: perf.Download, Done: true, SpeedMbps: float64(j)}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	var n int
+	if err := h.db.QueryRow(`SELECT COUNT(*) FROM results`).Scan(&n); err != nil || n != 200 {
+		t.Errorf("%d rows, err %v, want 200", n, err)
+	}
+}
+
+func TestHistoryCommand(t *testing.T) {
+	dir := t.TempDir()
+	h, err := openHistory(filepath.Join(dir, "yaperf.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mbps := range []float64{10, 20, 30} {
+		if err := h.Write(perf.Stats{URL: "https://example.com/a", Direction: perf.Download, Done: true, SizeBytes: 2e6, Elapsed: time.Second, SpeedMbps: mbps}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.Write(perf.Stats{URL: "https://example.com/other", Direction: perf.Download, Done: true})
+	h.Close()
+
+	cmd := yaperf(dir, "history", "-n", "2", "https://example.com/a")
+	var stdout strings.Builder
+	cmd.Stdout = &stdout
+	if code := exitCode(t, cmd, time.Minute); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+	// The newest results first, as many as -n asks for.
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "Time") || !strings.Contains(lines[1], "30.00") || !strings.Contains(lines[2], "20.00") {
+		t.Errorf("history printed\n%s", stdout.String())
+	}
+
+	if code := exitCode(t, yaperf(dir, "history", "-db", "missing.db", "https://example.com/a"), time.Minute); code != 1 {
+		t.Errorf("missing database: exit code %d, want 1", code)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// htmlReport keeps the final result of every transfer and, at the end of
+// the run, writes them with the summaries as one self-contained HTML page.
+type htmlReport struct {
+	mu      sync.Mutex
+	f       *os.File
+	results []perf.Stats
+}
+
+// openHTMLReport creates path straight away so a bad path fails at startup.
+func openHTMLReport(path string) (*htmlReport, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("report: %w", err)
+	}
+	return &htmlReport{f: f}, nil
+}
+
+func (r *htmlReport) Write(result perf.Stats) error {
+	if !result.Final() || result.URL == perf.TotalURL {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results = append(r.results, result)
+	return nil
+}
+
+// finish renders the report and closes the file.
+func (r *htmlReport) finish(meta reportMeta, summaries []perf.Summary) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := renderReport(r.f, meta, summaries, r.results)
+	if closeErr := r.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// reportMeta describes the run a report covers.
+type reportMeta struct {
+	RunID, Host string
+	Labels      map[string]string
+	Started     time.Time
+	Finished    time.Time
+}
+
+// reportResult is one transfer as the template shows it.
+type reportResult struct {
+	perf.Stats
+	Label string
+	Chart template.HTML
+}
+
+func renderReport(w io.Writer, meta reportMeta, summaries []perf.Summary, results []perf.Stats) error {
+	rows := make([]reportResult, len(results))
+	for i, result := range results {
+		rows[i] = reportResult{Stats: result, Label: label(result), Chart: chart(result.Samples)}
+	}
+	return reportTemplate.Execute(w, struct {
+		Meta      reportMeta
+		Summaries []perf.Summary
+		Unit      speedUnit
+		Results   []reportResult
+	}{meta, summaries, columnUnit(summaries, func(s perf.Summary) float64 { return s.MaxMbps }), rows})
+}
+
+const chartWidth, chartHeight = 600.0, 120.0
+
+// chart draws samples as an SVG line of Mbps over time, or returns "" when
+// there are fewer than two.
+func chart(samples []perf.Sample) template.HTML {
+	if len(samples) < 2 {
+		return ""
+	}
+	start := samples[0].Time.Add(-samples[0].Interval)
+	span := samples[len(samples)-1].Time.Sub(start).Seconds()
+	peak := 0.0
+	for _, s := range samples {
+		peak = max(peak, s.Mbps)
+	}
+	if span <= 0 || peak <= 0 {
+		return ""
+	}
+	var points strings.Builder
+	for _, s := range samples {
+		x := s.Time.Sub(start).Seconds() / span * chartWidth
+		y := chartHeight - s.Mbps/peak*chartHeight
+		fmt.Fprintf(&points, "%.1f,%.1f ", x, y)
+	}
+	// Every value is a number formatted here, so the markup is safe.
+	return template.HTML(fmt.Sprintf(`<svg viewBox="0 0 %g %g" width="%g" height="%g" role="img" aria-label="speed over time">`+
+		`<polyline fill="none" stroke="#2a6fdb" stroke-width="1.5" points="%s"/>`+
+		`<text x="2" y="10">%s</text><text x="2" y="%g">0</text><text x="%g" y="%g" text-anchor="end">%.0fs</text></svg>`,
+		chartWidth, chartHeight+14, chartWidth, chartHeight+14, strings.TrimSpace(points.String()),
+		showSpeed(peak), chartHeight-2, chartWidth-2, chartHeight+12, span))
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"number":        func(u speedUnit, v float64) string { return u.number(v) },
+	"speed":         showSpeed,
+	"size":          showSize,
+	"time":          func(t time.Time) string { return t.Format(time.RFC3339) },
+	"round":         func(d time.Duration) time.Duration { return d.Round(time.Millisecond) },
+	"summaryLabel":  summaryLabel,
+	"summaryErrors": summaryErrors,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>yaperf report {{.Meta.RunID}}</title>
+<style>
+body { font: 14px/1.4 system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.error { color: #b00020; }
+svg { display: block; background: #f7f9fc; margin: 4px 0 1em; }
+svg text { font-size: 10px; fill: #666; }
+dt { font-weight: bold; float: left; width: 8em; }
+</style>
+</head>
+<body>
+<h1>yaperf report</h1>
+<dl>
+<dt>Run</dt><dd>{{.Meta.RunID}}</dd>
+<dt>Host</dt><dd>{{.Meta.Host}}</dd>
+<dt>Started</dt><dd>{{time .Meta.Started}}</dd>
+<dt>Finished</dt><dd>{{time .Meta.Finished}}</dd>
+{{range $k, $v := .Meta.Labels}}<dt>{{$k}}</dt><dd>{{$v}}</dd>
+{{end}}</dl>
+
+<h2>Summary ({{.Unit}})</h2>
+<table>
+<tr><th>URL</th><th>Runs</th><th>Errors</th><th>Min</th><th>Mean</th><th>Median</th><th>P95</th><th>Max</th><th>Jitter</th></tr>
+{{range .Summaries}}<tr><td>{{summaryLabel .}}</td><td>{{.Runs}}</td><td>{{summaryErrors .}}</td><td>{{number $.Unit .MinMbps}}</td><td>{{number $.Unit .MeanMbps}}</td><td>{{number $.Unit .MedianMbps}}</td><td>{{number $.Unit .P95Mbps}}</td><td>{{number $.Unit .MaxMbps}}</td><td>{{number $.Unit .JitterMbps}}</td></tr>
+{{end}}</table>
+
+<h2>Transfers</h2>
+{{range .Results}}<h3>{{.Label}}</h3>
+{{if .Skipped}}<p>Skipped, {{.SkipReason}}.</p>
+{{else if .Error}}<p class="error">{{.Error}}</p>
+{{else}}<p>{{size .SizeBytes}} in {{round .Elapsed}}, {{speed .SpeedMbps}}</p>
+{{.Chart}}
+{{end}}{{else}}<p>No transfers finished.</p>
+{{end}}</body>
+</html>
+`))
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// wellFormed fails unless every element of an HTML page is closed in
+// order, void elements aside.
+func wellFormed(t *testing.T, page []byte) {
+	t.Helper()
+	d := xml.NewDecoder(bytes.NewReader(page))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	void := map[string]bool{"meta": true, "br": true, "img": true, "link": true}
+	var open []string
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("parsing the report: %v", err)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if !void[tok.Name.Local] {
+				open = append(open, tok.Name.Local)
+			}
+		case xml.EndElement:
+			if len(open) == 0 || open[len(open)-1] != tok.Name.Local {
+				t.Fatalf("</%s> closes %v", tok.Name.Local, open)
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if len(open) > 0 {
+		t.Fatalf("unclosed %v", open)
+	}
+}
+
+func TestRenderReport(t *testing.T) {
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	meta := reportMeta{RunID: "run-1", Host: "edge-1", Labels: map[string]string{"site": "lab"}, Started: started, Finished: started.Add(time.Minute)}
+	summaries := []perf.Summary{
+		{URL: "https://example.com/a", Name: "mirror", Direction: perf.Download, Runs: 2, MinMbps: 40, MeanMbps: 50, MedianMbps: 50, P95Mbps: 59, MaxMbps: 60, JitterMbps: 10},
+		{URL: "https://example.com/b", Direction: perf.Download, Errors: 1},
+	}
+	var samples []perf.Sample
+	for i, mbps := range []float64{40, 60, 50} {
+		samples = append(samples, perf.Sample{Time: started.Add(time.Duration(i+1) * time.Second), Interval: time.Second, Mbps: mbps})
+	}
+	results := []perf.Stats{
+		{URL: "https://example.com/a", Name: "mirror", Direction: perf.Download, Done: true, SizeBytes: 25000000, SpeedMbps: 50, Elapsed: 4 * time.Second, Samples: samples},
+		// Errors keep their place in the report, escaped.
+		{URL: "https://example.com/b", Direction: perf.Download, Done: true, Error: errors.New(`unexpected status 502 <b>"bad gateway"</b>`)},
+		{URL: "https://example.com/c", Direction: perf.Upload, Skipped: true, SkipReason: perf.SkipOutOfTime},
+	}
+	var out bytes.Buffer
+	if err := renderReport(&out, meta, summaries, results); err != nil {
+		t.Fatal(err)
+	}
+	page := out.String()
+	wellFormed(t, out.Bytes())
+	for _, want := range []string{
+		"<title>yaperf report run-1</title>",
+		"<dt>Host</dt><dd>edge-1</dd>",
+		"<dt>Started</dt><dd>2024-05-01T12:00:00Z</dd>",
+		"<dt>site</dt><dd>lab</dd>",
+		"<h2>Summary (Mbps)</h2>",
+		"<tr><td>mirror</td><td>2</td><td>0</td><td>40.00</td><td>50.00</td><td>50.00</td><td>59.00</td><td>60.00</td><td>10.00</td></tr>",
+		"<tr><td>https://example.com/b</td><td>0</td><td>1</td>",
+		"<h3>mirror</h3>\n<p>25.00 MB in 4s, 50.00 Mbps</p>",
+		`<polyline fill="none" stroke="#2a6fdb" stroke-width="1.5" points="200.0,40.0 400.0,0.0 600.0,20.0"/>`,
+		`<text x="598" y="132" text-anchor="end">3s</text>`,
+		`<p class="error">unexpected status 502 &lt;b&gt;&#34;bad gateway&#34;&lt;/b&gt;</p>`,
+		"<h3>https://example.com/c (upload)</h3>\n<p>Skipped, " + string(perf.SkipOutOfTime) + ".</p>",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("report lacks %q", want)
+		}
+	}
+	if strings.Contains(page, "<b>") || strings.Contains(page, "src=") || strings.Contains(page, "href=") {
+		t.Error("report has unescaped markup or external assets")
+	}
+	if strings.Count(page, "<svg") != 1 {
+		t.Errorf("%d charts, want one for the finished download", strings.Count(page, "<svg"))
+	}
+
+	out.Reset()
+	if err := renderReport(&out, meta, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	wellFormed(t, out.Bytes())
+	if !strings.Contains(out.String(), "<p>No transfers finished.</p>") {
+		t.Errorf("empty report:\n%s", out.String())
+	}
+}
+
+func TestChart(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	one := []perf.Sample{{Time: at, Interval: time.Second, Mbps: 10}}
+	if got := chart(one); got != "" {
+		t.Errorf("chart of one sample %q", got)
+	}
+	idle := []perf.Sample{{Time: at, Interval: time.Second}, {Time: at.Add(time.Second), Interval: time.Second}}
+	if got := chart(idle); got != "" {
+		t.Errorf("chart of idle samples %q", got)
+	}
+}
+
+func TestHTMLReportFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.html")
+	r, err := openHTMLReport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only finished transfers are kept, and not the aggregate.
+	for _, s := range []perf.Stats{
+		{URL: "https://example.com/progress", Direction: perf.Download, SizeBytes: 10},
+		{URL: perf.TotalURL, Direction: perf.Download, Done: true},
+		{URL: "https://example.com/final", Direction: perf.Download, Done: true, SizeBytes: 1000000},
+	} {
+		r.Write(s)
+	}
+	if err := r.finish(reportMeta{RunID: "run-2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	page, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(page, []byte("<h3>https://example.com/final</h3>")) || bytes.Contains(page, []byte("progress")) || bytes.Contains(page, []byte(perf.TotalURL)) {
+		t.Errorf("report:\n%s", page)
+	}
+	if _, err := openHTMLReport(filepath.Join(t.TempDir(), "missing", "out.html")); err == nil || !strings.HasPrefix(err.Error(), "report: ") {
+		t.Errorf("bad path: %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envRef matches ${VAR} and ${VAR:-default}.
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv substitutes environment variables into raw. A variable without
+// a default must be set, though it may be empty.
+func expandEnv(raw []byte) ([]byte, error) {
+	var missing []string
+	out := envRef.ReplaceAllFunc(raw, func(ref []byte) []byte {
+		m := envRef.FindSubmatch(ref)
+		if value, ok := os.LookupEnv(string(m[1])); ok && (value != "" || m[2] == nil) {
+			return []byte(value)
+		}
+		if m[2] != nil {
+			return m[3]
+		}
+		if !slices.Contains(missing, string(m[1])) {
+			missing = append(missing, string(m[1]))
+		}
+		return nil
+	})
+	switch len(missing) {
+	case 0:
+		return out, nil
+	case 1:
+		return nil, fmt.Errorf("environment variable %s is not set", missing[0])
+	}
+	return nil, fmt.Errorf("environment variables %s are not set", strings.Join(missing, ", "))
+}
+
+// readConfig reads the config document at path ("-" for stdin, or an
+// http(s) URL), in YAML, JSON or TOML, with its environment variables
+// expanded, its includes merged in and its defaults applied to every url.
+// Included files are resolved relative to the file naming them and may
+// include others in turn; stack holds the files being read to catch
+// cycles.
+func readConfig(path string, stack []string) (*yaml.Node, error) {
+	abs := path
+	if path != "-" && !isRemote(path) {
+		abs, _ = filepath.Abs(path)
+	}
+	if slices.Contains(stack, abs) {
+		return nil, fmt.Errorf("include cycle: %s", strings.Join(append(stack, abs), " -> "))
+	}
+	stack = append(stack, abs)
+
+	var raw []byte
+	var err error
+	switch {
+	case path == "-":
+		raw, err = io.ReadAll(os.Stdin)
+	case isRemote(path):
+		raw, err = configSource.read(path)
+	default:
+		raw, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if raw, err = expandEnv(raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	doc, err := parseConfig(raw, formatOf(path, len(stack) == 1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	root := mapping(doc)
+	if root == nil {
+		return doc, nil
+	}
+	includes, err := takeIncludes(root)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var base *yaml.Node
+	for _, inc := range includes {
+		included, err := readConfig(resolveInclude(path, inc), stack)
+		if err != nil {
+			return nil, err
+		}
+		if m := mapping(included); m != nil {
+			base = merge(base, m, true)
+		}
+	}
+	doc.Content[0] = merge(base, root, true)
+	// Defaults apply once every include is in, so an included file's
+	// defaults reach the urls of the file including it and back. The
+	// sinks of a group go first, so they win over those of the defaults.
+	if len(stack) == 1 {
+		applyGroupSinks(doc.Content[0])
+		if err := applyDefaults(doc.Content[0]); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return doc, nil
+}
+
+// applyDefaults merges the defaults mapping of root into every entry of
+// its urls, the way includes merge: mappings such as headers key by key,
+// and any other value an entry sets replaces the default. The defaults
+// key is left in place for yaperf check to find.
+func applyDefaults(root *yaml.Node) error {
+	i := keyIndex(root, "defaults")
+	if i < 0 {
+		return nil
+	}
+	defaults := root.Content[i+1]
+	if defaults.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: defaults must be a mapping of url settings", defaults.Line)
+	}
+	if j := keyIndex(defaults, "url"); j >= 0 {
+		return fmt.Errorf("line %d: defaults cannot set url", defaults.Content[j].Line)
+	}
+	j := keyIndex(root, "urls")
+	if j < 0 || root.Content[j+1].Kind != yaml.SequenceNode {
+		return nil
+	}
+	urls := root.Content[j+1]
+	for k, entry := range urls.Content {
+		if entry.Kind == yaml.ScalarNode {
+			// A bare URL is shorthand for an entry setting only url.
+			key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "url", Line: entry.Line, Column: entry.Column}
+			entry = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: entry.Line, Column: entry.Column, Content: []*yaml.Node{key, entry}}
+		}
+		if entry.Kind != yaml.MappingNode {
+			continue
+		}
+		merged := merge(defaults, entry, false)
+		// Keep url first, where the entry had it, rather than after the
+		// defaults.
+		if u := keyIndex(merged, "url"); u > 0 {
+			pair := slices.Clone(merged.Content[u : u+2])
+			merged.Content = append(pair, slices.Delete(merged.Content, u, u+2)...)
+		}
+		urls.Content[k] = merged
+	}
+	return nil
+}
+
+// applyGroupSinks gives every entry of the urls of root that sets a group
+// of group_sinks and no sinks of its own the sinks of its group. Entries
+// are left alone when group_sinks is not a mapping of lists, which
+// decoding the config reports.
+func applyGroupSinks(root *yaml.Node) {
+	i, j := keyIndex(root, "group_sinks"), keyIndex(root, "urls")
+	if i < 0 || j < 0 || root.Content[i+1].Kind != yaml.MappingNode || root.Content[j+1].Kind != yaml.SequenceNode {
+		return
+	}
+	groups := root.Content[i+1]
+	for _, entry := range root.Content[j+1].Content {
+		if entry.Kind != yaml.MappingNode || keyIndex(entry, "sinks") >= 0 {
+			continue
+		}
+		g := keyIndex(entry, "group")
+		if g < 0 {
+			continue
+		}
+		if k := keyIndex(groups, entry.Content[g+1].Value); k >= 0 && groups.Content[k+1].Kind == yaml.SequenceNode {
+			key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "sinks", Line: entry.Line, Column: entry.Column}
+			entry.Content = append(entry.Content, key, groups.Content[k+1])
+		}
+	}
+}
+
+// mapping returns the top-level mapping of doc, or nil if it has none.
+func mapping(doc *yaml.Node) *yaml.Node {
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 && doc.Content[0].Kind == yaml.MappingNode {
+		return doc.Content[0]
+	}
+	return nil
+}
+
+// takeIncludes removes the include key from root and returns the files it
+// names: one path or a list of them.
+func takeIncludes(root *yaml.Node) ([]string, error) {
+	if i := keyIndex(root, "include"); i >= 0 {
+		value := root.Content[i+1]
+		root.Content = slices.Delete(root.Content, i, i+2)
+		var files []string
+		if value.Kind == yaml.ScalarNode {
+			files = []string{value.Value}
+		} else if err := value.Decode(&files); err != nil {
+			return nil, errors.New("include must be a path or a list of paths")
+		}
+		return files, nil
+	}
+	return nil, nil
+}
+
+// merge overlays over onto base. Mappings merge key by key with over
+// winning, the top-level urls lists are appended, and any other value in
+// over replaces the one in base.
+func merge(base, over *yaml.Node, top bool) *yaml.Node {
+	if base == nil {
+		return over
+	}
+	if base.Kind != yaml.MappingNode || over.Kind != yaml.MappingNode {
+		return over
+	}
+	merged := *base
+	merged.Content = slices.Clone(base.Content)
+	for i := 0; i+1 < len(over.Content); i += 2 {
+		key, value := over.Content[i], over.Content[i+1]
+		j := keyIndex(&merged, key.Value)
+		if j < 0 {
+			merged.Content = append(merged.Content, key, value)
+			continue
+		}
+		old := merged.Content[j+1]
+		switch {
+		case top && key.Value == "urls" && old.Kind == yaml.SequenceNode && value.Kind == yaml.SequenceNode:
+			urls := *value
+			urls.Content = append(slices.Clone(old.Content), value.Content...)
+			merged.Content[j+1] = &urls
+		default:
+			merged.Content[j+1] = merge(old, value, false)
+		}
+	}
+	return &merged
+}
+
+// keyIndex returns the index of key in mapping m, or -1.
+func keyIndex(m *yaml.Node, key string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
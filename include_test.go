@@ -0,0 +1,284 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"yaperf/pkg/perf"
+)
+
+// writeFiles writes each file of files, by its path under dir, creating
+// directories as needed.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// decodeConfig reads and decodes the config at path.
+func decodeConfig(t *testing.T, path string) perf.Config {
+	t.Helper()
+	doc, err := readConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config perf.Config
+	if err := doc.Decode(&config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("YAPERF_HOST", "cdn.example")
+	t.Setenv("YAPERF_EMPTY", "")
+	tests := []struct {
+		in, want, err string
+	}{
+		{"url: https://${YAPERF_HOST}/f", "url: https://cdn.example/f", ""},
+		{"${YAPERF_HOST}${YAPERF_HOST}", "cdn.examplecdn.example", ""},
+		{"timeout: ${YAPERF_UNSET:-30s}", "timeout: 30s", ""},
+		{"host: ${YAPERF_HOST:-other.example}", "host: cdn.example", ""},
+		// An empty variable takes the default, or stays empty without one.
+		{"token: ${YAPERF_EMPTY:-none}", "token: none", ""},
+		{"token: '${YAPERF_EMPTY}'", "token: ''", ""},
+		{"token: '${YAPERF_UNSET:-}'", "token: ''", ""},
+		{"default: ${YAPERF_UNSET:-a b:c}", "default: a b:c", ""},
+		// Only the braced form is a reference.
+		{"cost: $YAPERF_HOST and $$ and ${not valid}", "cost: $YAPERF_HOST and $$ and ${not valid}", ""},
+		{"url: ${YAPERF_UNSET}", "", "environment variable YAPERF_UNSET is not set"},
+		{"${YAPERF_B} ${YAPERF_A} ${YAPERF_B}", "", "environment variables YAPERF_B, YAPERF_A are not set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := expandEnv([]byte(tt.in))
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || string(got) != tt.want {
+				t.Errorf("expandEnv = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadConfigEnv(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("YAPERF_EDGE", "edge.example")
+	writeFiles(t, dir, map[string]string{
+		"urls.yaml":   "include: shared.yaml\nurls:\n  - https://${YAPERF_EDGE}/a\n",
+		"shared.yaml": "timeout: ${YAPERF_TIMEOUT:-45s}\nlabels:\n  site: ${YAPERF_SITE}\n",
+	})
+	if _, err := readConfig(filepath.Join(dir, "urls.yaml"), nil); err == nil || !strings.Contains(err.Error(), "shared.yaml: environment variable YAPERF_SITE is not set") {
+		t.Fatalf("err = %v, want the included file and variable named", err)
+	}
+	t.Setenv("YAPERF_SITE", "lab")
+	config := decodeConfig(t, filepath.Join(dir, "urls.yaml"))
+	if config.Timeout != 45*time.Second || config.Labels["site"] != "lab" || config.URLs[0].URL != "https://edge.example/a" {
+		t.Errorf("decoded %+v", config)
+	}
+}
+
+func TestReadConfigIncludes(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"urls.yaml": `include: [common/base.yaml, common/site.yaml]
+retries: 4
+labels:
+  site: lab
+urls:
+  - url: https://example.com/own
+`,
+		// Paths are relative to the file that names them.
+		"common/base.yaml": `include: deep/tls.yaml
+timeout: 10s
+retries: 1
+concurrency: 2
+labels:
+  team: net
+  site: base
+urls:
+  - url: https://example.com/base
+`,
+		"common/site.yaml": `timeout: 20s
+labels:
+  rack: "7"
+urls:
+  - url: https://example.com/site
+`,
+		"common/deep/tls.yaml": `timeout: 5s
+connect_timeout: 3s
+`,
+	})
+	config := decodeConfig(t, filepath.Join(dir, "urls.yaml"))
+	// A later include wins over an earlier one, and the file including
+	// them over both; what is set once survives from any depth.
+	if config.Timeout != 20*time.Second || config.Retries != 4 || config.Concurrency != 2 || config.ConnectTimeout != 3*time.Second {
+		t.Errorf("timeout %v, retries %d, concurrency %d, connect_timeout %v", config.Timeout, config.Retries, config.Concurrency, config.ConnectTimeout)
+	}
+	if want := map[string]string{"team": "net", "site": "lab", "rack": "7"}; !maps.Equal(config.Labels, want) {
+		t.Errorf("labels %v, want %v", config.Labels, want)
+	}
+	var urls []string
+	for _, u := range config.URLs {
+		urls = append(urls, u.URL)
+	}
+	if got, want := strings.Join(urls, " "), "https://example.com/base https://example.com/site https://example.com/own"; got != want {
+		t.Errorf("urls %s, want %s", got, want)
+	}
+}
+
+func TestReadConfigIncludeErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.yaml":          "include: sub/b.yaml\n",
+		"sub/b.yaml":      "include: ../a.yaml\n",
+		"self.yaml":       "include: [self.yaml]\n",
+		"twice.yaml":      "include: [leaf.yaml, leaf.yaml]\n",
+		"leaf.yaml":       "retries: 2\n",
+		"bad.yaml":        "include: {a: b}\n",
+		"gone.yaml":       "include: missing.yaml\n",
+		"broken.yaml":     "include: sub/broken.yaml\n",
+		"sub/broken.yaml": "urls: [\n",
+	})
+	a, b := filepath.Join(dir, "a.yaml"), filepath.Join(dir, "sub", "b.yaml")
+	tests := []struct {
+		file, err string
+	}{
+		{"a.yaml", "include cycle: " + a + " -> " + b + " -> " + a},
+		{"self.yaml", "include cycle: " + filepath.Join(dir, "self.yaml") + " -> " + filepath.Join(dir, "self.yaml")},
+		{"bad.yaml", "bad.yaml: include must be a path or a list of paths"},
+		{"gone.yaml", "missing.yaml"},
+		{"broken.yaml", "broken.yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			_, err := readConfig(filepath.Join(dir, tt.file), nil)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+	// Including a file twice is not a cycle.
+	if config := decodeConfig(t, filepath.Join(dir, "twice.yaml")); config.Retries != 2 {
+		t.Errorf("retries %d", config.Retries)
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name     string
+		defaults string
+		entry    string
+		want     perf.Target
+	}{
+		// Scalars: the entry's replaces the default.
+		{"string unset", "{method: PUT}", "{url: u}", perf.Target{URL: "u", Method: "PUT"}},
+		{"string set", "{method: PUT}", "{url: u, method: GET}", perf.Target{URL: "u", Method: "GET"}},
+		{"int", "{streams: 4, probes: 3}", "{url: u, streams: 2}", perf.Target{URL: "u", Streams: 2, Probes: 3}},
+		{"bool", "{cookies: true}", "{url: u}", perf.Target{URL: "u", Cookies: true}},
+		{"size and rate", "{upload_size: 10MB, rate_limit: 50Mbps}", "{url: u, upload_size: 1MB}", perf.Target{URL: "u", UploadSize: 1e6, RateLimit: 50e6}},
+		{"inline thresholds", "{min_speed_mbps: 100, max_bytes: 1MB}", "{url: u, min_speed_mbps: 20}", perf.Target{URL: "u", Thresholds: perf.Thresholds{MinSpeedMbps: 20}, Limits: perf.Limits{MaxBytes: 1e6}}},
+		// Durations.
+		{"duration unset", "{stall_threshold: 5s}", "{url: u}", perf.Target{URL: "u", StallThreshold: 5 * time.Second}},
+		{"duration set", "{stall_threshold: 5s, floor_grace: 2s}", "{url: u, floor_grace: 500ms}", perf.Target{URL: "u", StallThreshold: 5 * time.Second, FloorGrace: 500 * time.Millisecond}},
+		{"inline duration", "{max_duration: 30s}", "{url: u, max_duration: 1m}", perf.Target{URL: "u", Limits: perf.Limits{MaxDuration: time.Minute}}},
+		// Lists replace the default whole.
+		{"list unset", "{sinks: [a, b]}", "{url: u}", perf.Target{URL: "u", Sinks: []string{"a", "b"}}},
+		{"list set", "{sinks: [a, b]}", "{url: u, sinks: [c]}", perf.Target{URL: "u", Sinks: []string{"c"}}},
+		{"list and scalar", "{capture_headers: [Server, Via]}", "{url: u, capture_headers: Age}", perf.Target{URL: "u", CaptureHeaders: perf.HeaderNames{"Age"}}},
+		// Maps merge key by key, the entry winning.
+		{"map unset", "{headers: {A: '1'}}", "{url: u}", perf.Target{URL: "u", Headers: map[string]string{"A": "1"}}},
+		{"map merged", "{headers: {A: '1', B: '2'}}", "{url: u, headers: {B: '3', C: '4'}}", perf.Target{URL: "u", Headers: map[string]string{"A": "1", "B": "3", "C": "4"}}},
+		{"struct merged", "{auth: {type: basic, user: probe, pass: secret}}", "{url: u, auth: {pass: other}}", perf.Target{URL: "u", Auth: &perf.Auth{Type: "basic", User: "probe", Pass: "other"}}},
+		{"empty map", "{headers: {A: '1'}}", "{url: u, headers: {}}", perf.Target{URL: "u", Headers: map[string]string{"A": "1"}}},
+		// An explicit zero, false or null overrides; only leaving it out
+		// takes the default.
+		{"explicit false", "{preflight: true}", "{url: u, preflight: false}", perf.Target{URL: "u", Preflight: &no}},
+		{"unset pointer", "{preflight: true}", "{url: u}", perf.Target{URL: "u", Preflight: &yes}},
+		{"explicit zero", "{streams: 4}", "{url: u, streams: 0}", perf.Target{URL: "u"}},
+		{"explicit empty string", "{method: PUT}", "{url: u, method: ''}", perf.Target{URL: "u"}},
+		{"explicit empty list", "{sinks: [a]}", "{url: u, sinks: []}", perf.Target{URL: "u", Sinks: []string{}}},
+		{"explicit null", "{headers: {A: '1'}}", "{url: u, headers: null}", perf.Target{URL: "u"}},
+		// A bare URL is an entry setting url alone.
+		{"bare url", "{method: PUT, headers: {A: '1'}}", "u", perf.Target{URL: "u", Method: "PUT", Headers: map[string]string{"A": "1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc yaml.Node
+			if err := yaml.Unmarshal([]byte("defaults: "+tt.defaults+"\nurls: ["+tt.entry+"]\n"), &doc); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyDefaults(doc.Content[0]); err != nil {
+				t.Fatal(err)
+			}
+			urls := doc.Content[0].Content[3]
+			if first := urls.Content[0].Content[0].Value; first != "url" {
+				t.Errorf("entry starts with %s, want url", first)
+			}
+			var config perf.Config
+			if err := doc.Decode(&config); err != nil {
+				t.Fatal(err)
+			}
+			if got := config.URLs[0]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merged\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyDefaultsErrors(t *testing.T) {
+	tests := []struct {
+		doc, err string
+	}{
+		{"defaults: [a]\nurls: [u]\n", "line 1: defaults must be a mapping of url settings"},
+		{"defaults:\n  url: https://example.com/\nurls: [u]\n", "line 2: defaults cannot set url"},
+	}
+	for _, tt := range tests {
+		var doc yaml.Node
+		if err := yaml.Unmarshal([]byte(tt.doc), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if err := applyDefaults(doc.Content[0]); err == nil || err.Error() != tt.err {
+			t.Errorf("%q: err = %v, want %q", tt.doc, err, tt.err)
+		}
+	}
+	// Without urls, or with every entry merged, the defaults key stays for
+	// yaperf check.
+	var doc yaml.Node
+	yaml.Unmarshal([]byte("defaults: {streams: 2}\n"), &doc)
+	if err := applyDefaults(doc.Content[0]); err != nil || keyIndex(doc.Content[0], "defaults") < 0 {
+		t.Errorf("err %v, defaults kept %v", err, keyIndex(doc.Content[0], "defaults") >= 0)
+	}
+}
+
+func TestDefaultsReachIncludedURLs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"urls.yaml":   "include: shared.yaml\ndefaults:\n  streams: 3\nurls:\n  - url: https://example.com/own\n    streams: 1\n",
+		"shared.yaml": "defaults:\n  headers: {X-Team: net}\nurls:\n  - https://example.com/shared\n",
+	})
+	config := decodeConfig(t, filepath.Join(dir, "urls.yaml"))
+	shared, own := config.URLs[0], config.URLs[1]
+	if shared.Streams != 3 || shared.Headers["X-Team"] != "net" || own.Streams != 1 || own.Headers["X-Team"] != "net" {
+		t.Errorf("shared %+v, own %+v", shared, own)
+	}
+}
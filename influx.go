@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+var (
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	fieldEscaper       = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// influxSink batches points in line protocol and writes them to the
+// InfluxDB v2 write API from a background goroutine, or hands the batches
+// to outbox when it is set. A batch delivered twice writes the same
+// points, timestamps included, so InfluxDB keeps one of each. Its batches
+// are queued there under name, the key that set it up.
+type influxSink struct {
+	name     string
+	cfg      perf.Influx
+	endpoint string
+	client   *http.Client
+	outbox   *outbox
+
+	mu    sync.Mutex
+	lines [][]byte
+	full  chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newInfluxSink(name string, cfg perf.Influx, box *outbox) (*influxSink, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("influx: invalid url %q", cfg.URL)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("influx: bucket is required")
+	}
+	if cfg.Measurement == "" {
+		cfg.Measurement = "yaperf"
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 10 * time.Second
+	}
+	u = u.JoinPath("api/v2/write")
+	u.RawQuery = url.Values{"org": {cfg.Org}, "bucket": {cfg.Bucket}, "precision": {"ns"}}.Encode()
+
+	s := &influxSink{
+		name:     name,
+		cfg:      cfg,
+		endpoint: u.String(),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		outbox:   box,
+		full:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if box != nil {
+		box.register(name, s.post)
+	}
+	s.wg.Add(1)
+	go s.loop()
+	return s, nil
+}
+
+func (s *influxSink) Write(result perf.Stats) error {
+	if result.Retrying || result.Skipped || (!result.Final() && !s.cfg.EmitProgress && !s.cfg.Intervals) {
+		return nil
+	}
+	line := s.line(result, stampedAt(result))
+
+	s.mu.Lock()
+	s.lines = append(s.lines, line)
+	full := len(s.lines) >= s.cfg.BatchSize
+	s.mu.Unlock()
+	if full {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *influxSink) line(result perf.Stats, now time.Time) []byte {
+	kind, speed := "final", result.SpeedMbps
+	if !result.Final() {
+		kind, speed = "interval", result.IntervalSpeedMbps
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s,url=%s,direction=%s,type=%s", measurementEscaper.Replace(s.cfg.Measurement),
+		tagEscaper.Replace(result.DisplayName()), tagEscaper.Replace(string(result.Direction)), kind)
+	if result.Group != "" {
+		fmt.Fprintf(&b, ",group=%s", tagEscaper.Replace(result.Group))
+	}
+	if result.Host != "" {
+		fmt.Fprintf(&b, ",host=%s", tagEscaper.Replace(result.Host))
+	}
+	if result.RunID != "" {
+		fmt.Fprintf(&b, ",run_id=%s", result.RunID)
+	}
+	for _, k := range slices.Sorted(maps.Keys(result.Labels)) {
+		if v := result.Labels[k]; v != "" {
+			fmt.Fprintf(&b, ",%s=%s", tagEscaper.Replace(k), tagEscaper.Replace(v))
+		}
+	}
+	fmt.Fprintf(&b, " bytes=%di,elapsed_ms=%di,speed_mbps=%s",
+		result.SizeBytes, result.Elapsed.Milliseconds(), strconv.FormatFloat(speed, 'f', -1, 64))
+	if result.Error != nil {
+		fmt.Fprintf(&b, `,error="%s"`, fieldEscaper.Replace(result.Error.Error()))
+	}
+	if g := result.LatencyGrade; g != nil {
+		fmt.Fprintf(&b, `,latency_grade="%s"`, g.Grade)
+	}
+	fmt.Fprintf(&b, " %d\n", now.UnixNano())
+	return b.Bytes()
+}
+
+func (s *influxSink) loop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			s.flush()
+			return
+		case <-ticker.C:
+			s.flush()
+		case <-s.full:
+			s.flush()
+		}
+	}
+}
+
+func (s *influxSink) flush() {
+	s.mu.Lock()
+	lines := s.lines
+	s.lines = nil
+	s.mu.Unlock()
+	if len(lines) == 0 {
+		return
+	}
+	body := bytes.Join(lines, nil)
+	if s.outbox != nil {
+		if err := s.outbox.add(s.name, body); err != nil {
+			slog.Error("influx: dropped points", "points", len(lines), "err", err)
+		}
+		return
+	}
+	if err := s.post("", body); err != nil {
+		slog.Error("influx: dropped points", "points", len(lines), "err", err)
+	}
+}
+
+// post writes body, sending id as its Idempotency-Key when it has one.
+func (s *influxSink) post(id string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.cfg.Token)
+	}
+	if id != "" {
+		req.Header.Set("Idempotency-Key", id)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Close writes any buffered points and stops the background writer.
+func (s *influxSink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return nil
+}
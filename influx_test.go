@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// influxWrite is one request to the write API.
+type influxWrite struct {
+	path, query, auth, contentType string
+	body                           string
+}
+
+// influxStub serves the InfluxDB v2 write API, answering with status, and
+// passes each write on to writes.
+func influxStub(t *testing.T, status int) (*httptest.Server, chan influxWrite) {
+	writes := make(chan influxWrite, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		writes <- influxWrite{r.URL.Path, r.URL.RawQuery, r.Header.Get("Authorization"), r.Header.Get("Content-Type"), string(body)}
+		if status != http.StatusNoContent {
+			http.Error(w, `{"code":"invalid","message":"bad timestamp"}`, status)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, writes
+}
+
+func TestInfluxLineProtocol(t *testing.T) {
+	srv, writes := influxStub(t, http.StatusNoContent)
+	s, err := newInfluxSink("influx", perf.Influx{URL: srv.URL + "/influx/", Token: "secret", Org: "lab ops", Bucket: "perf", Measurement: "link speed", BatchSize: 10, FlushInterval: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Unix(1714564800, 123456789)
+	results := []perf.Stats{
+		{
+			URL: "https://mirror.example.com/100MB.bin", Name: "mirror, eu=1", Group: "cdn", Host: "edge 1", RunID: "run-1",
+			Labels: map[string]string{"site": "lab", "rack": "7", "empty": ""}, Direction: perf.Download, Done: true,
+			SizeBytes: 100000000, Elapsed: 8123 * time.Millisecond, SpeedMbps: 98.5, Timestamp: at,
+			LatencyGrade: &perf.LatencyGrade{Grade: "B"},
+		},
+		{URL: "https://upload.example.com/", Direction: perf.Upload, Error: errors.New(`unexpected status 503: "busy" \o/`), Timestamp: at},
+		// Progress, retries and skips are not written by default.
+		{URL: "https://mirror.example.com/", Direction: perf.Download, SizeBytes: 10, Timestamp: at},
+		{URL: "https://mirror.example.com/", Direction: perf.Download, Retrying: true, Error: errors.New("reset"), Timestamp: at},
+		{URL: "https://mirror.example.com/", Direction: perf.Download, Skipped: true, Timestamp: at},
+	}
+	for _, r := range results {
+		if err := s.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Close flushes the partial batch.
+	s.Close()
+	w := <-writes
+	if w.path != "/influx/api/v2/write" || w.query != "bucket=perf&org=lab+ops&precision=ns" || w.auth != "Token secret" || w.contentType != "text/plain; charset=utf-8" {
+		t.Errorf("wrote to %s?%s with %q, %q", w.path, w.query, w.auth, w.contentType)
+	}
+	want := `link\ speed,url=mirror\,\ eu\=1,direction=download,type=final,group=cdn,host=edge\ 1,run_id=run-1,rack=7,site=lab bytes=100000000i,elapsed_ms=8123i,speed_mbps=98.5,latency_grade="B" 1714564800123456789
+link\ speed,url=https://upload.example.com/,direction=upload,type=final bytes=0i,elapsed_ms=0i,speed_mbps=0,error="unexpected status 503: \"busy\" \\o/" 1714564800123456789
+`
+	if w.body != want {
+		t.Errorf("body\n%s\nwant\n%s", w.body, want)
+	}
+	select {
+	case extra := <-writes:
+		t.Errorf("extra write %q", extra.body)
+	default:
+	}
+}
+
+func TestInfluxBatches(t *testing.T) {
+	srv, writes := influxStub(t, http.StatusNoContent)
+	s, err := newInfluxSink("influx", perf.Influx{URL: srv.URL, Bucket: "perf", EmitProgress: true, BatchSize: 2, FlushInterval: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	progress := perf.Stats{URL: "https://example.com/", Direction: perf.Download, SizeBytes: 10, IntervalSpeedMbps: 42, Timestamp: time.Unix(1, 0)}
+	s.Write(progress)
+	select {
+	case w := <-writes:
+		t.Fatalf("wrote %q before the batch was full", w.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Write(progress)
+	select {
+	case w := <-writes:
+		if w.auth != "" || strings.Count(w.body, "\n") != 2 || !strings.HasPrefix(w.body, "yaperf,url=https://example.com/,direction=download,type=interval bytes=10i,elapsed_ms=0i,speed_mbps=42 1000000000\n") {
+			t.Errorf("batch %q", w.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a full batch was not written")
+	}
+
+	// A batch also goes out once it has waited flush_interval.
+	ticked, writes := influxStub(t, http.StatusNoContent)
+	s2, err := newInfluxSink("influx", perf.Influx{URL: ticked.URL, Bucket: "perf", FlushInterval: 20 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	final := progress
+	final.Done = true
+	s2.Write(final)
+	select {
+	case <-writes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the flush interval did not write the batch")
+	}
+}
+
+func TestInfluxErrors(t *testing.T) {
+	srv, _ := influxStub(t, http.StatusBadRequest)
+	s, err := newInfluxSink("influx", perf.Influx{URL: srv.URL, Bucket: "perf"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.post("id-1", []byte("yaperf bytes=1i 1\n"))
+	if err == nil || err.Error() != `unexpected status 400 Bad Request: {"code":"invalid","message":"bad timestamp"}` {
+		t.Errorf("post = %v", err)
+	}
+
+	for _, cfg := range []perf.Influx{{URL: "not a url", Bucket: "perf"}, {URL: "http://influx:8086"}} {
+		if _, err := newInfluxSink("influx", cfg, nil); err == nil || !strings.HasPrefix(err.Error(), "influx: ") {
+			t.Errorf("%+v: err = %v", cfg, err)
+		}
+	}
+}
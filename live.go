@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// sparkWidth is how many interval samples the live display keeps per line.
+const sparkWidth = 30
+
+var sparkRunes = []rune("▁▂▃▄▅▆▇█")
+
+// liveLine is the progress state of one active transfer.
+type liveLine struct {
+	last    perf.Stats
+	samples []float64
+}
+
+// liveRenderer redraws one line per active transfer in place on w and prints
+// final results above them as they arrive.
+type liveRenderer struct {
+	w     io.Writer
+	final func(perf.Stats)
+	order []seriesKey
+	lines map[seriesKey]*liveLine
+	drawn int
+}
+
+func newLiveRenderer(w io.Writer, final func(perf.Stats)) *liveRenderer {
+	return &liveRenderer{w: w, final: final, lines: make(map[seriesKey]*liveLine)}
+}
+
+func (r *liveRenderer) print(result perf.Stats) {
+	key := seriesKey{result.URL, result.Direction, result.Family, result.Agent}
+	if result.Retrying || result.Final() {
+		r.clear()
+		r.remove(key)
+		r.final(result)
+		r.draw()
+		return
+	}
+	line, ok := r.lines[key]
+	if !ok {
+		line = &liveLine{}
+		r.lines[key] = line
+		r.order = append(r.order, key)
+	}
+	line.last = result
+	line.samples = append(line.samples, result.IntervalSpeedMbps)
+	if len(line.samples) > sparkWidth {
+		line.samples = line.samples[len(line.samples)-sparkWidth:]
+	}
+	r.clear()
+	r.draw()
+}
+
+func (r *liveRenderer) remove(key seriesKey) {
+	if _, ok := r.lines[key]; !ok {
+		return
+	}
+	delete(r.lines, key)
+	for i, k := range r.order {
+		if k == key {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// clear erases the lines drawn last time and leaves the cursor where the
+// first of them started.
+func (r *liveRenderer) clear() {
+	if r.drawn > 0 {
+		fmt.Fprintf(r.w, "\x1b[%dA\x1b[J", r.drawn)
+	}
+	r.drawn = 0
+}
+
+func (r *liveRenderer) draw() {
+	for _, key := range r.order {
+		fmt.Fprintln(r.w, liveStatus(r.lines[key]))
+	}
+	r.drawn = len(r.order)
+}
+
+func liveStatus(line *liveLine) string {
+	s := line.last
+	return fmt.Sprintf("[%s] %11s %14s %s %s%s", label(s), showSize(s.SizeBytes),
+		showSpeed(s.IntervalSpeedMbps), sparkline(line.samples, sparkWidth), clock(s.Elapsed), marks(s))
+}
+
+// sparkline renders samples scaled to their maximum, right-aligned in a
+// field width runes wide.
+func sparkline(samples []float64, width int) string {
+	if len(samples) > width {
+		samples = samples[len(samples)-width:]
+	}
+	peak := 0.0
+	for _, v := range samples {
+		peak = max(peak, v)
+	}
+	out := make([]rune, 0, width)
+	for range width - len(samples) {
+		out = append(out, ' ')
+	}
+	for _, v := range samples {
+		i := 0
+		if peak > 0 {
+			i = int(v / peak * float64(len(sparkRunes)-1))
+		}
+		out = append(out, sparkRunes[max(0, min(i, len(sparkRunes)-1))])
+	}
+	return string(out)
+}
+
+func clock(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%02d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
+
+// isTerminal reports whether f is a character device, which is as close to
+// a TTY check as the standard library gets.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
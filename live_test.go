@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func TestSparkline(t *testing.T) {
+	tests := []struct {
+		samples []float64
+		width   int
+		want    string
+	}{
+		{nil, 4, "    "},
+		{[]float64{0, 0}, 3, " ▁▁"},
+		{[]float64{10}, 3, "  █"},
+		{[]float64{0, 10, 20, 30, 40, 50, 60, 70}, 8, "▁▂▃▄▅▆▇█"},
+		{[]float64{70, 35, 0}, 3, "█▄▁"},
+		// Only the latest samples fit, scaled to their own peak.
+		{[]float64{1000, 10, 20}, 2, "▄█"},
+	}
+	for _, tt := range tests {
+		if got := sparkline(tt.samples, tt.width); got != tt.want {
+			t.Errorf("sparkline(%v, %d) = %q, want %q", tt.samples, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestClock(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "00:00"},
+		{1499 * time.Millisecond, "00:01"},
+		{1500 * time.Millisecond, "00:02"},
+		{59 * time.Second, "00:59"},
+		{61 * time.Second, "01:01"},
+		{100 * time.Minute, "100:00"},
+	}
+	for _, tt := range tests {
+		if got := clock(tt.d); got != tt.want {
+			t.Errorf("clock(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestLiveRenderer(t *testing.T) {
+	var out bytes.Buffer
+	var finals []string
+	r := newLiveRenderer(&out, func(s perf.Stats) {
+		finals = append(finals, s.URL)
+		out.WriteString("final " + s.URL + "\n")
+	})
+	progress := func(url string, mbps float64) perf.Stats {
+		return perf.Stats{URL: url, Direction: perf.Download, SizeBytes: 5000000, IntervalSpeedMbps: mbps, Elapsed: 3 * time.Second}
+	}
+
+	r.print(progress("https://example.com/a", 80))
+	if got := out.String(); strings.Contains(got, "\x1b[") || strings.Count(got, "\n") != 1 || !strings.HasPrefix(got, "[https://example.com/a]") {
+		t.Errorf("first draw %q", got)
+	}
+	if line := out.String(); !strings.Contains(line, "5.00 MB") || !strings.Contains(line, "80.00 Mbps") || !strings.Contains(line, "█ 00:03") {
+		t.Errorf("status line %q", line)
+	}
+
+	// Each update moves up over the lines drawn and redraws them all.
+	out.Reset()
+	r.print(progress("https://example.com/b", 40))
+	if got := out.String(); !strings.HasPrefix(got, "\x1b[1A\x1b[J") || strings.Count(got, "\n") != 2 {
+		t.Errorf("second draw %q", got)
+	}
+	out.Reset()
+	r.print(progress("https://example.com/a", 40))
+	lines := strings.Split(strings.TrimPrefix(out.String(), "\x1b[2A\x1b[J"), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "[https://example.com/a]") || !strings.Contains(lines[0], "█▄ 00:03") || !strings.HasPrefix(lines[1], "[https://example.com/b]") {
+		t.Errorf("redraw %q", out.String())
+	}
+
+	// A final result prints above the lines of the transfers still going.
+	out.Reset()
+	done := progress("https://example.com/a", 0)
+	done.Done = true
+	r.print(done)
+	if got := out.String(); !strings.HasPrefix(got, "\x1b[2A\x1b[Jfinal https://example.com/a\n[https://example.com/b]") || strings.Count(got, "\n") != 2 {
+		t.Errorf("final draw %q", got)
+	}
+	if len(r.order) != 1 || len(r.lines) != 1 {
+		t.Errorf("%d lines left, want b alone", len(r.order))
+	}
+
+	// A retry ends the line too, and the next attempt starts a fresh one.
+	out.Reset()
+	retry := progress("https://example.com/b", 0)
+	retry.Retrying = true
+	r.print(retry)
+	if got := out.String(); got != "\x1b[1A\x1b[Jfinal https://example.com/b\n" || r.drawn != 0 {
+		t.Errorf("retry draw %q", got)
+	}
+	for range sparkWidth + 5 {
+		r.print(progress("https://example.com/b", 10))
+	}
+	if n := len(r.lines[r.order[0]].samples); n != sparkWidth {
+		t.Errorf("kept %d samples, want %d", n, sparkWidth)
+	}
+	if len(finals) != 2 {
+		t.Errorf("finals %v", finals)
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if isTerminal(f) {
+		t.Error("a regular file is a terminal")
+	}
+}
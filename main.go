@@ -2,128 +2,868 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"yaperf/pkg/perf"
 )
 
-type Config struct {
-	URLs []string `yaml:"urls"`
+// shutdownGrace is how long an interrupted run may take to wind down.
+const shutdownGrace = 10 * time.Second
+
+// fatal logs err and exits. Errors pass every log level.
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
 }
 
-type Stats struct {
-	URL       string
-	SizeBytes int64
-	Elapsed   time.Duration
-	SpeedMBps float64
-	SpeedMbps float64
-	Error     error
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "history":
+			os.Exit(runHistory(os.Args[2:]))
+		case "check":
+			os.Exit(runCheck(os.Args[2:]))
+		case "serve-payload":
+			os.Exit(runPayload(os.Args[2:]))
+		case "selftest":
+			os.Exit(runSelftest(os.Args[2:]))
+		case "replay":
+			os.Exit(run(os.Args[2:], true))
+		}
+	}
+	os.Exit(run(os.Args[1:], false))
 }
 
-func downloadAndMeasure(ctx context.Context, url string) <-chan Stats {
-	ch := make(chan Stats)
+// labelFlags collects repeated -label key=value flags.
+type labelFlags map[string]string
 
-	go func() {
-		defer close(ch)
+func (l labelFlags) String() string { return "" }
 
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		client := &http.Client{Transport: tr}
-		resp, err := client.Get(url)
-		if err != nil {
-			ch <- Stats{URL: url, Error: err}
-			return
+func (l labelFlags) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("want key=value, got %q", value)
+	}
+	l[key] = val
+	return nil
+}
+
+// profileFlags collects repeated -profile flags.
+type profileFlags []string
+
+func (p *profileFlags) String() string { return strings.Join(*p, ",") }
+
+func (p *profileFlags) Set(value string) error {
+	if value == "" {
+		return errors.New("want a profile name")
+	}
+	*p = append(*p, value)
+	return nil
+}
+
+// loadConfig reads the config at path ("-" for stdin). URLs given as args
+// replace those in the config; without an explicit -config they are tested
+// with the defaults and no file is read. The parsed document is returned
+// for locating problems, or nil when there is none.
+func loadConfig(path string, args []string) (perf.Config, *yaml.Node, error) {
+	var config perf.Config
+	var doc *yaml.Node
+	if len(args) == 0 || isSet("config") {
+		var err error
+		if doc, err = readConfig(path, nil); err != nil {
+			return config, nil, err
 		}
-		defer resp.Body.Close()
-
-		var downloaded int64
-		start := time.Now()
-		buf := make([]byte, 32*1024)
-		ticker := time.NewTicker(1 * time.Second)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ctx.Done():
-				log.Printf("Download took %v \n", time.Since(start))
-				return
-			case <-ticker.C:
-				elapsed := time.Since(start)
-				ch <- Stats{
-					URL:       url,
-					SizeBytes: downloaded,
-					Elapsed:   elapsed,
-					SpeedMBps: float64(downloaded) / 1e6 / elapsed.Seconds(),
-					SpeedMbps: float64(downloaded*8) / 1e6 / elapsed.Seconds(),
-				}
-			default:
-				n, err := resp.Body.Read(buf)
-				if n > 0 {
-					downloaded += int64(n)
-				}
-				if err == io.EOF {
-					elapsed := time.Since(start)
-					ch <- Stats{
-						URL:       url,
-						SizeBytes: downloaded,
-						Elapsed:   elapsed,
-						SpeedMBps: float64(downloaded) / 1e6 / elapsed.Seconds(),
-						SpeedMbps: float64(downloaded*8) / 1e6 / elapsed.Seconds(),
-					}
-					return
-				}
-				if err != nil {
-					ch <- Stats{URL: url, Error: err}
-					return
-				}
+		if err := doc.Decode(&config); err != nil {
+			var typeErr *yaml.TypeError
+			if errors.As(err, &typeErr) {
+				perf.NameFields(doc, typeErr)
 			}
+			return config, doc, fmt.Errorf("%s: %w", path, err)
 		}
-	}()
+	}
+	if len(args) > 0 {
+		config.URLs = nil
+		for _, arg := range args {
+			config.URLs = append(config.URLs, perf.Target{URL: arg})
+		}
+	}
+	return config, doc, nil
+}
 
-	return ch
+// isSet reports whether the flag called name was given on the command line.
+func isSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
 }
 
-func main() {
-	raw, err := os.ReadFile("urls.yaml")
+// run tests the urls of the config or args, or with replaying set plays
+// back the results recorded in the files args names.
+func run(args []string, replaying bool) (code int) {
+	configPath := flag.String("config", "urls.yaml", "config file to read, - for stdin, or an http(s) URL to fetch it from")
+	flag.StringVar(&configFormat, "config-format", "", "format of the -config file: yaml, json or toml; by default its extension decides")
+	flag.StringVar(&configSource.header, "config-header", "", `header sent when fetching a remote config, as "Name: value"`)
+	flag.DurationVar(&configSource.timeout, "config-timeout", configSource.timeout, "timeout for fetching a remote config")
+	flag.StringVar(&configSource.cacheDir, "config-cache", defaultCacheDir(), "directory keeping the last good copy of a remote config and the speedtest server list; empty disables it")
+	format := flag.String("format", "", "output format: text or json (overrides output, reporters and outputs in the config)")
+	formatTemplate := flag.String("format-template", "", "print each result through this Go template, or the built-in short or tsv (overrides template in the config)")
+	once := flag.Bool("once", false, "run a single pass and exit (overrides iterations in the config)")
+	noProgress := flag.Bool("no-progress", false, "print progress as plain lines instead of updating it in place")
+	noTrend := flag.Bool("no-trend", false, "leave out the speed trend in continuous runs")
+	verbose := flag.Bool("v", false, "log debug detail (overrides log_level in the config)")
+	quiet := flag.Bool("q", false, "print only errors and the summary (overrides log_level in the config)")
+	flag.BoolVar(&showURLs, "show-urls", false, "print raw URLs instead of target names")
+	reportPath := flag.String("report", "", "write an HTML report of the run to this file at the end")
+	tui := flag.Bool("tui", false, "show a full-screen dashboard of the run in place of printed results")
+	baselinePath := flag.String("baseline", "", "compare the run with this baseline file and exit 3 when a URL is slower than regression_tolerance allows")
+	saveBaseline := flag.Bool("write-baseline", false, "write the run's results to the -baseline file instead of comparing with it")
+	labels := labelFlags{}
+	flag.Var(labels, "label", "attach key=value to every result; repeatable (overrides labels in the config)")
+	var profiles profileFlags
+	flag.Var(&profiles, "profile", "test only the urls of this profile in the config; repeatable, testing the urls of all of them")
+	quick := flag.Bool("quick", false, "run one short pass against built-in public test files instead of the config ("+quickURLsEnv+" replaces them)")
+	flag.Usage = func() {
+		if replaying {
+			fmt.Fprintf(flag.CommandLine.Output(), "usage: %s replay [flags] results.ndjson [samples.ndjson ...]\n", os.Args[0])
+		} else {
+			fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [url ...]\n", os.Args[0])
+		}
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
+	args = flag.Args()
+
+	// Logs and progress go to stderr so stdout carries only results.
+	level := new(slog.LevelVar)
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(handler))
+	notify := newNotifier()
+	defer notify.stopping()
+
+	// A replay reads the files given as args in place of testing urls.
+	var replay *replaySource
+	if replaying {
+		if len(args) == 0 {
+			flag.Usage()
+			return 2
+		}
+		if *quick {
+			fatal(errors.New("-quick tests built-in urls and cannot be used with replay"))
+		}
+		var err error
+		if replay, err = openReplay(args); err != nil {
+			fatal(err)
+		}
+		args = nil
+	}
+	if *saveBaseline && *baselinePath == "" {
+		fatal(errors.New("-write-baseline needs a -baseline file"))
+	}
+	if len(profiles) > 0 && len(args) > 0 {
+		fatal(errors.New("-profile picks from the urls in the config and cannot be used with urls given as arguments"))
+	}
+	if *quick && (len(args) > 0 || len(profiles) > 0) {
+		fatal(errors.New("-quick tests built-in urls and cannot be used with urls given as arguments or -profile"))
+	}
+	if err := checkConfigFormat(configFormat); err != nil {
+		fatal(err)
+	}
+	// Without a config or urls to test, yaperf falls back to -quick rather
+	// than failing, and a replay to the defaults.
+	noConfig := false
+	if !*quick && len(args) == 0 && !isSet("config") {
+		if _, err := os.Stat(*configPath); errors.Is(err, fs.ErrNotExist) && replay != nil {
+			noConfig = true
+		} else if errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("no " + *configPath + " found, running a quick test against built-in public urls; give urls or -config to test your own")
+			*quick = true
+		}
+	}
+	var config perf.Config
+	var doc *yaml.Node
+	var err error
+	if *quick {
+		config = quickConfig()
+		slog.Info("quick mode, testing built-in urls", "urls", targetNames(config.URLs))
+	} else if noConfig {
+		slog.Debug("no " + *configPath + " found, replaying with the defaults")
+	} else if config, doc, err = loadConfig(*configPath, args); err != nil {
+		fatal(err)
+	}
+	if replay != nil {
+		if err := replay.configure(&config); err != nil {
+			fatal(err)
+		}
+	}
+	applyLabels(&config, labels)
+	if problems := config.Problems(); len(problems) > 0 {
+		problems.Locate(doc)
+		for _, p := range problems {
+			slog.Error(fmt.Sprintf("%s: %v", *configPath, p))
+		}
+		os.Exit(1)
+	}
+	if err := useProfiles(&config, profiles); err != nil {
+		fatal(err)
+	}
+	if len(profiles) > 0 {
+		slog.Info("using profiles", "profiles", strings.Join(profiles, ","), "urls", targetNames(config.URLs))
+	}
+	units, grading = config.Units, config.LatencyGrading
+	configured, _ := config.Level()
+	level.Set(configured)
+	if config.LogFormat == perf.LogJournal {
+		handler = newJournalHandler(os.Stderr, level)
+		slog.SetDefault(slog.New(handler))
+	}
+	switch {
+	case *quiet:
+		level.Set(slog.LevelError)
+	case *verbose:
+		level.Set(slog.LevelDebug)
+	}
+	// URLs given as args are tested in place of speedtest servers too.
+	if len(args) == 0 {
+		if err := useSpeedtest(context.Background(), &config); err != nil {
+			fatal(err)
+		}
+	}
+	sched, err := newSchedule(config.Interval, config.Cron)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	iterations := 1
+	if sched != nil {
+		iterations = 0
+	}
+	if config.Iterations != nil {
+		iterations = *config.Iterations
+	}
+	if *once {
+		iterations = 1
+	}
+	if replay != nil {
+		iterations = len(replay.passes)
 	}
+	// An experiment takes as many passes as it schedules.
+	var exp *experimentRun
+	if config.Experiment != nil {
+		exp = newExperimentRun(*config.Experiment, config.Seed)
+		iterations = exp.passes()
+	}
+	names := config.Reporters
+	if len(names) == 0 {
+		names = []string{config.Output}
+	}
+	if *format != "" {
+		names = []string{*format}
+	}
+	if err := checkTableSort(config.TableSort); err != nil {
+		fatal(fmt.Errorf("table_sort: %w", err))
+	}
+	var trend *trends
+	if iterations != 1 && !*noTrend {
+		trend = newTrends(config.Trend)
+	}
+	liveProgress := !*noProgress && isTerminal(os.Stderr)
+	var reporters multiReporter
+	if len(config.Outputs) > 0 && *format == "" {
+		var files []*os.File
+		reporters, files, err = newOutputs(config.Outputs, liveProgress, *quiet, config.EmitProgress, trend)
+		names = []string{config.Outputs[0].Format}
+		defer func() {
+			for _, f := range files {
+				f.Close()
+			}
+		}()
+	} else {
+		reporters, err = newReporters(names, liveProgress, *quiet, config.EmitProgress, trend)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if *formatTemplate != "" {
+		config.Template = *formatTemplate
+	}
+	if config.Template != "" {
+		// A template replaces the display reporters, so its lines are all
+		// stdout carries.
+		tr, err := newTemplateReporter(config.Template, !*quiet, *quiet)
+		if err != nil {
+			fatal(err)
+		}
+		reporters = multiReporter{tr}
+	}
+	displays := len(reporters)
+	// Checks and comparisons follow the first display reporter's format.
+	output := "text"
+	if names[0] == "json" {
+		output = "json"
+	}
+	// runStart anchors the run offsets of results and samples.
+	runID, runStart := perf.NewRunID(), time.Now()
+	host, _ := os.Hostname()
+	sched = withJitter(sched, config, host)
+	// The manifest is finished last, once the sinks have closed their
+	// files.
+	var manifest *runManifest
+	var interrupted atomic.Bool
+	sinks := newSinkSet(config.Sinks)
+	defer func() {
+		if manifest == nil {
+			return
+		}
+		status := manifestCompleted
+		if interrupted.Load() {
+			status = manifestInterrupted
+		}
+		manifest.finish(status, code, sinks.list())
+	}()
+	pause := newPauser(config.PauseFile)
+	pause.watchSignals()
+	var budget *dataBudget
+	if config.DataBudget != nil {
+		if budget, err = openDataBudget(*config.DataBudget, configSource.cacheDir, time.Now()); err != nil {
+			fatal(err)
+		}
+	}
+	var alerts *perf.AlertTracker
+	if config.AlertThreshold > 0 {
+		alerts = perf.NewAlertTracker(config.AlertWindow, config.AlertThreshold, config.AlertClearAfter)
+	}
+	var breaker *perf.Breaker
+	if config.ProbeFailuresThreshold > 0 {
+		breaker = perf.NewBreaker(config.ProbeFailuresThreshold)
+	}
+	tester, err := newTester(config, runID, host, runStart, pause.hold, breaker)
+	if err != nil {
+		fatal(err)
+	}
+	defer func() { tester.Close() }()
 
-	var config Config
-	if err := yaml.Unmarshal(raw, &config); err != nil {
-		log.Fatal(err)
+	addSink := func(name string, s sink, err error) bool {
+		r, err := sinks.open(name, s, err)
+		if err != nil {
+			fatal(err)
+		}
+		if r == nil {
+			return false
+		}
+		reporters = append(reporters, r)
+		return true
+	}
+	var m *metrics
+	if config.MetricsListen != "" {
+		m = newMetrics(runID, host, config.Labels)
+		m.pause, m.budget, m.breaker = pause, budget, breaker
+		stop, err := serveMetrics(config.MetricsListen, m)
+		if addSink("metrics", m, err) {
+			defer stop()
+		} else {
+			m = nil
+		}
+	}
+	if config.CSVFile != "" {
+		csvFile, err := openCSVLog(config.CSVFile)
+		addSink("csv_file", csvFile, err)
+	}
+	var box *outbox
+	if config.Outbox != nil {
+		if box, err = openOutbox(*config.Outbox, configSource.cacheDir); err != nil {
+			fatal(err)
+		}
+		defer box.Close()
+		if m != nil {
+			m.outbox = box
+		}
+	}
+	if config.Influx != nil {
+		influx, err := newInfluxSink("influx", *config.Influx, box)
+		addSink("influx", influx, err)
+	}
+	if config.OTel != nil {
+		otel, err := newOTelSink(*config.OTel, runID, host)
+		addSink("otel", otel, err)
+	}
+	if config.StatsD != nil {
+		statsd, err := newStatsdSink(*config.StatsD)
+		addSink("statsd", statsd, err)
+	}
+	if config.Webhook != nil {
+		hook, err := newWebhook("webhook", *config.Webhook, config.URLs, box)
+		addSink("webhook", hook, err)
+	}
+	if config.SamplesFile != "" {
+		samples, err := openSampleFile(config.SamplesFile)
+		addSink("samples_file", samples, err)
+	}
+	if config.FlentOutput != "" {
+		flent, err := openFlentSink(config.FlentOutput, flentMeta{RunID: runID, Host: host, RunStart: runStart, Step: progressInterval(config.ProgressInterval)})
+		addSink("flent_output", flent, err)
+	}
+	if config.Heatmap != nil {
+		heat, err := newHeatmapSink(*config.Heatmap, config.LinkCapacity)
+		addSink("heatmap", heat, err)
+	}
+	if config.Socket.Path != "" {
+		socket, err := openSocketSink(config.Socket.Path, config.Socket.EmitProgress)
+		addSink("socket", socket, err)
+	}
+	if config.ResultsFile.Path != "" {
+		archive, err := openResultArchive(config.ResultsFile.Path, config.ResultsFile.EmitProgress, int64(config.RotateSize), config.RotateKeep)
+		addSink("results_file", archive, err)
+	}
+	for _, name := range config.NamedSinks() {
+		s, err := openNamedSink(name, config.Sinks[name], config, runID, host, box)
+		addSink(name, s, err)
+	}
+	var hist *history
+	if config.HistoryDB != "" {
+		hist, err = openHistory(config.HistoryDB)
+		if err == nil {
+			hist.cacheMode = config.CacheMode()
+		}
+		if !addSink("history_db", hist, err) {
+			hist = nil
+		}
+	}
+	var htmlOut *htmlReport
+	if *reportPath != "" {
+		htmlOut, err = openHTMLReport(*reportPath)
+		if !addSink("report", htmlOut, err) {
+			htmlOut = nil
+		}
+	}
+	// Closed before the outbox, so what they flush at the end is queued
+	// for its last delivery, and before the manifest is finished. A
+	// required sink that fails to close fails the run.
+	defer func() {
+		if err := sinks.close(); err != nil {
+			code = max(code, 1)
+		}
+	}()
+	if m != nil {
+		m.watch(sinks)
+	}
+	if box != nil {
+		box.start()
+	}
+	if config.Manifest != "" {
+		baseline := ""
+		if *saveBaseline {
+			baseline = *baselinePath
+		}
+		manifest, err = openManifest(config.Manifest, runID, host, runStart, config, manifestFiles(config, *reportPath, baseline), sinks.list())
+		if err != nil {
+			fatal(err)
+		}
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel() // Ensure resources are released when the function exits
+	if config.RunDeadline > 0 {
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeout(ctx, config.RunDeadline)
+		defer stop()
+	}
+
+	// The dashboard takes the place of the display reporters, and shows the
+	// log lines while it has the screen.
+	var dash *dashboard
+	if *tui && config.Serve == "" {
+		dash, err = openDashboard(os.Stdin, os.Stdout, cancel)
+		if err != nil {
+			slog.Warn("starting the dashboard, printing results instead", "err", err)
+		} else {
+			reporters = append(multiReporter{dash}, reporters[displays:]...)
+			slog.SetDefault(slog.New(slog.NewTextHandler(dash, &slog.HandlerOptions{Level: level})))
+			dash.setRestart(restarter(ctx, dash, tester, config.URLs, config.SigningKey))
+		}
+	}
 
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
+	// The first SIGINT or SIGTERM cancels the run so partial results and
+	// the summary still print; a second one, or a shutdown that outlasts
+	// the grace period, exits at once.
+	signalChan := make(chan os.Signal, 2)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-signalChan
-		fmt.Println("\nReceived interrupt signal. Shutting down...")
+		sig := <-signalChan
+		fmt.Fprintf(os.Stderr, "\nReceived %v, finishing up; press Ctrl+C again to force quit\n", sig)
+		interrupted.Store(true)
+		notify.stopping()
 		cancel()
+		select {
+		case <-signalChan:
+			fmt.Fprintln(os.Stderr, "Forced quit")
+		case <-time.After(shutdownGrace):
+			fmt.Fprintf(os.Stderr, "Still shutting down after %v, forcing quit\n", shutdownGrace)
+		}
+		if manifest != nil {
+			manifest.finish(manifestInterrupted, 130, sinks.list())
+		}
+		os.Exit(130)
 	}()
 
-	for {
-		for _, url := range config.URLs {
-			select {
-			case <-ctx.Done():
-				return
-			case result := <-downloadAndMeasure(ctx, url):
-				fmt.Printf("✓ %s\n", result.URL)
-				fmt.Printf("  Size:     %.2f MB\n", float64(result.SizeBytes)/1e6)
-				fmt.Printf("  Time:     %v\n", result.Elapsed)
-				fmt.Printf("  Speed:    %.2f MB/s (%.2f Mbps)\n\n", result.SpeedMBps, result.SpeedMbps)
+	// The config is valid and the sinks are open, so the service is up.
+	notify.ready()
+	if config.Serve != "" {
+		defer notify.waiting(ctx)()
+		if err := serveAPI(ctx, config.Serve, config.ServeOrigins, tester, reporters, config.Concurrency, pause); err != nil {
+			fatal(err)
+		}
+		return 0
+	}
+
+	orderer := newOrderer(config)
+	coord := newCoordinator(config, runID)
+	var src source = replay
+	live := &liveSource{}
+	if replay == nil {
+		live.use(config, tester, coord)
+		src = live
+	}
+
+	// SIGHUP rereads the config. The pass running when it arrives finishes
+	// under the old one, and the next pass starts with the new one.
+	var reloadWanted atomic.Bool
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			slog.Info("received SIGHUP, reloading config before the next pass")
+			reloadWanted.Store(true)
+		}
+	}()
+
+	collector := perf.NewCollector()
+	runFailed, incomplete := false, false
+	var rolls *rollups
+	switch {
+	case config.Rollup > 0 && iterations != 1:
+		rolls = newRollups(config.Rollup, reporters)
+	case config.Rollup > 0:
+		slog.Warn("rollup only applies to continuous runs", "rollup", config.Rollup)
+	}
+	var started time.Time
+	// probed are the targets of the last pass, whose hosts are probed while
+	// the link is down.
+	var probed []perf.Target
+	// A config served over HTTP is refetched before every later pass, so
+	// its url list can change while yaperf keeps running, unless the urls
+	// are speedtest servers.
+	refresh := isRemote(*configPath) && len(args) == 0 && !config.Speedtest.On() && replay == nil
+	for pass := 0; ctx.Err() == nil && (iterations == 0 || pass < iterations); pass++ {
+		notify.ping()
+		waited := notify.waiting(ctx)
+		if pass > 0 && breaker.State().Down {
+			if !awaitLink(ctx, tester, breaker, probed, config.LinkDownRetry, config.Interval) {
+				waited()
+				break
+			}
+		} else if pass > 0 && sched != nil && !wait(ctx, sched, started) {
+			waited()
+			break
+		}
+		if !pause.wait(ctx) {
+			waited()
+			break
+		}
+		if budget != nil && !budget.wait(ctx) {
+			waited()
+			break
+		}
+		waited()
+		started = time.Now()
+		// A replay's windows follow the recorded times, as its results are
+		// added.
+		if rolls != nil && replay == nil {
+			rolls.tick(started)
+		}
+		if pass > 0 && reloadWanted.Swap(false) && replay == nil {
+			next, err := reloadConfig(*configPath, args, labels, profiles, config)
+			var nextTester *perf.Tester
+			if err == nil {
+				nextTester, err = newTester(next, runID, host, runStart, pause.hold, breaker)
+			}
+			var nextSched schedule
+			if err == nil {
+				nextSched, err = newSchedule(next.Interval, next.Cron)
+				nextSched = withJitter(nextSched, next, host)
+			}
+			if err == nil && (nextSched == nil) != (sched == nil) {
+				err = errors.New("interval and cron cannot be added or removed while running")
+			}
+			if err != nil {
+				slog.Error("reloading config, keeping the current one", "err", err)
+			} else {
+				tester.Close()
+				config, tester, sched = next, nextTester, nextSched
+				pause.setFile(config.PauseFile)
+				orderer = newOrderer(config)
+				coord = newCoordinator(config, runID)
+				live.use(config, tester, coord)
+				if dash != nil {
+					dash.setRestart(restarter(ctx, dash, tester, config.URLs, config.SigningKey))
+				}
+				slog.Info("config reloaded", "urls", len(config.URLs))
+			}
+		} else if pass > 0 && refresh {
+			config.URLs = refreshURLs(*configPath, profiles, config.URLs)
+		}
+		// Templates are expanded afresh every pass, so the tokens they sign
+		// do not expire in a continuous run.
+		urls := config.URLs
+		if exp != nil {
+			urls = exp.targets(pass)
+		}
+		targets, err := perf.ExpandTargets(orderer.Pass(urls), config.SigningKey, started)
+		if err != nil {
+			slog.Error("expanding url templates", "err", err)
+			runFailed = true
+			break
+		}
+		probed = targets
+		if config.Order != "" && config.Order != perf.OrderSequential {
+			slog.Debug("pass order", "pass", pass+1, "urls", targetNames(targets))
+		}
+		var sweep []perf.SweepResult
+		if config.Sweep != nil {
+			sweep = tester.Sweep(ctx, targets, *config.Sweep)
+			if dash != nil {
+				logSweep(sweep)
+			} else {
+				printSweep(output, pass+1, sweep, *quiet)
+			}
+			if config.Sweep.SkipUnreachable {
+				targets = perf.SkipUnreachable(targets, sweep)
+			}
+		}
+		var finals []perf.Stats
+		for result := range src.pass(ctx, pass, targets) {
+			notify.ping()
+			if result.Final() && failed(result) {
+				runFailed = true
 			}
+			if result.Skipped && (result.SkipReason == perf.SkipOutOfTime || result.SkipReason == perf.SkipLinkDown) {
+				incomplete = true
+			}
+			if alerts != nil {
+				alerts.Observe(&result, src.now(result))
+			}
+			if result.Final() {
+				finals = append(finals, result)
+			}
+			collector.Add(result)
+			if budget != nil {
+				budget.add(result)
+			}
+			if rolls != nil {
+				rolls.add(result, src.now(result))
+			}
+			report(reporters, result)
+		}
+		table := newResultTable(pass+1, finals, config.TableSort)
+		if sweep != nil {
+			table.Sweep = newSweepCount(sweep)
+		}
+		if config.Score != nil {
+			table.Score = newCompositeScore(*config.Score, finals, targetWeights(urls))
+		}
+		if table.len() > 1 || table.Score != nil {
+			reporters.OnPass(table)
+		}
+		if exp != nil {
+			exp.add(pass, finals)
+		}
+		if budget != nil {
+			budget.save()
+		}
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		slog.Warn("run deadline reached", "run_deadline", config.RunDeadline)
+	}
+	if rolls != nil {
+		rolls.close(src.now(perf.Stats{}))
+	}
+	// The report and history below read back what the sinks wrote.
+	sinks.reporters.drain()
+	summaries := collector.Summaries()
+	config.LinkCapacity.Annotate(summaries)
+	// resolve_all rankings, dualstack_compare deltas, size sweeps and the
+	// results of agents side by side only show in the summary, so print it
+	// for one iteration too, as for a quick test.
+	if iterations != 1 || ctx.Err() != nil || *quiet || *quick || coord != nil || len(perf.RankIPs(summaries)) > 0 || len(perf.CompareFamilies(summaries)) > 0 || len(perf.SizeCurves(summaries)) > 0 || len(perf.OffsetProfiles(summaries)) > 0 || len(perf.CompareBidirectional(summaries)) > 0 || len(perf.LatencyGrades(summaries, grading)) > 0 {
+		reporters.OnSummary(summaries)
+	}
+	if dash != nil {
+		dash.close(summaries, handler)
+	}
+	if htmlOut != nil {
+		meta := reportMeta{RunID: runID, Host: host, Labels: config.Labels, Started: runStart, Finished: time.Now()}
+		if err := htmlOut.finish(meta, summaries); err != nil {
+			slog.Error("writing report", "err", err)
+		}
+	}
+	if exp != nil {
+		printExperiment(output, exp.result())
+	}
+	if hist != nil {
+		comparisons, err := hist.compare(summaries)
+		if err != nil {
+			slog.Error("comparing with history", "err", err)
+		} else if len(comparisons) > 0 {
+			printComparisons(output, comparisons)
+		}
+	}
+
+	status := perf.StatusOK
+	if runFailed || incomplete {
+		status = perf.StatusWarning
+	}
+	if checks := perf.Checks(config.URLs, summaries, config.LinkCapacity); len(checks) > 0 {
+		printChecks(output, checks)
+		for _, c := range checks {
+			status = max(status, c.Status)
+		}
+	}
+	if *baselinePath != "" {
+		return checkBaseline(*baselinePath, *saveBaseline, output, newBaseline(summaries, config.Labels, host, iterations), summaries, config.RegressionTolerance, int(status))
+	}
+	return int(status)
+}
+
+// newOrderer returns the Orderer for config's order, seeded from config or
+// at random.
+func newOrderer(config perf.Config) *perf.Orderer {
+	seed := rand.Uint64()
+	if config.Seed != nil {
+		seed = *config.Seed
+	}
+	if config.Order != "" && config.Order != perf.OrderSequential {
+		slog.Debug("ordering urls", "order", config.Order, "seed", seed)
+	}
+	return perf.NewOrderer(config.Order, seed)
+}
+
+// newTester builds the Tester for config, stamping its results with runID
+// and host, and holding each target back with hold.
+func newTester(config perf.Config, runID, host string, runStart time.Time, hold func(context.Context), breaker *perf.Breaker) (*perf.Tester, error) {
+	tlsConfig, err := config.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxyURL, err := config.ProxyURL()
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := perf.NewResolver(config.Resolver)
+	if err != nil {
+		return nil, err
+	}
+	return perf.New(perf.Options{
+		RunID:               runID,
+		RunStart:            runStart,
+		Host:                host,
+		Labels:              config.Labels,
+		TLSConfig:           tlsConfig,
+		Proxy:               proxyURL,
+		Resolver:            resolver,
+		Logger:              slog.Default(),
+		Timeout:             config.Timeout,
+		ConnectTimeout:      config.ConnectTimeout,
+		TLSTimeout:          config.TLSTimeout,
+		HeaderTimeout:       config.HeaderTimeout,
+		Limits:              config.Limits,
+		Streams:             config.Streams,
+		TrimRagged:          config.TrimRagged,
+		Preflight:           config.Preflight,
+		FollowRedirects:     config.FollowRedirects,
+		FreshConnection:     config.FreshConnection,
+		CacheMode:           config.CacheMode(),
+		MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+		IdleConnTimeout:     config.IdleConnTimeout,
+		MaxRedirects:        config.MaxRedirects,
+		MinBudget:           config.MinBudget,
+		BufferSize:          int(config.BufferSize),
+		IPVersion:           config.IPVersion,
+		Protocol:            config.Protocol,
+		Compression:         config.Compression,
+		NormalizeEncoding:   config.NormalizeEncoding,
+		UserAgent:           config.UserAgent,
+		Preset:              config.Preset,
+		Count:               config.Count,
+		Fallback:            config.Fallback,
+		Warmup:              config.Warmup,
+		Retries:             config.Retries,
+		RateLimit:           config.RateLimit,
+		TotalRateLimit:      config.TotalRateLimit,
+		RetryBackoff:        config.RetryBackoff,
+		Mode:                config.Mode,
+		Adaptive:            config.Adaptive,
+		ShiftDetection:      config.ShiftDetection,
+		StallThreshold:      config.StallThreshold,
+		StallFloor:          config.StallFloor,
+		AbortOnStall:        config.AbortOnStall,
+		MinSpeedFloor:       config.MinSpeedFloor,
+		FloorGrace:          config.FloorGrace,
+		ProgressInterval:    progressInterval(config.ProgressInterval),
+		CPUThreshold:        cpuThreshold(config.CPUThreshold),
+		LinkCapacity:        config.LinkCapacity,
+		LatencyGrading:      config.LatencyGrading,
+		PerHostConcurrency:  config.PerHostConcurrency,
+		Hold:                hold,
+		Breaker:             breaker,
+	}), nil
+}
+
+// progressInterval maps progress_interval onto Options, where progress is
+// turned off by a negative interval rather than zero.
+func progressInterval(d *time.Duration) time.Duration {
+	switch {
+	case d == nil:
+		return 0
+	case *d == 0:
+		return -1
+	}
+	return *d
+}
+
+// cpuThreshold maps cpu_threshold onto Options, where sampling is turned
+// off by a negative threshold rather than zero.
+func cpuThreshold(p *perf.Percent) float64 {
+	switch {
+	case p == nil:
+		return 0
+	case *p == 0:
+		return -1
+	}
+	return float64(*p) / 100
+}
+
+// targetNames lists the display names of targets in order.
+func targetNames(targets []perf.Target) []string {
+	names := make([]string, len(targets))
+	for i, t := range targets {
+		names[i] = t.URL
+		if t.Name != "" {
+			names[i] = t.Name
 		}
 	}
+	return names
 }
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func TestMain(m *testing.M) {
+	// A test can run the binary as yaperf itself, with its own flags and
+	// exit code.
+	if os.Getenv("YAPERF_TEST_MAIN") == "1" {
+		os.Args = append(os.Args[:1], strings.Fields(os.Getenv("YAPERF_TEST_ARGS"))...)
+		main()
+	}
+	// What yaperf logs as it goes would drown out the test output.
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	os.Exit(m.Run())
+}
+
+// yaperf returns the test binary run as yaperf with args, in dir.
+func yaperf(dir string, args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0])
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "YAPERF_TEST_MAIN=1", "YAPERF_TEST_ARGS="+strings.Join(args, " "))
+	return cmd
+}
+
+// exitCode starts cmd unless it is running and waits for it, failing the
+// test if it outlives timeout.
+func exitCode(t *testing.T, cmd *exec.Cmd, timeout time.Duration) int {
+	t.Helper()
+	if cmd.Process == nil {
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			return exit.ExitCode()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return 0
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-done
+		t.Fatalf("still running after %v", timeout)
+		return -1
+	}
+}
+
+func TestIterations(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	tests := []struct {
+		name        string
+		config      string
+		args        []string
+		requests    int32
+		exitNonzero bool
+	}{
+		{"one pass by default", "", nil, 1, false},
+		{"iterations", "iterations: 3\n", nil, 3, false},
+		{"once overrides iterations", "iterations: 3\n", []string{"-once"}, 1, false},
+		{"a failed download", "iterations: 2\n", nil, 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests.Store(0)
+			dir := t.TempDir()
+			urls := "urls:\n  - " + srv.URL + "/a\n"
+			if tt.exitNonzero {
+				urls += "  - " + srv.URL + "/missing\n"
+			}
+			if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(tt.config+urls), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			code := exitCode(t, yaperf(dir, append([]string{"-q", "-config", "urls.yaml"}, tt.args...)...), time.Minute)
+			if (code != 0) != tt.exitNonzero {
+				t.Errorf("exit code %d, want nonzero %v", code, tt.exitNonzero)
+			}
+			if got := requests.Load(); got != tt.requests {
+				t.Errorf("%d requests, want %d", got, tt.requests)
+			}
+		})
+	}
+}
+
+func TestIterationsForeverStopsOnSignal(t *testing.T) {
+	started := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		w.Write(make([]byte, 1000))
+		w.(http.Flusher).Flush()
+		// The download is in flight when the signal arrives.
+		select {
+		case <-r.Context().Done():
+		case <-time.After(500 * time.Millisecond):
+		}
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	config := fmt.Sprintf("iterations: 0\nurls:\n  - %s/a\n", srv.URL)
+	if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := yaperf(dir, "-q", "-config", "urls.yaml")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(30 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("no download started")
+	}
+	cmd.Process.Signal(syscall.SIGINT)
+	exitCode(t, cmd, 30*time.Second)
+}
+
+func TestConfigInputs(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	for name, url := range map[string]string{"urls.yaml": "/default", "other.yaml": "/other"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("urls:\n  - "+srv.URL+url+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name  string
+		args  []string
+		stdin string
+		want  []string
+	}{
+		{"default file", nil, "", []string{"/default"}},
+		{"config flag", []string{"-config", "other.yaml"}, "", []string{"/other"}},
+		{"stdin", []string{"-config", "-"}, "urls:\n  - " + srv.URL + "/stdin\n", []string{"/stdin"}},
+		// URL arguments replace the config.
+		{"arguments", []string{srv.URL + "/a", srv.URL + "/b"}, "", []string{"/a", "/b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			paths = nil
+			mu.Unlock()
+			cmd := yaperf(dir, append([]string{"-q"}, tt.args...)...)
+			cmd.Stdin = strings.NewReader(tt.stdin)
+			if code := exitCode(t, cmd, time.Minute); code != 0 {
+				t.Errorf("exit code %d", code)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			slices.Sort(paths)
+			if !slices.Equal(paths, tt.want) {
+				t.Errorf("downloaded %q, want %q", paths, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigInputErrors(t *testing.T) {
+	tests := []struct {
+		name, config, want string
+	}{
+		{"empty list", "urls: []\n", "urls: no urls to test"},
+		{"malformed url", "urls:\n  - https://ok.example/\n  - ://bad\n", "urls[1].url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := yaperf(t.TempDir(), "-config", "-")
+			cmd.Stdin = strings.NewReader(tt.config)
+			var stderr strings.Builder
+			cmd.Stderr = &stderr
+			if code := exitCode(t, cmd, time.Minute); code != 1 {
+				t.Errorf("exit code %d, want 1", code)
+			}
+			if !strings.Contains(stderr.String(), tt.want) {
+				t.Errorf("stderr\n%s\nwant %q", stderr.String(), tt.want)
+			}
+		})
+	}
+}
+
+// hangingServer sends the first body bytes of a larger response, or with
+// none not even the headers, and then stops, ignoring the client going
+// away. It reports each request on the returned channel.
+func hangingServer(t *testing.T, body int) (*httptest.Server, <-chan struct{}) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		if body > 0 {
+			w.Header().Set("Content-Length", strconv.Itoa(100*body))
+			w.Write(make([]byte, body))
+			w.(http.Flusher).Flush()
+		}
+		<-release
+	}))
+	t.Cleanup(func() {
+		close(release)
+		srv.CloseClientConnections()
+		srv.Close()
+	})
+	return srv, started
+}
+
+func TestShutdown(t *testing.T) {
+	srv, started := hangingServer(t, 100000)
+	collector, posted := hangingServer(t, 0)
+	tests := []struct {
+		name, config string
+		signals      []syscall.Signal
+		// wait is what has to happen before the next signal.
+		wait   <-chan struct{}
+		code   int
+		stderr string
+	}{
+		{"interrupt", "", []syscall.Signal{syscall.SIGINT}, nil, 0, "press Ctrl+C again to force quit"},
+		{"terminate", "", []syscall.Signal{syscall.SIGTERM}, nil, 0, "finishing up"},
+		// The export on the way out hangs, until the second signal.
+		{"force quit", "otel:\n  endpoint: " + collector.URL + "\n", []syscall.Signal{syscall.SIGINT, syscall.SIGINT}, posted, 130, "Forced quit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			config := tt.config + "urls:\n  - " + srv.URL + "/big\n"
+			if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			cmd := yaperf(dir, "-config", "urls.yaml")
+			var stdout, stderr strings.Builder
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-started:
+			case <-time.After(30 * time.Second):
+				cmd.Process.Kill()
+				t.Fatal("no download started")
+			}
+			for i, sig := range tt.signals {
+				if i > 0 {
+					select {
+					case <-tt.wait:
+					case <-time.After(30 * time.Second):
+						cmd.Process.Kill()
+						t.Fatal("nothing to wait on after the first signal")
+					}
+				}
+				cmd.Process.Signal(sig)
+			}
+			// The stuck read is unblocked well before the grace period ends.
+			code := exitCode(t, cmd, shutdownGrace/2)
+			if code != tt.code || !strings.Contains(stderr.String(), tt.stderr) {
+				t.Errorf("exit code %d, stderr\n%s\nwant %d and %q", code, stderr.String(), tt.code, tt.stderr)
+			}
+			// Winding down on its own, yaperf prints the partial result.
+			if tt.code == 0 && !strings.Contains(stdout.String(), "(cancelled)") {
+				t.Errorf("no partial result in\n%s", stdout.String())
+			}
+		})
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/r" {
+			http.Redirect(w, r, "/a", http.StatusFound)
+			return
+		}
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	// Two streams against a server without ranges log at info, the
+	// redirect and the reused connection of the second pass at debug.
+	urls := fmt.Sprintf("iterations: 2\nurls:\n  - url: %s/r\n    streams: 2\n", srv.URL)
+	tests := []struct {
+		name     string
+		config   string
+		args     []string
+		logs     []string
+		noLogs   []string
+		stdout   string
+		noStdout string
+	}{
+		{"info by default", "", nil, []string{"level=INFO"}, []string{"level=DEBUG"}, "✓ " + srv.URL + "/r", ""},
+		{"verbose", "", []string{"-v"}, []string{"level=INFO", `level=DEBUG msg="following redirect"`, "reused=true"}, nil, "✓ ", ""},
+		{"debug in the config", "log_level: debug\n", nil, []string{`msg="following redirect"`}, nil, "✓ ", ""},
+		{"warn in the config", "log_level: warn\n", nil, nil, []string{"level="}, "✓ ", ""},
+		{"verbose overrides the config", "log_level: error\n", []string{"-v"}, []string{"level=DEBUG"}, nil, "✓ ", ""},
+		// Quiet leaves only the summary.
+		{"quiet", "log_level: debug\n", []string{"-q"}, nil, []string{"level="}, "Summary (Mbps)", "✓ "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(tt.config+urls), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var stdout, stderr strings.Builder
+			cmd := yaperf(dir, tt.args...)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			if code := exitCode(t, cmd, time.Minute); code != 0 {
+				t.Fatalf("exit code %d: %s", code, stderr.String())
+			}
+			for _, want := range tt.logs {
+				if !strings.Contains(stderr.String(), want) {
+					t.Errorf("stderr has no %q:\n%s", want, stderr.String())
+				}
+			}
+			for _, unwanted := range tt.noLogs {
+				if strings.Contains(stderr.String(), unwanted) {
+					t.Errorf("stderr has %q:\n%s", unwanted, stderr.String())
+				}
+			}
+			// Results go to stdout alone, and logs never do.
+			if !strings.Contains(stdout.String(), tt.stdout) || strings.Contains(stderr.String(), tt.stdout) {
+				t.Errorf("stdout has no %q:\n%s", tt.stdout, stdout.String())
+			}
+			if tt.noStdout != "" && strings.Contains(stdout.String(), tt.noStdout) {
+				t.Errorf("stdout has %q:\n%s", tt.noStdout, stdout.String())
+			}
+			if strings.Contains(stdout.String(), "level=") {
+				t.Errorf("logs on stdout:\n%s", stdout.String())
+			}
+		})
+	}
+}
+
+func TestLabels(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	config := "output: json\nlabels:\n  site: nyc\n  isp: comcast\ncsv_file: out.csv\nurls:\n  - " + srv.URL + "/a\n"
+	if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout strings.Builder
+	cmd := yaperf(dir, "-label", "site=lab", "-label", "rack=7")
+	cmd.Stdout = &stdout
+	if code := exitCode(t, cmd, time.Minute); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+	// The flags override the config, and the JSON results and the CSV log
+	// carry the same run.
+	var result struct {
+		RunID  string            `json:"run_id"`
+		Host   string            `json:"host"`
+		Labels map[string]string `json:"labels"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(stdout.String())), &result); err != nil {
+		t.Fatalf("%s: %v", stdout.String(), err)
+	}
+	host, _ := os.Hostname()
+	if len(result.RunID) != 36 || result.Host != host || fmt.Sprint(result.Labels) != "map[isp:comcast rack:7 site:lab]" {
+		t.Errorf("result from run %q on %q labelled %v", result.RunID, result.Host, result.Labels)
+	}
+	log, err := os.ReadFile(filepath.Join(dir, "out.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "," + result.RunID + "," + host + ",isp=comcast;rack=7;site=lab,"; !strings.Contains(string(log), want) {
+		t.Errorf("csv log has no %q:\n%s", want, log)
+	}
+
+	// Label names must suit Prometheus once metrics are served.
+	config = "metrics_listen: 127.0.0.1:0\nlabels:\n  site: nyc\nurls:\n  - " + srv.URL + "/a\n"
+	if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stderr strings.Builder
+	cmd = yaperf(dir, "-label", "bad-name=x")
+	cmd.Stderr = &stderr
+	if code := exitCode(t, cmd, time.Minute); code != 1 || !strings.Contains(stderr.String(), `labels.bad-name: label \"bad-name\" is not a valid Prometheus label name`) {
+		t.Errorf("exit code %d: %s", code, stderr.String())
+	}
+}
+
+func TestRunDeadlineExit(t *testing.T) {
+	srv, _ := hangingServer(t, 100000)
+	dir := t.TempDir()
+	config := "run_deadline: 500ms\nurls:\n  - " + srv.URL + "/a\n  - " + srv.URL + "/b\n"
+	if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr strings.Builder
+	cmd := yaperf(dir)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	// An incomplete pass is a warning.
+	if code := exitCode(t, cmd, 30*time.Second); code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+	for _, want := range []string{
+		"- " + srv.URL + "/b (skipped, out of run time)",
+		"Skipped " + srv.URL + "/b: 1, out of run time",
+	} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("stdout lacks %q:\n%s", want, stdout.String())
+		}
+	}
+	if !strings.Contains(stderr.String(), "run deadline reached") {
+		t.Errorf("stderr:\n%s", stderr.String())
+	}
+}
+
+func TestProgressIntervalOption(t *testing.T) {
+	d := func(v time.Duration) *time.Duration { return &v }
+	tests := []struct {
+		config *time.Duration
+		want   time.Duration
+	}{
+		// Unset is the tester's default of a second, and zero turns
+		// progress off.
+		{nil, 0},
+		{d(0), -1},
+		{d(250 * time.Millisecond), 250 * time.Millisecond},
+		{d(5 * time.Second), 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := progressInterval(tt.config); got != tt.want {
+			t.Errorf("progressInterval(%v) = %v, want %v", tt.config, got, tt.want)
+		}
+	}
+}
+
+func TestCPUThresholdOption(t *testing.T) {
+	p := func(v perf.Percent) *perf.Percent { return &v }
+	tests := []struct {
+		config *perf.Percent
+		want   float64
+	}{
+		// Unset is the tester's default of 80%, and zero turns sampling
+		// off.
+		{nil, 0},
+		{p(0), -1},
+		{p(50), 0.5},
+		{p(95), 0.95},
+	}
+	for _, tt := range tests {
+		if got := cpuThreshold(tt.config); got != tt.want {
+			t.Errorf("cpuThreshold(%v) = %v, want %v", tt.config, got, tt.want)
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	config := "output: json\nprofiles:\n  quick:\n    urls: [a]\n  soak:\n    groups: [soak]\n    iterations: 2\n" +
+		"urls:\n  - url: " + srv.URL + "/a\n    name: a\n  - url: " + srv.URL + "/b\n    group: soak\n  - " + srv.URL + "/c\n"
+	if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		urls []string
+		// label is the profile label of the results.
+		label string
+	}{
+		{nil, []string{"/a", "/b", "/c"}, ""},
+		{[]string{"-profile", "quick"}, []string{"/a"}, "quick"},
+		// The soak profile runs two passes of its url.
+		{[]string{"-profile", "soak"}, []string{"/b", "/b"}, "soak"},
+		{[]string{"-profile", "soak", "-profile", "quick"}, []string{"/a", "/b", "/a", "/b"}, "soak,quick"},
+	}
+	for _, tt := range tests {
+		var stdout, stderr strings.Builder
+		cmd := yaperf(dir, tt.args...)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if code := exitCode(t, cmd, time.Minute); code != 0 {
+			t.Fatalf("%v: exit code %d\n%s", tt.args, code, stderr.String())
+		}
+		var urls []string
+		dec := json.NewDecoder(strings.NewReader(stdout.String()))
+		for dec.More() {
+			var result struct {
+				Kind   string            `json:"kind"`
+				URL    string            `json:"url"`
+				Labels map[string]string `json:"labels"`
+			}
+			if err := dec.Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Kind != "final" {
+				continue
+			}
+			urls = append(urls, strings.TrimPrefix(result.URL, srv.URL))
+			// The results of a run with profiles say which.
+			if result.Labels["profile"] != tt.label {
+				t.Errorf("%v: profile label %q, want %q", tt.args, result.Labels["profile"], tt.label)
+			}
+		}
+		if fmt.Sprint(urls) != fmt.Sprint(tt.urls) {
+			t.Errorf("%v: tested %v, want %v", tt.args, urls, tt.urls)
+		}
+		if logged := strings.Contains(stderr.String(), `msg="using profiles"`); logged != (len(tt.args) > 0) {
+			t.Errorf("%v: stderr\n%s", tt.args, stderr.String())
+		}
+	}
+
+	for _, tt := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-profile", "nightly"}, `-profile: no profile \"nightly\"; profiles are quick, soak`},
+		{[]string{"-profile", "quick", srv.URL + "/d"}, "-profile picks from the urls in the config and cannot be used with urls given as arguments"},
+	} {
+		var stderr strings.Builder
+		cmd := yaperf(dir, tt.args...)
+		cmd.Stderr = &stderr
+		if code := exitCode(t, cmd, time.Minute); code == 0 || !strings.Contains(stderr.String(), tt.err) {
+			t.Errorf("%v: exit code %d\n%s", tt.args, code, stderr.String())
+		}
+	}
+}
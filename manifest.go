@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// Run states of a manifest.
+const (
+	manifestRunning     = "running"
+	manifestCompleted   = "completed"
+	manifestInterrupted = "interrupted"
+)
+
+// manifestFile is one file the run writes.
+type manifestFile struct {
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+}
+
+type manifestHost struct {
+	Name string `json:"name,omitempty"`
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	CPUs int    `json:"cpus"`
+}
+
+type manifestSchedule struct {
+	ProbeID      string  `json:"probe_id"`
+	OffsetMs     float64 `json:"offset_ms"`
+	PassJitterMs float64 `json:"pass_jitter_ms,omitempty"`
+}
+
+// manifestDoc is the manifest file: what ran, with which config, and where
+// its results went.
+type manifestDoc struct {
+	RunID     string    `json:"run_id"`
+	Version   string    `json:"version"`
+	GoVersion string    `json:"go_version"`
+	Status    string    `json:"status"`
+	ExitCode  *int      `json:"exit_code,omitempty"`
+	Started   time.Time `json:"started"`
+	// RunStart is the instant the run offsets of results and samples count
+	// from on the monotonic clock, as wall time. Adding an offset to it
+	// orders results even across a step of the wall clock.
+	RunStart time.Time    `json:"run_start"`
+	Ended    *time.Time   `json:"ended,omitempty"`
+	Host     manifestHost `json:"host"`
+	// Schedule is the offset of the run's passes with schedule_jitter or
+	// pass_jitter set.
+	Schedule *manifestSchedule `json:"schedule,omitempty"`
+	Config   map[string]any    `json:"config"`
+	Files    []manifestFile    `json:"files"`
+	// Sinks are the states of the sinks, degraded for those the run went
+	// on without.
+	Sinks []sinkState `json:"sinks,omitempty"`
+}
+
+// runManifest writes the manifest at the start of a run and rewrites it
+// once at the end, each time atomically, so a reader never sees half of
+// one.
+type runManifest struct {
+	path string
+	once sync.Once
+	doc  manifestDoc
+}
+
+// openManifest writes the manifest of a run starting now to path.
+func openManifest(path, runID, host string, runStart time.Time, config perf.Config, files []manifestFile, sinks []sinkState) (*runManifest, error) {
+	m := &runManifest{path: path, doc: manifestDoc{
+		RunID:     runID,
+		Version:   buildVersion(),
+		GoVersion: runtime.Version(),
+		Status:    manifestRunning,
+		Started:   time.Now(),
+		RunStart:  runStart.Round(0),
+		Host:      manifestHost{Name: host, OS: runtime.GOOS, Arch: runtime.GOARCH, CPUs: runtime.NumCPU()},
+		Config:    config.Redacted(),
+		Files:     files,
+		Sinks:     sinks,
+	}}
+	if config.ScheduleJitter > 0 || config.PassJitter > 0 {
+		id, offset := scheduleOffset(config, host)
+		m.doc.Schedule = &manifestSchedule{ProbeID: id, OffsetMs: ms(offset), PassJitterMs: ms(config.PassJitter)}
+	}
+	if err := m.write(); err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	return m, nil
+}
+
+// finish records the end of the run, its exit code and how its sinks
+// fared. Only the first call counts, so a forced quit racing the normal end
+// writes one of them.
+func (m *runManifest) finish(status string, code int, sinks []sinkState) {
+	m.once.Do(func() {
+		now := time.Now()
+		m.doc.Status, m.doc.ExitCode, m.doc.Ended, m.doc.Sinks = status, &code, &now, sinks
+		if err := m.write(); err != nil {
+			fmt.Fprintf(os.Stderr, "manifest: %v\n", err)
+		}
+	})
+}
+
+func (m *runManifest) write() error {
+	raw, err := marshal(m.doc)
+	if err != nil {
+		return err
+	}
+	return writeCache(m.path, append(raw, '\n'))
+}
+
+// manifestFiles lists the result files config and the flags have the run
+// write, with absolute paths.
+func manifestFiles(config perf.Config, report, baseline string) []manifestFile {
+	files := []manifestFile{}
+	add := func(kind, path string) {
+		if path == "" {
+			return
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		files = append(files, manifestFile{kind, path})
+	}
+	add("csv_file", config.CSVFile)
+	add("results_file", config.ResultsFile.Path)
+	add("samples_file", config.SamplesFile)
+	add("flent_output", config.FlentOutput)
+	for _, name := range config.NamedSinks() {
+		add("sinks."+name, config.Sinks[name].File())
+	}
+	add("history_db", config.HistoryDB)
+	if config.Heatmap != nil {
+		add("heatmap", config.Heatmap.Dir)
+	}
+	add("report", report)
+	add("baseline", baseline)
+	return files
+}
+
+// buildVersion is the module version yaperf was built as, or the commit
+// it was built from when it was built from a checkout.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	version, dirty := "devel", ""
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision":
+			version = s.Value
+		case s.Key == "vcs.modified" && s.Value == "true":
+			dirty = "+dirty"
+		}
+	}
+	return version + dirty
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// readManifest decodes the manifest at path, failing the test if it is not
+// whole JSON.
+func readManifest(t *testing.T, path string) manifestDoc {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc manifestDoc
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		t.Fatalf("manifest %s: %v", raw, err)
+	}
+	return doc
+}
+
+func TestManifest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	config := "manifest: run/manifest.json\ncsv_file: out.csv\nsigning_key: hmac-key\nurls:\n  - url: " + srv.URL + "/a\n    headers: {Authorization: Bearer secret}\n"
+	if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := yaperf(dir, "-q")
+	if code := exitCode(t, cmd, time.Minute); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+	path := filepath.Join(dir, "run", "manifest.json")
+	doc := readManifest(t, path)
+	if doc.Status != manifestCompleted || doc.ExitCode == nil || *doc.ExitCode != 0 || doc.Ended == nil || doc.Ended.Before(doc.Started) {
+		t.Errorf("finished as %s with exit code %v, ended %v", doc.Status, doc.ExitCode, doc.Ended)
+	}
+	if len(doc.RunID) != 36 || doc.Version == "" || doc.Host.OS == "" || doc.Host.CPUs < 1 {
+		t.Errorf("run %q of version %q on %+v", doc.RunID, doc.Version, doc.Host)
+	}
+	if len(doc.Files) != 1 || doc.Files[0].Kind != "csv_file" || doc.Files[0].Path != filepath.Join(dir, "out.csv") {
+		t.Errorf("files %+v", doc.Files)
+	}
+	raw, _ := os.ReadFile(path)
+	if strings.Contains(string(raw), "hmac-key") || strings.Contains(string(raw), "Bearer secret") || doc.Config["signing_key"] != perf.Redacted {
+		t.Errorf("secrets in the manifest:\n%s", raw)
+	}
+	// The CSV log holds the run the manifest describes, and no temporary
+	// file is left next to the manifest.
+	if log, err := os.ReadFile(filepath.Join(dir, "out.csv")); err != nil || !strings.Contains(string(log), doc.RunID) {
+		t.Errorf("csv log of another run: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "run")); len(entries) != 1 {
+		t.Errorf("run dir has %d entries", len(entries))
+	}
+}
+
+func TestManifestInterrupted(t *testing.T) {
+	srv, started := hangingServer(t, 100000)
+	dir := t.TempDir()
+	config := "manifest: manifest.json\nurls:\n  - " + srv.URL + "/big\n"
+	if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := yaperf(dir, "-q")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(30 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("no download started")
+	}
+	// While the run goes on the manifest says so.
+	path := filepath.Join(dir, "manifest.json")
+	if doc := readManifest(t, path); doc.Status != manifestRunning || doc.ExitCode != nil || doc.Ended != nil {
+		t.Errorf("running manifest %s with exit code %v, ended %v", doc.Status, doc.ExitCode, doc.Ended)
+	}
+	cmd.Process.Signal(syscall.SIGINT)
+	code := exitCode(t, cmd, shutdownGrace/2)
+	doc := readManifest(t, path)
+	if doc.Status != manifestInterrupted || doc.ExitCode == nil || *doc.ExitCode != code || doc.Ended == nil {
+		t.Errorf("interrupted run finished as %s with exit code %v, ended %v; exited %d", doc.Status, doc.ExitCode, doc.Ended, code)
+	}
+}
+
+func TestManifestFinishOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	m, err := openManifest(path, "run-1", "edge-1", time.Now(), perf.Config{}, manifestFiles(perf.Config{}, "", ""), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc := readManifest(t, path); doc.RunID != "run-1" || doc.Host.Name != "edge-1" || doc.Files == nil || len(doc.Files) != 0 {
+		t.Errorf("started manifest %+v", doc)
+	}
+	// A forced quit racing the normal end writes one of them.
+	degraded := []sinkState{{Name: "influx", Status: "degraded", Error: "refused"}}
+	m.finish(manifestInterrupted, 130, degraded)
+	m.finish(manifestCompleted, 0, nil)
+	doc := readManifest(t, path)
+	if doc.Status != manifestInterrupted || *doc.ExitCode != 130 || len(doc.Sinks) != 1 || doc.Sinks[0].Status != "degraded" {
+		t.Errorf("finished as %s with exit code %d, sinks %+v", doc.Status, *doc.ExitCode, doc.Sinks)
+	}
+
+	// A manifest that cannot be written fails the start of the run.
+	if _, err := openManifest(filepath.Join(path, "manifest.json"), "run-1", "", time.Now(), perf.Config{}, nil, nil); err == nil || !strings.HasPrefix(err.Error(), "manifest: ") {
+		t.Errorf("manifest under a file: %v", err)
+	}
+}
+
+func TestManifestFiles(t *testing.T) {
+	config := perf.Config{
+		CSVFile:     "out.csv",
+		ResultsFile: perf.SinkPath{Path: "/var/lib/yaperf/results.jsonl.gz"},
+		SamplesFile: "samples.jsonl",
+		HistoryDB:   "history.db",
+		Heatmap:     &perf.Heatmap{Dir: "heat"},
+	}
+	wd, _ := os.Getwd()
+	want := []manifestFile{
+		{"csv_file", filepath.Join(wd, "out.csv")},
+		{"results_file", "/var/lib/yaperf/results.jsonl.gz"},
+		{"samples_file", filepath.Join(wd, "samples.jsonl")},
+		{"history_db", filepath.Join(wd, "history.db")},
+		{"heatmap", filepath.Join(wd, "heat")},
+		{"report", filepath.Join(wd, "report.html")},
+		{"baseline", "/etc/yaperf/baseline.json"},
+	}
+	got := manifestFiles(config, "report.html", "/etc/yaperf/baseline.json")
+	if len(got) != len(want) {
+		t.Fatalf("files %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("file %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+var durationBuckets = []float64{1, 2, 5, 10, 30, 60, 120, 300, 600}
+
+// seriesKey names one series. family is set on the copies of a
+// dualstack_compare target, which share their URL, and agent on results
+// collected from agents.
+type seriesKey struct {
+	url       string
+	direction perf.Direction
+	family    string
+	agent     string
+}
+
+// errorKey is one series of the error counter, which is also labeled with
+// the kind of error.
+type errorKey struct {
+	seriesKey
+	kind perf.ErrorKind
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metrics keeps the Prometheus series derived from the Stats stream.
+type metrics struct {
+	mu        sync.Mutex
+	current   map[seriesKey]float64
+	lastSpeed map[seriesKey]float64
+	lastUtil  map[seriesKey]float64
+	lastBytes map[seriesKey]float64
+	lastPeak  map[seriesKey]float64
+	lastRamp  map[seriesKey]float64
+	completed map[seriesKey]float64
+	errors    map[errorKey]float64
+	retries   map[seriesKey]float64
+	durations map[seriesKey]*histogram
+	groups    map[seriesKey]string
+	alerts    map[seriesKey]perf.AlertState
+	// grades are the latency grades of the last graded transfers.
+	grades map[seriesKey]string
+	// score is the composite score of the last pass, if any.
+	score *float64
+	// sinks are the run's sinks, whose dropped progress snapshots are
+	// counted and whose states are reported.
+	sinks *sinkSet
+	// pause reports whether the run is paused.
+	pause *pauser
+	// budget, if any, is the data budget whose remaining bytes are
+	// exported.
+	budget *dataBudget
+	// outbox, if any, is the queue whose depth is reported.
+	outbox *outbox
+	// breaker, if any, is the circuit breaker of probe_failures_threshold
+	// whose state is reported.
+	breaker *perf.Breaker
+	// static holds the host and config labels rendered once for every
+	// series; the run ID goes on yaperf_run_info only so restarts do not
+	// start new series.
+	static string
+	runID  string
+}
+
+func newMetrics(runID, host string, labels map[string]string) *metrics {
+	var static strings.Builder
+	if host != "" {
+		fmt.Fprintf(&static, ",host=\"%s\"", labelEscaper.Replace(host))
+	}
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		fmt.Fprintf(&static, ",%s=\"%s\"", k, labelEscaper.Replace(labels[k]))
+	}
+	return &metrics{
+		static:    static.String(),
+		runID:     runID,
+		current:   map[seriesKey]float64{},
+		lastSpeed: map[seriesKey]float64{},
+		lastUtil:  map[seriesKey]float64{},
+		lastBytes: map[seriesKey]float64{},
+		lastPeak:  map[seriesKey]float64{},
+		lastRamp:  map[seriesKey]float64{},
+		completed: map[seriesKey]float64{},
+		errors:    map[errorKey]float64{},
+		retries:   map[seriesKey]float64{},
+		durations: map[seriesKey]*histogram{},
+		groups:    map[seriesKey]string{},
+		alerts:    map[seriesKey]perf.AlertState{},
+		grades:    map[seriesKey]string{},
+	}
+}
+
+func (m *metrics) Write(result perf.Stats) error {
+	key := seriesKey{result.DisplayName(), result.Direction, result.Family, result.Agent}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if result.Group != "" {
+		m.groups[key] = result.Group
+	}
+	if result.Alert != nil {
+		m.alerts[key] = result.Alert.State
+	}
+	if result.LatencyGrade != nil {
+		m.grades[key] = result.LatencyGrade.Grade
+	}
+
+	switch result.Kind {
+	case perf.KindRetry:
+		m.current[key] = 0
+		m.retries[key]++
+	case perf.KindCancelled, perf.KindSkipped:
+		m.current[key] = 0
+	case perf.KindError:
+		m.current[key] = 0
+		m.errors[errorKey{key, result.ErrorKind}]++
+	case perf.KindFinal:
+		m.current[key] = 0
+		m.lastSpeed[key] = result.SpeedMbps
+		if result.Utilization > 0 {
+			m.lastUtil[key] = result.Utilization
+		}
+		m.lastBytes[key] = float64(result.SizeBytes)
+		m.lastPeak[key] = result.PeakMbps
+		if result.TimeToPeak > 0 {
+			m.lastRamp[key] = result.TimeToPeak.Seconds()
+		}
+		m.completed[key]++
+		h := m.durations[key]
+		if h == nil {
+			h = &histogram{counts: make([]uint64, len(durationBuckets))}
+			m.durations[key] = h
+		}
+		seconds := result.Elapsed.Seconds()
+		for i, bound := range durationBuckets {
+			if seconds <= bound {
+				h.counts[i]++
+			}
+		}
+		h.sum += seconds
+		h.count++
+	case perf.KindProgress:
+		m.current[key] = result.IntervalSpeedMbps
+	}
+	return nil
+}
+
+// watch adds the dropped progress snapshots and the states of sinks to the
+// metrics.
+func (m *metrics) watch(sinks *sinkSet) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sinks = sinks
+}
+
+// OnPass keeps the composite score of the pass.
+func (m *metrics) OnPass(table resultTable) {
+	if table.Score == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.score = &table.Score.Score
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP yaperf_run_info The run this process reports.")
+	fmt.Fprintln(w, "# TYPE yaperf_run_info gauge")
+	fmt.Fprintf(w, "yaperf_run_info{run_id=\"%s\"%s} 1\n", m.runID, m.static)
+	if m.pause != nil {
+		m.pause.check()
+		paused := 0
+		if ok, _ := m.pause.paused(); ok {
+			paused = 1
+		}
+		fmt.Fprintln(w, "# HELP yaperf_paused Whether the run is paused, by signal or pause_file.")
+		fmt.Fprintln(w, "# TYPE yaperf_paused gauge")
+		fmt.Fprintf(w, "yaperf_paused{%s} %d\n", strings.TrimPrefix(m.static, ","), paused)
+	}
+	if m.outbox != nil {
+		entries, evicted := m.outbox.depth()
+		fmt.Fprintln(w, "# HELP yaperf_outbox_entries Entries waiting in the outbox for delivery.")
+		fmt.Fprintln(w, "# TYPE yaperf_outbox_entries gauge")
+		fmt.Fprintf(w, "yaperf_outbox_entries{%s} %d\n", strings.TrimPrefix(m.static, ","), entries)
+		fmt.Fprintln(w, "# HELP yaperf_outbox_evicted_total Entries dropped from the full outbox before delivery.")
+		fmt.Fprintln(w, "# TYPE yaperf_outbox_evicted_total counter")
+		fmt.Fprintf(w, "yaperf_outbox_evicted_total{%s} %d\n", strings.TrimPrefix(m.static, ","), evicted)
+	}
+	if m.breaker != nil {
+		state := m.breaker.State()
+		down := 0
+		if state.Down {
+			down = 1
+		}
+		fmt.Fprintln(w, "# HELP yaperf_link_down Whether probe_failures_threshold has found the link down.")
+		fmt.Fprintln(w, "# TYPE yaperf_link_down gauge")
+		fmt.Fprintf(w, "yaperf_link_down{%s} %d\n", strings.TrimPrefix(m.static, ","), down)
+		fmt.Fprintln(w, "# HELP yaperf_link_down_total Times probe_failures_threshold found the link down.")
+		fmt.Fprintln(w, "# TYPE yaperf_link_down_total counter")
+		fmt.Fprintf(w, "yaperf_link_down_total{%s} %d\n", strings.TrimPrefix(m.static, ","), state.Trips)
+	}
+	if m.budget != nil {
+		fmt.Fprintln(w, "# HELP yaperf_budget_remaining_bytes Bytes left of the day's data_budget.")
+		fmt.Fprintln(w, "# TYPE yaperf_budget_remaining_bytes gauge")
+		fmt.Fprintf(w, "yaperf_budget_remaining_bytes{%s} %d\n", strings.TrimPrefix(m.static, ","), m.budget.remaining(time.Now()))
+	}
+	m.writeFamily(w, "yaperf_current_speed_mbps", "gauge", "Speed over the last progress interval in megabits per second.", m.current)
+	m.writeFamily(w, "yaperf_last_speed_mbps", "gauge", "Average speed of the last completed transfer in megabits per second.", m.lastSpeed)
+	if len(m.lastUtil) > 0 {
+		m.writeFamily(w, "yaperf_last_utilization_percent", "gauge", "Average speed of the last completed transfer as a percentage of link_capacity.", m.lastUtil)
+	}
+	m.writeFamily(w, "yaperf_last_peak_speed_mbps", "gauge", "Fastest speed over three seconds of the last completed transfer in megabits per second.", m.lastPeak)
+	m.writeFamily(w, "yaperf_last_time_to_peak_seconds", "gauge", "Time the last completed transfer took to come within 95% of its peak speed.", m.lastRamp)
+	m.writeFamily(w, "yaperf_last_download_bytes", "gauge", "Size of the last completed transfer in bytes.", m.lastBytes)
+	m.writeFamily(w, "yaperf_downloads_completed_total", "counter", "Transfers that completed successfully.", m.completed)
+	fmt.Fprintln(w, "# HELP yaperf_download_errors_total Transfers that failed, by kind of error.")
+	fmt.Fprintln(w, "# TYPE yaperf_download_errors_total counter")
+	errors := slices.SortedFunc(maps.Keys(m.errors), func(a, b errorKey) int {
+		if c := compareKeys(a.seriesKey, b.seriesKey); c != 0 {
+			return c
+		}
+		return strings.Compare(string(a.kind), string(b.kind))
+	})
+	for _, key := range errors {
+		fmt.Fprintf(w, "yaperf_download_errors_total{%s,kind=\"%s\"} %g\n", m.labels(key.seriesKey), key.kind, m.errors[key])
+	}
+	if len(m.alerts) > 0 {
+		fmt.Fprintln(w, "# HELP yaperf_alert_state Error budget state of the URL, 1 for the state it is in.")
+		fmt.Fprintln(w, "# TYPE yaperf_alert_state gauge")
+		for _, key := range sortedKeys(m.alerts) {
+			for _, state := range perf.AlertStates {
+				in := 0
+				if m.alerts[key] == state {
+					in = 1
+				}
+				fmt.Fprintf(w, "yaperf_alert_state{%s,state=\"%s\"} %d\n", m.labels(key), state, in)
+			}
+		}
+	}
+	if len(m.grades) > 0 {
+		fmt.Fprintln(w, "# HELP yaperf_latency_grade Latency grade of the last transfer with bufferbloat probes, 1 for the grade it got.")
+		fmt.Fprintln(w, "# TYPE yaperf_latency_grade gauge")
+		for _, key := range sortedKeys(m.grades) {
+			for _, grade := range perf.Grades {
+				got := 0
+				if m.grades[key] == grade {
+					got = 1
+				}
+				fmt.Fprintf(w, "yaperf_latency_grade{%s,grade=\"%s\"} %d\n", m.labels(key), grade, got)
+			}
+		}
+	}
+	m.writeFamily(w, "yaperf_download_retries_total", "counter", "Failed attempts that were retried.", m.retries)
+	fmt.Fprintln(w, "# HELP yaperf_sink_dropped_total Progress snapshots dropped for sinks that fell behind.")
+	fmt.Fprintln(w, "# TYPE yaperf_sink_dropped_total counter")
+	if m.sinks != nil {
+		for _, s := range m.sinks.reporters {
+			fmt.Fprintf(w, "yaperf_sink_dropped_total{sink=\"%s\"%s} %d\n", s.name, m.static, s.dropped.Load())
+		}
+		fmt.Fprintln(w, "# HELP yaperf_sink_degraded Whether a sink failed to set up or to close, 1 if so.")
+		fmt.Fprintln(w, "# TYPE yaperf_sink_degraded gauge")
+		for _, s := range m.sinks.list() {
+			degraded := 0
+			if s.Status != sinkOK {
+				degraded = 1
+			}
+			fmt.Fprintf(w, "yaperf_sink_degraded{sink=\"%s\",required=\"%t\"%s} %d\n", s.Name, s.Required, m.static, degraded)
+		}
+	}
+	if m.score != nil {
+		fmt.Fprintln(w, "# HELP yaperf_composite_score Composite score of the last pass, a weighted geometric mean of speeds in megabits per second.")
+		fmt.Fprintln(w, "# TYPE yaperf_composite_score gauge")
+		fmt.Fprintf(w, "yaperf_composite_score{%s} %g\n", strings.TrimPrefix(m.static, ","), *m.score)
+	}
+
+	fmt.Fprintln(w, "# HELP yaperf_download_duration_seconds Duration of completed transfers.")
+	fmt.Fprintln(w, "# TYPE yaperf_download_duration_seconds histogram")
+	for _, key := range sortedKeys(m.durations) {
+		h := m.durations[key]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "yaperf_download_duration_seconds_bucket{%s,le=\"%g\"} %d\n", m.labels(key), bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "yaperf_download_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", m.labels(key), h.count)
+		fmt.Fprintf(w, "yaperf_download_duration_seconds_sum{%s} %g\n", m.labels(key), h.sum)
+		fmt.Fprintf(w, "yaperf_download_duration_seconds_count{%s} %d\n", m.labels(key), h.count)
+	}
+}
+
+func (m *metrics) writeFamily(w io.Writer, name, kind, help string, values map[seriesKey]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s} %g\n", name, m.labels(key), values[key])
+	}
+}
+
+func sortedKeys[V any](m map[seriesKey]V) []seriesKey {
+	keys := make([]seriesKey, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, compareKeys)
+	return keys
+}
+
+func compareKeys(a, b seriesKey) int {
+	if c := strings.Compare(a.url, b.url); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.agent, b.agent); c != 0 {
+		return c
+	}
+	return strings.Compare(string(a.direction), string(b.direction))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels renders the labels of one series. The url label carries the
+// target's name when it has one.
+func (m *metrics) labels(key seriesKey) string {
+	group := ""
+	if g, ok := m.groups[key]; ok {
+		group = fmt.Sprintf(",group=\"%s\"", labelEscaper.Replace(g))
+	}
+	family := ""
+	if key.family != "" {
+		family = fmt.Sprintf(",family=\"%s\"", key.family)
+	}
+	agent := ""
+	if key.agent != "" {
+		agent = fmt.Sprintf(",agent=\"%s\"", labelEscaper.Replace(key.agent))
+	}
+	return fmt.Sprintf("url=\"%s\",direction=\"%s\"%s%s%s%s", labelEscaper.Replace(key.url), key.direction, family, agent, group, m.static)
+}
+
+// serveMetrics listens on addr straight away so a bad address fails at
+// startup, then serves /metrics until the returned stop func is called.
+func serveMetrics(addr string, m *metrics) (func(), error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("metrics_listen: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+
+	return func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}, nil
+}
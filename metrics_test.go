@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func scrape(t *testing.T, m *metrics) string {
+	t.Helper()
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("content type %q", ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetricsExpositionGolden(t *testing.T) {
+	m := newMetrics("run-1", "edge-1", map[string]string{"site": "lab", "rack": `7"b`})
+	a := perf.Stats{URL: "https://mirror.example.com/100MB.bin", Name: "mirror", Group: "cdn", Direction: perf.Download}
+	with := func(s perf.Stats, f func(*perf.Stats)) perf.Stats {
+		f(&s)
+		return s
+	}
+	for _, r := range []perf.Stats{
+		with(a, func(s *perf.Stats) { s.Kind, s.IntervalSpeedMbps = perf.KindProgress, 90 }),
+		with(a, func(s *perf.Stats) {
+			s.Kind, s.Done, s.SpeedMbps, s.SizeBytes, s.Elapsed = perf.KindFinal, true, 95.5, 100000000, 8*time.Second
+			s.PeakMbps, s.TimeToPeak, s.Utilization = 110, 1500*time.Millisecond, 9.55
+			s.Alert = &perf.Alert{State: perf.AlertOK}
+			s.LatencyGrade = &perf.LatencyGrade{Grade: "B"}
+		}),
+		with(a, func(s *perf.Stats) {
+			s.Kind, s.Error, s.ErrorKind = perf.KindRetry, errors.New("reset"), perf.ErrorRead
+		}),
+		with(a, func(s *perf.Stats) {
+			s.Kind, s.Error, s.ErrorKind = perf.KindError, errors.New("timeout"), perf.ErrorTimeout
+		}),
+		// Progress of another transfer that is still running.
+		{URL: "https://upload.example.com/", Direction: perf.Upload, Kind: perf.KindProgress, IntervalSpeedMbps: 12.25, Agent: "edge-2"},
+		{URL: "https://v6.example.com/", Direction: perf.Download, Family: "ipv6", Kind: perf.KindFinal, Done: true, SpeedMbps: 40, Elapsed: 45 * time.Second},
+	} {
+		if err := m.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.OnPass(resultTable{Score: &compositeScore{Score: 61.8}})
+	golden(t, "metrics.golden.txt", []byte(scrape(t, m)))
+}
+
+func TestMetricsSeries(t *testing.T) {
+	m := newMetrics("run-1", "", nil)
+	a := perf.Stats{URL: "https://example.com/a", Direction: perf.Download}
+	progress := a
+	progress.Kind, progress.IntervalSpeedMbps = perf.KindProgress, 50
+	final := a
+	final.Kind, final.Done, final.SpeedMbps, final.Elapsed = perf.KindFinal, true, 70, 3*time.Second
+	for _, r := range []perf.Stats{progress, final, progress} {
+		m.Write(r)
+	}
+	body := scrape(t, m)
+	for _, want := range []string{
+		`yaperf_run_info{run_id="run-1"} 1`,
+		`yaperf_current_speed_mbps{url="https://example.com/a",direction="download"} 50`,
+		`yaperf_last_speed_mbps{url="https://example.com/a",direction="download"} 70`,
+		`yaperf_download_duration_seconds_bucket{url="https://example.com/a",direction="download",le="2"} 0`,
+		`yaperf_download_duration_seconds_bucket{url="https://example.com/a",direction="download",le="5"} 1`,
+		`yaperf_download_duration_seconds_bucket{url="https://example.com/a",direction="download",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("scrape lacks %s:\n%s", want, body)
+		}
+	}
+	// Families without data are left out, not exported as zero.
+	for _, absent := range []string{"yaperf_last_utilization_percent", "yaperf_alert_state", "yaperf_composite_score", "yaperf_paused"} {
+		if strings.Contains(body, absent) {
+			t.Errorf("scrape has %s with no data for it", absent)
+		}
+	}
+	// A cancelled run brings the current speed back to zero.
+	cancelled := a
+	cancelled.Kind = perf.KindCancelled
+	m.Write(cancelled)
+	if body := scrape(t, m); !strings.Contains(body, `yaperf_current_speed_mbps{url="https://example.com/a",direction="download"} 0`+"\n") {
+		t.Errorf("current speed not reset:\n%s", body)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	if _, err := serveMetrics("256.0.0.1:http", newMetrics("r", "", nil)); err == nil || !strings.HasPrefix(err.Error(), "metrics_listen: ") {
+		t.Errorf("err = %v, want a metrics_listen error", err)
+	}
+	stop, err := serveMetrics("127.0.0.1:0", newMetrics("r", "", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+}
+
+func TestMetricsFamily(t *testing.T) {
+	m := newMetrics("run-1", "", nil)
+	for family, mbps := range map[string]float64{perf.FamilyIPv4: 80, perf.FamilyIPv6: 100} {
+		m.Write(perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/a", Name: "a", Direction: perf.Download, Family: family, Done: true, SpeedMbps: mbps})
+	}
+	body := scrape(t, m)
+	for _, want := range []string{
+		`yaperf_last_speed_mbps{url="a",direction="download",family="ipv4"} 80`,
+		`yaperf_last_speed_mbps{url="a",direction="download",family="ipv6"} 100`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("scrape lacks %s:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsUtilization(t *testing.T) {
+	m := newMetrics("run-1", "", nil)
+	m.Write(perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/a", Direction: perf.Download, Done: true, SpeedMbps: 812})
+	if body := scrape(t, m); strings.Contains(body, "yaperf_last_utilization_percent") {
+		t.Errorf("utilization without a plan:\n%s", body)
+	}
+	m.Write(perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/a", Direction: perf.Download, Done: true, SpeedMbps: 812, Utilization: 81.2})
+	if want := `yaperf_last_utilization_percent{url="https://example.com/a",direction="download"} 81.2`; !strings.Contains(scrape(t, m), want+"\n") {
+		t.Errorf("scrape lacks %s", want)
+	}
+}
+
+func TestMetricsPeak(t *testing.T) {
+	m := newMetrics("run-1", "", nil)
+	m.Write(perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/a", Direction: perf.Download, Done: true, SpeedMbps: 40, PeakMbps: 52.5, TimeToPeak: 4250 * time.Millisecond})
+	body := scrape(t, m)
+	for _, want := range []string{
+		`yaperf_last_peak_speed_mbps{url="https://example.com/a",direction="download"} 52.5`,
+		`yaperf_last_time_to_peak_seconds{url="https://example.com/a",direction="download"} 4.25`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("scrape lacks %s:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// OTLP span kinds and status codes, as the wire format numbers them.
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+	statusError      = 2
+)
+
+// otelSink exports a trace per final result over OTLP/HTTP in its JSON
+// encoding: a client span for the transfer with a child span for each of
+// its dns, connect, tls, ttfb and transfer phases. Spans are batched and
+// posted from a background goroutine, and flushed on Close.
+type otelSink struct {
+	endpoint string
+	headers  map[string]string
+	resource []otelAttr
+	client   *http.Client
+
+	mu    sync.Mutex
+	spans []otelSpan
+	full  chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// otelBatch is how many spans are buffered before a post.
+const otelBatch = 256
+
+type otelSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otelAttr `json:"attributes,omitempty"`
+	Status       otelStatus `json:"status"`
+}
+
+type otelStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// otelAttr is a key and a value holding one of stringValue, intValue or
+// doubleValue.
+type otelAttr struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func stringAttr(key, value string) otelAttr {
+	return otelAttr{key, map[string]any{"stringValue": value}}
+}
+
+func intAttr(key string, value int64) otelAttr {
+	// JSON carries 64-bit integers as strings.
+	return otelAttr{key, map[string]any{"intValue": strconv.FormatInt(value, 10)}}
+}
+
+func doubleAttr(key string, value float64) otelAttr {
+	return otelAttr{key, map[string]any{"doubleValue": value}}
+}
+
+func newOTelSink(cfg perf.OTel, runID, host string) (*otelSink, error) {
+	endpoint := cfg.Endpoint
+	if !isRemote(endpoint) {
+		scheme := "https://"
+		if cfg.Insecure {
+			scheme = "http://"
+		}
+		endpoint = scheme + endpoint
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	if err := checkOTelEndpoint(endpoint); err != nil {
+		return nil, err
+	}
+	resource := []otelAttr{stringAttr("service.name", cmp.Or(cfg.ServiceName, "yaperf")), stringAttr("yaperf.run_id", runID)}
+	if host != "" {
+		resource = append(resource, stringAttr("host.name", host))
+	}
+	s := &otelSink{
+		endpoint: endpoint,
+		headers:  cfg.Headers,
+		resource: resource,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		full:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.loop()
+	return s, nil
+}
+
+func checkOTelEndpoint(endpoint string) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, nil)
+	if err != nil || req.URL.Host == "" {
+		return fmt.Errorf("otel: invalid endpoint %q", endpoint)
+	}
+	return nil
+}
+
+func (s *otelSink) Write(result perf.Stats) error {
+	if !result.Final() || result.Skipped {
+		return nil
+	}
+	spans := s.trace(result, time.Now())
+
+	s.mu.Lock()
+	s.spans = append(s.spans, spans...)
+	full := len(s.spans) >= otelBatch
+	s.mu.Unlock()
+	if full {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// trace builds the spans of result, which arrived at end. The phases are
+// laid out from Started in the order they happen; a reused connection
+// has no dns, connect or tls span.
+func (s *otelSink) trace(result perf.Stats, end time.Time) []otelSpan {
+	traceID, rootID := randomID(16), randomID(8)
+	start := result.Started
+	if start.IsZero() || start.After(end) {
+		start = end.Add(-result.TTFB - result.Elapsed)
+	}
+	root := otelSpan{
+		TraceID: traceID, SpanID: rootID, Kind: spanKindClient,
+		Name:  fmt.Sprintf("%s %s", result.Direction, result.DisplayName()),
+		Start: unixNano(start), End: unixNano(end),
+		Attributes: []otelAttr{
+			stringAttr("url.full", result.URL),
+			stringAttr("yaperf.direction", string(result.Direction)),
+			intAttr("yaperf.bytes", result.SizeBytes),
+			doubleAttr("yaperf.speed_mbps", result.SpeedMbps),
+			intAttr("yaperf.elapsed_ms", result.Elapsed.Milliseconds()),
+		},
+	}
+	if result.Name != "" {
+		root.Attributes = append(root.Attributes, stringAttr("yaperf.name", result.Name))
+	}
+	if result.Group != "" {
+		root.Attributes = append(root.Attributes, stringAttr("yaperf.group", result.Group))
+	}
+	if result.Protocol != "" {
+		root.Attributes = append(root.Attributes, stringAttr("yaperf.protocol", result.Protocol))
+	}
+	if result.RemoteAddr != "" {
+		root.Attributes = append(root.Attributes, stringAttr("network.peer.address", result.RemoteAddr))
+	}
+	for _, k := range slices.Sorted(maps.Keys(result.Labels)) {
+		root.Attributes = append(root.Attributes, stringAttr("yaperf.label."+k, result.Labels[k]))
+	}
+	if result.Error != nil {
+		root.Status = otelStatus{Code: statusError, Message: result.Error.Error()}
+		root.Attributes = append(root.Attributes, stringAttr("error.type", string(result.ErrorKind)))
+	}
+	spans := []otelSpan{root}
+
+	child := func(name string, from, to time.Time) {
+		if to.After(end) {
+			to = end
+		}
+		if !to.After(from) {
+			return
+		}
+		spans = append(spans, otelSpan{
+			TraceID: traceID, SpanID: randomID(8), ParentSpanID: rootID, Kind: spanKindInternal,
+			Name: name, Start: unixNano(from), End: unixNano(to),
+		})
+	}
+	at := start
+	for _, phase := range []struct {
+		name string
+		d    time.Duration
+	}{{"dns", result.DNSLookup}, {"connect", result.TCPConnect}, {"tls", result.TLSHandshake}} {
+		child(phase.name, at, at.Add(phase.d))
+		at = at.Add(phase.d)
+	}
+	if result.TTFB > 0 {
+		child("ttfb", at, start.Add(result.TTFB))
+	}
+	if result.Direction != perf.Latency {
+		child("transfer", end.Add(-result.Elapsed), end)
+	}
+	return spans
+}
+
+func (s *otelSink) loop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			s.flush()
+			return
+		case <-ticker.C:
+			s.flush()
+		case <-s.full:
+			s.flush()
+		}
+	}
+}
+
+func (s *otelSink) flush() {
+	s.mu.Lock()
+	spans := s.spans
+	s.spans = nil
+	s.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	if err := s.post(spans); err != nil {
+		slog.Error("otel: dropped spans", "spans", len(spans), "err", err)
+	}
+}
+
+func (s *otelSink) post(spans []otelSpan) error {
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource":   map[string]any{"attributes": s.resource},
+			"scopeSpans": []any{map[string]any{"scope": map[string]string{"name": "yaperf"}, "spans": spans}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Close exports any buffered spans and stops the background exporter.
+func (s *otelSink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return nil
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// randomID returns n random bytes in hex, as OTLP/JSON encodes trace and
+// span ids.
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
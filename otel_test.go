@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// otelCollector records the requests an OTLP/HTTP exporter posts.
+type otelCollector struct {
+	*httptest.Server
+	mu     sync.Mutex
+	posts  [][]byte
+	header http.Header
+	path   string
+}
+
+func newOTelCollector(t *testing.T) *otelCollector {
+	c := &otelCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.posts = append(c.posts, body)
+		c.header, c.path = r.Header, r.URL.Path
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+var otelID = regexp.MustCompile(`"(traceId|spanId|parentSpanId)": "([0-9a-f]*)"`)
+
+// stableIDs replaces the random ids of an indented OTLP document with
+// names numbered in order of appearance, so spans keep their parents. It
+// fails on ids of the wrong length.
+func stableIDs(t *testing.T, doc []byte) []byte {
+	t.Helper()
+	names, counts := map[string]string{}, map[string]int{}
+	return otelID.ReplaceAllFunc(doc, func(m []byte) []byte {
+		sub := otelID.FindSubmatch(m)
+		field, id := string(sub[1]), string(sub[2])
+		kind, size := "span", 16
+		if field == "traceId" {
+			kind, size = "trace", 32
+		}
+		if len(id) != size {
+			t.Errorf("%s %q is not %d hex digits", field, id, size)
+		}
+		name, ok := names[id]
+		if !ok {
+			counts[kind]++
+			name = fmt.Sprintf("%s-%d", kind, counts[kind])
+			names[id] = name
+		}
+		return fmt.Appendf(nil, "%q: %q", field, name)
+	})
+}
+
+func TestOTelSpansGolden(t *testing.T) {
+	collector := newOTelCollector(t)
+	s, err := newOTelSink(perf.OTel{Endpoint: strings.TrimPrefix(collector.URL, "http://"), Insecure: true, ServiceName: "probe"}, "run-1", "edge-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	end := started.Add(2 * time.Second)
+	results := []perf.Stats{
+		{
+			URL: "https://mirror.example.com/100MB.bin", Name: "mirror", Group: "cdn", Direction: perf.Download, Done: true,
+			SizeBytes: 25000000, SpeedMbps: 109.09, Protocol: "HTTP/2.0", RemoteAddr: "192.0.2.1:443",
+			Labels:  map[string]string{"site": "lab", "rack": "7"},
+			Started: started, DNSLookup: 10 * time.Millisecond, TCPConnect: 20 * time.Millisecond, TLSHandshake: 30 * time.Millisecond,
+			TTFB: 170 * time.Millisecond, Elapsed: 1830 * time.Millisecond,
+		},
+		{
+			// A reused connection, failing: no dns, connect or tls span,
+			// and an error status.
+			URL: "https://upload.example.com/", Direction: perf.Upload, Done: true,
+			SizeBytes: 1000000, Error: errors.New("unexpected status 500"), ErrorKind: perf.ErrorHTTPStatus,
+			Started: started, TTFB: 500 * time.Millisecond, Elapsed: time.Second,
+		},
+		{
+			// No start recorded: the span ends at arrival and reaches back
+			// over the ttfb, with no transfer span for a latency probe.
+			URL: "https://mirror.example.com/", Direction: perf.Latency, Done: true, TTFB: 40 * time.Millisecond,
+		},
+	}
+	var spans []otelSpan
+	for _, r := range results {
+		spans = append(spans, s.trace(r, end)...)
+	}
+	if err := s.post(spans); err != nil {
+		t.Fatal(err)
+	}
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	if collector.path != "/v1/traces" || collector.header.Get("Content-Type") != "application/json" {
+		t.Errorf("posted to %s as %q", collector.path, collector.header.Get("Content-Type"))
+	}
+	var doc bytes.Buffer
+	if err := json.Indent(&doc, collector.posts[0], "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	doc.WriteByte('\n')
+	golden(t, "otel.golden.json", stableIDs(t, doc.Bytes()))
+}
+
+func TestOTelSinkExportsFinals(t *testing.T) {
+	collector := newOTelCollector(t)
+	s, err := newOTelSink(perf.OTel{Endpoint: collector.URL + "/", Headers: map[string]string{"Authorization": "Bearer k"}}, "run-1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress := perf.Stats{URL: "https://example.com/a", Direction: perf.Download, SizeBytes: 10, Elapsed: time.Second}
+	final := progress
+	final.Done = true
+	skipped := perf.Stats{URL: "https://example.com/b", Direction: perf.Download, Skipped: true}
+	for _, r := range []perf.Stats{progress, final, skipped} {
+		if err := s.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Close flushes what is buffered.
+	s.Close()
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	if len(collector.posts) != 1 || collector.header.Get("Authorization") != "Bearer k" || collector.path != "/v1/traces" {
+		t.Fatalf("%d posts to %s, headers %v", len(collector.posts), collector.path, collector.header)
+	}
+	var body struct {
+		ResourceSpans []struct {
+			Resource   struct{ Attributes []otelAttr }
+			ScopeSpans []struct{ Spans []otelSpan }
+		}
+	}
+	if err := json.Unmarshal(collector.posts[0], &body); err != nil {
+		t.Fatal(err)
+	}
+	spans := body.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 || spans[0].Name != "download https://example.com/a" || spans[1].Name != "transfer" {
+		t.Errorf("spans %+v, want the final download and its transfer", spans)
+	}
+	if attrs := body.ResourceSpans[0].Resource.Attributes; len(attrs) != 2 || attrs[0].Value["stringValue"] != "yaperf" {
+		t.Errorf("resource %+v, want the default service name and no host", attrs)
+	}
+}
+
+func TestOTelEndpoint(t *testing.T) {
+	tests := []struct {
+		cfg  perf.OTel
+		want string
+	}{
+		{perf.OTel{Endpoint: "collector:4318"}, "https://collector:4318/v1/traces"},
+		{perf.OTel{Endpoint: "collector:4318", Insecure: true}, "http://collector:4318/v1/traces"},
+		{perf.OTel{Endpoint: "https://collector.example/otlp/"}, "https://collector.example/otlp/v1/traces"},
+		{perf.OTel{Endpoint: "http://collector:4318/v1/traces"}, "http://collector:4318/v1/traces"},
+	}
+	for _, tt := range tests {
+		s, err := newOTelSink(tt.cfg, "run", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+		if s.endpoint != tt.want {
+			t.Errorf("%+v: endpoint %s, want %s", tt.cfg, s.endpoint, tt.want)
+		}
+	}
+	if _, err := newOTelSink(perf.OTel{Endpoint: "http://[bad"}, "run", ""); err == nil {
+		t.Error("accepted an invalid endpoint")
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// outboxEntry is one queued delivery, kept as JSON in a file of its own.
+type outboxEntry struct {
+	ID     string    `json:"id"`
+	Sink   string    `json:"sink"`
+	Queued time.Time `json:"queued"`
+	Body   []byte    `json:"body"`
+}
+
+// outboxSender delivers the body of an entry. id stays the same across
+// retries, so a backend can tell a redelivery from a new entry.
+type outboxSender func(id string, body []byte) error
+
+// outbox queues what remote sinks send as files in dir, named so that
+// they sort in the order they were queued, and delivers them from a
+// background goroutine. Each sink's entries go out in order: after a
+// failure its later entries wait for the retry, while other sinks carry
+// on.
+type outbox struct {
+	dir                 string
+	max                 int
+	backoff, maxBackoff time.Duration
+	senders             map[string]outboxSender
+	// retries holds the backoff of each sink whose last delivery failed.
+	// Only the delivering goroutine uses it.
+	retries map[string]*outboxRetry
+
+	mu sync.Mutex
+	// names are the files of the queued entries, oldest first.
+	names   []string
+	last    int64
+	evicted int64
+
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type outboxRetry struct {
+	delay time.Duration
+	next  time.Time
+}
+
+// openOutbox opens the queue in the dir of cfg, which defaults to outbox
+// in cacheDir, picking up the entries a previous run left.
+func openOutbox(cfg perf.Outbox, cacheDir string) (*outbox, error) {
+	o := &outbox{
+		dir:        cfg.Dir,
+		max:        cfg.MaxEntries,
+		backoff:    cfg.RetryBackoff,
+		maxBackoff: cfg.MaxBackoff,
+		senders:    map[string]outboxSender{},
+		retries:    map[string]*outboxRetry{},
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	if o.dir == "" {
+		if cacheDir == "" {
+			return nil, errors.New("outbox needs a dir when there is no cache directory")
+		}
+		o.dir = filepath.Join(cacheDir, "outbox")
+	}
+	if o.max == 0 {
+		o.max = 1000
+	}
+	if o.backoff == 0 {
+		o.backoff = time.Second
+	}
+	if o.maxBackoff == 0 {
+		o.maxBackoff = max(5*time.Minute, o.backoff)
+	}
+	if err := os.MkdirAll(o.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("outbox: %w", err)
+	}
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, fmt.Errorf("outbox: %w", err)
+	}
+	for _, e := range entries {
+		switch filepath.Ext(e.Name()) {
+		case ".json":
+			o.names = append(o.names, e.Name())
+		case ".tmp":
+			// A write cut short by a crash; its entry was never queued.
+			os.Remove(filepath.Join(o.dir, e.Name()))
+		}
+	}
+	if n := len(o.names); n > 0 {
+		stamp, _, _ := strings.Cut(o.names[n-1], "-")
+		o.last, _ = strconv.ParseInt(stamp, 10, 64)
+		slog.Info("outbox: delivering entries left by the last run", "entries", n, "dir", o.dir)
+	}
+	return o, nil
+}
+
+// register names the sink whose entries send delivers. Every sink is
+// registered before start.
+func (o *outbox) register(sink string, send outboxSender) {
+	o.senders[sink] = send
+}
+
+// start delivers the queue, beginning with what a previous run left.
+func (o *outbox) start() {
+	o.wg.Add(1)
+	go o.loop()
+}
+
+// add queues body for sink under a new ID, dropping the oldest entries
+// past the size of the queue.
+func (o *outbox) add(sink string, body []byte) error {
+	entry := outboxEntry{ID: perf.NewRunID(), Sink: sink, Queued: time.Now(), Body: body}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	// Names sort by when they were queued, even if the clock steps back.
+	o.last = max(o.last+1, entry.Queued.UnixNano())
+	name := fmt.Sprintf("%020d-%s.json", o.last, entry.ID)
+	tmp := filepath.Join(o.dir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(o.dir, name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("outbox: %w", err)
+	}
+	o.names = append(o.names, name)
+	for len(o.names) > o.max {
+		os.Remove(filepath.Join(o.dir, o.names[0]))
+		o.names = o.names[1:]
+		o.evicted++
+		slog.Warn("outbox: full, dropped its oldest entry", "max_entries", o.max)
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// depth is the number of entries waiting to be delivered, and evictions
+// the number dropped to keep the queue within its size.
+func (o *outbox) depth() (entries int, evictions int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.names), o.evicted
+}
+
+func (o *outbox) loop() {
+	defer o.wg.Done()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		wait := o.deliver(false)
+		timer.Stop()
+		var retry <-chan time.Time
+		if wait > 0 {
+			timer.Reset(wait)
+			retry = timer.C
+		}
+		select {
+		case <-o.done:
+			o.deliver(true)
+			return
+		case <-o.wake:
+		case <-retry:
+		}
+	}
+}
+
+// deliver sends the queued entries whose sink is not backing off, or all
+// of them when final, and returns how long until the next retry is due,
+// zero if none is.
+func (o *outbox) deliver(final bool) time.Duration {
+	o.mu.Lock()
+	names := append([]string(nil), o.names...)
+	o.mu.Unlock()
+
+	blocked := map[string]bool{}
+	for _, name := range names {
+		var entry outboxEntry
+		data, err := os.ReadFile(filepath.Join(o.dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			// Dropped while the queue was full.
+			continue
+		}
+		if err == nil {
+			err = json.Unmarshal(data, &entry)
+		}
+		if err != nil {
+			slog.Error("outbox: dropped an unreadable entry", "file", name, "err", err)
+			o.remove(name)
+			continue
+		}
+		send := o.senders[entry.Sink]
+		if send == nil || blocked[entry.Sink] {
+			// Entries of a sink no longer configured wait for it to come
+			// back, or to be dropped as the queue fills.
+			continue
+		}
+		now := time.Now()
+		if r := o.retries[entry.Sink]; r != nil && !final && now.Before(r.next) {
+			blocked[entry.Sink] = true
+			continue
+		}
+		if err := send(entry.ID, entry.Body); err != nil {
+			r := o.retries[entry.Sink]
+			if r == nil {
+				r = &outboxRetry{delay: o.backoff}
+				o.retries[entry.Sink] = r
+			} else {
+				r.delay = min(2*r.delay, o.maxBackoff)
+			}
+			r.next = now.Add(r.delay)
+			blocked[entry.Sink] = true
+			slog.Warn("outbox: delivery failed, retrying", "sink", entry.Sink, "id", entry.ID, "in", r.delay, "err", err)
+			continue
+		}
+		delete(o.retries, entry.Sink)
+		o.remove(name)
+	}
+
+	var wait time.Duration
+	for sink, r := range o.retries {
+		if !blocked[sink] {
+			// Its entries are gone.
+			delete(o.retries, sink)
+			continue
+		}
+		if d := max(time.Until(r.next), time.Millisecond); wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// remove takes the entry in file name off the queue.
+func (o *outbox) remove(name string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, n := range o.names {
+		if n == name {
+			o.names = append(o.names[:i], o.names[i+1:]...)
+			break
+		}
+	}
+	os.Remove(filepath.Join(o.dir, name))
+}
+
+// Close makes a last attempt at delivering every entry and stops. Those
+// still undelivered are sent on the next start.
+func (o *outbox) Close() error {
+	close(o.done)
+	o.wg.Wait()
+	if n, _ := o.depth(); n > 0 {
+		slog.Warn("outbox: entries left for the next start", "entries", n, "dir", o.dir)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// sinkBackend is a webhook receiver that keeps the first body of each
+// Idempotency-Key, in the order they came, dropping redeliveries.
+type sinkBackend struct {
+	mu     sync.Mutex
+	bodies []string
+	seen   map[string]string
+}
+
+func (b *sinkBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := r.Header.Get("Idempotency-Key")
+	if prev, ok := b.seen[id]; ok {
+		if prev != string(body) {
+			b.bodies = append(b.bodies, "different body under "+id)
+		}
+		return
+	}
+	b.seen[id] = string(body)
+	b.bodies = append(b.bodies, string(body))
+}
+
+func (b *sinkBackend) delivered() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.bodies)
+}
+
+// listen serves b on addr, the same address on every restart, until the
+// returned server is closed.
+func (b *sinkBackend) listen(t *testing.T, addr string) *httptest.Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(b)
+	srv.Listener.Close()
+	srv.Listener = ln
+	srv.Start()
+	return srv
+}
+
+// awaitDelivered waits for the backend to have n bodies.
+func awaitDelivered(t *testing.T, b *sinkBackend, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(b.delivered()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d entries delivered", len(b.delivered()), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestOutboxSurvivesOutagesAndRestarts(t *testing.T) {
+	dir := t.TempDir()
+	backend := &sinkBackend{seen: map[string]string{}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	cfg := perf.Outbox{Dir: dir, RetryBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	open := func() *outbox {
+		box, err := openOutbox(cfg, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newWebhook("hook", perf.Webhook{URL: "http://" + addr + "/"}, nil, box); err != nil {
+			t.Fatal(err)
+		}
+		box.start()
+		return box
+	}
+	sent := 0
+	add := func(box *outbox, n int) {
+		for range n {
+			if err := box.add("hook", fmt.Appendf(nil, `{"n":%d}`, sent)); err != nil {
+				t.Fatal(err)
+			}
+			sent++
+		}
+	}
+
+	srv := backend.listen(t, addr)
+	box := open()
+	add(box, 5)
+	awaitDelivered(t, backend, 5)
+
+	// The backend dies mid-run: entries queue up and go out once it is
+	// back.
+	srv.Close()
+	add(box, 5)
+	time.Sleep(50 * time.Millisecond)
+	if n, _ := box.depth(); n != 5 {
+		t.Fatalf("%d entries queued while the backend was down, want 5", n)
+	}
+	srv = backend.listen(t, addr)
+	awaitDelivered(t, backend, 10)
+
+	// It dies again, and yaperf stops before it is back: the entries wait
+	// on disk for the next start.
+	srv.Close()
+	add(box, 3)
+	box.Close()
+	if n, _ := box.depth(); n != 3 {
+		t.Fatalf("%d entries left at exit, want 3", n)
+	}
+	srv = backend.listen(t, addr)
+	defer srv.Close()
+	box = open()
+	awaitDelivered(t, backend, 13)
+	box.Close()
+	if n, _ := box.depth(); n != 0 {
+		t.Errorf("%d entries left", n)
+	}
+
+	var want []string
+	for i := range sent {
+		want = append(want, fmt.Sprintf(`{"n":%d}`, i))
+	}
+	if got := backend.delivered(); !slices.Equal(got, want) {
+		t.Errorf("delivered %q, want each entry once, in order:\n%q", got, want)
+	}
+}
+
+func TestOutboxDropsOldest(t *testing.T) {
+	box, err := openOutbox(perf.Outbox{Dir: t.TempDir(), MaxEntries: 3}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 5 {
+		if err := box.add("gone", fmt.Appendf(nil, "%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, evicted := box.depth(); n != 3 || evicted != 2 {
+		t.Errorf("depth %d, evicted %d, want 3 and 2", n, evicted)
+	}
+	// A new start finds the same entries, in order.
+	again, err := openOutbox(perf.Outbox{Dir: box.dir}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(again.names, box.names) {
+		t.Errorf("reopened with %q, want %q", again.names, box.names)
+	}
+}
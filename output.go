@@ -0,0 +1,934 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+type jsonResult struct {
+	Kind      string  `json:"kind"`
+	URL       string  `json:"url"`
+	Expanded  string  `json:"expanded_url,omitempty"`
+	Name      string  `json:"name,omitempty"`
+	Group     string  `json:"group,omitempty"`
+	Direction string  `json:"direction"`
+	SizeBytes int64   `json:"size_bytes"`
+	ElapsedMs int64   `json:"elapsed_ms"`
+	SpeedMbps float64 `json:"speed_mbps"`
+	SpeedMBps float64 `json:"speed_MBps"`
+	// Utilization is the speed as a percentage of link_capacity.
+	Utilization float64 `json:"utilization_percent,omitempty"`
+	// Final tells final results from the progress snapshots that streams
+	// with emit_progress carry too, whose IntervalMbps is the speed over
+	// the last interval.
+	Final        bool              `json:"is_final"`
+	IntervalMbps float64           `json:"interval_speed_mbps,omitempty"`
+	Expected     int64             `json:"expected_bytes,omitempty"`
+	ETag         string            `json:"etag,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	// HeadersTruncated marks headers cut short by capture_headers: all.
+	HeadersTruncated bool               `json:"headers_truncated,omitempty"`
+	Remote           string             `json:"remote_addr,omitempty"`
+	IPVersion        int                `json:"ip_version,omitempty"`
+	Local            string             `json:"local_addr,omitempty"`
+	Proxy            string             `json:"proxy,omitempty"`
+	Resolved         string             `json:"resolved_ip,omitempty"`
+	ConnectTo        string             `json:"connect_to,omitempty"`
+	CacheMode        string             `json:"cache_mode,omitempty"`
+	SweepSize        int64              `json:"sweep_size,omitempty"`
+	BidiPhase        string             `json:"bidi_phase,omitempty"`
+	SoloMbps         float64            `json:"solo_mbps,omitempty"`
+	SampleOffset     int64              `json:"sample_offset,omitempty"`
+	OffsetSamples    int                `json:"offset_samples,omitempty"`
+	SampleNote       string             `json:"sample_note,omitempty"`
+	Warmup           int64              `json:"warmup_bytes,omitempty"`
+	InWarmup         bool               `json:"warmup,omitempty"`
+	Streams          int                `json:"streams,omitempty"`
+	StartSkewMs      float64            `json:"start_skew_ms,omitempty"`
+	TrimmedMs        float64            `json:"trimmed_ms,omitempty"`
+	Attempts         int                `json:"attempts,omitempty"`
+	Status           int                `json:"status_code,omitempty"`
+	Protocol         string             `json:"protocol,omitempty"`
+	TLS              string             `json:"tls_version,omitempty"`
+	Cipher           string             `json:"cipher,omitempty"`
+	ALPN             string             `json:"alpn,omitempty"`
+	WireBytes        int64              `json:"wire_bytes,omitempty"`
+	Encoding         string             `json:"content_encoding,omitempty"`
+	BodyBytes        int64              `json:"body_bytes,omitempty"`
+	WireCount        bool               `json:"wire_counted,omitempty"`
+	Latency          *perf.LatencyStats `json:"latency,omitempty"`
+	Bloat            *perf.Bufferbloat  `json:"bufferbloat,omitempty"`
+	Grade            *perf.LatencyGrade `json:"latency_grade,omitempty"`
+	Pacing           *perf.WritePacing  `json:"write_pacing,omitempty"`
+	Shift            *perf.Shift        `json:"shift,omitempty"`
+	AlertState       perf.AlertState    `json:"alert_state,omitempty"`
+	LinkDown         bool               `json:"link_down,omitempty"`
+	Cancelled        bool               `json:"cancelled,omitempty"`
+	Skipped          bool               `json:"skipped,omitempty"`
+	SkipWhy          string             `json:"skip_reason,omitempty"`
+	Family           string             `json:"family,omitempty"`
+	QueueMs          int64              `json:"queue_wait_ms,omitempty"`
+	UserAgent        string             `json:"user_agent,omitempty"`
+	Truncated        bool               `json:"truncated,omitempty"`
+	Reused           bool               `json:"reused,omitempty"`
+	Resumes          int                `json:"resumes,omitempty"`
+	Segments         []jsonSegment      `json:"segments,omitempty"`
+	Stalled          bool               `json:"stalled,omitempty"`
+	Slow             bool               `json:"slow_aborted,omitempty"`
+	Output           string             `json:"output_path,omitempty"`
+	WriteMbps        float64            `json:"write_mbps,omitempty"`
+	WriteMs          int64              `json:"write_ms,omitempty"`
+	StalledMs        int64              `json:"stalled_ms,omitempty"`
+	LongestMs        int64              `json:"longest_stall_ms,omitempty"`
+	Redirects        []jsonHop          `json:"redirects,omitempty"`
+	Cold             *jsonCold          `json:"cold,omitempty"`
+	TCP              *jsonTCP           `json:"tcp,omitempty"`
+	CPU              *jsonCPU           `json:"cpu,omitempty"`
+	CPUWarning       string             `json:"cpu_warning,omitempty"`
+	Peak             float64            `json:"peak_mbps,omitempty"`
+	PeakMs           int64              `json:"time_to_peak_ms,omitempty"`
+	RampMs           float64            `json:"ramp_time_ms,omitempty"`
+	RampBytes        int64              `json:"ramp_bytes,omitempty"`
+	Adaptive         bool               `json:"adaptive,omitempty"`
+	Stable           float64            `json:"stable_mbps,omitempty"`
+	StableMs         int64              `json:"stable_after_ms,omitempty"`
+	RunID            string             `json:"run_id"`
+	Host             string             `json:"host,omitempty"`
+	Agent            string             `json:"agent,omitempty"`
+	Labels           map[string]string  `json:"labels,omitempty"`
+	Error            string             `json:"error,omitempty"`
+	ErrorKind        perf.ErrorKind     `json:"error_kind,omitempty"`
+	TimeoutPhase     string             `json:"timeout_phase,omitempty"`
+	Timestamp        time.Time          `json:"timestamp"`
+	RunOffsetMs      float64            `json:"run_offset_ms"`
+}
+
+type jsonHop struct {
+	URL       string  `json:"url"`
+	Status    int     `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+func newJSONResult(result perf.Stats) jsonResult {
+	r := jsonResult{
+		Kind:             string(result.Kind),
+		URL:              result.URL,
+		Expanded:         result.ExpandedURL,
+		Name:             result.Name,
+		Group:            result.Group,
+		Direction:        string(result.Direction),
+		SizeBytes:        result.SizeBytes,
+		ElapsedMs:        result.Elapsed.Milliseconds(),
+		SpeedMbps:        result.SpeedMbps,
+		SpeedMBps:        result.SpeedMBps,
+		Utilization:      result.Utilization,
+		Final:            result.Final(),
+		Expected:         result.ExpectedBytes,
+		ETag:             result.ETag,
+		Headers:          result.Headers,
+		HeadersTruncated: result.HeadersTruncated,
+		Remote:           result.RemoteAddr,
+		IPVersion:        result.IPVersion,
+		Local:            result.LocalAddr,
+		Proxy:            result.Proxy,
+		Resolved:         result.ResolvedIP,
+		ConnectTo:        result.ConnectTo,
+		CacheMode:        result.CacheMode,
+		SweepSize:        result.SweepSize,
+		BidiPhase:        result.BidiPhase,
+		SoloMbps:         result.SoloMbps,
+		SampleOffset:     result.SampleOffset,
+		OffsetSamples:    result.OffsetSamples,
+		SampleNote:       result.SampleNote,
+		Warmup:           result.WarmupBytes,
+		InWarmup:         result.Warmup,
+		Streams:          result.Streams,
+		StartSkewMs:      ms(result.StartSkew),
+		TrimmedMs:        ms(result.Trimmed),
+		Attempts:         result.Attempt,
+		Status:           result.StatusCode,
+		Protocol:         result.Protocol,
+		TLS:              result.TLSVersion,
+		Cipher:           result.Cipher,
+		ALPN:             result.ALPN,
+		WireBytes:        result.WireBytes,
+		BodyBytes:        result.BodyBytes,
+		Encoding:         result.ContentEncoding,
+		WireCount:        result.WireCounted,
+		Latency:          result.Latency,
+		Bloat:            result.Bufferbloat,
+		Grade:            result.LatencyGrade,
+		Pacing:           result.WritePacing,
+		Shift:            result.Shift,
+		LinkDown:         result.LinkDown,
+		Cancelled:        result.Cancelled,
+		Skipped:          result.Skipped,
+		SkipWhy:          result.SkipReason,
+		Family:           result.Family,
+		QueueMs:          result.QueueWait.Milliseconds(),
+		UserAgent:        result.UserAgent,
+		Truncated:        result.Truncated,
+		Reused:           result.Reused,
+		Resumes:          result.Resumes,
+		Stalled:          result.Stalled,
+		Slow:             result.SlowAborted,
+		Output:           result.OutputPath,
+		WriteMbps:        result.WriteMbps,
+		WriteMs:          result.WriteTime.Milliseconds(),
+		StalledMs:        result.StalledTime.Milliseconds(),
+		LongestMs:        result.LongestStall.Milliseconds(),
+		Peak:             result.PeakMbps,
+		PeakMs:           result.TimeToPeak.Milliseconds(),
+		RampMs:           ms(result.RampTime),
+		RampBytes:        result.RampBytes,
+		Adaptive:         result.Adaptive,
+		Stable:           result.StableMbps,
+		StableMs:         result.StableAfter.Milliseconds(),
+		RunID:            result.RunID,
+		Host:             result.Host,
+		Agent:            result.Agent,
+		Labels:           result.Labels,
+		CPUWarning:       result.CPUWarning,
+		TimeoutPhase:     result.TimeoutPhase,
+		Timestamp:        stampedAt(result).UTC(),
+		RunOffsetMs:      ms(result.RunOffset),
+	}
+	for _, hop := range result.Redirects {
+		r.Redirects = append(r.Redirects, jsonHop{URL: hop.URL, Status: hop.Status, LatencyMs: ms(hop.Latency)})
+	}
+	if !r.Final {
+		r.IntervalMbps = result.IntervalSpeedMbps
+	}
+	if result.Error != nil {
+		r.Error = result.Error.Error()
+		r.ErrorKind = result.ErrorKind
+	}
+	for _, seg := range result.Segments {
+		js := jsonSegment{Offset: seg.Offset, Bytes: seg.Bytes, ElapsedMs: seg.Elapsed.Milliseconds(), SpeedMbps: seg.SpeedMbps}
+		if seg.Error != nil {
+			js.Error = seg.Error.Error()
+		}
+		r.Segments = append(r.Segments, js)
+	}
+	if c := result.Cold; c != nil {
+		r.Cold = &jsonCold{SizeBytes: c.SizeBytes, ElapsedMs: c.Elapsed.Milliseconds(), SpeedMbps: c.SpeedMbps, TTFBMs: ms(c.TTFB)}
+	}
+	if tcp := result.TCP; tcp != nil {
+		r.TCP = &jsonTCP{RTTMs: ms(tcp.RTT), RTTVarMs: ms(tcp.RTTVar), Retransmits: tcp.Retransmits, DeliveryRateMbps: tcp.DeliveryRateMbps}
+	}
+	if cpu := result.CPU; cpu != nil {
+		r.CPU = &jsonCPU{UserMs: ms(cpu.User), SystemMs: ms(cpu.System), GCPauseMs: ms(cpu.GCPause), GCs: cpu.GCs, Percent: cpu.Fraction * 100}
+	}
+	if result.Alert != nil {
+		r.AlertState = result.Alert.State
+	}
+	return r
+}
+
+// jsonSegment is one part of a resumed download.
+type jsonSegment struct {
+	Offset    int64   `json:"offset"`
+	Bytes     int64   `json:"bytes"`
+	ElapsedMs int64   `json:"elapsed_ms"`
+	SpeedMbps float64 `json:"speed_mbps"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// jsonCold is the cold fetch of a reuse_probe.
+type jsonCold struct {
+	SizeBytes int64   `json:"size_bytes"`
+	ElapsedMs int64   `json:"elapsed_ms"`
+	SpeedMbps float64 `json:"speed_mbps"`
+	TTFBMs    float64 `json:"ttfb_ms"`
+}
+
+type jsonTCP struct {
+	RTTMs            float64 `json:"rtt_ms"`
+	RTTVarMs         float64 `json:"rttvar_ms"`
+	Retransmits      uint32  `json:"retransmits"`
+	DeliveryRateMbps float64 `json:"delivery_rate_mbps"`
+}
+
+// jsonCPU is the CPU the process used during a transfer.
+type jsonCPU struct {
+	UserMs    float64 `json:"user_ms"`
+	SystemMs  float64 `json:"system_ms"`
+	GCPauseMs float64 `json:"gc_pause_ms"`
+	GCs       int64   `json:"gcs"`
+	Percent   float64 `json:"cpu_percent"`
+}
+
+// printText prints result, with trend rendered below a completed one.
+func printText(out io.Writer, result perf.Stats, trend string) {
+	switch {
+	case result.Kind == perf.KindRetry:
+		printRetry(os.Stderr, result)
+	case result.Kind == perf.KindSkipped:
+		fmt.Fprintf(out, "- %s (skipped, %s)\n\n", label(result), result.SkipReason)
+	case result.Kind == perf.KindCancelled:
+		fmt.Fprintf(out, "⚠ %s (cancelled)\n", label(result))
+		fmt.Fprintf(out, "  Size:     %s\n", showSize(result.SizeBytes))
+		fmt.Fprintf(out, "  Time:     %v\n", result.Elapsed)
+		fmt.Fprintf(out, "  Speed:    %s\n\n", showSpeeds(result))
+	case result.Kind == perf.KindError:
+		fmt.Fprintf(out, "✗ %s%s\n", label(result), remote(result))
+		printExpanded(out, result)
+		if result.SizeBytes > 0 {
+			fmt.Fprintf(out, "  Size:     %s\n", showSize(result.SizeBytes))
+			fmt.Fprintf(out, "  Time:     %v\n", result.Elapsed)
+		}
+		if result.Attempt > 1 {
+			fmt.Fprintf(out, "  Attempts: %d/%d\n", result.Attempt, result.MaxAttempts)
+		}
+		if result.Resumes > 0 {
+			fmt.Fprintf(out, "  Resumed:  %s\n", resumed(result))
+		}
+		fmt.Fprintf(out, "  Error:    %v (%s)\n", result.Error, result.ErrorKind)
+		if result.LinkDown {
+			fmt.Fprintf(out, "  Link:     down, skipping the rest of the pass\n")
+		}
+		printHeaders(out, result)
+		fmt.Fprintln(out)
+	case result.Kind == perf.KindFinal && result.Latency != nil:
+		l := result.Latency
+		fmt.Fprintf(out, "✓ %s%s\n", label(result), remote(result))
+		printExpanded(out, result)
+		fmt.Fprintf(out, "  Probes:   %d in %v\n", l.Probes, result.Elapsed)
+		fmt.Fprintf(out, "  Latency:  min %s, avg %s, p95 %s, max %s\n", millis(l.Min), millis(l.Avg), millis(l.P95), millis(l.Max))
+		fmt.Fprintf(out, "  Jitter:   %s\n", millis(l.Jitter))
+		printHeaders(out, result)
+		fmt.Fprintln(out)
+	case result.Kind == perf.KindFinal && result.URL == perf.TotalURL:
+		fmt.Fprintf(out, "Σ %s\n", label(result))
+		fmt.Fprintf(out, "  Size:     %s\n", showSize(result.SizeBytes))
+		fmt.Fprintf(out, "  Time:     %v\n", result.Elapsed)
+		fmt.Fprintf(out, "  Peak:     %s over one second\n", showSpeed(result.PeakMbps))
+		if result.Trimmed > 0 {
+			fmt.Fprintf(out, "  Trimmed:  last %v left out of the speed (trim_ragged)\n", result.Trimmed.Round(time.Millisecond))
+		}
+		fmt.Fprintf(out, "  Speed:    %s\n\n", showSpeeds(result))
+	case result.Kind == perf.KindFinal:
+		fmt.Fprintf(out, "✓ %s%s\n", label(result), remote(result))
+		printExpanded(out, result)
+		fmt.Fprintf(out, "  Size:     %s\n", showSize(result.SizeBytes))
+		fmt.Fprintf(out, "  Time:     %v\n", result.Elapsed)
+		// The JSON an agent reports its results in has no phases.
+		if result.Agent == "" {
+			fmt.Fprintf(out, "  Phases:   %s\n", phases(result))
+		}
+		fmt.Fprintf(out, "  Protocol: %s\n", result.Protocol)
+		if result.ContentEncoding != "" && result.ContentEncoding != perf.EncodingIdentity {
+			fmt.Fprintf(out, "  Encoding: %s\n", result.ContentEncoding)
+		}
+		if b := result.Bufferbloat; b != nil {
+			fmt.Fprintf(out, "  Bloat:    %s%s\n", bloat(b), gradeNote(result.LatencyGrade))
+		}
+		if tcp := result.TCP; tcp != nil {
+			fmt.Fprintf(out, "  TCP:      RTT %s, retrans %d\n", millis(tcp.RTT), tcp.Retransmits)
+		}
+		if len(result.Redirects) > 0 {
+			fmt.Fprintf(out, "  Chain:    %s\n", redirects(result.Redirects))
+		}
+		if result.TLSVersion != "" {
+			fmt.Fprintf(out, "  TLS:      %s, %s, ALPN %s\n", result.TLSVersion, result.Cipher, alpn(result.ALPN))
+		}
+		if result.WireCounted {
+			fmt.Fprintf(out, "  Bytes:    %d body bytes in %d read off the wire; speed uses wire bytes\n", result.BodyBytes, result.WireBytes)
+		} else if result.BodyBytes != result.WireBytes {
+			fmt.Fprintf(out, "  Decoded:  %s body from %s on the wire; speed uses wire bytes\n", showSize(result.BodyBytes), showSize(result.WireBytes))
+		}
+		if result.Streams > 1 {
+			fmt.Fprintf(out, "  Streams:  %d, first bytes within %s\n", result.Streams, millis(result.StartSkew))
+		}
+		if result.Trimmed > 0 {
+			fmt.Fprintf(out, "  Trimmed:  last %v left out of the speed (trim_ragged)\n", result.Trimmed.Round(time.Millisecond))
+		}
+		if result.QueueWait > 0 {
+			fmt.Fprintf(out, "  Queued:   %v behind other transfers from the same host\n", result.QueueWait.Round(time.Millisecond))
+		}
+		if result.OutputPath != "" {
+			fmt.Fprintf(out, "  Disk:     %s, writes at %s took %v%s\n", result.OutputPath, showSpeed(result.WriteMbps),
+				result.WriteTime.Round(time.Millisecond), diskBound(result))
+		}
+		if result.TimeToPeak > 0 {
+			fmt.Fprintf(out, "  Peak:     %s over 3s, within 95%% of it after %v\n", showSpeed(result.PeakMbps), result.TimeToPeak.Round(100*time.Millisecond))
+		}
+		if result.RampTime > 0 {
+			fmt.Fprintf(out, "  Ramp:     up to speed after %v, %s in\n", result.RampTime.Round(10*time.Millisecond), showSize(result.RampBytes))
+		}
+		if result.Shift != nil {
+			fmt.Fprintf(out, "  Shift:    %s\n", result.Shift)
+		}
+		if result.StalledTime > 0 {
+			fmt.Fprintf(out, "  Stalls:   %v stalled, longest %v\n", result.StalledTime.Round(time.Second), result.LongestStall.Round(time.Second))
+		}
+		if p := result.WritePacing; p != nil {
+			fmt.Fprintf(out, "  Writes:   %s\n", pacing(p))
+		}
+		if result.CPUWarning != "" {
+			fmt.Fprintf(out, "  CPU:      %s\n", result.CPUWarning)
+		}
+		switch {
+		case result.Warmup:
+			fmt.Fprintf(out, "  Warm-up:  ended before the window closed, speed covers the whole transfer\n")
+		case result.WarmupBytes > 0:
+			fmt.Fprintf(out, "  Warm-up:  %s excluded from speed\n", showSize(result.WarmupBytes))
+		}
+		if c := result.Cold; c != nil {
+			reuse := "connection reused"
+			if !result.Reused {
+				reuse = "connection not reused"
+			}
+			delta := 0.0
+			if c.SpeedMbps > 0 {
+				delta = (result.SpeedMbps - c.SpeedMbps) / c.SpeedMbps * 100
+			}
+			fmt.Fprintf(out, "  Reuse:    cold %s, warm %s (%+.1f%%), %s\n", showSpeed(c.SpeedMbps), showSpeed(result.SpeedMbps), delta, reuse)
+		}
+		switch {
+		case result.StableAfter > 0:
+			fmt.Fprintf(out, "  Stable:   %s after %v\n", showSpeed(result.StableMbps), result.StableAfter.Round(time.Second))
+		case result.Adaptive:
+			fmt.Fprintf(out, "  Stable:   speed did not settle in %v\n", result.Elapsed.Round(time.Second))
+		}
+		if result.Truncated {
+			fmt.Fprintf(out, "  Stream:   no Content-Length, stopped after %v\n", result.Elapsed.Round(time.Second))
+		}
+		if result.Resumes > 0 {
+			fmt.Fprintf(out, "  Resumed:  %s\n", resumed(result))
+		}
+		if result.Attempt > 1 {
+			fmt.Fprintf(out, "  Attempts: %d/%d\n", result.Attempt, result.MaxAttempts)
+		}
+		fmt.Fprintf(out, "  Speed:    %s\n", showSpeeds(result))
+		if trend != "" {
+			fmt.Fprintf(out, "  Trend:    %s\n", trend)
+		}
+		printHeaders(out, result)
+		fmt.Fprintln(out)
+	default:
+		printProgress(os.Stderr, result)
+	}
+}
+
+// printHeaders lists the captured response headers, one per line in name
+// order.
+func printHeaders(out io.Writer, result perf.Stats) {
+	if len(result.Headers) == 0 {
+		return
+	}
+	fmt.Fprintln(out, "  Headers:")
+	for _, name := range slices.Sorted(maps.Keys(result.Headers)) {
+		fmt.Fprintf(out, "    %s: %s\n", name, result.Headers[name])
+	}
+	if result.HeadersTruncated {
+		fmt.Fprintln(out, "    ... the rest left out to stay under the size cap")
+	}
+}
+
+func printRetry(w io.Writer, result perf.Stats) {
+	fmt.Fprintf(w, "↻ %s attempt %d/%d failed: %v\n", label(result), result.Attempt, result.MaxAttempts, result.Error)
+}
+
+func printProgress(w io.Writer, result perf.Stats) {
+	fmt.Fprintf(w, "[%s]%s %s, current %s, average %s%s\n", label(result), marks(result), showSize(result.SizeBytes), showSpeed(result.IntervalSpeedMbps), showSpeed(result.SpeedMbps), ofPlan(result.Utilization))
+}
+
+// ofPlan renders a speed's utilization of link_capacity, if known.
+func ofPlan(utilization float64) string {
+	if utilization <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(", %.0f%% of plan", utilization)
+}
+
+// printExpanded prints the URL a URL template expanded to.
+func printExpanded(out io.Writer, result perf.Stats) {
+	if result.ExpandedURL != "" {
+		fmt.Fprintf(out, "  URL:      %s\n", result.ExpandedURL)
+	}
+}
+
+// diskBound notes a download that spent most of its time writing to disk,
+// so its speed is the disk's rather than the network's.
+func diskBound(result perf.Stats) string {
+	if result.Elapsed > 0 && result.WriteTime > result.Elapsed/2 {
+		return ", slower than the network"
+	}
+	return ""
+}
+
+// marks flags a progress snapshot taken during the warm-up or a stall.
+func marks(result perf.Stats) string {
+	switch {
+	case result.Stalled:
+		return " (stalled)"
+	case result.Warmup:
+		return " (warm-up)"
+	}
+	return ""
+}
+
+// showURLs prints raw URLs in place of target names.
+var showURLs bool
+
+// name is the target's display name, after the agent it ran on if any.
+func name(result perf.Stats) string {
+	n := result.DisplayName()
+	if showURLs {
+		n = result.URL
+	}
+	if result.Agent != "" {
+		n = result.Agent + ": " + n
+	}
+	return n
+}
+
+func label(result perf.Stats) string {
+	switch result.Direction {
+	case perf.Upload:
+		return name(result) + " (upload)"
+	case perf.Latency:
+		return name(result) + " (latency)"
+	}
+	return name(result)
+}
+
+func remote(result perf.Stats) string {
+	switch {
+	case result.Proxy != "":
+		return fmt.Sprintf(" [via proxy %s]", result.Proxy)
+	case result.ConnectTo != "":
+		return fmt.Sprintf(" [%s via connect_to]", cmp.Or(result.RemoteAddr, result.ConnectTo))
+	case result.RemoteAddr != "":
+		return fmt.Sprintf(" [%s]", result.RemoteAddr)
+	}
+	return ""
+}
+
+func alpn(proto string) string {
+	if proto == "" {
+		return "none"
+	}
+	return proto
+}
+
+func phases(result perf.Stats) string {
+	if result.Reused {
+		return fmt.Sprintf("connection reused, TTFB %s", millis(result.TTFB))
+	}
+	return fmt.Sprintf("DNS %s, connect %s, TLS %s, TTFB %s",
+		millis(result.DNSLookup), millis(result.TCPConnect), millis(result.TLSHandshake), millis(result.TTFB))
+}
+
+func millis(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", ms(d))
+}
+
+// summaryErrors renders the error count, calling out checksum mismatches
+// and suspected interceptions.
+func summaryErrors(s perf.Summary) string {
+	var kinds []string
+	if s.ChecksumErrors > 0 {
+		kinds = append(kinds, fmt.Sprintf("%d checksum", s.ChecksumErrors))
+	}
+	if s.Intercepted > 0 {
+		kinds = append(kinds, fmt.Sprintf("%d intercepted", s.Intercepted))
+	}
+	if len(kinds) > 0 {
+		return fmt.Sprintf("%d (%s)", s.Errors, strings.Join(kinds, ", "))
+	}
+	return strconv.Itoa(s.Errors)
+}
+
+// stampedAt is the wall time result was taken, or now for one that says
+// not.
+func stampedAt(result perf.Stats) time.Time {
+	if result.Timestamp.IsZero() {
+		return time.Now()
+	}
+	return result.Timestamp
+}
+
+// grading sets the bounds of the latency grades in the summary.
+var grading perf.LatencyGrading
+
+func printSummary(out io.Writer, output string, summaries []perf.Summary) {
+	if output == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(struct {
+			Summary   []perf.Summary          `json:"summary"`
+			Groups    []perf.GroupSummary     `json:"groups,omitempty"`
+			IPs       []perf.Summary          `json:"ips,omitempty"`
+			Dualstack []perf.FamilyComparison `json:"dualstack,omitempty"`
+			Sizes     []perf.SizeCurve        `json:"size_sweeps,omitempty"`
+			Offsets   []perf.OffsetProfile    `json:"offset_samples,omitempty"`
+			Bidi      []perf.BidiComparison   `json:"bidirectional,omitempty"`
+			Grades    []perf.URLGrade         `json:"latency_grades,omitempty"`
+		}{summaries, perf.Groups(summaries), perf.RankIPs(summaries), perf.CompareFamilies(summaries), perf.SizeCurves(summaries), perf.OffsetProfiles(summaries), perf.CompareBidirectional(summaries), perf.LatencyGrades(summaries, grading)}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	}
+
+	var speeds, latencies []perf.Summary
+	for _, s := range summaries {
+		if s.Direction == perf.Latency {
+			latencies = append(latencies, s)
+		} else {
+			speeds = append(speeds, s)
+		}
+	}
+	if len(speeds) > 0 {
+		u := columnUnit(speeds, func(s perf.Summary) float64 { return s.MaxMbps })
+		fmt.Fprintf(out, "Summary (%s)\n", u.name)
+		planned := slices.ContainsFunc(speeds, func(s perf.Summary) bool { return s.Utilization > 0 })
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		header := "URL\tRuns\tErrors\tMin\tMean\tMedian\tP95\tMax\tJitter"
+		if planned {
+			header += "\tOf plan"
+		}
+		fmt.Fprintln(w, header)
+		for _, s := range speeds {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s",
+				summaryLabel(s), s.Runs, summaryErrors(s), u.number(s.MinMbps), u.number(s.MeanMbps), u.number(s.MedianMbps),
+				u.number(s.P95Mbps), u.number(s.MaxMbps), u.number(s.JitterMbps))
+			if planned {
+				fmt.Fprintf(w, "\t%.0f%%", s.Utilization)
+			}
+			fmt.Fprintln(w)
+		}
+		w.Flush()
+		for _, g := range perf.LatencyGrades(speeds, grading) {
+			fmt.Fprintf(out, "Latency grade %s: %s (%s)\n", name(perf.Stats{URL: g.URL, Name: g.Name}), g.Grade, gradeInputs(g.LatencyGrade))
+		}
+		for _, s := range speeds {
+			switch {
+			case s.URL == perf.TotalURL && s.PeakMbps > 0:
+				fmt.Fprintf(out, "Peak %s: %s over one second\n", summaryLabel(s), showSpeed(s.PeakMbps))
+			case s.TimeToPeakMs > 0:
+				fmt.Fprintf(out, "Peak %s: %s over 3s, reached after %v on average\n", summaryLabel(s), showSpeed(s.PeakMbps),
+					time.Duration(s.TimeToPeakMs*float64(time.Millisecond)).Round(100*time.Millisecond))
+			}
+			if s.RampTimeMs > 0 {
+				fmt.Fprintf(out, "Ramp %s: up to speed after %v and %s on average\n", summaryLabel(s),
+					time.Duration(s.RampTimeMs*float64(time.Millisecond)).Round(10*time.Millisecond), showSize(int64(s.RampBytes)))
+			}
+			if s.Resumed > 0 {
+				fmt.Fprintf(out, "Resume %s: %d runs resumed %d times in all\n", summaryLabel(s), s.Resumed, s.Resumes)
+			}
+			if s.Reused > 0 {
+				fmt.Fprintf(out, "Reuse %s: %d of %d runs reused a connection (%.0f%%)\n", summaryLabel(s), s.Reused, s.Runs,
+					float64(s.Reused)/float64(s.Runs)*100)
+			}
+			if s.Shift != nil {
+				fmt.Fprintf(out, "Shift %s: %s (%d of %d runs)\n", summaryLabel(s), s.Shift, s.Shifts, s.Runs)
+			}
+			if s.Skipped > 0 {
+				fmt.Fprintf(out, "Skipped %s: %d, %s\n", summaryLabel(s), s.Skipped, s.SkipReason)
+			}
+			if s.Intercepted > 0 {
+				fmt.Fprintf(out, "Interception suspected %s: %d of %d runs, last %s; their speeds are left out\n",
+					summaryLabel(s), s.Intercepted, s.Runs+s.Errors, s.Interception)
+			}
+		}
+	}
+	if groups := perf.Groups(summaries); len(groups) > 0 {
+		u := columnUnit(groups, func(g perf.GroupSummary) float64 { return g.MeanMbps })
+		fmt.Fprintf(out, "Groups (%s)\n", u.name)
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "Group\tURLs\tRuns\tErrors\tMean")
+		for _, g := range groups {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n",
+				label(perf.Stats{URL: g.Group, Direction: g.Direction}), g.URLs, g.Runs, g.Errors, u.number(g.MeanMbps))
+		}
+		w.Flush()
+	}
+	if ips := perf.RankIPs(speeds); len(ips) > 0 {
+		u := columnUnit(ips, func(s perf.Summary) float64 { return max(s.MeanMbps, s.MedianMbps) })
+		fmt.Fprintf(out, "IPs by speed (%s)\n", u.name)
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "URL\tIP\tRuns\tErrors\tMean\tMedian")
+		for _, s := range ips {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n",
+				label(perf.Stats{URL: s.URL, Direction: s.Direction}), s.IP, s.Runs, summaryErrors(s), u.number(s.MeanMbps), u.number(s.MedianMbps))
+		}
+		w.Flush()
+	}
+	if families := perf.CompareFamilies(speeds); len(families) > 0 {
+		u := columnUnit(families, func(c perf.FamilyComparison) float64 { return max(c.IPv4Mbps, c.IPv6Mbps) })
+		fmt.Fprintf(out, "Dual stack (%s)\n", u.name)
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "URL\tIPv4\tIPv6\tFaster")
+		for _, c := range families {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+				label(perf.Stats{URL: c.URL, Name: c.Name, Direction: c.Direction}), u.number(c.IPv4Mbps), u.number(c.IPv6Mbps), faster(c))
+		}
+		w.Flush()
+	}
+	if curves := perf.SizeCurves(speeds); len(curves) > 0 {
+		u := columnUnit(curves, func(c perf.SizeCurve) float64 {
+			fastest := 0.0
+			for _, step := range c.Steps {
+				fastest = max(fastest, step.MeanMbps)
+			}
+			return fastest
+		})
+		fmt.Fprintf(out, "Size sweep (%s)\n", u.name)
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "URL\tSize\tRuns\tErrors\tMean\tTTFB ms\t")
+		for _, c := range curves {
+			for _, step := range c.Steps {
+				knee := ""
+				if step.SizeBytes == c.KneeBytes {
+					knee = "← knee"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%.1f\t%s\n", label(perf.Stats{URL: c.URL, Name: c.Name, Agent: c.Agent, Direction: c.Direction}),
+					perf.SizeLabel(step.SizeBytes), step.Runs, step.Errors, u.number(step.MeanMbps), step.MeanTTFBMs, knee)
+			}
+		}
+		w.Flush()
+	}
+	if profiles := perf.OffsetProfiles(speeds); len(profiles) > 0 {
+		u := columnUnit(profiles, func(p perf.OffsetProfile) float64 {
+			fastest := 0.0
+			for _, sample := range p.Samples {
+				fastest = max(fastest, sample.MeanMbps)
+			}
+			return fastest
+		})
+		fmt.Fprintf(out, "Offset samples (%s)\n", u.name)
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "URL\tOffset\tRuns\tErrors\tMean\tTTFB ms\t")
+		for _, p := range profiles {
+			slowest := -1
+			for i, sample := range p.Samples {
+				if sample.Runs > 0 && (slowest < 0 || sample.MeanMbps < p.Samples[slowest].MeanMbps) {
+					slowest = i
+				}
+			}
+			for i, sample := range p.Samples {
+				boundary := ""
+				if p.CacheBoundary && i == slowest {
+					boundary = fmt.Sprintf("← cache boundary? %.0f%% slower", p.SpreadPct)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%.1f\t%s\n", label(perf.Stats{URL: p.URL, Name: p.Name, Agent: p.Agent, Direction: perf.Download}),
+					perf.SizeLabel(sample.OffsetBytes), sample.Runs, sample.Errors, u.number(sample.MeanMbps), sample.MeanTTFBMs, boundary)
+			}
+		}
+		w.Flush()
+		for _, p := range profiles {
+			if p.Note != "" {
+				fmt.Fprintf(out, "Offset samples of %s: single sample, %s\n", label(perf.Stats{URL: p.URL, Name: p.Name, Agent: p.Agent, Direction: perf.Download}), p.Note)
+			}
+		}
+	}
+	if bidi := perf.CompareBidirectional(speeds); len(bidi) > 0 {
+		u := columnUnit(bidi, func(c perf.BidiComparison) float64 {
+			return max(c.DownSoloMbps, c.DownBothMbps, c.UpSoloMbps, c.UpBothMbps)
+		})
+		fmt.Fprintf(out, "Bidirectional (%s)\n", u.name)
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "URL\tDown solo\tDown both\tUp solo\tUp both\tIdle P50 ms\tLoaded P50 ms")
+		for _, c := range bidi {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%.1f\t%.1f\n", label(perf.Stats{URL: c.URL, Name: c.Name, Direction: perf.Download}),
+				u.number(c.DownSoloMbps), bidiBoth(u, c.DownBothMbps, c.DownChangePct), u.number(c.UpSoloMbps), bidiBoth(u, c.UpBothMbps, c.UpChangePct), c.IdleP50Ms, c.LoadedP50Ms)
+		}
+		w.Flush()
+	}
+	var bloated []perf.Summary
+	for _, s := range speeds {
+		if s.Bufferbloat != nil {
+			bloated = append(bloated, s)
+		}
+	}
+	if len(bloated) > 0 {
+		fmt.Fprintln(out, "Bufferbloat (ms)")
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "URL\tIdle P50\tIdle P95\tLoaded P50\tLoaded P95\tIncrease")
+		for _, s := range bloated {
+			b := s.Bufferbloat
+			fmt.Fprintf(w, "%s\t%.1f\t%.1f\t%.1f\t%.1f\t%.1fx\n",
+				summaryLabel(s), ms(b.Idle.P50), ms(b.Idle.P95), ms(b.Loaded.P50), ms(b.Loaded.P95), b.Factor)
+		}
+		w.Flush()
+	}
+	var uploads []perf.Summary
+	for _, s := range speeds {
+		if s.WritePacing != nil {
+			uploads = append(uploads, s)
+		}
+	}
+	if len(uploads) > 0 {
+		fmt.Fprintln(out, "Write pacing")
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		u := columnUnit(uploads, func(s perf.Summary) float64 { return s.WritePacing.P95Mbps })
+		fmt.Fprintf(w, "URL\tWrites\tP50 ms\tP95 ms\tLongest ms\tMean %s\tP95 %s\tBurstiness\n", u.name, u.name)
+		for _, s := range uploads {
+			p := s.WritePacing
+			fmt.Fprintf(w, "%s\t%d\t%.1f\t%.1f\t%.1f\t%s\t%s\t%.1fx\n",
+				summaryLabel(s), p.Writes, ms(p.P50), ms(p.P95), ms(p.LongestStall), u.number(p.MeanMbps), u.number(p.P95Mbps), p.Burstiness)
+		}
+		w.Flush()
+	}
+	if len(latencies) > 0 {
+		fmt.Fprintln(out, "Latency (ms)")
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "URL\tRuns\tErrors\tProbes\tMin\tAvg\tP95\tMax\tJitter")
+		for _, s := range latencies {
+			l := s.Latency
+			if l == nil {
+				l = &perf.LatencyStats{}
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\n",
+				name(perf.Stats{URL: s.URL, Name: s.Name}), s.Runs, s.Errors, l.Probes, ms(l.Min), ms(l.Avg), ms(l.P95), ms(l.Max), ms(l.Jitter))
+		}
+		w.Flush()
+	}
+	for _, s := range summaries {
+		if s.AlertState != "" && s.AlertState != perf.AlertOK {
+			fmt.Fprintf(out, "Alert %s: %s, %d failures in alert_window\n", summaryLabel(s), s.AlertState, s.AlertFailures)
+		}
+	}
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func printChecks(output string, checks []perf.Check) {
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(struct {
+			Checks []perf.Check `json:"checks"`
+		}{checks}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	}
+
+	fmt.Println("Checks")
+	for _, c := range checks {
+		fmt.Printf("  %-8s  %s\n", c.Status, label(perf.Stats{URL: c.URL, Name: c.Name, Direction: c.Direction, Agent: c.Agent}))
+		for _, f := range c.Failures {
+			fmt.Printf("            %s\n", f)
+		}
+	}
+}
+
+func summaryLabel(s perf.Summary) string {
+	l := label(perf.Stats{URL: s.URL, Name: s.Name, Direction: s.Direction, Agent: s.Agent})
+	if s.Runs == 0 && s.Partial > 0 {
+		l += " (partial)"
+	}
+	return l
+}
+
+// resumed describes the segments of a resumed download, as
+// "2 times, segments 40.00, 12.50 and 38.20 Mbps".
+func resumed(result perf.Stats) string {
+	u := columnUnit(result.Segments, func(seg perf.Segment) float64 { return seg.SpeedMbps })
+	speeds := make([]string, len(result.Segments))
+	for i, seg := range result.Segments {
+		speeds[i] = u.number(seg.SpeedMbps)
+	}
+	list := strings.Join(speeds, ", ")
+	if n := len(speeds); n > 1 {
+		list = strings.Join(speeds[:n-1], ", ") + " and " + speeds[n-1]
+	}
+	times := "times"
+	if result.Resumes == 1 {
+		times = "time"
+	}
+	return fmt.Sprintf("%d %s, segments %s %s", result.Resumes, times, list, u.name)
+}
+
+// faster says which family of c won and by how much, as "IPv6 by 12.3%".
+func faster(c perf.FamilyComparison) string {
+	switch c.Faster {
+	case perf.FamilyIPv4:
+		return fmt.Sprintf("IPv4 by %.1f%%", c.DeltaPercent)
+	case perf.FamilyIPv6:
+		return fmt.Sprintf("IPv6 by %.1f%%", c.DeltaPercent)
+	}
+	return "-"
+}
+
+// bidiBoth is the speed of a direction of a bidirectional test with the
+// other running, and how it changed from its solo speed, as "81.20 (-12.4%)".
+func bidiBoth(u speedUnit, mbps, change float64) string {
+	if change == 0 {
+		return u.number(mbps)
+	}
+	return fmt.Sprintf("%s (%+.1f%%)", u.number(mbps), change)
+}
+
+// pacing describes an upload's writes, as in "5120 writes, p50 0.1ms p95
+// 2.3ms, longest stall 410.0ms; burstiness 3.1x (p95 96.12, mean 31.00,
+// median 30.50 Mbps per 100ms)".
+func pacing(p *perf.WritePacing) string {
+	u := speedUnitFor(p.P95Mbps)
+	return fmt.Sprintf("%d writes, p50 %s p95 %s, longest stall %s; burstiness %.1fx (p95 %s, mean %s, median %s %s per 100ms)",
+		p.Writes, millis(p.P50), millis(p.P95), millis(p.LongestStall), p.Burstiness, u.number(p.P95Mbps), u.number(p.MeanMbps), u.number(p.MedianMbps), u.name)
+}
+
+// bloat formats idle against loaded round trips as
+// "idle p50 12.0ms p95 14.1ms, loaded p50 96.3ms p95 130.2ms (8.0x)".
+func bloat(b *perf.Bufferbloat) string {
+	if b.Loaded.Probes == 0 {
+		return fmt.Sprintf("idle p50 %s p95 %s, no probes under load", millis(b.Idle.P50), millis(b.Idle.P95))
+	}
+	return fmt.Sprintf("idle p50 %s p95 %s, loaded p50 %s p95 %s (%.1fx)",
+		millis(b.Idle.P50), millis(b.Idle.P95), millis(b.Loaded.P50), millis(b.Loaded.P95), b.Factor)
+}
+
+// gradeNote is the latency grade of a result for its Bloat line, as ",
+// grade B (+42.0ms loaded)".
+func gradeNote(g *perf.LatencyGrade) string {
+	if g == nil {
+		return ""
+	}
+	increase := g.DownloadIncreaseMs
+	if increase == nil {
+		increase = g.UploadIncreaseMs
+	}
+	if increase == nil {
+		return ", grade " + g.Grade
+	}
+	return fmt.Sprintf(", grade %s (+%.1fms loaded)", g.Grade, *increase)
+}
+
+// gradeInputs lists what a latency grade was given, as "idle 12.0ms,
+// download +42.0ms, upload +81.5ms; limited by upload".
+func gradeInputs(g perf.LatencyGrade) string {
+	parts := []string{fmt.Sprintf("idle %.1fms", g.IdleMs)}
+	if g.DownloadIncreaseMs != nil {
+		parts = append(parts, fmt.Sprintf("download +%.1fms", *g.DownloadIncreaseMs))
+	}
+	if g.UploadIncreaseMs != nil {
+		parts = append(parts, fmt.Sprintf("upload +%.1fms", *g.UploadIncreaseMs))
+	}
+	return strings.Join(parts, ", ") + "; limited by " + g.LimitedBy
+}
+
+// redirects formats a redirect chain as "url (302, 12.3ms) → …".
+func redirects(hops []perf.Hop) string {
+	parts := make([]string, len(hops))
+	for i, hop := range hops {
+		parts[i] = fmt.Sprintf("%s (%d, %s)", hop.URL, hop.Status, millis(hop.Latency))
+	}
+	return strings.Join(parts, " → ")
+}
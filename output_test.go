@@ -0,0 +1,795 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// golden compares got with the file testdata/name, or rewrites it with
+// -update.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the output:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestJSONResultGolden(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	results := []perf.Stats{
+		{
+			Kind: perf.KindProgress, URL: "https://mirror.example.com/100MB.bin", Direction: perf.Download,
+			SizeBytes: 12500000, Elapsed: time.Second, SpeedMbps: 100, SpeedMBps: 12.5,
+			IntervalBytes: 12500000, IntervalSpeedMbps: 100, ExpectedBytes: 100000000, Timestamp: at,
+		},
+		{
+			Kind: perf.KindFinal, Done: true, URL: "https://mirror.example.com/100MB.bin", Name: "mirror", Direction: perf.Download,
+			SizeBytes: 100000000, Elapsed: 8 * time.Second, SpeedMbps: 100, SpeedMBps: 12.5, ExpectedBytes: 100000000,
+			Timestamp: at.Add(8 * time.Second), Labels: map[string]string{"site": "lab"},
+		},
+		{
+			Kind: perf.KindError, URL: "https://down.example.com/", Direction: perf.Download,
+			Error: errors.New("dial tcp: connection refused"), ErrorKind: perf.ErrorConnect, Timestamp: at,
+		},
+		{
+			Kind: perf.KindCancelled, Cancelled: true, URL: "https://mirror.example.com/100MB.bin", Direction: perf.Upload,
+			SizeBytes: 2000000, Elapsed: 500 * time.Millisecond, SpeedMbps: 32, SpeedMBps: 4,
+			Error: context.Canceled, ErrorKind: perf.ErrorCancelled, Timestamp: at,
+		},
+	}
+	f, err := os.CreateTemp(t.TempDir(), "results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := newReporter("json", f, false, false, false, true, func(perf.Stats) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		report(multiReporter{r}, result)
+	}
+	out, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "results.golden.ndjson", out)
+}
+
+func TestPrintReuse(t *testing.T) {
+	tests := []struct {
+		reused bool
+		cold   float64
+		want   string
+	}{
+		{true, 50, "  Reuse:    cold 50.00 Mbps, warm 80.00 Mbps (+60.0%), connection reused\n"},
+		{false, 100, "  Reuse:    cold 100.00 Mbps, warm 80.00 Mbps (-20.0%), connection not reused\n"},
+		{true, 0, "  Reuse:    cold 0.00 Mbps, warm 80.00 Mbps (+0.0%), connection reused\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		printText(&out, perf.Stats{
+			Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true, SizeBytes: 1000, SpeedMbps: 80, Reused: tt.reused,
+			Cold: &perf.Stats{SizeBytes: 1000, SpeedMbps: tt.cold},
+		}, "")
+		if !bytes.Contains(out.Bytes(), []byte(tt.want)) {
+			t.Errorf("no %q in\n%s", tt.want, out.String())
+		}
+	}
+}
+
+func TestPrintTotal(t *testing.T) {
+	total := perf.Stats{
+		Kind: perf.KindFinal, Done: true, URL: perf.TotalURL, Direction: perf.Download,
+		SizeBytes: 18750000, Elapsed: 2500 * time.Millisecond, SpeedMbps: 60, SpeedMBps: 7.5, PeakMbps: 64,
+	}
+	var out bytes.Buffer
+	printText(&out, total, "")
+	want := "Σ TOTAL\n  Size:     18.75 MB\n  Time:     2.5s\n  Peak:     64.00 Mbps over one second\n  Speed:    7.50 MB/s (60.00 Mbps)\n\n"
+	if out.String() != want {
+		t.Errorf("printed\n%s\nwant\n%s", out.String(), want)
+	}
+	// The summary gets a TOTAL entry with its peak.
+	c := perf.NewCollector()
+	c.Add(total)
+	out.Reset()
+	printSummary(&out, "", c.Summaries())
+	if !bytes.Contains(out.Bytes(), []byte("\nTOTAL ")) || !bytes.Contains(out.Bytes(), []byte("Peak TOTAL: 64.00 Mbps over one second\n")) {
+		t.Errorf("summary has no TOTAL with its peak:\n%s", out.String())
+	}
+}
+
+func TestPrintConnectionDetails(t *testing.T) {
+	result := perf.Stats{
+		Kind: perf.KindFinal, Done: true, URL: "https://cdn.example.com/", Direction: perf.Download, SizeBytes: 1000, RemoteAddr: "192.0.2.1:443",
+		TLSVersion: "TLS 1.2", Cipher: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	}
+	var out bytes.Buffer
+	printText(&out, result, "")
+	for _, want := range []string{"✓ https://cdn.example.com/ [192.0.2.1:443]\n", "  TLS:      TLS 1.2, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, ALPN none\n"} {
+		if !bytes.Contains(out.Bytes(), []byte(want)) {
+			t.Errorf("no %q in\n%s", want, out.String())
+		}
+	}
+	doc, err := json.Marshal(newJSONResult(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"tls_version":"TLS 1.2","cipher":"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"`; !bytes.Contains(doc, []byte(want)) {
+		t.Errorf("no %s in %s", want, doc)
+	}
+	// Plain HTTP has no TLS line.
+	result.TLSVersion, result.Cipher = "", ""
+	out.Reset()
+	printText(&out, result, "")
+	if bytes.Contains(out.Bytes(), []byte("TLS:")) {
+		t.Errorf("TLS line for plain http:\n%s", out.String())
+	}
+}
+
+func TestPrintNames(t *testing.T) {
+	defer func() { showURLs = false }()
+	signed := perf.Stats{
+		Kind: perf.KindFinal, Done: true, URL: "https://cdn.example.com/x?sig=abc", Name: "cdn-eu", Group: "cdn",
+		Direction: perf.Download, SizeBytes: 1000, SpeedMbps: 100,
+	}
+	origin := perf.Stats{Kind: perf.KindFinal, Done: true, URL: "https://origin.example.com/x", Group: "origin", Direction: perf.Download, SizeBytes: 1000, SpeedMbps: 40}
+	var out bytes.Buffer
+	printText(&out, signed, "")
+	if !bytes.HasPrefix(out.Bytes(), []byte("✓ cdn-eu\n")) {
+		t.Errorf("printed\n%s\nwant it under its name", out.String())
+	}
+	showURLs = true
+	out.Reset()
+	printText(&out, signed, "")
+	if !bytes.HasPrefix(out.Bytes(), []byte("✓ https://cdn.example.com/x?sig=abc\n")) {
+		t.Errorf("printed\n%s\nwant it under its URL with -show-urls", out.String())
+	}
+	showURLs = false
+
+	// The JSON has both.
+	doc, err := json.Marshal(newJSONResult(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"url":"https://cdn.example.com/x?sig=abc","name":"cdn-eu","group":"cdn"`; !bytes.Contains(doc, []byte(want)) {
+		t.Errorf("no %s in %s", want, doc)
+	}
+
+	c := perf.NewCollector()
+	c.Add(signed)
+	c.Add(origin)
+	out.Reset()
+	printSummary(&out, "", c.Summaries())
+	for _, want := range []string{"\ncdn-eu ", "\nhttps://origin.example.com/x ", "Groups (Mbps)\n", "\ncdn     1     1     0       100.00\n", "\norigin  1     1     0       40.00\n"} {
+		if !bytes.Contains(out.Bytes(), []byte(want)) {
+			t.Errorf("summary has no %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestPrintRedirects(t *testing.T) {
+	result := perf.Stats{
+		Kind: perf.KindFinal, Done: true, URL: "https://example.com/login", Direction: perf.Download, SizeBytes: 1000,
+		Redirects: []perf.Hop{
+			{URL: "https://example.com/login", Status: 302, Latency: 12300 * time.Microsecond},
+			{URL: "https://example.com/hop", Status: 301, Latency: 4 * time.Millisecond},
+		},
+	}
+	var out bytes.Buffer
+	printText(&out, result, "")
+	if want := "  Chain:    https://example.com/login (302, 12.3ms) → https://example.com/hop (301, 4.0ms)\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+	doc, err := json.Marshal(newJSONResult(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"redirects":[{"url":"https://example.com/login","status":302,"latency_ms":12.3},{"url":"https://example.com/hop","status":301,"latency_ms":4}]`; !bytes.Contains(doc, []byte(want)) {
+		t.Errorf("no %s in %s", want, doc)
+	}
+}
+
+func TestPrintDisk(t *testing.T) {
+	tests := []struct {
+		write time.Duration
+		want  string
+	}{
+		{200 * time.Millisecond, "  Disk:     /data/mirror.bin, writes at 400.00 Mbps took 200ms\n"},
+		// Writes taking over half the transfer point at the disk.
+		{1500 * time.Millisecond, "  Disk:     /data/mirror.bin, writes at 400.00 Mbps took 1.5s, slower than the network\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		printText(&out, perf.Stats{
+			Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true, SizeBytes: 10000000, SpeedMbps: 40, Elapsed: 2 * time.Second,
+			OutputPath: "/data/mirror.bin", WriteTime: tt.write, WriteMbps: 400,
+		}, "")
+		if !bytes.Contains(out.Bytes(), []byte(tt.want)) {
+			t.Errorf("no %q in\n%s", tt.want, out.String())
+		}
+	}
+	var out bytes.Buffer
+	printText(&out, perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true, SizeBytes: 1000}, "")
+	if bytes.Contains(out.Bytes(), []byte("Disk:")) {
+		t.Errorf("discarded body printed a Disk line:\n%s", out.String())
+	}
+}
+
+func TestPrintIPRanking(t *testing.T) {
+	summaries := []perf.Summary{
+		{URL: "https://mirror.example.com/", Name: "mirror @ 192.0.2.1", IP: "192.0.2.1", Direction: perf.Download, Runs: 2, MeanMbps: 40, MedianMbps: 40},
+		{URL: "https://mirror.example.com/", Name: "mirror @ 192.0.2.2", IP: "192.0.2.2", Direction: perf.Download, Runs: 2, Errors: 1, MeanMbps: 90, MedianMbps: 90},
+	}
+	var out bytes.Buffer
+	printSummary(&out, "", summaries)
+	want := "IPs by speed (Mbps)\n" +
+		"URL                          IP         Runs  Errors  Mean   Median\n" +
+		"https://mirror.example.com/  192.0.2.2  2     1       90.00  90.00\n" +
+		"https://mirror.example.com/  192.0.2.1  2     0       40.00  40.00\n"
+	if !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no ranking\n%s\nin\n%s", want, out.String())
+	}
+}
+
+func TestPrintTCPInfo(t *testing.T) {
+	result := perf.Stats{
+		Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true, SizeBytes: 1000,
+		TCP: &perf.TCPInfo{RTT: 23400 * time.Microsecond, RTTVar: 2 * time.Millisecond, Retransmits: 14, DeliveryRateMbps: 95.5},
+	}
+	var out bytes.Buffer
+	printText(&out, result, "")
+	if want := "  TCP:      RTT 23.4ms, retrans 14\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+	doc, err := json.Marshal(newJSONResult(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"tcp":{"rtt_ms":23.4,"rttvar_ms":2,"retransmits":14,"delivery_rate_mbps":95.5}`; !bytes.Contains(doc, []byte(want)) {
+		t.Errorf("no %s in %s", want, doc)
+	}
+	// Without TCP_INFO, as off Linux, there is no line.
+	result.TCP = nil
+	out.Reset()
+	printText(&out, result, "")
+	if bytes.Contains(out.Bytes(), []byte("TCP:")) {
+		t.Errorf("TCP line without TCP_INFO:\n%s", out.String())
+	}
+}
+
+func TestPrintBufferbloat(t *testing.T) {
+	ms := time.Millisecond
+	b := &perf.Bufferbloat{
+		Idle:   &perf.LatencyStats{Probes: 5, P50: 12 * ms, P95: 14100 * time.Microsecond},
+		Loaded: &perf.LatencyStats{Probes: 6, P50: 96300 * time.Microsecond, P95: 130200 * time.Microsecond},
+		Factor: 8.025,
+	}
+	var out bytes.Buffer
+	printText(&out, perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true, SizeBytes: 1000, Bufferbloat: b}, "")
+	if want := "  Bloat:    idle p50 12.0ms p95 14.1ms, loaded p50 96.3ms p95 130.2ms (8.0x)\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+	out.Reset()
+	printSummary(&out, "", []perf.Summary{{URL: "https://example.com/", Direction: perf.Download, Runs: 1, MeanMbps: 10, Bufferbloat: b}})
+	want := "Bufferbloat (ms)\n" +
+		"URL                   Idle P50  Idle P95  Loaded P50  Loaded P95  Increase\n" +
+		"https://example.com/  12.0      14.1      96.3        130.2       8.0x\n"
+	if !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no table\n%s\nin\n%s", want, out.String())
+	}
+	// Without loaded probes the line says so.
+	b.Loaded, b.Factor = &perf.LatencyStats{}, 0
+	if got := bloat(b); got != "idle p50 12.0ms p95 14.1ms, no probes under load" {
+		t.Errorf("bloat without loaded probes %q", got)
+	}
+}
+
+func TestPrintSizeSweep(t *testing.T) {
+	step := func(size int64, mbps, ttfb float64) perf.Summary {
+		return perf.Summary{URL: "https://cdn.example.com/obj", Name: "cdn (" + perf.SizeLabel(size) + ")", Direction: perf.Download, SweepSize: size, Runs: 2, MeanMbps: mbps, MinMbps: mbps, MaxMbps: mbps, MedianMbps: mbps, P95Mbps: mbps, MeanTTFBMs: ttfb}
+	}
+	summaries := []perf.Summary{step(64e3, 12, 30), step(1e6, 470, 22.5), step(16e6, 500, 21)}
+	var out bytes.Buffer
+	printSummary(&out, "", summaries)
+	want := "Size sweep (Mbps)\n" +
+		"URL  Size  Runs  Errors  Mean    TTFB ms  \n" +
+		"cdn  64KB  2     0       12.00   30.0     \n" +
+		"cdn  1MB   2     0       470.00  22.5     ← knee\n" +
+		"cdn  16MB  2     0       500.00  21.0     \n"
+	if !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("summary lacks\n%s\ngot\n%s", want, out.String())
+	}
+
+	// JSON sets the steps side by side under the URL.
+	out.Reset()
+	printSummary(&out, "json", summaries)
+	var doc struct {
+		Sizes []perf.SizeCurve `json:"size_sweeps"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Sizes) != 1 || doc.Sizes[0].Name != "cdn" || len(doc.Sizes[0].Steps) != 3 || doc.Sizes[0].KneeBytes != 1e6 {
+		t.Errorf("size sweeps %+v", doc.Sizes)
+	}
+}
+
+func TestPrintOffsetSamples(t *testing.T) {
+	sample := func(offset int64, at string, mbps float64) perf.Summary {
+		return perf.Summary{URL: "https://cdn.example.com/iso", Name: "iso (@" + at + ")", Direction: perf.Download, SampleOffset: offset, OffsetSamples: 3, Runs: 1, MeanMbps: mbps, MinMbps: mbps, MaxMbps: mbps, MeanTTFBMs: 20}
+	}
+	summaries := []perf.Summary{sample(0, "0%", 400), sample(2e9, "50%", 380), sample(4e9, "100%", 100)}
+	var out bytes.Buffer
+	printSummary(&out, "", summaries)
+	want := "Offset samples (Mbps)\n" +
+		"URL  Offset  Runs  Errors  Mean    TTFB ms  \n" +
+		"iso  0B      1     0       400.00  20.0     \n" +
+		"iso  2GB     1     0       380.00  20.0     \n" +
+		"iso  4GB     1     0       100.00  20.0     ← cache boundary? 75% slower\n"
+	if !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("summary lacks\n%s\ngot\n%s", want, out.String())
+	}
+
+	// A URL tested with a single sample says why.
+	out.Reset()
+	single := sample(0, "0%", 400)
+	single.SampleNote = "the server does not accept byte ranges"
+	printSummary(&out, "", []perf.Summary{single})
+	if want := "Offset samples of iso: single sample, the server does not accept byte ranges\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+
+	out.Reset()
+	printSummary(&out, "json", summaries)
+	var doc struct {
+		Offsets []perf.OffsetProfile `json:"offset_samples"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Offsets) != 1 || doc.Offsets[0].Name != "iso" || len(doc.Offsets[0].Samples) != 3 || !doc.Offsets[0].CacheBoundary || doc.Offsets[0].SpreadPct != 75 {
+		t.Errorf("offset samples %+v", doc.Offsets)
+	}
+}
+
+func TestPrintBidirectional(t *testing.T) {
+	phase := func(d perf.Direction, phase string, mbps float64) perf.Summary {
+		return perf.Summary{URL: "https://edge.example.com/f", Name: "edge [" + phase + "]", Direction: d, BidiPhase: phase, Runs: 1, MeanMbps: mbps, MinMbps: mbps, MaxMbps: mbps}
+	}
+	both := phase(perf.Download, perf.BidiBoth, 80)
+	both.Bufferbloat = &perf.Bufferbloat{Idle: &perf.LatencyStats{P50: 12 * time.Millisecond}, Loaded: &perf.LatencyStats{P50: 48500 * time.Microsecond}}
+	summaries := []perf.Summary{phase(perf.Download, perf.BidiSolo, 100), phase(perf.Upload, perf.BidiSolo, 20), both, phase(perf.Upload, perf.BidiBoth, 20)}
+	var out bytes.Buffer
+	printSummary(&out, "", summaries)
+	want := "Bidirectional (Mbps)\n" +
+		"URL   Down solo  Down both       Up solo  Up both  Idle P50 ms  Loaded P50 ms\n" +
+		"edge  100.00     80.00 (-20.0%)  20.00    20.00    12.0         48.5\n"
+	if !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("summary lacks\n%s\ngot\n%s", want, out.String())
+	}
+	doc, _ := json.Marshal(newJSONResult(perf.Stats{Kind: perf.KindFinal, URL: "https://edge.example.com/f", BidiPhase: perf.BidiBoth, SoloMbps: 100}))
+	if !bytes.Contains(doc, []byte(`"bidi_phase":"both","solo_mbps":100`)) {
+		t.Errorf("JSON %s", doc)
+	}
+}
+
+func TestPrintWritePacing(t *testing.T) {
+	ms := time.Millisecond
+	p := &perf.WritePacing{Writes: 5120, Blocked: 900 * ms, P50: 100 * time.Microsecond, P95: 2300 * time.Microsecond, LongestStall: 410 * ms,
+		MeanMbps: 31, MedianMbps: 30.5, P95Mbps: 96.12, Burstiness: 3.1}
+	var out bytes.Buffer
+	printText(&out, perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Upload, Done: true, SizeBytes: 1000, WritePacing: p}, "")
+	if want := "  Writes:   5120 writes, p50 0.1ms p95 2.3ms, longest stall 410.0ms; burstiness 3.1x (p95 96.12, mean 31.00, median 30.50 Mbps per 100ms)\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+	out.Reset()
+	printSummary(&out, "", []perf.Summary{{URL: "https://example.com/", Direction: perf.Upload, Runs: 1, MeanMbps: 31, WritePacing: p}})
+	want := "Write pacing\n" +
+		"URL                            Writes  P50 ms  P95 ms  Longest ms  Mean Mbps  P95 Mbps  Burstiness\n" +
+		"https://example.com/ (upload)  5120    0.1     2.3     410.0       31.00      96.12     3.1x\n"
+	if !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no table\n%s\nin\n%s", want, out.String())
+	}
+	doc, _ := json.Marshal(newJSONResult(perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Upload, WritePacing: p}))
+	if want := `"write_pacing":{"writes":5120,"blocked_ms":900,"write_p50_ms":0.1,"write_p95_ms":2.3,"longest_write_stall_ms":410,"mean_interval_mbps":31,"median_interval_mbps":30.5,"p95_interval_mbps":96.12,"burstiness":3.1}`; !bytes.Contains(doc, []byte(want)) {
+		t.Errorf("JSON %s", doc)
+	}
+}
+
+func TestPrintWireCount(t *testing.T) {
+	result := perf.Stats{
+		Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true,
+		SizeBytes: 100734, WireBytes: 100734, BodyBytes: 100000, WireCounted: true,
+	}
+	var out bytes.Buffer
+	printText(&out, result, "")
+	if want := "  Bytes:    100000 body bytes in 100734 read off the wire; speed uses wire bytes\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+	doc, err := json.Marshal(newJSONResult(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"wire_bytes":100734,"body_bytes":100000,"wire_counted":true`; !bytes.Contains(doc, []byte(want)) {
+		t.Errorf("no %s in %s", want, doc)
+	}
+	// Counting the body, equal counts print nothing more.
+	result.WireCounted, result.WireBytes, result.BodyBytes = false, 100000, 100000
+	out.Reset()
+	printText(&out, result, "")
+	if bytes.Contains(out.Bytes(), []byte("Bytes:")) || bytes.Contains(out.Bytes(), []byte("Decoded:")) {
+		t.Errorf("body count printed byte counts:\n%s", out.String())
+	}
+}
+
+func TestPrintIntercepted(t *testing.T) {
+	summaries := []perf.Summary{{URL: "https://example.com/file", Direction: perf.Download, Runs: 2, Errors: 4, ChecksumErrors: 1, Intercepted: 2,
+		Interception: "got text/html, want application/octet-stream", MeanMbps: 80, MedianMbps: 80}}
+	var out bytes.Buffer
+	printSummary(&out, "", summaries)
+	for _, want := range []string{
+		"Interception suspected https://example.com/file: 2 of 6 runs, last got text/html, want application/octet-stream; their speeds are left out\n",
+		"4 (1 checksum, 2 intercepted)",
+	} {
+		if !bytes.Contains(out.Bytes(), []byte(want)) {
+			t.Errorf("no %q in\n%s", want, out.String())
+		}
+	}
+	for s, want := range map[perf.Summary]string{
+		{Errors: 3}:                    "3",
+		{Errors: 3, ChecksumErrors: 2}: "3 (2 checksum)",
+		{Errors: 3, Intercepted: 3}:    "3 (3 intercepted)",
+	} {
+		if got := summaryErrors(s); got != want {
+			t.Errorf("summaryErrors(%+v) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestPrintDualstack(t *testing.T) {
+	summaries := []perf.Summary{
+		{URL: "https://mirror.example.com/", Name: "mirror over IPv4", Family: perf.FamilyIPv4, Direction: perf.Download, Runs: 1, MeanMbps: 80, MedianMbps: 80},
+		{URL: "https://mirror.example.com/", Name: "mirror over IPv6", Family: perf.FamilyIPv6, Direction: perf.Download, Runs: 1, MeanMbps: 100, MedianMbps: 100},
+		{URL: "https://v4only.example.com/", Name: "https://v4only.example.com/ over IPv4", Family: perf.FamilyIPv4, Direction: perf.Download, Runs: 1, MeanMbps: 10, MedianMbps: 10},
+		{URL: "https://v4only.example.com/", Name: "https://v4only.example.com/ over IPv6", Family: perf.FamilyIPv6, Direction: perf.Download, Skipped: 1, SkipReason: "no IPv6 address"},
+	}
+	var out bytes.Buffer
+	printSummary(&out, "", summaries)
+	for _, want := range []string{
+		"Skipped https://v4only.example.com/ over IPv6: 1, no IPv6 address\n",
+		"Dual stack (Mbps)\n" +
+			"URL                          IPv4   IPv6    Faster\n" +
+			"mirror                       80.00  100.00  IPv6 by 25.0%\n" +
+			"https://v4only.example.com/  10.00  0.00    -\n",
+	} {
+		if !bytes.Contains(out.Bytes(), []byte(want)) {
+			t.Errorf("no\n%s\nin\n%s", want, out.String())
+		}
+	}
+	out.Reset()
+	printSummary(&out, "json", summaries)
+	if want := `"dualstack":[{"url":"https://mirror.example.com/","name":"mirror","direction":"download","ipv4_mbps":80,"ipv6_mbps":100,"faster":"ipv6","delta_percent":25}`; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %s in %s", want, out.String())
+	}
+	doc, err := json.Marshal(newJSONResult(perf.Stats{Kind: perf.KindSkipped, URL: "https://v4only.example.com/", Direction: perf.Download, Skipped: true, SkipReason: "no IPv6 address", Family: perf.FamilyIPv6}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"skipped":true,"skip_reason":"no IPv6 address","family":"ipv6"`; !bytes.Contains(doc, []byte(want)) {
+		t.Errorf("no %s in %s", want, doc)
+	}
+}
+
+func TestPrintQueueWait(t *testing.T) {
+	result := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true, SizeBytes: 1000, QueueWait: 1234567 * time.Microsecond}
+	var out bytes.Buffer
+	printText(&out, result, "")
+	if want := "  Queued:   1.235s behind other transfers from the same host\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+	doc, err := json.Marshal(newJSONResult(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"queue_wait_ms":1234`; !bytes.Contains(doc, []byte(want)) {
+		t.Errorf("no %s in %s", want, doc)
+	}
+	result.QueueWait = 0
+	out.Reset()
+	printText(&out, result, "")
+	if bytes.Contains(out.Bytes(), []byte("Queued:")) {
+		t.Errorf("Queued line without a wait:\n%s", out.String())
+	}
+}
+
+func TestPrintEncoding(t *testing.T) {
+	result := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true, SizeBytes: 1000, ContentEncoding: "gzip"}
+	var out bytes.Buffer
+	printText(&out, result, "")
+	if want := "  Encoding: gzip\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+	if doc, _ := json.Marshal(newJSONResult(result)); !bytes.Contains(doc, []byte(`"content_encoding":"gzip"`)) {
+		t.Errorf("JSON %s", doc)
+	}
+	// Identity is the norm, kept in JSON for comparing runs but not shown.
+	result.ContentEncoding = perf.EncodingIdentity
+	out.Reset()
+	printText(&out, result, "")
+	if bytes.Contains(out.Bytes(), []byte("Encoding:")) {
+		t.Errorf("Encoding line for identity:\n%s", out.String())
+	}
+	if doc, _ := json.Marshal(newJSONResult(result)); !bytes.Contains(doc, []byte(`"content_encoding":"identity"`)) {
+		t.Errorf("JSON %s", doc)
+	}
+}
+
+func TestPrintStreams(t *testing.T) {
+	result := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true, SizeBytes: 1000,
+		Streams: 4, StartSkew: 1200 * time.Microsecond, Trimmed: 340 * time.Millisecond}
+	var out bytes.Buffer
+	printText(&out, result, "")
+	for _, want := range []string{"  Streams:  4, first bytes within 1.2ms\n", "  Trimmed:  last 340ms left out of the speed (trim_ragged)\n"} {
+		if !bytes.Contains(out.Bytes(), []byte(want)) {
+			t.Errorf("no %q in\n%s", want, out.String())
+		}
+	}
+	if doc, _ := json.Marshal(newJSONResult(result)); !bytes.Contains(doc, []byte(`"start_skew_ms":1.2,"trimmed_ms":340`)) {
+		t.Errorf("JSON %s", doc)
+	}
+	// An untrimmed transfer says nothing of it.
+	result.Trimmed = 0
+	out.Reset()
+	printText(&out, result, "")
+	if bytes.Contains(out.Bytes(), []byte("Trimmed:")) {
+		t.Errorf("Trimmed line without trimming:\n%s", out.String())
+	}
+}
+
+func TestPrintUtilization(t *testing.T) {
+	result := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true, SizeBytes: 1000,
+		SpeedMbps: 812, SpeedMBps: 101.5, Utilization: 81.2}
+	var out bytes.Buffer
+	printText(&out, result, "")
+	if want := "  Speed:    101.50 MB/s (812.00 Mbps, 81% of plan)\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+	out.Reset()
+	printProgress(&out, perf.Stats{Kind: perf.KindProgress, URL: "https://example.com/", Direction: perf.Download, SizeBytes: 5e6, IntervalSpeedMbps: 900, SpeedMbps: 812, Utilization: 81.2})
+	if want := "average 812.00 Mbps, 81% of plan\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in %q", want, out.String())
+	}
+	doc, err := json.Marshal(newJSONResult(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"utilization_percent":81.2`; !bytes.Contains(doc, []byte(want)) {
+		t.Errorf("no %s in %s", want, doc)
+	}
+	// Without a plan nothing is said of one.
+	result.Utilization = 0
+	out.Reset()
+	printText(&out, result, "")
+	if doc, _ := json.Marshal(newJSONResult(result)); bytes.Contains(out.Bytes(), []byte("of plan")) || bytes.Contains(doc, []byte("utilization")) {
+		t.Errorf("plan shown without one:\n%s\n%s", out.String(), doc)
+	}
+
+	out.Reset()
+	printSummary(&out, "", []perf.Summary{
+		{URL: "https://example.com/a", Direction: perf.Download, Runs: 2, MeanMbps: 650, Utilization: 65},
+		{URL: "https://example.com/b", Direction: perf.Upload, Runs: 1, MeanMbps: 40},
+	})
+	lines := bytes.Split(out.Bytes(), []byte("\n"))
+	if len(lines) < 4 || !bytes.HasSuffix(lines[1], []byte("Of plan")) || !bytes.HasSuffix(lines[2], []byte("65%")) || !bytes.HasSuffix(lines[3], []byte("0%")) {
+		t.Errorf("summary:\n%s", out.String())
+	}
+	out.Reset()
+	printSummary(&out, "", []perf.Summary{{URL: "https://example.com/b", Direction: perf.Upload, Runs: 1, MeanMbps: 40}})
+	if bytes.Contains(out.Bytes(), []byte("Of plan")) {
+		t.Errorf("plan column without a plan:\n%s", out.String())
+	}
+}
+
+func TestPrintPeak(t *testing.T) {
+	result := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true, SizeBytes: 1000,
+		SpeedMbps: 40, PeakMbps: 52.5, TimeToPeak: 4260 * time.Millisecond}
+	var out bytes.Buffer
+	printText(&out, result, "")
+	if want := "  Peak:     52.50 Mbps over 3s, within 95% of it after 4.3s\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+	doc, err := json.Marshal(newJSONResult(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"peak_mbps":52.5,"time_to_peak_ms":4260`; !bytes.Contains(doc, []byte(want)) {
+		t.Errorf("no %s in %s", want, doc)
+	}
+	// A transfer too short to peak has no line.
+	result.TimeToPeak = 0
+	out.Reset()
+	printText(&out, result, "")
+	if bytes.Contains(out.Bytes(), []byte("Peak:")) {
+		t.Errorf("Peak line without a time to peak:\n%s", out.String())
+	}
+
+	out.Reset()
+	printSummary(&out, "", []perf.Summary{{URL: "https://example.com/", Direction: perf.Download, Runs: 2, MeanMbps: 40, PeakMbps: 52.5, TimeToPeakMs: 4260}})
+	if want := "Peak https://example.com/: 52.50 Mbps over 3s, reached after 4.3s on average\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+}
+
+func TestPrintRamp(t *testing.T) {
+	result := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true, SizeBytes: 1000,
+		SpeedMbps: 40, RampTime: 347 * time.Millisecond, RampBytes: 1760000}
+	var out bytes.Buffer
+	printText(&out, result, "")
+	if want := "  Ramp:     up to speed after 350ms, 1.76 MB in\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+	// The ramp comes back from JSON as it was, as an agent's result does.
+	doc, err := json.Marshal(newJSONResult(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"ramp_time_ms":347,"ramp_bytes":1760000`; !bytes.Contains(doc, []byte(want)) {
+		t.Errorf("no %s in %s", want, doc)
+	}
+	var back jsonResult
+	if err := json.Unmarshal(doc, &back); err != nil {
+		t.Fatal(err)
+	}
+	if s := back.stats(); s.RampTime != result.RampTime || s.RampBytes != result.RampBytes {
+		t.Errorf("ramp %v with %d bytes after a round trip", s.RampTime, s.RampBytes)
+	}
+
+	out.Reset()
+	printSummary(&out, "", []perf.Summary{{URL: "https://example.com/", Direction: perf.Download, Runs: 2, MeanMbps: 40, RampTimeMs: 347.5, RampBytes: 1.76e6}})
+	if want := "Ramp https://example.com/: up to speed after 350ms and 1.76 MB on average\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+	// A transfer that never got up to speed has no lines.
+	out.Reset()
+	printSummary(&out, "", []perf.Summary{{URL: "https://example.com/", Direction: perf.Download, Runs: 2, MeanMbps: 40}})
+	if bytes.Contains(out.Bytes(), []byte("Ramp")) {
+		t.Errorf("Ramp line without a ramp:\n%s", out.String())
+	}
+}
+
+func TestJSONUserAgent(t *testing.T) {
+	doc, err := json.Marshal(newJSONResult(perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true, UserAgent: "probe/1.0"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"user_agent":"probe/1.0"`; !bytes.Contains(doc, []byte(want)) {
+		t.Errorf("no %s in %s", want, doc)
+	}
+}
+
+func TestPrintReuseSummary(t *testing.T) {
+	var out bytes.Buffer
+	printSummary(&out, "", []perf.Summary{{URL: "https://example.com/", Direction: perf.Download, Runs: 4, Reused: 3, MeanMbps: 40}})
+	if want := "Reuse https://example.com/: 3 of 4 runs reused a connection (75%)\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+}
+
+func TestPrintCPU(t *testing.T) {
+	result := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true, SizeBytes: 1000000, Elapsed: 2 * time.Second,
+		CPU:        &perf.CPUUsage{User: 1200 * time.Millisecond, System: 540 * time.Millisecond, GCPause: 3 * time.Millisecond, GCs: 2, Fraction: 0.87},
+		CPUWarning: "measurement may be CPU-bound (87% CPU)"}
+	var out bytes.Buffer
+	printText(&out, result, "")
+	if want := "  CPU:      measurement may be CPU-bound (87% CPU)\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+	doc, err := json.Marshal(newJSONResult(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `"cpu":{"user_ms":1200,"system_ms":540,"gc_pause_ms":3,"gcs":2,"cpu_percent":87},"cpu_warning":"measurement may be CPU-bound (87% CPU)"`
+	if !bytes.Contains(doc, []byte(want)) {
+		t.Errorf("no %s in %s", want, doc)
+	}
+
+	// The raw numbers are kept without a warning, and only they are.
+	result.CPU.Fraction, result.CPUWarning = 0.1, ""
+	out.Reset()
+	printText(&out, result, "")
+	if bytes.Contains(out.Bytes(), []byte("CPU:")) {
+		t.Errorf("CPU line without a warning:\n%s", out.String())
+	}
+	if doc, _ := json.Marshal(newJSONResult(result)); !bytes.Contains(doc, []byte(`"cpu_percent":10}`)) || bytes.Contains(doc, []byte("cpu_warning")) {
+		t.Errorf("JSON %s", doc)
+	}
+}
+
+func TestPrintResumed(t *testing.T) {
+	result := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true, SizeBytes: 300000, Resumes: 2,
+		Segments: []perf.Segment{
+			{Offset: 0, Bytes: 100000, Elapsed: 20 * time.Millisecond, SpeedMbps: 40, Error: errors.New("unexpected EOF")},
+			{Offset: 100000, Bytes: 100000, Elapsed: 64 * time.Millisecond, SpeedMbps: 12.5, Error: errors.New("unexpected EOF")},
+			{Offset: 200000, Bytes: 100000, Elapsed: 21 * time.Millisecond, SpeedMbps: 38.2},
+		}}
+	var out bytes.Buffer
+	printText(&out, result, "")
+	if want := "  Resumed:  2 times, segments 40.00, 12.50 and 38.20 Mbps\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+	doc, err := json.Marshal(newJSONResult(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `"resumes":2,"segments":[{"offset":0,"bytes":100000,"elapsed_ms":20,"speed_mbps":40,"error":"unexpected EOF"},` +
+		`{"offset":100000,"bytes":100000,"elapsed_ms":64,"speed_mbps":12.5,"error":"unexpected EOF"},{"offset":200000,"bytes":100000,"elapsed_ms":21,"speed_mbps":38.2}]`
+	if !bytes.Contains(doc, []byte(want)) {
+		t.Errorf("no %s in %s", want, doc)
+	}
+
+	// A failed download says how far resuming got it.
+	result.Done, result.Kind, result.Error, result.Resumes, result.Segments = false, perf.KindError, errors.New("reset"), 1, result.Segments[:2]
+	out.Reset()
+	printText(&out, result, "")
+	if want := "  Resumed:  1 time, segments 40.00 and 12.50 Mbps\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+
+	out.Reset()
+	printSummary(&out, "", []perf.Summary{{URL: "https://example.com/", Direction: perf.Download, Runs: 3, Resumed: 2, Resumes: 5, MeanMbps: 30}})
+	if want := "Resume https://example.com/: 2 runs resumed 5 times in all\n"; !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no %q in\n%s", want, out.String())
+	}
+}
+
+func TestPrintHeaders(t *testing.T) {
+	result := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true, SizeBytes: 1000,
+		Headers: map[string]string{"X-Cache": "HIT", "Via": "1.1 edge-a, 1.1 shield-b", "Age": "12"}, HeadersTruncated: true}
+	var out bytes.Buffer
+	printText(&out, result, "")
+	want := "  Headers:\n" +
+		"    Age: 12\n" +
+		"    Via: 1.1 edge-a, 1.1 shield-b\n" +
+		"    X-Cache: HIT\n" +
+		"    ... the rest left out to stay under the size cap\n"
+	if !bytes.Contains(out.Bytes(), []byte(want)) {
+		t.Errorf("no\n%s\nin\n%s", want, out.String())
+	}
+	doc, err := json.Marshal(newJSONResult(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"headers":{"Age":"12","Via":"1.1 edge-a, 1.1 shield-b","X-Cache":"HIT"},"headers_truncated":true`; !bytes.Contains(doc, []byte(want)) {
+		t.Errorf("no %s in %s", want, doc)
+	}
+	// Failures show the headers too, to debug what the CDN answered.
+	result.Kind, result.Done, result.Error, result.HeadersTruncated = perf.KindError, false, errors.New("unexpected status 503"), false
+	out.Reset()
+	printText(&out, result, "")
+	if !bytes.Contains(out.Bytes(), []byte("  Headers:\n    Age: 12\n")) {
+		t.Errorf("no headers on a failure:\n%s", out.String())
+	}
+}
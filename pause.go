@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// pauseRecheck is how often a paused run looks for the pause file to be
+// gone.
+const pauseRecheck = 5 * time.Second
+
+// pauser holds a run back while it is paused: from a pause signal to a
+// resume signal, or while the pause file exists. Transfers already
+// running finish; the ones not yet started, and the next pass, wait.
+type pauser struct {
+	mu       sync.Mutex
+	file     string
+	signaled bool
+	// filed is whether the pause file existed when last looked for.
+	filed bool
+	// changed is closed, and replaced, whenever the state changes, which
+	// wakes everyone waiting.
+	changed chan struct{}
+}
+
+func newPauser(file string) *pauser {
+	return &pauser{file: file, changed: make(chan struct{})}
+}
+
+// setFile switches to the pause file of a reloaded config.
+func (p *pauser) setFile(file string) {
+	p.mu.Lock()
+	p.file = file
+	p.mu.Unlock()
+	p.check()
+}
+
+// watchSignals pauses on pauseSignal and resumes on resumeSignal, where
+// the platform has them.
+func (p *pauser) watchSignals() {
+	if pauseSignal == nil {
+		return
+	}
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, pauseSignal, resumeSignal)
+	go func() {
+		for sig := range sigs {
+			p.signal(sig == pauseSignal)
+		}
+	}()
+}
+
+// signal pauses or resumes the run.
+func (p *pauser) signal(pause bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.signaled == pause {
+		return
+	}
+	was := p.pausedLocked()
+	p.signaled = pause
+	if pause {
+		slog.Info("received pause signal, pausing once running transfers finish")
+	} else {
+		slog.Info("received resume signal")
+	}
+	p.noteLocked(was)
+}
+
+// check looks for the pause file. Without one the run is not paused by
+// it, so a reload that drops pause_file resumes a run it paused.
+func (p *pauser) check() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	filed := false
+	if p.file != "" {
+		_, err := os.Stat(p.file)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("checking pause_file", "err", err)
+			return
+		}
+		filed = err == nil
+	}
+	if filed == p.filed {
+		return
+	}
+	was := p.pausedLocked()
+	p.filed = filed
+	switch {
+	case filed:
+		slog.Info("pause_file exists, pausing", "pause_file", p.file)
+	case p.file == "":
+		slog.Info("pause_file no longer set")
+	default:
+		slog.Info("pause_file removed", "pause_file", p.file)
+	}
+	p.noteLocked(was)
+}
+
+// noteLocked logs whether the run is paused once that changed from was,
+// and wakes the waiters.
+func (p *pauser) noteLocked(was bool) {
+	switch now := p.pausedLocked(); {
+	case now && !was:
+		slog.Warn("paused")
+	case !now && was:
+		slog.Info("resumed")
+	}
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *pauser) pausedLocked() bool {
+	return p.signaled || p.filed
+}
+
+// paused reports whether the run is paused, and why.
+func (p *pauser) paused() (bool, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.signaled:
+		return true, "signal"
+	case p.filed:
+		return true, "pause_file"
+	}
+	return false, ""
+}
+
+// wait blocks while the run is paused, looking for the pause file first
+// and then every pauseRecheck. It returns false once ctx is done.
+func (p *pauser) wait(ctx context.Context) bool {
+	p.check()
+	for {
+		p.mu.Lock()
+		paused, changed := p.pausedLocked(), p.changed
+		p.mu.Unlock()
+		if !paused {
+			return ctx.Err() == nil
+		}
+		timer := time.NewTimer(pauseRecheck)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-changed:
+		case <-timer.C:
+			p.check()
+		}
+		timer.Stop()
+	}
+}
+
+// hold is wait in the form the Tester calls before it starts each
+// transfer.
+func (p *pauser) hold(ctx context.Context) {
+	p.wait(ctx)
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package main
+
+import "os"
+
+// There are no pause and resume signals here; pause_file still works.
+var pauseSignal, resumeSignal os.Signal
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// waited runs p.wait in the background, reporting what it returned.
+func waited(ctx context.Context, p *pauser) <-chan bool {
+	done := make(chan bool, 1)
+	go func() { done <- p.wait(ctx) }()
+	return done
+}
+
+// blocked fails unless nothing arrives on done for a while.
+func blocked(t *testing.T, done <-chan bool) {
+	t.Helper()
+	select {
+	case ok := <-done:
+		t.Fatalf("wait returned %v while paused", ok)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// released fails unless done gives want soon.
+func released(t *testing.T, done <-chan bool, want bool) {
+	t.Helper()
+	select {
+	case ok := <-done:
+		if ok != want {
+			t.Fatalf("wait returned %v, want %v", ok, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait still blocked")
+	}
+}
+
+func TestPauserSignal(t *testing.T) {
+	logs := captureLog(t)
+	p := newPauser("")
+	if paused, _ := p.paused(); paused || !p.wait(context.Background()) {
+		t.Fatal("a new pauser is paused")
+	}
+
+	p.signal(true)
+	if paused, reason := p.paused(); !paused || reason != "signal" {
+		t.Errorf("paused %v by %q after the pause signal", paused, reason)
+	}
+	done := waited(context.Background(), p)
+	blocked(t, done)
+	// A second pause signal changes nothing, and resuming wakes the wait.
+	p.signal(true)
+	blocked(t, done)
+	p.signal(false)
+	released(t, done, true)
+	if paused, _ := p.paused(); paused {
+		t.Error("still paused after the resume signal")
+	}
+	if got := logs.String(); strings.Count(got, `msg=paused`) != 1 || strings.Count(got, `msg=resumed`) != 1 {
+		t.Errorf("logs:\n%s", got)
+	}
+
+	// A cancelled run stops waiting.
+	p.signal(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	done = waited(ctx, p)
+	blocked(t, done)
+	cancel()
+	released(t, done, false)
+}
+
+func TestPauserFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "paused")
+	p := newPauser(path)
+	if !p.wait(context.Background()) {
+		t.Fatal("paused without the pause file")
+	}
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The file is looked for as the wait starts.
+	done := waited(context.Background(), p)
+	blocked(t, done)
+	if paused, reason := p.paused(); !paused || reason != "pause_file" {
+		t.Errorf("paused %v by %q with the pause file", paused, reason)
+	}
+
+	// A signal keeps the run paused after the file goes, and the signal's
+	// reason shows while both hold.
+	p.signal(true)
+	if _, reason := p.paused(); reason != "signal" {
+		t.Errorf("paused by %q", reason)
+	}
+	os.Remove(path)
+	p.check()
+	blocked(t, done)
+	p.signal(false)
+	released(t, done, true)
+
+	// A reloaded config without the pause file resumes a run paused by it.
+	os.WriteFile(path, nil, 0o644)
+	done = waited(context.Background(), p)
+	blocked(t, done)
+	p.setFile("")
+	released(t, done, true)
+}
+
+func TestPauseHoldsTransfers(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	p := newPauser("")
+	p.signal(true)
+	tester := perf.New(perf.Options{ProgressInterval: -1, Hold: p.hold})
+	results := tester.Run(context.Background(), []perf.Target{{URL: srv.URL + "/a"}, {URL: srv.URL + "/b"}}, 1)
+	time.Sleep(50 * time.Millisecond)
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("%d requests while paused", n)
+	}
+	p.signal(false)
+	finals := 0
+	for s := range results {
+		if s.Final() {
+			if s.Error != nil {
+				t.Error(s.Error)
+			}
+			finals++
+		}
+	}
+	if finals != 2 || requests.Load() != 2 {
+		t.Errorf("%d results from %d requests after resuming", finals, requests.Load())
+	}
+}
+
+func TestPauseVisible(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "paused")
+	p := newPauser(path)
+	m := newMetrics("run-1", "edge-1", nil)
+	m.pause = p
+	s := newTestAPI(t, fakeRunner{release: make(chan struct{})}, 1)
+	s.pause = p
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+
+	for _, paused := range []bool{false, true, false} {
+		if paused {
+			os.WriteFile(path, nil, 0o644)
+		} else {
+			os.Remove(path)
+		}
+		// Both look for the file themselves, without a pass to do it.
+		want := `yaperf_paused{host="edge-1"} 0`
+		if paused {
+			want = `yaperf_paused{host="edge-1"} 1`
+		}
+		if body := scrape(t, m); !strings.Contains(body, want+"\n") {
+			t.Errorf("paused %v: metrics lack %s", paused, want)
+		}
+		var status serverStatus
+		call(t, srv, "GET", "/status", "", &status)
+		if status.Paused != paused || (paused && status.Reason != "pause_file") {
+			t.Errorf("paused %v: status %+v", paused, status)
+		}
+		resp := call(t, srv, "POST", "/tests", `{"url": "https://example.com/a"}`, nil)
+		if (resp.StatusCode == http.StatusServiceUnavailable) != paused {
+			t.Errorf("paused %v: POST /tests %d", paused, resp.StatusCode)
+		}
+	}
+}
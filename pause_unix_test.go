@@ -0,0 +1,30 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"context"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPauseSignals(t *testing.T) {
+	p := newPauser("")
+	p.watchSignals()
+	defer signal.Reset(pauseSignal, resumeSignal)
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	// The signal arrives in its own time.
+	deadline := time.Now().Add(time.Second)
+	for paused, _ := p.paused(); !paused; paused, _ = p.paused() {
+		if time.Now().After(deadline) {
+			t.Fatal("not paused by SIGUSR1")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	done := waited(context.Background(), p)
+	blocked(t, done)
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR2)
+	released(t, done, true)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// generated is a seekable body of size bytes copied out of pattern, so
+// serving it allocates nothing per read.
+type generated struct {
+	pattern   perf.Pattern
+	size, off int64
+}
+
+func (g *generated) Read(p []byte) (int, error) {
+	if g.off >= g.size {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), g.size-g.off)]
+	g.pattern.Fill(p, g.off)
+	g.off += int64(len(p))
+	return len(p), nil
+}
+
+func (g *generated) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += g.off
+	case io.SeekEnd:
+		offset += g.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start")
+	}
+	g.off = offset
+	return offset, nil
+}
+
+// runPayload implements "yaperf serve-payload": a server for other yaperf
+// instances to test against.
+func runPayload(args []string) int {
+	fs := flag.NewFlagSet("serve-payload", flag.ExitOnError)
+	seed := fs.Uint64("seed", 0, "seed of the pattern downloads are filled with, for verify_pattern")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: yaperf serve-payload [-seed n] [addr]")
+		fmt.Fprintln(fs.Output(), "serves GET /download/{size} (such as 1GB) and POST /upload on addr, :8081 by default")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	addr := ":8081"
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		addr = fs.Arg(0)
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	slog.Info("serving payloads", "addr", addr)
+	if err := http.ListenAndServe(addr, payloadMux(perf.NewPattern(*seed))); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// payloadMux serves downloads filled with pattern and uploads.
+func payloadMux(pattern perf.Pattern) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /download/{size}", func(w http.ResponseWriter, r *http.Request) {
+		servePayload(w, r, pattern)
+	})
+	mux.HandleFunc("POST /upload", receivePayload)
+	return mux
+}
+
+// servePayload streams a body of the requested size filled with pattern,
+// or with the pattern of the seed query parameter when there is one. Range
+// and HEAD requests are handled by http.ServeContent.
+func servePayload(w http.ResponseWriter, r *http.Request, pattern perf.Pattern) {
+	size, err := perf.ParseByteSize(r.PathValue("size"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s := r.URL.Query().Get("seed"); s != "" {
+		seed, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "bad seed: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		pattern = perf.NewPattern(seed)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", time.Time{}, &generated{pattern: pattern, size: int64(size)})
+}
+
+// receivePayload discards the request body and reports how much arrived.
+func receivePayload(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"bytes":%d,"elapsed_ms":%d}`+"\n", n, time.Since(start).Milliseconds())
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"yaperf/pkg/perf"
+)
+
+func TestPayloadServer(t *testing.T) {
+	var ranges atomic.Int32
+	mux := payloadMux(perf.NewPattern(7))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	tester := perf.New(perf.Options{ProgressInterval: -1})
+	tests := []struct {
+		name   string
+		target perf.Target
+		bytes  int64
+	}{
+		{"download", perf.Target{URL: srv.URL + "/download/10MB"}, 10e6},
+		// A range request per stream, adding up to the body.
+		{"streams", perf.Target{URL: srv.URL + "/download/10MB", Streams: 4}, 10e6},
+		{"upload", perf.Target{URL: srv.URL + "/upload", Method: perf.MethodUpload, UploadSize: 5e6}, 5e6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges.Store(0)
+			var last perf.Stats
+			for s := range tester.Test(context.Background(), tt.target) {
+				last = s
+			}
+			if last.Error != nil || last.SizeBytes != tt.bytes {
+				t.Errorf("moved %d bytes, err %v, want %d", last.SizeBytes, last.Error, tt.bytes)
+			}
+			if tt.target.Streams > 1 && (last.Streams != tt.target.Streams || ranges.Load() < int32(tt.target.Streams)) {
+				t.Errorf("ran %d streams over %d range requests", last.Streams, ranges.Load())
+			}
+		})
+	}
+}
+
+func TestPayloadContent(t *testing.T) {
+	pattern := perf.NewPattern(7)
+	srv := httptest.NewServer(payloadMux(pattern))
+	defer srv.Close()
+	get := func(path, ranges string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if ranges != "" {
+			req.Header.Set("Range", ranges)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+	want := make([]byte, 300000)
+	pattern.Fill(want, 0)
+
+	resp, body := get("/download/300KB", "")
+	if resp.ContentLength != 300000 || resp.Header.Get("Accept-Ranges") != "bytes" || !bytes.Equal(body, want) {
+		t.Errorf("full body: length %d, accept ranges %q, matches %v", resp.ContentLength, resp.Header.Get("Accept-Ranges"), bytes.Equal(body, want))
+	}
+	// A range is the same bytes as the full body has there, even across a
+	// block of the pattern.
+	resp, body = get("/download/300KB", "bytes=65530-131080")
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != "bytes 65530-131080/300000" || !bytes.Equal(body, want[65530:131081]) {
+		t.Errorf("range: %s, %q, matches %v", resp.Status, resp.Header.Get("Content-Range"), bytes.Equal(body, want[65530:131081]))
+	}
+	resp, _ = get("/download/300KB", "bytes=400000-")
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range past the end: %s", resp.Status)
+	}
+	// Another seed is another pattern.
+	other := make([]byte, 1000)
+	perf.NewPattern(8).Fill(other, 0)
+	if _, body := get("/download/1000?seed=8", ""); !bytes.Equal(body, other) {
+		t.Error("seed query ignored")
+	}
+	if resp, _ := get("/download/lots", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad size: %s", resp.Status)
+	}
+
+	resp, err := http.Post(srv.URL+"/upload", "application/octet-stream", bytes.NewReader(make([]byte, 12345)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got struct{ Bytes int64 }
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil || got.Bytes != 12345 {
+		t.Errorf("upload reported %d bytes, err %v", got.Bytes, err)
+	}
+}
+
+func TestGeneratedAllocates(t *testing.T) {
+	g := &generated{pattern: perf.NewPattern(1), size: 1 << 40}
+	buf := make([]byte, 32<<10)
+	if allocs := testing.AllocsPerRun(100, func() { g.Read(buf) }); allocs != 0 {
+		t.Errorf("Read allocates %v times", allocs)
+	}
+}
@@ -0,0 +1,84 @@
+package perf
+
+import (
+	"fmt"
+	"time"
+)
+
+// Modes accepted by the mode option. A fixed test transfers the whole body
+// or up to its limits; an adaptive one stops once the speed is stable.
+const (
+	ModeFixed    = "fixed"
+	ModeAdaptive = "adaptive"
+)
+
+// adaptiveCap bounds adaptive tests that set no max_duration of their own.
+const adaptiveCap = 30 * time.Second
+
+// Adaptive tunes how an adaptive test decides the speed is stable.
+type Adaptive struct {
+	// Window is the number of interval samples looked at, 5 by default.
+	Window int `yaml:"window"`
+	// MaxCV is the coefficient of variation, the standard deviation over
+	// the mean, the window must fall below. It defaults to 0.05.
+	MaxCV float64 `yaml:"max_cv"`
+}
+
+func (a Adaptive) withDefaults() Adaptive {
+	if a.Window == 0 {
+		a.Window = 5
+	}
+	if a.MaxCV == 0 {
+		a.MaxCV = 0.05
+	}
+	return a
+}
+
+func checkMode(mode string) error {
+	switch mode {
+	case "", ModeFixed, ModeAdaptive:
+		return nil
+	}
+	return fmt.Errorf("mode must be fixed or adaptive, got %q", mode)
+}
+
+// stable reports whether the last window speeds vary by less than maxCV,
+// along with their mean. It needs at least window samples.
+func stable(speeds []float64, window int, maxCV float64) (float64, bool) {
+	if window < 2 || len(speeds) < window {
+		return 0, false
+	}
+	last := speeds[len(speeds)-window:]
+	m := mean(last)
+	if m <= 0 {
+		return m, false
+	}
+	return m, stddev(last)/m < maxCV
+}
+
+// stabilizer feeds the interval speeds of an adaptive test to stable. A nil
+// stabilizer never reports a stable speed.
+type stabilizer struct {
+	Adaptive
+	speeds []float64
+}
+
+func (t *Tester) stabilizer(target Target) *stabilizer {
+	if target.Mode != ModeAdaptive {
+		return nil
+	}
+	return &stabilizer{Adaptive: t.opts.Adaptive.withDefaults()}
+}
+
+// add records the interval of a progress snapshot. Snapshots inside the
+// warm-up window are skipped.
+func (s *stabilizer) add(stats Stats) (float64, bool) {
+	if s == nil || stats.Warmup {
+		return 0, false
+	}
+	s.speeds = append(s.speeds, stats.IntervalSpeedMbps)
+	if len(s.speeds) > s.Window {
+		s.speeds = s.speeds[len(s.speeds)-s.Window:]
+	}
+	return stable(s.speeds, s.Window, s.MaxCV)
+}
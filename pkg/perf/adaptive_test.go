@@ -0,0 +1,100 @@
+package perf
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStable(t *testing.T) {
+	tests := []struct {
+		name   string
+		speeds []float64
+		window int
+		maxCV  float64
+		mean   float64
+		stable bool
+	}{
+		{"too few", []float64{100, 100}, 3, 0.05, 0, false},
+		{"steady", []float64{100, 100, 100}, 3, 0.05, 100, true},
+		// 98 and 102 spread by 2 around 100, a CV of 0.02.
+		{"within", []float64{98, 102, 98, 102}, 4, 0.05, 100, true},
+		{"outside", []float64{98, 102, 98, 102}, 4, 0.01, 100, false},
+		// Only the last window counts, so a slow start is forgotten.
+		{"ramped up", []float64{5, 40, 90, 100, 100, 100}, 3, 0.05, 100, true},
+		{"still ramping", []float64{5, 40, 90, 100, 100, 100}, 5, 0.05, 86, false},
+		{"stalled", []float64{0, 0, 0}, 3, 0.05, 0, false},
+		{"window of one", []float64{100}, 1, 0.05, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mean, ok := stable(tt.speeds, tt.window, tt.maxCV)
+			if ok != tt.stable || !near(mean, tt.mean) {
+				t.Errorf("stable = %v, %v, want %v, %v", mean, ok, tt.mean, tt.stable)
+			}
+		})
+	}
+}
+
+func TestStabilizer(t *testing.T) {
+	tester := New(Options{Adaptive: Adaptive{Window: 3}})
+	if tester.stabilizer(Target{}) != nil || tester.stabilizer(Target{Mode: ModeFixed}) != nil {
+		t.Error("stabilizer for a fixed test")
+	}
+	var none *stabilizer
+	if _, ok := none.add(Stats{IntervalSpeedMbps: 100}); ok {
+		t.Error("a nil stabilizer reported a stable speed")
+	}
+	s := tester.stabilizer(Target{Mode: ModeAdaptive})
+	if s.Window != 3 || s.MaxCV != 0.05 {
+		t.Errorf("stabilizer %+v, want window 3 and the default max cv", s.Adaptive)
+	}
+	feed := []struct {
+		stats  Stats
+		stable bool
+	}{
+		{Stats{IntervalSpeedMbps: 100}, false},
+		// Warm-up snapshots are not counted toward the window.
+		{Stats{IntervalSpeedMbps: 100, Warmup: true}, false},
+		{Stats{IntervalSpeedMbps: 100, Warmup: true}, false},
+		{Stats{IntervalSpeedMbps: 300}, false},
+		{Stats{IntervalSpeedMbps: 300}, false},
+		{Stats{IntervalSpeedMbps: 300}, true},
+	}
+	for i, f := range feed {
+		if _, ok := s.add(f.stats); ok != f.stable {
+			t.Errorf("snapshot %d: stable %v, want %v", i, ok, f.stable)
+		}
+	}
+	if len(s.speeds) != 3 {
+		t.Errorf("kept %d speeds, want the window of 3", len(s.speeds))
+	}
+}
+
+func TestAdaptiveDownload(t *testing.T) {
+	// A body far too large to finish, served at a steady pace.
+	srv := payloadServer(t, 16<<10, 5*time.Millisecond)
+	tester := New(Options{ProgressInterval: 50 * time.Millisecond, Adaptive: Adaptive{Window: 3, MaxCV: 0.5}})
+	started := time.Now()
+	all := collect(tester.Test(context.Background(), Target{URL: srv.URL + "/bytes/1000000000", Mode: ModeAdaptive}))
+	last := all[len(all)-1]
+	if time.Since(started) > 5*time.Second {
+		t.Errorf("adaptive download ran %v", time.Since(started))
+	}
+	if !last.Done || last.Error != nil || !last.Adaptive {
+		t.Fatalf("final %+v, want a completed adaptive download", last)
+	}
+	if last.StableMbps <= 0 || last.StableAfter < 150*time.Millisecond || last.StableAfter > last.Elapsed+last.TTFB {
+		t.Errorf("stable at %v Mbps after %v, elapsed %v", last.StableMbps, last.StableAfter, last.Elapsed)
+	}
+
+	// A speed that never settles enough runs to max_duration.
+	tester = New(Options{ProgressInterval: 50 * time.Millisecond, Adaptive: Adaptive{Window: 3, MaxCV: 1e-9}})
+	target := Target{URL: srv.URL + "/bytes/1000000000", Mode: ModeAdaptive}
+	target.MaxDuration = 400 * time.Millisecond
+	all = collect(tester.Test(context.Background(), target))
+	last = all[len(all)-1]
+	if !last.Done || last.Error != nil || last.StableMbps != 0 || last.StableAfter != 0 {
+		t.Errorf("final %+v, want a download stopped at max_duration without a stable speed", last)
+	}
+}
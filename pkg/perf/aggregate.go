@@ -0,0 +1,136 @@
+package perf
+
+import "time"
+
+// TotalURL is the URL of the snapshots Aggregate adds.
+const TotalURL = "TOTAL"
+
+// total sums the traffic of every transfer in one direction.
+type total struct {
+	base  Stats
+	first time.Time
+	// at is when bytes was last updated, which ends the current interval.
+	at       time.Time
+	bytes    int64
+	tickedAt time.Time
+	ticked   int64
+	peak     float64
+	// stamped and offset are the Timestamp and RunOffset of the latest
+	// snapshot added.
+	stamped time.Time
+	offset  time.Duration
+	// doneAt is when the first transfer finished and doneBytes the count
+	// then, which the final speed ends at when trim is set.
+	trim      bool
+	doneAt    time.Time
+	doneBytes int64
+}
+
+// Aggregate forwards every snapshot from in, such as the results of Run,
+// and once a second adds a TOTAL snapshot per direction whose interval
+// covers the bytes of all transfers moving data. When in is closed it
+// sends a final TOTAL with the average speed over the whole run and the
+// peak one-second aggregate in PeakMbps. With trimRagged that average ends
+// when the first transfer finished, leaving out the tail where fewer ran.
+// Snapshots are summed by the one goroutine reading in, so any number of
+// transfers may feed it.
+func Aggregate(in <-chan Stats, trimRagged bool) <-chan Stats {
+	out := make(chan Stats)
+	go func() {
+		defer close(out)
+		seen := map[summaryKey]int64{}
+		totals := map[Direction]*total{}
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case s, ok := <-in:
+				if !ok {
+					for _, d := range []Direction{Download, Upload} {
+						if tot := totals[d]; tot != nil && tot.bytes > 0 {
+							out <- tot.final()
+						}
+					}
+					return
+				}
+				if s.Direction != Latency && s.URL != TotalURL {
+					tot := totals[s.Direction]
+					if tot == nil {
+						tot = &total{base: Stats{URL: TotalURL, Direction: s.Direction, RunID: s.RunID, Host: s.Host, Labels: s.Labels}, trim: trimRagged}
+						totals[s.Direction] = tot
+					}
+					tot.add(seen, s, time.Now())
+				}
+				out <- s
+			case <-ticker.C:
+				for _, d := range []Direction{Download, Upload} {
+					if tot := totals[d]; tot != nil && tot.at.After(tot.tickedAt) {
+						out <- tot.tick()
+					}
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// add counts the bytes s moved since the previous snapshot of its transfer.
+// A transfer's first snapshot dates the start of the total back to when
+// that transfer began.
+func (t *total) add(seen map[summaryKey]int64, s Stats, now time.Time) {
+	key := summaryKey{s.URL, s.Direction, s.PinnedIP, s.Family, s.Agent, s.SweepSize, s.BidiPhase, s.SampleOffset}
+	prev := seen[key]
+	if t.first.IsZero() {
+		t.first = now.Add(-s.Elapsed)
+		t.tickedAt = t.first
+	}
+	if s.SizeBytes > prev {
+		t.bytes += s.SizeBytes - prev
+	}
+	seen[key] = s.SizeBytes
+	t.at = now
+	t.stamped, t.offset = s.Timestamp, s.RunOffset
+	// A total is routed only to the sinks every transfer in it is.
+	t.base.Sinks = commonSinks(t.base.Sinks, s.Sinks)
+	if s.Final() || s.Retrying {
+		delete(seen, key)
+	}
+	if s.Final() && !s.Skipped && t.doneAt.IsZero() {
+		t.doneAt, t.doneBytes = now, t.bytes
+	}
+}
+
+// tick reports the bytes counted since the previous tick. The interval ends
+// at the last snapshot rather than at the tick, since that is how far the
+// count is known.
+func (t *total) tick() Stats {
+	s := t.base
+	s.Timestamp, s.RunOffset = t.stamped, t.offset
+	s.setSpeed(t.bytes, t.at.Sub(t.first))
+	s.IntervalBytes = t.bytes - t.ticked
+	s.IntervalSpeedMbps = float64(s.IntervalBytes*8) / 1e6 / t.at.Sub(t.tickedAt).Seconds()
+	t.peak = max(t.peak, s.IntervalSpeedMbps)
+	s.PeakMbps = t.peak
+	t.ticked, t.tickedAt = t.bytes, t.at
+	s.Kind = KindProgress
+	return s
+}
+
+func (t *total) final() Stats {
+	s := t.base
+	s.Timestamp, s.RunOffset = t.stamped, t.offset
+	s.setSpeed(t.bytes, t.at.Sub(t.first))
+	if t.trim && t.doneAt.After(t.first) && t.doneAt.Before(t.at) {
+		trimmed := s
+		trimmed.setSpeed(t.doneBytes, t.doneAt.Sub(t.first))
+		s.SpeedMbps, s.SpeedMBps = trimmed.SpeedMbps, trimmed.SpeedMBps
+		s.Trimmed = t.at.Sub(t.doneAt)
+	}
+	// A run shorter than a second has no full interval to take a peak from.
+	s.PeakMbps = t.peak
+	if s.PeakMbps == 0 {
+		s.PeakMbps = s.SpeedMbps
+	}
+	s.Done, s.Kind = true, KindFinal
+	return s
+}
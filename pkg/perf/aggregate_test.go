@@ -0,0 +1,120 @@
+package perf
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAggregate(t *testing.T) {
+	// Three downloads at 10, 20 and 30 Mbps and an upload at 5 report
+	// every 100ms for 2.5s, each from a goroutine of its own.
+	const steps, step = 25, 100 * time.Millisecond
+	in := make(chan Stats)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, f := range []struct {
+		url  string
+		dir  Direction
+		mbps int64
+	}{
+		{"/10", Download, 10},
+		{"/20", Download, 20},
+		{"/30", Download, 30},
+		{"/up", Upload, 5},
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			perStep := f.mbps * 1e6 / 8 / int64(time.Second/step)
+			for i := int64(1); i <= steps; i++ {
+				time.Sleep(time.Until(start.Add(time.Duration(i) * step)))
+				s := Stats{URL: f.url, Direction: f.dir, Kind: KindProgress, SizeBytes: i * perStep, Elapsed: time.Duration(i) * step}
+				if i == steps {
+					s.Kind, s.Done = KindFinal, true
+				}
+				in <- s
+			}
+		}()
+	}
+	// Latency probes move no data of their own.
+	go func() {
+		in <- Stats{URL: "/ping", Direction: Latency, Done: true, Kind: KindFinal, SizeBytes: 1e9}
+		wg.Wait()
+		close(in)
+	}()
+
+	var ticks, finals []Stats
+	forwarded := 0
+	for s := range Aggregate(in, false) {
+		switch {
+		case s.URL != TotalURL:
+			forwarded++
+		case s.Final():
+			finals = append(finals, s)
+		case s.Direction == Download:
+			ticks = append(ticks, s)
+		}
+	}
+	if forwarded != 4*steps+1 {
+		t.Errorf("forwarded %d snapshots, want %d", forwarded, 4*steps+1)
+	}
+	if len(ticks) < 2 {
+		t.Fatalf("%d download totals, want one a second", len(ticks))
+	}
+	for _, s := range ticks {
+		if s.IntervalSpeedMbps < 48 || s.IntervalSpeedMbps > 72 {
+			t.Errorf("interval total %.1f Mbps, want about 60", s.IntervalSpeedMbps)
+		}
+	}
+	if len(finals) != 2 {
+		t.Fatalf("%d final totals, want one per direction", len(finals))
+	}
+	down, up := finals[0], finals[1]
+	if down.Direction != Download || down.SizeBytes != 60e6/8*2.5 {
+		t.Errorf("download total of %d bytes", down.SizeBytes)
+	}
+	if down.SpeedMbps < 54 || down.SpeedMbps > 66 || down.PeakMbps < down.SpeedMbps*0.9 {
+		t.Errorf("download total %.1f Mbps, peak %.1f, want about 60", down.SpeedMbps, down.PeakMbps)
+	}
+	if up.Direction != Upload || up.SpeedMbps < 4.5 || up.SpeedMbps > 5.5 {
+		t.Errorf("upload total %s at %.1f Mbps, want about 5", up.Direction, up.SpeedMbps)
+	}
+}
+
+func TestAggregateTrimRagged(t *testing.T) {
+	// /a and /b have moved 1MB each over a second when /a finishes with
+	// another 1MB, and /b with its second half 500ms later. A skipped transfer finishes nothing.
+	for _, trim := range []bool{false, true} {
+		in := make(chan Stats)
+		go func() {
+			defer close(in)
+			in <- Stats{URL: "/a", Direction: Download, Kind: KindProgress, SizeBytes: 1e6, Elapsed: time.Second}
+			in <- Stats{URL: "/skipped", Direction: Download, Kind: KindSkipped, Skipped: true}
+			in <- Stats{URL: "/b", Direction: Download, Kind: KindProgress, SizeBytes: 1e6, Elapsed: time.Second}
+			in <- Stats{URL: "/a", Direction: Download, Kind: KindFinal, Done: true, SizeBytes: 2e6, Elapsed: time.Second}
+			time.Sleep(500 * time.Millisecond)
+			in <- Stats{URL: "/b", Direction: Download, Kind: KindFinal, Done: true, SizeBytes: 2e6, Elapsed: 1500 * time.Millisecond}
+		}()
+		var total Stats
+		for s := range Aggregate(in, trim) {
+			if s.URL == TotalURL && s.Final() {
+				total = s
+			}
+		}
+		if total.SizeBytes != 4e6 || total.Elapsed < 1500*time.Millisecond {
+			t.Errorf("trim %v: total of %d bytes in %v, want all of them", trim, total.SizeBytes, total.Elapsed)
+		}
+		// Trimmed, the speed is that of 3MB in the second both ran.
+		low, high := 19.0, 21.4
+		if trim {
+			low, high = 22.0, 24.1
+		}
+		if total.SpeedMbps < low || total.SpeedMbps > high {
+			t.Errorf("trim %v: %.2f Mbps, want %.0f to %.0f", trim, total.SpeedMbps, low, high)
+		}
+		if trimmed := total.Trimmed; trim && (trimmed < 450*time.Millisecond || trimmed > 800*time.Millisecond) || !trim && trimmed != 0 {
+			t.Errorf("trim %v: trimmed %v", trim, trimmed)
+		}
+	}
+}
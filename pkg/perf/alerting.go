@@ -0,0 +1,121 @@
+package perf
+
+import (
+	"slices"
+	"time"
+)
+
+// AlertState is where a URL stands against its error budget.
+type AlertState string
+
+// A URL is ok until a transfer fails and degraded while its failures in
+// the window stay below the threshold. Reaching the threshold makes it
+// alerting, and a success then starts recovering it; it is ok again after
+// enough successes in a row, and alerting again on any failure before.
+const (
+	AlertOK         AlertState = "ok"
+	AlertDegraded   AlertState = "degraded"
+	AlertAlerting   AlertState = "alerting"
+	AlertRecovering AlertState = "recovering"
+)
+
+// AlertStates are the states in the order a URL goes through them.
+var AlertStates = []AlertState{AlertOK, AlertDegraded, AlertAlerting, AlertRecovering}
+
+// Alert is the state of a URL after one of its transfers.
+type Alert struct {
+	State AlertState
+	// Failures counts the failures in the window.
+	Failures int
+	// Raised marks the transfer that made the URL alerting from ok or
+	// degraded, and Cleared the one that made it ok again from recovering.
+	// A URL flapping between alerting and recovering is neither.
+	Raised  bool
+	Cleared bool
+}
+
+// alertSeries is the error budget of one URL.
+type alertSeries struct {
+	state     AlertState
+	failures  []time.Time
+	successes int
+}
+
+// AlertTracker keeps the error budget of every URL: how many of its
+// transfers failed in a sliding window. It is not safe for concurrent use.
+type AlertTracker struct {
+	window     time.Duration
+	threshold  int
+	clearAfter int
+	byKey      map[summaryKey]*alertSeries
+}
+
+// NewAlertTracker returns a tracker that alerts on threshold failures
+// within window, an hour when zero, and clears after clearAfter successes
+// in a row, 3 when zero.
+func NewAlertTracker(window time.Duration, threshold, clearAfter int) *AlertTracker {
+	if window == 0 {
+		window = time.Hour
+	}
+	if clearAfter == 0 {
+		clearAfter = 3
+	}
+	return &AlertTracker{window: window, threshold: threshold, clearAfter: clearAfter, byKey: map[summaryKey]*alertSeries{}}
+}
+
+// Observe sets the Alert of a final snapshot completed at now. Cancelled
+// and skipped transfers leave the state as it is.
+func (a *AlertTracker) Observe(s *Stats, now time.Time) {
+	if !s.Final() || s.Cancelled || s.Skipped {
+		return
+	}
+	key := summaryKey{s.URL, s.Direction, s.PinnedIP, s.Family, s.Agent, s.SweepSize, s.BidiPhase, s.SampleOffset}
+	series := a.byKey[key]
+	if series == nil {
+		series = &alertSeries{state: AlertOK}
+		a.byKey[key] = series
+	}
+	alert := a.step(series, s.Error != nil, now)
+	s.Alert = &alert
+}
+
+// step moves series on by one transfer, which failed or not.
+func (a *AlertTracker) step(series *alertSeries, failed bool, now time.Time) Alert {
+	cutoff := now.Add(-a.window)
+	series.failures = slices.DeleteFunc(series.failures, func(t time.Time) bool { return !t.After(cutoff) })
+	if failed {
+		series.failures = append(series.failures, now)
+		series.successes = 0
+	} else {
+		series.successes++
+	}
+
+	var alert Alert
+	switch series.state {
+	case AlertOK, AlertDegraded:
+		switch {
+		case len(series.failures) >= a.threshold:
+			series.state = AlertAlerting
+			alert.Raised = true
+		case len(series.failures) > 0:
+			series.state = AlertDegraded
+		default:
+			series.state = AlertOK
+		}
+	case AlertAlerting:
+		if !failed {
+			series.state = AlertRecovering
+		}
+	case AlertRecovering:
+		if failed {
+			series.state = AlertAlerting
+		}
+	}
+	if series.state == AlertRecovering && series.successes >= a.clearAfter {
+		series.state = AlertOK
+		series.failures = nil
+		alert.Cleared = true
+	}
+	alert.State, alert.Failures = series.state, len(series.failures)
+	return alert
+}
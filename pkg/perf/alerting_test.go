@@ -0,0 +1,113 @@
+package perf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlertTracker(t *testing.T) {
+	// Each step is a transfer a minute after the last: "f" failed, "s"
+	// succeeded, and "+N" first lets N more minutes pass.
+	tests := []struct {
+		name       string
+		window     time.Duration
+		threshold  int
+		clearAfter int
+		steps      string
+		// want is the state after each transfer, ! marking a raise and ^
+		// a clear.
+		want string
+	}{
+		{"stays ok", 0, 3, 0, "s s s", "ok ok ok"},
+		{"degrades then alerts", 0, 3, 0, "f s f f", "degraded degraded degraded alerting!"},
+		{"alerts at once", 0, 1, 0, "s f", "ok alerting!"},
+		// Clearing takes clearAfter successes in a row.
+		{"clears", 0, 2, 3, "f f s s s s", "degraded alerting! recovering recovering ok^ ok"},
+		{"clears after one", 0, 1, 1, "f s", "alerting! ok^"},
+		// A failure while recovering goes back to alerting without a new
+		// raise, and the successes start over.
+		{"flapping", 0, 2, 3, "f f s f s s f s s s", "degraded alerting! recovering alerting recovering recovering alerting recovering recovering ok^"},
+		{"flapping in one window", 0, 2, 2, "f f s f s f s s", "degraded alerting! recovering alerting recovering alerting recovering ok^"},
+		// Failures leave the budget once they are older than the window.
+		{"failures expire", 10 * time.Minute, 3, 0, "f f +20 f f", "degraded degraded degraded degraded"},
+		{"degraded recovers", 10 * time.Minute, 3, 0, "f +20 s", "degraded ok"},
+		{"within the window", 10 * time.Minute, 3, 0, "f +5 f f", "degraded degraded alerting!"},
+		// Clearing empties the budget, so it takes threshold new failures
+		// to raise again.
+		{"raises again", 0, 2, 1, "f f s f f", "degraded alerting! ok^ degraded alerting!"},
+		// Alerting does not expire with its failures.
+		{"alerting outlasts the window", 10 * time.Minute, 2, 2, "f f +60 f +60 s", "degraded alerting! alerting recovering"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAlertTracker(tt.window, tt.threshold, tt.clearAfter)
+			now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+			var got []string
+			for _, step := range strings.Fields(tt.steps) {
+				if gap, ok := strings.CutPrefix(step, "+"); ok {
+					var minutes int
+					fmt.Sscan(gap, &minutes)
+					now = now.Add(time.Duration(minutes) * time.Minute)
+					continue
+				}
+				now = now.Add(time.Minute)
+				s := Stats{URL: "https://example.com/", Direction: Download, Done: true}
+				if step == "f" {
+					s.Error = errors.New("reset")
+				}
+				a.Observe(&s, now)
+				state := string(s.Alert.State)
+				if s.Alert.Raised {
+					state += "!"
+				}
+				if s.Alert.Cleared {
+					state += "^"
+				}
+				got = append(got, state)
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("states\n%s\nwant\n%s", strings.Join(got, " "), tt.want)
+			}
+		})
+	}
+}
+
+func TestAlertTrackerSeries(t *testing.T) {
+	a := NewAlertTracker(time.Hour, 1, 1)
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	failed := Stats{URL: "https://example.com/a", Direction: Download, Done: true, Error: errors.New("reset")}
+	a.Observe(&failed, now)
+	if failed.Alert == nil || failed.Alert.State != AlertAlerting || failed.Alert.Failures != 1 {
+		t.Fatalf("alert %+v", failed.Alert)
+	}
+	// Other URLs, directions and addresses have budgets of their own.
+	for _, s := range []Stats{
+		{URL: "https://example.com/b", Direction: Download, Done: true},
+		{URL: "https://example.com/a", Direction: Upload, Done: true},
+		{URL: "https://example.com/a", Direction: Download, PinnedIP: "192.0.2.1", Done: true},
+	} {
+		a.Observe(&s, now)
+		if s.Alert.State != AlertOK {
+			t.Errorf("%s %s %s is %s", s.URL, s.Direction, s.PinnedIP, s.Alert.State)
+		}
+	}
+	// Progress, cancelled and skipped results leave the state alone.
+	for _, s := range []Stats{
+		{URL: "https://example.com/a", Direction: Download, SizeBytes: 10},
+		{URL: "https://example.com/a", Direction: Download, Cancelled: true},
+		{URL: "https://example.com/a", Direction: Download, Skipped: true},
+	} {
+		a.Observe(&s, now)
+		if s.Alert != nil {
+			t.Errorf("%+v got alert %+v", s, s.Alert)
+		}
+	}
+	ok := Stats{URL: "https://example.com/a", Direction: Download, Done: true}
+	a.Observe(&ok, now.Add(time.Minute))
+	if !ok.Alert.Cleared || ok.Alert.State != AlertOK || ok.Alert.Failures != 0 {
+		t.Errorf("alert %+v, want cleared", ok.Alert)
+	}
+}
@@ -0,0 +1,241 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Phases of a bidirectional test, as Stats.BidiPhase gives them.
+const (
+	BidiSolo = "solo"
+	BidiBoth = "both"
+)
+
+// bidirectional tests target in three phases: a download on its own, an
+// upload to its upload_url on its own, then both at once. Round trips to
+// its host are probed before the first phase and while both directions
+// run, and land on the final snapshots of the last phase. A phase is not
+// started once ctx is done; as with Run, the terminal snapshot of every
+// transfer started is still delivered.
+func (t *Tester) bidirectional(ctx context.Context, target Target) <-chan Stats {
+	out := make(chan Stats)
+	down, up := target.bidiLegs()
+	go func() {
+		defer close(out)
+		forward := func(s Stats) {
+			if s.Kind.Terminal() {
+				out <- s
+				return
+			}
+			select {
+			case out <- s:
+			case <-ctx.Done():
+			}
+		}
+
+		probeTarget := target
+		if target.ProbeURL != "" {
+			probeTarget.URL = target.ProbeURL
+		}
+		client, release := t.client(probeTarget)
+		defer release()
+		idle, err := t.probeSeries(ctx, client, probeTarget, idleProbes)
+		if err != nil {
+			t.log().Warn("bidirectional probes failed, testing without them", "url", probeTarget.URL, "err", err)
+		}
+
+		solo := map[Direction]float64{}
+		for _, leg := range []Target{down(BidiSolo), up(BidiSolo)} {
+			if ctx.Err() != nil {
+				return
+			}
+			for s := range t.Test(ctx, leg) {
+				if s.Final() && s.Error == nil {
+					solo[s.Direction] = s.SpeedMbps
+				}
+				forward(s)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		var loading atomic.Bool
+		probeCtx, stopProbes := context.WithCancel(ctx)
+		loaded := make(chan []LatencyProbe, 1)
+		go func() {
+			loaded <- t.probeWhile(probeCtx, client, probeTarget, &loading)
+		}()
+		if t.opts.ProgressInterval < 0 {
+			mark := time.AfterFunc(time.Second, func() { loading.Store(true) })
+			defer mark.Stop()
+		}
+		var mu sync.Mutex
+		var finals []Stats
+		var wg sync.WaitGroup
+		for _, leg := range []Target{down(BidiBoth), up(BidiBoth)} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for s := range t.Test(ctx, leg) {
+					if !s.Final() {
+						loading.Store(true)
+						mu.Lock()
+						forward(s)
+						mu.Unlock()
+						continue
+					}
+					mu.Lock()
+					finals = append(finals, s)
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		stopProbes()
+		probes := <-loaded
+		for _, s := range finals {
+			s.SoloMbps = solo[s.Direction]
+			if idle != nil {
+				s.Bufferbloat = loadedBufferbloat(idle, probes)
+				s.LatencyGrade = gradeOf(s.Bufferbloat, s.Direction, t.opts.LatencyGrading)
+			}
+			forward(s)
+		}
+	}()
+	return out
+}
+
+// bidiLegs returns funcs making the download and the upload of a
+// bidirectional target for a phase, named after it. Results of the upload
+// keep the URL of target when it goes to upload_url.
+func (t Target) bidiLegs() (down, up func(phase string) Target) {
+	leg := func(phase string) Target {
+		c := t
+		c.Bidirectional, c.bidiPhase = false, phase
+		c.Name = fmt.Sprintf("%s [%s]", Stats{URL: t.configuredURL(), Name: t.Name}.DisplayName(), phase)
+		return c
+	}
+	down = func(phase string) Target {
+		c := leg(phase)
+		c.Method = MethodDownload
+		return c
+	}
+	up = func(phase string) Target {
+		c := leg(phase)
+		c.Method = MethodUpload
+		if t.UploadURL != "" {
+			c.URL, c.template, c.shown = t.UploadURL, t.configuredURL(), t.UploadURL
+		}
+		return c
+	}
+	return down, up
+}
+
+// bidiProblems adds the problems of the bidirectional setting of t, with
+// prefix naming it.
+func (t Target) bidiProblems(ps *Problems, prefix string) {
+	if s := scheme(t.URL); t.Direction() != Download || s != "http" && s != "https" {
+		ps.Addf(prefix+"bidirectional", "only applies to http(s) downloads")
+	}
+	if t.UploadSize <= 0 {
+		ps.Addf(prefix+"upload_size", "bidirectional needs a positive upload_size")
+	}
+	if t.UploadURL != "" {
+		ps.Add(prefix+"upload_url", checkURL(t.UploadURL))
+	}
+	for _, other := range []struct {
+		name string
+		set  bool
+	}{
+		{"bufferbloat", t.Bufferbloat},
+		{"reuse_probe", t.ReuseProbe},
+		{"resume", t.Resume},
+		{"resolve_all", t.ResolveAll},
+		{"dualstack_compare", t.DualstackCompare},
+		{"sweep", t.SizeSweep != nil},
+	} {
+		if other.set {
+			ps.Addf(prefix+"bidirectional", "cannot be used with %s", other.name)
+		}
+	}
+}
+
+// BidiComparison sets the phases of a bidirectional URL side by side.
+type BidiComparison struct {
+	URL  string `json:"url"`
+	Name string `json:"name,omitempty"`
+	// The speed fields are the mean speeds of each direction on its own
+	// and with the other running, zero for a phase with no completed run.
+	DownSoloMbps float64 `json:"down_solo_mbps"`
+	DownBothMbps float64 `json:"down_both_mbps"`
+	UpSoloMbps   float64 `json:"up_solo_mbps"`
+	UpBothMbps   float64 `json:"up_both_mbps"`
+	// DownChangePct and UpChangePct are how much faster, or slower when
+	// negative, each direction was with the other running.
+	DownChangePct float64 `json:"down_change_pct,omitempty"`
+	UpChangePct   float64 `json:"up_change_pct,omitempty"`
+	// IdleP50Ms and LoadedP50Ms are the median round trips before the test
+	// and while both directions ran.
+	IdleP50Ms   float64 `json:"idle_p50_ms,omitempty"`
+	LoadedP50Ms float64 `json:"loaded_p50_ms,omitempty"`
+}
+
+// CompareBidirectional pairs up the summaries of the phases of
+// bidirectional URLs, in the order the URLs first appear.
+func CompareBidirectional(summaries []Summary) []BidiComparison {
+	var comparisons []BidiComparison
+	index := map[string]int{}
+	for _, s := range summaries {
+		if s.BidiPhase == "" {
+			continue
+		}
+		i, ok := index[s.URL]
+		if !ok {
+			i = len(comparisons)
+			index[s.URL] = i
+			name := strings.TrimSuffix(s.Name, " ["+s.BidiPhase+"]")
+			if name == s.URL {
+				name = ""
+			}
+			comparisons = append(comparisons, BidiComparison{URL: s.URL, Name: name})
+		}
+		c := &comparisons[i]
+		if s.Runs == 0 {
+			continue
+		}
+		switch {
+		case s.Direction == Download && s.BidiPhase == BidiSolo:
+			c.DownSoloMbps = s.MeanMbps
+		case s.Direction == Download:
+			c.DownBothMbps = s.MeanMbps
+		case s.BidiPhase == BidiSolo:
+			c.UpSoloMbps = s.MeanMbps
+		default:
+			c.UpBothMbps = s.MeanMbps
+		}
+		if b := s.Bufferbloat; b != nil && s.BidiPhase == BidiBoth {
+			ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+			c.IdleP50Ms, c.LoadedP50Ms = ms(b.Idle.P50), ms(b.Loaded.P50)
+		}
+	}
+	for i := range comparisons {
+		c := &comparisons[i]
+		c.DownChangePct = change(c.DownSoloMbps, c.DownBothMbps)
+		c.UpChangePct = change(c.UpSoloMbps, c.UpBothMbps)
+	}
+	return comparisons
+}
+
+// change is how much to differs from from in percent, or zero when either
+// is unknown.
+func change(from, to float64) float64 {
+	if from <= 0 || to <= 0 {
+		return 0
+	}
+	return (to - from) / from * 100
+}
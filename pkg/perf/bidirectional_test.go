@@ -0,0 +1,189 @@
+package perf
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bidiServer serves a 600ms download, takes a paced upload at /up, and
+// answers HEAD probes 30ms late while either runs.
+func bidiServer(t *testing.T) *httptest.Server {
+	var loading atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodHead:
+			if loading.Load() > 0 {
+				time.Sleep(30 * time.Millisecond)
+			}
+			return
+		case http.MethodPost, http.MethodPut:
+			loading.Add(1)
+			defer loading.Add(-1)
+			for {
+				if _, err := io.CopyN(io.Discard, r.Body, 64<<10); err != nil {
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+		loading.Add(1)
+		defer loading.Add(-1)
+		w.Header().Set("Content-Length", "600000")
+		for range 12 {
+			if _, err := w.Write(make([]byte, 50000)); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	t.Cleanup(func() {
+		srv.CloseClientConnections()
+		srv.Close()
+	})
+	return srv
+}
+
+func TestBidirectional(t *testing.T) {
+	srv := bidiServer(t)
+	target := Target{URL: srv.URL + "/file", Name: "edge", Bidirectional: true, UploadSize: 640 << 10, UploadURL: srv.URL + "/up"}
+	c := NewCollector()
+	var finals []Stats
+	for s := range New(Options{ProgressInterval: 50 * time.Millisecond}).Test(context.Background(), target) {
+		c.Add(s)
+		if s.Final() {
+			finals = append(finals, s)
+		}
+	}
+	if len(finals) != 4 {
+		t.Fatalf("%d results, want one per direction and phase", len(finals))
+	}
+	for _, s := range finals {
+		if s.Error != nil {
+			t.Fatal(s.Error)
+		}
+	}
+	// The solo phases run in turn, then both directions together, all
+	// under the URL configured.
+	tests := []struct {
+		name      string
+		direction Direction
+		phase     string
+	}{
+		{"edge [solo]", Download, BidiSolo},
+		{"edge [solo]", Upload, BidiSolo},
+		{"edge [both]", Download, BidiBoth},
+		{"edge [both]", Upload, BidiBoth},
+	}
+	if finals[2].Direction == Upload {
+		finals[2], finals[3] = finals[3], finals[2]
+	}
+	for i, tt := range tests {
+		s := finals[i]
+		if s.URL != target.URL || s.Name != tt.name || s.Direction != tt.direction || s.BidiPhase != tt.phase {
+			t.Errorf("result %d: %s %q %s in phase %q, want %q %s %q", i, s.URL, s.Name, s.Direction, s.BidiPhase, tt.name, tt.direction, tt.phase)
+		}
+	}
+	if up := finals[1]; up.ExpandedURL != srv.URL+"/up" || up.SizeBytes != 640<<10 {
+		t.Errorf("upload went to %q with %d bytes", up.ExpandedURL, up.SizeBytes)
+	}
+	if !finals[0].Started.Before(finals[1].Started) || finals[1].Started.After(finals[2].Started) {
+		t.Error("phases ran out of order")
+	}
+	// Both directions at once overlap, and are set against their solo
+	// speeds and the loaded round trip.
+	for _, s := range finals[2:] {
+		solo := finals[0]
+		if s.Direction == Upload {
+			solo = finals[1]
+		}
+		if s.SoloMbps != solo.SpeedMbps {
+			t.Errorf("%s solo speed %v, want %v", s.Direction, s.SoloMbps, solo.SpeedMbps)
+		}
+		b := s.Bufferbloat
+		if b == nil || b.Idle.Probes != idleProbes || b.Loaded.Probes == 0 || b.Loaded.P50 < 30*time.Millisecond {
+			t.Fatalf("%s bufferbloat %+v", s.Direction, b)
+		}
+	}
+	if finals[0].SoloMbps != 0 || finals[0].Bufferbloat != nil {
+		t.Errorf("solo download set against %v, bufferbloat %+v", finals[0].SoloMbps, finals[0].Bufferbloat)
+	}
+
+	comparisons := CompareBidirectional(c.Summaries())
+	if len(comparisons) != 1 {
+		t.Fatalf("comparisons %+v", comparisons)
+	}
+	cmp := comparisons[0]
+	if cmp.URL != target.URL || cmp.Name != "edge" || cmp.DownSoloMbps != finals[0].SpeedMbps || cmp.UpBothMbps != finals[3].SpeedMbps || cmp.LoadedP50Ms < 30 {
+		t.Errorf("comparison %+v", cmp)
+	}
+}
+
+func TestBidirectionalCancel(t *testing.T) {
+	srv := bidiServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var all []Stats
+	var cancelled time.Time
+	for s := range New(Options{ProgressInterval: 50 * time.Millisecond}).Test(ctx, Target{URL: srv.URL + "/file", Bidirectional: true, UploadSize: 640 << 10}) {
+		all = append(all, s)
+		if s.SizeBytes > 0 && cancelled.IsZero() {
+			cancelled = time.Now()
+			cancel()
+		}
+	}
+	if took := time.Since(cancelled); took > 500*time.Millisecond {
+		t.Errorf("test ended %v after the cancel", took)
+	}
+	// The solo download stops and no later phase starts.
+	for _, s := range all {
+		if s.Direction != Download || s.BidiPhase != BidiSolo {
+			t.Errorf("%s in phase %q after the cancel", s.Direction, s.BidiPhase)
+		}
+	}
+	if last := all[len(all)-1]; last.Kind != KindCancelled {
+		t.Errorf("last result %s", last.Kind)
+	}
+}
+
+func TestCompareBidirectional(t *testing.T) {
+	phase := func(d Direction, phase string, runs int, mbps float64) Summary {
+		return Summary{URL: "a", Name: "a [" + phase + "]", Direction: d, BidiPhase: phase, Runs: runs, MeanMbps: mbps}
+	}
+	both := phase(Download, BidiBoth, 1, 80)
+	both.Bufferbloat = &Bufferbloat{Idle: &LatencyStats{P50: 10 * time.Millisecond}, Loaded: &LatencyStats{P50: 45 * time.Millisecond}}
+	got := CompareBidirectional([]Summary{
+		{URL: "b", Runs: 1, MeanMbps: 10},
+		phase(Download, BidiSolo, 1, 100), both,
+		phase(Upload, BidiSolo, 1, 20),
+		// A phase that never completed has no speed to compare.
+		phase(Upload, BidiBoth, 0, 0),
+	})
+	want := BidiComparison{URL: "a", DownSoloMbps: 100, DownBothMbps: 80, UpSoloMbps: 20, DownChangePct: -20, IdleP50Ms: 10, LoadedP50Ms: 45}
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("comparisons %+v, want %+v", got, want)
+	}
+}
+
+func TestBidirectionalChecks(t *testing.T) {
+	// Thresholds apply to each phase of the download.
+	target := Target{URL: "a", Bidirectional: true, UploadSize: 1000, Thresholds: Thresholds{MinSpeedMbps: 90}}
+	summaries := []Summary{
+		{URL: "a", Direction: Download, BidiPhase: BidiSolo, Runs: 1, MeanMbps: 100, MinMbps: 100},
+		{URL: "a", Name: "a [both]", Direction: Download, BidiPhase: BidiBoth, Runs: 1, MeanMbps: 80, MinMbps: 80},
+		{URL: "a", Direction: Upload, BidiPhase: BidiSolo, Runs: 1, MeanMbps: 20, MinMbps: 20},
+	}
+	checks := Checks([]Target{target}, summaries, LinkCapacity{})
+	if len(checks) != 2 || checks[0].Status != StatusOK || checks[1].Status != StatusCritical || checks[1].Name != "a [both]" {
+		t.Errorf("checks %+v", checks)
+	}
+}
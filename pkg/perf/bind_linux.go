@@ -0,0 +1,25 @@
+package perf
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const bindSupported = true
+
+// bindToDevice returns a dialer Control func that pins the socket to the
+// named network interface with SO_BINDTODEVICE.
+func bindToDevice(name string) func(network, address string, c syscall.RawConn) error {
+	return func(_, _ string, c syscall.RawConn) error {
+		var err error
+		if ctrlErr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+		}); ctrlErr != nil {
+			return ctrlErr
+		}
+		if err != nil {
+			return fmt.Errorf("bind to interface %s: %w", name, err)
+		}
+		return nil
+	}
+}
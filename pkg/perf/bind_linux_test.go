@@ -0,0 +1,23 @@
+package perf
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestBindToDevice(t *testing.T) {
+	srv := listenServer(t, "tcp4", "127.0.0.1:0")
+	all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL, Interface: "lo"}))
+	if err := all[len(all)-1].Error; errors.Is(err, syscall.EPERM) {
+		t.Skip("binding to an interface is not permitted here")
+	} else if err != nil {
+		t.Errorf("interface lo: %v", err)
+	}
+	all = collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL, Interface: "nosuch0"}))
+	if err := all[len(all)-1].Error; err == nil || !strings.Contains(err.Error(), "bind to interface nosuch0") {
+		t.Errorf("interface nosuch0: err %v, want a bind error", err)
+	}
+}
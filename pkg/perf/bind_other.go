@@ -0,0 +1,16 @@
+//go:build !linux
+
+package perf
+
+import (
+	"errors"
+	"syscall"
+)
+
+const bindSupported = false
+
+func bindToDevice(string) func(network, address string, c syscall.RawConn) error {
+	return func(string, string, syscall.RawConn) error {
+		return errors.New("interface binding is only supported on Linux")
+	}
+}
@@ -0,0 +1,246 @@
+package perf
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// SkipLinkDown is the SkipReason of a transfer skipped because the
+// transfers its pass started with all failed to reach their servers.
+const SkipLinkDown = "link down"
+
+// linkProbeTimeout bounds each dial of Tester.ProbeLink.
+const linkProbeTimeout = 3 * time.Second
+
+// Breaker is the circuit breaker of probe_failures_threshold. When the
+// first transfers of a pass, as many as its threshold, all fail to reach
+// their servers, the link is taken to be down and the rest of the pass is
+// skipped. They are the first to start, not the first to finish, so a
+// dead host failing fast does not trip it while transfers started before
+// are still on their way. The link stays down across passes until a transfer gets through
+// or Reset is called, once Tester.ProbeLink does. It is shared by the
+// Testers of a run, so a reload keeps its state.
+type Breaker struct {
+	threshold int
+
+	mu sync.Mutex
+	// outcomes are those of the current pass's transfers in the order they
+	// started, while counting; its first result from a server ends the
+	// count.
+	outcomes []outcome
+	counting bool
+	// open skips the rest of the current pass.
+	open  bool
+	state BreakerState
+}
+
+// BreakerState is what a Breaker knows of the link.
+type BreakerState struct {
+	// Down is set from the transfer that tripped the breaker until the
+	// link is back, and Since is when that was.
+	Down  bool
+	Since time.Time
+	// Trips counts the times the link went down.
+	Trips int
+}
+
+// outcome is how a transfer counted by a Breaker ended.
+type outcome uint8
+
+const (
+	outcomeRunning outcome = iota
+	outcomeFailed
+	// outcomeSkipped is a transfer skipped or cancelled, which says
+	// nothing of the link.
+	outcomeSkipped
+)
+
+// NewBreaker returns a Breaker tripping after threshold failures.
+func NewBreaker(threshold int) *Breaker {
+	return &Breaker{threshold: threshold}
+}
+
+// State returns the state of the link, the zero BreakerState for a nil b.
+func (b *Breaker) State() BreakerState {
+	if b == nil {
+		return BreakerState{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Reset marks the link as back up.
+func (b *Breaker) Reset() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state.Down = false
+}
+
+// startPass counts the results of a pass afresh.
+func (b *Breaker) startPass() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.outcomes, b.counting, b.open = b.outcomes[:0], true, false
+}
+
+// tripped reports whether the rest of the pass is to be skipped.
+func (b *Breaker) tripped() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// observe counts result, of the transfer the pass started order-th, and
+// sets LinkDown on it when its failure takes the link down. It reports
+// whether result tripped the breaker.
+func (b *Breaker) observe(order int, result *Stats) bool {
+	if b == nil || !result.Final() {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ended := outcomeSkipped
+	switch {
+	case result.Skipped || result.Cancelled:
+	case !unreachable(*result):
+		// A server answered, so the link is up whatever came of it.
+		b.counting, b.state.Down = false, false
+		return false
+	default:
+		ended = outcomeFailed
+	}
+	if !b.counting {
+		return false
+	}
+	for len(b.outcomes) <= order {
+		b.outcomes = append(b.outcomes, outcomeRunning)
+	}
+	b.outcomes[order] = ended
+	// The link is down once the first threshold transfers that count, in
+	// start order, have all failed; one still running may yet get through.
+	failures := 0
+	for _, o := range b.outcomes {
+		if o == outcomeRunning {
+			return false
+		}
+		if o == outcomeFailed {
+			failures++
+		}
+		if failures == b.threshold {
+			break
+		}
+	}
+	if failures < b.threshold {
+		return false
+	}
+	b.counting, b.open = false, true
+	if !b.state.Down {
+		b.state.Down, b.state.Since = true, time.Now()
+		b.state.Trips++
+		result.LinkDown = true
+	}
+	return true
+}
+
+// unreachable reports a failure to reach the server at all: its name did
+// not resolve, it refused or dropped the connection, or the lookup or dial
+// timed out.
+func unreachable(result Stats) bool {
+	switch result.ErrorKind {
+	case ErrorDNS, ErrorConnect:
+		return true
+	case ErrorTimeout:
+		switch result.TimeoutPhase {
+		case "", PhaseDNS, PhaseConnect:
+			return true
+		}
+	}
+	return false
+}
+
+// ProbeLink reports whether the link is up: it dials the hosts of targets,
+// or the proxy when one is set, at once and returns nil as soon as one of
+// them answers. Targets not on TCP, such as file URLs, are left out; with
+// none left the link counts as up.
+func (t *Tester) ProbeLink(ctx context.Context, targets []Target) error {
+	ctx, cancel := context.WithTimeout(ctx, linkProbeTimeout)
+	defer cancel()
+	dials := map[string]Target{}
+	for _, target := range targets {
+		addr := probeAddr(target.URL)
+		if u := t.opts.Proxy; u != nil {
+			addr = probeAddr(u.String())
+		}
+		if _, ok := dials[addr]; addr != "" && !ok {
+			dials[addr] = target
+		}
+	}
+	errs := make(chan error, len(dials))
+	for addr, target := range dials {
+		go func() {
+			conn, err := dialContext(target, t.opts.Resolver, linkProbeTimeout)(ctx, "tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+			errs <- err
+		}()
+	}
+	var first error
+	for range len(dials) {
+		err := <-errs
+		if err == nil {
+			return nil
+		}
+		first = cmp.Or(first, err)
+	}
+	if first != nil {
+		return fmt.Errorf("none of %d hosts answered: %w", len(dials), first)
+	}
+	return nil
+}
+
+// probeAddr is the host and port ProbeLink dials for rawURL, or "" for a
+// URL not on TCP.
+func probeAddr(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := map[string]string{"http": "80", "https": "443", SchemeFTP: "21", "socks5": "1080", "socks5h": "1080"}[u.Scheme]
+	if port == "" {
+		return ""
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// breakerProblems adds the problems of probe_failures_threshold and
+// link_down_retry.
+func (c Config) breakerProblems(ps *Problems) {
+	if c.ProbeFailuresThreshold < 0 {
+		ps.Addf("probe_failures_threshold", "must not be negative")
+	}
+	switch {
+	case c.LinkDownRetry < 0:
+		ps.Addf("link_down_retry", "must not be negative, got %v", c.LinkDownRetry)
+	case c.LinkDownRetry > 0 && c.ProbeFailuresThreshold == 0:
+		ps.Addf("link_down_retry", "needs probe_failures_threshold")
+	}
+}
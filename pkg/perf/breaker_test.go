@@ -0,0 +1,122 @@
+package perf
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBreakerCountsInStartOrder(t *testing.T) {
+	down := Stats{Done: true, Error: errNoResult, ErrorKind: ErrorConnect}
+	up := Stats{Done: true}
+	skipped := Stats{Skipped: true, SkipReason: SkipOutOfTime}
+	type result struct {
+		order int
+		stats Stats
+	}
+	tests := []struct {
+		name    string
+		results []result
+		trips   int
+	}{
+		{"all down", []result{{0, down}, {1, down}, {2, down}}, 2},
+		{"out of order", []result{{2, down}, {1, down}, {0, down}}, 2},
+		{"first still running", []result{{1, down}, {2, down}, {3, down}}, -1},
+		{"first got through", []result{{1, down}, {2, down}, {0, up}}, -1},
+		{"skipped ones left out", []result{{0, skipped}, {1, down}, {2, down}, {3, down}}, 3},
+		{"too few", []result{{0, down}, {1, down}}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBreaker(3)
+			b.startPass()
+			trips := -1
+			for i, r := range tt.results {
+				if b.observe(r.order, &r.stats) {
+					if trips >= 0 {
+						t.Fatalf("tripped twice")
+					}
+					trips = i
+					if !r.stats.LinkDown {
+						t.Error("the tripping result has no link_down")
+					}
+				}
+			}
+			if trips != tt.trips {
+				t.Fatalf("tripped on result %d, want %d", trips, tt.trips)
+			}
+			if got := b.tripped(); got != (tt.trips >= 0) || b.State().Down != got {
+				t.Errorf("tripped %v, down %v", got, b.State().Down)
+			}
+		})
+	}
+}
+
+func TestBreakerNil(t *testing.T) {
+	var b *Breaker
+	b.Reset()
+	b.startPass()
+	if b.observe(0, &Stats{Done: true, ErrorKind: ErrorConnect}) || b.tripped() || b.State().Down {
+		t.Error("a nil Breaker tripped")
+	}
+}
+
+// deadAddr returns an address refusing connections.
+func deadAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestBreakerRun(t *testing.T) {
+	srv := payloadServer(t, 16<<10, 20*time.Millisecond)
+	healthy := Target{URL: srv.URL + "/bytes/200000"}
+	dead := func(n int) []Target {
+		var targets []Target
+		for range n {
+			targets = append(targets, Target{URL: "http://" + deadAddr(t) + "/"})
+		}
+		return targets
+	}
+	tests := []struct {
+		name    string
+		targets []Target
+		down    bool
+	}{
+		{"total outage", dead(8), true},
+		// The dead hosts fail while the first transfer is still running.
+		{"partial outage", append(append([]Target{healthy}, dead(6)...), healthy), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker := NewBreaker(3)
+			tester := New(Options{Breaker: breaker})
+			var skipped, linkDown, healthy int
+			for s := range tester.Run(context.Background(), tt.targets, 4) {
+				switch {
+				case !s.Final():
+				case s.SkipReason == SkipLinkDown:
+					skipped++
+				case s.LinkDown:
+					linkDown++
+				case s.Error == nil:
+					healthy++
+				}
+			}
+			if got := breaker.State(); got.Down != tt.down {
+				t.Fatalf("down = %v, want %v", got.Down, tt.down)
+			}
+			if tt.down && (linkDown != 1 || skipped == 0) {
+				t.Errorf("%d link_down results and %d skipped, want 1 and some", linkDown, skipped)
+			}
+			if !tt.down && (skipped > 0 || linkDown > 0 || healthy != 2) {
+				t.Errorf("%d skipped, %d link_down and %d healthy results, want none, none and 2", skipped, linkDown, healthy)
+			}
+		})
+	}
+}
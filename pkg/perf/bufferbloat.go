@@ -0,0 +1,186 @@
+package perf
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// bloatInterval spaces the probes of a bufferbloat test, and idleProbes is
+// how many of them measure the baseline before the download starts.
+const (
+	bloatInterval = 200 * time.Millisecond
+	idleProbes    = 5
+)
+
+// Bufferbloat compares round trips to the host of a download measured
+// while the link was idle with those measured while the download ran.
+type Bufferbloat struct {
+	Idle   *LatencyStats
+	Loaded *LatencyStats
+	// Factor is the loaded median round trip over the idle one, or zero
+	// when either has no probes.
+	Factor float64
+	// LoadedProbes are the loaded round trips with when each was taken, as
+	// probed for the transfer; summaries have none.
+	LoadedProbes []LatencyProbe
+}
+
+// LatencyProbe is one round trip, taken RunOffset into the run.
+type LatencyProbe struct {
+	RunOffset time.Duration
+	RTT       time.Duration
+}
+
+// loadedBufferbloat is the bufferbloat of a transfer, with its loaded
+// probes.
+func loadedBufferbloat(idle []time.Duration, probes []LatencyProbe) *Bufferbloat {
+	rtts := make([]time.Duration, len(probes))
+	for i, p := range probes {
+		rtts[i] = p.RTT
+	}
+	b := newBufferbloat(idle, rtts)
+	b.LoadedProbes = probes
+	return b
+}
+
+func newBufferbloat(idle, loaded []time.Duration) *Bufferbloat {
+	b := &Bufferbloat{Idle: newLatencyStats(idle), Loaded: newLatencyStats(loaded)}
+	if b.Idle.P50 > 0 && b.Loaded.Probes > 0 {
+		b.Factor = float64(b.Loaded.P50) / float64(b.Idle.P50)
+	}
+	return b
+}
+
+// MarshalJSON encodes both distributions with every round trip they hold,
+// in milliseconds.
+func (b *Bufferbloat) MarshalJSON() ([]byte, error) {
+	ms := func(samples []time.Duration) []float64 {
+		out := make([]float64, len(samples))
+		for i, d := range samples {
+			out[i] = float64(d) / float64(time.Millisecond)
+		}
+		return out
+	}
+	return json.Marshal(struct {
+		Idle     *LatencyStats `json:"idle"`
+		Loaded   *LatencyStats `json:"loaded"`
+		IdleMs   []float64     `json:"idle_rtts_ms"`
+		LoadedMs []float64     `json:"loaded_rtts_ms"`
+		Factor   float64       `json:"factor"`
+	}{b.Idle, b.Loaded, ms(b.Idle.samples), ms(b.Loaded.samples), b.Factor})
+}
+
+// bufferbloat runs download with latency probes around it: idleProbes
+// before it starts, then one every bloatInterval until it ends. Probes go to
+// target.ProbeURL, or the download's own URL, over a connection of their
+// own. Probes sent before the first progress snapshot, or the first second
+// when progress is off, are left out of the loaded distribution, as the
+// download is still starting up. The result
+// lands on the final snapshot; if the idle probes fail the download runs
+// without it.
+func (t *Tester) bufferbloat(ctx context.Context, target Target, download func(context.Context) <-chan Stats) <-chan Stats {
+	e := t.newEmitter(ctx, target)
+
+	go func() {
+		defer close(e.ch)
+
+		probeTarget := target
+		if target.ProbeURL != "" {
+			probeTarget.URL = target.ProbeURL
+		}
+		client, release := t.client(probeTarget)
+		defer release()
+
+		idle, err := t.probeSeries(ctx, client, probeTarget, idleProbes)
+		if err != nil {
+			t.log().Warn("bufferbloat probes failed, downloading without them", "url", probeTarget.URL, "err", err)
+		}
+
+		var loading atomic.Bool
+		probeCtx, stopProbes := context.WithCancel(ctx)
+		loaded := make(chan []LatencyProbe, 1)
+		go func() {
+			loaded <- t.probeWhile(probeCtx, client, probeTarget, &loading)
+		}()
+		if t.opts.ProgressInterval < 0 {
+			// Without progress snapshots the download counts as started
+			// once it has had the time of a first tick.
+			mark := time.AfterFunc(time.Second, func() { loading.Store(true) })
+			defer mark.Stop()
+		}
+		stopped := false
+		stop := func() []LatencyProbe {
+			stopped = true
+			stopProbes()
+			return <-loaded
+		}
+
+		for stats := range download(ctx) {
+			if !stats.Final() {
+				loading.Store(true)
+			} else if !stopped {
+				probes := stop()
+				if idle != nil {
+					stats.Bufferbloat = loadedBufferbloat(idle, probes)
+					stats.LatencyGrade = gradeOf(stats.Bufferbloat, stats.Direction, t.opts.LatencyGrading)
+				}
+			}
+			e.send(stats)
+		}
+		if !stopped {
+			stop()
+		}
+	}()
+
+	return e.ch
+}
+
+// probeSeries sends n probes bloatInterval apart after one unmeasured probe
+// that sets up the connection.
+func (t *Tester) probeSeries(ctx context.Context, client *http.Client, target Target, n int) ([]time.Duration, error) {
+	var scratch Stats
+	if _, err := t.probe(ctx, client, target, &scratch); err != nil {
+		return nil, err
+	}
+	rtts := make([]time.Duration, 0, n)
+	for range n {
+		rtt, err := t.probe(ctx, client, target, &scratch)
+		if err != nil {
+			return nil, err
+		}
+		rtts = append(rtts, rtt)
+		select {
+		case <-time.After(bloatInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return rtts, nil
+}
+
+// probeWhile probes every bloatInterval until ctx is done and returns the
+// round trips of the probes sent while loading was set, with when each was
+// sent. Failed probes are
+// dropped; the download matters more than any one probe.
+func (t *Tester) probeWhile(ctx context.Context, client *http.Client, target Target, loading *atomic.Bool) []LatencyProbe {
+	var probes []LatencyProbe
+	var scratch Stats
+	ticker := time.NewTicker(bloatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return probes
+		}
+		counted := loading.Load()
+		at := time.Since(t.opts.RunStart)
+		rtt, err := t.probe(ctx, client, target, &scratch)
+		if err == nil && counted {
+			probes = append(probes, LatencyProbe{at, rtt})
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package perf
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bloatedServer serves a 1.2s download at /file and answers HEAD probes there and
+// at /probe, 40ms late while a download runs, as a bloated queue would.
+type bloatedServer struct {
+	*httptest.Server
+	loading atomic.Int32
+	mu      sync.Mutex
+	probes  []time.Time
+}
+
+func newBloatedServer(t *testing.T) *bloatedServer {
+	s := &bloatedServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			s.mu.Lock()
+			s.probes = append(s.probes, time.Now())
+			s.mu.Unlock()
+			if s.loading.Load() > 0 {
+				time.Sleep(40 * time.Millisecond)
+			}
+			return
+		}
+		s.loading.Add(1)
+		defer s.loading.Add(-1)
+		w.Header().Set("Content-Length", "1200000")
+		for range 24 {
+			w.Write(make([]byte, 50000))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *bloatedServer) probed() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.probes...)
+}
+
+func TestBufferbloat(t *testing.T) {
+	for name, probeURL := range map[string]string{"own url": "", "probe_url": "/probe"} {
+		t.Run(name, func(t *testing.T) {
+			srv := newBloatedServer(t)
+			target := Target{URL: srv.URL + "/file", Bufferbloat: true}
+			if probeURL != "" {
+				target.ProbeURL = srv.URL + probeURL
+			}
+			base := runtime.NumGoroutine()
+			all := collect(New(Options{ProgressInterval: 50 * time.Millisecond}).Test(context.Background(), target))
+			ended := time.Now()
+			last := all[len(all)-1]
+			if last.Error != nil || last.SizeBytes != 1200000 {
+				t.Fatalf("download: %d bytes, %v", last.SizeBytes, last.Error)
+			}
+			for _, s := range all[:len(all)-1] {
+				if s.Bufferbloat != nil {
+					t.Errorf("%s snapshot carries bufferbloat", s.Kind)
+				}
+			}
+			b := last.Bufferbloat
+			if b == nil {
+				t.Fatal("no bufferbloat on the final snapshot")
+			}
+			if b.Idle.Probes != idleProbes || b.Idle.P50 >= 20*time.Millisecond {
+				t.Errorf("idle %d probes, p50 %v; want %d quick ones", b.Idle.Probes, b.Idle.P50, idleProbes)
+			}
+			// A probe every 200ms over the 1.2s download.
+			if b.Loaded.Probes < 3 || b.Loaded.Probes > 7 || len(b.LoadedProbes) != b.Loaded.Probes {
+				t.Errorf("%d loaded probes (%d listed), want about 6", b.Loaded.Probes, len(b.LoadedProbes))
+			}
+			if b.Loaded.P50 < 40*time.Millisecond || b.Loaded.P95 < b.Loaded.P50 || b.Factor < 2 {
+				t.Errorf("loaded p50 %v p95 %v, factor %.1f; want the 40ms the queue adds", b.Loaded.P50, b.Loaded.P95, b.Factor)
+			}
+			if want := float64(b.Loaded.P50) / float64(b.Idle.P50); b.Factor != want {
+				t.Errorf("factor %v, want %v", b.Factor, want)
+			}
+
+			// The probes stop with the download.
+			time.Sleep(3 * bloatInterval)
+			probes := srv.probed()
+			if late := probes[len(probes)-1]; late.After(ended) {
+				t.Errorf("probe sent %v after the download ended", late.Sub(ended))
+			}
+			if len(probes) < idleProbes+1+b.Loaded.Probes {
+				t.Errorf("server saw %d probes", len(probes))
+			}
+			srv.CloseClientConnections()
+			if n := settleGoroutines(base); n > base {
+				t.Errorf("%d goroutines left running, %d before", n, base)
+			}
+		})
+	}
+}
+
+func TestBufferbloatIdleFailure(t *testing.T) {
+	srv := payloadServer(t, 10000, 0)
+	// The probes fail, and the download goes ahead without them.
+	all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL + "/bytes/100000", Bufferbloat: true, ProbeURL: srv.URL + "/status/500"}))
+	last := all[len(all)-1]
+	if last.Error != nil || !last.Done || last.Bufferbloat != nil {
+		t.Errorf("download %s, bufferbloat %+v, err %v", last.Kind, last.Bufferbloat, last.Error)
+	}
+}
+
+func TestBufferbloatJSON(t *testing.T) {
+	ms := time.Millisecond
+	b := newBufferbloat([]time.Duration{10 * ms, 12 * ms, 14 * ms}, []time.Duration{50 * ms, 60 * ms})
+	if b.Factor != 55.0/12 {
+		t.Errorf("factor %v, want %v", b.Factor, 55.0/12)
+	}
+	doc, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"idle":{`, `"loaded":{`, `"idle_rtts_ms":[10,12,14]`, `"loaded_rtts_ms":[50,60]`} {
+		if !strings.Contains(string(doc), want) {
+			t.Errorf("no %s in %s", want, doc)
+		}
+	}
+	if none := newBufferbloat([]time.Duration{10 * ms}, nil); none.Factor != 0 || none.Loaded.Probes != 0 {
+		t.Errorf("no loaded probes gives %+v", none)
+	}
+
+	// Summaries pool the round trips of every run.
+	c := NewCollector()
+	for _, loaded := range []time.Duration{40 * ms, 80 * ms} {
+		c.Add(Stats{URL: "a", Direction: Download, Done: true, SizeBytes: 1, Bufferbloat: newBufferbloat([]time.Duration{10 * ms}, []time.Duration{loaded})})
+	}
+	if s := c.Summaries()[0].Bufferbloat; s == nil || s.Idle.Probes != 2 || s.Loaded.Probes != 2 || s.Loaded.P50 != 60*ms || s.Factor != 6 {
+		t.Errorf("summary bufferbloat %+v", s)
+	}
+}
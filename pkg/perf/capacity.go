@@ -0,0 +1,76 @@
+package perf
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LinkCapacity is the nominal speed of the link under test, such as a
+// "1Gbps down / 50Mbps up" plan. Zero means unknown.
+type LinkCapacity struct {
+	Down Rate `yaml:"down"`
+	Up   Rate `yaml:"up"`
+}
+
+// For is the capacity in direction d: Up for uploads, Down otherwise.
+// Latency probes have none.
+func (c LinkCapacity) For(d Direction) Rate {
+	switch d {
+	case Upload:
+		return c.Up
+	case Latency:
+		return 0
+	}
+	return c.Down
+}
+
+// Utilization is mbps in direction d as a percentage of the capacity, or
+// zero when the capacity is unknown.
+func (c LinkCapacity) Utilization(d Direction, mbps float64) float64 {
+	capacity := c.For(d)
+	if capacity <= 0 {
+		return 0
+	}
+	return mbps * 1e6 / float64(capacity) * 100
+}
+
+// Annotate sets the Utilization of each summary from its mean speed.
+func (c LinkCapacity) Annotate(summaries []Summary) {
+	for i := range summaries {
+		summaries[i].Utilization = c.Utilization(summaries[i].Direction, summaries[i].MeanMbps)
+	}
+}
+
+// SpeedLimit is a speed threshold, written either as a rate such as
+// "700Mbps" or "80MB/s", or as a percentage of the link capacity such
+// as "70%".
+type SpeedLimit struct {
+	Rate  Rate
+	Share Percent
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (l *SpeedLimit) UnmarshalYAML(node *yaml.Node) error {
+	*l = SpeedLimit{}
+	if strings.HasSuffix(strings.TrimSpace(node.Value), "%") {
+		return l.Share.UnmarshalYAML(node)
+	}
+	return l.Rate.UnmarshalYAML(node)
+}
+
+func (l SpeedLimit) String() string {
+	if l.Share > 0 {
+		return l.Share.String()
+	}
+	return l.Rate.String()
+}
+
+// mbps is the limit in megabits per second against capacity, zero when it
+// is unset or a percentage of an unknown capacity.
+func (l SpeedLimit) mbps(capacity Rate) float64 {
+	if l.Share > 0 {
+		return float64(capacity) * float64(l.Share) / 100 / 1e6
+	}
+	return float64(l.Rate) / 1e6
+}
@@ -0,0 +1,110 @@
+package perf
+
+import (
+	"context"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestLinkCapacity(t *testing.T) {
+	plan := LinkCapacity{Down: 1e9, Up: 50e6}
+	tests := []struct {
+		capacity  LinkCapacity
+		direction Direction
+		mbps      float64
+		want      float64
+	}{
+		{plan, Download, 812, 81.2},
+		{plan, Upload, 45, 90},
+		// Faster than the plan is over a hundred percent.
+		{plan, Upload, 60, 120},
+		{plan, Latency, 10, 0},
+		{LinkCapacity{Up: 50e6}, Download, 812, 0},
+		{LinkCapacity{}, Upload, 45, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.capacity.Utilization(tt.direction, tt.mbps); !near(got, tt.want) {
+			t.Errorf("%+v: %v Mbps %s is %v%% of plan, want %v%%", tt.capacity, tt.mbps, tt.direction, got, tt.want)
+		}
+	}
+
+	summaries := []Summary{{Direction: Download, MeanMbps: 500}, {Direction: Upload, MeanMbps: 25}, {Direction: Latency}}
+	plan.Annotate(summaries)
+	if summaries[0].Utilization != 50 || summaries[1].Utilization != 50 || summaries[2].Utilization != 0 {
+		t.Errorf("annotated %+v", summaries)
+	}
+}
+
+func TestSpeedLimit(t *testing.T) {
+	tests := []struct {
+		doc       string
+		want      SpeedLimit
+		text      string
+		mbps      float64
+		unplanned float64
+	}{
+		{"70%", SpeedLimit{Share: 70}, "70%", 70, 0},
+		{"12.5%", SpeedLimit{Share: 12.5}, "12.5%", 12.5, 0},
+		{"700Mbps", SpeedLimit{Rate: 700e6}, "700.00 Mbps", 700, 700},
+		{"80MB/s", SpeedLimit{Rate: 640e6}, "640.00 Mbps", 640, 640},
+	}
+	for _, tt := range tests {
+		var l SpeedLimit
+		if err := yaml.Unmarshal([]byte(tt.doc), &l); err != nil || l != tt.want {
+			t.Errorf("%q decoded as %+v, %v; want %+v", tt.doc, l, err, tt.want)
+			continue
+		}
+		if l.String() != tt.text {
+			t.Errorf("%q prints as %q, want %q", tt.doc, l.String(), tt.text)
+		}
+		// Against a 100 Mbps plan, and one not known.
+		if got := l.mbps(100e6); !near(got, tt.mbps) {
+			t.Errorf("%q of 100 Mbps is %v Mbps, want %v", tt.doc, got, tt.mbps)
+		}
+		if got := l.mbps(0); !near(got, tt.unplanned) {
+			t.Errorf("%q of an unknown plan is %v Mbps, want %v", tt.doc, got, tt.unplanned)
+		}
+	}
+	for _, doc := range []string{"101%", "-5%", "fast", "50M"} {
+		var l SpeedLimit
+		if err := yaml.Unmarshal([]byte(doc), &l); err == nil {
+			t.Errorf("%q decoded as %+v", doc, l)
+		}
+	}
+}
+
+func TestEvaluateOfPlan(t *testing.T) {
+	s := Summary{URL: "https://example.com/", Direction: Download, Runs: 1, MeanMbps: 650, Utilization: 65}
+	thresholds := Thresholds{MinSpeed: SpeedLimit{Share: 70}, WarnSpeed: SpeedLimit{Rate: 900e6}}.resolve(1e9)
+	if thresholds.MinSpeedMbps != 700 || thresholds.WarnSpeedMbps != 900 {
+		t.Fatalf("resolved to %+v", thresholds)
+	}
+	c := Evaluate(s, thresholds)
+	if c.Status != StatusCritical || len(c.Failures) != 1 || c.Failures[0] != "speed 650.00 Mbps (65% of plan) below 700.00 Mbps" {
+		t.Errorf("check %v %q", c.Status, c.Failures)
+	}
+	// Mbps limits given as such are left alone.
+	if got := (Thresholds{MinSpeedMbps: 10}).resolve(1e9); got.MinSpeedMbps != 10 {
+		t.Errorf("resolved to %+v", got)
+	}
+}
+
+func TestUtilization(t *testing.T) {
+	srv := payloadServer(t, 1000, 0)
+	tester := New(Options{ProgressInterval: -1, LinkCapacity: LinkCapacity{Down: 1e9}})
+	all := collect(tester.Test(context.Background(), Target{URL: srv.URL + "/bytes/100000"}))
+	last := all[len(all)-1]
+	if last.Error != nil {
+		t.Fatal(last.Error)
+	}
+	if last.Utilization <= 0 || !near(last.Utilization, last.SpeedMbps/10) {
+		t.Errorf("%.2f Mbps is %.2f%% of a 1 Gbps plan", last.SpeedMbps, last.Utilization)
+	}
+	// A plan that only gives the uplink says nothing of downloads.
+	tester = New(Options{ProgressInterval: -1, LinkCapacity: LinkCapacity{Up: 50e6}})
+	all = collect(tester.Test(context.Background(), Target{URL: srv.URL + "/bytes/100000"}))
+	if last := all[len(all)-1]; last.Error != nil || last.Utilization != 0 {
+		t.Errorf("utilization %v with no down capacity (%v)", last.Utilization, last.Error)
+	}
+}
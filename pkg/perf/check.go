@@ -0,0 +1,146 @@
+package perf
+
+import (
+	"fmt"
+	"time"
+)
+
+// Thresholds are limits checked against a URL's summary once the run is
+// over. Zero fields are not checked. Crossing a Warn limit yields
+// StatusWarning, crossing the other StatusCritical. MinSpeed and WarnSpeed
+// stand in for the Mbps limits with a unit or a percentage of the link
+// capacity.
+type Thresholds struct {
+	MinSpeedMbps  float64    `yaml:"min_speed_mbps"`
+	WarnSpeedMbps float64    `yaml:"warn_speed_mbps"`
+	MinSpeed      SpeedLimit `yaml:"min_speed"`
+	WarnSpeed     SpeedLimit `yaml:"warn_speed"`
+	MaxLatencyMs  float64    `yaml:"max_latency_ms"`
+	WarnLatencyMs float64    `yaml:"warn_latency_ms"`
+}
+
+func (t Thresholds) empty() bool {
+	return t == Thresholds{}
+}
+
+// resolve folds MinSpeed and WarnSpeed into the Mbps limits, taking
+// percentages of capacity.
+func (t Thresholds) resolve(capacity Rate) Thresholds {
+	if mbps := t.MinSpeed.mbps(capacity); mbps > 0 {
+		t.MinSpeedMbps = mbps
+	}
+	if mbps := t.WarnSpeed.mbps(capacity); mbps > 0 {
+		t.WarnSpeedMbps = mbps
+	}
+	return t
+}
+
+// Status is the outcome of a Check. Its value doubles as a Nagios-style
+// exit code.
+type Status int
+
+// Check outcomes, from best to worst.
+const (
+	StatusOK Status = iota
+	StatusWarning
+	StatusCritical
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "OK"
+	case StatusWarning:
+		return "WARNING"
+	default:
+		return "CRITICAL"
+	}
+}
+
+// MarshalText encodes s by name.
+func (s Status) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Check is the result of evaluating one URL against its Thresholds.
+type Check struct {
+	URL       string    `json:"url"`
+	Name      string    `json:"name,omitempty"`
+	Direction Direction `json:"direction"`
+	Agent     string    `json:"agent,omitempty"`
+	Status    Status    `json:"status"`
+	// Failures describes every threshold that was crossed.
+	Failures []string `json:"failures,omitempty"`
+}
+
+// Evaluate checks the mean speed and TTFB of s against t, or for a latency
+// target the mean of its round trips.
+func Evaluate(s Summary, t Thresholds) Check {
+	c := Check{URL: s.URL, Name: s.Name, Direction: s.Direction, Agent: s.Agent}
+	fail := func(status Status, format string, args ...any) {
+		c.Status = max(c.Status, status)
+		c.Failures = append(c.Failures, fmt.Sprintf(format, args...))
+	}
+	if s.Runs == 0 {
+		fail(StatusCritical, "no successful runs")
+		return c
+	}
+	plan := ""
+	if s.Utilization > 0 {
+		plan = fmt.Sprintf(" (%.0f%% of plan)", s.Utilization)
+	}
+	switch {
+	case t.MinSpeedMbps > 0 && s.MeanMbps < t.MinSpeedMbps:
+		fail(StatusCritical, "speed %.2f Mbps%s below %.2f Mbps", s.MeanMbps, plan, t.MinSpeedMbps)
+	case t.WarnSpeedMbps > 0 && s.MeanMbps < t.WarnSpeedMbps:
+		fail(StatusWarning, "speed %.2f Mbps%s below %.2f Mbps", s.MeanMbps, plan, t.WarnSpeedMbps)
+	}
+	metric, latency := "TTFB", s.MeanTTFBMs
+	if s.Latency != nil {
+		metric, latency = "latency", float64(s.Latency.Avg)/float64(time.Millisecond)
+	}
+	switch {
+	case t.MaxLatencyMs > 0 && latency > t.MaxLatencyMs:
+		fail(StatusCritical, "%s %.1fms above %.1fms", metric, latency, t.MaxLatencyMs)
+	case t.WarnLatencyMs > 0 && latency > t.WarnLatencyMs:
+		fail(StatusWarning, "%s %.1fms above %.1fms", metric, latency, t.WarnLatencyMs)
+	}
+	return c
+}
+
+// Checks evaluates every target that has thresholds against its summary,
+// with speed limits in percent taken of capacity. A resolve_all target is
+// checked once per address it was tested at, a dualstack_compare one once
+// per address family, a size sweep once per size, a bidirectional one once
+// per phase of its download, one with offset_samples once per offset and a
+// target run on agents once per agent.
+func Checks(targets []Target, summaries []Summary, capacity LinkCapacity) []Check {
+	byKey := make(map[summaryKey]Summary, len(summaries))
+	pinned := map[summaryKey][]Summary{}
+	for _, s := range summaries {
+		byKey[summaryKey{s.URL, s.Direction, s.IP, s.Family, s.Agent, s.SweepSize, s.BidiPhase, s.SampleOffset}] = s
+		if s.IP != "" || s.Family != "" || s.Agent != "" || s.SweepSize > 0 || s.BidiPhase != "" || s.OffsetSamples > 0 {
+			key := summaryKey{url: s.URL, direction: s.Direction}
+			pinned[key] = append(pinned[key], s)
+		}
+	}
+	var checks []Check
+	for _, target := range targets {
+		if target.Thresholds.empty() {
+			continue
+		}
+		thresholds := target.Thresholds.resolve(capacity.For(target.Direction()))
+		if ips := pinned[summaryKey{url: target.URL, direction: target.Direction()}]; len(ips) > 0 && (target.ResolveAll || target.DualstackCompare || target.SizeSweep != nil || target.Bidirectional || target.OffsetSamples > 0 || ips[0].Agent != "") {
+			for _, s := range ips {
+				checks = append(checks, Evaluate(s, thresholds))
+			}
+			continue
+		}
+		s, ok := byKey[summaryKey{url: target.URL, direction: target.Direction()}]
+		if !ok {
+			s = Summary{URL: target.URL, Name: target.Name, Direction: target.Direction()}
+		}
+		checks = append(checks, Evaluate(s, thresholds))
+	}
+	return checks
+}
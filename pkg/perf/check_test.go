@@ -0,0 +1,128 @@
+package perf
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEvaluateLatency(t *testing.T) {
+	limits := Thresholds{MaxLatencyMs: 50, WarnLatencyMs: 20}
+	tests := []struct {
+		name    string
+		summary Summary
+		status  Status
+		failure string
+	}{
+		{"fast TTFB", Summary{Direction: Download, Runs: 3, MeanTTFBMs: 10}, StatusOK, ""},
+		{"slow TTFB", Summary{Direction: Download, Runs: 3, MeanTTFBMs: 30}, StatusWarning, "TTFB 30.0ms above 20.0ms"},
+		{"fast probes", Summary{Direction: Latency, Runs: 3, Latency: &LatencyStats{Avg: 5 * time.Millisecond}}, StatusOK, ""},
+		{"slow probes", Summary{Direction: Latency, Runs: 3, Latency: &LatencyStats{Avg: 80 * time.Millisecond}}, StatusCritical, "latency 80.0ms above 50.0ms"},
+		{"no runs", Summary{Direction: Latency}, StatusCritical, "no successful runs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Evaluate(tt.summary, limits)
+			if c.Status != tt.status {
+				t.Errorf("status = %v, want %v (failures %q)", c.Status, tt.status, c.Failures)
+			}
+			if tt.failure != "" && !slices.Contains(c.Failures, tt.failure) {
+				t.Errorf("failures = %q, want %q", c.Failures, tt.failure)
+			}
+		})
+	}
+}
+
+func TestEvaluateSpeed(t *testing.T) {
+	limits := Thresholds{MinSpeedMbps: 50, WarnSpeedMbps: 100}
+	tests := []struct {
+		name     string
+		summary  Summary
+		status   Status
+		failures []string
+	}{
+		{"fast", Summary{Runs: 3, MeanMbps: 150}, StatusOK, nil},
+		{"on the warning floor", Summary{Runs: 3, MeanMbps: 100}, StatusOK, nil},
+		{"slow", Summary{Runs: 3, MeanMbps: 80}, StatusWarning, []string{"speed 80.00 Mbps below 100.00 Mbps"}},
+		{"too slow", Summary{Runs: 3, MeanMbps: 20.5}, StatusCritical, []string{"speed 20.50 Mbps below 50.00 Mbps"}},
+		{"against the plan", Summary{Runs: 3, MeanMbps: 20, Utilization: 4}, StatusCritical, []string{"speed 20.00 Mbps (4% of plan) below 50.00 Mbps"}},
+		{"no runs", Summary{Errors: 3}, StatusCritical, []string{"no successful runs"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Evaluate(tt.summary, limits)
+			if c.Status != tt.status || !slices.Equal(c.Failures, tt.failures) {
+				t.Errorf("Evaluate = %v %q, want %v %q", c.Status, c.Failures, tt.status, tt.failures)
+			}
+		})
+	}
+	// The worst crossing decides, and every crossing is listed.
+	c := Evaluate(Summary{Runs: 2, MeanMbps: 80, MeanTTFBMs: 90}, Thresholds{WarnSpeedMbps: 100, MaxLatencyMs: 50})
+	if c.Status != StatusCritical || len(c.Failures) != 2 {
+		t.Errorf("Evaluate = %v %q, want critical with both failures", c.Status, c.Failures)
+	}
+}
+
+func TestChecks(t *testing.T) {
+	targets := []Target{
+		{URL: "https://example.com/fast", Thresholds: Thresholds{MinSpeedMbps: 50}},
+		{URL: "https://example.com/slow", Thresholds: Thresholds{MinSpeedMbps: 50, WarnSpeedMbps: 100}},
+		{URL: "https://example.com/up", Method: MethodUpload, Thresholds: Thresholds{MinSpeed: SpeedLimit{Share: 50}}},
+		{URL: "https://example.com/unchecked"},
+		{URL: "https://example.com/never-ran", Name: "missing", Thresholds: Thresholds{MaxLatencyMs: 100}},
+		{URL: "https://example.com/pinned", ResolveAll: true, Thresholds: Thresholds{MinSpeedMbps: 50}},
+	}
+	summaries := []Summary{
+		// Over several iterations the mean is what is checked.
+		{URL: "https://example.com/fast", Direction: Download, Runs: 3, MeanMbps: 60, MinMbps: 10},
+		{URL: "https://example.com/slow", Direction: Download, Runs: 3, MeanMbps: 70},
+		// Half of a 20 Mbps uplink is 10 Mbps.
+		{URL: "https://example.com/up", Direction: Upload, Runs: 1, MeanMbps: 8},
+		{URL: "https://example.com/unchecked", Direction: Download, Runs: 1, MeanMbps: 1},
+		{URL: "https://example.com/pinned", Direction: Download, IP: "192.0.2.1", Runs: 1, MeanMbps: 90},
+		{URL: "https://example.com/pinned", Direction: Download, IP: "192.0.2.2", Runs: 1, MeanMbps: 30},
+	}
+	checks := Checks(targets, summaries, LinkCapacity{Down: 100e6, Up: 20e6})
+	var got []string
+	status := StatusOK
+	for _, c := range checks {
+		got = append(got, fmt.Sprintf("%s %s %v %q", c.URL, c.Direction, c.Status, c.Failures))
+		status = max(status, c.Status)
+	}
+	want := []string{
+		`https://example.com/fast download OK []`,
+		`https://example.com/slow download WARNING ["speed 70.00 Mbps below 100.00 Mbps"]`,
+		`https://example.com/up upload CRITICAL ["speed 8.00 Mbps below 10.00 Mbps"]`,
+		`https://example.com/never-ran download CRITICAL ["no successful runs"]`,
+		`https://example.com/pinned download OK []`,
+		`https://example.com/pinned download CRITICAL ["speed 30.00 Mbps below 50.00 Mbps"]`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("checks\n%q\nwant\n%q", got, want)
+	}
+	if checks[3].Name != "missing" {
+		t.Errorf("check of a target with no summary is named %q", checks[3].Name)
+	}
+	// The worst check is the exit code.
+	if status != StatusCritical || int(status) != 2 || int(StatusWarning) != 1 || int(StatusOK) != 0 {
+		t.Errorf("exit status %d", status)
+	}
+	if Checks(targets[3:4], summaries, LinkCapacity{}) != nil {
+		t.Error("checks for a target without thresholds")
+	}
+}
+
+func TestCheckJSON(t *testing.T) {
+	b, err := json.Marshal(Check{URL: "https://example.com/", Direction: Download, Status: StatusWarning, Failures: []string{"speed 1.00 Mbps below 2.00 Mbps"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"url":"https://example.com/","direction":"download","status":"WARNING","failures":["speed 1.00 Mbps below 2.00 Mbps"]}`; string(b) != want {
+		t.Errorf("json %s, want %s", b, want)
+	}
+	if s := Status(7).String(); s != "CRITICAL" {
+		t.Errorf("Status(7) = %s", s)
+	}
+}
@@ -0,0 +1,56 @@
+package perf
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// ChecksumError reports a downloaded body whose digest differs from the
+// one configured for its URL.
+type ChecksumError struct {
+	Algorithm string
+	Want, Got string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s mismatch: got %s, want %s", e.Algorithm, e.Got, e.Want)
+}
+
+// digest is a running checksum of a body and the value it should reach.
+type digest struct {
+	hash.Hash
+	algorithm, want string
+}
+
+// digest returns the checksum configured for t, or nil when there is none
+// so the read loop does not hash at all.
+func (t Target) digest() *digest {
+	switch {
+	case t.SHA256 != "":
+		return &digest{sha256.New(), "sha256", strings.ToLower(t.SHA256)}
+	case t.MD5 != "":
+		return &digest{md5.New(), "md5", strings.ToLower(t.MD5)}
+	}
+	return nil
+}
+
+func (d *digest) verify() error {
+	if got := hex.EncodeToString(d.Sum(nil)); got != d.want {
+		return &ChecksumError{Algorithm: d.algorithm, Want: d.want, Got: got}
+	}
+	return nil
+}
+
+func checkDigest(name, value string, size int) error {
+	if value == "" {
+		return nil
+	}
+	if b, err := hex.DecodeString(value); err != nil || len(b) != size {
+		return fmt.Errorf("%s must be %d hex digits, got %q", name, size*2, value)
+	}
+	return nil
+}
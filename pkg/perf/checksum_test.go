@@ -0,0 +1,85 @@
+package perf
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const checksumSize = 100000
+
+func TestChecksum(t *testing.T) {
+	srv := payloadServer(t, 16<<10, 0)
+	sha := sha256.Sum256(make([]byte, checksumSize))
+	md := md5.Sum(make([]byte, checksumSize))
+	tests := []struct {
+		name        string
+		sha256, md5 string
+		mismatch    bool
+	}{
+		{name: "none"},
+		{name: "sha256 match", sha256: hex.EncodeToString(sha[:])},
+		{name: "sha256 upper case", sha256: strings.ToUpper(hex.EncodeToString(sha[:]))},
+		{name: "sha256 mismatch", sha256: strings.Repeat("0", 64), mismatch: true},
+		{name: "md5 match", md5: hex.EncodeToString(md[:])},
+		{name: "md5 mismatch", md5: strings.Repeat("f", 32), mismatch: true},
+	}
+	collector := NewCollector()
+	tester := New(Options{})
+	target := Target{URL: srv.URL + "/bytes/" + strconv.Itoa(checksumSize)}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target.SHA256, target.MD5 = tt.sha256, tt.md5
+			var last Stats
+			for s := range tester.Test(context.Background(), target) {
+				last = s
+			}
+			collector.Add(last)
+			var checksum *ChecksumError
+			if got := errors.As(last.Error, &checksum); got != tt.mismatch {
+				t.Fatalf("error = %v, want a checksum mismatch: %v", last.Error, tt.mismatch)
+			}
+			if !tt.mismatch && (last.Error != nil || last.SizeBytes != checksumSize) {
+				t.Errorf("got %d bytes, error %v", last.SizeBytes, last.Error)
+			}
+		})
+	}
+	if got := collector.Summaries()[0].ChecksumErrors; got != 2 {
+		t.Errorf("summary counts %d checksum errors, want 2", got)
+	}
+}
+
+// BenchmarkChecksum shows what hashing costs a download, against one
+// without a checksum, which skips hashing altogether.
+func BenchmarkChecksum(b *testing.B) {
+	const size = 64 << 20
+	srv := payloadServer(b, 1<<20, 0)
+	sha := sha256.Sum256(make([]byte, size))
+	md := md5.Sum(make([]byte, size))
+	tester := New(Options{ProgressInterval: -1})
+	for _, bb := range []struct {
+		name        string
+		sha256, md5 string
+	}{
+		{name: "none"},
+		{name: "sha256", sha256: hex.EncodeToString(sha[:])},
+		{name: "md5", md5: hex.EncodeToString(md[:])},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			target := Target{URL: srv.URL + "/bytes/" + strconv.Itoa(size), SHA256: bb.sha256, MD5: bb.md5}
+			b.SetBytes(size)
+			for b.Loop() {
+				for s := range tester.Test(context.Background(), target) {
+					if s.Final() && s.Error != nil {
+						b.Fatal(s.Error)
+					}
+				}
+			}
+		})
+	}
+}
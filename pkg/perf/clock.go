@@ -0,0 +1,43 @@
+package perf
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// epoch anchors the instants kept as integers. time.Unix drops the
+// monotonic reading, so an instant stored as UnixNano would measure
+// durations on the wall clock, which NTP may step.
+var epoch = time.Now()
+
+// Clock reads the wall time that results and samples are stamped with. A
+// Tester measures durations and run offsets on the monotonic clock
+// instead, so a Clock that steps, as NTP may, moves Stats.Timestamp and
+// Sample.Time but nothing measured.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// instant is a time set once from any goroutine.
+type instant struct {
+	// ns is one more than the nanoseconds from epoch, zero while unset.
+	ns atomic.Int64
+}
+
+// mark sets i to now unless it is set already.
+func (i *instant) mark() {
+	i.ns.CompareAndSwap(0, int64(time.Since(epoch))+1)
+}
+
+// time returns i with its monotonic reading, or the zero time while it is
+// unset.
+func (i *instant) time() time.Time {
+	if ns := i.ns.Load(); ns != 0 {
+		return epoch.Add(time.Duration(ns - 1))
+	}
+	return time.Time{}
+}
@@ -0,0 +1,84 @@
+package perf
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// steppedClock is the system clock moved by step, read without its
+// monotonic reading as a wall clock that NTP steps would be.
+type steppedClock struct {
+	step atomic.Int64
+}
+
+func (c *steppedClock) Now() time.Time {
+	return time.Now().Add(time.Duration(c.step.Load())).Round(0)
+}
+
+func TestWallClockStepDuringTransfer(t *testing.T) {
+	srv := payloadServer(t, 16<<10, 10*time.Millisecond)
+	clock := &steppedClock{}
+	tester := New(Options{ProgressInterval: 20 * time.Millisecond, Clock: clock})
+	began := time.Now()
+	var all []Stats
+	for s := range tester.Test(context.Background(), Target{URL: srv.URL + "/bytes/640000"}) {
+		all = append(all, s)
+		// The wall clock goes back an hour after the first snapshot, then
+		// forward two after the third.
+		switch len(all) {
+		case 1:
+			clock.step.Store(int64(-time.Hour))
+		case 3:
+			clock.step.Store(int64(time.Hour))
+		}
+	}
+	took := time.Since(began)
+	if len(all) < 5 {
+		t.Fatalf("%d snapshots, want enough to span both steps", len(all))
+	}
+
+	last := all[len(all)-1]
+	if !last.Done || last.Error != nil || last.SizeBytes != 640000 {
+		t.Fatalf("final %+v", last)
+	}
+	if last.Elapsed <= 0 || last.Elapsed > took {
+		t.Errorf("elapsed %v, want it within the %v the transfer took", last.Elapsed, took)
+	}
+	if want := float64(640000*8) / 1e6 / last.Elapsed.Seconds(); !near(last.SpeedMbps, want) {
+		t.Errorf("speed %vMbps, want %v", last.SpeedMbps, want)
+	}
+	if d := all[1].Timestamp.Sub(all[0].Timestamp); d > -50*time.Minute {
+		t.Errorf("timestamps %v then %v, want the step back to show", all[0].Timestamp, all[1].Timestamp)
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i].RunOffset < all[i-1].RunOffset {
+			t.Errorf("run offset went from %v to %v", all[i-1].RunOffset, all[i].RunOffset)
+		}
+	}
+	if last.RunOffset <= 0 || last.RunOffset > time.Since(tester.opts.RunStart) {
+		t.Errorf("final run offset %v", last.RunOffset)
+	}
+
+	var total time.Duration
+	stepped := false
+	for i, s := range last.Samples {
+		if s.Interval <= 0 || s.Mbps < 0 {
+			t.Errorf("sample %d: %+v", i, s)
+		}
+		if i > 0 && s.RunOffset <= last.Samples[i-1].RunOffset {
+			t.Errorf("sample %d at offset %v, after %v", i, s.RunOffset, last.Samples[i-1].RunOffset)
+		}
+		if time.Since(s.Time) > 50*time.Minute || time.Until(s.Time) > 50*time.Minute {
+			stepped = true
+		}
+		total += s.Interval
+	}
+	if len(last.Samples) == 0 || !stepped {
+		t.Errorf("samples %+v, want some stamped by the stepped clock", last.Samples)
+	}
+	if total > took {
+		t.Errorf("samples span %v of a %v transfer", total, took)
+	}
+}
@@ -0,0 +1,848 @@
+package perf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the on-disk configuration read from urls.yaml.
+type Config struct {
+	URLs []Target `yaml:"urls"`
+	// Profiles are named subsets of the urls, picked with -profile.
+	Profiles map[string]Profile `yaml:"profiles"`
+	// EmitProgress writes progress snapshots to stdout as JSON lines, next
+	// to the final results, when the output is json.
+	EmitProgress bool `yaml:"emit_progress"`
+	// SigningKey is the key hmac signs with in URL templates; see
+	// ExpandURL.
+	SigningKey  string `yaml:"signing_key" secret:"true"`
+	Concurrency int    `yaml:"concurrency"`
+	// PerHostConcurrency caps the transfers running at once per host, or
+	// per pool for URLs that set one.
+	PerHostConcurrency int `yaml:"per_host_concurrency"`
+	// Order is sequential (the default), shuffle or weighted; see
+	// OrderSequential. Seed makes its random choices repeatable.
+	Order  string  `yaml:"order"`
+	Seed   *uint64 `yaml:"seed"`
+	Output string  `yaml:"output"`
+	// Reporters lists the display formats to use, console and/or json. It
+	// defaults to Output.
+	Reporters []string `yaml:"reporters"`
+	// Outputs writes results to several destinations at once, each in a
+	// format of its own, in place of output and reporters.
+	Outputs []Destination `yaml:"outputs"`
+	// Template formats each final result as one line in place of the
+	// reporters: a text/template, or the name of a built-in one.
+	Template string `yaml:"template"`
+	// TableSort is the column the results table of each pass is sorted by,
+	// speed by default.
+	TableSort string `yaml:"table_sort"`
+	Trend     Trend  `yaml:"trend"`
+	// Units picks the units speeds and sizes are shown to people in.
+	Units Units `yaml:"units"`
+	// LatencyGrading overrides the bounds of the latency grades of
+	// bufferbloat tests.
+	LatencyGrading LatencyGrading `yaml:"latency_grading"`
+	// Sweep checks every URL answers before each pass.
+	Sweep *Sweep `yaml:"sweep"`
+	// Score adds a composite score of each pass to its results table.
+	Score    *Score `yaml:"score"`
+	LogLevel string `yaml:"log_level"`
+	// LogFormat is text (the default) or journal, which starts every log
+	// line with its syslog priority for systemd's journal.
+	LogFormat string            `yaml:"log_format"`
+	Labels    map[string]string `yaml:"labels"`
+	Timeout   time.Duration     `yaml:"timeout"`
+	// ConnectTimeout, TLSTimeout and HeaderTimeout bound the phases of a
+	// request on their own: the lookup and dial, the TLS handshake, and
+	// the wait for the response headers.
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	TLSTimeout     time.Duration `yaml:"tls_timeout"`
+	HeaderTimeout  time.Duration `yaml:"header_timeout"`
+	// RunDeadline bounds the whole invocation. Transfers still running
+	// when it passes are stopped and URLs not yet started are skipped, as
+	// are those that would start with less than MinBudget left.
+	RunDeadline time.Duration `yaml:"run_deadline"`
+	MinBudget   time.Duration `yaml:"min_budget"`
+	// ProbeFailuresThreshold takes the link to be down when that many
+	// transfers a pass starts with all fail to reach their servers, and
+	// skips the rest of the pass. Before the next pass the hosts are probed,
+	// after LinkDownRetry, 5s by default, and twice as long after each
+	// failed probe, until one answers.
+	ProbeFailuresThreshold int           `yaml:"probe_failures_threshold"`
+	LinkDownRetry          time.Duration `yaml:"link_down_retry"`
+	Iterations             *int          `yaml:"iterations"`
+	Interval               time.Duration `yaml:"interval"`
+	Cron                   string        `yaml:"cron"`
+	// ScheduleJitter offsets every scheduled pass by up to this much, by
+	// an amount hashed from ProbeID, or the hostname, so a fleet of probes
+	// spreads its passes out while each keeps the same offset across
+	// restarts. PassJitter adds a random delay of up to this much to each
+	// pass on top.
+	ScheduleJitter time.Duration `yaml:"schedule_jitter"`
+	PassJitter     time.Duration `yaml:"pass_jitter"`
+	ProbeID        string        `yaml:"probe_id"`
+	// Rollup aggregates the results of a continuous run per URL over
+	// windows of this width, reported as each window closes.
+	Rollup time.Duration `yaml:"rollup"`
+	// LinkCapacity is the plan speed of the link, which speeds are reported
+	// as a percentage of and speed thresholds may be given in percent of.
+	LinkCapacity LinkCapacity `yaml:"link_capacity"`
+	// DataBudget caps the bytes transferred per day, for metered links.
+	DataBudget *DataBudget `yaml:"data_budget"`
+	// PauseFile pauses a run while it exists. It is looked for before each
+	// pass and, once paused, every few seconds.
+	PauseFile     string `yaml:"pause_file"`
+	MetricsListen string `yaml:"metrics_listen"`
+	// Serve is the address of the HTTP API that runs tests on demand. When
+	// set yaperf runs until stopped instead of testing urls.
+	Serve string `yaml:"serve"`
+	// ServeOrigins are the browser origins, such as
+	// "https://dash.example.com", allowed to open /ws besides the API's
+	// own host.
+	ServeOrigins []string `yaml:"serve_origins"`
+	// Agents are remote yaperf instances serving the test API. When set,
+	// every url is tested from each of them in place of this machine.
+	Agents []Agent `yaml:"agents"`
+	// AgentTimeout bounds one test on an agent, 10 minutes by default, and
+	// AgentConcurrency caps the agents testing at once, all of them when 0.
+	AgentTimeout     time.Duration `yaml:"agent_timeout"`
+	AgentConcurrency int           `yaml:"agent_concurrency"`
+	CSVFile          string        `yaml:"csv_file"`
+	Influx           *Influx       `yaml:"influx"`
+	Webhook          *Webhook      `yaml:"webhook"`
+	OTel             *OTel         `yaml:"otel"`
+	// Outbox keeps what influx and webhook send on disk until it is
+	// delivered, retrying while their backend is down.
+	Outbox *Outbox `yaml:"outbox"`
+	// Sinks sets the policy of each sink by its key, such as influx or
+	// csv_file, and defines named sinks of its own that urls may route
+	// their results to. GroupSinks routes the urls of a group that name
+	// no sinks of their own.
+	Sinks      map[string]SinkConfig `yaml:"sinks"`
+	GroupSinks map[string][]string   `yaml:"group_sinks"`
+	// AlertThreshold, when set, marks a URL alerting once that many of its
+	// transfers failed within AlertWindow, an hour by default, until
+	// AlertClearAfter transfers in a row succeed, 3 by default.
+	AlertThreshold  int           `yaml:"alert_threshold"`
+	AlertWindow     time.Duration `yaml:"alert_window"`
+	AlertClearAfter int           `yaml:"alert_clear_after"`
+	// Experiment alternates passes between two sets of URLs in place of
+	// urls and compares their speeds.
+	Experiment *Experiment `yaml:"experiment"`
+	// Speedtest tests nearby speedtest.net servers in place of URLs.
+	Speedtest *Speedtest `yaml:"speedtest"`
+	StatsD    *StatsD    `yaml:"statsd"`
+	HistoryDB string     `yaml:"history_db"`
+	// RegressionTolerance is how many percent slower than a -baseline file
+	// a URL may be before the run fails, 10 when zero.
+	RegressionTolerance float64 `yaml:"regression_tolerance"`
+	SamplesFile         string  `yaml:"samples_file"`
+	// FlentOutput writes the interval samples and loaded round trips of the
+	// run to this file at its end, in flent's data format.
+	FlentOutput string `yaml:"flent_output"`
+	// Heatmap draws the interval speeds of every URL as a heatmap, kept
+	// up to date pass by pass.
+	Heatmap *Heatmap `yaml:"heatmap"`
+	// Socket streams every final result as a JSON line to the clients of
+	// a unix socket at this path, or into a named pipe already there.
+	Socket SinkPath `yaml:"socket"`
+	// ResultsFile archives every final result as a JSON line, compressed
+	// when it ends in .gz. It is rotated at RotateSize, keeping the newest
+	// RotateKeep archives, or all of them when zero.
+	ResultsFile SinkPath `yaml:"results_file"`
+	RotateSize  ByteSize `yaml:"rotate_size"`
+	RotateKeep  int      `yaml:"rotate_keep"`
+	// Manifest is a JSON file describing the run, its config and the files
+	// it writes, written as the run starts and again as it ends.
+	Manifest string `yaml:"manifest"`
+	Streams  int    `yaml:"streams"`
+	// TrimRagged leaves the tail after the first stream of a download, or
+	// the first of concurrent transfers, finished out of its speed.
+	TrimRagged      bool  `yaml:"trim_ragged"`
+	Preflight       bool  `yaml:"preflight"`
+	FollowRedirects *bool `yaml:"follow_redirects"`
+	// FreshConnection dials every transfer afresh instead of keeping
+	// connections between passes; MaxIdleConnsPerHost and
+	// IdleConnTimeout bound the connections kept.
+	FreshConnection bool `yaml:"fresh_connection"`
+	// ColdStart dials every transfer afresh and looks its host up without
+	// a caching system resolver, as on the first run of the day. Warm
+	// keeps DNS answers for their TTL and idle connections for as long as
+	// the server allows between passes, for steady-state results.
+	ColdStart           bool          `yaml:"cold_start"`
+	Warm                bool          `yaml:"warm"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+	MaxRedirects        int           `yaml:"max_redirects"`
+	BufferSize          ByteSize      `yaml:"buffer_size"`
+	IPVersion           string        `yaml:"ip_version"`
+	Protocol            string        `yaml:"protocol"`
+	Compression         string        `yaml:"compression"`
+	// NormalizeEncoding forces Accept-Encoding: identity and fails
+	// downloads whose body still comes compressed, so byte counts stay
+	// comparable across runs.
+	NormalizeEncoding bool           `yaml:"normalize_encoding"`
+	UserAgent         string         `yaml:"user_agent"`
+	Preset            string         `yaml:"preset"`
+	Count             string         `yaml:"count"`
+	Fallback          bool           `yaml:"fallback"`
+	Proxy             string         `yaml:"proxy"`
+	Resolver          string         `yaml:"resolver"`
+	Warmup            time.Duration  `yaml:"warmup"`
+	Retries           int            `yaml:"retries"`
+	RetryBackoff      time.Duration  `yaml:"retry_backoff"`
+	RateLimit         Rate           `yaml:"rate_limit"`
+	TotalRateLimit    Rate           `yaml:"total_rate_limit"`
+	Mode              string         `yaml:"mode"`
+	Adaptive          Adaptive       `yaml:"adaptive"`
+	ShiftDetection    ShiftDetection `yaml:"shift_detection"`
+	StallThreshold    time.Duration  `yaml:"stall_threshold"`
+	StallFloor        Rate           `yaml:"stall_floor"`
+	AbortOnStall      bool           `yaml:"abort_on_stall"`
+	MinSpeedFloor     Rate           `yaml:"min_speed_floor"`
+	FloorGrace        time.Duration  `yaml:"floor_grace"`
+	// ProgressInterval is how often progress is reported, every second when
+	// unset. Zero turns progress off and only final results are reported.
+	ProgressInterval *time.Duration `yaml:"progress_interval"`
+	// CPUThreshold is the share of one core the process may use during a
+	// transfer before the result warns it may be CPU-bound, 80% when
+	// unset. Zero turns CPU sampling off.
+	CPUThreshold       *Percent `yaml:"cpu_threshold"`
+	Limits             `yaml:",inline"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	CAFile             string `yaml:"ca_file"`
+	ClientCert         string `yaml:"client_cert"`
+	ClientKey          string `yaml:"client_key"`
+}
+
+// Trend configures the speed trend printed under each result when passes
+// repeat. History is how many results the sparkline shows (10 by default)
+// and Window how many earlier results the change is measured against (5).
+type Trend struct {
+	History int `yaml:"history"`
+	Window  int `yaml:"window"`
+}
+
+// SinkPath is the file or socket a sink writes to, given as its path
+// alone or as a mapping of path and emit_progress. EmitProgress writes
+// progress snapshots too, not just final results.
+type SinkPath struct {
+	Path         string `yaml:"path"`
+	EmitProgress bool   `yaml:"emit_progress"`
+}
+
+func (s *SinkPath) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		s.Path = node.Value
+		return nil
+	}
+	type plain SinkPath
+	return node.Decode((*plain)(s))
+}
+
+// Failed URLs in a Score.
+const (
+	ScoreSkip = "skip"
+	ScoreZero = "zero"
+)
+
+// Score configures the composite score of a pass, a weighted geometric
+// mean of its URLs' speeds. Failed is skip (the default), leaving failed
+// URLs out, or zero, which scores the pass 0 when any URL failed.
+// ErrorPenalty takes that share off the score for each failed attempt, and
+// a loaded p95 round trip above LatencyTarget scales the score down by
+// how far it is over.
+type Score struct {
+	Failed        string        `yaml:"failed"`
+	ErrorPenalty  Percent       `yaml:"error_penalty"`
+	LatencyTarget time.Duration `yaml:"latency_target"`
+}
+
+// Influx configures writing results to an InfluxDB v2 bucket.
+type Influx struct {
+	URL         string `yaml:"url"`
+	Token       string `yaml:"token" secret:"true"`
+	Org         string `yaml:"org"`
+	Bucket      string `yaml:"bucket"`
+	Measurement string `yaml:"measurement"`
+	// EmitProgress also writes every progress snapshot, not just final
+	// results. Intervals is its older name.
+	EmitProgress bool `yaml:"emit_progress"`
+	Intervals    bool `yaml:"intervals"`
+	// BatchSize is how many points are buffered before a write; FlushInterval
+	// bounds how long a point may wait.
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+// Outbox queues the batches written to influx and the alerts sent to
+// webhook on disk, with an ID each, and delivers them oldest first from
+// the background. An entry is removed once its backend accepts it; until
+// then it is retried, backing off exponentially, and it survives restarts.
+type Outbox struct {
+	// Dir holds the queue, outbox in the cache directory by default.
+	Dir string `yaml:"dir"`
+	// MaxEntries caps the queue, 1000 by default; past it the oldest
+	// entries are dropped.
+	MaxEntries int `yaml:"max_entries"`
+	// RetryBackoff is the wait after a first failed delivery, 1s by
+	// default, doubling with every failure in a row up to MaxBackoff, 5m
+	// by default.
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	MaxBackoff   time.Duration `yaml:"max_backoff"`
+}
+
+// SinkNames are the sinks a SinkPolicy may be set for: the config keys
+// that set them up, and report for the -report flag.
+var SinkNames = []string{"metrics", "csv_file", "influx", "otel", "statsd", "webhook", "samples_file", "heatmap", "socket", "results_file", "history_db", "flent_output", "report"}
+
+// SinkPolicy says what a sink failing does to the run.
+type SinkPolicy struct {
+	// Required sinks, as all are by default, stop the run before the first
+	// transfer when they cannot be set up, and fail it when they cannot
+	// be closed. Any other goes degraded: the run carries on without it.
+	Required *bool `yaml:"required"`
+}
+
+// IsRequired reports whether the sink must work for the run to.
+func (p SinkPolicy) IsRequired() bool {
+	return p.Required == nil || *p.Required
+}
+
+// SinkConfig is an entry of sinks. Under one of SinkNames it sets the
+// policy of that sink. Under a name of its own it also defines a sink,
+// setting exactly one of the fields below as the top-level key of the
+// same name would.
+type SinkConfig struct {
+	SinkPolicy  `yaml:",inline"`
+	CSVFile     string   `yaml:"csv_file"`
+	Influx      *Influx  `yaml:"influx"`
+	OTel        *OTel    `yaml:"otel"`
+	StatsD      *StatsD  `yaml:"statsd"`
+	Webhook     *Webhook `yaml:"webhook"`
+	SamplesFile string   `yaml:"samples_file"`
+	Socket      SinkPath `yaml:"socket"`
+	ResultsFile SinkPath `yaml:"results_file"`
+}
+
+// Budget days start at midnight in one of these.
+const (
+	BudgetLocal = "local"
+	BudgetUTC   = "utc"
+)
+
+// DataBudget caps the bytes a run may transfer per day, uploads and
+// aborted transfers included. Once a day's budget is used up, passes are
+// skipped until the next day starts.
+type DataBudget struct {
+	PerDay ByteSize `yaml:"per_day"`
+	// Timezone is local (the default) or utc, whose midnight starts a day.
+	Timezone string `yaml:"timezone"`
+	// StateFile keeps the day's count across restarts, budget.json in the
+	// cache directory by default.
+	StateFile string `yaml:"state_file"`
+}
+
+// Heatmap layouts.
+const (
+	HeatmapTimeOfDay = "time_of_day"
+	HeatmapPass      = "pass"
+)
+
+// Heatmap writes a CSV grid and a PNG of it to Dir for each URL. The
+// time_of_day layout counts the interval samples that fell in each column
+// of the day and each SpeedStep of speed; the pass layout has a column per
+// pass and a row per Row of time into the transfer, holding the mean
+// speed there.
+type Heatmap struct {
+	Dir    string `yaml:"dir"`
+	Layout string `yaml:"layout"`
+	// Column is the width of a time_of_day column, 15m by default; it
+	// must divide a day.
+	Column time.Duration `yaml:"column"`
+	// SpeedStep is the height of a time_of_day speed row, a fiftieth of
+	// MaxSpeed by default, and MaxSpeed the speed the top row ends at,
+	// link_capacity or 1Gbps by default. Faster samples count in the top
+	// row.
+	SpeedStep Rate `yaml:"speed_step"`
+	MaxSpeed  Rate `yaml:"max_speed"`
+	// Row is the height of a pass row, 1s by default.
+	Row time.Duration `yaml:"row"`
+}
+
+// Agent is a remote yaperf instance with serve set, whose results carry
+// Label.
+type Agent struct {
+	Label string `yaml:"label"`
+	URL   string `yaml:"url"`
+}
+
+// Webhook configures alerts sent when a transfer fails or is slower than
+// its min_speed_mbps.
+type Webhook struct {
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers" secret:"true"`
+	// Template is a text/template for the request body. It sees the alert's
+	// URL, Direction, SpeedMbps, ThresholdMbps, Error, State, Failures,
+	// Timestamp, RunID, Host and Labels and provides a json function for
+	// quoting strings. The default body is the alert as JSON.
+	Template string `yaml:"template"`
+	// Cooldown is the minimum time between alerts for one URL. It defaults
+	// to 10 minutes.
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// OTel configures exporting a trace per transfer to an OpenTelemetry
+// collector over OTLP/HTTP.
+type OTel struct {
+	// Endpoint is the collector's host:port, or a URL its /v1/traces is
+	// appended to. Insecure sends to a host:port over plain HTTP.
+	Endpoint string            `yaml:"endpoint"`
+	Insecure bool              `yaml:"insecure"`
+	Headers  map[string]string `yaml:"headers" secret:"true"`
+	// ServiceName is the service.name traces are reported under, "yaperf"
+	// by default.
+	ServiceName string `yaml:"service_name"`
+}
+
+// Speedtest configures testing against the nearest Ookla speedtest
+// servers. URLs are tested instead when the servers cannot be found.
+type Speedtest struct {
+	Enabled bool `yaml:"enabled"`
+	// Servers is how many of the lowest-latency servers are tested, 3 by
+	// default.
+	Servers int `yaml:"servers"`
+	// ListURL is where the server list is fetched from, speedtest.net's by
+	// default. Both its JSON and its older XML format are read.
+	ListURL string `yaml:"list_url"`
+	// DownloadSize and UploadSize are how much each server is sent and
+	// asked for, 25MB and 10MB by default.
+	DownloadSize ByteSize `yaml:"download_size"`
+	UploadSize   ByteSize `yaml:"upload_size"`
+	// CacheTTL is how long a fetched server list is reused, a day by
+	// default.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// On reports whether s is set and enabled.
+func (s *Speedtest) On() bool {
+	return s != nil && s.Enabled
+}
+
+// StatsD configures sending metrics to a StatsD or DogStatsD agent over
+// UDP.
+type StatsD struct {
+	Address string `yaml:"address"`
+	// Prefix starts every metric name; it defaults to "yaperf".
+	Prefix string `yaml:"prefix"`
+	// DogStatsD tags metrics with the URL, direction, host, labels and Tags
+	// instead of putting the direction in the name.
+	DogStatsD bool              `yaml:"dogstatsd"`
+	Tags      map[string]string `yaml:"tags"`
+}
+
+// Compression modes. Identity asks for uncompressed bodies; accept allows
+// gzip and counts the compressed bytes.
+const (
+	CompressionIdentity = "identity"
+	CompressionAccept   = "accept"
+)
+
+func checkCompression(mode string) error {
+	switch mode {
+	case "", CompressionIdentity, CompressionAccept:
+		return nil
+	}
+	return fmt.Errorf("compression must be identity or accept, got %q", mode)
+}
+
+// Methods accepted in a Target.
+const (
+	MethodDownload = "download"
+	MethodUpload   = "upload"
+	MethodLatency  = "latency"
+)
+
+// Target is one entry of the urls list. It may be written in YAML either as
+// a bare URL string or as a mapping with the fields below.
+type Target struct {
+	URL string `yaml:"url"`
+	// Name is shown in place of the URL, and Group gathers targets whose
+	// speeds are compared in the summary.
+	Name  string `yaml:"name"`
+	Group string `yaml:"group"`
+	// Sinks routes the results of the entry to these sinks alone, by
+	// their key in sinks or the top-level key setting them up. Unset,
+	// they go to every sink.
+	Sinks           []string          `yaml:"sinks"`
+	Method          string            `yaml:"method"`
+	UploadSize      ByteSize          `yaml:"upload_size"`
+	Headers         map[string]string `yaml:"headers" secret:"true"`
+	Auth            *Auth             `yaml:"auth"`
+	Streams         int               `yaml:"streams"`
+	Preflight       *bool             `yaml:"preflight"`
+	FollowRedirects *bool             `yaml:"follow_redirects"`
+	// FreshConnection overrides the global fresh_connection.
+	FreshConnection *bool `yaml:"fresh_connection"`
+	MaxRedirects    int   `yaml:"max_redirects"`
+	Cookies         bool  `yaml:"cookies"`
+	FTPPassive      *bool `yaml:"ftp_passive"`
+	// DirectIO reads a file:// URL with O_DIRECT, bypassing the page cache.
+	DirectIO    bool   `yaml:"direct_io"`
+	IPVersion   string `yaml:"ip_version"`
+	Protocol    string `yaml:"protocol"`
+	Compression string `yaml:"compression"`
+	// NormalizeEncoding overrides the global normalize_encoding.
+	NormalizeEncoding *bool `yaml:"normalize_encoding"`
+	// UserAgent is sent as the User-Agent, and Preset names the browser
+	// or client whose headers are sent: chrome, firefox, safari or curl.
+	// Headers override both.
+	UserAgent string `yaml:"user_agent"`
+	Preset    string `yaml:"preset"`
+	Count     string `yaml:"count"`
+	// CaptureHeaders names the response headers kept with the result, or
+	// is all.
+	CaptureHeaders HeaderNames `yaml:"capture_headers"`
+	SourceIP       string      `yaml:"source_ip"`
+	Interface      string      `yaml:"interface"`
+	Resolve        Pins        `yaml:"resolve"`
+	// ConnectTo is the host:port connections to the URL's host go to in
+	// its place, like curl's --connect-to. HostHeader is sent as the Host
+	// and SNI as the TLS server name, which the certificate is verified
+	// against; SNI defaults to the host of HostHeader.
+	ConnectTo  string `yaml:"connect_to"`
+	HostHeader string `yaml:"host_header"`
+	SNI        string `yaml:"sni"`
+	// ResolveAll tests the URL once per address its host resolves to.
+	ResolveAll bool `yaml:"resolve_all"`
+	// DualstackCompare tests the URL twice, once over IPv4 and once over
+	// IPv6. A family the host has no address in is skipped.
+	DualstackCompare bool `yaml:"dualstack_compare"`
+	// SizeSweep tests the URL once per size, to see how its speed depends
+	// on the size of the object.
+	SizeSweep *SizeSweep `yaml:"sweep"`
+	// OffsetSamples tests the URL this many times, fetching SampleSize
+	// bytes, 32MB by default, from evenly spaced offsets through the
+	// object, to catch a body whose parts are served from different
+	// caches.
+	OffsetSamples int      `yaml:"offset_samples"`
+	SampleSize    ByteSize `yaml:"sample_size"`
+	// Ramp times how quickly the transfer reaches its steady speed, from
+	// the bytes it moves at a fine resolution through its first seconds.
+	Ramp *Ramp `yaml:"ramp"`
+	// Pool groups URLs for per_host_concurrency in place of their host.
+	Pool string `yaml:"pool"`
+	// SHA256 or MD5 is the expected digest of the body. It is verified on
+	// downloads that run to the end of the body.
+	SHA256 string `yaml:"sha256"`
+	MD5    string `yaml:"md5"`
+	// Expect fails a response that does not look like the body of the URL
+	// with an InterceptionError in place of its speed.
+	Expect *Expect `yaml:"expect"`
+	// VerifyPattern checks the body against the pattern serve-payload
+	// sends, failing at the first byte that differs.
+	VerifyPattern *VerifyPattern `yaml:"verify_pattern"`
+	// S3 fetches an object from S3 in place of url, signing every request.
+	// The entry is named after the object's key unless it has a name.
+	S3 *S3Object `yaml:"s3"`
+	// Probes is the number of requests a latency test sends, and
+	// ReuseConnections whether they share a warmed-up connection.
+	Probes           int  `yaml:"probes"`
+	ReuseConnections bool `yaml:"reuse_connections"`
+	// Bufferbloat probes the round trip to the host before and during a
+	// download or upload, sending the probes to ProbeURL when it is set.
+	Bufferbloat bool   `yaml:"bufferbloat"`
+	ProbeURL    string `yaml:"probe_url"`
+	// ReuseProbe downloads the URL twice over one keep-alive connection to
+	// compare a cold fetch with a warm one.
+	ReuseProbe bool `yaml:"reuse_probe"`
+	// Bidirectional downloads the URL and uploads upload_size to
+	// UploadURL, or the URL, first each on its own and then both at once,
+	// probing the round trip while both run.
+	Bidirectional bool   `yaml:"bidirectional"`
+	UploadURL     string `yaml:"upload_url"`
+	RateLimit     Rate   `yaml:"rate_limit"`
+	// Simulate shapes the downloaded body as if it came over the link it
+	// describes.
+	Simulate       *Simulate     `yaml:"simulate"`
+	Mode           string        `yaml:"mode"`
+	StallThreshold time.Duration `yaml:"stall_threshold"`
+	StallFloor     Rate          `yaml:"stall_floor"`
+	AbortOnStall   *bool         `yaml:"abort_on_stall"`
+	// MinSpeedFloor aborts a download whose speed over the last
+	// FloorGrace (10s by default) is below it.
+	MinSpeedFloor Rate          `yaml:"min_speed_floor"`
+	FloorGrace    time.Duration `yaml:"floor_grace"`
+	// Sink is discard (the default) or file, which also writes the body to
+	// OutputPath. A file left by a failed download is removed unless
+	// KeepPartial is set.
+	Sink        string `yaml:"sink"`
+	OutputPath  string `yaml:"output_path"`
+	KeepPartial bool   `yaml:"keep_partial"`
+	// Resume continues a download that failed part way with a Range
+	// request for the rest, up to MaxResumes times (3 by default).
+	Resume     bool `yaml:"resume"`
+	MaxResumes int  `yaml:"max_resumes"`
+	// Weight is how often the URL is drawn with order: weighted, relative
+	// to the others. It defaults to 1.
+	Weight     float64 `yaml:"weight"`
+	Limits     `yaml:",inline"`
+	Thresholds `yaml:",inline"`
+
+	decodeErrs []Problem
+	// pinnedIP is the address a resolve_all copy dials, and resolveErr why
+	// its host could not be looked up.
+	pinnedIP   string
+	resolveErr error
+	// family is "ipv4" or "ipv6" on the copies of a dualstack_compare
+	// target, and skipReason why one is skipped.
+	family     string
+	skipReason string
+	// sweepSize is the size a copy of a size sweep fetches.
+	sweepSize int64
+	// bidiPhase is the phase a leg of a bidirectional target runs in.
+	bidiPhase string
+	// sampleOffset is where the copy of an offset_samples target starts
+	// fetching, offsetSamples how many copies there are and sampleRanged
+	// whether it asks for a range; sampleNote says why there is a single
+	// unranged copy.
+	sampleOffset  int64
+	offsetSamples int
+	sampleRanged  bool
+	sampleNote    string
+	// queueWait is how long Run held the target back for its pool, and
+	// order its place among the transfers its pass handed out.
+	queueWait time.Duration
+	order     int
+	// resumeFrom is the offset a resumed download asks for the rest of
+	// the body from, and resumeETag the ETag the body had when it began.
+	resumeFrom int64
+	resumeETag string
+	// s3Creds are the keys an s3 entry's requests are signed with.
+	s3Creds *s3Credentials
+	// template is the URL as configured when it is a template and URL its
+	// expansion for this pass; shown is that expansion with its signatures
+	// redacted.
+	template string
+	shown    string
+}
+
+// Direction reports which way the Target transfers data.
+func (t Target) Direction() Direction {
+	switch t.Method {
+	case MethodUpload:
+		return Upload
+	case MethodLatency:
+		return Latency
+	}
+	return Download
+}
+
+// Auth types accepted in an Auth block.
+const (
+	AuthBearer = "bearer"
+	AuthBasic  = "basic"
+)
+
+// Auth holds the credentials sent with a Target's requests.
+type Auth struct {
+	Type  string `yaml:"type"`
+	Token string `yaml:"token" secret:"true"`
+	User  string `yaml:"user"`
+	Pass  string `yaml:"pass" secret:"true"`
+}
+
+// prepare adds the target's headers and credentials to req.
+func (t Target) prepare(req *http.Request) {
+	t.identify(req)
+	if t.Compression == CompressionAccept && (t.NormalizeEncoding == nil || !*t.NormalizeEncoding) {
+		req.Header.Set("Accept-Encoding", "gzip")
+	} else {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	for name, value := range t.Headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	if t.HostHeader != "" {
+		req.Host = t.HostHeader
+	}
+	if t.s3Creds != nil {
+		signS3(req, *t.s3Creds, t.S3.region(), time.Now())
+	}
+	if t.Auth == nil {
+		return
+	}
+	switch t.Auth.Type {
+	case AuthBearer:
+		req.Header.Set("Authorization", "Bearer "+t.Auth.Token)
+	case AuthBasic:
+		req.SetBasicAuth(t.Auth.User, t.Auth.Pass)
+	}
+}
+
+// CacheMode is CacheCold with cold_start, CacheWarm with warm, or "" when
+// neither is set.
+func (c Config) CacheMode() string {
+	switch {
+	case c.ColdStart:
+		return CacheCold
+	case c.Warm:
+		return CacheWarm
+	}
+	return ""
+}
+
+// Limits stops a transfer early; the result is still reported as a normal
+// completion. Zero values mean no limit.
+type Limits struct {
+	MaxBytes    ByteSize      `yaml:"max_bytes"`
+	MaxDuration time.Duration `yaml:"max_duration"`
+}
+
+func (l Limits) merge(override Limits) Limits {
+	if override.MaxBytes > 0 {
+		l.MaxBytes = override.MaxBytes
+	}
+	if override.MaxDuration > 0 {
+		l.MaxDuration = override.MaxDuration
+	}
+	return l
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (t *Target) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*t = Target{URL: node.Value}
+		return nil
+	}
+	type plain Target
+	var p plain
+	if err := node.Decode(&p); err != nil {
+		// Keep the entry so later ones keep their index; Problems reports
+		// what failed to decode.
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return err
+		}
+		for _, e := range typeErr.Errors {
+			p.decodeErrs = append(p.decodeErrs, decodeProblem(node, e))
+		}
+	}
+	if p.S3 != nil {
+		switch {
+		case p.URL != "":
+			p.decodeErrs = append(p.decodeErrs, Problem{Path: "s3", Line: node.Line, Err: errors.New("cannot be used with url")})
+		default:
+			p.URL = p.S3.url()
+		}
+		if p.Name == "" {
+			p.Name = p.S3.Key
+		}
+	}
+	*t = Target(p)
+	return nil
+}
+
+// Validate reports settings that cannot be used, joining every Problem.
+func (c Config) Validate() error {
+	return c.Problems().Err()
+}
+
+// Destination is one of the outputs: a format and where it goes.
+type Destination struct {
+	// Format is text, json or csv.
+	Format string `yaml:"format"`
+	// To is stdout, the default, stderr or the path of a file, which is
+	// appended to.
+	To string `yaml:"to"`
+}
+
+// Destinations an output may name besides a file.
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+)
+
+// Log formats accepted by log_format.
+const (
+	LogText    = "text"
+	LogJournal = "journal"
+)
+
+// Level parses log_level: debug, info (the default), warn or error.
+func (c Config) Level() (slog.Level, error) {
+	var level slog.Level
+	if c.LogLevel == "" {
+		return level, nil
+	}
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return level, fmt.Errorf("log_level must be debug, info, warn or error, got %q", c.LogLevel)
+	}
+	return level, nil
+}
+
+// ProxyURL parses the configured proxy. It returns nil when none is set, in
+// which case the proxy environment variables apply.
+func (c Config) ProxyURL() (*url.URL, error) {
+	if c.Proxy == "" {
+		return nil, nil
+	}
+	return ParseProxy(c.Proxy)
+}
+
+// TLSConfig builds the client TLS configuration described by c.
+func (c Config) TLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file: no PEM certificates found in %s", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if c.ClientCert != "" || c.ClientKey != "" {
+		if c.ClientCert == "" || c.ClientKey == "" {
+			return nil, fmt.Errorf("client_cert and client_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// deadline returns a timer that fires after MaxDuration, or never when no
+// duration limit is set.
+func (l Limits) deadline() *time.Timer {
+	if l.MaxDuration > 0 {
+		return time.NewTimer(l.MaxDuration)
+	}
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+	return t
+}
@@ -0,0 +1,245 @@
+package perf
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// writeCert writes a self-signed certificate for cn and its key as PEM
+// files named after cn in dir.
+func writeCert(t *testing.T, dir, cn string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: cn},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, cn+".pem"), filepath.Join(dir, cn+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestTLSConfigVerification(t *testing.T) {
+	// The server asks for a client certificate and names the one it got.
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if certs := r.TLS.PeerCertificates; len(certs) > 0 {
+			w.Header().Set("X-Client", certs[0].Subject.CommonName)
+		}
+		w.Write([]byte("ok"))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	trusted := filepath.Join(dir, "ca.pem")
+	os.WriteFile(trusted, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600)
+	// A CA file that parses but does not hold the server's certificate.
+	untrusted, _ := writeCert(t, dir, "other")
+	certFile, keyFile := writeCert(t, dir, "probe-1")
+
+	tests := []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"system roots", Config{}, false},
+		{"untrusted ca_file", Config{CAFile: untrusted}, false},
+		{"trusted ca_file", Config{CAFile: trusted}, true},
+		{"insecure_skip_verify", Config{InsecureSkipVerify: true}, true},
+		{"client certificate", Config{CAFile: trusted, ClientCert: certFile, ClientKey: keyFile}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tt.cfg.TLSConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tester := New(Options{TLSConfig: cfg})
+			last, err := tester.DownloadAndWait(context.Background(), srv.URL)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("download failed: %v", err)
+				}
+				return
+			}
+			var unknown x509.UnknownAuthorityError
+			if !errors.As(err, &unknown) || last.ErrorKind != ErrorTLS {
+				t.Errorf("err = %v (%s), want an unknown authority TLS error", err, last.ErrorKind)
+			}
+		})
+	}
+
+	// The client certificate reaches the server.
+	cfg, err := Config{CAFile: trusted, ClientCert: certFile, ClientKey: keyFile}.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("X-Client"); got != "probe-1" {
+		t.Errorf("server saw client %q, want probe-1", got)
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.pem")
+	os.WriteFile(garbage, []byte("not a certificate"), 0o600)
+	certFile, _ := writeCert(t, dir, "probe-1")
+	tests := []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{CAFile: filepath.Join(dir, "missing.pem")}, "ca_file: open "},
+		{Config{CAFile: garbage}, "ca_file: no PEM certificates found in " + garbage},
+		{Config{ClientCert: certFile}, "client_cert and client_key must be set together"},
+		{Config{ClientCert: certFile, ClientKey: garbage}, "client certificate: "},
+	}
+	for _, tt := range tests {
+		if _, err := tt.cfg.TLSConfig(); err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%+v: err = %v, want %q", tt.cfg, err, tt.want)
+		}
+	}
+	if cfg, err := (Config{}).TLSConfig(); err != nil || cfg.InsecureSkipVerify {
+		t.Errorf("default TLS config %+v, %v: verification must be on", cfg, err)
+	}
+}
+
+func TestTargetYAMLShapes(t *testing.T) {
+	doc := `urls:
+  - https://example.com/plain
+  - url: https://example.com/private
+    headers:
+      X-Probe: edge-1
+    auth:
+      type: bearer
+      token: secret
+`
+	var c Config
+	if err := yaml.Unmarshal([]byte(doc), &c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.URLs) != 2 {
+		t.Fatalf("%d urls, want 2", len(c.URLs))
+	}
+	if plain := c.URLs[0]; plain.URL != "https://example.com/plain" || plain.Headers != nil || plain.Auth != nil {
+		t.Errorf("plain entry %+v", plain)
+	}
+	private := c.URLs[1]
+	if private.URL != "https://example.com/private" || private.Headers["X-Probe"] != "edge-1" {
+		t.Errorf("struct entry %+v", private)
+	}
+	if private.Auth == nil || *private.Auth != (Auth{Type: AuthBearer, Token: "secret"}) {
+		t.Errorf("auth %+v", private.Auth)
+	}
+}
+
+func TestSinkPathYAMLShapes(t *testing.T) {
+	doc := `socket: /run/yaperf.sock
+results_file:
+  path: results.jsonl.gz
+  emit_progress: true
+influx:
+  url: http://influx:8086
+  bucket: perf
+  intervals: true
+`
+	var c Config
+	if err := yaml.Unmarshal([]byte(doc), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Socket != (SinkPath{Path: "/run/yaperf.sock"}) {
+		t.Errorf("socket %+v", c.Socket)
+	}
+	if c.ResultsFile != (SinkPath{Path: "results.jsonl.gz", EmitProgress: true}) {
+		t.Errorf("results_file %+v", c.ResultsFile)
+	}
+	// intervals is still read, as the older name of emit_progress.
+	if c.Influx == nil || !c.Influx.Intervals || c.Influx.EmitProgress {
+		t.Errorf("influx %+v", c.Influx)
+	}
+}
+
+func TestTargetHeadersAndAuth(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		if r.Header.Get("Authorization") == "" {
+			http.Error(w, "log in first", http.StatusUnauthorized)
+			return
+		}
+		w.Write(make([]byte, 100))
+	}))
+	defer srv.Close()
+	tester := New(Options{ProgressInterval: -1})
+
+	tests := []struct {
+		name      string
+		target    Target
+		header    string
+		wantAuth  string
+		wantError bool
+	}{
+		{"bearer", Target{Headers: map[string]string{"X-Probe": "edge-1"}, Auth: &Auth{Type: AuthBearer, Token: "secret"}}, "edge-1", "Bearer secret", false},
+		{"basic", Target{Auth: &Auth{Type: AuthBasic, User: "probe", Pass: "pw"}}, "", "Basic cHJvYmU6cHc=", false},
+		// An error page is an error, not a result.
+		{"no auth", Target{}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.target.URL = srv.URL
+			all := collect(tester.Test(context.Background(), tt.target))
+			last := all[len(all)-1]
+			if got.Get("X-Probe") != tt.header || got.Get("Authorization") != tt.wantAuth {
+				t.Errorf("sent X-Probe %q and Authorization %q, want %q and %q", got.Get("X-Probe"), got.Get("Authorization"), tt.header, tt.wantAuth)
+			}
+			var status *StatusError
+			if tt.wantError != errors.As(last.Error, &status) {
+				t.Errorf("err %v, want a status error %v", last.Error, tt.wantError)
+			}
+			if tt.wantError && (status.Code != http.StatusUnauthorized || last.ErrorKind != ErrorHTTPStatus) {
+				t.Errorf("status %d, kind %q", status.Code, last.ErrorKind)
+			}
+			if !tt.wantError && last.SizeBytes != 100 {
+				t.Errorf("read %d bytes, want 100", last.SizeBytes)
+			}
+		})
+	}
+}
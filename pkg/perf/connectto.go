@@ -0,0 +1,90 @@
+package perf
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// connectTo dials to in place of from, the host:port of the URL, like
+// curl's --connect-to. Other addresses, such as those redirects lead to,
+// are dialed as they are.
+func connectTo(from, to string, dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if strings.EqualFold(addr, from) {
+			addr = to
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// urlAddr is the host:port rawURL is dialed at, with the default port of
+// its scheme when it has none.
+func urlAddr(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case SchemeFTP:
+			port = "21"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// serverName is the TLS server name t sends in place of its URL's host, or
+// "" to send that.
+func (t Target) serverName() string {
+	if t.SNI != "" || t.HostHeader == "" {
+		return t.SNI
+	}
+	if host, _, err := net.SplitHostPort(t.HostHeader); err == nil {
+		return host
+	}
+	return t.HostHeader
+}
+
+// connectToProblems adds the problems of the connect_to, host_header and
+// sni settings of t, with prefix naming it.
+func (t Target) connectToProblems(ps *Problems, prefix string) {
+	if t.ConnectTo != "" {
+		host, port, err := net.SplitHostPort(t.ConnectTo)
+		n, _ := strconv.Atoi(port)
+		switch {
+		case err != nil || host == "" || n < 1 || n > 65535:
+			ps.Addf(prefix+"connect_to", "want host:port, got %q", t.ConnectTo)
+		case scheme(t.URL) == SchemeFile:
+			ps.Addf(prefix+"connect_to", "does not apply to file URLs")
+		case t.ResolveAll:
+			ps.Addf(prefix+"connect_to", "cannot be used with resolve_all")
+		case t.Protocol == ProtocolH3:
+			ps.Addf(prefix+"connect_to", "cannot be used with protocol h3, which dials on its own")
+		}
+	}
+	s := scheme(t.URL)
+	if t.HostHeader != "" {
+		switch {
+		case s != "http" && s != "https":
+			ps.Addf(prefix+"host_header", "only applies to http(s) URLs")
+		case strings.ContainsAny(t.HostHeader, " /\t"):
+			ps.Addf(prefix+"host_header", "want host[:port], got %q", t.HostHeader)
+		}
+	}
+	if t.SNI != "" {
+		switch {
+		case s != "https":
+			ps.Addf(prefix+"sni", "only applies to https URLs")
+		case strings.ContainsAny(t.SNI, " /:\t"):
+			ps.Addf(prefix+"sni", "want a host name, got %q", t.SNI)
+		}
+	}
+}
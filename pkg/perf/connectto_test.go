@@ -0,0 +1,127 @@
+package perf
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// greeting is the Host and TLS server name a request came with.
+type greeting struct{ host, sni string }
+
+// greetedServer is a TLS server, its certificate good for example.com,
+// recording how each request greeted it.
+func greetedServer(t *testing.T) (*httptest.Server, func() []greeting) {
+	var mu sync.Mutex
+	var seen []greeting
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, greeting{r.Host, r.TLS.ServerName})
+		mu.Unlock()
+		w.Write(make([]byte, 1000))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []greeting {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]greeting(nil), seen...)
+	}
+}
+
+func TestConnectTo(t *testing.T) {
+	srv, seen := greetedServer(t)
+	origin := strings.TrimPrefix(srv.URL, "https://")
+	tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	tests := []struct {
+		name   string
+		target Target
+		want   greeting
+	}{
+		// The host_header names the certificate's host for the SNI too.
+		{"host_header", Target{URL: "https://www.public.example/", ConnectTo: origin, HostHeader: "example.com"}, greeting{"example.com", "example.com"}},
+		{"sni", Target{URL: "https://www.public.example/", ConnectTo: origin, SNI: "example.com"}, greeting{"www.public.example", "example.com"}},
+		{"both", Target{URL: "https://www.public.example/", ConnectTo: origin, HostHeader: "origin.internal:8443", SNI: "example.com"}, greeting{"origin.internal:8443", "example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(seen())
+			all := collect(New(Options{ProgressInterval: -1, TLSConfig: tlsConfig}).Test(context.Background(), tt.target))
+			last := all[len(all)-1]
+			if last.Error != nil {
+				t.Fatal(last.Error)
+			}
+			// The result keeps the URL and records where it went.
+			if last.URL != tt.target.URL || last.ConnectTo != origin || last.RemoteAddr != origin {
+				t.Errorf("result for %s via %s at %s", last.URL, last.ConnectTo, last.RemoteAddr)
+			}
+			if got := seen(); len(got) != before+1 || got[before] != tt.want {
+				t.Errorf("server saw %+v, want %+v", got[before:], tt.want)
+			}
+		})
+	}
+
+	// The certificate is checked against the name sent, which without an
+	// override is the URL's host.
+	all := collect(New(Options{ProgressInterval: -1, TLSConfig: tlsConfig}).Test(context.Background(), Target{URL: "https://www.public.example/", ConnectTo: origin}))
+	if last := all[len(all)-1]; last.ErrorKind != ErrorTLS || !strings.Contains(last.Error.Error(), "www.public.example") {
+		t.Errorf("certificate of another host: %s %v", last.ErrorKind, last.Error)
+	}
+	if tlsConfig.ServerName != "" {
+		t.Errorf("the shared TLS config was changed to %q", tlsConfig.ServerName)
+	}
+}
+
+func TestConnectToKept(t *testing.T) {
+	// Entries of one URL sent to different servers keep a client each. The
+	// test servers share a certificate, so one config trusts both.
+	east, eastSeen := greetedServer(t)
+	west, westSeen := greetedServer(t)
+	tlsConfig := east.Client().Transport.(*http.Transport).TLSClientConfig
+	targets := []Target{
+		{URL: "https://example.com/", ConnectTo: strings.TrimPrefix(east.URL, "https://")},
+		{URL: "https://example.com/", ConnectTo: strings.TrimPrefix(west.URL, "https://")},
+	}
+	tester := New(Options{ProgressInterval: -1, TLSConfig: tlsConfig})
+	for range 2 {
+		for s := range tester.Run(context.Background(), targets, 1) {
+			if s.Final() && s.Error != nil {
+				t.Fatal(s.Error)
+			}
+		}
+	}
+	if e, w := len(eastSeen()), len(westSeen()); e != 2 || w != 2 {
+		t.Errorf("east saw %d requests and west %d, want 2 each", e, w)
+	}
+}
+
+func TestURLAddr(t *testing.T) {
+	tests := []struct{ url, want string }{
+		{"https://example.com/a", "example.com:443"},
+		{"http://example.com/a", "example.com:80"},
+		{"http://example.com:8080/a", "example.com:8080"},
+		{"ftp://ftp.example.com/a", "ftp.example.com:21"},
+		{"https://[2001:db8::1]/a", "[2001:db8::1]:443"},
+		{"://bad", ""},
+	}
+	for _, tt := range tests {
+		if got := urlAddr(tt.url); got != tt.want {
+			t.Errorf("urlAddr(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+	for _, tt := range []struct {
+		target Target
+		want   string
+	}{
+		{Target{}, ""},
+		{Target{HostHeader: "example.com"}, "example.com"},
+		{Target{HostHeader: "example.com:8443"}, "example.com"},
+		{Target{HostHeader: "example.com", SNI: "cdn.example"}, "cdn.example"},
+	} {
+		if got := tt.target.serverName(); got != tt.want {
+			t.Errorf("serverName of %+v = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
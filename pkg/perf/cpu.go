@@ -0,0 +1,104 @@
+package perf
+
+import (
+	"cmp"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// defaultCPUThreshold is the share of one core the process may use during
+// a transfer before the transfer is flagged as possibly CPU-bound.
+const defaultCPUThreshold = 0.8
+
+// cpuMinWall is how long a transfer must last to be flagged: over less,
+// the CPU clock is too coarse to tell.
+const cpuMinWall = time.Second
+
+// CPUUsage is the CPU time the process used while a transfer ran, with
+// the garbage collector's pauses in that time. It covers the whole
+// process, so transfers running at once share it. Fraction is User and
+// System over the transfer's wall time, where 1 is one core kept busy.
+type CPUUsage struct {
+	User     time.Duration
+	System   time.Duration
+	GCPause  time.Duration
+	GCs      int64
+	Fraction float64
+}
+
+// resourceUsage is a reading of the process's CPU and GC totals.
+type resourceUsage struct {
+	user, system, gcPause time.Duration
+	gcs                   int64
+}
+
+// resourceReader reads the process's resource totals. A reader that
+// cannot reports false, and the transfer goes without CPU hints.
+type resourceReader interface {
+	read() (resourceUsage, bool)
+}
+
+// processResources reads the resources of this process.
+type processResources struct{}
+
+func (processResources) read() (resourceUsage, bool) {
+	user, system, ok := cpuTimes()
+	if !ok {
+		return resourceUsage{}, false
+	}
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+	return resourceUsage{user: user, system: system, gcPause: gc.PauseTotal, gcs: gc.NumGC}, true
+}
+
+// cpuSampler takes a reading when a transfer starts and compares the one
+// at its end with it. Two readings per transfer keep it cheap.
+type cpuSampler struct {
+	r         resourceReader
+	threshold float64
+	start     resourceUsage
+	at        time.Time
+}
+
+// cpuSampler starts sampling for a transfer, or returns nil with
+// sampling turned off.
+func (t *Tester) cpuSampler() *cpuSampler {
+	threshold := t.opts.CPUThreshold
+	if threshold < 0 {
+		return nil
+	}
+	r := t.resources
+	if r == nil {
+		r = processResources{}
+	}
+	start, ok := r.read()
+	if !ok {
+		return nil
+	}
+	return &cpuSampler{r: r, threshold: cmp.Or(threshold, defaultCPUThreshold), start: start, at: time.Now()}
+}
+
+// apply sets the CPU usage of s since the sampler started, and warns when
+// it is above the threshold.
+func (c *cpuSampler) apply(s *Stats, now time.Time) {
+	if c == nil {
+		return
+	}
+	end, ok := c.r.read()
+	wall := now.Sub(c.at)
+	if !ok || wall <= 0 {
+		return
+	}
+	u := &CPUUsage{
+		User:    end.user - c.start.user,
+		System:  end.system - c.start.system,
+		GCPause: end.gcPause - c.start.gcPause,
+		GCs:     end.gcs - c.start.gcs,
+	}
+	u.Fraction = float64(u.User+u.System) / float64(wall)
+	s.CPU = u
+	if wall >= cpuMinWall && u.Fraction >= c.threshold {
+		s.CPUWarning = fmt.Sprintf("measurement may be CPU-bound (%.0f%% CPU)", u.Fraction*100)
+	}
+}
@@ -0,0 +1,144 @@
+package perf
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResources hands out readings in turn, failing once they run out.
+type fakeResources struct {
+	mu       sync.Mutex
+	readings []resourceUsage
+}
+
+func (f *fakeResources) read() (resourceUsage, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.readings) == 0 {
+		return resourceUsage{}, false
+	}
+	r := f.readings[0]
+	f.readings = f.readings[1:]
+	return r, true
+}
+
+// busyResources reads as a process that has kept cores of CPU busy since
+// it was made.
+type busyResources struct {
+	since time.Time
+	cores float64
+}
+
+func (b busyResources) read() (resourceUsage, bool) {
+	return resourceUsage{user: time.Duration(b.cores * float64(time.Since(b.since)))}, true
+}
+
+func TestCPUSampler(t *testing.T) {
+	start := resourceUsage{user: 10 * time.Second, system: 5 * time.Second, gcPause: time.Millisecond, gcs: 4}
+	after := func(user, system time.Duration) resourceUsage {
+		return resourceUsage{user: start.user + user, system: start.system + system, gcPause: start.gcPause + 3*time.Millisecond, gcs: start.gcs + 2}
+	}
+	tests := []struct {
+		name      string
+		threshold float64
+		wall      time.Duration
+		end       resourceUsage
+		fraction  float64
+		warning   string
+	}{
+		{"idle", 0, 2 * time.Second, after(100*time.Millisecond, 100*time.Millisecond), 0.1, ""},
+		{"under the default", 0, 2 * time.Second, after(time.Second, 500*time.Millisecond), 0.75, ""},
+		{"at the default", 0, 2 * time.Second, after(time.Second, 600*time.Millisecond), 0.8, "measurement may be CPU-bound (80% CPU)"},
+		{"over the default", 0, 2 * time.Second, after(1200*time.Millisecond, 540*time.Millisecond), 0.87, "measurement may be CPU-bound (87% CPU)"},
+		{"past one core", 0, 2 * time.Second, after(2*time.Second, time.Second), 1.5, "measurement may be CPU-bound (150% CPU)"},
+		{"lower threshold", 0.5, 2 * time.Second, after(time.Second, 0), 0.5, "measurement may be CPU-bound (50% CPU)"},
+		{"higher threshold", 0.95, 2 * time.Second, after(time.Second, 800*time.Millisecond), 0.9, ""},
+		// Over less than a second the CPU clock is too coarse to warn on.
+		{"short", 0, 500 * time.Millisecond, after(500*time.Millisecond, 0), 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tester := New(Options{CPUThreshold: tt.threshold})
+			tester.resources = &fakeResources{readings: []resourceUsage{start, tt.end}}
+			c := tester.cpuSampler()
+			var s Stats
+			c.apply(&s, c.at.Add(tt.wall))
+			if s.CPU == nil {
+				t.Fatal("no CPU usage")
+			}
+			if !near(s.CPU.Fraction, tt.fraction) || s.CPUWarning != tt.warning {
+				t.Errorf("CPU %.2f warning %q, want %.2f %q", s.CPU.Fraction, s.CPUWarning, tt.fraction, tt.warning)
+			}
+			if s.CPU.User != tt.end.user-start.user || s.CPU.System != tt.end.system-start.system || s.CPU.GCPause != 3*time.Millisecond || s.CPU.GCs != 2 {
+				t.Errorf("usage %+v", s.CPU)
+			}
+		})
+	}
+}
+
+func TestCPUSamplerOff(t *testing.T) {
+	// A negative threshold turns sampling off without a reading.
+	tester := New(Options{CPUThreshold: -1})
+	fake := &fakeResources{readings: []resourceUsage{{}, {}}}
+	tester.resources = fake
+	c := tester.cpuSampler()
+	var s Stats
+	c.apply(&s, time.Now())
+	if c != nil || s.CPU != nil || len(fake.readings) != 2 {
+		t.Errorf("sampler %v set %+v after %d readings", c, s.CPU, 2-len(fake.readings))
+	}
+
+	// A reader that cannot read leaves the transfer without CPU hints.
+	tester = New(Options{})
+	tester.resources = &fakeResources{}
+	if c := tester.cpuSampler(); c != nil {
+		t.Error("sampler from a reader that cannot read")
+	}
+	tester.resources = &fakeResources{readings: []resourceUsage{{}}}
+	c = tester.cpuSampler()
+	c.apply(&s, c.at.Add(2*time.Second))
+	if s.CPU != nil || s.CPUWarning != "" {
+		t.Errorf("failed end reading set %+v %q", s.CPU, s.CPUWarning)
+	}
+}
+
+func TestCPUWarning(t *testing.T) {
+	// Eleven chunks 100ms apart last past the second a warning needs.
+	srv := payloadServer(t, 1000, 100*time.Millisecond)
+	for _, tt := range []struct {
+		cores float64
+		warn  bool
+	}{{1, true}, {0.1, false}} {
+		tester := New(Options{ProgressInterval: -1})
+		tester.resources = busyResources{since: time.Now(), cores: tt.cores}
+		all := collect(tester.Test(context.Background(), Target{URL: srv.URL + "/bytes/11000"}))
+		last := all[len(all)-1]
+		if last.Error != nil {
+			t.Fatal(last.Error)
+		}
+		if last.CPU == nil || (last.CPUWarning != "") != tt.warn {
+			t.Errorf("%v cores busy: CPU %+v warning %q", tt.cores, last.CPU, last.CPUWarning)
+		}
+	}
+
+	// The process's own readings are taken by default, and not at all with
+	// sampling off.
+	srv = payloadServer(t, 1000, 0)
+	for _, threshold := range []float64{0, -1} {
+		all := collect(New(Options{ProgressInterval: -1, CPUThreshold: threshold}).Test(context.Background(), Target{URL: srv.URL + "/bytes/1000"}))
+		last := all[len(all)-1]
+		if last.Error != nil {
+			t.Fatal(last.Error)
+		}
+		if (last.CPU != nil) != (threshold == 0 && cpuReadable()) {
+			t.Errorf("threshold %v: CPU %+v", threshold, last.CPU)
+		}
+	}
+}
+
+func cpuReadable() bool {
+	_, ok := processResources{}.read()
+	return ok
+}
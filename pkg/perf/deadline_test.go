@@ -0,0 +1,109 @@
+package perf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowServer sends the start of a body and then holds the response until
+// the client goes away, counting requests.
+func slowServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Length", "10000000")
+		w.Write(make([]byte, 1000))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(func() {
+		srv.CloseClientConnections()
+		srv.Close()
+	})
+	return srv, &requests
+}
+
+func TestRunDeadline(t *testing.T) {
+	srv, requests := slowServer(t)
+	targets := []Target{{URL: srv.URL + "/a"}, {URL: srv.URL + "/b"}, {URL: srv.URL + "/c", Method: MethodUpload, UploadSize: 1000}}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var finals []Stats
+	for s := range New(Options{ProgressInterval: -1}).Run(ctx, targets, 1) {
+		if s.Final() {
+			finals = append(finals, s)
+		}
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("run took %v past a 300ms deadline", took)
+	}
+	if len(finals) != 3 {
+		t.Fatalf("%d results, want one per target: %+v", len(finals), finals)
+	}
+	// The download in flight is stopped at the deadline, and the rest are
+	// skipped without a request.
+	if a := finals[0]; !errors.Is(a.Error, context.DeadlineExceeded) || a.SizeBytes < 1000 {
+		t.Errorf("in flight download %s with %d bytes (%v), want stopped at the deadline", a.Kind, a.SizeBytes, a.Error)
+	}
+	for _, s := range finals[1:] {
+		if s.Kind != KindSkipped || !s.Skipped || s.SkipReason != SkipOutOfTime {
+			t.Errorf("%s %s is %s (%q), want skipped out of run time", s.URL, s.Direction, s.Kind, s.SkipReason)
+		}
+	}
+	if finals[2].Direction != Upload {
+		t.Errorf("skipped upload has direction %s", finals[2].Direction)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d requests, want 1", n)
+	}
+	c := NewCollector()
+	for _, s := range finals {
+		c.Add(s)
+	}
+	if s := c.Summaries()[1]; s.Skipped != 1 || s.SkipReason != SkipOutOfTime || s.Runs != 0 {
+		t.Errorf("summary %+v, want one skipped", s)
+	}
+}
+
+func TestMinBudget(t *testing.T) {
+	srv := payloadServer(t, 1000, 0)
+	targets := []Target{{URL: srv.URL + "/bytes/1000"}, {URL: srv.URL + "/bytes/2000"}}
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		budget   time.Duration
+		skipped  int
+	}{
+		{"no deadline", 0, time.Hour, 0},
+		{"enough left", time.Minute, time.Second, 0},
+		{"too little left", time.Second, time.Minute, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+			skipped, done := 0, 0
+			for s := range New(Options{ProgressInterval: -1, MinBudget: tt.budget}).Run(ctx, targets, 1) {
+				switch s.Kind {
+				case KindSkipped:
+					skipped++
+				case KindFinal:
+					done++
+				}
+			}
+			if skipped != tt.skipped || done != len(targets)-tt.skipped {
+				t.Errorf("%d skipped and %d done, want %d skipped", skipped, done, tt.skipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Cache modes: CacheCold starts every download and upload without kept
+// connections or cached DNS answers, CacheWarm keeps both between passes.
+const (
+	CacheCold = "cold"
+	CacheWarm = "warm"
+)
+
+// coldResolver is r, or the Go resolver when it is nil, which asks the
+// servers in resolv.conf itself rather than going through a caching
+// system resolver.
+func coldResolver(r *net.Resolver) *net.Resolver {
+	if r != nil {
+		return r
+	}
+	return &net.Resolver{PreferGo: true}
+}
+
+// warmResolver looks up hosts like r, or the servers in resolv.conf when
+// it is nil, keeping every answer for its TTL.
+func warmResolver(r *net.Resolver) *net.Resolver {
+	dial := (&net.Dialer{}).DialContext
+	if r != nil && r.Dial != nil {
+		dial = r.Dial
+	}
+	cache := &dnsCache{answers: map[dnsmessage.Question]dnsAnswer{}}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &cachedConn{ctx: ctx, cache: cache, dial: func(ctx context.Context) (net.Conn, error) {
+				return dial(ctx, network, address)
+			}}, nil
+		},
+	}
+}
+
+// dnsCache holds DNS answers by question until their TTL runs out.
+type dnsCache struct {
+	mu      sync.Mutex
+	answers map[dnsmessage.Question]dnsAnswer
+}
+
+type dnsAnswer struct {
+	msg     []byte
+	expires time.Time
+}
+
+// get returns a copy of the answer to q if it has not expired.
+func (c *dnsCache) get(q dnsmessage.Question) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a, ok := c.answers[q]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(a.expires) {
+		delete(c.answers, q)
+		return nil, false
+	}
+	return bytes.Clone(a.msg), true
+}
+
+// put keeps msg, the answer to q, for the lowest TTL of its records. Failed
+// and truncated answers, and those without records, are not kept.
+func (c *dnsCache) put(q dnsmessage.Question, msg []byte) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || h.RCode != dnsmessage.RCodeSuccess || h.Truncated {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	ttl := -1
+	for {
+		rh, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return
+		}
+		if ttl < 0 || int(rh.TTL) < ttl {
+			ttl = int(rh.TTL)
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.answers[q] = dnsAnswer{msg: bytes.Clone(msg), expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+}
+
+// cachedConn answers the Go resolver's TCP-framed DNS queries from a
+// dnsCache, dialing the server for those it has no answer to.
+type cachedConn struct {
+	ctx      context.Context
+	cache    *dnsCache
+	dial     func(context.Context) (net.Conn, error)
+	conn     net.Conn
+	deadline time.Time
+	query    bytes.Buffer
+	answer   bytes.Reader
+}
+
+func (c *cachedConn) Write(b []byte) (int, error) {
+	c.query.Write(b)
+	for c.query.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.query.Bytes()))
+		if c.query.Len() < 2+size {
+			break
+		}
+		msg := make([]byte, 2+size)
+		c.query.Read(msg)
+		answer, err := c.exchange(msg[2:])
+		if err != nil {
+			return 0, err
+		}
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(answer)))
+		c.answer.Reset(append(framed, answer...))
+	}
+	return len(b), nil
+}
+
+// exchange answers msg from the cache, or from the server, keeping its
+// answer.
+func (c *cachedConn) exchange(msg []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, fmt.Errorf("resolver: %w", err)
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, fmt.Errorf("resolver: %w", err)
+	}
+	if answer, ok := c.cache.get(q); ok {
+		binary.BigEndian.PutUint16(answer, h.ID)
+		return answer, nil
+	}
+	answer, err := c.ask(msg)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.put(q, answer)
+	return answer, nil
+}
+
+// ask sends msg to the server, framed for a stream connection and as it is
+// for a datagram one.
+func (c *cachedConn) ask(msg []byte) ([]byte, error) {
+	if c.conn == nil {
+		conn, err := c.dial(c.ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(c.deadline)
+		c.conn = conn
+	}
+	if _, ok := c.conn.(net.PacketConn); ok {
+		if _, err := c.conn.Write(msg); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := c.conn.Read(buf)
+		return buf[:n], err
+	}
+	if _, err := c.conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(msg)))); err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(size[:]))
+	_, err := io.ReadFull(c.conn, answer)
+	return answer, err
+}
+
+func (c *cachedConn) Read(b []byte) (int, error) {
+	if c.answer.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.answer.Read(b)
+}
+
+func (c *cachedConn) Close() error {
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+func (c *cachedConn) LocalAddr() net.Addr  { return cacheAddr{} }
+func (c *cachedConn) RemoteAddr() net.Addr { return cacheAddr{} }
+
+func (c *cachedConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	if c.conn != nil {
+		return c.conn.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c *cachedConn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *cachedConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+type cacheAddr struct{}
+
+func (cacheAddr) Network() string { return "dns-cache" }
+func (cacheAddr) String() string  { return "dns-cache" }
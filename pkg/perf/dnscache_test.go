@@ -0,0 +1,149 @@
+package perf
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCacheModes(t *testing.T) {
+	var dials atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	tests := []struct {
+		mode    string
+		dials   int32
+		lookups int
+		reused  bool
+	}{
+		{"", 1, 1, true},
+		{CacheWarm, 1, 1, true},
+		// Cold passes dial afresh and look the host up each time.
+		{CacheCold, 2, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run("mode "+tt.mode, func(t *testing.T) {
+			dials.Store(0)
+			stub := newDNSStub(t)
+			resolver, err := NewResolver(stub.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tester := New(Options{ProgressInterval: -1, Resolver: resolver, CacheMode: tt.mode})
+			var finals []Stats
+			for range 2 {
+				for s := range tester.Run(context.Background(), []Target{{URL: "http://speed.example.test:" + port + "/", IPVersion: "4"}}, 1) {
+					if s.CacheMode != tt.mode {
+						t.Errorf("%s result in mode %q", s.Kind, s.CacheMode)
+					}
+					if s.Final() {
+						finals = append(finals, s)
+					}
+				}
+			}
+			if finals[0].Error != nil || finals[1].Error != nil {
+				t.Fatal(finals[0].Error, finals[1].Error)
+			}
+			stub.mu.Lock()
+			lookups := len(stub.names)
+			stub.mu.Unlock()
+			if n := dials.Load(); n != tt.dials || lookups != tt.lookups || finals[0].Reused || finals[1].Reused != tt.reused {
+				t.Errorf("%d dials, %d lookups, second pass reused %v; want %d, %d, %v", n, lookups, finals[1].Reused, tt.dials, tt.lookups, tt.reused)
+			}
+		})
+	}
+}
+
+func TestWarmResolver(t *testing.T) {
+	stub := newDNSStub(t)
+	resolver, err := NewResolver(stub.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	warm := warmResolver(resolver)
+	asked := func() int {
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+		return len(stub.names)
+	}
+	// Answers are kept for their TTL, whichever connection asks.
+	for range 3 {
+		addrs, err := warm.LookupIP(context.Background(), "ip4", "mirror.example")
+		if err != nil || len(addrs) != 1 || !addrs[0].Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Fatalf("looked up %v, %v", addrs, err)
+		}
+	}
+	if n := asked(); n != 1 {
+		t.Errorf("server asked %d times, want once", n)
+	}
+	stub.answerWith("10.0.0.7")
+	if addrs, _ := warm.LookupIP(context.Background(), "ip4", "other.example"); len(addrs) != 1 || addrs[0].String() != "10.0.0.7" || asked() != 2 {
+		t.Errorf("another name looked up as %v after %d questions", addrs, asked())
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("mirror.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	answer := func(rcode dnsmessage.RCode, ttls ...uint32) []byte {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, RCode: rcode})
+		b.StartQuestions()
+		b.Question(q)
+		b.StartAnswers()
+		for _, ttl := range ttls {
+			b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl}, dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+		}
+		msg, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	tests := []struct {
+		name string
+		msg  []byte
+		ttl  time.Duration
+	}{
+		{"lowest ttl", answer(dnsmessage.RCodeSuccess, 300, 60), time.Minute},
+		{"no records", answer(dnsmessage.RCodeSuccess), 0},
+		{"zero ttl", answer(dnsmessage.RCodeSuccess, 0), 0},
+		{"failed", answer(dnsmessage.RCodeNameError, 60), 0},
+		{"garbled", []byte{1, 2, 3}, 0},
+	}
+	for _, tt := range tests {
+		c := &dnsCache{answers: map[dnsmessage.Question]dnsAnswer{}}
+		c.put(q, tt.msg)
+		a, kept := c.answers[q]
+		if kept != (tt.ttl > 0) || kept && time.Until(a.expires).Round(time.Second) != tt.ttl {
+			t.Errorf("%s: kept %v until %v", tt.name, kept, a.expires)
+		}
+	}
+
+	// An expired answer is dropped on the next look.
+	c := &dnsCache{answers: map[dnsmessage.Question]dnsAnswer{q: {msg: []byte{1}, expires: time.Now().Add(-time.Second)}}}
+	if _, ok := c.get(q); ok || len(c.answers) != 0 {
+		t.Error("expired answer served")
+	}
+	// Answers are handed out as copies, whose ID the caller rewrites.
+	c.put(q, answer(dnsmessage.RCodeSuccess, 60))
+	got, _ := c.get(q)
+	got[0] = 0xff
+	if again, _ := c.get(q); again[0] == 0xff {
+		t.Error("cached answer changed through a copy")
+	}
+}
@@ -0,0 +1,104 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Address families of dualstack_compare copies, as Stats.Family gives them.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// families returns a copy of target forced over IPv4 and one over IPv6,
+// named after the family. A copy whose family the host has no address in
+// is skipped when run; when neither has one, target itself is returned
+// carrying the lookup error.
+func (t *Tester) families(ctx context.Context, target Target) []Target {
+	var copies []Target
+	var errs []error
+	for _, family := range []string{FamilyIPv4, FamilyIPv6} {
+		c := target
+		c.family, c.IPVersion = family, strings.TrimPrefix(family, "ipv")
+		c.Name = fmt.Sprintf("%s over %s", Stats{URL: target.URL, Name: target.Name}.DisplayName(), familyName(family))
+		if _, err := t.lookupAll(ctx, c); err != nil {
+			c.skipReason = "no " + familyName(family) + " address"
+			errs = append(errs, err)
+			t.log().Debug("skipping address family", "url", target.URL, "family", family, "err", err)
+		}
+		copies = append(copies, c)
+	}
+	if len(errs) == len(copies) {
+		target.resolveErr = fmt.Errorf("dualstack_compare: %w", errs[0])
+		return []Target{target}
+	}
+	return copies
+}
+
+// familyName spells a family as "IPv4" or "IPv6".
+func familyName(family string) string {
+	return "IPv" + strings.TrimPrefix(family, "ipv")
+}
+
+// FamilyComparison sets the IPv4 and IPv6 results of a dualstack_compare
+// URL side by side.
+type FamilyComparison struct {
+	URL       string    `json:"url"`
+	Name      string    `json:"name,omitempty"`
+	Direction Direction `json:"direction"`
+	// IPv4Mbps and IPv6Mbps are the mean speeds over each family, zero for
+	// a family with no completed run.
+	IPv4Mbps float64 `json:"ipv4_mbps"`
+	IPv6Mbps float64 `json:"ipv6_mbps"`
+	// Faster is the family that was faster, empty when either has no
+	// completed run, and DeltaPercent how much faster it was than the
+	// other.
+	Faster       string  `json:"faster,omitempty"`
+	DeltaPercent float64 `json:"delta_percent,omitempty"`
+}
+
+// CompareFamilies pairs up the summaries of dualstack_compare copies, in
+// the order the URLs first appear.
+func CompareFamilies(summaries []Summary) []FamilyComparison {
+	var comparisons []FamilyComparison
+	index := map[summaryKey]int{}
+	for _, s := range summaries {
+		if s.Family == "" {
+			continue
+		}
+		key := summaryKey{url: s.URL, direction: s.Direction}
+		i, ok := index[key]
+		if !ok {
+			i = len(comparisons)
+			index[key] = i
+			name := strings.TrimSuffix(s.Name, " over "+familyName(s.Family))
+			if name == s.URL {
+				name = ""
+			}
+			comparisons = append(comparisons, FamilyComparison{URL: s.URL, Name: name, Direction: s.Direction})
+		}
+		c := &comparisons[i]
+		if s.Runs > 0 {
+			if s.Family == FamilyIPv4 {
+				c.IPv4Mbps = s.MeanMbps
+			} else {
+				c.IPv6Mbps = s.MeanMbps
+			}
+		}
+	}
+	for i := range comparisons {
+		c := &comparisons[i]
+		if c.IPv4Mbps <= 0 || c.IPv6Mbps <= 0 {
+			continue
+		}
+		fast, slow := c.IPv6Mbps, c.IPv4Mbps
+		c.Faster = FamilyIPv6
+		if c.IPv4Mbps > c.IPv6Mbps {
+			fast, slow, c.Faster = c.IPv4Mbps, c.IPv6Mbps, FamilyIPv4
+		}
+		c.DeltaPercent = (fast - slow) / slow * 100
+	}
+	return comparisons
+}
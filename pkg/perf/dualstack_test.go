@@ -0,0 +1,159 @@
+package perf
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dualstackServer listens on 127.0.0.1 and ::1 at the same port, serving
+// 40kB, slower over IPv6. It counts requests by the family they came in
+// over.
+func dualstackServer(t *testing.T) (port string, hits func() map[string]int) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	counts := map[string]int{}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		local := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+		family := FamilyIPv6
+		if local.IP.To4() != nil {
+			family = FamilyIPv4
+		}
+		mu.Lock()
+		counts[family]++
+		mu.Unlock()
+		w.Header().Set("Content-Length", "40000")
+		for range 4 {
+			w.Write(make([]byte, 10000))
+			w.(http.Flusher).Flush()
+			if family == FamilyIPv6 {
+				time.Sleep(30 * time.Millisecond)
+			}
+		}
+	}))
+	srv.Listener.Close()
+	srv.Listener = ln
+	srv.Start()
+	t.Cleanup(srv.Close)
+	_, port, _ = net.SplitHostPort(ln.Addr().String())
+	return port, func() map[string]int {
+		mu.Lock()
+		defer mu.Unlock()
+		return counts
+	}
+}
+
+func TestDualstackCompare(t *testing.T) {
+	port, hits := dualstackServer(t)
+	dns := newDNSStub(t)
+	dns.answerWith("127.0.0.1", "::1")
+	resolver, err := NewResolver(dns.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tester := New(Options{ProgressInterval: -1, Resolver: resolver})
+	url := "http://mirror.example:" + port + "/file"
+
+	for _, concurrency := range []int{1, 2} {
+		c := NewCollector()
+		var finals []Stats
+		for s := range tester.Run(context.Background(), []Target{{URL: url, Name: "mirror", DualstackCompare: true}}, concurrency) {
+			if s.Final() {
+				finals = append(finals, s)
+			}
+			c.Add(s)
+		}
+		if len(finals) != 2 {
+			t.Fatalf("concurrency %d: %d results, want one per family", concurrency, len(finals))
+		}
+		byFamily := map[string]Stats{}
+		for _, s := range finals {
+			byFamily[s.Family] = s
+		}
+		for family, ip := range map[string]string{FamilyIPv4: "127.0.0.1", FamilyIPv6: "::1"} {
+			s := byFamily[family]
+			if want := map[string]int{FamilyIPv4: 4, FamilyIPv6: 6}[family]; s.IPVersion != want {
+				t.Errorf("concurrency %d: %s result connected over IPv%d", concurrency, family, s.IPVersion)
+			}
+			// The second round reuses the connection, and looks nothing up.
+			if s.Error != nil || s.URL != url || s.Name != "mirror over "+familyName(family) || (!s.Reused && s.ResolvedIP != ip) || s.SizeBytes != 40000 {
+				t.Errorf("concurrency %d: %s result %q at %s, %d bytes (%v)", concurrency, family, s.Name, s.ResolvedIP, s.SizeBytes, s.Error)
+			}
+		}
+		summaries := c.Summaries()
+		if len(summaries) != 2 || summaries[0].Family != FamilyIPv4 || summaries[1].Family != FamilyIPv6 {
+			t.Errorf("concurrency %d: summaries %+v", concurrency, summaries)
+		}
+		cmp := CompareFamilies(summaries)
+		if len(cmp) != 1 || cmp[0].Name != "mirror" || cmp[0].Faster != FamilyIPv4 || cmp[0].DeltaPercent <= 0 {
+			t.Errorf("concurrency %d: comparison %+v", concurrency, cmp)
+		}
+	}
+	if got := hits(); got[FamilyIPv4] != 2 || got[FamilyIPv6] != 2 {
+		t.Errorf("requests by family %v, want two over each", got)
+	}
+
+	// A host with one family tests that one and skips the other.
+	dns.answerWith("127.0.0.1")
+	var finals []Stats
+	for s := range tester.Run(context.Background(), []Target{{URL: url, DualstackCompare: true}}, 1) {
+		if s.Final() {
+			finals = append(finals, s)
+		}
+	}
+	if len(finals) != 2 || finals[0].Error != nil || finals[0].Family != FamilyIPv4 {
+		t.Fatalf("IPv4 only host: %+v", finals)
+	}
+	if s := finals[1]; s.Kind != KindSkipped || s.Family != FamilyIPv6 || s.SkipReason != "no IPv6 address" {
+		t.Errorf("IPv6 side of an IPv4 only host is %s %q, family %q", s.Kind, s.SkipReason, s.Family)
+	}
+}
+
+func TestDualstackNoAddress(t *testing.T) {
+	// The stub has gone, so neither family resolves.
+	dns := newDNSStub(t)
+	resolver, err := NewResolver(dns.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	all := collect(New(Options{ProgressInterval: -1, Resolver: resolver}).Run(ctx, []Target{{URL: "http://mirror.example/", DualstackCompare: true}}, 1))
+	last := all[len(all)-1]
+	if len(all) != 1 || last.Error == nil || !strings.HasPrefix(last.Error.Error(), "dualstack_compare: ") {
+		t.Errorf("%d results, last %s: %v", len(all), last.Kind, last.Error)
+	}
+}
+
+func TestCompareFamilies(t *testing.T) {
+	summaries := []Summary{
+		{URL: "a", Name: "mirror over IPv4", Family: FamilyIPv4, Direction: Download, Runs: 1, MeanMbps: 80},
+		{URL: "a", Name: "mirror over IPv6", Family: FamilyIPv6, Direction: Download, Runs: 1, MeanMbps: 100},
+		{URL: "b", Direction: Download, Runs: 1, MeanMbps: 5},
+		// Unnamed targets are named after the URL, which is left out.
+		{URL: "c", Name: "c over IPv4", Family: FamilyIPv4, Direction: Upload, Runs: 2, MeanMbps: 10},
+		{URL: "c", Name: "c over IPv6", Family: FamilyIPv6, Direction: Upload, Skipped: 1},
+	}
+	want := []FamilyComparison{
+		{URL: "a", Name: "mirror", Direction: Download, IPv4Mbps: 80, IPv6Mbps: 100, Faster: FamilyIPv6, DeltaPercent: 25},
+		{URL: "c", Direction: Upload, IPv4Mbps: 10},
+	}
+	got := CompareFamilies(summaries)
+	if len(got) != len(want) {
+		t.Fatalf("CompareFamilies = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("comparison %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package perf
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// emitter delivers the snapshots of a single transfer, stamped with the
+// Tester's run metadata and the target's name and group.
+type emitter struct {
+	ctx         context.Context
+	ch          chan Stats
+	began       time.Time
+	opts        *Options
+	name, group string
+	sinks       []string
+	pinnedIP    string
+	connectTo   string
+	sweepSize   int64
+	bidiPhase   string
+	// sampleOffset, offsetSamples and sampleNote describe an offset
+	// sample.
+	sampleOffset  int64
+	offsetSamples int
+	sampleNote    string
+	family        string
+	queueWait     time.Duration
+	userAgent     string
+	// timer, when set, times the request whose deadline interrupt reports
+	// the phase of.
+	timer *phaseTimer
+	// template and shown are the configured and shown URL of a target
+	// whose URL was expanded from a template.
+	template, shown string
+}
+
+func (t *Tester) newEmitter(ctx context.Context, target Target) *emitter {
+	return &emitter{ctx: ctx, ch: make(chan Stats, 1), began: time.Now(), opts: &t.opts, name: target.Name, group: target.Group, sinks: target.Sinks, pinnedIP: target.pinnedIP, connectTo: target.ConnectTo, sweepSize: target.sweepSize, bidiPhase: target.bidiPhase, sampleOffset: target.sampleOffset, offsetSamples: target.offsetSamples, sampleNote: target.sampleNote, family: target.family, queueWait: target.queueWait, userAgent: target.userAgent(), template: target.template, shown: target.shown}
+}
+
+func (e *emitter) stamp(stats *Stats) {
+	stats.RunID, stats.Host, stats.Labels = e.opts.RunID, e.opts.Host, e.opts.Labels
+	stats.Timestamp, stats.RunOffset = e.opts.Clock.Now(), time.Since(e.opts.RunStart)
+	stats.Name, stats.Group, stats.PinnedIP, stats.Family = e.name, e.group, e.pinnedIP, e.family
+	stats.Sinks = e.sinks
+	stats.QueueWait, stats.UserAgent, stats.ConnectTo = e.queueWait, e.userAgent, e.connectTo
+	stats.CacheMode, stats.SweepSize, stats.BidiPhase = e.opts.CacheMode, e.sweepSize, e.bidiPhase
+	stats.SampleOffset, stats.OffsetSamples, stats.SampleNote = e.sampleOffset, e.offsetSamples, e.sampleNote
+	classify(stats)
+	stats.Utilization = e.opts.LinkCapacity.Utilization(stats.Direction, stats.SpeedMbps)
+	if e.template != "" {
+		stats.URL, stats.ExpandedURL = e.template, e.shown
+	}
+	stats.Kind = stats.kind()
+}
+
+// classify sets the ErrorKind of stats, and the TimeoutPhase of a phase
+// timeout.
+func classify(stats *Stats) {
+	stats.ErrorKind = Classify(stats.Error)
+	var phaseErr *PhaseTimeoutError
+	if errors.As(stats.Error, &phaseErr) {
+		stats.TimeoutPhase = phaseErr.Phase
+	}
+}
+
+// send gives up once ctx is cancelled so an abandoned channel never strands
+// the producer.
+func (e *emitter) send(stats Stats) bool {
+	e.stamp(&stats)
+	select {
+	case e.ch <- stats:
+		return true
+	case <-e.ctx.Done():
+		return false
+	}
+}
+
+// finish delivers the last snapshot of a transfer. Unlike send it is never
+// dropped once ctx is done: a tick still unread gives way to it.
+func (e *emitter) finish(stats Stats) {
+	e.stamp(&stats)
+	deliver(e.ctx, e.ch, stats)
+}
+
+// progress sends a progress snapshot, or drops it when progress snapshots
+// are off. Either way it reports false once ctx is cancelled.
+func (e *emitter) progress(stats Stats) bool {
+	if e.opts.ProgressInterval < 0 {
+		return e.ctx.Err() == nil
+	}
+	return e.send(stats)
+}
+
+// interrupt delivers the partial result without blocking: any tick still
+// sitting unread in the buffer is replaced, so the send always fits.
+func (e *emitter) interrupt(stats Stats, transferred int64, start time.Time) {
+	e.stamp(&stats)
+	stats.SizeBytes, stats.Error, stats.Cancelled = transferred, e.ctx.Err(), true
+	if errors.Is(e.ctx.Err(), context.DeadlineExceeded) {
+		stats.Error = fmt.Errorf("timed out after %v: %w", time.Since(e.began).Round(time.Millisecond), e.ctx.Err())
+		if e.timer != nil {
+			deadline, _ := e.ctx.Deadline()
+			stats.Error = &PhaseTimeoutError{Phase: e.timer.phase(), Budget: deadline.Sub(e.began).Round(time.Millisecond), Err: e.ctx.Err()}
+		}
+		stats.Cancelled = false
+	}
+	if !start.IsZero() {
+		stats.setSpeed(transferred, time.Since(start))
+	}
+	classify(&stats)
+	stats.Kind = stats.kind()
+	select {
+	case <-e.ch:
+	default:
+	}
+	e.ch <- stats
+}
+
+// errNoResult stands in for the result of a transfer that ended without
+// one.
+var errNoResult = errors.New("transfer ended without a result")
+
+// terminate forwards the snapshots of in, setting their Kind and holding
+// them to exactly one terminal snapshot: any after the first are dropped,
+// and when in closes without one an error or cancellation is made up.
+// Once ctx is done, progress is dropped and, like interrupt, the terminal
+// snapshot replaces one still unread, so it is always delivered.
+func (t *Tester) terminate(ctx context.Context, target Target, in <-chan Stats) <-chan Stats {
+	out := make(chan Stats, 1)
+	go func() {
+		defer close(out)
+		ended := false
+		for s := range in {
+			s.Kind = s.kind()
+			switch {
+			case ended:
+				t.log().Debug("dropping a snapshot after the terminal one", "url", s.URL, "kind", s.Kind)
+			case s.Kind.Terminal():
+				ended = true
+				deliver(ctx, out, s)
+			default:
+				select {
+				case out <- s:
+				case <-ctx.Done():
+				}
+			}
+		}
+		if !ended {
+			s := Stats{URL: target.URL, Direction: target.Direction(), Error: cmp.Or(ctx.Err(), errNoResult)}
+			s.Cancelled = errors.Is(ctx.Err(), context.Canceled)
+			t.newEmitter(ctx, target).stamp(&s)
+			deliver(ctx, out, s)
+		}
+	}()
+	return out
+}
+
+// deliver sends s on out. Once ctx is done it empties out's buffer of one
+// first, so the send never blocks out's only writer.
+func deliver(ctx context.Context, out chan Stats, s Stats) {
+	select {
+	case out <- s:
+		return
+	case <-ctx.Done():
+	}
+	select {
+	case <-out:
+	default:
+	}
+	out <- s
+}
+
+// ticker paces the progress of a transfer of target at ProgressInterval,
+// or every second when progress is off or the interval unset, ticking
+// finely through the window of its ramp.
+func (t *Tester) ticker(target Target) *progressTicker {
+	every := time.Second
+	if t.opts.ProgressInterval > 0 {
+		every = t.opts.ProgressInterval
+	}
+	p := &progressTicker{every: every}
+	if r := target.Ramp; r != nil {
+		p.fine, p.window = cmp.Or(r.Resolution, defaultRampResolution), cmp.Or(r.Window, defaultRampWindow)
+		p.began = time.Now()
+		p.next = p.began.Add(every)
+		p.Ticker = time.NewTicker(p.fine)
+		return p
+	}
+	p.Ticker = time.NewTicker(every)
+	return p
+}
+
+func progress(base Stats, m *meter, transferred, lastTransferred int64, start, lastTick, now time.Time) Stats {
+	stats := base
+	m.apply(&stats, transferred, start, now)
+	stats.IntervalBytes = transferred - lastTransferred
+	stats.IntervalSpeedMbps = float64(stats.IntervalBytes*8) / 1e6 / now.Sub(lastTick).Seconds()
+	m.stall.observe(stats.IntervalBytes, now.Sub(lastTick))
+	stats.Stalled = m.stall.stalled()
+	if m.sampledAt.IsZero() {
+		m.sampledN, m.sampledAt = lastTransferred, lastTick
+	}
+	m.sample(transferred, now)
+	return stats
+}
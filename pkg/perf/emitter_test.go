@@ -0,0 +1,182 @@
+package perf
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestProgressIntervals(t *testing.T) {
+	// Bytes arriving each second: bursts with idle seconds between them.
+	bursts := []int64{1e6, 0, 2e6, 0, 0, 5e5}
+	m := New(Options{}).newMeter(Target{})
+	start := time.Unix(1e9, 0)
+	var transferred, last int64
+	lastTick := start
+	for i, n := range bursts {
+		transferred += n
+		now := start.Add(time.Duration(i+1) * time.Second)
+		s := progress(Stats{}, m, transferred, last, start, lastTick, now)
+		if s.IntervalBytes != n {
+			t.Errorf("second %d: interval bytes = %d, want %d", i+1, s.IntervalBytes, n)
+		}
+		if want := float64(n*8) / 1e6; !near(s.IntervalSpeedMbps, want) {
+			t.Errorf("second %d: interval speed = %.3f Mbps, want %.3f", i+1, s.IntervalSpeedMbps, want)
+		}
+		if want := float64(transferred*8) / 1e6 / float64(i+1); !near(s.SpeedMbps, want) {
+			t.Errorf("second %d: average speed = %.3f Mbps, want %.3f", i+1, s.SpeedMbps, want)
+		}
+		last, lastTick = transferred, now
+	}
+}
+
+func TestProgressIntervalLength(t *testing.T) {
+	// The interval speed divides by the time since the last tick, whatever
+	// its length.
+	m := New(Options{}).newMeter(Target{})
+	start := time.Unix(1e9, 0)
+	for _, every := range []time.Duration{250 * time.Millisecond, 5 * time.Second} {
+		now := start.Add(every)
+		s := progress(Stats{}, m, 1e6, 0, start, start, now)
+		if want := 8 / every.Seconds(); !near(s.IntervalSpeedMbps, want) {
+			t.Errorf("%v interval: %.3f Mbps, want %.3f", every, s.IntervalSpeedMbps, want)
+		}
+	}
+}
+
+func TestProgressInterval(t *testing.T) {
+	// 10KB every 20ms is 4 Mbps, for 600ms.
+	srv := payloadServer(t, 10000, 20*time.Millisecond)
+	url := srv.URL + "/bytes/300000"
+	tests := []struct {
+		name     string
+		interval time.Duration
+		min, max int
+	}{
+		{"250ms", 250 * time.Millisecond, 2, 3},
+		{"5s", 5 * time.Second, 0, 0},
+		{"disabled", -1, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			all := collect(New(Options{ProgressInterval: tt.interval}).Test(context.Background(), Target{URL: url}))
+			final, ticks := all[len(all)-1], all[:len(all)-1]
+			if final.Kind != KindFinal || final.SizeBytes != 300000 {
+				t.Fatalf("final %s of %d bytes", final.Kind, final.SizeBytes)
+			}
+			if len(ticks) < tt.min || len(ticks) > tt.max {
+				t.Fatalf("%d progress snapshots, want %d to %d", len(ticks), tt.min, tt.max)
+			}
+			for i, s := range ticks {
+				if s.Kind != KindProgress {
+					t.Errorf("snapshot %d is %s", i, s.Kind)
+				}
+				// Each tick covers a quarter second at 4 Mbps.
+				if s.IntervalBytes < 70000 || s.IntervalBytes > 130000 || s.IntervalSpeedMbps < 2.5 || s.IntervalSpeedMbps > 5 {
+					t.Errorf("tick %d: %d bytes at %.2f Mbps, want about 100000 at 4 Mbps", i, s.IntervalBytes, s.IntervalSpeedMbps)
+				}
+			}
+		})
+	}
+
+	// With progress off, a reader that waits does not hold up the
+	// transfer.
+	ch := New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: url})
+	time.Sleep(1500 * time.Millisecond)
+	all := collect(ch)
+	if len(all) != 1 || all[0].Elapsed > time.Second {
+		t.Errorf("%d snapshots, the transfer took %v behind a late reader", len(all), all[0].Elapsed)
+	}
+}
+
+func near(got, want float64) bool {
+	return math.Abs(got-want) <= 1e-9*max(1, math.Abs(want))
+}
+
+func TestExactlyOneTerminalSnapshot(t *testing.T) {
+	srv := payloadServer(t, 16<<10, 5*time.Millisecond)
+	slow := srv.URL + "/bytes/1000000000"
+	tests := []struct {
+		name   string
+		opts   Options
+		url    string
+		cancel time.Duration
+		want   Kind
+		// partial wants the bytes read before the transfer was cut off.
+		partial bool
+	}{
+		{name: "success", url: srv.URL + "/bytes/100000", want: KindFinal},
+		{name: "error", url: srv.URL + "/status/500", want: KindError},
+		{name: "retried error", opts: Options{Retries: 2, RetryBackoff: time.Millisecond}, url: srv.URL + "/status/503", want: KindError},
+		{name: "timeout", opts: Options{Timeout: 50 * time.Millisecond}, url: slow, want: KindError, partial: true},
+		{name: "timeout with retries", opts: Options{Timeout: 50 * time.Millisecond, Retries: 2}, url: slow, want: KindError, partial: true},
+		{name: "cancelled", url: slow, cancel: 50 * time.Millisecond, want: KindCancelled, partial: true},
+		{name: "cancelled with retries", opts: Options{Retries: 2}, url: slow, cancel: 50 * time.Millisecond, want: KindCancelled, partial: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.ProgressInterval = 5 * time.Millisecond
+			tester := New(tt.opts)
+			// A terminal snapshot lost to a race shows up now and then, so
+			// each case runs a few times.
+			for range 5 {
+				ctx, cancel := context.WithCancel(context.Background())
+				if tt.cancel > 0 {
+					time.AfterFunc(tt.cancel, cancel)
+				}
+				all := collect(tester.Test(ctx, Target{URL: tt.url}))
+				cancel()
+				var terminal []Stats
+				for _, s := range all {
+					if s.Kind.Terminal() {
+						terminal = append(terminal, s)
+					}
+				}
+				if len(terminal) != 1 || !all[len(all)-1].Kind.Terminal() {
+					t.Fatalf("got %d terminal snapshots of %d, want one, last", len(terminal), len(all))
+				}
+				last := terminal[0]
+				if last.Kind != tt.want || errors.Is(last.Error, errNoResult) {
+					t.Fatalf("kind = %q, error %v, want %q", last.Kind, last.Error, tt.want)
+				}
+				if tt.partial && last.SizeBytes == 0 {
+					t.Fatalf("%s result lost the bytes read", last.Kind)
+				}
+			}
+		})
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	tester := New(Options{})
+	target := Target{URL: "http://example.com/"}
+	tests := []struct {
+		name string
+		in   []Stats
+		want []Kind
+	}{
+		{"one", []Stats{{}, {Done: true}}, []Kind{KindProgress, KindFinal}},
+		{"extra after the terminal one", []Stats{{Done: true}, {Error: errNoResult}, {}}, []Kind{KindFinal}},
+		{"none", []Stats{{}, {}}, []Kind{KindProgress, KindProgress, KindError}},
+		{"retried", []Stats{{Retrying: true, Error: errNoResult}, {Done: true}}, []Kind{KindRetry, KindFinal}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := make(chan Stats, len(tt.in))
+			for _, s := range tt.in {
+				in <- s
+			}
+			close(in)
+			var got []Kind
+			for s := range tester.terminate(context.Background(), target, in) {
+				got = append(got, s.Kind)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("kinds = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
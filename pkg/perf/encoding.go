@@ -0,0 +1,48 @@
+package perf
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// EncodingIdentity is the ContentEncoding of a body sent as is.
+const EncodingIdentity = "identity"
+
+// EncodingError reports a compressed body sent to a target with
+// normalize_encoding, whose byte counts would not compare with identity
+// runs.
+type EncodingError struct {
+	Encoding string
+}
+
+func (e *EncodingError) Error() string {
+	return fmt.Sprintf("server sent a %s body despite Accept-Encoding: identity", e.Encoding)
+}
+
+// contentEncoding is the encoding resp's body came with. Go's transport
+// drops the Content-Encoding header of a gzip body it decompresses on the
+// fly and sets Uncompressed instead, which only happens with a caller's
+// Client, since the default transport never asks for gzip itself.
+func contentEncoding(resp *http.Response) string {
+	if resp.Uncompressed {
+		return "gzip"
+	}
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" {
+		return EncodingIdentity
+	}
+	return encoding
+}
+
+// checkEncoding fails a response that is not identity-encoded when the
+// target normalizes encodings.
+func (t Target) checkEncoding(resp *http.Response) error {
+	if t.NormalizeEncoding == nil || !*t.NormalizeEncoding {
+		return nil
+	}
+	if encoding := contentEncoding(resp); encoding != EncodingIdentity {
+		return &EncodingError{Encoding: encoding}
+	}
+	return nil
+}
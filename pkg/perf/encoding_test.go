@@ -0,0 +1,131 @@
+package perf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flipServer serves body gzipped to every other request whatever it was
+// asked for, as a mirror whose edge nodes disagree would, ranges included.
+func flipServer(t *testing.T, body []byte) *httptest.Server {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(body)
+	zw.Close()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1)%2 == 0 {
+			w.Header().Set("Content-Encoding", "gzip")
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(gz.Bytes()))
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestContentEncoding(t *testing.T) {
+	tests := []struct {
+		resp http.Response
+		want string
+	}{
+		{http.Response{Header: http.Header{}}, EncodingIdentity},
+		{http.Response{Header: http.Header{"Content-Encoding": {" GZIP "}}}, "gzip"},
+		{http.Response{Header: http.Header{"Content-Encoding": {"br"}}}, "br"},
+		{http.Response{Header: http.Header{}, Uncompressed: true}, "gzip"},
+	}
+	for _, tt := range tests {
+		if got := contentEncoding(&tt.resp); got != tt.want {
+			t.Errorf("contentEncoding(%v, uncompressed %v) = %q, want %q", tt.resp.Header, tt.resp.Uncompressed, got, tt.want)
+		}
+	}
+
+	// A client left to ask for gzip itself decodes the body on the fly and
+	// drops the header, leaving only Uncompressed to tell.
+	srv := flipServer(t, bytes.Repeat([]byte("yaperf "), 1000))
+	for _, want := range []string{EncodingIdentity, "gzip"} {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := contentEncoding(resp); got != want || resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("got %q with Content-Encoding %q, want %q", got, resp.Header.Get("Content-Encoding"), want)
+		}
+	}
+}
+
+func TestNormalizeEncoding(t *testing.T) {
+	body := bytes.Repeat([]byte("yaperf "), 20000)
+	on, off := true, false
+	run := func(opts Options, target Target) []Stats {
+		srv := flipServer(t, body)
+		opts.ProgressInterval = -1
+		tester := New(opts)
+		target.URL = srv.URL
+		var finals []Stats
+		for range 2 {
+			all := collect(tester.Test(context.Background(), target))
+			finals = append(finals, all[len(all)-1])
+		}
+		return finals
+	}
+
+	// Without it the encoding is recorded, and the byte counts differ.
+	finals := run(Options{}, Target{})
+	if finals[0].Error != nil || finals[1].Error != nil {
+		t.Fatal(finals[0].Error, finals[1].Error)
+	}
+	if finals[0].ContentEncoding != EncodingIdentity || finals[1].ContentEncoding != "gzip" || finals[1].SizeBytes >= finals[0].SizeBytes {
+		t.Errorf("recorded %q of %d bytes and %q of %d", finals[0].ContentEncoding, finals[0].SizeBytes, finals[1].ContentEncoding, finals[1].SizeBytes)
+	}
+
+	// With it the compressed run fails, set globally or on the target;
+	// compression: accept asks for identity.
+	for _, tt := range []struct {
+		name   string
+		opts   Options
+		target Target
+	}{
+		{"global", Options{NormalizeEncoding: true}, Target{}},
+		{"target", Options{}, Target{NormalizeEncoding: &on}},
+		{"over accept", Options{NormalizeEncoding: true, Compression: CompressionAccept}, Target{}},
+	} {
+		finals := run(tt.opts, tt.target)
+		if err := finals[0].Error; err != nil || finals[0].ContentEncoding != EncodingIdentity {
+			t.Errorf("%s: identity run %q, %v", tt.name, finals[0].ContentEncoding, err)
+		}
+		var encErr *EncodingError
+		err := finals[1].Error
+		if !errors.As(err, &encErr) || encErr.Encoding != "gzip" || finals[1].ErrorKind != ErrorEncoding {
+			t.Errorf("%s: gzip run failed with %v (%s)", tt.name, err, finals[1].ErrorKind)
+		}
+		if err != nil && err.Error() != "server sent a gzip body despite Accept-Encoding: identity" {
+			t.Errorf("%s: error %q", tt.name, err)
+		}
+	}
+
+	// Several streams fail on the range probe already.
+	gzipped := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+	defer gzipped.Close()
+	all := collect(New(Options{ProgressInterval: -1, NormalizeEncoding: true}).Test(context.Background(), Target{URL: gzipped.URL, Streams: 2}))
+	if last := all[len(all)-1]; last.ErrorKind != ErrorEncoding {
+		t.Errorf("streams: %v (%s)", last.Error, last.ErrorKind)
+	}
+
+	// A target can turn the global setting off.
+	if finals := run(Options{NormalizeEncoding: true}, Target{NormalizeEncoding: &off}); finals[1].Error != nil {
+		t.Errorf("normalize_encoding off: %v", finals[1].Error)
+	}
+}
@@ -0,0 +1,98 @@
+package perf
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+)
+
+// ErrorKind groups failures by where they happened.
+type ErrorKind string
+
+const (
+	ErrorDNS        ErrorKind = "dns"
+	ErrorConnect    ErrorKind = "connect"
+	ErrorTLS        ErrorKind = "tls"
+	ErrorTimeout    ErrorKind = "timeout"
+	ErrorHTTPStatus ErrorKind = "http_status"
+	ErrorChecksum   ErrorKind = "checksum"
+	ErrorCorrupt    ErrorKind = "corrupt"
+	ErrorStall      ErrorKind = "stall"
+	ErrorSlow       ErrorKind = "slow"
+	ErrorResume     ErrorKind = "resume"
+	ErrorEncoding   ErrorKind = "encoding"
+	ErrorIntercept  ErrorKind = "interception_suspected"
+	ErrorRead       ErrorKind = "read"
+	ErrorCancelled  ErrorKind = "cancelled"
+)
+
+// Classify returns the kind of err, or "" when err is nil. It looks through
+// wrapped errors, so the *url.Error the HTTP client returns is classified by
+// its cause. Anything not recognised happened while transferring and counts
+// as a read error.
+func Classify(err error) ErrorKind {
+	var (
+		dnsErr       *net.DNSError
+		statusErr    *StatusError
+		checksumErr  *ChecksumError
+		patternErr   *PatternError
+		stallErr     *StallError
+		slowErr      *SlowError
+		resumeErr    *ResumeError
+		encodingErr  *EncodingError
+		interceptErr *InterceptionError
+		phaseErr     *PhaseTimeoutError
+		opErr        *net.OpError
+		netErr       net.Error
+	)
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return ErrorCancelled
+	case errors.As(err, &statusErr):
+		return ErrorHTTPStatus
+	case errors.As(err, &checksumErr):
+		return ErrorChecksum
+	case errors.As(err, &patternErr):
+		return ErrorCorrupt
+	case errors.As(err, &stallErr):
+		return ErrorStall
+	case errors.As(err, &slowErr):
+		return ErrorSlow
+	case errors.As(err, &resumeErr):
+		return ErrorResume
+	case errors.As(err, &encodingErr):
+		return ErrorEncoding
+	case errors.As(err, &interceptErr):
+		return ErrorIntercept
+	case errors.As(err, &phaseErr):
+		return ErrorTimeout
+	case errors.As(err, &dnsErr):
+		return ErrorDNS
+	case isTLS(err):
+		return ErrorTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	case errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect"):
+		return ErrorConnect
+	}
+	return ErrorRead
+}
+
+func isTLS(err error) bool {
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		unknownErr   x509.UnknownAuthorityError
+		hostErr      x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+		echRejectErr *tls.ECHRejectionError
+	)
+	return errors.As(err, &verifyErr) || errors.As(err, &recordErr) || errors.As(err, &alertErr) ||
+		errors.As(err, &unknownErr) || errors.As(err, &hostErr) || errors.As(err, &invalidErr) ||
+		errors.As(err, &echRejectErr)
+}
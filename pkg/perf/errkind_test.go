@@ -0,0 +1,77 @@
+package perf
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	// get wraps err the way the HTTP client does.
+	get := func(err error) error { return &url.Error{Op: "Get", URL: "https://example.com/", Err: err} }
+	dial := func(err error) error { return &net.OpError{Op: "dial", Net: "tcp", Err: err} }
+	tests := []struct {
+		name string
+		err  error
+		want ErrorKind
+	}{
+		{"nil", nil, ""},
+		{"dns", get(dial(&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true})), ErrorDNS},
+		{"dns timeout", get(dial(&net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true})), ErrorDNS},
+		{"refused", get(dial(&os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED})), ErrorConnect},
+		{"proxy", get(&net.OpError{Op: "proxyconnect", Net: "tcp", Err: syscall.ECONNREFUSED}), ErrorConnect},
+		{"tls", get(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}), ErrorTLS},
+		{"x509 hostname", get(x509.HostnameError{Certificate: &x509.Certificate{}, Host: "example.com"}), ErrorTLS},
+		{"deadline", fmt.Errorf("reading body: %w", context.DeadlineExceeded), ErrorTimeout},
+		{"phase timeout", &PhaseTimeoutError{Phase: PhaseHeaders, Err: context.DeadlineExceeded}, ErrorTimeout},
+		{"net timeout", get(&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}), ErrorTimeout},
+		{"cancelled", get(context.Canceled), ErrorCancelled},
+		{"cancelled past a deadline", errors.Join(context.Canceled, context.DeadlineExceeded), ErrorCancelled},
+		{"status", fmt.Errorf("fetching: %w", &StatusError{Code: 503, Status: "503 Service Unavailable"}), ErrorHTTPStatus},
+		{"checksum", &ChecksumError{Algorithm: "sha256"}, ErrorChecksum},
+		{"encoding", &EncodingError{Encoding: "gzip"}, ErrorEncoding},
+		{"interception", fmt.Errorf("stream 1: %w", &InterceptionError{Reason: "got text/html, want image/"}), ErrorIntercept},
+		{"corrupt", fmt.Errorf("stream 2: %w", &PatternError{Offset: 10}), ErrorCorrupt},
+		{"reset", get(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}), ErrorRead},
+		{"unexpected EOF", fmt.Errorf("body: %w", errors.New("unexpected EOF")), ErrorRead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Classify(tt.err); got != tt.want {
+				t.Errorf("Classify(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyClientErrors(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := "http://" + ln.Addr().String() + "/"
+	ln.Close()
+	for _, tt := range []struct {
+		url  string
+		want ErrorKind
+	}{
+		{tlsServer.URL, ErrorTLS},
+		{closed, ErrorConnect},
+	} {
+		_, err := http.Get(tt.url)
+		if got := Classify(err); got != tt.want {
+			t.Errorf("GET %s: Classify(%v) = %q, want %q", tt.url, err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package perf
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Expect describes the body a URL should serve. A captive portal or a WAF
+// answering in its place serves a small page of its own instead, whose
+// speed would be meaningless.
+type Expect struct {
+	// ContentType is the media type, or a prefix of it such as "image/",
+	// the Content-Type of the response must have.
+	ContentType string   `yaml:"content_type"`
+	MinSize     ByteSize `yaml:"min_size"`
+}
+
+// InterceptionError reports a response that does not look like the body
+// its URL serves, so something on the path likely answered in its place.
+type InterceptionError struct {
+	Reason string
+}
+
+func (e *InterceptionError) Error() string {
+	return "interception suspected: " + e.Reason
+}
+
+// checkContentType fails resp when its Content-Type is not the one
+// expected of t.
+func (t Target) checkContentType(resp *http.Response) error {
+	if t.Expect == nil || t.Expect.ContentType == "" {
+		return nil
+	}
+	header := resp.Header.Get("Content-Type")
+	got, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		got = strings.ToLower(strings.TrimSpace(header))
+	}
+	if want := strings.ToLower(t.Expect.ContentType); !strings.HasPrefix(got, want) {
+		if got == "" {
+			got = "no content type"
+		}
+		return &InterceptionError{Reason: fmt.Sprintf("got %s, want %s", got, want)}
+	}
+	return nil
+}
+
+// checkSize fails a body of size bytes smaller than t expects.
+func (t Target) checkSize(size int64) error {
+	if t.Expect == nil || size >= int64(t.Expect.MinSize) {
+		return nil
+	}
+	return &InterceptionError{Reason: fmt.Sprintf("body is %d bytes, want at least %d", size, t.Expect.MinSize)}
+}
+
+// expectProblems adds the problems of an expect entry, with prefix naming
+// it.
+func (t Target) expectProblems(ps *Problems, prefix string) {
+	if s := scheme(t.URL); t.Direction() != Download || s != "http" && s != "https" {
+		ps.Addf(prefix+"expect", "only applies to http(s) downloads")
+	}
+	if t.Expect.ContentType == "" && t.Expect.MinSize == 0 {
+		ps.Addf(prefix+"expect", "needs a content_type or a min_size")
+	}
+	if t.Expect.MinSize < 0 {
+		ps.Addf(prefix+"expect.min_size", "must not be negative")
+	}
+}
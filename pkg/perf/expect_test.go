@@ -0,0 +1,97 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// portalServer answers /portal as a captive portal would, with a small
+// HTML page, and /file with 1MB the way the URL should.
+func portalServer(t *testing.T) *httptest.Server {
+	body := make([]byte, 1e6)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/portal":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<html><body>Please log in</body></html>"))
+		case "/chunked":
+			// Without a Content-Length the size is only known at the end.
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("tiny"))
+			w.(http.Flusher).Flush()
+		case "/untyped":
+			w.Header()["Content-Type"] = nil
+			w.Write(body)
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(body)
+		default:
+			w.Header().Set("Content-Type", "Application/Octet-Stream; name=file.bin")
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestExpect(t *testing.T) {
+	srv := portalServer(t)
+	octets := &Expect{ContentType: "application/octet-stream"}
+	tests := []struct {
+		name    string
+		path    string
+		expect  *Expect
+		streams int
+		err     string
+	}{
+		{"compliant", "/file", &Expect{ContentType: "application/octet-stream", MinSize: 1e6}, 0, ""},
+		{"portal page", "/portal", octets, 0, "interception suspected: got text/html, want application/octet-stream"},
+		{"portal size", "/portal", &Expect{MinSize: 10e6}, 0, "interception suspected: body is 39 bytes, want at least 10000000"},
+		{"prefix", "/image", &Expect{ContentType: "image/"}, 0, ""},
+		{"other prefix", "/image", &Expect{ContentType: "video/"}, 0, "interception suspected: got image/png, want video/"},
+		{"no content type", "/untyped", octets, 0, "interception suspected: got no content type, want application/octet-stream"},
+		{"size at the end", "/chunked", &Expect{MinSize: 1000}, 0, "interception suspected: body is 4 bytes, want at least 1000"},
+		{"no expect", "/portal", nil, 0, ""},
+		// Streams check the range probe, by type and by the whole size.
+		{"streams", "/file", &Expect{ContentType: "application/octet-stream", MinSize: 1e6}, 2, ""},
+		{"streams portal", "/portal", octets, 2, "interception suspected: got text/html, want application/octet-stream"},
+		{"streams size", "/file", &Expect{MinSize: 2e6}, 2, "interception suspected: body is 1000000 bytes, want at least 2000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL + tt.path, Expect: tt.expect, Streams: tt.streams}))
+			last := all[len(all)-1]
+			if tt.err == "" {
+				if last.Error != nil || !last.Done {
+					t.Errorf("%s: %v", last.Kind, last.Error)
+				}
+				return
+			}
+			var intercept *InterceptionError
+			if last.Error == nil || last.Error.Error() != tt.err || !errors.As(last.Error, &intercept) || last.ErrorKind != ErrorIntercept {
+				t.Errorf("error %v (%s), want %q", last.Error, last.ErrorKind, tt.err)
+			}
+			// The page's speed is not reported as the URL's.
+			if last.Done || last.Kind != KindError || tt.path == "/portal" && last.SpeedMbps != 0 {
+				t.Errorf("intercepted result %s done %v at %.2f Mbps", last.Kind, last.Done, last.SpeedMbps)
+			}
+		})
+	}
+}
+
+func TestSummaryIntercepted(t *testing.T) {
+	c := NewCollector()
+	c.Add(Stats{Kind: KindFinal, URL: "/a", Direction: Download, Done: true, SizeBytes: 1e6, SpeedMbps: 80})
+	c.Add(Stats{Kind: KindError, URL: "/a", Direction: Download, Error: &InterceptionError{Reason: "got text/html, want application/octet-stream"}})
+	c.Add(Stats{Kind: KindError, URL: "/a", Direction: Download, Error: &InterceptionError{Reason: "body is 39 bytes, want at least 10000000"}})
+	c.Add(Stats{Kind: KindError, URL: "/a", Direction: Download, Error: errors.New("reset")})
+	s := c.Summaries()[0]
+	if s.Runs != 1 || s.Errors != 3 || s.Intercepted != 2 || s.Interception != "body is 39 bytes, want at least 10000000" || s.MeanMbps != 80 {
+		t.Errorf("summary %d runs, %d errors, %d intercepted (%q) at %.2f Mbps", s.Runs, s.Errors, s.Intercepted, s.Interception, s.MeanMbps)
+	}
+}
@@ -0,0 +1,216 @@
+package perf
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+)
+
+// Experiment arms.
+const (
+	ArmA = "a"
+	ArmB = "b"
+)
+
+// Experiment orders. Alternate runs A, B, A, B...; random runs every pair
+// of passes as A, B or B, A at random, so neither arm always goes first.
+const (
+	ExperimentAlternate = "alternate"
+	ExperimentRandom    = "random"
+)
+
+// defaultExperimentPasses is how many passes each arm gets by default.
+const defaultExperimentPasses = 10
+
+// significance is the p-value below which a difference is significant.
+const significance = 0.05
+
+// Experiment compares two sets of URLs by testing them in interleaved
+// passes, which controls for the time of day. Passes counts the passes of
+// each arm, 10 by default.
+type Experiment struct {
+	A      []Target `yaml:"a"`
+	B      []Target `yaml:"b"`
+	Passes int      `yaml:"passes"`
+	Order  string   `yaml:"order"`
+}
+
+// PassesPerArm is Passes with its default applied.
+func (e Experiment) PassesPerArm() int {
+	if e.Passes == 0 {
+		return defaultExperimentPasses
+	}
+	return e.Passes
+}
+
+// Schedule is the arm of every pass, in order, whose random choices follow
+// seed.
+func (e Experiment) Schedule(seed uint64) []string {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	arms := make([]string, 0, 2*e.PassesPerArm())
+	for range e.PassesPerArm() {
+		if e.Order == ExperimentRandom && rng.IntN(2) == 1 {
+			arms = append(arms, ArmB, ArmA)
+		} else {
+			arms = append(arms, ArmA, ArmB)
+		}
+	}
+	return arms
+}
+
+// Arm returns the targets of arm.
+func (e Experiment) Arm(arm string) []Target {
+	if arm == ArmB {
+		return e.B
+	}
+	return e.A
+}
+
+func checkExperimentOrder(order string) error {
+	switch order {
+	case "", ExperimentAlternate, ExperimentRandom:
+		return nil
+	}
+	return fmt.Errorf("order must be alternate or random, got %q", order)
+}
+
+// PassSpeed is the mean speed in megabits per second of the completed
+// transfers among a pass's final results, and false when none completed.
+func PassSpeed(finals []Stats) (float64, bool) {
+	var speeds []float64
+	for _, s := range finals {
+		if s.URL == TotalURL || s.Direction == Latency || !s.Done || s.Error != nil {
+			continue
+		}
+		speeds = append(speeds, s.SpeedMbps)
+	}
+	return mean(speeds), len(speeds) > 0
+}
+
+// ArmSummary describes the per-pass speeds of one arm.
+type ArmSummary struct {
+	Arm        string  `json:"arm"`
+	Passes     int     `json:"passes"`
+	MeanMbps   float64 `json:"mean_mbps"`
+	StddevMbps float64 `json:"stddev_mbps"`
+}
+
+// ExperimentResult compares the per-pass speeds of the arms with Welch's
+// t-test. DiffMbps and DiffPercent are B's mean less A's. P is two-sided;
+// it is 1 when either arm has fewer than two passes.
+type ExperimentResult struct {
+	A           ArmSummary `json:"a"`
+	B           ArmSummary `json:"b"`
+	DiffMbps    float64    `json:"diff_mbps"`
+	DiffPercent float64    `json:"diff_percent"`
+	T           float64    `json:"t"`
+	DF          float64    `json:"df"`
+	P           float64    `json:"p"`
+	Significant bool       `json:"significant"`
+}
+
+// Welch compares the per-pass speeds a and b.
+func Welch(a, b []float64) ExperimentResult {
+	r := ExperimentResult{
+		A:        armSummary(ArmA, a),
+		B:        armSummary(ArmB, b),
+		DiffMbps: mean(b) - mean(a),
+		P:        1,
+	}
+	if r.A.MeanMbps > 0 {
+		r.DiffPercent = r.DiffMbps / r.A.MeanMbps * 100
+	}
+	if len(a) < 2 || len(b) < 2 {
+		return r
+	}
+	qa, qb := variance(a)/float64(len(a)), variance(b)/float64(len(b))
+	se := math.Sqrt(qa + qb)
+	if se == 0 {
+		// Both arms are constant: any difference is certain.
+		if r.DiffMbps != 0 {
+			r.P, r.Significant = 0, true
+		}
+		return r
+	}
+	r.T = r.DiffMbps / se
+	r.DF = (qa + qb) * (qa + qb) / (qa*qa/float64(len(a)-1) + qb*qb/float64(len(b)-1))
+	r.P = incompleteBeta(r.DF/2, 0.5, r.DF/(r.DF+r.T*r.T))
+	r.Significant = r.P < significance
+	return r
+}
+
+func armSummary(arm string, speeds []float64) ArmSummary {
+	return ArmSummary{Arm: arm, Passes: len(speeds), MeanMbps: mean(speeds), StddevMbps: math.Sqrt(variance(speeds))}
+}
+
+// variance is the sample variance of values.
+func variance(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	m := mean(values)
+	var sum float64
+	for _, v := range values {
+		sum += (v - m) * (v - m)
+	}
+	return sum / float64(len(values)-1)
+}
+
+// incompleteBeta is the regularized incomplete beta function I_x(a, b),
+// evaluated by its continued fraction. The two-sided p-value of Student's
+// t with df degrees of freedom is I_{df/(df+t²)}(df/2, 1/2).
+func incompleteBeta(a, b, x float64) float64 {
+	switch {
+	case x <= 0:
+		return 0
+	case x >= 1:
+		return 1
+	}
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log(1-x))
+	// The continued fraction converges quickly below this point; above it
+	// the symmetry I_x(a, b) = 1 - I_{1-x}(b, a) is used.
+	if x < (a+1)/(a+b+2) {
+		return front * betaFraction(a, b, x) / a
+	}
+	return 1 - front*betaFraction(b, a, 1-x)/b
+}
+
+// betaFraction evaluates the continued fraction of the incomplete beta
+// function with the modified Lentz method.
+func betaFraction(a, b, x float64) float64 {
+	const (
+		tiny    = 1e-300
+		epsilon = 1e-14
+	)
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= 300; m++ {
+		fm := float64(m)
+		for _, num := range []float64{
+			fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm)),
+			-(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1)),
+		} {
+			d = 1 + num*d
+			if math.Abs(d) < tiny {
+				d = tiny
+			}
+			c = 1 + num/c
+			if math.Abs(c) < tiny {
+				c = tiny
+			}
+			d = 1 / d
+			h *= d * c
+		}
+		if math.Abs(d*c-1) < epsilon {
+			break
+		}
+	}
+	return h
+}
@@ -0,0 +1,118 @@
+package perf
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestWelch(t *testing.T) {
+	// Reference values from integrating Student's t density numerically.
+	tests := []struct {
+		name     string
+		a, b     []float64
+		t, df, p float64
+	}{
+		// Equal variances and sizes: t = 2 with 8 degrees of freedom.
+		{"equal variance", []float64{1, 2, 3, 4, 5}, []float64{3, 4, 5, 6, 7}, 2, 8, 0.0805162380},
+		{"equal variance t=1", []float64{1, 2, 3, 4, 5}, []float64{2, 3, 4, 5, 6}, 1, 8, 0.3465935071},
+		{"unequal variance", []float64{10, 12, 11, 14, 13}, []float64{20, 30, 25, 22, 28, 24}, 7.6770034330, 7.0010348988, 0.0001183829},
+		{"no real difference", []float64{100, 101, 99, 100.5}, []float64{100.2, 99.8, 100.9, 100.1}, 0.2570589332, 4.6382129677, 0.8081429231},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Welch(tt.a, tt.b)
+			if math.Abs(r.T-tt.t) > 1e-8 || math.Abs(r.DF-tt.df) > 1e-8 || math.Abs(r.P-tt.p) > 1e-8 {
+				t.Errorf("t %v, df %v, p %v, want %v, %v, %v", r.T, r.DF, r.P, tt.t, tt.df, tt.p)
+			}
+			if r.Significant != (tt.p < significance) {
+				t.Errorf("significant = %v at p %v", r.Significant, r.P)
+			}
+			// Swapping the arms flips t and keeps p.
+			swapped := Welch(tt.b, tt.a)
+			if !near(swapped.T, -r.T) || math.Abs(swapped.P-r.P) > 1e-12 {
+				t.Errorf("swapped: t %v, p %v", swapped.T, swapped.P)
+			}
+		})
+	}
+}
+
+func TestWelchSummaries(t *testing.T) {
+	r := Welch([]float64{90, 110}, []float64{120, 120, 120})
+	if r.A.Passes != 2 || r.A.MeanMbps != 100 || !near(r.A.StddevMbps, math.Sqrt(200)) || r.B.StddevMbps != 0 {
+		t.Errorf("arms %+v, %+v", r.A, r.B)
+	}
+	if r.DiffMbps != 20 || r.DiffPercent != 20 {
+		t.Errorf("diff %vMbps, %v%%, want 20 and 20", r.DiffMbps, r.DiffPercent)
+	}
+}
+
+func TestWelchDegenerate(t *testing.T) {
+	tests := []struct {
+		name        string
+		a, b        []float64
+		p           float64
+		significant bool
+	}{
+		{"zero variance, different means", []float64{50, 50, 50}, []float64{60, 60}, 0, true},
+		{"zero variance, same means", []float64{50, 50}, []float64{50, 50, 50}, 1, false},
+		{"one pass of A", []float64{50}, []float64{60, 61, 62}, 1, false},
+		{"one pass of B", []float64{50, 51}, []float64{60}, 1, false},
+		{"no passes", nil, nil, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Welch(tt.a, tt.b)
+			if r.P != tt.p || r.Significant != tt.significant || r.T != 0 || r.DF != 0 {
+				t.Errorf("p %v, significant %v, t %v, df %v, want p %v", r.P, r.Significant, r.T, r.DF, tt.p)
+			}
+			if math.IsNaN(r.DiffPercent) || math.IsInf(r.DiffPercent, 0) {
+				t.Errorf("diff %v%%", r.DiffPercent)
+			}
+		})
+	}
+}
+
+func TestIncompleteBeta(t *testing.T) {
+	tests := []struct {
+		a, b, x, want float64
+	}{
+		{1, 1, 0.3, 0.3},
+		{2, 2, 0.5, 0.5},
+		{5, 5, 0.5, 0.5},
+		// I_x(a, 1) = x^a and I_x(1, b) = 1 - (1-x)^b.
+		{3, 1, 0.4, 0.064},
+		{1, 4, 0.2, 1 - 0.4096},
+		{2, 3, 0, 0},
+		{2, 3, 1, 1},
+	}
+	for _, tt := range tests {
+		if got := incompleteBeta(tt.a, tt.b, tt.x); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("I_%v(%v, %v) = %v, want %v", tt.x, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestExperimentSchedule(t *testing.T) {
+	alternate := Experiment{Passes: 3}.Schedule(1)
+	if want := []string{ArmA, ArmB, ArmA, ArmB, ArmA, ArmB}; !slices.Equal(alternate, want) {
+		t.Errorf("alternate = %v, want %v", alternate, want)
+	}
+	random := Experiment{Order: ExperimentRandom}
+	first := random.Schedule(7)
+	if len(first) != 2*defaultExperimentPasses || !slices.Equal(random.Schedule(7), first) {
+		t.Fatalf("schedule %v is not %d passes that repeat for a seed", first, 2*defaultExperimentPasses)
+	}
+	flipped := 0
+	for i := 0; i < len(first); i += 2 {
+		if first[i] == first[i+1] {
+			t.Fatalf("pair %d of %v runs one arm twice", i/2, first)
+		}
+		if first[i] == ArmB {
+			flipped++
+		}
+	}
+	if flipped == 0 || flipped == defaultExperimentPasses {
+		t.Errorf("schedule %v never changes which arm goes first", first)
+	}
+}
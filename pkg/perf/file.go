@@ -0,0 +1,60 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+)
+
+// openFile reads the local file a file:// URL names, so that disks can be
+// measured like any other source. With direct_io on Linux the file is read
+// with O_DIRECT, bypassing the page cache.
+func (t *Tester) openFile(target Target) opener {
+	return func(ctx context.Context, _ *phaseTimer) (io.ReadCloser, int64, error) {
+		path, err := filePath(target.URL)
+		if err != nil {
+			return nil, 0, err
+		}
+		var f *os.File
+		if target.DirectIO {
+			f, err = openDirect(path)
+		} else {
+			f, err = os.Open(path)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		if !info.Mode().IsRegular() {
+			f.Close()
+			return nil, 0, fmt.Errorf("%s is not a regular file", path)
+		}
+		var body io.ReadCloser = f
+		if target.DirectIO {
+			body = newAlignedReader(f)
+		}
+		return body, info.Size(), nil
+	}
+}
+
+// filePath returns the path of a file:// URL, which may only name a host
+// of localhost.
+func filePath(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("file URL must be local, got host %q", u.Host)
+	}
+	if u.Path == "" {
+		return "", fmt.Errorf("missing path in %q", raw)
+	}
+	return u.Path, nil
+}
@@ -0,0 +1,56 @@
+package perf
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const directIOSupported = true
+
+// directAlign is the alignment O_DIRECT wants of buffers and read sizes,
+// which covers the logical block size of common disks.
+const directAlign = 4096
+
+func openDirect(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECT, 0)
+}
+
+// alignedReader reads an O_DIRECT file through a buffer aligned for it,
+// since the caller's buffer may be of any size and address.
+type alignedReader struct {
+	f        *os.File
+	buf      []byte
+	pos, end int
+}
+
+func newAlignedReader(f *os.File) *alignedReader {
+	const size = 1 << 20
+	raw := make([]byte, size+directAlign)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&raw[0])) % directAlign); rem != 0 {
+		off = directAlign - rem
+	}
+	return &alignedReader{f: f, buf: raw[off : off+size]}
+}
+
+func (r *alignedReader) Read(p []byte) (int, error) {
+	if r.pos == r.end {
+		n, err := r.f.Read(r.buf)
+		if n == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		r.pos, r.end = 0, n
+	}
+	n := copy(p, r.buf[r.pos:r.end])
+	r.pos += n
+	return n, nil
+}
+
+func (r *alignedReader) Close() error {
+	return r.f.Close()
+}
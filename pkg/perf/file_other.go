@@ -0,0 +1,19 @@
+//go:build !linux
+
+package perf
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+const directIOSupported = false
+
+func openDirect(string) (*os.File, error) {
+	return nil, errors.New("direct_io is only supported on Linux")
+}
+
+func newAlignedReader(f *os.File) io.ReadCloser {
+	return f
+}
@@ -0,0 +1,42 @@
+package perf
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultFloorGrace is the window min_speed_floor is averaged over when
+// floor_grace is unset.
+const defaultFloorGrace = 10 * time.Second
+
+// SlowError reports a transfer aborted by min_speed_floor: over the last
+// Over it averaged Mbps, below FloorMbps.
+type SlowError struct {
+	FloorMbps float64
+	Mbps      float64
+	Over      time.Duration
+}
+
+func (e *SlowError) Error() string {
+	return fmt.Sprintf("averaged %.2f Mbps over the last %v, below the %.2f Mbps floor", e.Mbps, e.Over.Round(time.Second), e.FloorMbps)
+}
+
+// floor watches the speed over the last grace of a transfer, like curl's
+// --speed-limit and --speed-time. Zero mbps turns it off.
+type floor struct {
+	mbps   float64
+	recent window
+}
+
+// aborted returns the error a transfer stops with once its speed over the
+// window has fallen below the floor, or nil. The window first has to fill,
+// which gives a transfer its grace period to ramp up.
+func (f *floor) aborted() error {
+	if f.mbps <= 0 {
+		return nil
+	}
+	if mbps, ok := f.recent.mbps(); ok && mbps < f.mbps {
+		return &SlowError{FloorMbps: f.mbps, Mbps: mbps, Over: f.recent.covered}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trickle reads size bytes, at most chunk a call and pausing before each.
+type trickle struct {
+	*bytes.Reader
+	chunk int
+	pause time.Duration
+}
+
+func (r *trickle) Read(p []byte) (int, error) {
+	time.Sleep(r.pause)
+	return r.Reader.Read(p[:min(len(p), r.chunk)])
+}
+
+// floorServer serves /fast, 4MB at full speed, and /trickle, 4MB at about
+// 40 kbps, both with byte ranges, and takes /upload-fast and
+// /upload-trickle the same ways.
+func floorServer(t *testing.T) *httptest.Server {
+	body := make([]byte, 4e6)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /fast", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	})
+	mux.HandleFunc("GET /trickle", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, &trickle{bytes.NewReader(body), 100, 20 * time.Millisecond})
+	})
+	mux.HandleFunc("POST /upload-fast", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	})
+	mux.HandleFunc("POST /upload-trickle", func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 100)
+		for {
+			if _, err := r.Body.Read(buf); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	// Close waits for running handlers, and a trickling upload would drain
+	// what the socket buffered first.
+	t.Cleanup(func() {
+		srv.CloseClientConnections()
+		srv.Close()
+	})
+	return srv
+}
+
+// trickleTCP listens for tcp:// downloads, sending 100 bytes every 20ms.
+func trickleTCP(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					if _, err := conn.Write(make([]byte, 100)); err != nil {
+						return
+					}
+					time.Sleep(20 * time.Millisecond)
+				}
+			}()
+		}
+	}()
+	return "tcp://" + ln.Addr().String() + "?bytes=4000000"
+}
+
+func TestSpeedFloor(t *testing.T) {
+	srv := floorServer(t)
+	tcp := trickleTCP(t)
+	tests := []struct {
+		name   string
+		target Target
+		slow   bool
+	}{
+		{"fast download", Target{URL: srv.URL + "/fast"}, false},
+		{"trickling download", Target{URL: srv.URL + "/trickle"}, true},
+		{"fast streams", Target{URL: srv.URL + "/fast", Streams: 4}, false},
+		{"trickling streams", Target{URL: srv.URL + "/trickle", Streams: 4}, true},
+		{"trickling tcp", Target{URL: tcp}, true},
+		{"fast upload", Target{URL: srv.URL + "/upload-fast", Method: MethodUpload, UploadSize: 4e6}, false},
+		{"trickling upload", Target{URL: srv.URL + "/upload-trickle", Method: MethodUpload, UploadSize: 64e6}, true},
+	}
+	tester := New(Options{MinSpeedFloor: 1e6, FloorGrace: 300 * time.Millisecond, ProgressInterval: 20 * time.Millisecond})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			began := time.Now()
+			var last Stats
+			for s := range tester.Test(ctx, tt.target) {
+				last = s
+			}
+			var slow *SlowError
+			switch {
+			case !tt.slow && (last.Error != nil || last.SlowAborted):
+				t.Fatalf("error %v, slow_aborted %v, want a full transfer", last.Error, last.SlowAborted)
+			case !tt.slow:
+				return
+			case !errors.As(last.Error, &slow) || !last.SlowAborted || last.ErrorKind != ErrorSlow:
+				t.Fatalf("error %v (%s), slow_aborted %v, want aborted below the floor", last.Error, last.ErrorKind, last.SlowAborted)
+			case time.Since(began) > 3*time.Second:
+				t.Errorf("aborted after %v, want soon after the 300ms grace", time.Since(began))
+			}
+			if !strings.Contains(last.Error.Error(), "below the 1.00 Mbps floor") {
+				t.Errorf("error %q", last.Error)
+			}
+		})
+	}
+}
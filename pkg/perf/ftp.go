@@ -0,0 +1,203 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// openFTP logs in to an ftp:// URL, anonymously unless it carries user
+// info, and RETRs its path in binary mode. The data connection is passive
+// unless target sets ftp_passive: false.
+func (t *Tester) openFTP(target Target) opener {
+	return func(ctx context.Context, timer *phaseTimer) (io.ReadCloser, int64, error) {
+		u, err := url.Parse(target.URL)
+		if err != nil {
+			return nil, 0, err
+		}
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "21")
+		}
+		conn, err := t.dialRaw(ctx, target, timer, addr)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Until the transfer starts a cancelled ctx unblocks the dialogue by
+		// closing the connection.
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		defer stop()
+
+		c := &ftpConn{conn: conn, text: textproto.NewConn(conn), dial: dialContext(target, t.opts.Resolver, t.opts.ConnectTimeout)}
+		body, size, err := c.retr(ctx, target, u)
+		if err != nil {
+			conn.Close()
+			return nil, 0, fmt.Errorf("ftp: %w", err)
+		}
+		// TTFB runs up to the server accepting the RETR.
+		timer.trace().GotFirstResponseByte()
+		return body, size, nil
+	}
+}
+
+type ftpConn struct {
+	conn net.Conn
+	text *textproto.Conn
+	// dial opens passive data connections.
+	dial dialFunc
+}
+
+// cmd sends a command and reads its reply, which must start with expect.
+func (c *ftpConn) cmd(expect int, format string, args ...any) (int, string, error) {
+	if _, err := c.text.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	return c.text.ReadResponse(expect)
+}
+
+func (c *ftpConn) retr(ctx context.Context, target Target, u *url.URL) (io.ReadCloser, int64, error) {
+	if _, _, err := c.text.ReadResponse(2); err != nil {
+		return nil, 0, err
+	}
+	user, pass := "anonymous", "anonymous@"
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			pass = p
+		}
+	}
+	code, _, err := c.cmd(0, "USER %s", user)
+	switch {
+	case err != nil:
+		return nil, 0, err
+	case code == 331:
+		if _, _, err := c.cmd(2, "PASS %s", pass); err != nil {
+			return nil, 0, err
+		}
+	case code/100 != 2:
+		return nil, 0, fmt.Errorf("USER: unexpected reply %d", code)
+	}
+	if _, _, err := c.cmd(2, "TYPE I"); err != nil {
+		return nil, 0, err
+	}
+	path := strings.TrimPrefix(u.Path, "/")
+	size := int64(-1)
+	if _, msg, err := c.cmd(213, "SIZE %s", path); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err == nil {
+			size = n
+		}
+	}
+
+	passive := target.FTPPassive == nil || *target.FTPPassive
+	var data net.Conn
+	var ln net.Listener
+	if passive {
+		if data, err = c.passive(ctx); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		if ln, err = c.active(); err != nil {
+			return nil, 0, err
+		}
+		defer ln.Close()
+	}
+	if _, _, err := c.cmd(1, "RETR %s", path); err != nil {
+		if data != nil {
+			data.Close()
+		}
+		return nil, 0, err
+	}
+	if ln != nil {
+		ln.(*net.TCPListener).SetDeadline(time.Now().Add(30 * time.Second))
+		if data, err = ln.Accept(); err != nil {
+			return nil, 0, fmt.Errorf("waiting for the data connection: %w", err)
+		}
+	}
+	return &ftpBody{data: data, c: c}, size, nil
+}
+
+// passive opens the data connection the server offers, with EPSV or, on
+// servers without it, PASV. EPSV reuses the control connection's host.
+func (c *ftpConn) passive(ctx context.Context) (net.Conn, error) {
+	if _, msg, err := c.cmd(229, "EPSV"); err == nil {
+		// 229 Entering Extended Passive Mode (|||port|)
+		_, port, _ := strings.Cut(msg, "(|||")
+		port, _, _ = strings.Cut(port, "|")
+		host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+		return c.dial(ctx, "tcp", net.JoinHostPort(host, port))
+	}
+	_, msg, err := c.cmd(227, "PASV")
+	if err != nil {
+		return nil, err
+	}
+	// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+	_, fields, _ := strings.Cut(msg, "(")
+	fields, _, _ = strings.Cut(fields, ")")
+	parts := strings.Split(fields, ",")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("PASV: cannot parse %q", msg)
+	}
+	p1, err1 := strconv.Atoi(parts[4])
+	p2, err2 := strconv.Atoi(parts[5])
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("PASV: cannot parse %q", msg)
+	}
+	addr := net.JoinHostPort(strings.Join(parts[:4], "."), strconv.Itoa(p1<<8|p2))
+	return c.dial(ctx, "tcp", addr)
+}
+
+// active listens on the control connection's local address and tells the
+// server to connect there, with PORT over IPv4 and EPRT over IPv6.
+func (c *ftpConn) active() (net.Listener, error) {
+	local := c.conn.LocalAddr().(*net.TCPAddr)
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: local.IP})
+	if err != nil {
+		return nil, err
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	if ip4 := local.IP.To4(); ip4 != nil {
+		_, _, err = c.cmd(2, "PORT %d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], port>>8, port&0xff)
+	} else {
+		_, _, err = c.cmd(2, "EPRT |2|%s|%d|", local.IP, port)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// ftpBody is the data connection of a RETR. At its end the server's final
+// reply decides whether the transfer succeeded.
+type ftpBody struct {
+	data  net.Conn
+	c     *ftpConn
+	close sync.Once
+}
+
+func (b *ftpBody) Read(p []byte) (int, error) {
+	n, err := b.data.Read(p)
+	if err == io.EOF {
+		if _, _, replyErr := b.c.text.ReadResponse(2); replyErr != nil {
+			return n, fmt.Errorf("ftp: %w", replyErr)
+		}
+	}
+	return n, err
+}
+
+func (b *ftpBody) Close() error {
+	b.close.Do(func() {
+		b.data.Close()
+		b.c.conn.SetDeadline(time.Now().Add(time.Second))
+		b.c.text.Cmd("QUIT")
+		b.c.conn.Close()
+	})
+	return nil
+}
@@ -0,0 +1,225 @@
+package perf
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ftpStub is an FTP server with one file, /file.bin, that records the
+// commands it is sent. With noEPSV set it only knows PASV.
+type ftpStub struct {
+	net.Listener
+	size   int
+	noEPSV bool
+	mu     sync.Mutex
+	cmds   []string
+}
+
+func newFTPStub(t *testing.T, size int, noEPSV bool) *ftpStub {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ftpStub{Listener: ln, size: size, noEPSV: noEPSV}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ftpStub) commands() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.Join(s.cmds, ", ")
+}
+
+func (s *ftpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...any) { fmt.Fprintf(conn, format+"\r\n", args...) }
+	reply("220 stub ready")
+	var pasv net.Listener
+	var active string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+		s.mu.Lock()
+		s.cmds = append(s.cmds, strings.TrimSpace(cmd+" "+arg))
+		s.mu.Unlock()
+		switch cmd {
+		case "USER":
+			reply("331 password please")
+		case "PASS":
+			reply("230 logged in")
+		case "TYPE":
+			reply("200 binary")
+		case "SIZE":
+			if arg != "file.bin" {
+				reply("550 no such file")
+				continue
+			}
+			reply("213 %d", s.size)
+		case "EPSV", "PASV":
+			if cmd == "EPSV" && s.noEPSV {
+				reply("502 not implemented")
+				continue
+			}
+			if pasv, err = net.Listen("tcp4", "127.0.0.1:0"); err != nil {
+				reply("425 %v", err)
+				continue
+			}
+			port := pasv.Addr().(*net.TCPAddr).Port
+			if cmd == "EPSV" {
+				reply("229 Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				reply("227 Entering Passive Mode (127,0,0,1,%d,%d)", port>>8, port&0xff)
+			}
+		case "PORT":
+			var h [4]int
+			var p1, p2 int
+			fmt.Sscanf(arg, "%d,%d,%d,%d,%d,%d", &h[0], &h[1], &h[2], &h[3], &p1, &p2)
+			active = fmt.Sprintf("%d.%d.%d.%d:%d", h[0], h[1], h[2], h[3], p1<<8|p2)
+			reply("200 port ok")
+		case "RETR":
+			if arg != "file.bin" {
+				reply("550 no such file")
+				continue
+			}
+			reply("150 sending")
+			var data net.Conn
+			if pasv != nil {
+				data, err = pasv.Accept()
+				pasv.Close()
+				pasv = nil
+			} else {
+				data, err = net.Dial("tcp", active)
+			}
+			if err != nil {
+				reply("425 %v", err)
+				continue
+			}
+			io.Copy(data, io.LimitReader(zeros{}, int64(s.size)))
+			data.Close()
+			reply("226 done")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestFTP(t *testing.T) {
+	off := false
+	tests := []struct {
+		name    string
+		noEPSV  bool
+		path    string
+		passive *bool
+		cmds    string
+		err     string
+	}{
+		{"passive", false, "anonymous@%s/file.bin", nil, "USER anonymous, PASS anonymous@, TYPE I, SIZE file.bin, EPSV, RETR file.bin, QUIT", ""},
+		{"pasv without epsv", true, "probe:secret@%s/file.bin", nil, "USER probe, PASS secret, TYPE I, SIZE file.bin, EPSV, PASV, RETR file.bin, QUIT", ""},
+		{"active", false, "%s/file.bin", &off, "USER anonymous, PASS anonymous@, TYPE I, SIZE file.bin, PORT 127,0,0,1", ""},
+		{"missing file", false, "%s/nope.bin", nil, "", `ftp: 550 "no such file"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newFTPStub(t, 300000, tt.noEPSV)
+			target := Target{URL: "ftp://" + fmt.Sprintf(tt.path, stub.Addr()), FTPPassive: tt.passive}
+			all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), target))
+			last := all[len(all)-1]
+			if tt.err != "" {
+				if last.Error == nil || last.Error.Error() != tt.err {
+					t.Errorf("err %v, want %q", last.Error, tt.err)
+				}
+				return
+			}
+			if last.Error != nil || last.SizeBytes != 300000 || last.ExpectedBytes != 300000 || last.Protocol != "FTP" {
+				t.Fatalf("read %d of %d bytes over %s, err %v", last.SizeBytes, last.ExpectedBytes, last.Protocol, last.Error)
+			}
+			if last.Direction != Download || last.SpeedMbps <= 0 || last.TTFB <= 0 {
+				t.Errorf("stats %+v", last)
+			}
+			// QUIT is sent as the body is closed, after the result.
+			deadline := time.Now().Add(time.Second)
+			for !strings.HasPrefix(stub.commands(), tt.cmds) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if !strings.HasPrefix(stub.commands(), tt.cmds) {
+				t.Errorf("commands %q, want %q", stub.commands(), tt.cmds)
+			}
+		})
+	}
+}
+
+func TestTCP(t *testing.T) {
+	// The listener sends size bytes and closes.
+	serve := func(size int64) string {
+		ln, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(conn, io.LimitReader(zeros{}, size))
+					conn.Close()
+				}()
+			}
+		}()
+		return ln.Addr().String()
+	}
+	tests := []struct {
+		name  string
+		size  int64
+		query string
+		bytes int64
+		err   bool
+	}{
+		{"bytes target", 10e6, "?bytes=1MB", 1e6, false},
+		{"until closed", 2e6, "", 2e6, false},
+		{"closed early", 1000, "?bytes=1MB", 1000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := serve(tt.size)
+			all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: "tcp://" + addr + tt.query}))
+			last := all[len(all)-1]
+			if (last.Error != nil) != tt.err || last.SizeBytes != tt.bytes || last.Protocol != "TCP" {
+				t.Errorf("read %d bytes over %s, err %v, want %d bytes and an error %v", last.SizeBytes, last.Protocol, last.Error, tt.bytes, tt.err)
+			}
+		})
+	}
+	if _, _, err := parseTCP("tcp://127.0.0.1"); err == nil || err.Error() != `tcp URL needs a port, got "tcp://127.0.0.1"` {
+		t.Errorf("no port: %v", err)
+	}
+	if _, _, err := parseTCP("tcp://127.0.0.1:5001?bytes=-1"); err == nil {
+		t.Error("accepted a negative size")
+	}
+}
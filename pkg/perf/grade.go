@@ -0,0 +1,166 @@
+package perf
+
+import (
+	"fmt"
+	"time"
+)
+
+// Grades are the latency grades, best first.
+var Grades = []string{"A", "B", "C", "D", "F"}
+
+// Default bounds of grades A to D: the idle median round trip, and how
+// much it may rise under load, as in Waveform's bufferbloat test.
+var (
+	defaultIdleGrades     = []time.Duration{20 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond}
+	defaultIncreaseGrades = []time.Duration{30 * time.Millisecond, 60 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}
+)
+
+// LatencyGrading sets the bounds of latency grades A to D, each the most a
+// round trip may be for that grade; above the last one it is an F.
+type LatencyGrading struct {
+	// Idle bounds the median round trip on an idle link, 20ms, 50ms, 100ms
+	// and 200ms by default.
+	Idle []time.Duration `yaml:"idle"`
+	// Increase bounds how much the median rises under load, 30ms, 60ms,
+	// 200ms and 400ms by default.
+	Increase []time.Duration `yaml:"increase"`
+}
+
+// problems adds the problems of g.
+func (g LatencyGrading) problems(ps *Problems) {
+	for _, bounds := range []struct {
+		key    string
+		bounds []time.Duration
+	}{{"latency_grading.idle", g.Idle}, {"latency_grading.increase", g.Increase}} {
+		if bounds.bounds == nil {
+			continue
+		}
+		if len(bounds.bounds) != len(Grades)-1 {
+			ps.Addf(bounds.key, "needs %d bounds, for grades A to D, got %d", len(Grades)-1, len(bounds.bounds))
+			continue
+		}
+		for i, d := range bounds.bounds {
+			switch {
+			case d <= 0:
+				ps.Addf(fmt.Sprintf("%s[%d]", bounds.key, i), "must be positive, got %v", d)
+			case i > 0 && d < bounds.bounds[i-1]:
+				ps.Addf(fmt.Sprintf("%s[%d]", bounds.key, i), "must not be below the bound of grade %s, %v", Grades[i-1], bounds.bounds[i-1])
+			}
+		}
+	}
+}
+
+// LatencyGrade grades how well round trips hold up under load along with
+// the measurements it was given, so it can be explained.
+type LatencyGrade struct {
+	Grade  string  `json:"grade"`
+	IdleMs float64 `json:"idle_ms"`
+	// DownloadIncreaseMs and UploadIncreaseMs are how much the median
+	// round trip rose under each load, when it was measured.
+	DownloadIncreaseMs *float64 `json:"download_increase_ms,omitempty"`
+	UploadIncreaseMs   *float64 `json:"upload_increase_ms,omitempty"`
+	// LimitedBy names the measurement the grade is from: idle, download or
+	// upload.
+	LimitedBy string `json:"limited_by"`
+}
+
+// GradeLatency grades idle, the median round trip on an idle link, and
+// increases, how much it rose under load in each direction measured,
+// against g. Each is graded on its own and the worst grade is the
+// result, the first of idle, download and upload to get it limiting it.
+// Increases below zero count as none.
+func GradeLatency(idle time.Duration, increases map[Direction]time.Duration, g LatencyGrading) LatencyGrade {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	grade := LatencyGrade{IdleMs: ms(idle), LimitedBy: "idle"}
+	worst := rank(idle, boundsOr(g.Idle, defaultIdleGrades))
+	for _, d := range []Direction{Download, Upload} {
+		increase, ok := increases[d]
+		if !ok {
+			continue
+		}
+		increase = max(increase, 0)
+		v := ms(increase)
+		if d == Download {
+			grade.DownloadIncreaseMs = &v
+		} else {
+			grade.UploadIncreaseMs = &v
+		}
+		if r := rank(increase, boundsOr(g.Increase, defaultIncreaseGrades)); r > worst {
+			worst, grade.LimitedBy = r, string(d)
+		}
+	}
+	grade.Grade = Grades[worst]
+	return grade
+}
+
+// rank is the index in Grades of the first bound d is within.
+func rank(d time.Duration, bounds []time.Duration) int {
+	for i, bound := range bounds {
+		if d <= bound {
+			return i
+		}
+	}
+	return len(Grades) - 1
+}
+
+// boundsOr is bounds, or defaults when none are set.
+func boundsOr(bounds, defaults []time.Duration) []time.Duration {
+	if len(bounds) == 0 {
+		return defaults
+	}
+	return bounds
+}
+
+// gradeOf grades the bufferbloat of a transfer in direction, or returns
+// nil when it has no idle or loaded probes.
+func gradeOf(b *Bufferbloat, direction Direction, g LatencyGrading) *LatencyGrade {
+	if b == nil || b.Idle.Probes == 0 || b.Loaded.Probes == 0 {
+		return nil
+	}
+	grade := GradeLatency(b.Idle.P50, map[Direction]time.Duration{direction: b.Loaded.P50 - b.Idle.P50}, g)
+	return &grade
+}
+
+// LatencyGrades grades each URL whose summaries hold bufferbloat probes,
+// in the order the URLs first appear. The idle round trip is the lowest
+// idle median among them, and each direction's increase the largest
+// measured under it.
+func LatencyGrades(summaries []Summary, g LatencyGrading) []URLGrade {
+	type inputs struct {
+		name      string
+		idle      time.Duration
+		increases map[Direction]time.Duration
+	}
+	var order []string
+	byURL := map[string]*inputs{}
+	for _, s := range summaries {
+		b := s.Bufferbloat
+		if b == nil || b.Idle.Probes == 0 || b.Loaded.Probes == 0 || s.Direction == Latency {
+			continue
+		}
+		in := byURL[s.URL]
+		if in == nil {
+			in = &inputs{name: s.Name, idle: b.Idle.P50, increases: map[Direction]time.Duration{}}
+			byURL[s.URL] = in
+			order = append(order, s.URL)
+		}
+		in.idle = min(in.idle, b.Idle.P50)
+		increase := b.Loaded.P50 - b.Idle.P50
+		if prev, ok := in.increases[s.Direction]; !ok || increase > prev {
+			in.increases[s.Direction] = increase
+		}
+	}
+	out := make([]URLGrade, len(order))
+	for i, url := range order {
+		in := byURL[url]
+		out[i] = URLGrade{URL: url, Name: in.name, LatencyGrade: GradeLatency(in.idle, in.increases, g)}
+	}
+	return out
+}
+
+// URLGrade is the latency grade of one URL.
+type URLGrade struct {
+	URL  string `json:"url"`
+	Name string `json:"name,omitempty"`
+	LatencyGrade
+}
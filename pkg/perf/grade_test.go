@@ -0,0 +1,143 @@
+package perf
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGradeLatencyBounds(t *testing.T) {
+	const ms = time.Millisecond
+	custom := LatencyGrading{Idle: []time.Duration{5 * ms, 10 * ms, 10 * ms, 40 * ms}, Increase: []time.Duration{1 * ms, 2 * ms, 3 * ms, 4 * ms}}
+	tests := []struct {
+		name    string
+		idle    time.Duration
+		down    *time.Duration
+		up      *time.Duration
+		grading LatencyGrading
+		want    string
+		limited string
+	}{
+		{"zero", 0, nil, nil, LatencyGrading{}, "A", "idle"},
+		{"idle at A", 20 * ms, nil, nil, LatencyGrading{}, "A", "idle"},
+		{"idle past A", 20*ms + 1, nil, nil, LatencyGrading{}, "B", "idle"},
+		{"idle at B", 50 * ms, nil, nil, LatencyGrading{}, "B", "idle"},
+		{"idle past B", 50*ms + 1, nil, nil, LatencyGrading{}, "C", "idle"},
+		{"idle at C", 100 * ms, nil, nil, LatencyGrading{}, "C", "idle"},
+		{"idle past C", 100*ms + 1, nil, nil, LatencyGrading{}, "D", "idle"},
+		{"idle at D", 200 * ms, nil, nil, LatencyGrading{}, "D", "idle"},
+		{"idle past D", 200*ms + 1, nil, nil, LatencyGrading{}, "F", "idle"},
+		{"increase at A", 0, ptr(30 * ms), nil, LatencyGrading{}, "A", "idle"},
+		{"increase past A", 0, ptr(30*ms + 1), nil, LatencyGrading{}, "B", "download"},
+		{"increase at B", 0, ptr(60 * ms), nil, LatencyGrading{}, "B", "download"},
+		{"increase past B", 0, ptr(60*ms + 1), nil, LatencyGrading{}, "C", "download"},
+		{"increase at C", 0, nil, ptr(200 * ms), LatencyGrading{}, "C", "upload"},
+		{"increase past C", 0, nil, ptr(200*ms + 1), LatencyGrading{}, "D", "upload"},
+		{"increase at D", 0, nil, ptr(400 * ms), LatencyGrading{}, "D", "upload"},
+		{"increase past D", 0, nil, ptr(400*ms + 1), LatencyGrading{}, "F", "upload"},
+		{"negative increase", 0, ptr(-time.Second), nil, LatencyGrading{}, "A", "idle"},
+		// The first of idle, download and upload to get the worst grade
+		// limits it.
+		{"idle ties download", 100 * ms, ptr(200 * ms), nil, LatencyGrading{}, "C", "idle"},
+		{"download ties upload", 0, ptr(200 * ms), ptr(150 * ms), LatencyGrading{}, "C", "download"},
+		{"upload worst", 60 * ms, ptr(50 * ms), ptr(500 * ms), LatencyGrading{}, "F", "upload"},
+		{"custom idle", 5*ms + 1, nil, nil, custom, "B", "idle"},
+		// Equal bounds leave the grade between them empty.
+		{"custom equal bounds", 10*ms + 1, nil, nil, custom, "D", "idle"},
+		{"custom increase", 0, ptr(4*ms + 1), nil, custom, "F", "download"},
+		{"idle only custom", 0, ptr(31 * ms), nil, LatencyGrading{Idle: custom.Idle}, "B", "download"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			increases := map[Direction]time.Duration{}
+			if tt.down != nil {
+				increases[Download] = *tt.down
+			}
+			if tt.up != nil {
+				increases[Upload] = *tt.up
+			}
+			got := GradeLatency(tt.idle, increases, tt.grading)
+			if got.Grade != tt.want || got.LimitedBy != tt.limited {
+				t.Errorf("grade %s limited by %s, want %s by %s", got.Grade, got.LimitedBy, tt.want, tt.limited)
+			}
+			if (got.DownloadIncreaseMs != nil) != (tt.down != nil) || (got.UploadIncreaseMs != nil) != (tt.up != nil) {
+				t.Errorf("increases %v %v, want only those measured", got.DownloadIncreaseMs, got.UploadIncreaseMs)
+			}
+			if tt.down != nil && *got.DownloadIncreaseMs < 0 {
+				t.Errorf("download increase %vms", *got.DownloadIncreaseMs)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestLatencyGradingProblems(t *testing.T) {
+	const ms = time.Millisecond
+	tests := []struct {
+		name    string
+		grading LatencyGrading
+		want    []string
+	}{
+		{"defaults", LatencyGrading{}, nil},
+		{"rising", LatencyGrading{Idle: []time.Duration{1, 2, 2, 3}}, nil},
+		{"too few", LatencyGrading{Idle: []time.Duration{ms, 2 * ms, 3 * ms}}, []string{"latency_grading.idle: needs 4 bounds, for grades A to D, got 3"}},
+		{"too many", LatencyGrading{Increase: []time.Duration{1, 2, 3, 4, 5}}, []string{"latency_grading.increase: needs 4 bounds, for grades A to D, got 5"}},
+		{"empty", LatencyGrading{Idle: []time.Duration{}}, []string{"latency_grading.idle: needs 4 bounds"}},
+		{"not positive", LatencyGrading{Increase: []time.Duration{0, ms, 2 * ms, 3 * ms}}, []string{"latency_grading.increase[0]: must be positive, got 0s"}},
+		{"falling", LatencyGrading{Idle: []time.Duration{ms, 3 * ms, 2 * ms, 4 * ms}}, []string{"latency_grading.idle[2]: must not be below the bound of grade B, 3ms"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ps Problems
+			tt.grading.problems(&ps)
+			if len(ps) != len(tt.want) {
+				t.Fatalf("problems %v, want %q", ps, tt.want)
+			}
+			for i, p := range ps {
+				if !strings.HasPrefix(p.Error(), tt.want[i]) {
+					t.Errorf("problem %q, want %q", p.Error(), tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLatencyGrades(t *testing.T) {
+	const ms = time.Millisecond
+	bloat := func(idle, loaded time.Duration) *Bufferbloat {
+		return &Bufferbloat{Idle: &LatencyStats{Probes: 5, P50: idle}, Loaded: &LatencyStats{Probes: 5, P50: loaded}}
+	}
+	summaries := []Summary{
+		{URL: "b", Name: "second", Direction: Download, Bufferbloat: bloat(30*ms, 50*ms)},
+		{URL: "a", Direction: Download, Bufferbloat: bloat(10*ms, 50*ms)},
+		{URL: "b", Direction: Upload, Bufferbloat: bloat(25*ms, 300*ms)},
+		{URL: "b", Direction: Download, Bufferbloat: bloat(40*ms, 80*ms)},
+		{URL: "c", Direction: Download, Bufferbloat: &Bufferbloat{Idle: &LatencyStats{}, Loaded: &LatencyStats{Probes: 5}}},
+		{URL: "d", Direction: Latency, Bufferbloat: bloat(10*ms, 10*ms)},
+		{URL: "e", Direction: Download},
+	}
+	got := LatencyGrades(summaries, LatencyGrading{})
+	if len(got) != 2 || got[0].URL != "b" || got[1].URL != "a" {
+		t.Fatalf("graded %+v, want b and a, in order", got)
+	}
+	// b: the lowest idle median, 25ms, and the largest increases, 40ms
+	// down and 275ms up.
+	b := got[0]
+	if b.Name != "second" || b.IdleMs != 25 || *b.DownloadIncreaseMs != 40 || *b.UploadIncreaseMs != 275 || b.Grade != "D" || b.LimitedBy != "upload" {
+		t.Errorf("b graded %+v", b.LatencyGrade)
+	}
+	if a := got[1]; a.Grade != "B" || a.LimitedBy != "download" || a.UploadIncreaseMs != nil {
+		t.Errorf("a graded %+v", a.LatencyGrade)
+	}
+
+	if g := gradeOf(bloat(10*ms, 45*ms), Upload, LatencyGrading{}); g == nil || g.Grade != "B" || g.LimitedBy != "upload" {
+		t.Errorf("gradeOf = %+v", g)
+	}
+	if g := gradeOf(summaries[4].Bufferbloat, Download, LatencyGrading{}); g != nil {
+		t.Errorf("graded a transfer with no idle probes: %+v", g)
+	}
+	if g := gradeOf(nil, Download, LatencyGrading{}); g != nil {
+		t.Errorf("graded a transfer with no bufferbloat: %+v", g)
+	}
+}
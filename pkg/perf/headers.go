@@ -0,0 +1,79 @@
+package perf
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// HeadersAll captures every response header.
+const HeadersAll = "all"
+
+// headersCap bounds the bytes of names and values kept with
+// capture_headers: all.
+const headersCap = 8 << 10
+
+// HeaderNames lists the response headers kept in Stats.Headers, or is
+// [HeadersAll]. In YAML it is one name or a list of them.
+type HeaderNames []string
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (h *HeaderNames) UnmarshalYAML(node *yaml.Node) error {
+	var names []string
+	if node.Kind == yaml.ScalarNode {
+		names = []string{node.Value}
+	} else if err := node.Decode(&names); err != nil {
+		return err
+	}
+	*h = names
+	return nil
+}
+
+func (h HeaderNames) all() bool {
+	return slices.ContainsFunc(h, func(name string) bool { return strings.EqualFold(name, HeadersAll) })
+}
+
+// capture returns the headers of header that h selects, under their
+// canonical names with the values of a repeated header joined by ", ".
+// With all, headers are taken in name order until headersCap is reached,
+// and truncated reports that some were left out.
+func (h HeaderNames) capture(header http.Header) (captured map[string]string, truncated bool) {
+	if len(h) == 0 || len(header) == 0 {
+		return nil, false
+	}
+	captured = map[string]string{}
+	if !h.all() {
+		for _, name := range h {
+			name = http.CanonicalHeaderKey(name)
+			if values := header.Values(name); len(values) > 0 {
+				captured[name] = strings.Join(values, ", ")
+			}
+		}
+		return captured, false
+	}
+	size := 0
+	for _, name := range slices.Sorted(maps.Keys(header)) {
+		value := strings.Join(header[name], ", ")
+		if size += len(name) + len(value); size > headersCap {
+			return captured, true
+		}
+		captured[name] = value
+	}
+	return captured, false
+}
+
+func checkCaptureHeaders(h HeaderNames) error {
+	for _, name := range h {
+		switch {
+		case name == "" || strings.ContainsAny(name, " \t:"):
+			return fmt.Errorf("invalid header name %q", name)
+		case strings.EqualFold(name, HeadersAll) && len(h) > 1:
+			return fmt.Errorf("all cannot be listed with other names")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestCaptureHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("X-Cache", "HIT")
+		w.Header().Set("CF-Ray", "8a1b2c3d4e5f-CDG")
+		w.Header().Add("Via", "1.1 edge-a")
+		w.Header().Add("Via", "1.1 shield-b")
+		w.Header().Set("Age", "12")
+		w.Header().Set("Content-Length", "1000")
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	// Names match whatever their case, and a repeated header is joined.
+	capture := HeaderNames{"x-cache", "VIA", "Age", "x-missing"}
+	want := "map[Age:12 Via:1.1 edge-a, 1.1 shield-b X-Cache:HIT]"
+	for _, target := range []Target{
+		{URL: srv.URL, CaptureHeaders: capture},
+		{URL: srv.URL, CaptureHeaders: capture, Streams: 2},
+		{URL: srv.URL, CaptureHeaders: capture, Method: MethodUpload, UploadSize: 1000},
+	} {
+		all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), target))
+		last := all[len(all)-1]
+		if last.Error != nil {
+			t.Fatal(last.Error)
+		}
+		if got := fmt.Sprint(last.Headers); got != want || last.HeadersTruncated {
+			t.Errorf("%s with %d streams captured %s (truncated %v), want %s", last.Direction, target.Streams, got, last.HeadersTruncated, want)
+		}
+	}
+
+	all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL}))
+	if last := all[len(all)-1]; last.Headers != nil {
+		t.Errorf("captured %v without capture_headers", last.Headers)
+	}
+	all = collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL, CaptureHeaders: HeaderNames{"ALL"}}))
+	if last := all[len(all)-1]; len(last.Headers) != 7 || last.Headers["Cf-Ray"] != "8a1b2c3d4e5f-CDG" || last.Headers["Date"] == "" {
+		t.Errorf("captured all as %v", last.Headers)
+	}
+}
+
+func TestCaptureHeadersCap(t *testing.T) {
+	header := http.Header{}
+	for i := range 20 {
+		header.Set(fmt.Sprintf("X-Big-%02d", i), strings.Repeat("v", 1000))
+	}
+	captured, truncated := HeaderNames{HeadersAll}.capture(header)
+	if !truncated {
+		t.Error("20kB of headers not truncated")
+	}
+	// The headers are taken in name order up to the cap.
+	size := 0
+	for name, value := range captured {
+		size += len(name) + len(value)
+	}
+	if size > headersCap || len(captured) != 8 {
+		t.Errorf("kept %d headers of %d bytes past a cap of %d", len(captured), size, headersCap)
+	}
+	for i := range 8 {
+		if _, ok := captured[fmt.Sprintf("X-Big-%02d", i)]; !ok {
+			t.Errorf("X-Big-%02d left out before later names", i)
+		}
+	}
+	// Named headers are kept whatever their size.
+	captured, truncated = HeaderNames{"x-big-00", "x-big-19"}.capture(header)
+	if len(captured) != 2 || truncated {
+		t.Errorf("named headers %d, truncated %v", len(captured), truncated)
+	}
+}
+
+func TestHeaderNames(t *testing.T) {
+	var c struct {
+		One  HeaderNames `yaml:"one"`
+		Many HeaderNames `yaml:"many"`
+	}
+	if err := yaml.Unmarshal([]byte("one: all\nmany: [x-cache, cf-ray]\n"), &c); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(c.One) != "[all]" || fmt.Sprint(c.Many) != "[x-cache cf-ray]" || !c.One.all() || c.Many.all() {
+		t.Errorf("decoded %v and %v", c.One, c.Many)
+	}
+	tests := []struct {
+		names HeaderNames
+		want  string
+	}{
+		{HeaderNames{"x-cache", "Age"}, ""},
+		{HeaderNames{"All"}, ""},
+		{HeaderNames{"x cache"}, `invalid header name "x cache"`},
+		{HeaderNames{"x-cache:"}, `invalid header name "x-cache:"`},
+		{HeaderNames{""}, `invalid header name ""`},
+		{HeaderNames{"all", "age"}, "all cannot be listed with other names"},
+	}
+	for _, tt := range tests {
+		err := checkCaptureHeaders(tt.names)
+		if got := fmt.Sprint(err); (tt.want == "" && err != nil) || (tt.want != "" && got != tt.want) {
+			t.Errorf("checkCaptureHeaders(%q) = %v, want %q", tt.names, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build http3
+
+package perf
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+const http3Supported = true
+
+// newHTTP3Transport returns a QUIC transport. Source binding, ip_version,
+// proxies and resolver settings do not apply to it.
+func newHTTP3Transport(tlsConfig *tls.Config) (http.RoundTripper, func()) {
+	if tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+	}
+	tr := &http3.Transport{TLSClientConfig: tlsConfig}
+	return tr, func() { tr.Close() }
+}
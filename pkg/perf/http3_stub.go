@@ -0,0 +1,23 @@
+//go:build !http3
+
+package perf
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+)
+
+const http3Supported = false
+
+func newHTTP3Transport(*tls.Config) (http.RoundTripper, func()) {
+	return roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("protocol h3 needs a build with -tags http3")
+	}), func() {}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
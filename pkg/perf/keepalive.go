@@ -0,0 +1,53 @@
+package perf
+
+import "net/http"
+
+// keptClient is a client kept between passes and the func that closes its
+// connections.
+type keptClient struct {
+	client  *http.Client
+	release func()
+}
+
+// keptKey names a kept client: entries of one URL share it unless they
+// dial or greet the server differently.
+type keptKey struct {
+	summaryKey
+	connectTo, serverName      string
+	ipVersion, sourceIP, iface string
+}
+
+// session returns the client for a download or upload of target. Each
+// target keeps its client for the Tester's lifetime, so later passes can
+// reuse its connections, unless it sets fresh_connection or the Tester has
+// an injected Client. Wire counts are taken from the connections dialed
+// for a test, so a target counting wire bytes never keeps them, and
+// cold_start keeps none.
+func (t *Tester) session(target Target) (*http.Client, func()) {
+	if t.opts.Client != nil || target.FreshConnection != nil && *target.FreshConnection || target.Count == CountWire || t.opts.CacheMode == CacheCold {
+		return t.client(target)
+	}
+	key := keptKey{summaryKey{url: target.configuredURL(), direction: target.Direction(), ip: target.pinnedIP, family: target.family, size: target.sweepSize, phase: target.bidiPhase, offset: target.sampleOffset}, target.ConnectTo, target.serverName(), target.IPVersion, target.SourceIP, target.Interface}
+	t.keptMu.Lock()
+	defer t.keptMu.Unlock()
+	kept, ok := t.kept[key]
+	if !ok {
+		kept.client, kept.release = t.client(target)
+		if t.kept == nil {
+			t.kept = map[keptKey]keptClient{}
+		}
+		t.kept[key] = kept
+	}
+	return kept.client, func() {}
+}
+
+// Close closes the connections the Tester keeps open between passes. A
+// test started afterwards dials afresh.
+func (t *Tester) Close() {
+	t.keptMu.Lock()
+	defer t.keptMu.Unlock()
+	for _, kept := range t.kept {
+		kept.release()
+	}
+	clear(t.kept)
+}
@@ -0,0 +1,116 @@
+package perf
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// connServer serves 10kB and counts the connections made to it.
+func connServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Length", "10000")
+		w.Write(make([]byte, 10000))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv, &conns
+}
+
+func TestKeepAlive(t *testing.T) {
+	fresh := true
+	tests := []struct {
+		name   string
+		opts   Options
+		target Target
+		// dials is how many connections two fetches in a row make.
+		dials int32
+	}{
+		{"download", Options{}, Target{}, 1},
+		{"upload", Options{}, Target{Method: MethodUpload, UploadSize: 1000}, 1},
+		{"fresh_connection", Options{}, Target{FreshConnection: &fresh}, 2},
+		{"global fresh_connection", Options{FreshConnection: true}, Target{}, 2},
+		{"target over global", Options{FreshConnection: true}, Target{FreshConnection: new(bool)}, 1},
+		{"wire count", Options{}, Target{Count: CountWire}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, conns := connServer(t)
+			tt.opts.ProgressInterval = -1
+			tester := New(tt.opts)
+			defer tester.Close()
+			tt.target.URL = srv.URL
+			var reused []bool
+			for range 2 {
+				all := collect(tester.Test(context.Background(), tt.target))
+				last := all[len(all)-1]
+				if last.Error != nil {
+					t.Fatal(last.Error)
+				}
+				reused = append(reused, last.Reused)
+			}
+			if n := conns.Load(); n != tt.dials {
+				t.Errorf("%d connections, want %d", n, tt.dials)
+			}
+			if reused[0] || reused[1] != (tt.dials == 1) {
+				t.Errorf("reused %v", reused)
+			}
+		})
+	}
+}
+
+func TestKeepAliveClose(t *testing.T) {
+	srv, conns := connServer(t)
+	tester := New(Options{ProgressInterval: -1, IdleConnTimeout: 50 * time.Millisecond})
+	fetch := func(url string) Stats {
+		t.Helper()
+		all := collect(tester.Test(context.Background(), Target{URL: url}))
+		return all[len(all)-1]
+	}
+	fetch(srv.URL + "/a")
+	// Each URL keeps connections of its own.
+	if fetch(srv.URL + "/b").Reused {
+		t.Error("a second URL reused the first one's connection")
+	}
+	// Close drops the kept connections, and an idle one times out.
+	tester.Close()
+	if fetch(srv.URL + "/a").Reused {
+		t.Error("reused a connection after Close")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if fetch(srv.URL + "/a").Reused {
+		t.Error("reused a connection past idle_conn_timeout")
+	}
+	tester.Close()
+	if n := conns.Load(); n != 4 {
+		t.Errorf("%d connections, want 4", n)
+	}
+}
+
+func TestReuseSummary(t *testing.T) {
+	srv, _ := connServer(t)
+	tester := New(Options{ProgressInterval: -1})
+	defer tester.Close()
+	c := NewCollector()
+	for range 3 {
+		for s := range tester.Run(context.Background(), []Target{{URL: srv.URL}}, 1) {
+			c.Add(s)
+		}
+	}
+	// Every pass but the first reuses the connection.
+	if s := c.Summaries()[0]; s.Runs != 3 || s.Reused != 2 {
+		t.Errorf("%d runs, %d reused; want 3 and 2", s.Runs, s.Reused)
+	}
+}
@@ -0,0 +1,148 @@
+package perf
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// LatencyStats summarises the round-trip times of a latency test. Each
+// round trip runs from sending a request to its first response byte, so a
+// cold probe includes DNS, connect and TLS.
+type LatencyStats struct {
+	Probes int
+	Min    time.Duration
+	Avg    time.Duration
+	Max    time.Duration
+	P50    time.Duration
+	P95    time.Duration
+	// Jitter is the mean difference between consecutive round trips.
+	Jitter time.Duration
+
+	samples []time.Duration
+}
+
+// MarshalJSON encodes the durations in milliseconds.
+func (l *LatencyStats) MarshalJSON() ([]byte, error) {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return json.Marshal(struct {
+		Probes int     `json:"probes"`
+		Min    float64 `json:"min_ms"`
+		Avg    float64 `json:"avg_ms"`
+		Max    float64 `json:"max_ms"`
+		P50    float64 `json:"p50_ms"`
+		P95    float64 `json:"p95_ms"`
+		Jitter float64 `json:"jitter_ms"`
+	}{l.Probes, ms(l.Min), ms(l.Avg), ms(l.Max), ms(l.P50), ms(l.P95), ms(l.Jitter)})
+}
+
+func newLatencyStats(samples []time.Duration) *LatencyStats {
+	l := &LatencyStats{Probes: len(samples), samples: samples}
+	if len(samples) == 0 {
+		return l
+	}
+	sorted := make([]float64, len(samples))
+	var jitter time.Duration
+	for i, d := range samples {
+		sorted[i] = float64(d)
+		if i > 0 {
+			jitter += (d - samples[i-1]).Abs()
+		}
+	}
+	slices.Sort(sorted)
+	l.Min = time.Duration(sorted[0])
+	l.Max = time.Duration(sorted[len(sorted)-1])
+	l.Avg = time.Duration(mean(sorted))
+	l.P50 = time.Duration(Percentile(sorted, 50))
+	l.P95 = time.Duration(Percentile(sorted, 95))
+	if len(samples) > 1 {
+		l.Jitter = jitter / time.Duration(len(samples)-1)
+	}
+	return l
+}
+
+// latency sends target.Probes small HEAD requests one after another. With
+// ReuseConnections they share one connection that is warmed up by an
+// unmeasured request first; otherwise each probe dials afresh.
+func (t *Tester) latency(ctx context.Context, target Target) <-chan Stats {
+	ctx, cancel := t.withTimeout(ctx)
+	e := t.newEmitter(ctx, target)
+
+	go func() {
+		defer close(e.ch)
+		defer cancel()
+
+		probes := target.Probes
+		if probes <= 0 {
+			probes = 10
+		}
+		base := Stats{URL: target.URL, Direction: Latency, Proxy: t.proxyFor(target.URL)}
+		fail := func(err error) {
+			if ctx.Err() != nil {
+				e.interrupt(base, 0, time.Time{})
+				return
+			}
+			base.Error = err
+			e.send(base)
+		}
+
+		var shared *http.Client
+		if target.ReuseConnections {
+			client, release := t.client(target)
+			defer release()
+			shared = client
+			if _, err := t.probe(ctx, shared, target, &base); err != nil {
+				fail(err)
+				return
+			}
+		}
+
+		start := time.Now()
+		rtts := make([]time.Duration, 0, probes)
+		for range probes {
+			client, release := shared, func() {}
+			if client == nil {
+				client, release = t.client(target)
+			}
+			rtt, err := t.probe(ctx, client, target, &base)
+			release()
+			if err != nil {
+				fail(err)
+				return
+			}
+			rtts = append(rtts, rtt)
+		}
+
+		base.Done = true
+		base.Elapsed = time.Since(start)
+		base.Latency = newLatencyStats(rtts)
+		e.send(base)
+	}()
+
+	return e.ch
+}
+
+// probe times one HEAD request and records its phases in stats.
+func (t *Tester) probe(ctx context.Context, client *http.Client, target Target, stats *Stats) (time.Duration, error) {
+	timer := t.phaseTimer(target.URL)
+	req, err := http.NewRequestWithContext(timer.context(ctx), http.MethodHead, target.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	target.prepare(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	timer.apply(stats)
+	recordResponse(stats, resp, target.CaptureHeaders)
+	if err := checkStatus(resp); err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return stats.TTFB, nil
+}
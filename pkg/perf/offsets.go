@@ -0,0 +1,215 @@
+package perf
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// defaultSampleSize is how much of an object each offset sample fetches
+// unless sample_size says otherwise.
+const defaultSampleSize = 32 << 20
+
+// boundaryShare is the share of the fastest sample's speed below which a
+// slower sample flags a cache boundary.
+const boundaryShare = 0.7
+
+// offsets returns a copy of target per offset sample, each fetching
+// sample_size bytes as a Range request, the first starting at the
+// beginning of the body and the last ending at its end. The size of the
+// body comes from a HEAD request; when it gives none, or the server does
+// not take ranges, a single sample of the start of the body is returned,
+// with a note saying why.
+func (t *Tester) offsets(ctx context.Context, target Target) []Target {
+	chunk := int64(cmp.Or(target.SampleSize, defaultSampleSize))
+	length, note := t.sampleLength(ctx, target)
+	if note == "" && length <= chunk {
+		note = fmt.Sprintf("the body is %s, no larger than sample_size", SizeLabel(length))
+	}
+	if note != "" {
+		t.log().Warn("offset_samples: testing a single sample", "url", target.URL, "reason", note)
+		c := target.sample(0, 1, chunk, false, "@0%")
+		c.sampleNote = note
+		return []Target{c}
+	}
+	n := target.OffsetSamples
+	copies := make([]Target, n)
+	for i := range n {
+		offset := int64(i) * (length - chunk) / int64(n-1)
+		copies[i] = target.sample(offset, n, chunk, true, fmt.Sprintf("@%d%%", i*100/(n-1)))
+	}
+	return copies
+}
+
+// sampleLength asks for the size of the body of target with a HEAD
+// request, returning a note instead when it cannot be sampled by range.
+func (t *Tester) sampleLength(ctx context.Context, target Target) (int64, string) {
+	client, release := t.client(target)
+	defer release()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target.URL, nil)
+	if err != nil {
+		return 0, err.Error()
+	}
+	target.prepare(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "HEAD failed: " + err.Error()
+	}
+	resp.Body.Close()
+	switch {
+	case checkStatus(resp) != nil:
+		return 0, "HEAD answered " + resp.Status
+	case resp.ContentLength <= 0:
+		return 0, "HEAD gave no Content-Length"
+	case resp.Header.Get("Accept-Ranges") != "bytes":
+		return 0, "the server does not accept byte ranges"
+	}
+	return resp.ContentLength, ""
+}
+
+// sample returns a copy of t fetching chunk bytes from offset, as a Range
+// request when ranged, named after where it is in the body.
+func (t Target) sample(offset int64, n int, chunk int64, ranged bool, at string) Target {
+	off := false
+	c := t
+	c.sampleOffset, c.offsetSamples, c.sampleRanged, c.Preflight = offset, n, ranged, &off
+	c.MaxBytes = min(cmp.Or(c.MaxBytes, ByteSize(chunk)), ByteSize(chunk))
+	c.Name = fmt.Sprintf("%s (%s)", Stats{URL: t.configuredURL(), Name: t.Name}.DisplayName(), at)
+	return c
+}
+
+// requestOffset asks req for the bytes of an offset sample.
+func (t Target) requestOffset(req *http.Request) {
+	if t.sampleRanged {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", t.sampleOffset, t.sampleOffset+int64(t.MaxBytes)-1))
+	}
+}
+
+// checkSampled accepts the answer to an offset sample: a 206 whose
+// Content-Range starts at its offset, unless it was not ranged.
+func (t Target) checkSampled(resp *http.Response) error {
+	if !t.sampleRanged {
+		return nil
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("offset_samples: server answered %s instead of 206 Partial Content", resp.Status)
+	}
+	var first int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &first); err != nil || first != t.sampleOffset {
+		return fmt.Errorf("offset_samples: Content-Range %q does not start at byte %d", resp.Header.Get("Content-Range"), t.sampleOffset)
+	}
+	return nil
+}
+
+// offsetProblems adds the problems of the offset_samples setting of t, with
+// prefix naming it.
+func (t Target) offsetProblems(ps *Problems, prefix string) {
+	if t.SampleSize < 0 {
+		ps.Addf(prefix+"sample_size", "must not be negative")
+	}
+	if t.OffsetSamples == 0 {
+		ps.Addf(prefix+"sample_size", "only applies with offset_samples")
+		return
+	}
+	if s := scheme(t.URL); t.Direction() != Download || s != "http" && s != "https" {
+		ps.Addf(prefix+"offset_samples", "only applies to http(s) downloads")
+	}
+	if t.OffsetSamples < 2 {
+		ps.Addf(prefix+"offset_samples", "needs at least 2 samples, got %d", t.OffsetSamples)
+	}
+	for _, other := range []struct {
+		name string
+		set  bool
+	}{
+		{"sweep", t.SizeSweep != nil},
+		{"resolve_all", t.ResolveAll},
+		{"dualstack_compare", t.DualstackCompare},
+		{"bidirectional", t.Bidirectional},
+		{"streams", t.Streams > 1},
+		{"resume", t.Resume},
+		{"reuse_probe", t.ReuseProbe},
+	} {
+		if other.set {
+			ps.Addf(prefix+"offset_samples", "cannot be used with %s", other.name)
+		}
+	}
+}
+
+// OffsetProfile sets the offset samples of a URL side by side, in the
+// order they are in the body.
+type OffsetProfile struct {
+	URL     string         `json:"url"`
+	Name    string         `json:"name,omitempty"`
+	Agent   string         `json:"agent,omitempty"`
+	Samples []OffsetSample `json:"samples"`
+	// SpreadPct is how much slower the slowest sample was than the
+	// fastest, in percent of the fastest.
+	SpreadPct float64 `json:"spread_pct"`
+	// CacheBoundary flags a spread of over 30%, as when the start of an
+	// object is cached at the edge and the rest comes from the origin.
+	CacheBoundary bool `json:"cache_boundary,omitempty"`
+	// Note says why the URL was tested with a single sample.
+	Note string `json:"note,omitempty"`
+}
+
+// OffsetSample is the summary of one offset of a URL.
+type OffsetSample struct {
+	OffsetBytes int64   `json:"offset_bytes"`
+	Runs        int     `json:"runs"`
+	Errors      int     `json:"errors"`
+	MeanMbps    float64 `json:"mean_mbps"`
+	MeanTTFBMs  float64 `json:"mean_ttfb_ms"`
+}
+
+// OffsetProfiles gathers the summaries of offset samples under the URL
+// they sampled, in the order the URLs first appear.
+func OffsetProfiles(summaries []Summary) []OffsetProfile {
+	var profiles []OffsetProfile
+	index := map[summaryKey]int{}
+	for _, s := range summaries {
+		if s.OffsetSamples == 0 {
+			continue
+		}
+		key := summaryKey{url: s.URL, direction: s.Direction, agent: s.Agent}
+		i, ok := index[key]
+		if !ok {
+			i = len(profiles)
+			index[key] = i
+			name := s.Name
+			if at := strings.LastIndex(name, " (@"); at >= 0 {
+				name = name[:at]
+			}
+			if name == s.URL {
+				name = ""
+			}
+			profiles = append(profiles, OffsetProfile{URL: s.URL, Name: name, Agent: s.Agent})
+		}
+		p := &profiles[i]
+		p.Note = cmp.Or(p.Note, s.SampleNote)
+		p.Samples = append(p.Samples, OffsetSample{OffsetBytes: s.SampleOffset, Runs: s.Runs, Errors: s.Errors, MeanMbps: s.MeanMbps, MeanTTFBMs: s.MeanTTFBMs})
+	}
+	for i := range profiles {
+		p := &profiles[i]
+		slices.SortFunc(p.Samples, func(a, b OffsetSample) int { return cmp.Compare(a.OffsetBytes, b.OffsetBytes) })
+		fastest, slowest := 0.0, 0.0
+		for _, sample := range p.Samples {
+			if sample.Runs == 0 {
+				continue
+			}
+			if fastest == 0 || sample.MeanMbps > fastest {
+				fastest = sample.MeanMbps
+			}
+			if slowest == 0 || sample.MeanMbps < slowest {
+				slowest = sample.MeanMbps
+			}
+		}
+		if fastest > 0 {
+			p.SpreadPct = (fastest - slowest) / fastest * 100
+			p.CacheBoundary = slowest < boundaryShare*fastest
+		}
+	}
+	return profiles
+}
@@ -0,0 +1,200 @@
+package perf
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// offsetServer serves a 1MiB object whose second half is slow, as when
+// only the start of it is cached at the edge. /object.bin takes ranges,
+// /plain ignores them and /liar says it takes them but sends the whole
+// body anyway. It records the Range header of each GET.
+func offsetServer(t *testing.T) (*httptest.Server, func() []string) {
+	const size = 1 << 20
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/plain" {
+			w.Header().Set("Accept-Ranges", "bytes")
+		}
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", fmt.Sprint(size))
+			return
+		}
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		first, last := int64(0), int64(size-1)
+		if r.URL.Path == "/object.bin" {
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last); err == nil {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, size))
+				w.Header().Set("Content-Length", fmt.Sprint(last-first+1))
+				w.WriteHeader(http.StatusPartialContent)
+			}
+		}
+		chunk := make([]byte, 8<<10)
+		for at := first; at <= last; at += int64(len(chunk)) {
+			if at >= size/2 {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if _, err := w.Write(chunk[:min(int64(len(chunk)), last-at+1)]); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(func() {
+		srv.CloseClientConnections()
+		srv.Close()
+	})
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(ranges)
+	}
+}
+
+func TestOffsetSamples(t *testing.T) {
+	srv, ranges := offsetServer(t)
+	targets := []Target{{URL: srv.URL + "/object.bin", Name: "cdn", OffsetSamples: 3, SampleSize: 64 << 10, Thresholds: Thresholds{MinSpeedMbps: 1}}}
+	c := NewCollector()
+	var finals []Stats
+	for s := range New(Options{ProgressInterval: -1}).Run(context.Background(), targets, 1) {
+		c.Add(s)
+		if s.Final() {
+			finals = append(finals, s)
+		}
+	}
+	tests := []struct {
+		name   string
+		offset int64
+	}{
+		{"cdn (@0%)", 0},
+		{"cdn (@50%)", 480 << 10},
+		{"cdn (@100%)", 960 << 10},
+	}
+	if len(finals) != len(tests) {
+		t.Fatalf("%d results, want one per offset", len(finals))
+	}
+	for i, tt := range tests {
+		s := finals[i]
+		if s.Error != nil || s.Name != tt.name || s.SampleOffset != tt.offset || s.OffsetSamples != 3 || s.SizeBytes != 64<<10 {
+			t.Errorf("sample %d: %q at %d of %d with %d bytes (%v), want %q at %d", i, s.Name, s.SampleOffset, s.OffsetSamples, s.SizeBytes, s.Error, tt.name, tt.offset)
+		}
+	}
+	if got := ranges(); !slices.Equal(got, []string{"bytes=0-65535", "bytes=491520-557055", "bytes=983040-1048575"}) {
+		t.Errorf("ranges asked for %q", got)
+	}
+
+	// The samples are summarised and checked one by one, and set side by
+	// side under the URL, where the slow half flags a cache boundary.
+	summaries := c.Summaries()
+	if len(summaries) != 3 {
+		t.Fatalf("%d summaries, want one per offset", len(summaries))
+	}
+	if checks := Checks(targets, summaries, LinkCapacity{}); len(checks) != 3 {
+		t.Errorf("%d checks, want one per offset", len(checks))
+	}
+	profiles := OffsetProfiles(summaries)
+	if len(profiles) != 1 || profiles[0].Name != "cdn" || len(profiles[0].Samples) != 3 || profiles[0].Note != "" {
+		t.Fatalf("profiles %+v", profiles)
+	}
+	p := profiles[0]
+	if p.Samples[1].MeanMbps >= boundaryShare*p.Samples[0].MeanMbps || !p.CacheBoundary || p.SpreadPct <= 30 {
+		t.Errorf("samples %+v spread %.0f%%, boundary %v", p.Samples, p.SpreadPct, p.CacheBoundary)
+	}
+}
+
+func TestOffsetSamplesFallback(t *testing.T) {
+	srv, ranges := offsetServer(t)
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	tests := []struct {
+		name  string
+		url   string
+		chunk ByteSize
+		size  int64
+		note  string
+	}{
+		{"no ranges", srv.URL + "/plain", 64 << 10, 64 << 10, "the server does not accept byte ranges"},
+		{"small body", srv.URL + "/object.bin", 2 << 20, 1 << 20, "the body is 1MiB, no larger than sample_size"},
+		{"failed HEAD", missing.URL + "/object.bin", 64 << 10, 0, "HEAD answered 404 Not Found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(ranges())
+			var logs bytes.Buffer
+			var finals []Stats
+			for s := range New(Options{ProgressInterval: -1, Logger: slog.New(slog.NewTextHandler(&logs, nil))}).Run(context.Background(), []Target{{URL: tt.url, Name: "cdn", OffsetSamples: 3, SampleSize: tt.chunk}}, 1) {
+				if s.Final() {
+					finals = append(finals, s)
+				}
+			}
+			if len(finals) != 1 {
+				t.Fatalf("%d results, want a single sample", len(finals))
+			}
+			s := finals[0]
+			if s.Name != "cdn (@0%)" || s.SampleNote != tt.note || s.SizeBytes != tt.size {
+				t.Errorf("sample %q with %d bytes noting %q, want %d bytes noting %q", s.Name, s.SizeBytes, s.SampleNote, tt.size, tt.note)
+			}
+			if want := fmt.Sprintf("reason=%q", tt.note); !strings.Contains(logs.String(), want) {
+				t.Errorf("log lacks %s:\n%s", want, logs.String())
+			}
+			if got := ranges()[before:]; tt.size > 0 && !slices.Equal(got, []string{""}) {
+				t.Errorf("ranges asked for %q, want a plain GET", got)
+			}
+			profiles := OffsetProfiles([]Summary{{URL: s.URL, Name: s.Name, Direction: Download, OffsetSamples: s.OffsetSamples, SampleNote: s.SampleNote, Runs: 1, MeanMbps: 10}})
+			if len(profiles) != 1 || profiles[0].Note != tt.note || profiles[0].CacheBoundary {
+				t.Errorf("profiles %+v", profiles)
+			}
+		})
+	}
+
+	// A server that claims ranges but sends the whole body fails the sample.
+	all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL + "/liar"}.sample(0, 2, 64<<10, true, "@0%")))
+	if err := all[len(all)-1].Error; err == nil || err.Error() != "offset_samples: server answered 200 OK instead of 206 Partial Content" {
+		t.Errorf("unranged answer: %v", err)
+	}
+}
+
+func TestOffsetProfiles(t *testing.T) {
+	sample := func(url string, offset int64, runs int, mbps float64) Summary {
+		// A name that is the URL and where it was sampled is no name.
+		return Summary{URL: url, Name: url + " (@x%)", Direction: Download, OffsetSamples: 3, SampleOffset: offset, Runs: runs, MeanMbps: mbps}
+	}
+	tests := []struct {
+		name     string
+		samples  []Summary
+		spread   float64
+		boundary bool
+	}{
+		{"even", []Summary{sample("a", 0, 1, 100), sample("a", 5e6, 1, 90), sample("a", 1e7, 1, 95)}, 10, false},
+		// The slowest at exactly 70% of the fastest is no boundary yet.
+		{"at the share", []Summary{sample("a", 0, 1, 100), sample("a", 1e7, 1, 70)}, 30, false},
+		{"cold tail", []Summary{sample("a", 1e7, 1, 20), sample("a", 0, 1, 100), sample("a", 5e6, 1, 25)}, 80, true},
+		// A failed sample is neither the fastest nor the slowest.
+		{"failed sample", []Summary{sample("a", 0, 0, 0), sample("a", 1e7, 1, 100)}, 0, false},
+	}
+	for _, tt := range tests {
+		profiles := OffsetProfiles(append(tt.samples, Summary{URL: "b", Runs: 1, MeanMbps: 500}))
+		if len(profiles) != 1 {
+			t.Fatalf("%s: profiles %+v", tt.name, profiles)
+		}
+		p := profiles[0]
+		if !near(p.SpreadPct, tt.spread) || p.CacheBoundary != tt.boundary || p.Name != "" {
+			t.Errorf("%s: spread %.1f%% boundary %v, want %.1f%% %v", tt.name, p.SpreadPct, p.CacheBoundary, tt.spread, tt.boundary)
+		}
+		if !slices.IsSortedFunc(p.Samples, func(a, b OffsetSample) int { return cmp.Compare(a.OffsetBytes, b.OffsetBytes) }) {
+			t.Errorf("%s: samples out of order %+v", tt.name, p.Samples)
+		}
+	}
+}
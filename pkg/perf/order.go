@@ -0,0 +1,83 @@
+package perf
+
+import (
+	"fmt"
+	"math/rand/v2"
+)
+
+// Orders accepted by the order option. Sequential tests the URLs in config
+// order, shuffle in a new random order every pass, and weighted fills each
+// pass by drawing URLs with replacement in proportion to their weight.
+const (
+	OrderSequential = "sequential"
+	OrderShuffle    = "shuffle"
+	OrderWeighted   = "weighted"
+)
+
+func checkOrder(order string) error {
+	switch order {
+	case "", OrderSequential, OrderShuffle, OrderWeighted:
+		return nil
+	}
+	return fmt.Errorf("order must be sequential, shuffle or weighted, got %q", order)
+}
+
+// Orderer arranges the targets of each pass.
+type Orderer struct {
+	order string
+	rng   *rand.Rand
+}
+
+// NewOrderer returns an Orderer for order whose random choices follow
+// seed, so the same seed repeats the same sequence of passes.
+func NewOrderer(order string, seed uint64) *Orderer {
+	return &Orderer{order: order, rng: rand.New(rand.NewPCG(seed, seed))}
+}
+
+// Pass returns the targets to test in the next pass. targets is not
+// modified.
+func (o *Orderer) Pass(targets []Target) []Target {
+	switch o.order {
+	case OrderShuffle:
+		pass := append([]Target(nil), targets...)
+		o.rng.Shuffle(len(pass), func(i, j int) { pass[i], pass[j] = pass[j], pass[i] })
+		return pass
+	case OrderWeighted:
+		return o.weighted(targets)
+	}
+	return targets
+}
+
+// weighted draws len(targets) targets with replacement, each with a chance
+// proportional to its weight. An unset weight counts as 1.
+func (o *Orderer) weighted(targets []Target) []Target {
+	var total float64
+	for _, t := range targets {
+		total += t.weight()
+	}
+	if total <= 0 {
+		return targets
+	}
+	pass := make([]Target, len(targets))
+	for slot := range pass {
+		r := o.rng.Float64() * total
+		for _, t := range targets {
+			if r -= t.weight(); r < 0 {
+				pass[slot] = t
+				break
+			}
+		}
+		if pass[slot].URL == "" {
+			// Rounding left r just short of zero; the last target owns it.
+			pass[slot] = targets[len(targets)-1]
+		}
+	}
+	return pass
+}
+
+func (t Target) weight() float64 {
+	if t.Weight == 0 {
+		return 1
+	}
+	return t.Weight
+}
@@ -0,0 +1,97 @@
+package perf
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+func urlsOf(targets []Target) []string {
+	urls := make([]string, len(targets))
+	for i, t := range targets {
+		urls[i] = t.URL
+	}
+	return urls
+}
+
+func TestOrdererSequential(t *testing.T) {
+	targets := []Target{{URL: "a"}, {URL: "b"}, {URL: "c"}}
+	for _, order := range []string{"", OrderSequential} {
+		o := NewOrderer(order, 1)
+		for range 3 {
+			if got := urlsOf(o.Pass(targets)); !slices.Equal(got, []string{"a", "b", "c"}) {
+				t.Errorf("%q pass %v, want config order", order, got)
+			}
+		}
+	}
+}
+
+func TestOrdererShuffle(t *testing.T) {
+	var targets []Target
+	for i := range 8 {
+		targets = append(targets, Target{URL: fmt.Sprint(i)})
+	}
+	want := urlsOf(targets)
+	o, again := NewOrderer(OrderShuffle, 42), NewOrderer(OrderShuffle, 42)
+	seen := map[string]bool{}
+	for range 20 {
+		pass := urlsOf(o.Pass(targets))
+		if !slices.Equal(slices.Sorted(slices.Values(pass)), want) {
+			t.Fatalf("pass %v is not a permutation of %v", pass, want)
+		}
+		// The same seed repeats the same sequence of passes.
+		if repeat := urlsOf(again.Pass(targets)); !slices.Equal(pass, repeat) {
+			t.Errorf("seeded passes %v and %v differ", pass, repeat)
+		}
+		seen[fmt.Sprint(pass)] = true
+	}
+	if len(seen) < 15 {
+		t.Errorf("%d distinct orders in 20 passes", len(seen))
+	}
+	if !slices.Equal(urlsOf(targets), want) {
+		t.Errorf("targets reordered to %v", urlsOf(targets))
+	}
+	if other := urlsOf(NewOrderer(OrderShuffle, 43).Pass(targets)); slices.Equal(other, urlsOf(NewOrderer(OrderShuffle, 42).Pass(targets))) {
+		t.Errorf("seeds 42 and 43 gave the same first pass %v", other)
+	}
+}
+
+func TestOrdererWeighted(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []Target
+		want    map[string]float64
+	}{
+		{"weights", []Target{{URL: "a", Weight: 1}, {URL: "b", Weight: 2}, {URL: "c", Weight: 7}}, map[string]float64{"a": 0.1, "b": 0.2, "c": 0.7}},
+		{"unset counts as one", []Target{{URL: "a"}, {URL: "b", Weight: 3}}, map[string]float64{"a": 0.25, "b": 0.75}},
+		{"fractions", []Target{{URL: "a", Weight: 0.5}, {URL: "b", Weight: 0.5}}, map[string]float64{"a": 0.5, "b": 0.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := NewOrderer(OrderWeighted, 7)
+			const passes = 20000
+			counts := map[string]int{}
+			for range passes {
+				pass := o.Pass(tt.targets)
+				if len(pass) != len(tt.targets) {
+					t.Fatalf("pass of %d, want %d", len(pass), len(tt.targets))
+				}
+				for _, target := range pass {
+					counts[target.URL]++
+				}
+			}
+			draws := float64(passes * len(tt.targets))
+			for url, share := range tt.want {
+				// Well over four standard deviations of a binomial share.
+				slack := 4.5 * math.Sqrt(share*(1-share)/draws)
+				if got := float64(counts[url]) / draws; math.Abs(got-share) > slack {
+					t.Errorf("%s drawn %.4f of the time, want %.4f ± %.4f", url, got, share, slack)
+				}
+			}
+		})
+	}
+	if pass := NewOrderer(OrderWeighted, 1).Pass(nil); len(pass) != 0 {
+		t.Errorf("pass of no targets %v", pass)
+	}
+}
@@ -0,0 +1,117 @@
+package perf
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pacer hands Run's workers their targets in order, holding back any whose
+// pool already has limit transfers running so they queue behind their own
+// pool rather than blocking the others. Targets of one pool start in the
+// order they were given. A limit of zero holds nothing back.
+type pacer struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	pending []*paced
+	running map[string]int
+	closed  bool
+	done    bool
+	// handed counts the targets handed out.
+	handed int
+}
+
+// paced is a target waiting in a pacer. heldSince is when a worker was
+// first free to start it but its pool was full.
+type paced struct {
+	target    Target
+	pool      string
+	heldSince time.Time
+}
+
+func newPacer(ctx context.Context, limit int) *pacer {
+	p := &pacer{limit: limit, running: map[string]int{}}
+	p.cond = sync.NewCond(&p.mu)
+	// Once ctx is done the remaining targets are handed out without delay,
+	// to be reported as skipped.
+	context.AfterFunc(ctx, func() {
+		p.mu.Lock()
+		p.done = true
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	})
+	return p
+}
+
+// add queues targets; close says no more will come.
+func (p *pacer) add(targets []Target) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, target := range targets {
+		p.pending = append(p.pending, &paced{target: target, pool: target.pool()})
+	}
+	p.cond.Broadcast()
+}
+
+func (p *pacer) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// next blocks until a target may start and returns it with the time it
+// was held back by its pool, or reports false once every target has been
+// handed out. The caller must pass the target to release when it is done.
+func (p *pacer) next() (Target, time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		now := time.Now()
+		for i, q := range p.pending {
+			if p.limit > 0 && !p.done && p.running[q.pool] >= p.limit {
+				if q.heldSince.IsZero() {
+					q.heldSince = now
+				}
+				continue
+			}
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			p.running[q.pool]++
+			q.target.order = p.handed
+			p.handed++
+			var held time.Duration
+			if !q.heldSince.IsZero() {
+				held = now.Sub(q.heldSince)
+			}
+			return q.target, held, true
+		}
+		if p.closed && len(p.pending) == 0 {
+			return Target{}, 0, false
+		}
+		p.cond.Wait()
+	}
+}
+
+// release frees the pool slot of a target next handed out.
+func (p *pacer) release(target Target) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running[target.pool()]--
+	p.cond.Broadcast()
+}
+
+// pool is the group a target shares per_host_concurrency with: its pool
+// tag, or else its host and port.
+func (t Target) pool() string {
+	if t.Pool != "" {
+		return t.Pool
+	}
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return t.URL
+	}
+	return strings.ToLower(u.Host)
+}
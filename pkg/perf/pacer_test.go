@@ -0,0 +1,145 @@
+package perf
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pacedServer takes 100ms over each response, recording the order paths
+// were asked for and the most requests it held at once.
+type pacedServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	paths    []string
+	inFlight int
+	most     int
+}
+
+func newPacedServer(t *testing.T) *pacedServer {
+	s := &pacedServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.paths = append(s.paths, r.URL.Path)
+		s.inFlight++
+		s.most = max(s.most, s.inFlight)
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			s.inFlight--
+			s.mu.Unlock()
+		}()
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		w.Write(make([]byte, 1000))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *pacedServer) stats() ([]string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.paths...), s.most
+}
+
+func TestPerHostConcurrency(t *testing.T) {
+	a, b := newPacedServer(t), newPacedServer(t)
+	targets := []Target{{URL: a.URL + "/1"}, {URL: a.URL + "/2"}, {URL: a.URL + "/3"}, {URL: b.URL + "/1"}}
+	start := time.Now()
+	finals := map[string]Stats{}
+	for s := range New(Options{ProgressInterval: -1, PerHostConcurrency: 1}).Run(context.Background(), targets, 3) {
+		if s.Final() {
+			if s.Error != nil {
+				t.Fatal(s.Error)
+			}
+			finals[s.URL] = s
+		}
+	}
+	took := time.Since(start)
+
+	// One host takes its URLs one at a time in order, while the other runs
+	// alongside.
+	paths, most := a.stats()
+	if most != 1 || len(paths) != 3 || paths[0] != "/1" || paths[1] != "/2" || paths[2] != "/3" {
+		t.Errorf("host a served %v, %d at once", paths, most)
+	}
+	if took < 300*time.Millisecond || took > 2*time.Second {
+		t.Errorf("run took %v, want about 300ms", took)
+	}
+	if s := finals[b.URL+"/1"]; s.QueueWait != 0 {
+		t.Errorf("host b queued for %v", s.QueueWait)
+	}
+	// The wait for the host is kept out of the transfer's timings, the
+	// server's 100ms to the first byte among them.
+	for i, url := range []string{a.URL + "/1", a.URL + "/2", a.URL + "/3"} {
+		s := finals[url]
+		want := time.Duration(i) * 100 * time.Millisecond
+		if s.QueueWait < want-20*time.Millisecond || s.QueueWait > want+500*time.Millisecond {
+			t.Errorf("%s queued for %v, want about %v", url, s.QueueWait, want)
+		}
+		if s.TTFB < 100*time.Millisecond || s.TTFB > 500*time.Millisecond {
+			t.Errorf("%s first byte after %v, want about 100ms", url, s.TTFB)
+		}
+	}
+
+	// A shared pool paces hosts together, and no limit lets them all run.
+	a, b = newPacedServer(t), newPacedServer(t)
+	for range collect(New(Options{ProgressInterval: -1, PerHostConcurrency: 1}).Run(context.Background(),
+		[]Target{{URL: a.URL + "/1", Pool: "cdn"}, {URL: b.URL + "/1", Pool: "cdn"}, {URL: a.URL + "/2"}}, 3)) {
+	}
+	if paths, most := a.stats(); most != 2 || len(paths) != 2 {
+		t.Errorf("host a in and out of the pool served %v, %d at once", paths, most)
+	}
+	c := newPacedServer(t)
+	for range collect(New(Options{ProgressInterval: -1}).Run(context.Background(), []Target{{URL: c.URL + "/1"}, {URL: c.URL + "/2"}, {URL: c.URL + "/3"}}, 3)) {
+	}
+	if _, most := c.stats(); most != 3 {
+		t.Errorf("%d at once without a limit, want 3", most)
+	}
+}
+
+func TestPerHostConcurrencyCancel(t *testing.T) {
+	a := newPacedServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	targets := []Target{{URL: a.URL + "/1"}, {URL: a.URL + "/2"}, {URL: a.URL + "/3"}, {URL: a.URL + "/4"}}
+	start := time.Now()
+	skipped := 0
+	for s := range New(Options{ProgressInterval: -1, PerHostConcurrency: 1}).Run(ctx, targets, 2) {
+		if s.Kind == KindSkipped {
+			skipped++
+		}
+	}
+	// Targets still queued for their host when the run ends are skipped
+	// straight away.
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("run took %v past a 150ms deadline", took)
+	}
+	if paths, _ := a.stats(); len(paths) != 2 || skipped != 2 {
+		t.Errorf("%d requests and %d skipped, want 2 of each", len(paths), skipped)
+	}
+}
+
+func TestTargetPool(t *testing.T) {
+	tests := []struct {
+		target Target
+		want   string
+	}{
+		{Target{URL: "https://Mirror.example.com/a"}, "mirror.example.com"},
+		{Target{URL: "https://mirror.example.com:8443/a"}, "mirror.example.com:8443"},
+		{Target{URL: "https://mirror.example.com/a", Pool: "cdn"}, "cdn"},
+		{Target{URL: "://bad"}, "://bad"},
+	}
+	for _, tt := range tests {
+		if got := tt.target.pool(); got != tt.want {
+			t.Errorf("pool of %+v = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
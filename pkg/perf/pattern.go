@@ -0,0 +1,87 @@
+package perf
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+)
+
+// patternBlockSize is the length of the block a Pattern repeats.
+const patternBlockSize = 64 * 1024
+
+// Pattern is the deterministic body "yaperf serve-payload" sends: a block
+// of random bytes drawn from a seed, repeated. The bytes are random so
+// compression along the path cannot inflate the measured speed.
+type Pattern struct {
+	block []byte
+}
+
+// NewPattern returns the pattern of seed.
+func NewPattern(seed uint64) Pattern {
+	b := make([]byte, patternBlockSize)
+	r := rand.New(rand.NewPCG(seed, seed))
+	for i := range b {
+		b[i] = byte(r.Uint32())
+	}
+	return Pattern{b}
+}
+
+// Fill copies the bytes of the pattern from offset off on into b.
+func (p Pattern) Fill(b []byte, off int64) {
+	n := 0
+	for n < len(b) {
+		n += copy(b[n:], p.block[(off+int64(n))%patternBlockSize:])
+	}
+}
+
+// VerifyPattern checks a downloaded body against the Pattern of Seed as it
+// is read.
+type VerifyPattern struct {
+	Seed uint64 `yaml:"seed"`
+}
+
+// PatternError reports the first byte of a body that differs from its
+// pattern.
+type PatternError struct {
+	Offset    int64
+	Want, Got byte
+}
+
+func (e *PatternError) Error() string {
+	return fmt.Sprintf("body corrupt at byte %d: got 0x%02x, want 0x%02x", e.Offset, e.Got, e.Want)
+}
+
+// patternCheck is written the body from offset off on and fails on the
+// first byte that differs from pattern, so nothing is buffered.
+type patternCheck struct {
+	pattern Pattern
+	off     int64
+}
+
+// patternCheck returns the check of t's body from offset off, or nil when t
+// does not verify a pattern.
+func (t Target) patternCheck(off int64) *patternCheck {
+	if t.VerifyPattern == nil {
+		return nil
+	}
+	return &patternCheck{NewPattern(t.VerifyPattern.Seed), off}
+}
+
+func (c *patternCheck) Write(b []byte) (int, error) {
+	// Whole runs of the block are compared at once; only a run that
+	// differs is looked at byte by byte.
+	for n := 0; n < len(b); {
+		want := c.pattern.block[(c.off+int64(n))%patternBlockSize:]
+		got := b[n:min(len(b), n+len(want))]
+		if !bytes.Equal(got, want[:len(got)]) {
+			for i := range got {
+				if got[i] != want[i] {
+					return n + i, &PatternError{Offset: c.off + int64(n+i), Want: want[i], Got: got[i]}
+				}
+			}
+		}
+		n += len(got)
+	}
+	c.off += int64(len(b))
+	return len(b), nil
+}
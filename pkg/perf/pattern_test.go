@@ -0,0 +1,142 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// patternBody is size bytes of the pattern of seed, with the byte at
+// corrupt flipped when it is not negative.
+func patternBody(seed uint64, size int, corrupt int) []byte {
+	b := make([]byte, size)
+	NewPattern(seed).Fill(b, 0)
+	if corrupt >= 0 {
+		b[corrupt] ^= 0xff
+	}
+	return b
+}
+
+func TestPattern(t *testing.T) {
+	p := NewPattern(42)
+	whole := make([]byte, 3*patternBlockSize)
+	p.Fill(whole, 0)
+	if !bytes.Equal(whole[:patternBlockSize], whole[patternBlockSize:2*patternBlockSize]) {
+		t.Error("the pattern does not repeat its block")
+	}
+	// Any stretch of it can be filled on its own, across blocks too.
+	for _, off := range []int{0, 1, patternBlockSize - 3, patternBlockSize, 100000} {
+		part := make([]byte, 70000)
+		p.Fill(part, int64(off))
+		if !bytes.Equal(part, whole[off:off+len(part)]) {
+			t.Errorf("fill from %d differs from the whole", off)
+		}
+	}
+	again := make([]byte, 1000)
+	NewPattern(42).Fill(again, 0)
+	other := make([]byte, 1000)
+	NewPattern(43).Fill(other, 0)
+	if !bytes.Equal(again, whole[:1000]) || bytes.Equal(other, again) {
+		t.Error("the pattern does not follow its seed")
+	}
+}
+
+func TestPatternCheck(t *testing.T) {
+	body := patternBody(42, 200000, -1)
+	target := Target{VerifyPattern: &VerifyPattern{Seed: 42}}
+	// Written in uneven pieces, from the start or from an offset.
+	for _, from := range []int{0, 70001} {
+		c := target.patternCheck(int64(from))
+		for off := from; off < len(body); off += 9999 {
+			if _, err := c.Write(body[off:min(len(body), off+9999)]); err != nil {
+				t.Fatalf("from %d: %v", from, err)
+			}
+		}
+	}
+	if (Target{}).patternCheck(0) != nil {
+		t.Error("check without verify_pattern")
+	}
+
+	for _, corrupt := range []int{0, patternBlockSize - 1, patternBlockSize, 150001} {
+		bad := patternBody(42, len(body), corrupt)
+		c := target.patternCheck(0)
+		var err error
+		written := 0
+		for off := 0; off < len(bad) && err == nil; off += 32 << 10 {
+			var n int
+			n, err = c.Write(bad[off:min(len(bad), off+32<<10)])
+			written += n
+		}
+		var pe *PatternError
+		if !errors.As(err, &pe) || pe.Offset != int64(corrupt) || pe.Got != bad[corrupt] || pe.Want != body[corrupt] {
+			t.Errorf("flipped byte %d: %v", corrupt, err)
+			continue
+		}
+		// What was written up to the bad byte counts as taken.
+		if written != corrupt {
+			t.Errorf("flipped byte %d: %d bytes taken", corrupt, written)
+		}
+	}
+	if got := (&PatternError{Offset: 150001, Want: 0x0f, Got: 0xf0}).Error(); got != "body corrupt at byte 150001: got 0xf0, want 0x0f" {
+		t.Errorf("error %q", got)
+	}
+}
+
+func TestVerifyPattern(t *testing.T) {
+	const size, corrupt = 1 << 20, 700001
+	good, bad := patternBody(42, size, -1), patternBody(42, size, corrupt)
+	mux := http.NewServeMux()
+	for path, body := range map[string][]byte{"/good": good, "/bad": bad} {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+		})
+	}
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	dir := t.TempDir()
+	for name, body := range map[string][]byte{"good.bin": good, "bad.bin": bad} {
+		if err := os.WriteFile(filepath.Join(dir, name), body, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tester := New(Options{ProgressInterval: -1})
+	verify := &VerifyPattern{Seed: 42}
+	tests := []struct {
+		name   string
+		target Target
+		offset int64
+	}{
+		{"clean", Target{URL: srv.URL + "/good", VerifyPattern: verify}, -1},
+		{"corrupt", Target{URL: srv.URL + "/bad", VerifyPattern: verify}, corrupt},
+		// Each stream checks its range from where the range starts.
+		{"clean streams", Target{URL: srv.URL + "/good", VerifyPattern: verify, Streams: 4}, -1},
+		{"corrupt streams", Target{URL: srv.URL + "/bad", VerifyPattern: verify, Streams: 4}, corrupt},
+		{"clean file", Target{URL: "file://" + filepath.Join(dir, "good.bin"), VerifyPattern: verify}, -1},
+		{"corrupt file", Target{URL: "file://" + filepath.Join(dir, "bad.bin"), VerifyPattern: verify}, corrupt},
+		{"wrong seed", Target{URL: srv.URL + "/good", VerifyPattern: &VerifyPattern{Seed: 7}}, 0},
+		{"not verified", Target{URL: srv.URL + "/bad"}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			all := collect(tester.Test(context.Background(), tt.target))
+			last := all[len(all)-1]
+			if tt.offset < 0 {
+				if last.Error != nil || last.SizeBytes != size {
+					t.Errorf("%d bytes, %v", last.SizeBytes, last.Error)
+				}
+				return
+			}
+			var pe *PatternError
+			if !errors.As(last.Error, &pe) || pe.Offset != tt.offset || last.ErrorKind != ErrorCorrupt {
+				t.Errorf("failed with %v (%s), want corruption at byte %d", last.Error, last.ErrorKind, tt.offset)
+			}
+		})
+	}
+}
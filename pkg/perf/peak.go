@@ -0,0 +1,57 @@
+package perf
+
+import "time"
+
+// peakWindow is the span PeakMbps is measured over, long enough to smooth
+// out the jitter of single intervals.
+const peakWindow = 3 * time.Second
+
+// peakShare is how close to the peak the speed must come for TimeToPeak.
+const peakShare = 0.95
+
+// peakTracker finds the fastest peakWindow of a transfer as its samples
+// arrive. It keeps only the samples of the current window, and the
+// windows that may yet turn out to be the first within peakShare of the
+// peak, so memory stays small however long the transfer runs.
+type peakTracker struct {
+	origin time.Time
+	recent window
+	peak   float64
+	// marks are the windows that raised the peak and are still within
+	// peakShare of it, oldest first.
+	marks []peakMark
+}
+
+// peakMark is the end of a window, from the start of the transfer, and its
+// speed.
+type peakMark struct {
+	at   time.Duration
+	mbps float64
+}
+
+func (p *peakTracker) add(s Sample) {
+	if p.origin.IsZero() {
+		p.origin = s.Time.Add(-s.Interval)
+	}
+	p.recent.add(s)
+	mbps, ok := p.recent.mbps()
+	if !ok || mbps <= p.peak {
+		return
+	}
+	// The first window within peakShare of the final peak must have raised
+	// the peak when it ended, so only such windows are kept.
+	p.peak = mbps
+	p.marks = append(p.marks, peakMark{s.Time.Sub(p.origin), mbps})
+	for p.marks[0].mbps < peakShare*p.peak {
+		p.marks = p.marks[1:]
+	}
+}
+
+// result returns the peak speed and when the speed first came within
+// peakShare of it, or zeros for a transfer shorter than peakWindow.
+func (p *peakTracker) result() (float64, time.Duration) {
+	if len(p.marks) == 0 {
+		return 0, 0
+	}
+	return p.peak, p.marks[0].at
+}
@@ -0,0 +1,90 @@
+package perf
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// trackPeak feeds a peakTracker one-second samples at the given speeds.
+func trackPeak(speeds []float64) *peakTracker {
+	p := &peakTracker{recent: window{span: peakWindow}}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, mbps := range speeds {
+		p.add(Sample{Time: start.Add(time.Duration(i+1) * time.Second), Interval: time.Second, Bytes: int64(mbps * 1e6 / 8)})
+	}
+	return p
+}
+
+func TestPeakTracker(t *testing.T) {
+	tests := []struct {
+		name   string
+		speeds []float64
+		peak   float64
+		ramp   time.Duration
+	}{
+		{"too short", []float64{50, 50}, 0, 0},
+		{"steady", []float64{50, 50, 50, 50}, 50, 3 * time.Second},
+		// Over three seconds the ramp reaches 46.7 at 6s, short of 95% of
+		// 50, and 50 at 7s.
+		{"ramp", []float64{10, 20, 30, 40, 50, 50, 50, 50}, 50, 7 * time.Second},
+		// A single fast interval is smoothed over the window.
+		{"spike", []float64{10, 10, 100, 10, 10, 10}, 40, 3 * time.Second},
+		// An early window within 95% of a later peak is when it was reached.
+		{"early near peak", []float64{48, 48, 48, 10, 10, 50, 50, 50}, 50, 3 * time.Second},
+		// One well short of it is not.
+		{"early far from peak", []float64{30, 30, 30, 10, 60, 60, 60}, 60, 7 * time.Second},
+		{"slowing", []float64{90, 90, 90, 30, 30, 30}, 90, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peak, ramp := trackPeak(tt.speeds).result()
+			if !near(peak, tt.peak) || ramp != tt.ramp {
+				t.Errorf("peak %v after %v, want %v after %v", peak, ramp, tt.peak, tt.ramp)
+			}
+		})
+	}
+}
+
+func TestPeakTrackerMemory(t *testing.T) {
+	// An hour of jittery samples keeps no more than one window of them.
+	speeds := make([]float64, 3600)
+	for i := range speeds {
+		speeds[i] = 100 + float64(i*7919%13)
+	}
+	p := trackPeak(speeds)
+	if n := len(p.recent.samples); n > 4 {
+		t.Errorf("%d samples kept, want one window of them", n)
+	}
+	if n := len(p.marks); n > 10 {
+		t.Errorf("%d peak marks kept", n)
+	}
+	if peak, ramp := p.result(); peak < 100 || peak > 112 || ramp <= 0 {
+		t.Errorf("peak %v after %v", peak, ramp)
+	}
+}
+
+func TestShortTransferPeak(t *testing.T) {
+	srv := payloadServer(t, 1000, 0)
+	all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL + "/bytes/100000"}))
+	last := all[len(all)-1]
+	// A transfer shorter than the window peaks at its average.
+	if last.Error != nil || last.PeakMbps != last.SpeedMbps || last.TimeToPeak != 0 {
+		t.Errorf("peak %v after %v, speed %v (%v)", last.PeakMbps, last.TimeToPeak, last.SpeedMbps, last.Error)
+	}
+}
+
+func TestPeakSummary(t *testing.T) {
+	c := NewCollector()
+	for _, s := range []Stats{
+		{URL: "a", Direction: Download, Done: true, SizeBytes: 1, SpeedMbps: 40, PeakMbps: 60, TimeToPeak: 2 * time.Second},
+		{URL: "a", Direction: Download, Done: true, SizeBytes: 1, SpeedMbps: 50, PeakMbps: 80, TimeToPeak: 4 * time.Second},
+		// A run too short to peak sets no time to it.
+		{URL: "a", Direction: Download, Done: true, SizeBytes: 1, SpeedMbps: 30, PeakMbps: 30},
+	} {
+		c.Add(s)
+	}
+	if s := c.Summaries()[0]; s.PeakMbps != 80 || s.TimeToPeakMs != 3000 {
+		t.Errorf("peak %v after %vms, want 80 after 3000ms", s.PeakMbps, s.TimeToPeakMs)
+	}
+}
@@ -0,0 +1,50 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// preflight sends a HEAD request for target and records the advertised
+// size and ETag in stats. It uses its own client so the download that
+// follows still measures a cold connection.
+func (t *Tester) preflight(ctx context.Context, target Target, stats *Stats) error {
+	client, release := t.client(target)
+	defer release()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target.URL, nil)
+	if err != nil {
+		return err
+	}
+	target.prepare(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("preflight: %w", err)
+	}
+	resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return fmt.Errorf("preflight: %w", err)
+	}
+	if resp.ContentLength > 0 {
+		stats.ExpectedBytes = resp.ContentLength
+	}
+	stats.ETag = resp.Header.Get("ETag")
+	return nil
+}
+
+// checkLength compares a completed transfer against the expected size. An
+// unknown size (zero, as with chunked responses) always passes.
+func checkLength(got, expected int64) error {
+	if expected <= 0 || got == expected {
+		return nil
+	}
+	if got < expected {
+		return shortRead(got, expected)
+	}
+	return fmt.Errorf("long read: got %v of %v", ByteSize(got), ByteSize(expected))
+}
+
+func shortRead(got, expected int64) error {
+	return fmt.Errorf("short read: got %v of %v", ByteSize(got), ByteSize(expected))
+}
@@ -0,0 +1,84 @@
+package perf
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContentLengthValidation(t *testing.T) {
+	mux := http.NewServeMux()
+	// /early promises a megabyte and hangs up after 400kB.
+	mux.HandleFunc("GET /early", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000000")
+		w.Write(make([]byte, 400000))
+		w.(http.Flusher).Flush()
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	})
+	// /chunked has no length to compare with.
+	mux.HandleFunc("GET /chunked", func(w http.ResponseWriter, r *http.Request) {
+		for range 4 {
+			w.Write(make([]byte, 1000))
+			w.(http.Flusher).Flush()
+		}
+	})
+	// /changed advertises more on HEAD than its chunked GET sends.
+	mux.HandleFunc("HEAD /changed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5000")
+		w.Header().Set("ETag", `"v1"`)
+	})
+	mux.HandleFunc("GET /changed", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+		w.(http.Flusher).Flush()
+		w.Write(make([]byte, 1000))
+	})
+	// /nohead rejects HEAD.
+	mux.HandleFunc("/nohead", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Write(make([]byte, 1000))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	tester := New(Options{ProgressInterval: -1})
+	on := true
+
+	tests := []struct {
+		path      string
+		preflight bool
+		err       string
+		expected  int64
+		etag      string
+	}{
+		{"/early", false, "short read: got", 1000000, ""},
+		{"/chunked", false, "", 0, ""},
+		{"/chunked", true, "", 0, ""},
+		{"/changed", true, "short read: got", 5000, `"v1"`},
+		{"/changed", false, "", 0, ""},
+		{"/nohead", true, "preflight: unexpected status 405", 0, ""},
+	}
+	for _, tt := range tests {
+		target := Target{URL: srv.URL + tt.path}
+		if tt.preflight {
+			target.Preflight = &on
+		}
+		all := collect(tester.Test(context.Background(), target))
+		last := all[len(all)-1]
+		switch {
+		case tt.err == "" && last.Error != nil:
+			t.Errorf("%s, preflight %v: %v", tt.path, tt.preflight, last.Error)
+		case tt.err != "" && (last.Error == nil || !strings.Contains(last.Error.Error(), tt.err)):
+			t.Errorf("%s, preflight %v: err %v, want %q", tt.path, tt.preflight, last.Error, tt.err)
+		}
+		if last.ExpectedBytes != tt.expected || last.ETag != tt.etag {
+			t.Errorf("%s, preflight %v: expected %d bytes and etag %q, want %d and %q", tt.path, tt.preflight, last.ExpectedBytes, last.ETag, tt.expected, tt.etag)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package perf
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Profile picks some of the urls for a run: those named in URLs and those
+// in any of Groups. Iterations and Concurrency override the config's.
+type Profile struct {
+	URLs        []string `yaml:"urls"`
+	Groups      []string `yaml:"groups"`
+	Iterations  *int     `yaml:"iterations"`
+	Concurrency *int     `yaml:"concurrency"`
+}
+
+// selects reports whether p picks t.
+func (p Profile) selects(t Target) bool {
+	return t.Name != "" && slices.Contains(p.URLs, t.Name) || t.Group != "" && slices.Contains(p.Groups, t.Group)
+}
+
+// UseProfiles narrows c to the urls any of the named profiles picks, in
+// the order the urls are listed. Overrides are taken from the profiles in
+// the order named, so a later one wins.
+func (c Config) UseProfiles(names []string) (Config, error) {
+	if len(names) == 0 {
+		return c, nil
+	}
+	var profiles []Profile
+	for _, name := range names {
+		p, ok := c.Profiles[name]
+		if !ok {
+			return c, fmt.Errorf("no profile %q; %s", name, known("profiles", slices.Sorted(maps.Keys(c.Profiles))))
+		}
+		profiles = append(profiles, p)
+		if p.Iterations != nil {
+			c.Iterations = p.Iterations
+		}
+		if p.Concurrency != nil {
+			c.Concurrency = *p.Concurrency
+		}
+	}
+	var urls []Target
+	for _, t := range c.URLs {
+		if slices.ContainsFunc(profiles, func(p Profile) bool { return p.selects(t) }) {
+			urls = append(urls, t)
+		}
+	}
+	c.URLs = urls
+	return c, nil
+}
+
+// profileProblems checks that every profile picks from urls that exist.
+func (c Config) profileProblems(ps *Problems) {
+	var names, groups []string
+	for _, t := range c.URLs {
+		if t.Name != "" && !slices.Contains(names, t.Name) {
+			names = append(names, t.Name)
+		}
+		if t.Group != "" && !slices.Contains(groups, t.Group) {
+			groups = append(groups, t.Group)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Profiles)) {
+		p := c.Profiles[name]
+		prefix := "profiles." + name + "."
+		if len(p.URLs) == 0 && len(p.Groups) == 0 {
+			ps.Addf("profiles."+name, "picks no urls; list url names under urls or groups under groups")
+		}
+		for i, n := range p.URLs {
+			if !slices.Contains(names, n) {
+				ps.Addf(fmt.Sprintf("%surls[%d]", prefix, i), "no url is named %q; %s", n, known("url names", names))
+			}
+		}
+		for i, g := range p.Groups {
+			if !slices.Contains(groups, g) {
+				ps.Addf(fmt.Sprintf("%sgroups[%d]", prefix, i), "no url is in group %q; %s", g, known("groups", groups))
+			}
+		}
+		if p.Iterations != nil && *p.Iterations < 0 {
+			ps.Addf(prefix+"iterations", "must not be negative")
+		}
+		if p.Concurrency != nil && *p.Concurrency < 0 {
+			ps.Addf(prefix+"concurrency", "must not be negative")
+		}
+	}
+}
+
+// known lists the choices there are for a name, or says there are none.
+func known(what string, choices []string) string {
+	if len(choices) == 0 {
+		return "there are no " + what
+	}
+	return what + " are " + strings.Join(choices, ", ")
+}
@@ -0,0 +1,70 @@
+package perf
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestUseProfiles(t *testing.T) {
+	one, four, five := 1, 4, 5
+	config := Config{
+		URLs: []Target{
+			{URL: "https://example.com/a", Name: "a", Group: "cdn"},
+			{URL: "https://example.com/b", Name: "b"},
+			{URL: "https://example.com/c", Group: "cdn"},
+			{URL: "https://example.com/d", Name: "d", Group: "origin"},
+			{URL: "https://example.com/e"},
+		},
+		Concurrency: 2,
+		Profiles: map[string]Profile{
+			"quick":   {URLs: []string{"b"}, Iterations: &one},
+			"cdn":     {Groups: []string{"cdn"}, Concurrency: &four},
+			"origin":  {URLs: []string{"d"}, Groups: []string{"origin"}, Iterations: &five},
+			"mixed":   {URLs: []string{"d"}, Groups: []string{"cdn"}},
+			"nothing": {Groups: []string{"none"}},
+		},
+	}
+	tests := []struct {
+		profiles    []string
+		urls        []string
+		iterations  *int
+		concurrency int
+	}{
+		{nil, []string{"a", "b", "c", "d", "e"}, nil, 2},
+		{[]string{"quick"}, []string{"b"}, &one, 2},
+		{[]string{"cdn"}, []string{"a", "c"}, nil, 4},
+		// A url named and in a group is picked once.
+		{[]string{"origin"}, []string{"d"}, &five, 2},
+		{[]string{"mixed"}, []string{"a", "c", "d"}, nil, 2},
+		// Several profiles test the urls of all of them in config order, a
+		// later override winning.
+		{[]string{"origin", "quick"}, []string{"b", "d"}, &one, 2},
+		{[]string{"quick", "origin", "cdn"}, []string{"a", "b", "c", "d"}, &five, 4},
+		{[]string{"quick", "quick"}, []string{"b"}, &one, 2},
+		{[]string{"nothing"}, nil, nil, 2},
+	}
+	for _, tt := range tests {
+		got, err := config.UseProfiles(tt.profiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var urls []string
+		for _, u := range got.URLs {
+			urls = append(urls, u.URL[len("https://example.com/"):])
+		}
+		if !slices.Equal(urls, tt.urls) || got.Concurrency != tt.concurrency || got.Iterations != tt.iterations {
+			t.Errorf("profiles %v picked %v with concurrency %d, iterations %v; want %v, %d, %v", tt.profiles, urls, got.Concurrency, got.Iterations, tt.urls, tt.concurrency, tt.iterations)
+		}
+	}
+	if len(config.URLs) != 5 || config.Concurrency != 2 {
+		t.Error("UseProfiles changed the config it was called on")
+	}
+
+	_, err := config.UseProfiles([]string{"quick", "nightly"})
+	if want := `no profile "nightly"; profiles are cdn, mixed, nothing, origin, quick`; err == nil || err.Error() != want {
+		t.Errorf("unknown profile: %v, want %q", err, want)
+	}
+	if _, err := (Config{}).UseProfiles([]string{"quick"}); err == nil || err.Error() != `no profile "quick"; there are no profiles` {
+		t.Errorf("no profiles: %v", err)
+	}
+}
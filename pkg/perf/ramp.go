@@ -0,0 +1,149 @@
+package perf
+
+import (
+	"cmp"
+	"time"
+)
+
+// Defaults of a Ramp.
+const (
+	defaultRampResolution = 100 * time.Millisecond
+	defaultRampWindow     = 5 * time.Second
+	defaultRampShare      = 80
+)
+
+// Ramp samples the start of a transfer finely to time how quickly it
+// reaches its steady speed, as TCP slow start ramps up.
+type Ramp struct {
+	// Resolution is how often the bytes moved are read during Window,
+	// 100ms and 5s by default. Progress is still reported at the usual
+	// interval.
+	Resolution time.Duration `yaml:"resolution"`
+	Window     time.Duration `yaml:"window"`
+	// Share is how close to the steady speed the ramp ends, 80% by
+	// default.
+	Share Percent `yaml:"share"`
+}
+
+// rampProblems adds the problems of the ramp setting of t, with prefix
+// naming it.
+func (t Target) rampProblems(ps *Problems, prefix string) {
+	r := t.Ramp
+	if r.Resolution < 0 {
+		ps.Addf(prefix+"ramp.resolution", "must not be negative, got %v", r.Resolution)
+	}
+	if r.Window < 0 {
+		ps.Addf(prefix+"ramp.window", "must not be negative, got %v", r.Window)
+	}
+	if r.Resolution > 0 && r.Resolution >= cmp.Or(r.Window, defaultRampWindow) {
+		ps.Addf(prefix+"ramp.resolution", "must be shorter than the window, %v", cmp.Or(r.Window, defaultRampWindow))
+	}
+	if t.Direction() == Latency {
+		ps.Addf(prefix+"ramp", "only applies to downloads and uploads")
+	}
+}
+
+// rampTrace is the count of bytes moved at each fine tick of a ramp
+// window.
+type rampTrace struct {
+	share  float64
+	points []rampPoint
+}
+
+type rampPoint struct {
+	at time.Time
+	n  int64
+}
+
+func newRampTrace(r *Ramp) *rampTrace {
+	if r == nil {
+		return nil
+	}
+	return &rampTrace{share: float64(cmp.Or(r.Share, defaultRampShare)) / 100}
+}
+
+func (r *rampTrace) add(now time.Time, n int64) {
+	r.points = append(r.points, rampPoint{now, n})
+}
+
+// result returns how long after start the transfer, which moved n bytes
+// by end, first went at least share of its steady speed over a tick, and
+// how many bytes it had moved by then. The steady speed is that after the
+// ramp window, or over the second half of a transfer shorter than twice
+// the window. Zeros mean it never got there within the window.
+func (r *rampTrace) result(n int64, start, end time.Time) (time.Duration, int64) {
+	var points []rampPoint
+	for _, p := range r.points {
+		if p.at.After(start) && p.at.Before(end) {
+			points = append(points, p)
+		}
+	}
+	if len(points) == 0 {
+		return 0, 0
+	}
+	last := points[len(points)-1]
+	from, fromN := last.at, last.n
+	if end.Sub(start) <= 2*last.at.Sub(start) {
+		half := start.Add(end.Sub(start) / 2)
+		fromN = r.bytesAt(half, start, points)
+		from = half
+	}
+	if !end.After(from) || n <= fromN {
+		return 0, 0
+	}
+	steady := float64(n-fromN) / end.Sub(from).Seconds()
+	prev := rampPoint{start, 0}
+	for _, p := range points {
+		if float64(p.n-prev.n)/p.at.Sub(prev.at).Seconds() >= r.share*steady {
+			return p.at.Sub(start), p.n
+		}
+		prev = p
+	}
+	return 0, 0
+}
+
+// bytesAt interpolates the bytes moved at t between the points around it.
+func (r *rampTrace) bytesAt(t, start time.Time, points []rampPoint) int64 {
+	prev := rampPoint{start, 0}
+	for _, p := range points {
+		if !p.at.Before(t) {
+			frac := float64(t.Sub(prev.at)) / float64(p.at.Sub(prev.at))
+			return prev.n + int64(frac*float64(p.n-prev.n))
+		}
+		prev = p
+	}
+	return prev.n
+}
+
+// progressTicker paces the progress of a transfer. With a ramp it ticks at
+// the ramp's resolution through its window, recording the bytes moved, and
+// only every interval of those ticks is due for a progress snapshot; after
+// the window it ticks at the interval.
+type progressTicker struct {
+	*time.Ticker
+	every        time.Duration
+	fine, window time.Duration
+	began, next  time.Time
+}
+
+// due records n bytes moved at now for the ramp of m, and reports whether
+// the tick is due for a progress snapshot.
+func (p *progressTicker) due(now time.Time, m *meter, n int64) bool {
+	if p.fine == 0 {
+		return true
+	}
+	m.ramp.add(now, n)
+	if now.Sub(p.began) >= p.window {
+		p.Reset(p.every)
+		p.fine = 0
+	}
+	// A fine tick a little early still counts, so progress keeps its
+	// pace.
+	if now.Before(p.next.Add(-p.fine / 2)) {
+		return false
+	}
+	for !p.next.After(now.Add(p.fine / 2)) {
+		p.next = p.next.Add(p.every)
+	}
+	return true
+}
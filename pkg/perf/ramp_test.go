@@ -0,0 +1,151 @@
+package perf
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// rampServer sends 4kB every 20ms for its first 300ms and 64kB every 20ms
+// after that, until 1.2s are up, like a connection out of slow start.
+func rampServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		slow, fast := make([]byte, 4<<10), make([]byte, 64<<10)
+		for time.Since(start) < 1200*time.Millisecond {
+			chunk := fast
+			if time.Since(start) < 300*time.Millisecond {
+				chunk = slow
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(func() {
+		srv.CloseClientConnections()
+		srv.Close()
+	})
+	return srv
+}
+
+func TestRamp(t *testing.T) {
+	srv := rampServer(t)
+	var progress int
+	var last Stats
+	for s := range New(Options{ProgressInterval: 200 * time.Millisecond}).Test(context.Background(), Target{URL: srv.URL, Ramp: &Ramp{Resolution: 50 * time.Millisecond, Window: time.Second}}) {
+		if s.Kind == KindProgress {
+			progress++
+		}
+		last = s
+	}
+	if last.Error != nil {
+		t.Fatal(last.Error)
+	}
+	// Up to speed a tick or two after the slow 300ms, with little of the
+	// body moved by then.
+	if last.RampTime < 250*time.Millisecond || last.RampTime > 700*time.Millisecond {
+		t.Errorf("ramp time %v, want about 350ms", last.RampTime)
+	}
+	if last.RampBytes <= 0 || last.RampBytes > last.SizeBytes/2 {
+		t.Errorf("%d of %d bytes moved during the ramp", last.RampBytes, last.SizeBytes)
+	}
+	// The fine ticks are not each reported as progress.
+	if progress < 3 || progress > 9 {
+		t.Errorf("%d progress snapshots over 1.2s at 200ms", progress)
+	}
+
+	// Without a ramp nothing is timed.
+	all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL}))
+	if last := all[len(all)-1]; last.RampTime != 0 || last.RampBytes != 0 {
+		t.Errorf("ramp %v, %d bytes without a ramp", last.RampTime, last.RampBytes)
+	}
+}
+
+func TestRampTrace(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tick := 100 * time.Millisecond
+	// trace moves the bytes of each 100ms tick given, then 1MB per tick.
+	trace := func(share Percent, until time.Duration, ticks ...int64) (*rampTrace, int64) {
+		r := newRampTrace(&Ramp{Share: share})
+		var n int64
+		for i := 1; time.Duration(i)*tick <= until; i++ {
+			step := int64(1e6)
+			if i <= len(ticks) {
+				step = ticks[i-1]
+			}
+			n += step
+			r.add(start.Add(time.Duration(i)*tick), n)
+		}
+		return r, n
+	}
+	tests := []struct {
+		name  string
+		share Percent
+		// window is how long the ticks are traced, end when the transfer
+		// ended, with steady bytes per tick after the window.
+		window, end time.Duration
+		ticks       []int64
+		steady      int64
+		ramp        time.Duration
+		bytes       int64
+	}{
+		// Doubling from 10kB, the fifth tick is the first within 80% of a
+		// steady 1MB per tick.
+		{"slow start", 0, 5 * time.Second, 10 * time.Second, []int64{10e3, 50e3, 200e3, 600e3, 900e3}, 1e6, 500 * time.Millisecond, 1.76e6},
+		{"higher share", 95, 5 * time.Second, 10 * time.Second, []int64{10e3, 50e3, 200e3, 600e3, 900e3}, 1e6, 600 * time.Millisecond, 2.76e6},
+		{"at speed", 0, 5 * time.Second, 10 * time.Second, nil, 1e6, 100 * time.Millisecond, 1e6},
+		// A transfer shorter than twice the window is steady over its
+		// second half.
+		{"short", 0, 5 * time.Second, 2 * time.Second, []int64{100e3, 300e3}, 0, 300 * time.Millisecond, 1.4e6},
+		// Speeding up past the window, it never got near the steady speed.
+		{"late", 0, 5 * time.Second, 10 * time.Second, nil, 10e6, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, n := trace(tt.share, min(tt.window, tt.end-tick), tt.ticks...)
+			if tt.steady > 0 {
+				n += tt.steady * int64((tt.end-tt.window)/tick)
+			} else {
+				n += 1e6
+			}
+			ramp, bytes := r.result(n, start, start.Add(tt.end))
+			if ramp != tt.ramp || bytes != tt.bytes {
+				t.Errorf("ramp %v with %d bytes, want %v with %d", ramp, bytes, tt.ramp, tt.bytes)
+			}
+		})
+	}
+	// No ticks, no ramp.
+	if ramp, bytes := newRampTrace(&Ramp{}).result(1e6, start, start.Add(time.Second)); ramp != 0 || bytes != 0 {
+		t.Errorf("ramp %v with %d bytes from no ticks", ramp, bytes)
+	}
+	if newRampTrace(nil) != nil {
+		t.Error("trace without a ramp")
+	}
+}
+
+func TestProgressTicker(t *testing.T) {
+	began := time.Unix(1000, 0)
+	p := &progressTicker{Ticker: time.NewTicker(time.Hour), every: time.Second, fine: 100 * time.Millisecond, window: 3 * time.Second, began: began, next: began.Add(time.Second)}
+	defer p.Stop()
+	m := &meter{ramp: newRampTrace(&Ramp{})}
+	var due []int
+	for i := 1; i <= 40; i++ {
+		// Ticks run a little late, as real ones do.
+		if p.due(began.Add(time.Duration(i)*100*time.Millisecond+3*time.Millisecond), m, int64(i)) {
+			due = append(due, i)
+		}
+	}
+	// Every tenth fine tick is due through the window, and every tick of
+	// the coarse ticker after it.
+	if len(due) != 13 || due[0] != 10 || due[1] != 20 || due[2] != 30 || due[3] != 31 {
+		t.Errorf("due at ticks %v", due)
+	}
+	if len(m.ramp.points) != 30 || p.fine != 0 {
+		t.Errorf("%d ticks traced, fine %v after the window", len(m.ramp.points), p.fine)
+	}
+}
@@ -0,0 +1,86 @@
+package perf
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket over bytes. Reads take their tokens afterwards
+// and wait while the bucket is in debt, so concurrent readers sharing one
+// limiter queue up behind each other.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter returns a limiter for r, or nil when r is not positive.
+func newLimiter(r Rate) *limiter {
+	if r <= 0 {
+		return nil
+	}
+	rate := float64(r) / 8
+	// A burst of 100ms keeps the rate steady at one-second resolution.
+	return &limiter{rate: rate, burst: rate / 10, tokens: rate / 10, last: time.Now()}
+}
+
+// wait takes n tokens and sleeps until the bucket is no longer in debt. It
+// returns early with ctx's error when ctx is done.
+func (l *limiter) wait(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type throttledReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*limiter
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	n, err := t.r.Read(b)
+	for _, l := range t.limiters {
+		if werr := l.wait(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// throttle wraps r so reads stay within the transfer's limiter and the
+// Tester-wide one. Either may be nil.
+func (t *Tester) throttle(ctx context.Context, r io.Reader, transfer *limiter) io.Reader {
+	var limiters []*limiter
+	for _, l := range []*limiter{transfer, t.total} {
+		if l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+	if len(limiters) == 0 {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, limiters: limiters}
+}
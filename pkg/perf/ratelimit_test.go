@@ -0,0 +1,63 @@
+package perf
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	srv := payloadServer(t, 32<<10, 0)
+	// 7.5MB at 40 Mbps takes 1.5s, long enough for the 100ms burst to
+	// stay well inside the tolerance.
+	url := srv.URL + "/bytes/7500000"
+
+	t.Run("per transfer", func(t *testing.T) {
+		t.Parallel()
+		tester := New(Options{RateLimit: 40e6, ProgressInterval: -1})
+		last, err := tester.DownloadAndWait(context.Background(), url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(last.SpeedMbps-40)/40 > 0.1 {
+			t.Errorf("%v Mbps, want within 10%% of 40", last.SpeedMbps)
+		}
+	})
+	t.Run("total", func(t *testing.T) {
+		t.Parallel()
+		// Two transfers at once share the Tester's cap, so together they
+		// take as long as one at 40 Mbps each would.
+		tester := New(Options{TotalRateLimit: 80e6, ProgressInterval: -1})
+		targets := []Target{{URL: url}, {URL: url + "?b"}}
+		start := time.Now()
+		var bytes int64
+		for s := range tester.Run(context.Background(), targets, 2) {
+			if s.Final() && s.Error != nil {
+				t.Fatal(s.Error)
+			}
+			if s.Final() {
+				bytes += s.SizeBytes
+			}
+		}
+		if mbps := float64(bytes*8) / 1e6 / time.Since(start).Seconds(); bytes != 15e6 || math.Abs(mbps-80)/80 > 0.1 {
+			t.Errorf("%d bytes at %v Mbps together, want 15000000 within 10%% of 80", bytes, mbps)
+		}
+	})
+	t.Run("cancelled", func(t *testing.T) {
+		t.Parallel()
+		// At 80 kbps a single 32kB read waits for seconds.
+		tester := New(Options{RateLimit: 80e3, ProgressInterval: -1})
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		last, err := tester.DownloadAndWait(ctx, url)
+		if took := time.Since(start); took > time.Second {
+			t.Errorf("stopped %v after starting, sleeping past the cancel", took)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) || last.Done {
+			t.Errorf("kind %q, err %v, want the deadline", last.Kind, err)
+		}
+	})
+}
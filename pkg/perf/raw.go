@@ -0,0 +1,249 @@
+package perf
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// URL schemes tested without HTTP.
+const (
+	SchemeFTP  = "ftp"
+	SchemeTCP  = "tcp"
+	SchemeFile = "file"
+)
+
+// scheme returns the scheme of rawURL in lower case.
+func scheme(rawURL string) string {
+	s, _, _ := strings.Cut(rawURL, "://")
+	return strings.ToLower(s)
+}
+
+// opener connects to a source that is not HTTP and returns its body and the
+// body size, or -1 when it is unknown. Connection phases go on timer.
+type opener func(ctx context.Context, timer *phaseTimer) (io.ReadCloser, int64, error)
+
+// rawDownload reads the body open returns with the same limits, ticks and
+// final snapshot as an HTTP download. protocol names it in Stats.
+func (t *Tester) rawDownload(ctx context.Context, target Target, protocol string, open opener) <-chan Stats {
+	limits := target.Limits
+	ctx, cancel := t.withTimeout(ctx)
+	e := t.newEmitter(ctx, target)
+
+	go func() {
+		defer close(e.ch)
+		defer cancel()
+
+		base := Stats{URL: target.URL, Direction: Download, Protocol: protocol, Adaptive: target.Mode == ModeAdaptive}
+		timer := t.phaseTimer(target.URL)
+		body, size, err := open(ctx, timer)
+		timer.apply(&base)
+		if err != nil {
+			if ctx.Err() != nil {
+				e.interrupt(base, 0, time.Time{})
+			} else {
+				base.Error = err
+				e.send(base)
+			}
+			return
+		}
+		defer body.Close()
+		if size > 0 {
+			base.ExpectedBytes = size
+		}
+
+		readCtx, stopReading := context.WithCancel(ctx)
+		defer stopReading()
+		var downloaded atomic.Int64
+		r := t.throttle(readCtx, newShaper(target.Simulate).reader(readCtx, body), newLimiter(target.RateLimit))
+		sum := target.digest()
+		if sum != nil {
+			r = io.TeeReader(r, sum)
+		}
+		if check := target.patternCheck(0); check != nil {
+			r = io.TeeReader(r, check)
+		}
+		out, err := target.openSink()
+		if err != nil {
+			base.Error = err
+			e.send(base)
+			return
+		}
+		if out != nil {
+			defer out.close()
+			r = io.TeeReader(r, out)
+		}
+		var lastDownloaded int64
+		start := time.Now()
+		lastTick := start
+		done := make(chan error, 1)
+		go func() {
+			buf, release := t.buffer()
+			defer release()
+			done <- drain(r, buf, int64(limits.MaxBytes), &downloaded)
+		}()
+		stop := func() {
+			stopReading()
+			body.Close()
+			<-done
+		}
+
+		streaming := base.ExpectedBytes == 0 && limits == Limits{}
+		if streaming {
+			limits.MaxDuration = streamCap
+			t.log().Info("source has no length, stopping it after the stream cap", "url", target.URL, "cap", streamCap)
+		}
+		ticker := t.ticker(target)
+		defer ticker.Stop()
+		deadline := limits.deadline()
+		defer deadline.Stop()
+		m := t.newMeter(target)
+		st := t.stabilizer(target)
+
+		finish := func(truncated bool) {
+			stats := base
+			stats.Done = true
+			stats.Truncated = truncated
+			m.final(&stats, downloaded.Load(), start, time.Now())
+			stats.TCP = timer.tcpInfo()
+			stats.WireBytes, stats.BodyBytes = stats.SizeBytes, stats.SizeBytes
+			if out != nil {
+				out.done(&stats)
+			}
+			e.send(stats)
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				stop()
+				e.interrupt(base, downloaded.Load(), start)
+				return
+			case <-deadline.C:
+				stop()
+				finish(streaming)
+				return
+			case now := <-ticker.C:
+				n := downloaded.Load()
+				if !ticker.due(now, m, n) {
+					continue
+				}
+				stats := progress(base, m, n, lastDownloaded, start, lastTick, now)
+				if !e.progress(stats) {
+					stop()
+					e.interrupt(base, downloaded.Load(), start)
+					return
+				}
+				lastDownloaded, lastTick = n, now
+				if err := cmp.Or(m.stall.aborted(), m.floor.aborted()); err != nil {
+					stop()
+					stats := base
+					stats.Error = err
+					var slow *SlowError
+					stats.SlowAborted = errors.As(err, &slow)
+					m.final(&stats, downloaded.Load(), start, time.Now())
+					stats.TCP = timer.tcpInfo()
+					e.send(stats)
+					return
+				}
+				if mbps, ok := st.add(stats); ok {
+					stop()
+					base.StableMbps, base.StableAfter = mbps, now.Sub(start)
+					finish(false)
+					return
+				}
+			case err := <-done:
+				n := downloaded.Load()
+				switch {
+				case errors.Is(err, errLimitReached):
+					err = nil
+				case err == io.EOF:
+					err = checkLength(n, base.ExpectedBytes)
+					if err == nil && sum != nil {
+						err = sum.verify()
+					}
+				}
+				switch {
+				case err == nil:
+					finish(false)
+				case ctx.Err() != nil:
+					e.interrupt(base, n, start)
+				default:
+					stats := base
+					stats.Error = err
+					stats.setSpeed(n, time.Since(start))
+					e.send(stats)
+				}
+				return
+			}
+		}
+	}()
+
+	return e.ch
+}
+
+// dialRaw connects to addr the way target's HTTP connections would be made,
+// reporting the connection on timer.
+func (t *Tester) dialRaw(ctx context.Context, target Target, timer *phaseTimer, addr string) (net.Conn, error) {
+	trace := timer.trace()
+	trace.ConnectStart("tcp", addr)
+	conn, err := dialContext(target, t.opts.Resolver, t.opts.ConnectTimeout)(timer.context(ctx), "tcp", addr)
+	trace.ConnectDone("tcp", addr, err)
+	if err != nil {
+		return nil, err
+	}
+	trace.GotConn(httptrace.GotConnInfo{Conn: conn})
+	return conn, nil
+}
+
+// openTCP reads a raw TCP connection to tcp://host:port. With ?bytes=N the
+// download ends after N bytes, and fails if the server closes it sooner;
+// without it, it runs until the server closes it or a limit is hit.
+func (t *Tester) openTCP(target Target) opener {
+	return func(ctx context.Context, timer *phaseTimer) (io.ReadCloser, int64, error) {
+		u, size, err := parseTCP(target.URL)
+		if err != nil {
+			return nil, 0, err
+		}
+		conn, err := t.dialRaw(ctx, target, timer, u.Host)
+		if err != nil {
+			return nil, 0, err
+		}
+		if size < 0 {
+			return conn, -1, nil
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(conn, size), conn}, size, nil
+	}
+}
+
+// parseTCP parses a tcp:// URL and its bytes parameter, which is -1 when
+// it is not set.
+func parseTCP(raw string) (*url.URL, int64, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	if u.Port() == "" {
+		return nil, 0, fmt.Errorf("tcp URL needs a port, got %q", raw)
+	}
+	v := u.Query().Get("bytes")
+	if v == "" {
+		return u, -1, nil
+	}
+	size, err := ParseByteSize(v)
+	if err != nil || size <= 0 {
+		return nil, 0, fmt.Errorf("tcp URL bytes must be a positive size, got %q", v)
+	}
+	return u, int64(size), nil
+}
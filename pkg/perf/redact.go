@@ -0,0 +1,105 @@
+package perf
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Fields tagged secret:"true" hold credentials, such as tokens and signing
+// keys, that Redacted leaves out; on a map it is every value.
+
+// Redacted returns c as plain values keyed by their YAML names, ready to be
+// encoded as JSON, with its secrets replaced by Redacted and the passwords
+// of URLs removed. Unset fields are left out.
+func (c Config) Redacted() map[string]any {
+	m, _ := plain(reflect.ValueOf(c), false).(map[string]any)
+	return m
+}
+
+var (
+	stringer     = reflect.TypeFor[fmt.Stringer]()
+	durationType = reflect.TypeFor[time.Duration]()
+)
+
+// plain converts v to maps, slices and scalars, redacting it all when
+// secret is set.
+func plain(v reflect.Value, secret bool) any {
+	switch {
+	case !v.IsValid(), (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil():
+		return nil
+	case secret && v.Kind() == reflect.Map:
+		m := map[string]any{}
+		for _, k := range v.MapKeys() {
+			m[fmt.Sprint(k.Interface())] = Redacted
+		}
+		return m
+	case secret:
+		return Redacted
+	case v.Type() == durationType:
+		return v.Interface().(time.Duration).String()
+	case v.Type().Implements(stringer) && v.Kind() != reflect.Pointer:
+		return v.Interface().(fmt.Stringer).String()
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return plain(v.Elem(), false)
+	case reflect.Struct:
+		m := map[string]any{}
+		plainFields(v, m)
+		return m
+	case reflect.Slice, reflect.Array:
+		s := make([]any, v.Len())
+		for i := range s {
+			s[i] = plain(v.Index(i), false)
+		}
+		return s
+	case reflect.Map:
+		m := map[string]any{}
+		for _, k := range v.MapKeys() {
+			m[fmt.Sprint(k.Interface())] = plain(v.MapIndex(k), false)
+		}
+		return m
+	case reflect.String:
+		return redactURL(v.String())
+	}
+	return v.Interface()
+}
+
+// plainFields adds the exported fields of struct v to m, those of inline
+// structs among them.
+func plainFields(v reflect.Value, m map[string]any) {
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if opts == "inline" {
+			plainFields(v.Field(i), m)
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if !v.Field(i).IsZero() {
+			m[name] = plain(v.Field(i), field.Tag.Get("secret") == "true")
+		}
+	}
+}
+
+// redactURL removes the password of s if it is a URL with one.
+func redactURL(s string) string {
+	if !strings.Contains(s, "@") {
+		return s
+	}
+	if u, err := url.Parse(s); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.User(u.User.Username())
+			return u.String()
+		}
+	}
+	return s
+}
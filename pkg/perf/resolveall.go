@@ -0,0 +1,145 @@
+package perf
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// expand returns the targets Run dispatches: every resolve_all target is
+// replaced by one copy per distinct address of its host, pinned to that
+// address, and every dualstack_compare target by one copy per address
+// family. All such hosts are looked up in parallel before the first
+// transfer starts, as are the sizes of the bodies of offset_samples
+// targets. A target whose lookup fails is kept and reports the
+// error when tested.
+func (t *Tester) expand(ctx context.Context, targets []Target) []Target {
+	copies := make([][]Target, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		var split func(context.Context, Target) []Target
+		switch {
+		case target.ResolveAll:
+			split = t.pinAll
+		case target.DualstackCompare:
+			split = t.families
+		case target.SizeSweep != nil:
+			copies[i] = target.sizes()
+			continue
+		case target.OffsetSamples > 0:
+			split = t.offsets
+		default:
+			copies[i] = []Target{target}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			copies[i] = split(ctx, target)
+		}()
+	}
+	wg.Wait()
+	return slices.Concat(copies...)
+}
+
+// pinAll returns a copy of target pinned to each address of its host, or
+// target itself carrying the lookup error.
+func (t *Tester) pinAll(ctx context.Context, target Target) []Target {
+	addrs, err := t.lookupAll(ctx, target)
+	if err != nil {
+		target.resolveErr = fmt.Errorf("resolve_all: %w", err)
+		return []Target{target}
+	}
+	pinned := make([]Target, len(addrs))
+	for i, ip := range addrs {
+		pinned[i] = target.pin(ip)
+	}
+	return pinned
+}
+
+// lookupAll returns the distinct addresses of target's host in the order
+// the resolver gave them, limited to its ip_version.
+func (t *Tester) lookupAll(ctx context.Context, target Target) ([]string, error) {
+	u, err := url.Parse(target.URL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+	network := "ip"
+	switch t.resolve(target).IPVersion {
+	case "4":
+		network = "ip4"
+	case "6":
+		network = "ip6"
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if v4 := ip.To4() != nil; (network == "ip4" && !v4) || (network == "ip6" && v4) {
+			return nil, fmt.Errorf("%s is not an %s address", host, map[string]string{"ip4": "IPv4", "ip6": "IPv6"}[network])
+		}
+		return []string{host}, nil
+	}
+	resolver := t.opts.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	found, err := resolver.LookupNetIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, addr := range found {
+		if ip := addr.Unmap().String(); !slices.Contains(addrs, ip) {
+			addrs = append(addrs, ip)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s has no addresses", host)
+	}
+	return addrs, nil
+}
+
+// pin returns a copy of t that dials ip, named after it. The request keeps
+// the URL's host for the Host header and SNI.
+func (t Target) pin(ip string) Target {
+	u, _ := url.Parse(t.URL)
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443", SchemeFTP: "21"}[u.Scheme]
+	}
+	pins := maps.Clone(t.Resolve)
+	if pins == nil {
+		pins = Pins{}
+	}
+	pins[net.JoinHostPort(strings.ToLower(u.Hostname()), port)] = ip
+	t.Resolve = pins
+	t.pinnedIP = ip
+	t.Name = fmt.Sprintf("%s @ %s", Stats{URL: t.URL, Name: t.Name}.DisplayName(), ip)
+	return t
+}
+
+// RankIPs returns the summaries of resolve_all targets, those with an IP,
+// grouped by URL in the order the URLs first appear and fastest first
+// within each URL.
+func RankIPs(summaries []Summary) []Summary {
+	first := map[string]int{}
+	var ranked []Summary
+	for _, s := range summaries {
+		if s.IP == "" {
+			continue
+		}
+		if _, ok := first[s.URL]; !ok {
+			first[s.URL] = len(first)
+		}
+		ranked = append(ranked, s)
+	}
+	slices.SortStableFunc(ranked, func(a, b Summary) int {
+		return cmp.Or(cmp.Compare(first[a.URL], first[b.URL]), cmp.Compare(b.MeanMbps, a.MeanMbps))
+	})
+	return ranked
+}
@@ -0,0 +1,146 @@
+package perf
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResolveAll(t *testing.T) {
+	dns := newDNSStub(t)
+	// Duplicates of an address are tested once.
+	dns.answerWith("127.0.0.1", "127.0.0.2", "127.0.0.1", "127.0.0.3")
+	// One server on every loopback address, slower the higher the address.
+	ln, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	hits := map[string]int{}
+	inFlight, most := 0, 0
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		local := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		ip, _, _ := net.SplitHostPort(local.String())
+		mu.Lock()
+		hits[ip]++
+		inFlight++
+		most = max(most, inFlight)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+		// The request still names the host, for the Host header and SNI.
+		if !strings.HasPrefix(r.Host, "example.com:") || r.TLS.ServerName != "example.com" {
+			http.Error(w, "host "+r.Host+", sni "+r.TLS.ServerName, http.StatusMisdirectedRequest)
+			return
+		}
+		w.Header().Set("Content-Length", "40000")
+		pause := time.Duration(net.ParseIP(ip).To4()[3]-1) * 20 * time.Millisecond
+		for range 4 {
+			w.Write(make([]byte, 10000))
+			w.(http.Flusher).Flush()
+			time.Sleep(pause)
+		}
+	}))
+	srv.Listener.Close()
+	srv.Listener = ln
+	srv.StartTLS()
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	resolver, err := NewResolver(dns.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tester := New(Options{
+		ProgressInterval: -1,
+		Resolver:         resolver,
+		TLSConfig:        &tls.Config{RootCAs: srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs},
+	})
+	url := "https://example.com:" + port + "/file"
+	c := NewCollector()
+	for s := range tester.Run(context.Background(), []Target{{URL: url, Name: "mirror", ResolveAll: true}}, 2) {
+		if s.Final() {
+			if s.Error != nil {
+				t.Errorf("%s: %v", s.Name, s.Error)
+			}
+			if want := "mirror @ " + s.PinnedIP; s.Name != want || s.URL != url {
+				t.Errorf("result for %s named %q, url %s", s.PinnedIP, s.Name, s.URL)
+			}
+		}
+		c.Add(s)
+	}
+	mu.Lock()
+	if len(hits) != 3 || hits["127.0.0.1"] != 1 || hits["127.0.0.2"] != 1 || hits["127.0.0.3"] != 1 {
+		t.Errorf("requests by address %v, want one to each", hits)
+	}
+	if most > 2 {
+		t.Errorf("%d transfers at once past a concurrency of 2", most)
+	}
+	mu.Unlock()
+
+	// The summary ranks the addresses fastest first.
+	var ranked []string
+	for _, s := range RankIPs(c.Summaries()) {
+		ranked = append(ranked, s.IP)
+	}
+	if got := strings.Join(ranked, " "); got != "127.0.0.1 127.0.0.2 127.0.0.3" {
+		t.Errorf("ranked %s", got)
+	}
+}
+
+func TestLookupAll(t *testing.T) {
+	resolver, err := NewResolver(newDNSStub(t).LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tester := New(Options{Resolver: resolver})
+	tests := []struct {
+		target Target
+		want   string
+		err    string
+	}{
+		{Target{URL: "http://192.0.2.1/"}, "192.0.2.1", ""},
+		{Target{URL: "http://[2001:db8::1]/"}, "2001:db8::1", ""},
+		{Target{URL: "http://192.0.2.1/", IPVersion: "6"}, "", "192.0.2.1 is not an IPv6 address"},
+		{Target{URL: "http://[2001:db8::1]/", IPVersion: "4"}, "", "2001:db8::1 is not an IPv4 address"},
+		{Target{URL: "http://mirror.example/", IPVersion: "4"}, "127.0.0.1", ""},
+	}
+	for _, tt := range tests {
+		addrs, err := tester.lookupAll(context.Background(), tt.target)
+		if got := strings.Join(addrs, " "); got != tt.want || (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s ip_version %q: %v, %v; want %q, %q", tt.target.URL, tt.target.IPVersion, addrs, err, tt.want, tt.err)
+		}
+	}
+
+	// A lookup failure leaves the target to report it.
+	pinned := tester.pinAll(context.Background(), Target{URL: "http://[2001:db8::1]/", IPVersion: "4"})
+	if len(pinned) != 1 || pinned[0].resolveErr == nil || !strings.HasPrefix(pinned[0].resolveErr.Error(), "resolve_all: ") {
+		t.Errorf("pinAll of an unresolvable target %+v", pinned)
+	}
+}
+
+func TestPin(t *testing.T) {
+	target := Target{URL: "https://Mirror.example.com/file", Resolve: Pins{"other.example.com:443": "192.0.2.9"}}
+	pinned := target.pin("192.0.2.1")
+	if pinned.Resolve["mirror.example.com:443"] != "192.0.2.1" || pinned.Resolve["other.example.com:443"] != "192.0.2.9" || pinned.pinnedIP != "192.0.2.1" {
+		t.Errorf("pinned %+v", pinned)
+	}
+	if pinned.Name != "https://Mirror.example.com/file @ 192.0.2.1" {
+		t.Errorf("pinned name %q", pinned.Name)
+	}
+	if len(target.Resolve) != 1 {
+		t.Errorf("pin changed the original pins %v", target.Resolve)
+	}
+	if got := (Target{URL: "ftp://mirror.example.com/file"}).pin("192.0.2.1").Resolve; got["mirror.example.com:21"] != "192.0.2.1" {
+		t.Errorf("ftp pins %v", got)
+	}
+}
@@ -0,0 +1,172 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// NewResolver returns a resolver that sends every lookup to server, given
+// as an IP with an optional port for classic DNS or as an https:// URL for
+// DNS over HTTPS. An empty server returns nil, the system resolver.
+func NewResolver(server string) (*net.Resolver, error) {
+	if server == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(server, "https://") {
+		u, err := url.Parse(server)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("resolver: invalid DoH URL %q", server)
+		}
+		doh := &http.Client{Timeout: 10 * time.Second}
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return &dohConn{ctx: ctx, client: doh, url: server}, nil
+			},
+		}, nil
+	}
+	addr := server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		addr = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("resolver: want ip[:port] or an https:// URL, got %q", server)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
+
+// dohConn carries the Go resolver's TCP-framed DNS messages over HTTPS
+// (RFC 8484). Each framed query written becomes one POST; its answer is
+// framed again for the following reads.
+type dohConn struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+	query  bytes.Buffer
+	answer bytes.Reader
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.query.Write(b)
+	for c.query.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.query.Bytes()))
+		if c.query.Len() < 2+size {
+			break
+		}
+		msg := make([]byte, 2+size)
+		c.query.Read(msg)
+		answer, err := c.exchange(msg[2:])
+		if err != nil {
+			return 0, err
+		}
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(answer)))
+		c.answer.Reset(append(framed, answer...))
+	}
+	return len(b), nil
+}
+
+func (c *dohConn) exchange(msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("resolver: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("resolver: %s answered %s", c.url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.answer.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.answer.Read(b)
+}
+
+func (c *dohConn) Close() error                     { return nil }
+func (c *dohConn) LocalAddr() net.Addr              { return dohAddr(c.url) }
+func (c *dohConn) RemoteAddr() net.Addr             { return dohAddr(c.url) }
+func (c *dohConn) SetDeadline(time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(time.Time) error { return nil }
+
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
+
+// Pins maps host:port to the IP it is dialed at, like curl's --resolve. In
+// YAML it is one "host:port:ip" string or a list of them.
+type Pins map[string]string
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (p *Pins) UnmarshalYAML(node *yaml.Node) error {
+	var entries []string
+	if node.Kind == yaml.ScalarNode {
+		entries = []string{node.Value}
+	} else if err := node.Decode(&entries); err != nil {
+		return err
+	}
+	*p = Pins{}
+	for _, entry := range entries {
+		host, rest, _ := strings.Cut(entry, ":")
+		port, ip, _ := strings.Cut(rest, ":")
+		ip = strings.Trim(ip, "[]")
+		if n, err := strconv.Atoi(port); host == "" || err != nil || n < 1 || n > 65535 || net.ParseIP(ip) == nil {
+			return decodeError(node, fmt.Errorf("resolve %q: want host:port:ip", entry))
+		}
+		(*p)[net.JoinHostPort(strings.ToLower(host), port)] = ip
+	}
+	return nil
+}
+
+// pinned dials the pinned address of addr instead of resolving it. The
+// pin is reported to the request's trace as a lookup so it shows up as the
+// resolved IP.
+func pinned(pins Pins, dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ip, ok := pins[net.JoinHostPort(strings.ToLower(host), port)]
+		if !ok {
+			return dial(ctx, network, addr)
+		}
+		if trace := httptrace.ContextClientTrace(ctx); trace != nil {
+			if trace.DNSStart != nil {
+				trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+			}
+			if trace.DNSDone != nil {
+				trace.DNSDone(httptrace.DNSDoneInfo{Addrs: []net.IPAddr{{IP: net.ParseIP(ip)}}})
+			}
+		}
+		return dial(ctx, network, net.JoinHostPort(ip, port))
+	}
+}
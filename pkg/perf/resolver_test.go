@@ -0,0 +1,201 @@
+package perf
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// dnsStub answers A queries for every name with 127.0.0.1, or the IPv4
+// addresses given to answerWith, AAAA queries with the IPv6 ones, over
+// UDP, and other queries with no records. It records the names asked for.
+type dnsStub struct {
+	net.PacketConn
+	mu    sync.Mutex
+	names []string
+	addrs []net.IP
+	addr6 []net.IP
+}
+
+// answerWith sets the addresses A and AAAA queries are answered with.
+func (s *dnsStub) answerWith(ips ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addrs, s.addr6 = []net.IP{}, nil
+	for _, ip := range ips {
+		if v4 := net.ParseIP(ip).To4(); v4 != nil {
+			s.addrs = append(s.addrs, v4)
+		} else {
+			s.addr6 = append(s.addr6, net.ParseIP(ip))
+		}
+	}
+}
+
+func newDNSStub(t *testing.T) *dnsStub {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnsStub{PacketConn: conn}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if answer := s.answer(buf[:n]); answer != nil {
+				conn.WriteTo(answer, addr)
+			}
+		}
+	}()
+	return s
+}
+
+func (s *dnsStub) answer(query []byte) []byte {
+	// The question follows the 12-byte header: labels, then type and class.
+	end := 12
+	var labels []string
+	for end < len(query) && query[end] != 0 {
+		labels = append(labels, string(query[end+1:end+1+int(query[end])]))
+		end += 1 + int(query[end])
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	s.mu.Lock()
+	s.names = append(s.names, strings.Join(labels, "."))
+	addrs, addr6 := s.addrs, s.addr6
+	s.mu.Unlock()
+	if addrs == nil {
+		addrs = []net.IP{{127, 0, 0, 1}}
+	}
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+	msg := append([]byte(nil), query[:2]...)
+	msg = append(msg, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0)
+	msg = append(msg, query[12:end]...)
+	switch qtype {
+	case 1:
+		binary.BigEndian.PutUint16(msg[6:], uint16(len(addrs)))
+		for _, ip := range addrs {
+			// A pointer to the question's name, type A, class IN, a TTL
+			// of 60 and the address.
+			msg = append(msg, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+			msg = append(msg, ip...)
+		}
+	case 28:
+		binary.BigEndian.PutUint16(msg[6:], uint16(len(addr6)))
+		for _, ip := range addr6 {
+			msg = append(msg, 0xc0, 12, 0, 28, 0, 1, 0, 0, 0, 60, 0, 16)
+			msg = append(msg, ip...)
+		}
+	}
+	return msg
+}
+
+func TestResolver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 100))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	stub := newDNSStub(t)
+	resolver, err := NewResolver(stub.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tester := New(Options{Resolver: resolver, ProgressInterval: -1})
+	all := collect(tester.Test(context.Background(), Target{URL: "http://speed.example.test:" + port + "/", IPVersion: "4"}))
+	last := all[len(all)-1]
+	if last.Error != nil {
+		t.Fatal(last.Error)
+	}
+	if last.ResolvedIP != "127.0.0.1" || last.SizeBytes != 100 {
+		t.Errorf("resolved to %q, %d bytes", last.ResolvedIP, last.SizeBytes)
+	}
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if len(stub.names) == 0 || stub.names[0] != "speed.example.test" {
+		t.Errorf("the stub was asked for %q", stub.names)
+	}
+}
+
+func TestResolvePins(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 100))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	var target Target
+	doc := fmt.Sprintf("url: http://speed.invalid:%s/\nresolve: Speed.Invalid:%s:127.0.0.1\n", port, port)
+	if err := yaml.Unmarshal([]byte(doc), &target); err != nil {
+		t.Fatal(err)
+	}
+	// The host does not resolve: only the pin leads to the server.
+	all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), target))
+	last := all[len(all)-1]
+	if last.Error != nil || last.ResolvedIP != "127.0.0.1" || last.SizeBytes != 100 {
+		t.Errorf("resolved to %q, %d bytes, err %v", last.ResolvedIP, last.SizeBytes, last.Error)
+	}
+
+	tests := []struct {
+		doc  string
+		want Pins
+		err  string
+	}{
+		{`a.example:443:192.0.2.1`, Pins{"a.example:443": "192.0.2.1"}, ""},
+		{`[a.example:443:192.0.2.1, "b.example:80:[2001:db8::1]"]`, Pins{"a.example:443": "192.0.2.1", "b.example:80": "2001:db8::1"}, ""},
+		{`a.example:443`, nil, `resolve "a.example:443": want host:port:ip`},
+		{`a.example:99999:192.0.2.1`, nil, "want host:port:ip"},
+		{`a.example:443:not-an-ip`, nil, "want host:port:ip"},
+	}
+	for _, tt := range tests {
+		var pins Pins
+		err := yaml.Unmarshal([]byte(tt.doc), &pins)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err %v, want %q", tt.doc, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(pins) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: %v, err %v, want %v", tt.doc, pins, err, tt.want)
+		}
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	tests := []struct {
+		server string
+		system bool
+		err    string
+	}{
+		{"", true, ""},
+		{"1.1.1.1", false, ""},
+		{"1.1.1.1:5353", false, ""},
+		{"[2606:4700::1111]", false, ""},
+		{"https://dns.example/dns-query", false, ""},
+		{"dns.example", false, `resolver: want ip[:port] or an https:// URL, got "dns.example"`},
+		{"https://", false, `resolver: invalid DoH URL "https://"`},
+	}
+	for _, tt := range tests {
+		r, err := NewResolver(tt.server)
+		if got := fmt.Sprint(err); (tt.err == "" && err != nil) || (tt.err != "" && got != tt.err) {
+			t.Errorf("NewResolver(%q) err %v, want %q", tt.server, err, tt.err)
+		}
+		if err == nil && (r == nil) != tt.system {
+			t.Errorf("NewResolver(%q) = %v, want the system resolver %v", tt.server, r, tt.system)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package perf
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const defaultMaxResumes = 3
+
+// ResumeError reports a server that did not answer a resumed download with
+// the rest of the body.
+type ResumeError struct {
+	Offset int64
+	Reason string
+}
+
+func (e *ResumeError) Error() string {
+	return fmt.Sprintf("cannot resume at byte %d: %s", e.Offset, e.Reason)
+}
+
+// Segment is one part of a resumed download: the offset it started at and
+// the bytes, time and speed of its transfer. Error is why it ended early,
+// or nil on the last segment of a download that completed.
+type Segment struct {
+	Offset    int64
+	Bytes     int64
+	Elapsed   time.Duration
+	SpeedMbps float64
+	Error     error
+}
+
+// requestRest asks req for the body from target's resumeFrom on, and only
+// if it is still the body that was started.
+func (t Target) requestRest(req *http.Request) {
+	if t.resumeFrom == 0 {
+		return
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", t.resumeFrom))
+	if t.resumeETag != "" {
+		req.Header.Set("If-Range", t.resumeETag)
+	}
+}
+
+// checkResumed accepts a 206 whose Content-Range starts at offset. A 200
+// means the server ignored the Range, or the body changed since the
+// download began.
+func checkResumed(resp *http.Response, offset int64) error {
+	if resp.StatusCode != http.StatusPartialContent {
+		return &ResumeError{offset, fmt.Sprintf("server answered %s instead of 206 Partial Content", resp.Status)}
+	}
+	cr := resp.Header.Get("Content-Range")
+	var first, last int64
+	if _, err := fmt.Sscanf(cr, "bytes %d-%d/", &first, &last); err != nil || first != offset || last < first {
+		return &ResumeError{offset, fmt.Sprintf("Content-Range %q does not continue the body", cr)}
+	}
+	return nil
+}
+
+// resumable reports whether a download that failed with err may go on
+// from where it stopped.
+func resumable(err error) bool {
+	switch Classify(err) {
+	case ErrorTimeout, ErrorStall, ErrorSlow, ErrorRead, ErrorConnect, ErrorDNS, ErrorTLS:
+		return true
+	}
+	return false
+}
+
+// resume downloads target and, each time it fails part way, asks for the
+// rest of the body with a Range request, up to MaxResumes times.
+// Progress covers the whole body. The final snapshot of a resumed download
+// adds its Segments up and times its speed from the first byte to the
+// last, the time spent resuming included; one that never broke off looks
+// like a plain download.
+func (t *Tester) resume(ctx context.Context, target Target) <-chan Stats {
+	e := t.newEmitter(ctx, target)
+	maxResumes := cmp.Or(target.MaxResumes, defaultMaxResumes)
+
+	go func() {
+		defer close(e.ch)
+
+		var (
+			offset   int64
+			segments []Segment
+			first    Stats
+			began    time.Time
+			peak     float64
+			last     Stats
+		)
+		for {
+			segment := target
+			segment.resumeFrom, segment.resumeETag = offset, first.ETag
+			if segment.MaxBytes > 0 {
+				segment.MaxBytes -= ByteSize(offset)
+			}
+			for stats := range t.download(ctx, segment) {
+				if offset > 0 {
+					stats.SizeBytes += offset
+					if stats.ExpectedBytes > 0 {
+						stats.ExpectedBytes += offset
+					}
+				}
+				stats.Resumes = len(segments)
+				last = stats
+				if stats.Final() {
+					break
+				}
+				if !e.send(stats) {
+					e.interrupt(stats, stats.SizeBytes, time.Time{})
+					return
+				}
+			}
+
+			n := last.SizeBytes - offset
+			if len(segments) == 0 {
+				first, began = last, time.Now().Add(-last.Elapsed)
+			}
+			segments = append(segments, Segment{Offset: offset, Bytes: n, Elapsed: last.Elapsed, SpeedMbps: last.SpeedMbps, Error: last.Error})
+			peak = max(peak, last.PeakMbps)
+			if last.Error == nil || last.Cancelled || !resumable(last.Error) || offset+n == 0 || len(segments) > maxResumes || ctx.Err() != nil {
+				break
+			}
+			offset += n
+			t.log().Info("resuming download", "url", target.URL, "at", ByteSize(offset), "resume", len(segments), "of", maxResumes, "err", last.Error)
+		}
+
+		if len(segments) == 1 {
+			e.finish(last)
+			return
+		}
+		final := last
+		final.Resumes, final.Segments = len(segments)-1, segments
+		final.DNSLookup, final.TCPConnect, final.TLSHandshake, final.TTFB = first.DNSLookup, first.TCPConnect, first.TLSHandshake, first.TTFB
+		final.Started, final.ETag = first.Started, first.ETag
+		final.setSpeed(final.SizeBytes, time.Since(began))
+		if final.WireBytes > 0 {
+			final.WireBytes, final.BodyBytes = final.WireBytes+offset, final.BodyBytes+offset
+		}
+		final.PeakMbps, final.TimeToPeak = max(peak, final.SpeedMbps), 0
+		e.finish(final)
+	}()
+
+	return e.ch
+}
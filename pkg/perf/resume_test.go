@@ -0,0 +1,172 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// resumeServer serves a 300kB body with an ETag, dropping the connection
+// after 100kB for the first drops responses. With ignoreRange it answers
+// every request with the whole body, and with shiftRange it claims ranges
+// one byte off.
+type resumeServer struct {
+	*httptest.Server
+	drops                   int
+	ignoreRange, shiftRange bool
+
+	mu      sync.Mutex
+	ranges  []string
+	ifRange []string
+}
+
+func newResumeServer(t *testing.T, drops int) *resumeServer {
+	s := &resumeServer{drops: drops}
+	body := make([]byte, 300000)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			return
+		}
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.ifRange = append(s.ifRange, r.Header.Get("If-Range"))
+		drop := len(s.ranges) <= s.drops
+		s.mu.Unlock()
+		w.Header().Set("ETag", `"v1"`)
+		rest := bytes.NewReader(body)
+		switch {
+		case s.ignoreRange:
+			r.Header.Del("Range")
+		case s.shiftRange && r.Header.Get("Range") != "":
+			w.Header().Set("Content-Range", "bytes 1-299999/300000")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(body[1:])
+			return
+		}
+		if !drop {
+			http.ServeContent(w, r, "", time.Time{}, rest)
+			return
+		}
+		// Send 100kB of what was asked for, and break off.
+		rec := httptest.NewRecorder()
+		rec.Header().Set("ETag", `"v1"`)
+		http.ServeContent(rec, r, "", time.Time{}, rest)
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes()[:100000])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *resumeServer) requests() ([]string, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ranges...), append([]string(nil), s.ifRange...)
+}
+
+func TestResume(t *testing.T) {
+	srv := newResumeServer(t, 2)
+	var progress []Stats
+	all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL, Resume: true}))
+	for _, s := range all[:len(all)-1] {
+		progress = append(progress, s)
+	}
+	last := all[len(all)-1]
+	if last.Error != nil || !last.Done || last.SizeBytes != 300000 || last.Resumes != 2 {
+		t.Fatalf("final %s, %d bytes, %d resumes (%v)", last.Kind, last.SizeBytes, last.Resumes, last.Error)
+	}
+	// Each resume asks for the rest of the same body.
+	ranges, ifRange := srv.requests()
+	if len(ranges) != 3 || ranges[0] != "" || ranges[1] != "bytes=100000-" || ranges[2] != "bytes=200000-" {
+		t.Errorf("ranges asked for %q", ranges)
+	}
+	if ifRange[1] != `"v1"` || ifRange[2] != `"v1"` {
+		t.Errorf("If-Range %q", ifRange)
+	}
+	if len(last.Segments) != 3 {
+		t.Fatalf("segments %+v", last.Segments)
+	}
+	for i, seg := range last.Segments {
+		if seg.Offset != int64(i)*100000 || seg.Bytes != 100000 || seg.SpeedMbps <= 0 || (seg.Error == nil) != (i == 2) {
+			t.Errorf("segment %d: %+v", i, seg)
+		}
+	}
+	if last.SpeedMbps <= 0 || last.PeakMbps < last.SpeedMbps {
+		t.Errorf("overall speed %v, peak %v", last.SpeedMbps, last.PeakMbps)
+	}
+	// Retries of a segment are progress of the whole body.
+	for _, s := range progress {
+		if s.Final() {
+			t.Errorf("a final %s before the last", s.Kind)
+		}
+	}
+
+	c := NewCollector()
+	c.Add(last)
+	c.Add(Stats{URL: srv.URL, Direction: Download, Done: true, SizeBytes: 300000, SpeedMbps: 1})
+	if s := c.Summaries()[0]; s.Runs != 2 || s.Resumed != 1 || s.Resumes != 2 {
+		t.Errorf("summary %d runs, %d resumed %d times", s.Runs, s.Resumed, s.Resumes)
+	}
+}
+
+func TestResumeRefused(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*resumeServer)
+		want  string
+	}{
+		{"range ignored", func(s *resumeServer) { s.ignoreRange = true }, "cannot resume at byte 100000: server answered 200 OK instead of 206 Partial Content"},
+		{"wrong range", func(s *resumeServer) { s.shiftRange = true }, `cannot resume at byte 100000: Content-Range "bytes 1-299999/300000" does not continue the body`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newResumeServer(t, 1)
+			tt.setup(srv)
+			all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL, Resume: true}))
+			last := all[len(all)-1]
+			var resumeErr *ResumeError
+			if !errors.As(last.Error, &resumeErr) || last.Error.Error() != tt.want || last.ErrorKind != ErrorResume {
+				t.Errorf("error %v (%s), want %q", last.Error, last.ErrorKind, tt.want)
+			}
+			if last.Resumes != 1 || len(last.Segments) != 2 || last.SizeBytes != 100000 {
+				t.Errorf("%d resumes, %d segments, %d bytes", last.Resumes, len(last.Segments), last.SizeBytes)
+			}
+		})
+	}
+}
+
+func TestResumeLimit(t *testing.T) {
+	srv := newResumeServer(t, 10)
+	all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL, Resume: true, MaxResumes: 1}))
+	last := all[len(all)-1]
+	if last.Error == nil || last.Resumes != 1 || len(last.Segments) != 2 || last.SizeBytes != 200000 {
+		t.Errorf("%d resumes, %d segments, %d bytes (%v)", last.Resumes, len(last.Segments), last.SizeBytes, last.Error)
+	}
+	if ranges, _ := srv.requests(); len(ranges) != 2 {
+		t.Errorf("%d requests, want 2", len(ranges))
+	}
+
+	// Without resume a broken download just fails, and a clean one with
+	// it looks like any other.
+	srv = newResumeServer(t, 1)
+	all = collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL}))
+	if last := all[len(all)-1]; last.Error == nil || last.Resumes != 0 || last.Segments != nil {
+		t.Errorf("without resume: %d resumes, %v", last.Resumes, last.Error)
+	}
+	all = collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL, Resume: true}))
+	if last := all[len(all)-1]; last.Error != nil || last.Resumes != 0 || last.Segments != nil || last.SizeBytes != 300000 {
+		t.Errorf("clean resume: %d resumes, %d segments, %v", last.Resumes, len(last.Segments), last.Error)
+	}
+}
@@ -0,0 +1,72 @@
+package perf
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+const defaultRetryBackoff = time.Second
+
+// retry runs attempt until it succeeds, is cancelled, or the retry budget
+// is spent. Failed attempts that will be retried are forwarded with
+// Retrying set; the timeout budget covers all attempts together.
+func (t *Tester) retry(ctx context.Context, target Target, attempt func(context.Context) <-chan Stats) <-chan Stats {
+	ctx, cancel := t.withTimeout(ctx)
+	e := t.newEmitter(ctx, target)
+	maxAttempts := t.opts.Retries + 1
+
+	go func() {
+		defer close(e.ch)
+		defer cancel()
+
+		for n := 1; ; n++ {
+			var last Stats
+			for stats := range attempt(ctx) {
+				stats.Attempt, stats.MaxAttempts = n, maxAttempts
+				last = stats
+				if stats.Final() {
+					break
+				}
+				if !e.send(stats) {
+					e.interrupt(stats, stats.SizeBytes, time.Time{})
+					return
+				}
+			}
+
+			if last.Error == nil || last.Cancelled || n == maxAttempts || ctx.Err() != nil {
+				e.finish(last)
+				return
+			}
+
+			last.Retrying = true
+			if !e.send(last) {
+				// Cancelled meanwhile: this failure is the last word.
+				last.Retrying = false
+				e.finish(last)
+				return
+			}
+			delay := t.backoff(n)
+			t.log().Debug("retrying", "url", target.URL, "attempt", n, "of", maxAttempts, "in", delay, "err", last.Error)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				e.interrupt(Stats{URL: target.URL, Direction: last.Direction, Attempt: n, MaxAttempts: maxAttempts}, 0, time.Time{})
+				return
+			}
+		}
+	}()
+
+	return e.ch
+}
+
+// backoff returns the delay before retry number n: the base delay doubled
+// per attempt, randomised by up to half its length either way.
+func (t *Tester) backoff(n int) time.Duration {
+	base := t.opts.RetryBackoff
+	if base <= 0 {
+		base = defaultRetryBackoff
+	}
+	delay := base << (n - 1)
+	return delay/2 + rand.N(delay)
+}
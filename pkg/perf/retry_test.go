@@ -0,0 +1,103 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyServer fails the first failures requests with a 503.
+func flakyServer(t *testing.T, failures int32) *httptest.Server {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(make([]byte, 1000))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		retries int
+		// want is the kind and attempt of each snapshot.
+		want string
+	}{
+		{3, "retry 1/4, retry 2/4, final 3/4"},
+		{2, "retry 1/3, retry 2/3, final 3/3"},
+		{1, "retry 1/2, error 2/2"},
+		// Without retries attempts are not counted.
+		{0, "error 0/0"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.retries, " retries"), func(t *testing.T) {
+			srv := flakyServer(t, 2)
+			tester := New(Options{Retries: tt.retries, RetryBackoff: time.Millisecond, ProgressInterval: -1})
+			var got string
+			for s := range tester.Test(context.Background(), Target{URL: srv.URL}) {
+				if got != "" {
+					got += ", "
+				}
+				got += fmt.Sprintf("%s %d/%d", s.Kind, s.Attempt, s.MaxAttempts)
+				if s.Retrying && s.Error == nil {
+					t.Errorf("attempt %d retrying without an error", s.Attempt)
+				}
+			}
+			if got != tt.want {
+				t.Errorf("snapshots %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryStopsWaiting(t *testing.T) {
+	srv := flakyServer(t, 100)
+	tests := []struct {
+		name      string
+		opts      Options
+		cancel    time.Duration
+		cancelled bool
+	}{
+		{"cancelled", Options{}, 100 * time.Millisecond, true},
+		{"timeout budget", Options{Timeout: 100 * time.Millisecond}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Retries, tt.opts.RetryBackoff, tt.opts.ProgressInterval = 5, time.Hour, -1
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel > 0 {
+				time.AfterFunc(tt.cancel, cancel)
+			}
+			start := time.Now()
+			all := collect(New(tt.opts).Test(ctx, Target{URL: srv.URL}))
+			last := all[len(all)-1]
+			if took := time.Since(start); took > time.Second {
+				t.Errorf("waited %v for the backoff", took)
+			}
+			if !last.Final() || last.Retrying || last.Cancelled != tt.cancelled || last.Attempt != 1 {
+				t.Errorf("last %q attempt %d, cancelled %v, want cancelled %v", last.Kind, last.Attempt, last.Cancelled, tt.cancelled)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tester := New(Options{RetryBackoff: 100 * time.Millisecond})
+	for n := 1; n <= 4; n++ {
+		delay := 100 * time.Millisecond << (n - 1)
+		for range 100 {
+			if got := tester.backoff(n); got < delay/2 || got >= delay*3/2 {
+				t.Fatalf("backoff(%d) = %v, want %v ± half", n, got, delay)
+			}
+		}
+	}
+}
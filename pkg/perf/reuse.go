@@ -0,0 +1,43 @@
+package perf
+
+import (
+	"context"
+	"time"
+)
+
+// reuseProbe downloads target twice over one client with keep-alives: a
+// cold fetch that sets up the connection and a warm one that should reuse
+// it. Progress of both is forwarded; the final result is the warm fetch
+// with the cold one attached, unless the cold fetch did not complete.
+func (t *Tester) reuseProbe(ctx context.Context, target Target) <-chan Stats {
+	e := t.newEmitter(ctx, target)
+	client, release := t.client(target)
+
+	go func() {
+		defer close(e.ch)
+		defer release()
+
+		var cold *Stats
+		for {
+			var last Stats
+			for stats := range t.fetch(ctx, target, client, func() {}) {
+				last = stats
+				if stats.Final() {
+					break
+				}
+				if !e.send(stats) {
+					e.interrupt(stats, stats.SizeBytes, time.Time{})
+					return
+				}
+			}
+			if cold != nil || last.Error != nil || last.Cancelled {
+				last.Cold = cold
+				e.finish(last)
+				return
+			}
+			cold = &last
+		}
+	}()
+
+	return e.ch
+}
@@ -0,0 +1,60 @@
+package perf
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReuseProbe(t *testing.T) {
+	var conns, requests atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", "100000")
+		w.Write(make([]byte, 100000))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL, ReuseProbe: true}))
+	finals := 0
+	for _, s := range all {
+		if s.Final() {
+			finals++
+		}
+	}
+	last := all[len(all)-1]
+	if finals != 1 || last.Error != nil {
+		t.Fatalf("%d final results, err %v, want one", finals, last.Error)
+	}
+	// The warm fetch reports the reuse the trace saw, with the cold fetch
+	// that set up the connection attached.
+	if !last.Reused || last.SizeBytes != 100000 {
+		t.Errorf("warm fetch reused %v, read %d bytes", last.Reused, last.SizeBytes)
+	}
+	if c := last.Cold; c == nil || c.Reused || c.SizeBytes != 100000 || c.DNSLookup+c.TCPConnect == 0 {
+		t.Errorf("cold fetch %+v, want a new connection", c)
+	}
+	if conns.Load() != 1 || requests.Load() != 2 {
+		t.Errorf("%d connections for %d requests, want 1 for 2", conns.Load(), requests.Load())
+	}
+
+	// A failed cold fetch ends the probe.
+	requests.Store(0)
+	all = collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL + "/missing", ReuseProbe: true}))
+	if last := all[len(all)-1]; last.Error == nil || last.Cold != nil || requests.Load() != 1 {
+		t.Errorf("err %v, cold %+v after %d requests, want the one failed fetch", last.Error, last.Cold, requests.Load())
+	}
+}
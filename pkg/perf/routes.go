@@ -0,0 +1,193 @@
+package perf
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+)
+
+// sinkKind is a key a named sink may set, and whether a SinkConfig sets
+// it.
+type sinkKind struct {
+	name string
+	set  bool
+}
+
+func (s SinkConfig) kinds() []sinkKind {
+	return []sinkKind{
+		{"csv_file", s.CSVFile != ""},
+		{"influx", s.Influx != nil},
+		{"otel", s.OTel != nil},
+		{"statsd", s.StatsD != nil},
+		{"webhook", s.Webhook != nil},
+		{"samples_file", s.SamplesFile != ""},
+		{"socket", s.Socket.Path != ""},
+		{"results_file", s.ResultsFile.Path != ""},
+	}
+}
+
+// Kinds returns the keys of the sinks s defines, in the order of its
+// fields.
+func (s SinkConfig) Kinds() []string {
+	var kinds []string
+	for _, kind := range s.kinds() {
+		if kind.set {
+			kinds = append(kinds, kind.name)
+		}
+	}
+	return kinds
+}
+
+// File is the file s writes results to, if it writes one.
+func (s SinkConfig) File() string {
+	switch {
+	case s.CSVFile != "":
+		return s.CSVFile
+	case s.SamplesFile != "":
+		return s.SamplesFile
+	}
+	return s.ResultsFile.Path
+}
+
+// NamedSinks returns the keys of the sinks c defines under names of their
+// own, sorted.
+func (c Config) NamedSinks() []string {
+	var names []string
+	for _, name := range slices.Sorted(maps.Keys(c.Sinks)) {
+		if !slices.Contains(SinkNames, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// settingProblems adds the problems of the sinks s sets up, with prefix
+// naming it.
+func (s SinkConfig) settingProblems(ps *Problems, prefix string) {
+	if s.Influx != nil {
+		ps.Add(prefix+"influx.url", checkURL(s.Influx.URL))
+		if s.Influx.Bucket == "" {
+			ps.Addf(prefix+"influx.bucket", "is required")
+		}
+		if s.Influx.FlushInterval < 0 {
+			ps.Addf(prefix+"influx.flush_interval", "must not be negative, got %v", s.Influx.FlushInterval)
+		}
+	}
+	if s.StatsD != nil {
+		if _, _, err := net.SplitHostPort(s.StatsD.Address); err != nil {
+			ps.Add(prefix+"statsd.address", err)
+		}
+	}
+	if s.OTel != nil && s.OTel.Endpoint == "" {
+		ps.Addf(prefix+"otel.endpoint", "is required")
+	}
+	if s.Webhook != nil {
+		ps.Add(prefix+"webhook.url", checkURL(s.Webhook.URL))
+		if s.Webhook.Cooldown < 0 {
+			ps.Addf(prefix+"webhook.cooldown", "must not be negative, got %v", s.Webhook.Cooldown)
+		}
+	}
+}
+
+// sinkProblems adds the problems of the sinks and group_sinks settings.
+func (c Config) sinkProblems(ps *Problems) {
+	for _, name := range slices.Sorted(maps.Keys(c.Sinks)) {
+		def, prefix := c.Sinks[name], "sinks."+name
+		kinds := def.Kinds()
+		switch {
+		case slices.Contains(SinkNames, name):
+			if len(kinds) > 0 {
+				ps.Addf(prefix+"."+kinds[0], "cannot be set under %s, which the %s key sets up", name, name)
+			}
+		case len(kinds) == 0:
+			ps.Addf(prefix, "is not a sink, want one of %s, or a sink of its own setting one of %s", strings.Join(SinkNames, ", "), strings.Join(sinkKindNames(), ", "))
+		case len(kinds) > 1:
+			ps.Addf(prefix, "sets %s; a named sink sets one of them", strings.Join(kinds, " and "))
+		default:
+			def.settingProblems(ps, prefix+".")
+		}
+	}
+	for _, group := range slices.Sorted(maps.Keys(c.GroupSinks)) {
+		c.routeProblems(ps, c.GroupSinks[group], "group_sinks."+group)
+	}
+}
+
+// sinkKindNames are the keys a named sink may set.
+func sinkKindNames() []string {
+	var names []string
+	for _, kind := range (SinkConfig{}).kinds() {
+		names = append(names, kind.name)
+	}
+	return names
+}
+
+// routeProblems adds the problems of sinks, the route at key: every sink
+// it names must be set up.
+func (c Config) routeProblems(ps *Problems, sinks []string, key string) {
+	if sinks != nil && len(sinks) == 0 {
+		ps.Addf(key, "must name at least one sink; leave it out to route to every sink")
+	}
+	for i, name := range sinks {
+		if !c.hasSink(name) {
+			ps.Addf(fmt.Sprintf("%s[%d]", key, i), "%q is not a sink set up by the config", name)
+		}
+	}
+}
+
+// hasSink reports whether c sets up the sink called name, under a name of
+// its own in sinks or by its top-level key. report is set up by a flag,
+// so routing to it is always allowed.
+func (c Config) hasSink(name string) bool {
+	if def, ok := c.Sinks[name]; ok && !slices.Contains(SinkNames, name) {
+		return len(def.Kinds()) == 1
+	}
+	switch name {
+	case "metrics":
+		return c.MetricsListen != ""
+	case "csv_file":
+		return c.CSVFile != ""
+	case "influx":
+		return c.Influx != nil
+	case "otel":
+		return c.OTel != nil
+	case "statsd":
+		return c.StatsD != nil
+	case "webhook":
+		return c.Webhook != nil
+	case "samples_file":
+		return c.SamplesFile != ""
+	case "heatmap":
+		return c.Heatmap != nil
+	case "socket":
+		return c.Socket.Path != ""
+	case "results_file":
+		return c.ResultsFile.Path != ""
+	case "history_db":
+		return c.HistoryDB != ""
+	case "flent_output":
+		return c.FlentOutput != ""
+	case "report":
+		return true
+	}
+	return false
+}
+
+// commonSinks returns the sinks routes a and b share, where a nil route
+// takes every sink. Routes sharing none give an empty route.
+func commonSinks(a, b []string) []string {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	}
+	common := []string{}
+	for _, name := range a {
+		if slices.Contains(b, name) {
+			common = append(common, name)
+		}
+	}
+	return common
+}
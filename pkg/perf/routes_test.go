@@ -0,0 +1,57 @@
+package perf
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCommonSinks(t *testing.T) {
+	tests := []struct {
+		a, b, want []string
+	}{
+		{nil, nil, nil},
+		{nil, []string{"prod"}, []string{"prod"}},
+		{[]string{"prod"}, nil, []string{"prod"}},
+		{[]string{"prod", "csv_file"}, []string{"csv_file", "staging"}, []string{"csv_file"}},
+		// Routes sharing nothing, or one routed nowhere, go nowhere.
+		{[]string{"prod"}, []string{"staging"}, []string{}},
+		{[]string{}, nil, []string{}},
+	}
+	for _, tt := range tests {
+		got := commonSinks(tt.a, tt.b)
+		if !slices.Equal(got, tt.want) || (got == nil) != (tt.want == nil) {
+			t.Errorf("commonSinks(%q, %q) = %#v, want %#v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNamedSinks(t *testing.T) {
+	c := Config{Sinks: map[string]SinkConfig{
+		"staging_csv": {CSVFile: "staging.csv"},
+		"influx":      {},
+		"archive":     {ResultsFile: SinkPath{Path: "results.jsonl"}},
+		"prod":        {Influx: &Influx{URL: "https://influx.example", Bucket: "prod"}},
+	}, CSVFile: "all.csv"}
+	if got := c.NamedSinks(); !slices.Equal(got, []string{"archive", "prod", "staging_csv"}) {
+		t.Errorf("named sinks %q", got)
+	}
+	for _, tt := range []struct {
+		name, kind, file string
+	}{
+		{"archive", "results_file", "results.jsonl"},
+		{"prod", "influx", ""},
+		{"staging_csv", "csv_file", "staging.csv"},
+	} {
+		def := c.Sinks[tt.name]
+		if kinds := def.Kinds(); !slices.Equal(kinds, []string{tt.kind}) || def.File() != tt.file {
+			t.Errorf("%s sets %q writing %q, want %s writing %q", tt.name, kinds, def.File(), tt.kind, tt.file)
+		}
+	}
+	// A route may name a named sink, a key the config sets up, or the
+	// report, but not a key it leaves unset.
+	for name, want := range map[string]bool{"prod": true, "csv_file": true, "report": true, "influx": false, "typo": false} {
+		if got := c.hasSink(name); got != want {
+			t.Errorf("hasSink(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
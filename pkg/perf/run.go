@@ -0,0 +1,33 @@
+package perf
+
+import (
+	"crypto/rand"
+	"fmt"
+	"regexp"
+)
+
+// NewRunID returns a random version 4 UUID.
+func NewRunID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabels are the label names yaperf sets on its own series.
+var reservedLabels = map[string]bool{"url": true, "direction": true, "host": true, "run_id": true, "le": true, "type": true, "group": true}
+
+// checkLabel reports a label name Prometheus would reject or that clashes
+// with yaperf's own labels.
+func checkLabel(name string) error {
+	switch {
+	case !labelName.MatchString(name), len(name) >= 2 && name[:2] == "__":
+		return fmt.Errorf("label %q is not a valid Prometheus label name", name)
+	case reservedLabels[name]:
+		return fmt.Errorf("label %q is reserved", name)
+	}
+	return nil
+}
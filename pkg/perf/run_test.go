@@ -0,0 +1,67 @@
+package perf
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNewRunID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := map[string]bool{}
+	for range 100 {
+		id := NewRunID()
+		if !uuid.MatchString(id) || seen[id] {
+			t.Fatalf("run id %q is not a new version 4 UUID", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestRunMetadata(t *testing.T) {
+	srv := payloadServer(t, 1000, 0)
+	labels := map[string]string{"site": "nyc"}
+	tester := New(Options{RunID: "run-1", Host: "probe-1", Labels: labels, ProgressInterval: -1})
+	for _, s := range collect(tester.Test(context.Background(), Target{URL: srv.URL + "/bytes/1000"})) {
+		if s.RunID != "run-1" || s.Host != "probe-1" || s.Labels["site"] != "nyc" {
+			t.Errorf("%s snapshot from %q on %q labelled %v", s.Kind, s.RunID, s.Host, s.Labels)
+		}
+	}
+	// Without them each Tester is a run of its own on this host.
+	a, b := New(Options{}), New(Options{})
+	if a.opts.RunID == "" || a.opts.RunID == b.opts.RunID || a.opts.Host == "" {
+		t.Errorf("run ids %q and %q on %q", a.opts.RunID, b.opts.RunID, a.opts.Host)
+	}
+}
+
+func TestCheckLabel(t *testing.T) {
+	tests := []struct {
+		name string
+		err  string
+	}{
+		{"site", ""},
+		{"_isp", ""},
+		{"rack_7", ""},
+		{"7rack", `label "7rack" is not a valid Prometheus label name`},
+		{"bad-name", `label "bad-name" is not a valid Prometheus label name`},
+		{"__name__", `label "__name__" is not a valid Prometheus label name`},
+		{"url", `label "url" is reserved`},
+		{"run_id", `label "run_id" is reserved`},
+	}
+	for _, tt := range tests {
+		err := checkLabel(tt.name)
+		if (err == nil) != (tt.err == "") || err != nil && err.Error() != tt.err {
+			t.Errorf("checkLabel(%q) = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+	// Labels are only checked when metrics are served.
+	config := Config{URLs: []Target{{URL: "https://example.com/"}}, Labels: map[string]string{"bad-name": "x"}}
+	if err := config.Validate(); err != nil {
+		t.Errorf("without metrics: %v", err)
+	}
+	config.MetricsListen = "127.0.0.1:9100"
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "labels.bad-name") {
+		t.Errorf("with metrics: %v", err)
+	}
+}
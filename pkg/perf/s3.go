@@ -0,0 +1,243 @@
+package perf
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Credential sources accepted in an S3Object. By default the environment
+// is tried first and then the shared credentials file.
+const (
+	S3CredentialsEnv    = "env"
+	S3CredentialsShared = "shared"
+)
+
+// s3EmptyHash is the SHA-256 of an empty body, which every request to an
+// object is sent with.
+const s3EmptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Object is an object in S3, or in an S3-compatible store at Endpoint,
+// downloaded with requests yaperf signs itself (SigV4) as it sends them,
+// so a long run never outlives a presigned URL.
+type S3Object struct {
+	Bucket string `yaml:"bucket"`
+	Key    string `yaml:"key"`
+	// Region defaults to AWS_REGION, then AWS_DEFAULT_REGION, then
+	// us-east-1.
+	Region string `yaml:"region"`
+	// Endpoint is the base URL of an S3-compatible store such as MinIO,
+	// whose objects are addressed path-style. Without it the object is
+	// fetched from AWS, virtual-hosted style.
+	Endpoint string `yaml:"endpoint"`
+	// Credentials is env, shared or empty for either, and Profile the
+	// profile of the shared credentials file, AWS_PROFILE or default by
+	// default.
+	Credentials string `yaml:"credentials"`
+	Profile     string `yaml:"profile"`
+}
+
+// s3Credentials are the keys requests are signed with.
+type s3Credentials struct {
+	accessKey, secretKey, sessionToken string
+}
+
+func (o S3Object) region() string {
+	for _, r := range []string{o.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")} {
+		if r != "" {
+			return r
+		}
+	}
+	return "us-east-1"
+}
+
+// url is the URL of the object.
+func (o S3Object) url() string {
+	if o.Endpoint != "" {
+		return strings.TrimSuffix(o.Endpoint, "/") + "/" + s3Escape(o.Bucket, true) + "/" + s3Escape(o.Key, false)
+	}
+	return "https://" + o.Bucket + ".s3." + o.region() + ".amazonaws.com/" + s3Escape(o.Key, false)
+}
+
+// credentials looks up the keys of o in its credential source.
+func (o S3Object) credentials() (s3Credentials, error) {
+	if o.Credentials != S3CredentialsShared {
+		creds := s3Credentials{os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")}
+		if creds.accessKey != "" && creds.secretKey != "" {
+			return creds, nil
+		}
+		if o.Credentials == S3CredentialsEnv {
+			return creds, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are not set")
+		}
+	}
+	return o.sharedCredentials()
+}
+
+// sharedCredentials reads the keys of o's profile from the shared
+// credentials file, AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials.
+func (o S3Object) sharedCredentials() (s3Credentials, error) {
+	var creds s3Credentials
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return creds, fmt.Errorf("no credentials in the environment and %w", err)
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := o.Profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return creds, fmt.Errorf("no credentials in the environment and %w", err)
+	}
+	defer f.Close()
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.accessKey = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.secretKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.sessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return creds, fmt.Errorf("%s: %w", path, err)
+	}
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return creds, fmt.Errorf("%s: profile %q has no aws_access_key_id and aws_secret_access_key", path, profile)
+	}
+	return creds, nil
+}
+
+// signS3 signs req for region with SigV4 as of now, covering its host, its
+// Range if set by then and its x-amz- headers. Requests carry no body.
+func signS3(req *http.Request, creds s3Credentials, region string, now time.Time) {
+	now = now.UTC()
+	stamp := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptyHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	values := map[string]string{"host": host}
+	for name, vs := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			values[name] = strings.TrimSpace(strings.Join(vs, ","))
+		}
+	}
+	names := slices.Sorted(maps.Keys(values))
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + values[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical := strings.Join([]string{req.Method, s3Escape(req.URL.Path, false), s3Query(req.URL.Query()), headers.String(), signed, s3EmptyHash}, "\n")
+
+	scope := now.Format("20060102") + "/" + region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+	key := []byte("AWS4" + creds.secretKey)
+	for _, part := range []string{now.Format("20060102"), region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Query is the canonical form of a query: its parameters sorted and
+// escaped.
+func s3Query(q url.Values) string {
+	var params []string
+	for name, vs := range q {
+		for _, v := range vs {
+			params = append(params, s3Escape(name, true)+"="+s3Escape(v, true))
+		}
+	}
+	slices.Sort(params)
+	return strings.Join(params, "&")
+}
+
+// s3Escape percent-encodes every byte of s but the unreserved ones, and
+// slashes too when slash is set, as SigV4 wants.
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~', c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Problems adds the problems of an s3 entry, with prefix naming it.
+func (t Target) s3Problems(ps *Problems, prefix string) {
+	o := t.S3
+	if o.Bucket == "" {
+		ps.Addf(prefix+"s3.bucket", "s3 needs a bucket")
+	}
+	if o.Key == "" {
+		ps.Addf(prefix+"s3.key", "s3 needs a key")
+	}
+	if o.Endpoint != "" {
+		ps.Add(prefix+"s3.endpoint", checkURL(o.Endpoint))
+	}
+	switch o.Credentials {
+	case "", S3CredentialsEnv, S3CredentialsShared:
+	default:
+		ps.Addf(prefix+"s3.credentials", "must be env or shared, got %q", o.Credentials)
+	}
+	if o.Profile != "" && o.Credentials == S3CredentialsEnv {
+		ps.Addf(prefix+"s3.profile", "only applies to shared credentials")
+	}
+	if t.Direction() != Download {
+		ps.Addf(prefix+"method", "s3 objects only support download")
+	}
+	if t.Auth != nil {
+		ps.Addf(prefix+"auth", "cannot be used with s3, whose requests are signed")
+	}
+}
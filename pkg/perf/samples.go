@@ -0,0 +1,169 @@
+package perf
+
+import (
+	"cmp"
+	"time"
+)
+
+// maxSamples bounds the samples kept per transfer.
+const maxSamples = 10000
+
+// Sample is the traffic of one progress interval.
+type Sample struct {
+	// Time is the end of the interval, and RunOffset how long after the
+	// start of the run it was on the monotonic clock.
+	Time      time.Time     `json:"time"`
+	RunOffset time.Duration `json:"run_offset_ns"`
+	Interval  time.Duration `json:"interval_ns"`
+	Bytes     int64         `json:"bytes"`
+	Mbps      float64       `json:"mbps"`
+}
+
+// sampleLog keeps the interval samples of one transfer. Past maxSamples it
+// merges neighbouring samples, halving the resolution, so memory stays
+// bounded however long the transfer runs.
+type sampleLog struct {
+	samples []Sample
+	// pending collects ticks until they cover the current resolution.
+	pending Sample
+	per     int
+	seen    int
+}
+
+func (l *sampleLog) add(s Sample) {
+	if l.per == 0 {
+		l.per = 1
+	}
+	l.pending.Time, l.pending.RunOffset = s.Time, s.RunOffset
+	l.pending.Interval += s.Interval
+	l.pending.Bytes += s.Bytes
+	if l.seen++; l.seen < l.per {
+		return
+	}
+	l.samples = append(l.samples, l.pending.withSpeed())
+	l.pending, l.seen = Sample{}, 0
+	if len(l.samples) >= maxSamples {
+		merged := l.samples[:0]
+		for i := 0; i+1 < len(l.samples); i += 2 {
+			a, b := l.samples[i], l.samples[i+1]
+			merged = append(merged, Sample{Time: b.Time, RunOffset: b.RunOffset, Interval: a.Interval + b.Interval, Bytes: a.Bytes + b.Bytes}.withSpeed())
+		}
+		l.samples = merged
+		l.per *= 2
+	}
+}
+
+func (s Sample) withSpeed() Sample {
+	if s.Interval > 0 {
+		s.Mbps = float64(s.Bytes*8) / 1e6 / s.Interval.Seconds()
+	}
+	return s
+}
+
+// list returns a copy of the samples, so the final Stats does not share
+// memory with a log that may still grow.
+func (l *sampleLog) list() []Sample {
+	return append([]Sample(nil), l.samples...)
+}
+
+// window holds the latest samples of a transfer that cover at least span,
+// the sliding window behind PeakMbps and min_speed_floor.
+type window struct {
+	span    time.Duration
+	samples []Sample
+	bytes   int64
+	covered time.Duration
+}
+
+// add appends s and drops the oldest samples not needed to cover span.
+func (w *window) add(s Sample) {
+	w.samples = append(w.samples, s)
+	w.bytes += s.Bytes
+	w.covered += s.Interval
+	for len(w.samples) > 1 && w.covered-w.samples[0].Interval >= w.span {
+		w.bytes -= w.samples[0].Bytes
+		w.covered -= w.samples[0].Interval
+		w.samples = w.samples[1:]
+	}
+}
+
+// mbps returns the speed over the window, or false while the samples cover
+// less than span.
+func (w *window) mbps() (float64, bool) {
+	if w.covered < w.span || w.covered <= 0 {
+		return 0, false
+	}
+	return float64(w.bytes*8) / 1e6 / w.covered.Seconds(), true
+}
+
+// meter carries what a transfer's snapshots report beyond its byte counter:
+// the warm-up window, stalls and the interval samples.
+type meter struct {
+	warmup
+	stall stall
+	log   sampleLog
+	peak  peakTracker
+	floor floor
+	// sampledN and sampledAt mark the end of the last sample.
+	sampledN  int64
+	sampledAt time.Time
+	shift     ShiftDetection
+	cpu       *cpuSampler
+	// runStart is what sample offsets count from, and clock what stamps
+	// samples with the wall time.
+	runStart time.Time
+	clock    Clock
+	// ramp, when the target has one, holds its fine ticks.
+	ramp *rampTrace
+}
+
+func (t *Tester) newMeter(target Target) *meter {
+	m := &meter{shift: t.opts.ShiftDetection, cpu: t.cpuSampler(), runStart: t.opts.RunStart, clock: t.opts.Clock, ramp: newRampTrace(target.Ramp)}
+	m.peak.recent.span = peakWindow
+	m.floor = floor{mbps: float64(target.MinSpeedFloor) / 1e6, recent: window{span: cmp.Or(target.FloorGrace, defaultFloorGrace)}}
+	m.d = t.opts.Warmup
+	m.stall = stall{threshold: target.StallThreshold, floor: float64(target.StallFloor) / 8}
+	if m.stall.threshold == 0 {
+		m.stall.threshold = defaultStallThreshold
+	}
+	if target.AbortOnStall != nil {
+		m.stall.abort = *target.AbortOnStall
+	}
+	return m
+}
+
+func (m *meter) sample(n int64, now time.Time) {
+	if !m.sampledAt.IsZero() && now.After(m.sampledAt) {
+		s := Sample{Time: m.clock.Now(), RunOffset: now.Sub(m.runStart), Interval: now.Sub(m.sampledAt), Bytes: n - m.sampledN}
+		m.log.add(s)
+		m.peak.add(s)
+		if m.floor.mbps > 0 {
+			m.floor.recent.add(s)
+		}
+	}
+	m.sampledN, m.sampledAt = n, now
+}
+
+// final sets the speed and peak of s and attaches the samples, including
+// the partial interval since the last tick, any shift of speed found in
+// them and the CPU the process used meanwhile.
+func (m *meter) final(s *Stats, n int64, start, now time.Time) {
+	m.apply(s, n, start, now)
+	if m.sampledAt.IsZero() {
+		m.sampledAt = start
+	}
+	if !start.IsZero() {
+		m.sample(n, now)
+	}
+	s.Samples = m.log.list()
+	if m.ramp != nil && !start.IsZero() {
+		s.RampTime, s.RampBytes = m.ramp.result(n, start, now)
+	}
+	s.Shift = DetectShift(s.Samples, m.shift)
+	// A transfer shorter than the peak window peaks at its average.
+	if s.PeakMbps, s.TimeToPeak = m.peak.result(); s.PeakMbps == 0 {
+		s.PeakMbps = s.SpeedMbps
+	}
+	m.stall.record(s)
+	m.cpu.apply(s, now)
+}
@@ -0,0 +1,65 @@
+package perf
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSampleLogBounded(t *testing.T) {
+	var l sampleLog
+	const n = 3*maxSamples + 7
+	for i := range n {
+		l.add(Sample{Time: time.Unix(int64(i), 0), Interval: time.Second, Bytes: 1000})
+	}
+	// Each merge halves the resolution, keeping the log under the cap.
+	if len(l.samples) >= maxSamples || l.per != 4 {
+		t.Fatalf("%d samples of %d ticks each, want fewer than %d of 4", len(l.samples), l.per, maxSamples)
+	}
+	var bytes int64
+	var covered time.Duration
+	for _, s := range l.samples {
+		bytes += s.Bytes
+		covered += s.Interval
+		if !near(s.Mbps, 0.008) {
+			t.Fatalf("merged sample at %v Mbps, want 0.008", s.Mbps)
+		}
+	}
+	// What the log holds and what waits to fill the next sample add up to
+	// every tick.
+	if bytes+l.pending.Bytes != n*1000 || covered+l.pending.Interval != n*time.Second {
+		t.Errorf("%d bytes over %v, want %d over %v", bytes+l.pending.Bytes, covered+l.pending.Interval, n*1000, n*time.Second)
+	}
+	if last := l.samples[len(l.samples)-1]; !last.Time.Equal(time.Unix(int64(len(l.samples)*4-1), 0)) {
+		t.Errorf("last sample ends at %v", last.Time)
+	}
+}
+
+func TestSamplesTimeline(t *testing.T) {
+	// 10kB every 20ms is 4 Mbps.
+	srv := payloadServer(t, 10000, 20*time.Millisecond)
+	tester := New(Options{ProgressInterval: 50 * time.Millisecond})
+	last, err := tester.DownloadAndWait(context.Background(), srv.URL+"/bytes/300000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(last.Samples) < 5 {
+		t.Fatalf("%d samples, want one per progress interval", len(last.Samples))
+	}
+	var bytes int64
+	var covered time.Duration
+	for i, s := range last.Samples {
+		bytes += s.Bytes
+		covered += s.Interval
+		if i > 0 && !s.Time.After(last.Samples[i-1].Time) {
+			t.Errorf("sample %d at %v, not after %v", i, s.Time, last.Samples[i-1].Time)
+		}
+		// The last sample covers the partial interval before the end.
+		if i < len(last.Samples)-1 && (s.Mbps < 2 || s.Mbps > 6) {
+			t.Errorf("sample %d of %d bytes over %v at %v Mbps, want about 4", i, s.Bytes, s.Interval, s.Mbps)
+		}
+	}
+	if bytes != last.SizeBytes || covered != last.Elapsed {
+		t.Errorf("samples add up to %d bytes over %v, want %d over %v", bytes, covered, last.SizeBytes, last.Elapsed)
+	}
+}
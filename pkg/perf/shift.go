@@ -0,0 +1,119 @@
+package perf
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ShiftDetection tunes how DetectShift tells a lasting change in speed from
+// a noisy link.
+type ShiftDetection struct {
+	// MinChange is the least change between the two speed levels, as a
+	// fraction of the faster one. It defaults to 0.3.
+	MinChange float64 `yaml:"min_change"`
+	// MinSamples is the fewest interval samples each level must span, 3 by
+	// default.
+	MinSamples int `yaml:"min_samples"`
+	// MinScore is how many standard deviations of the speed within the
+	// levels must separate their means, 3 by default. Raise it for noisy
+	// links.
+	MinScore float64 `yaml:"min_score"`
+}
+
+func (d ShiftDetection) withDefaults() ShiftDetection {
+	if d.MinChange == 0 {
+		d.MinChange = 0.3
+	}
+	if d.MinSamples == 0 {
+		d.MinSamples = 3
+	}
+	if d.MinScore == 0 {
+		d.MinScore = 3
+	}
+	return d
+}
+
+// Shift is a lasting change in speed part way through a transfer, such as
+// a link shaped down after its first seconds.
+type Shift struct {
+	// At is when the second level began, from the start of the transfer.
+	At         time.Duration
+	BeforeMbps float64
+	AfterMbps  float64
+}
+
+// Dropped reports whether the speed went down.
+func (s *Shift) Dropped() bool {
+	return s.AfterMbps < s.BeforeMbps
+}
+
+// String describes s as "speed dropped from 920.0 to 310.0 Mbps after 11s".
+func (s *Shift) String() string {
+	verb := "rose"
+	if s.Dropped() {
+		verb = "dropped"
+	}
+	return fmt.Sprintf("speed %s from %.1f to %.1f Mbps after %v", verb, s.BeforeMbps, s.AfterMbps, s.At.Round(time.Second))
+}
+
+// MarshalJSON encodes s with At in milliseconds.
+func (s *Shift) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		AtMs       int64   `json:"at_ms"`
+		BeforeMbps float64 `json:"before_mbps"`
+		AfterMbps  float64 `json:"after_mbps"`
+	}{s.At.Milliseconds(), s.BeforeMbps, s.AfterMbps})
+}
+
+// DetectShift looks for one lasting change of level in the speeds of
+// samples. It splits them where the two sides are best described by their
+// own means, and reports the split only if both sides span d.MinSamples,
+// their means differ by d.MinChange and they stand d.MinScore standard
+// deviations apart. A last sample shorter than half the one before, the
+// partial interval a transfer ends on, is left out. It returns nil when
+// there is no such shift.
+func DetectShift(samples []Sample, d ShiftDetection) *Shift {
+	d = d.withDefaults()
+	if n := len(samples); n >= 2 && samples[n-1].Interval < samples[n-2].Interval/2 {
+		samples = samples[:n-1]
+	}
+	n := len(samples)
+	if n < 2*d.MinSamples || d.MinSamples < 1 {
+		return nil
+	}
+	// Prefix sums give the squared error of any split in constant time.
+	sum := make([]float64, n+1)
+	sq := make([]float64, n+1)
+	for i, s := range samples {
+		sum[i+1] = sum[i] + s.Mbps
+		sq[i+1] = sq[i] + s.Mbps*s.Mbps
+	}
+	sse := func(from, to int) float64 {
+		k := float64(to - from)
+		s := sum[to] - sum[from]
+		return max(sq[to]-sq[from]-s*s/k, 0)
+	}
+	best, bestErr := 0, math.Inf(1)
+	for k := d.MinSamples; k <= n-d.MinSamples; k++ {
+		if e := sse(0, k) + sse(k, n); e < bestErr {
+			best, bestErr = k, e
+		}
+	}
+
+	before := sum[best] / float64(best)
+	after := (sum[n] - sum[best]) / float64(n-best)
+	diff := math.Abs(after - before)
+	if diff < d.MinChange*max(before, after) {
+		return nil
+	}
+	// The spread within the levels, pooled; an exact step has none.
+	if n > 2 {
+		if sd := math.Sqrt(bestErr / float64(n-2)); sd > 0 && diff/sd < d.MinScore {
+			return nil
+		}
+	}
+	start := samples[0].Time.Add(-samples[0].Interval)
+	return &Shift{At: samples[best-1].Time.Sub(start), BeforeMbps: before, AfterMbps: after}
+}
@@ -0,0 +1,81 @@
+package perf
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+// series returns one second samples at the given speeds.
+func series(mbps ...float64) []Sample {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	samples := make([]Sample, len(mbps))
+	for i, v := range mbps {
+		samples[i] = Sample{Time: start.Add(time.Duration(i+1) * time.Second), Interval: time.Second, Mbps: v}
+	}
+	return samples
+}
+
+func repeat(v float64, n int) []float64 {
+	return slices.Repeat([]float64{v}, n)
+}
+
+func TestDetectShift(t *testing.T) {
+	// The partial interval a transfer ends on, a fifth of a second.
+	partial := append(series(slices.Concat(repeat(920, 5), repeat(310, 5))...),
+		Sample{Time: time.Date(2024, 5, 1, 12, 0, 10, 200e6, time.UTC), Interval: 200 * time.Millisecond, Mbps: 5})
+	tests := []struct {
+		name    string
+		samples []Sample
+		d       ShiftDetection
+		want    *Shift
+	}{
+		{"shaped", series(slices.Concat(repeat(920, 11), repeat(310, 9))...), ShiftDetection{}, &Shift{At: 11 * time.Second, BeforeMbps: 920, AfterMbps: 310}},
+		{"rose", series(slices.Concat(repeat(100, 5), repeat(500, 5))...), ShiftDetection{}, &Shift{At: 5 * time.Second, BeforeMbps: 100, AfterMbps: 500}},
+		{"noisy levels", series(900, 940, 910, 930, 920, 300, 320, 310, 290, 330), ShiftDetection{}, &Shift{At: 5 * time.Second, BeforeMbps: 920, AfterMbps: 310}},
+		{"steady", series(repeat(500, 20)...), ShiftDetection{}, nil},
+		{"too small a change", series(slices.Concat(repeat(100, 5), repeat(80, 5))...), ShiftDetection{}, nil},
+		{"small change allowed", series(slices.Concat(repeat(100, 5), repeat(80, 5))...), ShiftDetection{MinChange: 0.1}, &Shift{At: 5 * time.Second, BeforeMbps: 100, AfterMbps: 80}},
+		// Levels 40 apart with a spread of about 27 are noise, not a shift,
+		// unless the score asked for is lowered.
+		{"within the noise", series(100, 130, 70, 130, 70, 100, 60, 90, 30, 90, 30, 60), ShiftDetection{}, nil},
+		{"low score", series(100, 130, 70, 130, 70, 100, 60, 90, 30, 90, 30, 60), ShiftDetection{MinScore: 1}, &Shift{At: 6 * time.Second, BeforeMbps: 100, AfterMbps: 60}},
+		// The slow level must last MinSamples intervals.
+		{"short dip", series(slices.Concat(repeat(920, 10), repeat(310, 2))...), ShiftDetection{}, nil},
+		{"short dip allowed", series(slices.Concat(repeat(920, 10), repeat(310, 2))...), ShiftDetection{MinSamples: 2}, &Shift{At: 10 * time.Second, BeforeMbps: 920, AfterMbps: 310}},
+		{"too few samples", series(920, 920, 310, 310), ShiftDetection{}, nil},
+		{"no samples", nil, ShiftDetection{}, nil},
+		{"partial last interval", partial, ShiftDetection{}, &Shift{At: 5 * time.Second, BeforeMbps: 920, AfterMbps: 310}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DetectShift(tt.samples, tt.d)
+			switch {
+			case got == nil && tt.want == nil:
+			case got == nil || tt.want == nil:
+				t.Errorf("DetectShift = %v, want %v", got, tt.want)
+			case got.At != tt.want.At || !near(got.BeforeMbps, tt.want.BeforeMbps) || !near(got.AfterMbps, tt.want.AfterMbps):
+				t.Errorf("DetectShift = %+v, want %+v", *got, *tt.want)
+			}
+		})
+	}
+}
+
+func TestShiftReport(t *testing.T) {
+	s := &Shift{At: 11*time.Second + 300*time.Millisecond, BeforeMbps: 920, AfterMbps: 310}
+	if got, want := s.String(), "speed dropped from 920.0 to 310.0 Mbps after 11s"; got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+	up := &Shift{At: 4 * time.Second, BeforeMbps: 100, AfterMbps: 500}
+	if got, want := up.String(), "speed rose from 100.0 to 500.0 Mbps after 4s"; got != want || up.Dropped() {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"at_ms":11300,"before_mbps":920,"after_mbps":310}`; string(b) != want {
+		t.Errorf("json %s, want %s", b, want)
+	}
+}
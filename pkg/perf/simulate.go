@@ -0,0 +1,153 @@
+package perf
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// simulatedMSS is the packet size simulated loss is counted in.
+const simulatedMSS = 1460
+
+// errSimulated is the read error Simulate.Errors injects.
+var errSimulated = errors.New("simulated connection reset")
+
+// Simulate shapes a download's body as if it came over a slower link, to
+// exercise measurement and reporting without one. The body is read no
+// faster than Bandwidth; the first byte waits Latency; each packet is lost
+// with probability Loss, holding the rest of the read back for a
+// retransmission after another Latency; and each read fails with
+// probability Errors. Jitter varies each wait by up to that much either
+// way. The random choices follow Seed, so a run repeats exactly.
+type Simulate struct {
+	Bandwidth Rate          `yaml:"bandwidth"`
+	Latency   time.Duration `yaml:"latency"`
+	Jitter    time.Duration `yaml:"jitter"`
+	Loss      Percent       `yaml:"loss"`
+	Errors    Percent       `yaml:"errors"`
+	Seed      uint64        `yaml:"seed"`
+}
+
+// shaper is the simulated link of one transfer, shared by its streams.
+type shaper struct {
+	sim     Simulate
+	limiter *limiter
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// newShaper returns the link sim describes, or nil when sim is nil.
+func newShaper(sim *Simulate) *shaper {
+	if sim == nil {
+		return nil
+	}
+	return &shaper{sim: *sim, limiter: newLimiter(sim.Bandwidth), rng: rand.New(rand.NewPCG(sim.Seed, sim.Seed))}
+}
+
+// reader shapes r, or returns it as it is from a nil shaper.
+func (s *shaper) reader(ctx context.Context, r io.Reader) io.Reader {
+	if s == nil {
+		return r
+	}
+	return &shapedReader{ctx: ctx, r: r, link: s, wait: s.delay()}
+}
+
+// delay is Latency give or take up to Jitter.
+func (s *shaper) delay() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.sim.Latency
+	if s.sim.Jitter > 0 {
+		d += time.Duration((s.rng.Float64()*2 - 1) * float64(s.sim.Jitter))
+	}
+	return max(d, 0)
+}
+
+// fate decides what becomes of a read of n bytes: whether it fails, or
+// else how many bytes get through before the first lost packet, n when
+// none is lost.
+func (s *shaper) fate(n int) (fail bool, through int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sim.Errors > 0 && s.rng.Float64() < float64(s.sim.Errors)/100 {
+		return true, 0
+	}
+	if s.sim.Loss <= 0 {
+		return false, n
+	}
+	// The number of packets that arrive before a loss is geometric.
+	p := float64(s.sim.Loss) / 100
+	if p >= 1 {
+		return false, 0
+	}
+	packets := math.Floor(math.Log(1-s.rng.Float64()) / math.Log(1-p))
+	if packets*simulatedMSS >= float64(n) {
+		return false, n
+	}
+	return false, int(packets) * simulatedMSS
+}
+
+type shapedReader struct {
+	ctx  context.Context
+	r    io.Reader
+	link *shaper
+	// wait is the delay before the next bytes are returned, and pending
+	// the bytes held back by a loss.
+	wait    time.Duration
+	pending []byte
+}
+
+func (s *shapedReader) Read(b []byte) (int, error) {
+	if s.wait > 0 {
+		if err := sleep(s.ctx, s.wait); err != nil {
+			return 0, err
+		}
+		s.wait = 0
+	}
+	var (
+		n   int
+		err error
+	)
+	if len(s.pending) > 0 {
+		n = copy(b, s.pending)
+		s.pending = s.pending[n:]
+	} else {
+		n, err = s.r.Read(b)
+	}
+	if n > 0 {
+		fail, through := s.link.fate(n)
+		if fail {
+			return 0, errSimulated
+		}
+		if through < n {
+			// Keep the rest for after the retransmission, ahead of what
+			// an earlier loss still holds back.
+			s.pending = append(slices.Clone(b[through:n]), s.pending...)
+			s.wait, n, err = s.link.delay(), through, nil
+		}
+	}
+	if s.link.limiter != nil {
+		if werr := s.link.limiter.wait(s.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// sleep waits d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
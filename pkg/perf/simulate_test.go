@@ -0,0 +1,154 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// readShaped reads body through a link simulated by sim in 32kB reads,
+// returning what came through, the size of every read and how long it
+// took.
+func readShaped(sim Simulate, body []byte) ([]byte, []int, time.Duration, error) {
+	r := newShaper(&sim).reader(context.Background(), bytes.NewReader(body))
+	var got bytes.Buffer
+	var sizes []int
+	buf := make([]byte, 32<<10)
+	start := time.Now()
+	for {
+		n, err := r.Read(buf)
+		got.Write(buf[:n])
+		if n > 0 {
+			sizes = append(sizes, n)
+		}
+		if err == io.EOF {
+			return got.Bytes(), sizes, time.Since(start), nil
+		}
+		if err != nil {
+			return got.Bytes(), sizes, time.Since(start), err
+		}
+	}
+}
+
+func TestSimulatedBandwidth(t *testing.T) {
+	srv := payloadServer(t, 32<<10, 0)
+	// A 3MB body at 20 Mbps takes 1.2s less the 100ms burst, one stream or
+	// several sharing the link.
+	for _, streams := range []int{1, 2} {
+		all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(),
+			Target{URL: srv.URL + "/bytes/3000000", Streams: streams, Simulate: &Simulate{Bandwidth: 20e6}}))
+		last := all[len(all)-1]
+		if last.Error != nil {
+			t.Fatal(last.Error)
+		}
+		if last.SpeedMbps < 18 || last.SpeedMbps > 24 {
+			t.Errorf("%d streams: %.2f Mbps through a 20 Mbps link", streams, last.SpeedMbps)
+		}
+	}
+}
+
+func TestSimulatedLink(t *testing.T) {
+	body := make([]byte, 2<<20)
+	rand.NewChaCha8([32]byte{9}).Read(body)
+
+	// The first byte waits the latency.
+	_, _, took, err := readShaped(Simulate{Latency: 100 * time.Millisecond}, body[:1000])
+	if err != nil || took < 100*time.Millisecond || took > time.Second {
+		t.Errorf("with 100ms latency the body took %v (%v)", took, err)
+	}
+
+	// Losses split reads and hold the rest back, but every byte arrives in
+	// order, and the same seed repeats the same reads.
+	sim := Simulate{Loss: 2, Latency: time.Millisecond, Seed: 7}
+	got, sizes, _, err := readShaped(sim, body)
+	if err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("lossy link gave %d of %d bytes intact %v (%v)", len(got), len(body), bytes.Equal(got, body), err)
+	}
+	short := 0
+	for _, n := range sizes {
+		if n%simulatedMSS == 0 && n < 32<<10 {
+			short++
+		}
+	}
+	if short < 5 {
+		t.Errorf("%d reads cut short by a loss in %d", short, len(sizes))
+	}
+	_, again, _, _ := readShaped(sim, body)
+	if !equalInts(sizes, again) {
+		t.Error("the same seed gave different reads")
+	}
+	sim.Seed = 8
+	if _, other, _, _ := readShaped(sim, body); equalInts(sizes, other) {
+		t.Error("another seed gave the same reads")
+	}
+
+	// Injected errors fail a read, at the same read for the same seed.
+	_, sizes, _, err = readShaped(Simulate{Errors: 10, Seed: 3}, body)
+	if !errors.Is(err, errSimulated) {
+		t.Fatalf("with errors at 10%% the body read to %v", err)
+	}
+	if _, again, _, _ := readShaped(Simulate{Errors: 10, Seed: 3}, body); !equalInts(sizes, again) {
+		t.Errorf("failed after %d reads, then after %d", len(sizes), len(again))
+	}
+	if _, _, _, err := readShaped(Simulate{Errors: 100}, body); !errors.Is(err, errSimulated) {
+		t.Errorf("errors at 100%%: %v", err)
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSimulatedJitter(t *testing.T) {
+	s := newShaper(&Simulate{Latency: 50 * time.Millisecond, Jitter: 20 * time.Millisecond, Seed: 1})
+	lo, hi := time.Hour, time.Duration(0)
+	for range 1000 {
+		d := s.delay()
+		lo, hi = min(lo, d), max(hi, d)
+	}
+	if lo < 30*time.Millisecond || hi > 70*time.Millisecond || hi-lo < 30*time.Millisecond {
+		t.Errorf("delays from %v to %v, want spread over 30ms to 70ms", lo, hi)
+	}
+	// Jitter past the latency never makes a wait negative.
+	s = newShaper(&Simulate{Latency: time.Millisecond, Jitter: time.Second})
+	for range 1000 {
+		if d := s.delay(); d < 0 {
+			t.Fatalf("delay %v", d)
+		}
+	}
+	if newShaper(nil) != nil {
+		t.Error("a nil Simulate shapes")
+	}
+}
+
+func TestPercent(t *testing.T) {
+	for text, want := range map[string]Percent{"0.5%": 0.5, "2": 2, " 10 % ": 10, "100%": 100} {
+		var p Percent
+		if err := yaml.Unmarshal([]byte(text), &p); err != nil || p != want {
+			t.Errorf("%q decoded as %v, %v; want %v", text, p, err, want)
+		}
+	}
+	for _, text := range []string{"101%", "-1", "half"} {
+		var p Percent
+		if err := yaml.Unmarshal([]byte(text), &p); err == nil {
+			t.Errorf("%q decoded as %v", text, p)
+		}
+	}
+	if s := Percent(0.5).String(); s != "0.5%" {
+		t.Errorf("String() = %q", s)
+	}
+}
@@ -0,0 +1,84 @@
+package perf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Sinks accepted by the sink option. A discarded body never touches the
+// disk; a file sink also writes it to output_path.
+const (
+	SinkDiscard = "discard"
+	SinkFile    = "file"
+)
+
+func checkSink(t Target) error {
+	switch t.Sink {
+	case "", SinkDiscard:
+		if t.OutputPath != "" {
+			return errors.New("output_path needs sink: file")
+		}
+		return nil
+	case SinkFile:
+		if t.OutputPath == "" {
+			return errors.New("sink file needs an output_path")
+		}
+		if t.Method != "" && t.Method != MethodDownload {
+			return errors.New("sink file only applies to downloads")
+		}
+		return nil
+	}
+	return fmt.Errorf("sink must be discard or file, got %q", t.Sink)
+}
+
+// fileSink writes a downloaded body to disk and times the writes, so a
+// disk slower than the network shows up next to the network speed.
+type fileSink struct {
+	f        *os.File
+	keep     bool
+	complete bool
+	n        int64
+	busy     time.Duration
+}
+
+// openSink creates the output file of target, or returns nil when the body
+// is discarded.
+func (t Target) openSink() (*fileSink, error) {
+	if t.Sink != SinkFile {
+		return nil, nil
+	}
+	f, err := os.Create(t.OutputPath)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{f: f, keep: t.KeepPartial}, nil
+}
+
+func (s *fileSink) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := s.f.Write(p)
+	s.busy += time.Since(start)
+	s.n += int64(n)
+	return n, err
+}
+
+// done marks the file complete and records the write speed on stats.
+func (s *fileSink) done(stats *Stats) {
+	s.complete = true
+	stats.OutputPath = s.f.Name()
+	stats.WriteTime = s.busy
+	if s.busy > 0 {
+		stats.WriteMbps = float64(s.n*8) / 1e6 / s.busy.Seconds()
+	}
+}
+
+// close closes the file and removes it unless the download completed or
+// keep_partial is set.
+func (s *fileSink) close() {
+	s.f.Close()
+	if !s.complete && !s.keep {
+		os.Remove(s.f.Name())
+	}
+}
@@ -0,0 +1,106 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFileSink(t *testing.T) {
+	payload := make([]byte, 3<<20)
+	rand.NewChaCha8([32]byte{5, 6}).Read(payload)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+
+	// The file holds the body as served, even when streams ask for ranges.
+	for _, streams := range []int{1, 4} {
+		path := filepath.Join(dir, "streams"+strconv.Itoa(streams)+".bin")
+		all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL, Sink: SinkFile, OutputPath: path, Streams: streams}))
+		last := all[len(all)-1]
+		if last.Error != nil {
+			t.Fatal(last.Error)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("%d streams: file of %d bytes differs from the %d served", streams, len(got), len(payload))
+		}
+		if last.OutputPath != path || last.SizeBytes != int64(len(payload)) || last.WriteTime <= 0 || last.WriteMbps <= 0 {
+			t.Errorf("%d streams: result %s, %d bytes, writes %v at %v Mbps", streams, last.OutputPath, last.SizeBytes, last.WriteTime, last.WriteMbps)
+		}
+	}
+
+	// A discarded body leaves no file behind.
+	all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL}))
+	last := all[len(all)-1]
+	if last.Error != nil || last.OutputPath != "" || last.WriteTime != 0 {
+		t.Errorf("discarded download %+v", last)
+	}
+}
+
+func TestPartialFile(t *testing.T) {
+	srv, _ := slowServer(t)
+	for _, keep := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "partial.bin")
+		ctx, cancel := context.WithCancel(context.Background())
+		var last Stats
+		for s := range New(Options{ProgressInterval: 20 * time.Millisecond}).Test(ctx, Target{URL: srv.URL, Sink: SinkFile, OutputPath: path, KeepPartial: keep}) {
+			if s.SizeBytes > 0 {
+				cancel()
+			}
+			last = s
+		}
+		cancel()
+		if !last.Cancelled {
+			t.Fatalf("keep_partial %v: %s result, want cancelled", keep, last.Kind)
+		}
+		got, err := os.ReadFile(path)
+		switch {
+		case !keep && !os.IsNotExist(err):
+			t.Errorf("partial file left behind: %v", err)
+		case keep && (err != nil || len(got) != 1000):
+			t.Errorf("kept partial file of %d bytes (%v), want 1000", len(got), err)
+		}
+	}
+
+	// A file that cannot be created fails the download.
+	all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL, Sink: SinkFile, OutputPath: filepath.Join(t.TempDir(), "missing", "out.bin")}))
+	last := all[len(all)-1]
+	if !os.IsNotExist(last.Error) {
+		t.Errorf("unwritable output_path: %v", last.Error)
+	}
+}
+
+func TestCheckSink(t *testing.T) {
+	tests := []struct {
+		target Target
+		want   string
+	}{
+		{Target{}, ""},
+		{Target{Sink: SinkDiscard}, ""},
+		{Target{Sink: SinkFile, OutputPath: "out.bin"}, ""},
+		{Target{OutputPath: "out.bin"}, "output_path needs sink: file"},
+		{Target{Sink: SinkFile}, "sink file needs an output_path"},
+		{Target{Sink: SinkFile, OutputPath: "out.bin", Method: MethodUpload}, "sink file only applies to downloads"},
+		{Target{Sink: "tee"}, `sink must be discard or file, got "tee"`},
+	}
+	for _, tt := range tests {
+		err := checkSink(tt.target)
+		if got := fmt.Sprint(err); (tt.want == "" && err != nil) || (tt.want != "" && got != tt.want) {
+			t.Errorf("checkSink(%+v) = %v, want %q", tt.target, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package perf
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// sizePlaceholder in the URL of a size sweep is replaced by the size of
+// each step in bytes, fetching a distinct object per size instead of a
+// range of one.
+const sizePlaceholder = "{size}"
+
+// kneeShare is the share of the fastest step's speed a step must reach to
+// be the knee of a sweep, where throughput stops growing with size.
+const kneeShare = 0.9
+
+// SizeSweep fetches a URL once per size, as a Range request for its first
+// bytes or, when the URL has {size} in it, as the object named by the size
+// in bytes. Each size is tested, summarised and checked on its own.
+type SizeSweep struct {
+	Sizes []ByteSize `yaml:"sizes"`
+}
+
+// sizes returns a copy of target per size of its sweep, named after the
+// size. Their results keep the URL of target.
+func (t Target) sizes() []Target {
+	copies := make([]Target, len(t.SizeSweep.Sizes))
+	off := false
+	for i, size := range t.SizeSweep.Sizes {
+		c := t
+		c.sweepSize, c.Preflight = int64(size), &off
+		c.Name = fmt.Sprintf("%s (%s)", Stats{URL: t.configuredURL(), Name: t.Name}.DisplayName(), SizeLabel(int64(size)))
+		c.MaxBytes = min(cmp.Or(c.MaxBytes, size), size)
+		if strings.Contains(t.URL, sizePlaceholder) {
+			n := strconv.FormatInt(int64(size), 10)
+			c.template = t.configuredURL()
+			c.URL = strings.ReplaceAll(t.URL, sizePlaceholder, n)
+			c.shown = strings.ReplaceAll(cmp.Or(t.shown, t.URL), sizePlaceholder, n)
+		}
+		copies[i] = c
+	}
+	return copies
+}
+
+// requestSize asks req for the first bytes of the body of a sweep step
+// that fetches a range.
+func (t Target) requestSize(req *http.Request) {
+	if t.sweepSize > 0 && !strings.Contains(cmp.Or(t.template, t.URL), sizePlaceholder) {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", t.sweepSize-1))
+	}
+}
+
+// SizeLabel spells size in the largest unit that divides it, as "64KB"
+// or "16MiB".
+func SizeLabel(size int64) string {
+	for _, u := range []struct {
+		suffix string
+		scale  int64
+	}{{"GiB", 1 << 30}, {"GB", 1e9}, {"MiB", 1 << 20}, {"MB", 1e6}, {"KiB", 1 << 10}, {"KB", 1e3}} {
+		if size >= u.scale && size%u.scale == 0 {
+			return fmt.Sprintf("%d%s", size/u.scale, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", size)
+}
+
+// sizeSweepProblems adds the problems of the sweep entry of t, with prefix
+// naming it.
+func (t Target) sizeSweepProblems(ps *Problems, prefix string) {
+	if s := scheme(t.URL); t.Direction() != Download || s != "http" && s != "https" {
+		ps.Addf(prefix+"sweep", "only applies to http(s) downloads")
+	}
+	if len(t.SizeSweep.Sizes) == 0 {
+		ps.Addf(prefix+"sweep.sizes", "needs at least one size")
+	}
+	for i, size := range t.SizeSweep.Sizes {
+		if size <= 0 {
+			ps.Addf(fmt.Sprintf("%ssweep.sizes[%d]", prefix, i), "must be positive")
+		} else if slices.Index(t.SizeSweep.Sizes, size) < i {
+			ps.Addf(fmt.Sprintf("%ssweep.sizes[%d]", prefix, i), "%s is listed twice", SizeLabel(int64(size)))
+		}
+	}
+	for _, other := range []struct {
+		name string
+		set  bool
+	}{
+		{"resolve_all", t.ResolveAll},
+		{"dualstack_compare", t.DualstackCompare},
+		{"streams", t.Streams > 1},
+		{"resume", t.Resume},
+	} {
+		if other.set {
+			ps.Addf(prefix+"sweep", "cannot be used with %s", other.name)
+		}
+	}
+}
+
+// SizeCurve sets the steps of a size sweep side by side, smallest first.
+type SizeCurve struct {
+	URL       string     `json:"url"`
+	Name      string     `json:"name,omitempty"`
+	Direction Direction  `json:"direction"`
+	Agent     string     `json:"agent,omitempty"`
+	Steps     []SizeStep `json:"steps"`
+	// KneeBytes is the smallest size reaching 90% of the speed of the
+	// fastest step, past which larger objects gain little. It is zero
+	// when no step completed.
+	KneeBytes int64 `json:"knee_bytes,omitempty"`
+}
+
+// SizeStep is the summary of one size of a sweep.
+type SizeStep struct {
+	SizeBytes  int64   `json:"size_bytes"`
+	Runs       int     `json:"runs"`
+	Errors     int     `json:"errors"`
+	MeanMbps   float64 `json:"mean_mbps"`
+	MeanTTFBMs float64 `json:"mean_ttfb_ms"`
+}
+
+// SizeCurves gathers the summaries of size sweep steps under the URL they
+// swept, in the order the URLs first appear.
+func SizeCurves(summaries []Summary) []SizeCurve {
+	var curves []SizeCurve
+	index := map[summaryKey]int{}
+	for _, s := range summaries {
+		if s.SweepSize == 0 {
+			continue
+		}
+		key := summaryKey{url: s.URL, direction: s.Direction, agent: s.Agent}
+		i, ok := index[key]
+		if !ok {
+			i = len(curves)
+			index[key] = i
+			name := strings.TrimSuffix(s.Name, " ("+SizeLabel(s.SweepSize)+")")
+			if name == s.URL {
+				name = ""
+			}
+			curves = append(curves, SizeCurve{URL: s.URL, Name: name, Direction: s.Direction, Agent: s.Agent})
+		}
+		curves[i].Steps = append(curves[i].Steps, SizeStep{SizeBytes: s.SweepSize, Runs: s.Runs, Errors: s.Errors, MeanMbps: s.MeanMbps, MeanTTFBMs: s.MeanTTFBMs})
+	}
+	for i := range curves {
+		c := &curves[i]
+		slices.SortFunc(c.Steps, func(a, b SizeStep) int { return cmp.Compare(a.SizeBytes, b.SizeBytes) })
+		fastest := 0.0
+		for _, step := range c.Steps {
+			if step.Runs > 0 {
+				fastest = max(fastest, step.MeanMbps)
+			}
+		}
+		for _, step := range c.Steps {
+			if fastest > 0 && step.Runs > 0 && step.MeanMbps >= kneeShare*fastest {
+				c.KneeBytes = step.SizeBytes
+				break
+			}
+		}
+	}
+	return curves
+}
@@ -0,0 +1,144 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeServer serves a 4MB object, honouring ranges, and records the Range
+// header of each request.
+func rangeServer(t *testing.T) (*httptest.Server, func() []string) {
+	payload := make([]byte, 4<<20)
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "object.bin", time.Time{}, bytes.NewReader(payload))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(ranges)
+	}
+}
+
+func TestSizeSweep(t *testing.T) {
+	srv, ranges := rangeServer(t)
+	objects := payloadServer(t, 32*1024, 0)
+	sizes := &SizeSweep{Sizes: []ByteSize{1 << 20, 64 << 10, 4 << 20}}
+	targets := []Target{
+		{URL: srv.URL + "/object.bin", Name: "cdn", SizeSweep: sizes},
+		// A {size} URL fetches an object per size, without a range.
+		{URL: objects.URL + "/bytes/{size}", SizeSweep: &SizeSweep{Sizes: []ByteSize{1000, 2000}}},
+	}
+	c := NewCollector()
+	var finals []Stats
+	for s := range New(Options{ProgressInterval: -1}).Run(context.Background(), targets, 1) {
+		c.Add(s)
+		if s.Final() {
+			finals = append(finals, s)
+		}
+	}
+	tests := []struct {
+		url  string
+		name string
+		size int64
+	}{
+		{srv.URL + "/object.bin", "cdn (1MiB)", 1 << 20},
+		{srv.URL + "/object.bin", "cdn (64KiB)", 64 << 10},
+		{srv.URL + "/object.bin", "cdn (4MiB)", 4 << 20},
+		{objects.URL + "/bytes/{size}", objects.URL + "/bytes/{size} (1KB)", 1000},
+		{objects.URL + "/bytes/{size}", objects.URL + "/bytes/{size} (2KB)", 2000},
+	}
+	if len(finals) != len(tests) {
+		t.Fatalf("%d results, want one per size", len(finals))
+	}
+	for i, tt := range tests {
+		s := finals[i]
+		if s.Error != nil || s.URL != tt.url || s.Name != tt.name || s.SweepSize != tt.size || s.SizeBytes != tt.size {
+			t.Errorf("step %d: %s %q swept %d with %d bytes (%v), want %s %q %d", i, s.URL, s.Name, s.SweepSize, s.SizeBytes, s.Error, tt.url, tt.name, tt.size)
+		}
+	}
+	if got := ranges(); !slices.Equal(got, []string{"bytes=0-1048575", "bytes=0-65535", "bytes=0-4194303"}) {
+		t.Errorf("ranges asked for %q", got)
+	}
+	if finals[3].ExpandedURL != objects.URL+"/bytes/1000" {
+		t.Errorf("object fetched at %q", finals[3].ExpandedURL)
+	}
+
+	// Each size is summarised on its own and grouped under its URL.
+	summaries := c.Summaries()
+	if len(summaries) != 5 {
+		t.Fatalf("%d summaries, want one per size", len(summaries))
+	}
+	curves := SizeCurves(summaries)
+	if len(curves) != 2 || curves[0].URL != srv.URL+"/object.bin" || curves[0].Name != "cdn" || curves[1].Name != "" {
+		t.Fatalf("curves %+v", curves)
+	}
+	var steps []int64
+	for _, step := range curves[0].Steps {
+		steps = append(steps, step.SizeBytes)
+		if step.Runs != 1 || step.MeanMbps <= 0 || step.MeanTTFBMs <= 0 {
+			t.Errorf("step %+v", step)
+		}
+	}
+	if !slices.Equal(steps, []int64{64 << 10, 1 << 20, 4 << 20}) || curves[0].KneeBytes == 0 {
+		t.Errorf("steps %v, knee %d", steps, curves[0].KneeBytes)
+	}
+}
+
+func TestSizeCurves(t *testing.T) {
+	step := func(url string, size int64, runs int, mbps float64) Summary {
+		return Summary{URL: url, Name: url + " (" + SizeLabel(size) + ")", Direction: Download, SweepSize: size, Runs: runs, MeanMbps: mbps}
+	}
+	tests := []struct {
+		name  string
+		steps []Summary
+		knee  int64
+	}{
+		// The first size within 90% of the fastest is the knee.
+		{"saturating", []Summary{step("a", 16e6, 1, 95), step("a", 64e3, 1, 10), step("a", 1e6, 1, 60), step("a", 256e6, 1, 100)}, 16e6},
+		{"exactly 90%", []Summary{step("a", 1e6, 1, 90), step("a", 16e6, 1, 100)}, 1e6},
+		// Failed steps are no knee, however fast they were once.
+		{"failed step", []Summary{step("a", 1e6, 0, 100), step("a", 16e6, 1, 50)}, 16e6},
+		{"all failed", []Summary{step("a", 1e6, 0, 0)}, 0},
+	}
+	for _, tt := range tests {
+		curves := SizeCurves(append(tt.steps, Summary{URL: "b", Runs: 1, MeanMbps: 500}))
+		if len(curves) != 1 || curves[0].KneeBytes != tt.knee {
+			t.Errorf("%s: curves %+v, want knee %d", tt.name, curves, tt.knee)
+		}
+	}
+}
+
+func TestSizeLabel(t *testing.T) {
+	tests := []struct {
+		size int64
+		want string
+	}{
+		{0, "0B"},
+		{999, "999B"},
+		{1000, "1KB"},
+		{1024, "1KiB"},
+		{64 << 10, "64KiB"},
+		{1500, "1500B"},
+		{16e6, "16MB"},
+		{256 << 20, "256MiB"},
+		{3e9, "3GB"},
+		{1 << 40, "1024GiB"},
+	}
+	for _, tt := range tests {
+		if got := SizeLabel(tt.size); got != tt.want {
+			t.Errorf("SizeLabel(%d) = %q, want %q", tt.size, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package perf
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultStallThreshold is how long a transfer must stay below the stall
+// floor to count as stalled when stall_threshold is unset.
+const defaultStallThreshold = 5 * time.Second
+
+// StallError reports a transfer aborted by abort_on_stall.
+type StallError struct {
+	For time.Duration
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("stalled for %v", e.For.Round(time.Second))
+}
+
+// stall tracks runs of progress intervals slower than floor. Only runs of
+// at least threshold count as stalls.
+type stall struct {
+	threshold time.Duration
+	// floor is in bytes per second; zero means an interval must move no
+	// bytes at all.
+	floor float64
+	abort bool
+
+	current, total, longest time.Duration
+}
+
+func (s *stall) observe(bytes int64, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	if bytes == 0 || s.floor > 0 && float64(bytes)/interval.Seconds() < s.floor {
+		s.current += interval
+		return
+	}
+	s.end()
+}
+
+// end closes the current run of slow intervals.
+func (s *stall) end() {
+	if s.current >= s.threshold {
+		s.total += s.current
+		s.longest = max(s.longest, s.current)
+	}
+	s.current = 0
+}
+
+func (s *stall) stalled() bool {
+	return s.threshold > 0 && s.current >= s.threshold
+}
+
+// aborted returns the error a transfer stops with once it has stalled and
+// abort_on_stall is set, or nil.
+func (s *stall) aborted() error {
+	if s.abort && s.stalled() {
+		return &StallError{For: s.current}
+	}
+	return nil
+}
+
+// record sets the stall fields of a final snapshot.
+func (s *stall) record(st *Stats) {
+	s.end()
+	st.StalledTime, st.LongestStall = s.total, s.longest
+}
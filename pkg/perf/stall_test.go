@@ -0,0 +1,104 @@
+package perf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStallAccounting(t *testing.T) {
+	tests := []struct {
+		name string
+		// intervals are the bytes of each 100ms interval.
+		intervals []int64
+		floor     float64
+		stalled   string
+		total     time.Duration
+		longest   time.Duration
+	}{
+		{"no stall", []int64{10, 10, 10}, 0, "---", 0, 0},
+		// Runs shorter than the 300ms threshold do not count.
+		{"short pause", []int64{10, 0, 0, 10}, 0, "----", 0, 0},
+		{"stall", []int64{10, 0, 0, 0, 0, 10}, 0, "---SS-", 400 * time.Millisecond, 400 * time.Millisecond},
+		{"two stalls", []int64{0, 0, 0, 10, 0, 0, 0, 0, 0}, 0, "--S---SSS", 800 * time.Millisecond, 500 * time.Millisecond},
+		// Below a floor of 1000 bytes a second, 100 bytes in 100ms is not.
+		{"floor", []int64{50, 50, 50, 100, 100}, 1000, "--S--", 300 * time.Millisecond, 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &stall{threshold: 300 * time.Millisecond, floor: tt.floor}
+			var got []byte
+			for _, n := range tt.intervals {
+				s.observe(n, 100*time.Millisecond)
+				mark := byte('-')
+				if s.stalled() {
+					mark = 'S'
+				}
+				got = append(got, mark)
+			}
+			var st Stats
+			s.record(&st)
+			if string(got) != tt.stalled || st.StalledTime != tt.total || st.LongestStall != tt.longest {
+				t.Errorf("stalled %s for %v, longest %v, want %s for %v, longest %v", got, st.StalledTime, st.LongestStall, tt.stalled, tt.total, tt.longest)
+			}
+		})
+	}
+}
+
+func TestStalledDownload(t *testing.T) {
+	// The server sends half the body, pauses and sends the rest.
+	pause := 600 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "200000")
+		w.Write(make([]byte, 100000))
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(pause):
+		case <-r.Context().Done():
+			return
+		}
+		w.Write(make([]byte, 100000))
+	}))
+	defer srv.Close()
+
+	tester := New(Options{ProgressInterval: 50 * time.Millisecond, StallThreshold: 200 * time.Millisecond})
+	all := collect(tester.Test(context.Background(), Target{URL: srv.URL}))
+	last := all[len(all)-1]
+	if last.Error != nil || last.SizeBytes != 200000 {
+		t.Fatalf("read %d bytes, err %v", last.SizeBytes, last.Error)
+	}
+	stalled := 0
+	for _, s := range all {
+		if s.Stalled {
+			stalled++
+		}
+	}
+	if stalled == 0 {
+		t.Error("no progress snapshot was marked stalled")
+	}
+	if last.StalledTime < pause-150*time.Millisecond || last.StalledTime > pause+150*time.Millisecond || last.LongestStall != last.StalledTime {
+		t.Errorf("stalled for %v, longest %v, want about %v", last.StalledTime, last.LongestStall, pause)
+	}
+	c := NewCollector()
+	c.Add(last)
+	millis := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	if s := c.Summaries()[0]; s.StalledMs != millis(last.StalledTime) || s.LongestStallMs != millis(last.LongestStall) {
+		t.Errorf("summary stalled %vms, longest %vms", s.StalledMs, s.LongestStallMs)
+	}
+
+	// With abort_on_stall the transfer fails once it stalls.
+	abort := true
+	start := time.Now()
+	all = collect(tester.Test(context.Background(), Target{URL: srv.URL, AbortOnStall: &abort}))
+	last = all[len(all)-1]
+	var stall *StallError
+	if !errors.As(last.Error, &stall) || stall.For < 200*time.Millisecond {
+		t.Errorf("err %v, want a stall of at least 200ms", last.Error)
+	}
+	if elapsed := time.Since(start); elapsed > pause {
+		t.Errorf("aborted after %v, want before the pause of %v ends", elapsed, pause)
+	}
+}
@@ -0,0 +1,357 @@
+package perf
+
+import "time"
+
+// Direction tells which way a transfer moves data.
+type Direction string
+
+// Transfer directions.
+const (
+	Download Direction = "download"
+	Upload   Direction = "upload"
+	// Latency marks the result of a latency test, which times small
+	// requests instead of moving data.
+	Latency Direction = "latency"
+)
+
+// Kind tells the snapshots of a transfer apart. A transfer sends any
+// number of progress and retry snapshots and then exactly one terminal
+// snapshot: final, error, cancelled or skipped.
+type Kind string
+
+// Snapshot kinds.
+const (
+	KindProgress Kind = "progress"
+	// KindRetry is a failed attempt that will be retried.
+	KindRetry Kind = "retry"
+	// KindFinal is a transfer that completed.
+	KindFinal     Kind = "final"
+	KindError     Kind = "error"
+	KindCancelled Kind = "cancelled"
+	KindSkipped   Kind = "skipped"
+)
+
+// Terminal reports whether k ends its transfer.
+func (k Kind) Terminal() bool {
+	switch k {
+	case KindFinal, KindError, KindCancelled, KindSkipped:
+		return true
+	}
+	return false
+}
+
+// Stats is a snapshot of a single transfer. A transfer produces zero or more
+// progress and retry snapshots followed by exactly one terminal snapshot,
+// as told by Kind.
+//
+// Snapshots are sent by value and the producer never changes one after
+// sending it, so a consumer may keep it without copying. Labels is shared
+// by every snapshot of a Tester and must not be modified.
+type Stats struct {
+	// Kind is the kind of snapshot, which follows from Retrying, Skipped,
+	// Cancelled, Error and Done.
+	Kind Kind
+	// URL is the address being tested. For a URL template it is the
+	// template, and ExpandedURL the URL requested, with its signatures
+	// redacted.
+	URL         string
+	ExpandedURL string
+	// Name and Group are those of the Target, if set.
+	Name  string
+	Group string
+	// Sinks are the sinks the snapshot is routed to, those of the Target:
+	// every sink when nil, and none when empty.
+	Sinks []string
+	// Direction is Download, Upload or Latency.
+	Direction Direction
+	// SizeBytes is the number of body bytes transferred so far, as they
+	// crossed the wire.
+	SizeBytes int64
+	// Elapsed is the time since the response headers arrived for downloads,
+	// or since the first body byte was sent for uploads.
+	Elapsed time.Duration
+	// SpeedMBps is the average speed in megabytes per second.
+	SpeedMBps float64
+	// SpeedMbps is the average speed in megabits per second.
+	SpeedMbps float64
+	// Utilization is SpeedMbps as a percentage of Options.LinkCapacity,
+	// zero when the capacity is unknown.
+	Utilization float64
+	// IntervalBytes is the number of bytes transferred since the previous
+	// progress snapshot.
+	IntervalBytes int64
+	// IntervalSpeedMbps is the speed over the last interval in megabits per
+	// second.
+	IntervalSpeedMbps float64
+	// ExpectedBytes is the size advertised by the server through
+	// Content-Length, or zero when it is unknown.
+	ExpectedBytes int64
+	// ETag is the entity tag reported by the server, if any.
+	ETag string
+	// Headers are the response headers picked by capture_headers, and
+	// HeadersTruncated reports that capture_headers: all left some out to
+	// stay under its size cap.
+	Headers          map[string]string
+	HeadersTruncated bool
+	// Streams is the number of parallel connections used, or zero for a
+	// single-connection transfer. StartSkew is the spread between the
+	// streams reading their first bytes, and Trimmed how much of the end
+	// trim_ragged left out of the speed.
+	Streams   int
+	StartSkew time.Duration
+	Trimmed   time.Duration
+	// Started is when the transfer began setting up. The phases below
+	// follow it in order.
+	Started time.Time
+	// DNSLookup is the time spent resolving the host name.
+	DNSLookup time.Duration
+	// TCPConnect is the time spent establishing the TCP connection. It is
+	// zero when an existing connection was reused.
+	TCPConnect time.Duration
+	// TLSHandshake is the time spent in the TLS handshake.
+	TLSHandshake time.Duration
+	// TTFB is the time from sending the request to the first response byte.
+	TTFB time.Duration
+	// Redirects lists the redirects followed before the final response.
+	Redirects []Hop
+	// Reused reports whether the request ran on a connection that was
+	// already open.
+	Reused bool
+	// Attempt is the 1-based attempt number when retries are enabled, and
+	// MaxAttempts the number of attempts allowed.
+	Attempt     int
+	MaxAttempts int
+	// Retrying reports that this attempt failed with Error and will be
+	// retried; such a snapshot is not final.
+	Retrying bool
+	// RemoteAddr is the ip:port of the server the connection went to, and
+	// IPVersion its address family (4 or 6).
+	RemoteAddr string
+	IPVersion  int
+	// LocalAddr is the ip:port the connection was made from.
+	LocalAddr string
+	// Proxy is the host of the proxy the transfer went through, if any.
+	// RemoteAddr is then the proxy's address and timings include it.
+	Proxy string
+	// ResolvedIP is the first address the host was looked up to, or the
+	// address it was pinned to with resolve.
+	ResolvedIP string
+	// ConnectTo is the host:port connect_to sent the connection to in place
+	// of the URL's.
+	ConnectTo string
+	// CacheMode is the cache mode of the Tester, CacheCold or CacheWarm,
+	// so results measured from cold and warm caches are not mixed up.
+	CacheMode string
+	// TCP is the state of the transfer's connection when it ended, or of
+	// its first stream's. It is only set on Linux.
+	TCP *TCPInfo
+	// Bufferbloat compares idle and loaded round trips on the final
+	// snapshot of a download or upload with bufferbloat set.
+	Bufferbloat *Bufferbloat
+	// LatencyGrade grades Bufferbloat, when it has probes from both before
+	// and during the transfer.
+	LatencyGrade *LatencyGrade
+	// UserAgent is the User-Agent the requests were sent with, empty for
+	// net/http's default.
+	UserAgent string
+	// QueueWait is how long Run held the transfer back because its pool
+	// was at per_host_concurrency. It is not part of Elapsed.
+	QueueWait time.Duration
+	// PinnedIP is the address a resolve_all target was tested at, and
+	// Family the address family, "ipv4" or "ipv6", a dualstack_compare
+	// target was tested over.
+	PinnedIP string
+	Family   string
+	// SweepSize is the size a step of a size sweep fetched.
+	SweepSize int64
+	// BidiPhase is the phase of a bidirectional test the transfer ran in,
+	// solo or both, and SoloMbps, on the final snapshots of the both
+	// phase, the speed of the same direction in the solo phase.
+	BidiPhase string
+	SoloMbps  float64
+	// SampleOffset is the byte an offset sample started at, OffsetSamples
+	// how many samples its URL was split into and SampleNote why it was
+	// tested with a single one.
+	SampleOffset  int64
+	OffsetSamples int
+	SampleNote    string
+	// WarmupBytes were transferred during the warm-up window and are left
+	// out of the speed fields. Warmup marks a snapshot taken before the
+	// window closed; on a final snapshot it means the transfer ended inside
+	// the window and the speed covers all of it.
+	WarmupBytes int64
+	Warmup      bool
+	// ContentEncoding is the encoding the body came with, "identity" when
+	// it was sent as is.
+	ContentEncoding string
+	// WireBytes and BodyBytes are set on a completed download. They differ
+	// when a compressed body was decoded, or with count: wire, when
+	// WireCounted is set and WireBytes holds everything read off the
+	// connections, headers and TLS records included. Speeds use WireBytes.
+	WireBytes   int64
+	BodyBytes   int64
+	WireCounted bool
+	// StatusCode is the HTTP status of the response, or zero if none was
+	// received.
+	StatusCode int
+	// Protocol is the protocol the response arrived over, such as
+	// "HTTP/1.1", "HTTP/2.0" or "HTTP/3.0".
+	Protocol string
+	// TLSVersion, Cipher and ALPN describe the TLS session, such as
+	// "TLS 1.3", "TLS_AES_128_GCM_SHA256" and "h2". They are empty for
+	// plain HTTP.
+	TLSVersion string
+	Cipher     string
+	ALPN       string
+	// Samples is the traffic of every progress interval, set on a completed
+	// transfer. Very long transfers keep a coarser timeline.
+	Samples []Sample
+	// Shift is a lasting change of speed found in Samples; see DetectShift.
+	Shift *Shift
+	// RunID, Host and Labels identify the run and the machine the result
+	// was taken on. Labels is shared between snapshots and must not be
+	// modified.
+	RunID  string
+	Host   string
+	Labels map[string]string
+	// Timestamp is the wall time the snapshot was taken, and RunOffset how
+	// long after the start of the run, read from the monotonic clock, so
+	// snapshots keep their order when the wall clock steps.
+	Timestamp time.Time
+	RunOffset time.Duration
+	// Agent is the label of the agent a coordinator ran the test on.
+	Agent string
+	// Adaptive marks a test run in adaptive mode. StableMbps is the mean
+	// speed over the window that was found stable and StableAfter how long
+	// into the transfer that was; both are zero if it never stabilized.
+	Adaptive    bool
+	StableMbps  float64
+	StableAfter time.Duration
+	// OutputPath is the file a completed download with sink: file was
+	// written to. WriteTime is the time spent writing it and WriteMbps the
+	// speed of those writes.
+	OutputPath string
+	WriteTime  time.Duration
+	WriteMbps  float64
+	// Stalled marks a progress snapshot taken while the transfer has been
+	// below the stall floor for at least the stall threshold. StalledTime
+	// and LongestStall, set on the final snapshot, are the total time spent
+	// in such stalls and the longest one.
+	Stalled bool
+	// SlowAborted marks a transfer stopped by min_speed_floor; its Error is
+	// a *SlowError.
+	SlowAborted  bool
+	StalledTime  time.Duration
+	LongestStall time.Duration
+	// PeakMbps, set on final snapshots, is the fastest speed over any
+	// three seconds of the transfer, and TimeToPeak when the speed over
+	// three seconds first came within 95% of it. A transfer shorter than
+	// that peaks at its average speed, with no TimeToPeak. On the TOTAL
+	// snapshots of Aggregate, PeakMbps is the fastest one-second aggregate.
+	PeakMbps   float64
+	TimeToPeak time.Duration
+	// RampTime, set on final snapshots of a target with a ramp, is when a
+	// tick of it first went at its share of the steady speed, and RampBytes
+	// how much the transfer had moved by then. Both are zero when it did
+	// not within the ramp window.
+	RampTime  time.Duration
+	RampBytes int64
+	// Resumes counts how often a download with resume went on after
+	// failing part way, and Segments, set on the final snapshot of such a
+	// download, describes the parts it was fetched in.
+	Resumes  int
+	Segments []Segment
+	// Cold is the first fetch of a reuse_probe; the Stats itself then
+	// describes the second, warm fetch.
+	Cold *Stats
+	// CPU, set on final snapshots, is the CPU the process used during the
+	// transfer. CPUWarning notes a transfer during which it used more than
+	// the CPU threshold, so the client may have been the bottleneck.
+	CPU        *CPUUsage
+	CPUWarning string
+	// Latency holds the round-trip times of a latency test.
+	Latency *LatencyStats
+	// WritePacing, set on the final snapshot of an upload, describes how
+	// its writes went out on the connection.
+	WritePacing *WritePacing
+	// Alert, set on final snapshots when alert_threshold is, is the state
+	// of the URL against its error budget after the transfer.
+	Alert *Alert
+	// LinkDown, set on the final snapshot whose failure tripped
+	// probe_failures_threshold, marks the link going down. It is set once
+	// until the link is back.
+	LinkDown bool
+	// Error is set when the download failed or was interrupted.
+	Error error
+	// ErrorKind classifies Error; see Classify.
+	ErrorKind ErrorKind
+	// TimeoutPhase is the phase of the request, one of the Phase
+	// constants, that a timeout stopped.
+	TimeoutPhase string
+	// Done reports that the body was transferred to completion.
+	Done bool
+	// Truncated reports a body of unknown length that was still streaming
+	// when the default cap stopped it. The transfer is otherwise Done.
+	Truncated bool
+	// Cancelled reports that the transfer was stopped by its context before
+	// completing; SizeBytes and Elapsed then describe the partial transfer.
+	Cancelled bool
+	// Skipped reports a transfer that was never started, for the reason in
+	// SkipReason, such as SkipOutOfTime; it is the only snapshot of its
+	// transfer.
+	Skipped    bool
+	SkipReason string
+}
+
+// SkipOutOfTime is the SkipReason of a transfer skipped because the run
+// ran out of time.
+const SkipOutOfTime = "out of run time"
+
+// TCPInfo is what the kernel reports about a TCP connection through
+// TCP_INFO.
+type TCPInfo struct {
+	RTT    time.Duration
+	RTTVar time.Duration
+	// Retransmits counts every segment retransmitted on the connection.
+	Retransmits uint32
+	// DeliveryRateMbps is the kernel's most recent estimate of the rate
+	// data was delivered at.
+	DeliveryRateMbps float64
+}
+
+// DisplayName returns Name, or the URL when the target has no name.
+func (s Stats) DisplayName() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.URL
+}
+
+// Final reports whether s is the last snapshot of its transfer.
+func (s Stats) Final() bool {
+	return s.kind().Terminal()
+}
+
+// kind derives the Kind of s from its flags.
+func (s Stats) kind() Kind {
+	switch {
+	case s.Retrying:
+		return KindRetry
+	case s.Skipped:
+		return KindSkipped
+	case s.Cancelled:
+		return KindCancelled
+	case s.Error != nil:
+		return KindError
+	case s.Done:
+		return KindFinal
+	}
+	return KindProgress
+}
+
+func (s *Stats) setSpeed(downloaded int64, elapsed time.Duration) {
+	s.SizeBytes = downloaded
+	s.Elapsed = elapsed
+	s.SpeedMBps = float64(downloaded) / 1e6 / elapsed.Seconds()
+	s.SpeedMbps = float64(downloaded*8) / 1e6 / elapsed.Seconds()
+}
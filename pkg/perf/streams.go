@@ -0,0 +1,414 @@
+package perf
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamCounter is shared by the streams of one download. Streams add to it
+// from their own goroutines and the reporting loop reads it once per tick.
+type streamCounter struct {
+	bytes atomic.Int64
+	start instant
+	// waiting counts the streams still waiting for their response. The
+	// last to get one opens gate, so that every stream starts counting
+	// bytes at the same instant.
+	waiting atomic.Int32
+	gate    chan struct{}
+
+	mu sync.Mutex
+	// firstRead and lastRead are when the earliest and the latest stream
+	// read their first bytes.
+	firstRead, lastRead time.Time
+	// doneAt is when the first stream finished and doneBytes the count
+	// then.
+	doneAt    time.Time
+	doneBytes int64
+}
+
+func newStreamCounter(streams int) *streamCounter {
+	c := &streamCounter{gate: make(chan struct{})}
+	c.waiting.Store(int32(streams))
+	return c
+}
+
+// ready holds a stream that has its response back until every stream has
+// one. It reports false when ctx ends first.
+func (c *streamCounter) ready(ctx context.Context) bool {
+	if c.waiting.Add(-1) == 0 {
+		close(c.gate)
+	}
+	select {
+	case <-c.gate:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// read notes a stream reading its first bytes at now.
+func (c *streamCounter) read(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.firstRead.IsZero() || now.Before(c.firstRead) {
+		c.firstRead = now
+	}
+	if now.After(c.lastRead) {
+		c.lastRead = now
+	}
+}
+
+// skew is the spread between the streams reading their first bytes.
+func (c *streamCounter) skew() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastRead.Sub(c.firstRead)
+}
+
+// finished notes a stream reaching the end of its part at now.
+func (c *streamCounter) finished(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.doneAt.IsZero() {
+		c.doneAt, c.doneBytes = now, c.bytes.Load()
+	}
+}
+
+// firstDone is when the first stream finished and the count then.
+func (c *streamCounter) firstDone() (time.Time, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.doneAt, c.doneBytes
+}
+
+// firstRead calls began when its first bytes are read.
+type firstRead struct {
+	io.Reader
+	began func(time.Time)
+}
+
+func (r *firstRead) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 && r.began != nil {
+		r.began(time.Now())
+		r.began = nil
+	}
+	return n, err
+}
+
+// trimRagged bases the speed of s on the n bytes counted from start until
+// end, when the first of its streams or transfers finished, leaving out
+// the ragged tail up to now where fewer of them ran. Size and elapsed time
+// still cover the whole transfer.
+func (m *meter) trimRagged(s *Stats, n int64, start, end, now time.Time) {
+	if end.IsZero() || !end.Before(now) || !end.After(start.Add(m.d)) {
+		return
+	}
+	size, elapsed := s.SizeBytes, s.Elapsed
+	m.warmup.apply(s, n, start, end)
+	s.SizeBytes, s.Elapsed = size, elapsed
+	s.Trimmed = now.Sub(end)
+}
+
+func (c *streamCounter) started() time.Time {
+	return c.start.time()
+}
+
+// multiDownload fetches target over streams parallel connections. When the
+// server supports byte ranges the body is split between them; otherwise
+// every stream downloads the whole body.
+func (t *Tester) multiDownload(ctx context.Context, target Target, streams int) <-chan Stats {
+	ctx, cancel := t.withTimeout(ctx)
+	e := t.newEmitter(ctx, target)
+
+	go func() {
+		defer close(e.ch)
+		defer cancel()
+
+		base := Stats{URL: target.URL, Direction: Download, Streams: streams, Proxy: t.proxyFor(target.URL), Adaptive: target.Mode == ModeAdaptive}
+		size, resp, err := t.probeRange(ctx, target)
+		if resp != nil {
+			recordResponse(&base, resp, target.CaptureHeaders)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				e.interrupt(base, 0, time.Time{})
+			} else {
+				base.Error = err
+				e.send(base)
+			}
+			return
+		}
+		if size >= 0 {
+			base.ExpectedBytes = size
+		}
+		if size < 0 {
+			t.log().Info("server does not support range requests, running full downloads", "url", target.URL, "streams", streams)
+		}
+
+		streamCtx, stopStreams := context.WithCancel(ctx)
+		defer stopStreams()
+		var wire *atomic.Int64
+		if target.Count == CountWire {
+			wire = new(atomic.Int64)
+			streamCtx = countWire(streamCtx, wire)
+		}
+		requested := time.Now()
+
+		type part struct{ first, last int64 }
+		var parts []part
+		for i := 0; i < streams; i++ {
+			first, last := int64(-1), int64(-1)
+			if size >= 0 {
+				first = size * int64(i) / int64(streams)
+				last = size*int64(i+1)/int64(streams) - 1
+				if last < first {
+					continue
+				}
+			}
+			parts = append(parts, part{first, last})
+		}
+		counter := newStreamCounter(len(parts))
+		rate, link := newLimiter(target.RateLimit), newShaper(target.Simulate)
+		var wg sync.WaitGroup
+		errs := make(chan error, streams)
+		timer := t.phaseTimer(target.URL)
+		for i, p := range parts {
+			ctx := streamCtx
+			if i == 0 {
+				ctx = timer.context(streamCtx)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := t.stream(ctx, target, p.first, p.last, counter, rate, link); err != nil {
+					errs <- err
+				}
+			}()
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+
+		var lastBytes int64
+		var lastTick time.Time
+		ticker := t.ticker(target)
+		defer ticker.Stop()
+		deadline := target.Limits.deadline()
+		defer deadline.Stop()
+		m := t.newMeter(target)
+		st := t.stabilizer(target)
+
+		finish := func(stats Stats) {
+			timer.apply(&stats)
+			stats.Done = true
+			stats.StartSkew = counter.skew()
+			if now := time.Now(); wire != nil {
+				m.final(&stats, wire.Load(), requested, now)
+				stats.WireBytes, stats.BodyBytes = wire.Load(), counter.bytes.Load()
+				stats.WireCounted = true
+			} else {
+				m.final(&stats, counter.bytes.Load(), counter.started(), now)
+				if t.opts.TrimRagged {
+					end, n := counter.firstDone()
+					m.trimRagged(&stats, n, counter.started(), end, now)
+				}
+			}
+			stats.TCP = timer.tcpInfo()
+			e.send(stats)
+		}
+
+		failed := func(err error) {
+			timer.apply(&base)
+			switch {
+			case ctx.Err() != nil:
+				e.interrupt(base, counter.bytes.Load(), counter.started())
+			case errors.Is(err, errLimitReached):
+				finish(base)
+			default:
+				base.Error = err
+				base.SizeBytes = counter.bytes.Load()
+				e.send(base)
+			}
+		}
+
+		for {
+			select {
+			case now := <-ticker.C:
+				start := counter.started()
+				if start.IsZero() {
+					continue
+				}
+				if lastTick.IsZero() {
+					lastTick = start
+				}
+				downloaded := counter.bytes.Load()
+				if !ticker.due(now, m, downloaded) {
+					continue
+				}
+				stats := base
+				timer.apply(&stats)
+				stats = progress(stats, m, downloaded, lastBytes, start, lastTick, now)
+				if !e.progress(stats) {
+					stopStreams()
+					<-done
+					e.interrupt(stats, counter.bytes.Load(), start)
+					return
+				}
+				lastBytes, lastTick = downloaded, now
+				if err := cmp.Or(m.stall.aborted(), m.floor.aborted()); err != nil {
+					stopStreams()
+					<-done
+					timer.apply(&base)
+					base.Error = err
+					var slow *SlowError
+					base.SlowAborted = errors.As(err, &slow)
+					m.final(&base, counter.bytes.Load(), start, time.Now())
+					base.TCP = timer.tcpInfo()
+					e.send(base)
+					return
+				}
+				if mbps, ok := st.add(stats); ok {
+					stopStreams()
+					<-done
+					base.StableMbps, base.StableAfter = mbps, now.Sub(start)
+					finish(base)
+					return
+				}
+			case <-deadline.C:
+				stopStreams()
+				<-done
+				finish(base)
+				return
+			case err := <-errs:
+				stopStreams()
+				<-done
+				failed(err)
+				return
+			case <-done:
+				select {
+				case err := <-errs:
+					failed(err)
+				default:
+					if err := checkLength(counter.bytes.Load(), base.ExpectedBytes); err != nil {
+						failed(err)
+					} else {
+						finish(base)
+					}
+				}
+				return
+			}
+		}
+	}()
+
+	return e.ch
+}
+
+var errLimitReached = errors.New("byte limit reached")
+
+// stream downloads bytes first..last of target (the whole body when first
+// is negative) and adds what it reads to counter. The streams of one download
+// share rate and the simulated link.
+func (t *Tester) stream(ctx context.Context, target Target, first, last int64, counter *streamCounter, rate *limiter, link *shaper) error {
+	client, release := t.client(target)
+	defer release()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.URL, nil)
+	if err != nil {
+		return err
+	}
+	target.prepare(req)
+	if first >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first, last))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+	if err := target.checkEncoding(resp); err != nil {
+		return err
+	}
+	if err := target.checkContentType(resp); err != nil {
+		return err
+	}
+	if first >= 0 && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("expected 206 for range %d-%d, got %s", first, last, resp.Status)
+	}
+	if !counter.ready(ctx) {
+		return ctx.Err()
+	}
+	counter.start.mark()
+	// The timed stream's connection is closed by release before the final
+	// snapshot.
+	if timer, ok := ctx.Value(timerKey{}).(*phaseTimer); ok {
+		defer timer.keepTCP()
+	}
+
+	body := t.throttle(ctx, link.reader(ctx, &firstRead{resp.Body, counter.read}), rate)
+	if check := target.patternCheck(max(first, 0)); check != nil {
+		body = io.TeeReader(body, check)
+	}
+	buf, release := t.buffer()
+	defer release()
+	if err := drain(body, buf, int64(target.Limits.MaxBytes), &counter.bytes); err != io.EOF {
+		return err
+	}
+	counter.finished(time.Now())
+	return nil
+}
+
+// probeRange asks for the first byte of target. It returns the full body
+// size when the server answers with a usable Content-Range, or -1 when
+// ranges are not supported, along with the response once one arrived.
+func (t *Tester) probeRange(ctx context.Context, target Target) (int64, *http.Response, error) {
+	client, release := t.client(target)
+	defer release()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.URL, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	target.prepare(req)
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return 0, resp, err
+	}
+	if err := target.checkEncoding(resp); err != nil {
+		return 0, resp, err
+	}
+	if err := target.checkContentType(resp); err != nil {
+		return 0, resp, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return -1, resp, nil
+	}
+	_, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	size, err := strconv.ParseInt(total, 10, 64)
+	if !ok || err != nil {
+		return -1, resp, nil
+	}
+	if err := target.checkSize(size); err != nil {
+		return 0, resp, err
+	}
+	return size, resp, nil
+}
@@ -0,0 +1,197 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMultiStreamDownload(t *testing.T) {
+	const size = 1000000
+	body := make([]byte, size)
+	tests := []struct {
+		name    string
+		ranges  bool
+		streams int
+		// want is the Range headers of the parts, after the probe.
+		want []string
+		size int64
+	}{
+		{"ranges", true, 4, []string{"bytes=0-249999", "bytes=250000-499999", "bytes=500000-749999", "bytes=750000-999999"}, size},
+		{"uneven ranges", true, 3, []string{"bytes=0-333332", "bytes=333333-666665", "bytes=666666-999999"}, size},
+		// Without range support every stream downloads the whole body.
+		{"full downloads", false, 3, []string{"", "", ""}, 3 * size},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var ranges []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				ranges = append(ranges, r.Header.Get("Range"))
+				mu.Unlock()
+				if !tt.ranges {
+					r.Header.Del("Range")
+				}
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+			}))
+			defer srv.Close()
+			tester := New(Options{ProgressInterval: -1})
+			all := collect(tester.Test(context.Background(), Target{URL: srv.URL, Streams: tt.streams}))
+			last := all[len(all)-1]
+			if last.Error != nil || !last.Done {
+				t.Fatalf("final %+v", last)
+			}
+			if last.SizeBytes != tt.size || last.Streams != tt.streams {
+				t.Errorf("%d bytes over %d streams, want %d over %d", last.SizeBytes, last.Streams, tt.size, tt.streams)
+			}
+			// The speed is of the bytes of every stream together.
+			if want := float64(last.SizeBytes) * 8 / 1e6 / last.Elapsed.Seconds(); !near(last.SpeedMbps, want) {
+				t.Errorf("speed %v Mbps, want %v for %d bytes in %v", last.SpeedMbps, want, last.SizeBytes, last.Elapsed)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(ranges) == 0 || ranges[0] != "bytes=0-0" {
+				t.Fatalf("requests %q, want a range probe first", ranges)
+			}
+			parts := slices.Sorted(slices.Values(ranges[1:]))
+			if !slices.Equal(parts, tt.want) {
+				t.Errorf("parts %q, want %q", parts, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultiStreamProgress(t *testing.T) {
+	srv := payloadServer(t, 16<<10, 20*time.Millisecond)
+	tester := New(Options{ProgressInterval: 10 * time.Millisecond})
+	all := collect(tester.Test(context.Background(), Target{URL: srv.URL + "/bytes/400000", Streams: 2}))
+	last := all[len(all)-1]
+	if len(all) < 2 {
+		t.Fatalf("%d snapshots, want progress", len(all))
+	}
+	// Each tick counts the bytes of both streams, growing to the final.
+	var n int64
+	for _, s := range all[:len(all)-1] {
+		if s.SizeBytes < n || s.SizeBytes > last.SizeBytes {
+			t.Errorf("progress at %d bytes after %d, final %d", s.SizeBytes, n, last.SizeBytes)
+		}
+		n = s.SizeBytes
+	}
+	if last.SizeBytes != 2*400000 {
+		t.Errorf("final %d bytes, want both full bodies", last.SizeBytes)
+	}
+}
+
+func TestStartBarrier(t *testing.T) {
+	// The part from offset 0 is answered 200ms after the others, which
+	// wait for it before counting.
+	body := make([]byte, 400000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rng := r.Header.Get("Range"); strings.HasPrefix(rng, "bytes=0-") && rng != "bytes=0-0" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+	defer srv.Close()
+	all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL, Streams: 4}))
+	last := all[len(all)-1]
+	if last.Error != nil {
+		t.Fatal(last.Error)
+	}
+	if last.StartSkew <= 0 || last.StartSkew > 50*time.Millisecond {
+		t.Errorf("streams read their first bytes %v apart, want together", last.StartSkew)
+	}
+	// The wait for the slow part is setup, not transfer time.
+	if last.Elapsed > 150*time.Millisecond {
+		t.Errorf("elapsed %v counts the wait for the slowest response", last.Elapsed)
+	}
+
+	// A single stream has no skew to report.
+	all = collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL}))
+	if last := all[len(all)-1]; last.Error != nil || last.StartSkew != 0 {
+		t.Errorf("one stream: skew %v (%v)", last.StartSkew, last.Error)
+	}
+}
+
+func TestStreamCounter(t *testing.T) {
+	c := newStreamCounter(3)
+	opened := make(chan bool, 3)
+	for range 2 {
+		go func() { opened <- c.ready(context.Background()) }()
+	}
+	select {
+	case <-opened:
+		t.Fatal("gate opened before every stream was ready")
+	case <-time.After(50 * time.Millisecond):
+	}
+	go func() { opened <- c.ready(context.Background()) }()
+	for range 3 {
+		if !<-opened {
+			t.Error("ready stream not let through")
+		}
+	}
+
+	// A stream whose context ends waits no longer.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if newStreamCounter(2).ready(ctx) {
+		t.Error("gate opened with a stream missing")
+	}
+
+	start := time.Now()
+	for _, d := range []time.Duration{3, 1, 7} {
+		c.read(start.Add(d * time.Millisecond))
+	}
+	if got := c.skew(); got != 6*time.Millisecond {
+		t.Errorf("skew %v, want 6ms", got)
+	}
+	// Only the first stream to finish marks the ragged tail.
+	c.bytes.Store(500)
+	c.finished(start.Add(time.Second))
+	c.bytes.Store(900)
+	c.finished(start.Add(2 * time.Second))
+	if at, n := c.firstDone(); !at.Equal(start.Add(time.Second)) || n != 500 {
+		t.Errorf("first done at %v with %d bytes", at.Sub(start), n)
+	}
+}
+
+func TestTrimRagged(t *testing.T) {
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	tests := []struct {
+		name    string
+		warmup  time.Duration
+		end     time.Time
+		mbps    float64
+		trimmed time.Duration
+	}{
+		// 3MB over 3s untrimmed, 2MB of it before the first stream finished
+		// a second before the end.
+		{"trimmed", 0, at(2 * time.Second), 8, time.Second},
+		{"no stream finished", 0, time.Time{}, 8, 0},
+		{"finished last", 0, at(3 * time.Second), 8, 0},
+		{"finished in the warm-up", time.Second, at(500 * time.Millisecond), 8, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &meter{}
+			m.d = tt.warmup
+			s := Stats{}
+			s.setSpeed(3e6, 3*time.Second)
+			m.trimRagged(&s, 2e6, start, tt.end, at(3*time.Second))
+			if !near(s.SpeedMbps, tt.mbps) || s.Trimmed != tt.trimmed {
+				t.Errorf("%.2f Mbps trimmed %v, want %.2f %v", s.SpeedMbps, s.Trimmed, tt.mbps, tt.trimmed)
+			}
+			if s.SizeBytes != 3e6 || s.Elapsed != 3*time.Second {
+				t.Errorf("trimming changed the transfer to %d bytes in %v", s.SizeBytes, s.Elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,386 @@
+package perf
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// Summary aggregates the results of every run against one URL.
+type Summary struct {
+	URL       string    `json:"url"`
+	Name      string    `json:"name,omitempty"`
+	Group     string    `json:"group,omitempty"`
+	Direction Direction `json:"direction"`
+	// IP is the address a resolve_all target was tested at, and Family
+	// the address family of a dualstack_compare copy.
+	IP     string `json:"ip,omitempty"`
+	Family string `json:"family,omitempty"`
+	// SweepSize is the size of a size sweep step.
+	SweepSize int64 `json:"sweep_size,omitempty"`
+	// BidiPhase is the phase of a bidirectional test.
+	BidiPhase string `json:"bidi_phase,omitempty"`
+	// SampleOffset, OffsetSamples and SampleNote describe an offset
+	// sample.
+	SampleOffset  int64  `json:"sample_offset,omitempty"`
+	OffsetSamples int    `json:"offset_samples,omitempty"`
+	SampleNote    string `json:"sample_note,omitempty"`
+	// Agent is the agent the runs were taken on, for agents.
+	Agent string `json:"agent,omitempty"`
+	// Runs counts completed transfers and Errors failed ones.
+	Runs   int `json:"runs"`
+	Errors int `json:"errors"`
+	// ChecksumErrors counts the Errors that were checksum mismatches.
+	ChecksumErrors int `json:"checksum_errors,omitempty"`
+	// Intercepted counts the Errors that were responses unlike what expect
+	// describes, and Interception says how the last of them differed.
+	Intercepted  int    `json:"intercepted,omitempty"`
+	Interception string `json:"interception,omitempty"`
+	// Partial counts runs cancelled part way. Their speeds stand in for
+	// the speed fields only when no run completed.
+	Partial int `json:"partial,omitempty"`
+	// Skipped counts runs never started, and SkipReason says why the last
+	// of them was.
+	Skipped    int    `json:"skipped,omitempty"`
+	SkipReason string `json:"skip_reason,omitempty"`
+	// The speed fields describe the average speed of completed runs in
+	// megabits per second.
+	MinMbps    float64 `json:"min_mbps"`
+	MaxMbps    float64 `json:"max_mbps"`
+	MeanMbps   float64 `json:"mean_mbps"`
+	MedianMbps float64 `json:"median_mbps"`
+	P95Mbps    float64 `json:"p95_mbps"`
+	// JitterMbps is the standard deviation of the per-interval speeds seen
+	// across all runs.
+	JitterMbps float64 `json:"jitter_mbps"`
+	// Utilization is MeanMbps as a percentage of the link capacity, when
+	// one is configured.
+	Utilization float64 `json:"utilization_percent,omitempty"`
+	// PeakMbps is the fastest PeakMbps of the completed runs, and
+	// TimeToPeakMs their mean TimeToPeak in milliseconds.
+	PeakMbps     float64 `json:"peak_mbps,omitempty"`
+	TimeToPeakMs float64 `json:"time_to_peak_ms,omitempty"`
+	// RampTimeMs and RampBytes are the mean RampTime, in milliseconds, and
+	// RampBytes of the completed runs that ramped up within their window.
+	RampTimeMs float64 `json:"ramp_time_ms,omitempty"`
+	RampBytes  float64 `json:"ramp_bytes,omitempty"`
+	// Reused counts the completed runs that ran on a connection kept from
+	// an earlier one.
+	Reused int `json:"reused,omitempty"`
+	// Resumed counts the runs that were resumed after failing part way,
+	// and Resumes how often they were resumed in all.
+	Resumed int `json:"resumed,omitempty"`
+	Resumes int `json:"resumes,omitempty"`
+	// MeanTTFBMs is the mean time to first byte of completed runs in
+	// milliseconds.
+	MeanTTFBMs float64 `json:"mean_ttfb_ms"`
+	// StalledMs is the time all runs spent stalled and LongestStallMs the
+	// longest single stall, in milliseconds.
+	StalledMs      float64 `json:"stalled_ms,omitempty"`
+	LongestStallMs float64 `json:"longest_stall_ms,omitempty"`
+	// Latency combines the round trips of every latency run.
+	Latency *LatencyStats `json:"latency,omitempty"`
+	// Bufferbloat combines the idle and loaded round trips of every run
+	// with bufferbloat set.
+	Bufferbloat *Bufferbloat `json:"bufferbloat,omitempty"`
+	// Shifts counts completed runs whose speed shifted part way, and Shift
+	// is the shift of the latest of them.
+	Shifts int    `json:"shifts,omitempty"`
+	Shift  *Shift `json:"shift,omitempty"`
+	// WritePacing combines the writes and write intervals of every
+	// completed upload.
+	WritePacing *WritePacing `json:"write_pacing,omitempty"`
+	// AlertState is the state of the URL against its error budget after
+	// its last transfer, and AlertFailures its failures in the window then.
+	AlertState    AlertState `json:"alert_state,omitempty"`
+	AlertFailures int        `json:"alert_failures,omitempty"`
+}
+
+type summaryKey struct {
+	url       string
+	direction Direction
+	ip        string
+	family    string
+	agent     string
+	size      int64
+	phase     string
+	offset    int64
+}
+
+type samples struct {
+	name, group  string
+	speeds       []float64
+	partial      []float64
+	ttfbs        []float64
+	intervals    []float64
+	latency      []time.Duration
+	idle         []time.Duration
+	loaded       []time.Duration
+	bloated      bool
+	writes       []time.Duration
+	paced        []float64
+	shifts       int
+	shift        *Shift
+	alert        *Alert
+	peak         float64
+	rampUps      []float64
+	ramps        []float64
+	rampBytes    []float64
+	reused       int
+	resumed      int
+	resumes      int
+	stalled      time.Duration
+	longest      time.Duration
+	runs         int
+	skipped      int
+	skipReason   string
+	errors       int
+	checksums    int
+	intercepted  int
+	interception string
+	// offsetSamples and sampleNote come from the first result, like name.
+	offsetSamples int
+	sampleNote    string
+}
+
+// Collector accumulates Stats into per-URL summaries. It is not safe for
+// concurrent use.
+type Collector struct {
+	order []summaryKey
+	byKey map[summaryKey]*samples
+}
+
+// NewCollector returns an empty Collector.
+func NewCollector() *Collector {
+	return &Collector{byKey: map[summaryKey]*samples{}}
+}
+
+// Add records one snapshot.
+func (c *Collector) Add(s Stats) {
+	key := summaryKey{s.URL, s.Direction, s.PinnedIP, s.Family, s.Agent, s.SweepSize, s.BidiPhase, s.SampleOffset}
+	entry := c.byKey[key]
+	if entry == nil {
+		entry = &samples{name: s.Name, group: s.Group, offsetSamples: s.OffsetSamples, sampleNote: s.SampleNote}
+		c.byKey[key] = entry
+		c.order = append(c.order, key)
+	}
+
+	if b := s.Bufferbloat; b != nil {
+		entry.bloated = true
+		entry.idle = append(entry.idle, b.Idle.samples...)
+		entry.loaded = append(entry.loaded, b.Loaded.samples...)
+	}
+	if s.Alert != nil {
+		entry.alert = s.Alert
+	}
+	if s.Final() {
+		entry.stalled += s.StalledTime
+		entry.longest = max(entry.longest, s.LongestStall)
+		if s.Resumes > 0 {
+			entry.resumed++
+			entry.resumes += s.Resumes
+		}
+	}
+	switch {
+	case s.Skipped:
+		entry.skipped++
+		entry.skipReason = s.SkipReason
+	case s.Cancelled:
+		if s.SizeBytes > 0 && s.Direction != Latency {
+			entry.partial = append(entry.partial, s.SpeedMbps)
+		}
+	case s.Retrying:
+	case s.Error != nil:
+		entry.errors++
+		var checksum *ChecksumError
+		if errors.As(s.Error, &checksum) {
+			entry.checksums++
+		}
+		var intercept *InterceptionError
+		if errors.As(s.Error, &intercept) {
+			entry.intercepted++
+			entry.interception = intercept.Reason
+		}
+	case s.Done && s.Latency != nil:
+		entry.runs++
+		entry.latency = append(entry.latency, s.Latency.samples...)
+	case s.Done:
+		entry.runs++
+		entry.speeds = append(entry.speeds, s.SpeedMbps)
+		entry.peak = max(entry.peak, s.PeakMbps)
+		if s.Reused {
+			entry.reused++
+		}
+		if s.TimeToPeak > 0 {
+			entry.rampUps = append(entry.rampUps, float64(s.TimeToPeak)/float64(time.Millisecond))
+		}
+		if s.RampTime > 0 {
+			entry.ramps = append(entry.ramps, float64(s.RampTime)/float64(time.Millisecond))
+			entry.rampBytes = append(entry.rampBytes, float64(s.RampBytes))
+		}
+		entry.ttfbs = append(entry.ttfbs, float64(s.TTFB)/float64(time.Millisecond))
+		if w := s.WritePacing; w != nil {
+			entry.writes = append(entry.writes, w.writes...)
+			entry.paced = append(entry.paced, w.intervals...)
+		}
+		if s.Shift != nil {
+			entry.shifts++
+			entry.shift = s.Shift
+		}
+	default:
+		entry.intervals = append(entry.intervals, s.IntervalSpeedMbps)
+	}
+}
+
+// Summaries returns one Summary per URL in the order they were first seen.
+func (c *Collector) Summaries() []Summary {
+	summaries := make([]Summary, 0, len(c.order))
+	for _, key := range c.order {
+		entry := c.byKey[key]
+		summary := Summary{
+			URL:            key.url,
+			Name:           entry.name,
+			Group:          entry.group,
+			Direction:      key.direction,
+			IP:             key.ip,
+			Family:         key.family,
+			SweepSize:      key.size,
+			BidiPhase:      key.phase,
+			SampleOffset:   key.offset,
+			OffsetSamples:  entry.offsetSamples,
+			SampleNote:     entry.sampleNote,
+			Agent:          key.agent,
+			Runs:           entry.runs,
+			Errors:         entry.errors,
+			ChecksumErrors: entry.checksums,
+			Intercepted:    entry.intercepted,
+			Interception:   entry.interception,
+			Partial:        len(entry.partial),
+			Skipped:        entry.skipped,
+			SkipReason:     entry.skipReason,
+			JitterMbps:     stddev(entry.intervals),
+			PeakMbps:       entry.peak,
+			TimeToPeakMs:   mean(entry.rampUps),
+			RampTimeMs:     mean(entry.ramps),
+			RampBytes:      mean(entry.rampBytes),
+			Reused:         entry.reused,
+			Resumed:        entry.resumed,
+			Resumes:        entry.resumes,
+			MeanTTFBMs:     mean(entry.ttfbs),
+			StalledMs:      float64(entry.stalled) / float64(time.Millisecond),
+			LongestStallMs: float64(entry.longest) / float64(time.Millisecond),
+			Shifts:         entry.shifts,
+			Shift:          entry.shift,
+		}
+		speeds := entry.speeds
+		if len(speeds) == 0 {
+			speeds = entry.partial
+		}
+		if len(speeds) > 0 {
+			sorted := append([]float64(nil), speeds...)
+			sort.Float64s(sorted)
+			summary.MinMbps = sorted[0]
+			summary.MaxMbps = sorted[len(sorted)-1]
+			summary.MeanMbps = mean(sorted)
+			summary.MedianMbps = Percentile(sorted, 50)
+			summary.P95Mbps = Percentile(sorted, 95)
+		}
+		if len(entry.latency) > 0 {
+			summary.Latency = newLatencyStats(entry.latency)
+		}
+		if entry.bloated {
+			summary.Bufferbloat = newBufferbloat(entry.idle, entry.loaded)
+		}
+		if len(entry.writes) > 0 {
+			summary.WritePacing = newWritePacing(entry.writes, entry.paced)
+		}
+		if entry.alert != nil {
+			summary.AlertState, summary.AlertFailures = entry.alert.State, entry.alert.Failures
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
+
+// GroupSummary compares the targets of one group.
+type GroupSummary struct {
+	Group     string    `json:"group"`
+	Direction Direction `json:"direction"`
+	URLs      int       `json:"urls"`
+	Runs      int       `json:"runs"`
+	Errors    int       `json:"errors"`
+	// MeanMbps is the mean speed of every completed run in the group.
+	MeanMbps float64 `json:"mean_mbps"`
+}
+
+// Groups totals summaries by group and direction, in the order the groups
+// first appear. Summaries without a group and latency tests are left out.
+func Groups(summaries []Summary) []GroupSummary {
+	var groups []GroupSummary
+	index := map[summaryKey]int{}
+	for _, s := range summaries {
+		if s.Group == "" || s.Direction == Latency {
+			continue
+		}
+		key := summaryKey{url: s.Group, direction: s.Direction}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, GroupSummary{Group: s.Group, Direction: s.Direction})
+		}
+		g := &groups[i]
+		// MeanMbps weighted by the runs behind it is the mean of all runs.
+		if total := g.Runs + s.Runs; total > 0 {
+			g.MeanMbps = (g.MeanMbps*float64(g.Runs) + s.MeanMbps*float64(s.Runs)) / float64(total)
+		}
+		g.URLs++
+		g.Runs += s.Runs
+		g.Errors += s.Errors
+	}
+	return groups
+}
+
+// Percentile returns the p-th percentile (0-100) of sorted using linear
+// interpolation between the closest ranks. It returns zero for an empty
+// slice.
+func Percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	if lower < 0 {
+		return sorted[0]
+	}
+	if upper >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// stddev is the population standard deviation of values.
+func stddev(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	m := mean(values)
+	var sum float64
+	for _, v := range values {
+		sum += (v - m) * (v - m)
+	}
+	return math.Sqrt(sum / float64(len(values)))
+}
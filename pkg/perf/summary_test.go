@@ -0,0 +1,173 @@
+package perf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		sorted []float64
+		p      float64
+		want   float64
+	}{
+		{nil, 50, 0},
+		{[]float64{7}, 0, 7},
+		{[]float64{7}, 95, 7},
+		{[]float64{10, 20}, 50, 15},
+		{[]float64{10, 20}, 95, 19.5},
+		{[]float64{1, 2, 3, 4, 5}, 0, 1},
+		{[]float64{1, 2, 3, 4, 5}, 25, 2},
+		{[]float64{1, 2, 3, 4, 5}, 50, 3},
+		{[]float64{1, 2, 3, 4, 5}, 90, 4.6},
+		{[]float64{1, 2, 3, 4, 5}, 100, 5},
+		{[]float64{1, 2, 3, 4}, 50, 2.5},
+		// The p95 of 1 to 20 is at rank 0.95 × 19 = 18.05, just past 19.
+		{[]float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}, 95, 19.05},
+		{[]float64{5, 5, 5}, 95, 5},
+		// Out of range percentiles clamp to the ends.
+		{[]float64{1, 2, 3}, -10, 1},
+		{[]float64{1, 2, 3}, 150, 3},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.sorted, " p", tt.p), func(t *testing.T) {
+			if got := Percentile(tt.sorted, tt.p); !near(got, tt.want) {
+				t.Errorf("Percentile = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMeanAndStddev(t *testing.T) {
+	tests := []struct {
+		values       []float64
+		mean, stddev float64
+	}{
+		{nil, 0, 0},
+		{[]float64{4}, 4, 0},
+		{[]float64{2, 4, 4, 4, 5, 5, 7, 9}, 5, 2},
+		{[]float64{1, 3}, 2, 1},
+		{[]float64{-1, 1}, 0, 1},
+	}
+	for _, tt := range tests {
+		if got := mean(tt.values); !near(got, tt.mean) {
+			t.Errorf("mean(%v) = %v, want %v", tt.values, got, tt.mean)
+		}
+		if got := stddev(tt.values); !near(got, tt.stddev) {
+			t.Errorf("stddev(%v) = %v, want %v", tt.values, got, tt.stddev)
+		}
+	}
+}
+
+func TestCollectorSummaries(t *testing.T) {
+	done := func(url string, mbps float64) Stats {
+		return Stats{URL: url, Direction: Download, Done: true, SizeBytes: 100, SpeedMbps: mbps, TTFB: 20 * time.Millisecond}
+	}
+	c := NewCollector()
+	for _, mbps := range []float64{50, 10, 40, 20, 30} {
+		c.Add(done("a", mbps))
+	}
+	// Progress snapshots feed the jitter alone.
+	for _, mbps := range []float64{10, 30} {
+		c.Add(Stats{URL: "a", Direction: Download, SizeBytes: 10, IntervalSpeedMbps: mbps})
+	}
+	c.Add(Stats{URL: "a", Direction: Download, Error: &ChecksumError{Algorithm: "sha256"}})
+	c.Add(Stats{URL: "a", Direction: Download, Error: fmt.Errorf("proxy: %w", &InterceptionError{Reason: "content type text/html"})})
+	c.Add(Stats{URL: "a", Direction: Download, Error: errors.New("reset")})
+	c.Add(Stats{URL: "a", Direction: Download, Retrying: true, Error: errors.New("retrying")})
+	c.Add(Stats{URL: "a", Direction: Download, Skipped: true, SkipReason: SkipOutOfTime})
+	c.Add(Stats{URL: "a", Direction: Download, Cancelled: true, SizeBytes: 5, SpeedMbps: 1})
+	// The same URL uploaded, and at a pinned address, is a summary of its
+	// own.
+	up := done("a", 5)
+	up.Direction = Upload
+	c.Add(up)
+	pinned := done("a", 70)
+	pinned.PinnedIP = "192.0.2.1"
+	c.Add(pinned)
+	// With no completed run, partial runs stand in for the speeds.
+	for _, mbps := range []float64{8, 4} {
+		c.Add(Stats{URL: "b", Direction: Download, Cancelled: true, SizeBytes: 5, SpeedMbps: mbps})
+	}
+	c.Add(Stats{URL: "b", Direction: Download, Cancelled: true})
+
+	summaries := c.Summaries()
+	if len(summaries) != 4 {
+		t.Fatalf("%d summaries, want 4", len(summaries))
+	}
+	a := summaries[0]
+	want := Summary{
+		URL: "a", Direction: Download, Runs: 5, Errors: 3, ChecksumErrors: 1, Intercepted: 1, Interception: "content type text/html",
+		Partial: 1, Skipped: 1, SkipReason: SkipOutOfTime,
+		MinMbps: 10, MaxMbps: 50, MeanMbps: 30, MedianMbps: 30, P95Mbps: 48, JitterMbps: 10, MeanTTFBMs: 20,
+	}
+	if fmt.Sprintf("%+v", a) != fmt.Sprintf("%+v", want) {
+		t.Errorf("a summarized as\n%+v\nwant\n%+v", a, want)
+	}
+	if s := summaries[1]; s.Direction != Upload || s.Runs != 1 || s.MedianMbps != 5 || s.P95Mbps != 5 {
+		t.Errorf("upload summarized as %+v", s)
+	}
+	if s := summaries[2]; s.IP != "192.0.2.1" || s.Runs != 1 || s.MeanMbps != 70 {
+		t.Errorf("pinned summarized as %+v", s)
+	}
+	if b := summaries[3]; b.Runs != 0 || b.Partial != 2 || b.MinMbps != 4 || b.MaxMbps != 8 || b.MeanMbps != 6 || !near(b.P95Mbps, 7.8) {
+		t.Errorf("b summarized as %+v", b)
+	}
+	for _, s := range summaries {
+		for _, v := range []float64{s.MinMbps, s.MaxMbps, s.MeanMbps, s.MedianMbps, s.P95Mbps, s.JitterMbps} {
+			if math.IsNaN(v) {
+				t.Errorf("%s %s: NaN in %+v", s.URL, s.Direction, s)
+			}
+		}
+	}
+}
+
+func TestGroups(t *testing.T) {
+	summaries := []Summary{
+		{URL: "a", Group: "cdn", Direction: Download, Runs: 1, MeanMbps: 100},
+		{URL: "b", Group: "cdn", Direction: Download, Runs: 3, Errors: 1, MeanMbps: 20},
+		{URL: "c", Group: "cdn", Direction: Upload, Runs: 2, MeanMbps: 10},
+		{URL: "d", Direction: Download, Runs: 5, MeanMbps: 1},
+		{URL: "e", Group: "cdn", Direction: Latency, Runs: 5},
+		{URL: "f", Group: "cdn", Direction: Download, Errors: 2},
+	}
+	groups := Groups(summaries)
+	want := []GroupSummary{
+		// The mean of all four runs, not of the two URL means.
+		{Group: "cdn", Direction: Download, URLs: 3, Runs: 4, Errors: 3, MeanMbps: 40},
+		{Group: "cdn", Direction: Upload, URLs: 1, Runs: 2, MeanMbps: 10},
+	}
+	if fmt.Sprint(groups) != fmt.Sprint(want) {
+		t.Errorf("Groups = %+v, want %+v", groups, want)
+	}
+}
+
+func TestNames(t *testing.T) {
+	if got := (Stats{URL: "https://cdn.example.com/x?sig=abc"}).DisplayName(); got != "https://cdn.example.com/x?sig=abc" {
+		t.Errorf("unnamed DisplayName = %q, want the URL", got)
+	}
+	if got := (Stats{URL: "https://cdn.example.com/x?sig=abc", Name: "cdn-eu"}).DisplayName(); got != "cdn-eu" {
+		t.Errorf("named DisplayName = %q, want the name", got)
+	}
+	// Results and their summaries carry the name and group of the target.
+	srv := payloadServer(t, 1000, 0)
+	c := NewCollector()
+	tester := New(Options{ProgressInterval: -1})
+	for s := range tester.Run(context.Background(), []Target{
+		{URL: srv.URL + "/bytes/1000", Name: "cdn-eu", Group: "cdn"},
+		{URL: srv.URL + "/bytes/2000"},
+	}, 1) {
+		if s.URL == srv.URL+"/bytes/1000" && (s.Name != "cdn-eu" || s.Group != "cdn") {
+			t.Errorf("%s result named %q in group %q", s.Kind, s.Name, s.Group)
+		}
+		c.Add(s)
+	}
+	summaries := c.Summaries()
+	if len(summaries) != 2 || summaries[0].Name != "cdn-eu" || summaries[0].Group != "cdn" || summaries[1].Name != "" || summaries[1].Group != "" {
+		t.Errorf("summaries %+v", summaries)
+	}
+}
@@ -0,0 +1,140 @@
+package perf
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Sweep defaults.
+const (
+	defaultSweepConcurrency = 16
+	defaultSweepTimeout     = 3 * time.Second
+)
+
+// SkipUnreachableReason is the SkipReason of a target that failed the
+// availability sweep.
+const SkipUnreachableReason = "unreachable in sweep"
+
+// Sweep configures the availability check run before each pass: a HEAD
+// request to every http(s) URL, Concurrency (16 by default) at a time and
+// each bounded by Timeout (3s). SkipUnreachable skips the URLs that failed
+// it for the rest of the pass.
+type Sweep struct {
+	Concurrency     int           `yaml:"concurrency"`
+	Timeout         time.Duration `yaml:"timeout"`
+	SkipUnreachable bool          `yaml:"skip_unreachable"`
+}
+
+// SweepResult is the outcome of sweeping one URL. Method is HEAD, or GET
+// for a server that refused HEAD and was asked for its first byte instead.
+type SweepResult struct {
+	URL        string
+	Name       string
+	Method     string
+	StatusCode int
+	TTFB       time.Duration
+	Error      error
+	ErrorKind  ErrorKind
+}
+
+// Reachable reports whether the URL answered with a status below 400.
+func (r SweepResult) Reachable() bool {
+	return r.Error == nil
+}
+
+// Sweep checks that the http(s) targets answer, in parallel, and returns
+// one result per such target in their order. Other targets are left out.
+func (t *Tester) Sweep(ctx context.Context, targets []Target, cfg Sweep) []SweepResult {
+	var swept []Target
+	for _, target := range targets {
+		if s := scheme(target.URL); s == "http" || s == "https" {
+			swept = append(swept, target)
+		}
+	}
+	results := make([]SweepResult, len(swept))
+	sem := make(chan struct{}, cmp.Or(cfg.Concurrency, defaultSweepConcurrency))
+	var wg sync.WaitGroup
+	for i, target := range swept {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = t.sweep(ctx, target, cmp.Or(cfg.Timeout, defaultSweepTimeout))
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func (t *Tester) sweep(ctx context.Context, target Target, timeout time.Duration) SweepResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	client, release := t.client(target)
+	defer release()
+
+	r := SweepResult{URL: target.configuredURL(), Name: target.Name, Method: http.MethodHead}
+	resp, ttfb, err := t.sweepProbe(ctx, client, target, http.MethodHead)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp.Body.Close()
+		r.Method = http.MethodGet
+		resp, ttfb, err = t.sweepProbe(ctx, client, target, http.MethodGet)
+	}
+	if err != nil {
+		r.Error, r.ErrorKind = err, Classify(err)
+		return r
+	}
+	defer resp.Body.Close()
+	r.StatusCode, r.TTFB = resp.StatusCode, ttfb
+	if err := checkStatus(resp); err != nil {
+		r.Error, r.ErrorKind = err, Classify(err)
+	}
+	return r
+}
+
+// sweepProbe sends one method request for target, asking a GET for the
+// first byte only, and returns the response with its TTFB.
+func (t *Tester) sweepProbe(ctx context.Context, client *http.Client, target Target, method string) (*http.Response, time.Duration, error) {
+	timer := t.phaseTimer(target.URL)
+	req, err := http.NewRequestWithContext(timer.context(ctx), method, target.URL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	target.prepare(req)
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	var stats Stats
+	timer.apply(&stats)
+	if method == http.MethodGet {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<10))
+	}
+	return resp, stats.TTFB, nil
+}
+
+// SkipUnreachable returns targets with those whose sweep failed marked to
+// be skipped with SkipUnreachableReason.
+func SkipUnreachable(targets []Target, results []SweepResult) []Target {
+	failed := map[string]bool{}
+	for _, r := range results {
+		if !r.Reachable() {
+			failed[r.URL] = true
+		}
+	}
+	out := make([]Target, len(targets))
+	for i, target := range targets {
+		if failed[target.URL] {
+			target.skipReason = SkipUnreachableReason
+		}
+		out[i] = target
+	}
+	return out
+}
@@ -0,0 +1,161 @@
+package perf
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sweepServer answers /ok, refuses HEAD on /nohead, fails /missing and
+// holds /hang past any sweep timeout, tracking how many requests it has
+// in flight at once.
+func sweepServer(t *testing.T) (*httptest.Server, func() int) {
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+		switch r.URL.Path {
+		case "/nohead":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if r.Header.Get("Range") != "bytes=0-0" {
+				t.Errorf("GET fallback asked for range %q", r.Header.Get("Range"))
+			}
+			w.Header().Set("Content-Range", "bytes 0-0/1000")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte{0})
+		case "/missing":
+			http.NotFound(w, r)
+		case "/hang":
+			<-r.Context().Done()
+		default:
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(func() {
+		srv.CloseClientConnections()
+		srv.Close()
+	})
+	return srv, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return peak
+	}
+}
+
+// refusedURL returns a URL on a port nothing listens on.
+func refusedURL(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return "http://" + l.Addr().String() + "/"
+}
+
+func TestSweep(t *testing.T) {
+	srv, _ := sweepServer(t)
+	refused := refusedURL(t)
+	targets := []Target{
+		{URL: srv.URL + "/ok", Name: "origin"},
+		{URL: "ftp://ftp.example.com/file"},
+		{URL: srv.URL + "/nohead"},
+		{URL: srv.URL + "/missing"},
+		{URL: refused},
+		{URL: srv.URL + "/hang"},
+	}
+	start := time.Now()
+	results := New(Options{ProgressInterval: -1}).Sweep(context.Background(), targets, Sweep{Timeout: 300 * time.Millisecond})
+	if took := time.Since(start); took > 3*time.Second {
+		t.Errorf("sweep took %v with a 300ms timeout", took)
+	}
+	// The ftp URL is left out, the rest keep their order.
+	if len(results) != 5 {
+		t.Fatalf("%d results, want 5: %+v", len(results), results)
+	}
+	tests := []struct {
+		url       string
+		method    string
+		status    int
+		reachable bool
+		kind      ErrorKind
+	}{
+		{srv.URL + "/ok", http.MethodHead, 200, true, ""},
+		{srv.URL + "/nohead", http.MethodGet, 206, true, ""},
+		{srv.URL + "/missing", http.MethodHead, 404, false, ErrorHTTPStatus},
+		{refused, http.MethodHead, 0, false, ErrorConnect},
+		{srv.URL + "/hang", http.MethodHead, 0, false, ErrorTimeout},
+	}
+	for i, tt := range tests {
+		r := results[i]
+		if r.URL != tt.url || r.Method != tt.method || r.StatusCode != tt.status || r.Reachable() != tt.reachable || r.ErrorKind != tt.kind {
+			t.Errorf("swept %s as %s %d reachable %v %q (%v), want %s %d %v %q", r.URL, r.Method, r.StatusCode, r.Reachable(), r.ErrorKind, r.Error, tt.method, tt.status, tt.reachable, tt.kind)
+		}
+		if tt.reachable && r.TTFB <= 0 {
+			t.Errorf("%s: TTFB %v", r.URL, r.TTFB)
+		}
+	}
+	if results[0].Name != "origin" {
+		t.Errorf("name %q", results[0].Name)
+	}
+
+	// The sweep's concurrency is its own, whatever the main one.
+	for _, n := range []int{1, 3} {
+		srv, peak := sweepServer(t)
+		many := make([]Target, 12)
+		for i := range many {
+			many[i] = Target{URL: srv.URL + "/ok"}
+		}
+		for _, r := range New(Options{ProgressInterval: -1}).Sweep(context.Background(), many, Sweep{Concurrency: n}) {
+			if !r.Reachable() {
+				t.Fatal(r.Error)
+			}
+		}
+		if got := peak(); got != n {
+			t.Errorf("concurrency %d: %d requests in flight at once", n, got)
+		}
+	}
+}
+
+func TestSkipUnreachable(t *testing.T) {
+	srv := payloadServer(t, 1000, 0)
+	refused := refusedURL(t)
+	targets := []Target{{URL: srv.URL + "/bytes/1000"}, {URL: refused}, {URL: srv.URL + "/status/503"}}
+	tester := New(Options{ProgressInterval: -1})
+	sweep := tester.Sweep(context.Background(), targets, Sweep{SkipUnreachable: true})
+	var finals []Stats
+	for s := range tester.Run(context.Background(), SkipUnreachable(targets, sweep), 1) {
+		if s.Final() {
+			finals = append(finals, s)
+		}
+	}
+	if len(finals) != 3 {
+		t.Fatalf("%d results, want 3", len(finals))
+	}
+	if s := finals[0]; s.Error != nil || s.Skipped || s.SizeBytes != 1000 {
+		t.Errorf("reachable URL: %+v", s)
+	}
+	for _, s := range finals[1:] {
+		if s.Kind != KindSkipped || s.SkipReason != SkipUnreachableReason {
+			t.Errorf("%s is %s (%q), want skipped as unreachable", s.URL, s.Kind, s.SkipReason)
+		}
+	}
+	// The targets given are left alone.
+	if again := SkipUnreachable(targets, nil); again[1].skipReason != "" || targets[1].skipReason != "" {
+		t.Error("an empty sweep skipped a target")
+	}
+}
@@ -0,0 +1,42 @@
+package perf
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readTCPInfo queries TCP_INFO on conn, or returns nil when conn is not a
+// TCP socket or is already closed.
+func readTCPInfo(conn net.Conn) *TCPInfo {
+	// Unwrap TLS and wire counting down to the socket.
+	for {
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapped.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var info *unix.TCPInfo
+	if ctrlErr := raw.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}); ctrlErr != nil || err != nil {
+		return nil
+	}
+	return &TCPInfo{
+		RTT:              time.Duration(info.Rtt) * time.Microsecond,
+		RTTVar:           time.Duration(info.Rttvar) * time.Microsecond,
+		Retransmits:      info.Total_retrans,
+		DeliveryRateMbps: float64(info.Delivery_rate) * 8 / 1e6,
+	}
+}
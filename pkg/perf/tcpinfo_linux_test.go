@@ -0,0 +1,81 @@
+package perf
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTCPInfo(t *testing.T) {
+	body := make([]byte, 4000000)
+	ranges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(body))
+	}))
+	defer ranges.Close()
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000000")
+		w.Write(make([]byte, 1000000))
+	}))
+	defer tlsSrv.Close()
+	upload := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer upload.Close()
+	tests := []struct {
+		name   string
+		opts   Options
+		target Target
+	}{
+		{"download", Options{}, Target{URL: ranges.URL}},
+		{"streams", Options{}, Target{URL: ranges.URL, Streams: 3}},
+		{"upload", Options{}, Target{URL: upload.URL, Method: MethodUpload, UploadSize: 4000000}},
+		// The TLS connection is unwrapped down to the socket.
+		{"tls", Options{TLSConfig: &tls.Config{RootCAs: tlsSrv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}}, Target{URL: tlsSrv.URL}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.ProgressInterval = -1
+			all := collect(New(tt.opts).Test(context.Background(), tt.target))
+			last := all[len(all)-1]
+			if last.Error != nil {
+				t.Fatal(last.Error)
+			}
+			if last.TCP == nil {
+				t.Fatal("no TCP_INFO on a localhost transfer")
+			}
+			if last.TCP.RTT <= 0 || last.TCP.RTTVar <= 0 || last.TCP.DeliveryRateMbps <= 0 {
+				t.Errorf("TCP_INFO %+v, want an rtt and a delivery rate", *last.TCP)
+			}
+		})
+	}
+}
+
+func TestReadTCPInfoNotTCP(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	if info := readTCPInfo(client); info != nil {
+		t.Errorf("a pipe has TCP_INFO %+v", info)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readTCPInfo(conn) == nil {
+		t.Error("no TCP_INFO on an open connection")
+	}
+	conn.Close()
+	if info := readTCPInfo(conn); info != nil {
+		t.Errorf("a closed connection has TCP_INFO %+v", info)
+	}
+}
@@ -0,0 +1,895 @@
+package perf
+
+import (
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Options configures a Tester.
+type Options struct {
+	// Client performs the requests. When nil, each target's downloads and
+	// uploads share a transport using TLSConfig for the Tester's lifetime,
+	// so later passes can reuse its connections; other tests, and targets
+	// with FreshConnection, get a fresh one each time.
+	Client *http.Client
+	// FreshConnection gives every download and upload a fresh transport,
+	// unless the Target overrides it.
+	FreshConnection bool
+	// MaxIdleConnsPerHost and IdleConnTimeout bound the idle connections
+	// the default client keeps, 2 and 90 seconds by default.
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// CacheMode is CacheCold to give every download and upload a fresh
+	// transport and look hosts up without a caching system resolver, or
+	// CacheWarm to keep DNS answers for their TTL and idle connections
+	// without a timeout between passes. It is recorded in every Stats.
+	CacheMode string
+	// LatencyGrading grades the round trips of bufferbloat probes.
+	LatencyGrading LatencyGrading
+	// TLSConfig is used for the default client. It is ignored when Client
+	// is set.
+	TLSConfig *tls.Config
+	// Proxy routes the default client through an HTTP(S) or SOCKS5 proxy.
+	// When nil, HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honoured.
+	Proxy *url.URL
+	// Resolver looks up hosts for the default client; see NewResolver. Nil
+	// uses the system resolver.
+	Resolver *net.Resolver
+	// Timeout bounds each test. Zero means no limit.
+	Timeout time.Duration
+	// ConnectTimeout, TLSTimeout and HeaderTimeout bound the lookup and
+	// dial, the TLS handshake and the wait for response headers of the
+	// default client. Zero means no limit of their own.
+	ConnectTimeout time.Duration
+	TLSTimeout     time.Duration
+	HeaderTimeout  time.Duration
+	// Limits applies to every test unless the Target overrides it.
+	Limits Limits
+	// Streams is the number of parallel connections used per download
+	// unless the Target overrides it. Values below 2 use one connection.
+	Streams int
+	// TrimRagged bases the speed of a multi-stream download on the bytes
+	// counted until its first stream finished, leaving out the tail where
+	// fewer streams ran.
+	TrimRagged bool
+	// Retries is how many times a failed test is repeated before its error
+	// is reported.
+	Retries int
+	// RetryBackoff is the delay before the first retry; later retries double
+	// it. It defaults to one second.
+	RetryBackoff time.Duration
+	// BufferSize is the read buffer used per connection. It defaults to
+	// 32 KiB.
+	BufferSize int
+	// IPVersion is "4" or "6" to force the address family, or "auto"/empty
+	// to let the resolver decide, unless the Target overrides it.
+	IPVersion string
+	// Warmup is the opening part of every transfer left out of its speed, so
+	// slow start and connection setup do not drag the average down.
+	Warmup time.Duration
+	// Protocol selects h1, h2 or h3 for the default client unless the
+	// Target overrides it; empty or "auto" negotiates h1 or h2. Fallback
+	// lets a failed h3 request be retried over TCP.
+	Protocol string
+	Fallback bool
+	// Compression is "identity" (the default) or "accept", unless the
+	// Target overrides it. With accept, gzip bodies are decoded and speeds
+	// still use the compressed byte count.
+	Compression string
+	// NormalizeEncoding asks for identity bodies whatever Compression says
+	// and fails downloads that still come compressed, unless the Target
+	// overrides it.
+	NormalizeEncoding bool
+	// UserAgent and Preset identify the client to targets that set
+	// neither.
+	UserAgent string
+	Preset    string
+	// Count is "body" (the default) or "wire", unless the Target overrides
+	// it. With wire, a completed HTTP download counts every byte read off
+	// its connections and times its speed from the request. It has no
+	// effect with an injected Client.
+	Count string
+	// FollowRedirects controls whether the default client follows 3xx
+	// responses, unless the Target overrides it. Nil means follow; a 3xx
+	// that is not followed fails the test.
+	FollowRedirects *bool
+	// MaxRedirects is how many redirects the default client follows before
+	// failing, unless the Target overrides it. It defaults to 10.
+	MaxRedirects int
+	// Preflight sends a HEAD request before each download to learn the
+	// expected size, unless the Target overrides it.
+	Preflight bool
+	// Logger receives debug detail about connections, redirects and
+	// retries. Use slog.New to plug in your own handler. It defaults to
+	// slog.Default().
+	Logger *slog.Logger
+	// RunID, Host and Labels are attached to every Stats. RunID defaults to
+	// a new UUID and Host to the hostname.
+	RunID  string
+	Host   string
+	Labels map[string]string
+	// RunStart is the instant Stats.RunOffset and Sample.RunOffset count
+	// from, on the monotonic clock, so it must come from time.Now rather
+	// than be parsed. It defaults to when New is called.
+	RunStart time.Time
+	// Clock stamps results and samples with the wall time. It defaults to
+	// the system clock.
+	Clock Clock
+	// RateLimit caps the speed of each transfer unless the Target overrides
+	// it. TotalRateLimit caps all transfers of the Tester together.
+	RateLimit      Rate
+	TotalRateLimit Rate
+	// Mode is "fixed" (the default) or "adaptive" unless the Target
+	// overrides it. Adaptive downloads stop once their speed is stable as
+	// set by Adaptive, or after 30 seconds without another max_duration.
+	Mode     string
+	Adaptive Adaptive
+	// ShiftDetection tunes how a lasting change of speed is found in the
+	// samples of each transfer.
+	ShiftDetection ShiftDetection
+	// MinBudget is the least time before ctx's deadline that Run still
+	// starts a target in.
+	MinBudget time.Duration
+	// Breaker, when set, skips the rest of a pass of Run once the transfers
+	// it started with all failed to reach their servers.
+	Breaker *Breaker
+	// StallThreshold is how long a transfer must stay below StallFloor (no
+	// bytes at all when zero) to count as stalled, 5 seconds by default.
+	// AbortOnStall fails it once it has. The Target may override each.
+	StallThreshold time.Duration
+	StallFloor     Rate
+	AbortOnStall   bool
+	// MinSpeedFloor aborts a download averaging less over the last
+	// FloorGrace, 10 seconds by default, unless the Target overrides them.
+	MinSpeedFloor Rate
+	FloorGrace    time.Duration
+	// PerHostConcurrency limits how many transfers Run has in flight per
+	// pool, the Target's pool tag or else its host, so downloads from one
+	// origin do not slow each other down. Zero means no limit.
+	PerHostConcurrency int
+	// ProgressInterval is how often transfers send a progress snapshot, once
+	// a second when zero. A negative interval sends none, only the final
+	// result; transfers still check for stalls and stable speeds every
+	// second.
+	ProgressInterval time.Duration
+	// CPUThreshold is the share of one core, 0.8 when zero, the process
+	// may use during a transfer before its Stats warn that the measurement
+	// may be CPU-bound. A negative threshold turns CPU sampling off.
+	CPUThreshold float64
+	// LinkCapacity is the plan speed that Stats report their Utilization
+	// of.
+	LinkCapacity LinkCapacity
+	// Hold, when set, is called by Run before it starts each target and may
+	// block, holding the rest of the pass back while the caller is paused.
+	Hold func(context.Context)
+}
+
+// Tester measures download and upload speeds.
+type Tester struct {
+	opts  Options
+	total *limiter
+	// buffers holds read buffers, so repeated and parallel transfers do not
+	// each allocate their own.
+	buffers sync.Pool
+	// kept holds the clients of targets, by target, kept between passes.
+	keptMu sync.Mutex
+	kept   map[keptKey]keptClient
+	// resources reads the process's CPU and GC totals, processResources
+	// when nil.
+	resources resourceReader
+}
+
+// New returns a Tester configured by opts.
+func New(opts Options) *Tester {
+	if opts.RunID == "" {
+		opts.RunID = NewRunID()
+	}
+	if opts.Host == "" {
+		opts.Host, _ = os.Hostname()
+	}
+	if opts.RunStart.IsZero() {
+		opts.RunStart = time.Now()
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	switch opts.CacheMode {
+	case CacheCold:
+		opts.Resolver = coldResolver(opts.Resolver)
+	case CacheWarm:
+		opts.Resolver = warmResolver(opts.Resolver)
+	}
+	size := 32 * 1024
+	if opts.BufferSize > 0 {
+		size = opts.BufferSize
+	}
+	t := &Tester{opts: opts, total: newLimiter(opts.TotalRateLimit)}
+	t.buffers.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return t
+}
+
+func (t *Tester) log() *slog.Logger {
+	if t.opts.Logger != nil {
+		return t.opts.Logger
+	}
+	return slog.Default()
+}
+
+// Test runs the transfer described by target. The channel carries its
+// snapshots, ending with exactly one terminal one, and is then closed. A
+// bidirectional target ends with one per transfer it runs.
+func (t *Tester) Test(ctx context.Context, target Target) <-chan Stats {
+	target = t.resolve(target)
+	if target.Bidirectional {
+		return t.bidirectional(ctx, target)
+	}
+	return t.terminate(ctx, target, t.test(ctx, target))
+}
+
+func (t *Tester) test(ctx context.Context, target Target) <-chan Stats {
+	if target.resolveErr != nil {
+		e := t.newEmitter(ctx, target)
+		go func() {
+			defer close(e.ch)
+			e.send(Stats{URL: target.URL, Direction: target.Direction(), Error: target.resolveErr})
+		}()
+		return e.ch
+	}
+	run := func(ctx context.Context) <-chan Stats {
+		switch scheme(target.URL) {
+		case SchemeFTP:
+			return t.rawDownload(ctx, target, "FTP", t.openFTP(target))
+		case SchemeTCP:
+			return t.rawDownload(ctx, target, "TCP", t.openTCP(target))
+		case SchemeFile:
+			return t.rawDownload(ctx, target, "file", t.openFile(target))
+		}
+		switch target.Method {
+		case MethodUpload:
+			return t.upload(ctx, target)
+		case MethodLatency:
+			return t.latency(ctx, target)
+		}
+		if target.ReuseProbe {
+			return t.reuseProbe(ctx, target)
+		}
+		if target.Resume {
+			return t.resume(ctx, target)
+		}
+		// Ranges arrive out of order, so a checksum or an output file needs
+		// a single stream.
+		if target.Streams > 1 && target.digest() == nil && target.Sink != SinkFile {
+			return t.multiDownload(ctx, target, target.Streams)
+		}
+		return t.download(ctx, target)
+	}
+	if target.Bufferbloat {
+		download := run
+		run = func(ctx context.Context) <-chan Stats {
+			return t.bufferbloat(ctx, target, download)
+		}
+	}
+	if t.opts.Retries > 0 {
+		return t.retry(ctx, target, run)
+	}
+	return run(ctx)
+}
+
+// resolve fills the settings target leaves unset from the Tester options.
+func (t *Tester) resolve(target Target) Target {
+	target.Limits = t.opts.Limits.merge(target.Limits)
+	if target.Streams == 0 {
+		target.Streams = t.opts.Streams
+	}
+	if target.IPVersion == "" {
+		target.IPVersion = t.opts.IPVersion
+	}
+	if target.Protocol == "" {
+		target.Protocol = t.opts.Protocol
+	}
+	if target.Compression == "" {
+		target.Compression = t.opts.Compression
+	}
+	if target.Count == "" {
+		target.Count = t.opts.Count
+	}
+	if target.UserAgent == "" {
+		target.UserAgent = t.opts.UserAgent
+	}
+	if target.Preset == "" {
+		target.Preset = t.opts.Preset
+	}
+	if target.FreshConnection == nil {
+		target.FreshConnection = &t.opts.FreshConnection
+	}
+	if target.NormalizeEncoding == nil {
+		target.NormalizeEncoding = &t.opts.NormalizeEncoding
+	}
+	if target.FollowRedirects == nil {
+		target.FollowRedirects = t.opts.FollowRedirects
+	}
+	if target.Preflight == nil {
+		target.Preflight = &t.opts.Preflight
+	}
+	if target.RateLimit == 0 {
+		target.RateLimit = t.opts.RateLimit
+	}
+	if target.MaxRedirects == 0 {
+		target.MaxRedirects = t.opts.MaxRedirects
+	}
+	if target.Mode == "" {
+		target.Mode = t.opts.Mode
+	}
+	if target.StallThreshold == 0 {
+		target.StallThreshold = t.opts.StallThreshold
+	}
+	if target.StallFloor == 0 {
+		target.StallFloor = t.opts.StallFloor
+	}
+	if target.MinSpeedFloor == 0 {
+		target.MinSpeedFloor = t.opts.MinSpeedFloor
+	}
+	if target.FloorGrace == 0 {
+		target.FloorGrace = t.opts.FloorGrace
+	}
+	if target.AbortOnStall == nil {
+		target.AbortOnStall = &t.opts.AbortOnStall
+	}
+	if target.Mode == ModeAdaptive && target.MaxDuration == 0 {
+		target.MaxDuration = adaptiveCap
+	}
+	// The keys are looked up for every test, so rotated ones are picked up
+	// between passes.
+	if target.S3 != nil && target.resolveErr == nil {
+		creds, err := target.S3.credentials()
+		if err != nil {
+			target.resolveErr = fmt.Errorf("s3: %w", err)
+		}
+		target.s3Creds = &creds
+	}
+	return target
+}
+
+// Download starts downloading url and returns a channel that receives a
+// progress snapshot every second and a final snapshot before it is closed.
+// The caller should drain the channel; if it stops reading, cancelling ctx
+// releases the download.
+func (t *Tester) Download(ctx context.Context, url string) <-chan Stats {
+	target := t.resolve(Target{URL: url, Streams: 1})
+	return t.terminate(ctx, target, t.download(ctx, target))
+}
+
+// DownloadWithProgress downloads url, calling progress with every snapshot
+// including the final one, and returns the final snapshot. The error is the
+// transfer's, or ctx's when it was cancelled first. progress is called from
+// a single goroutine in snapshot order and should not block; while it
+// runs, newer snapshots replace the one waiting, so a slow callback skips
+// progress snapshots rather than holding up the download.
+func (t *Tester) DownloadWithProgress(ctx context.Context, url string, progress func(Stats)) (Stats, error) {
+	return wait(ctx, t.Download(ctx, url), progress)
+}
+
+// DownloadAndWait downloads url and returns its final snapshot, like
+// DownloadWithProgress without a callback.
+func (t *Tester) DownloadAndWait(ctx context.Context, url string) (Stats, error) {
+	return wait(ctx, t.Download(ctx, url), nil)
+}
+
+// wait drains ch, handing its snapshots to progress when it is set, and
+// returns the last one.
+func wait(ctx context.Context, ch <-chan Stats, progress func(Stats)) (Stats, error) {
+	pending := make(chan Stats, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for stats := range pending {
+			progress(stats)
+		}
+	}()
+	var last Stats
+	for stats := range ch {
+		last = stats
+		if progress == nil {
+			continue
+		}
+		select {
+		case pending <- stats:
+		default:
+			// progress is still busy: swap the waiting snapshot for this one.
+			select {
+			case <-pending:
+			default:
+			}
+			pending <- stats
+		}
+	}
+	close(pending)
+	<-done
+	switch {
+	case last.Error != nil:
+		return last, last.Error
+	case !last.Done:
+		return last, ctx.Err()
+	}
+	return last, nil
+}
+
+func (t *Tester) download(ctx context.Context, target Target) <-chan Stats {
+	client, release := t.session(target)
+	return t.fetch(ctx, target, client, release)
+}
+
+// fetch downloads target with client and calls release when done.
+func (t *Tester) fetch(ctx context.Context, target Target, client *http.Client, release func()) <-chan Stats {
+	url, limits := target.URL, target.Limits
+	ctx, cancel := t.withTimeout(ctx)
+	e := t.newEmitter(ctx, target)
+
+	go func() {
+		defer close(e.ch)
+		defer cancel()
+		defer release()
+
+		base := Stats{URL: url, Direction: Download, Proxy: t.proxyFor(url), Adaptive: target.Mode == ModeAdaptive}
+		if *target.Preflight && target.resumeFrom == 0 {
+			if err := t.preflight(ctx, target, &base); err != nil {
+				if ctx.Err() != nil {
+					e.interrupt(base, 0, time.Time{})
+				} else {
+					base.Error = err
+					e.send(base)
+				}
+				return
+			}
+		}
+
+		timer := t.phaseTimer(url)
+		e.timer = timer
+		reqCtx := timer.context(ctx)
+		var wire *atomic.Int64
+		if target.Count == CountWire {
+			wire = new(atomic.Int64)
+			reqCtx = countWire(reqCtx, wire)
+		}
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
+		if err != nil {
+			base.Error = err
+			e.send(base)
+			return
+		}
+		target.prepare(req)
+		target.requestRest(req)
+		target.requestSize(req)
+		target.requestOffset(req)
+		requested := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				e.interrupt(base, 0, time.Time{})
+			} else {
+				base.Error = timer.timedOut(err, &t.opts)
+				e.send(base)
+			}
+			return
+		}
+		defer resp.Body.Close()
+
+		timer.apply(&base)
+		recordResponse(&base, resp, target.CaptureHeaders)
+		if base.ExpectedBytes == 0 && resp.ContentLength > 0 {
+			base.ExpectedBytes = resp.ContentLength
+		}
+		if base.ETag == "" {
+			base.ETag = resp.Header.Get("ETag")
+		}
+		if err := checkStatus(resp); err != nil {
+			base.Error = err
+			e.send(base)
+			return
+		}
+		if err := target.checkEncoding(resp); err != nil {
+			base.Error = err
+			e.send(base)
+			return
+		}
+		if err := target.checkContentType(resp); err != nil {
+			base.Error = err
+			e.send(base)
+			return
+		}
+		if resp.ContentLength >= 0 && target.resumeFrom == 0 && !target.sampleRanged {
+			if err := target.checkSize(resp.ContentLength); err != nil {
+				base.Error = err
+				e.send(base)
+				return
+			}
+		}
+		if target.resumeFrom > 0 {
+			if err := checkResumed(resp, target.resumeFrom); err != nil {
+				base.Error = err
+				e.send(base)
+				return
+			}
+		}
+		if err := target.checkSampled(resp); err != nil {
+			base.Error = err
+			e.send(base)
+			return
+		}
+
+		// The body is read on its own goroutine so the hot path is a plain
+		// Read loop; this loop only wakes for ticks and closes the body to
+		// stop the reader early.
+		// With a gzip body, downloaded counts the compressed bytes and
+		// decoded the bytes after inflating them.
+		readCtx, stopReading := context.WithCancel(ctx)
+		defer stopReading()
+		var downloaded, decoded atomic.Int64
+		body := t.throttle(readCtx, newShaper(target.Simulate).reader(readCtx, resp.Body), newLimiter(target.RateLimit))
+		counter := &downloaded
+		// The rest of a resumed gzip body cannot be inflated on its own.
+		if target.Compression == CompressionAccept && resp.Header.Get("Content-Encoding") == "gzip" && target.resumeFrom == 0 {
+			body = &gzipBody{r: &countingReader{r: body, n: &downloaded}}
+			counter = &decoded
+		}
+		sum := target.digest()
+		if sum != nil {
+			body = io.TeeReader(body, sum)
+		}
+		if check := target.patternCheck(target.resumeFrom); check != nil {
+			body = io.TeeReader(body, check)
+		}
+		out, err := target.openSink()
+		if err != nil {
+			base.Error = err
+			e.send(base)
+			return
+		}
+		if out != nil {
+			defer out.close()
+			body = io.TeeReader(body, out)
+		}
+		var lastDownloaded int64
+		start := time.Now()
+		lastTick := start
+		done := make(chan error, 1)
+		go func() {
+			buf, release := t.buffer()
+			defer release()
+			done <- drain(body, buf, int64(limits.MaxBytes), counter)
+		}()
+		stop := func() {
+			stopReading()
+			resp.Body.Close()
+			<-done
+		}
+
+		// A body of unknown length may never end, so without a limit of its
+		// own it is cut off after streamCap.
+		streaming := base.ExpectedBytes == 0 && resp.ContentLength < 0 && limits == Limits{}
+		if streaming {
+			limits.MaxDuration = streamCap
+			t.log().Info("response has no length, stopping it after the stream cap", "url", url, "cap", streamCap)
+		}
+		truncated := false
+		ticker := t.ticker(target)
+		defer ticker.Stop()
+		deadline := limits.deadline()
+		defer deadline.Stop()
+		m := t.newMeter(target)
+		st := t.stabilizer(target)
+
+		finish := func() {
+			stats := base
+			stats.Done = true
+			stats.Truncated = truncated
+			n, from := downloaded.Load(), start
+			if wire != nil {
+				// Wire bytes start with the response headers, so the speed
+				// is timed from the request.
+				n, from = wire.Load(), requested
+				stats.WireCounted = true
+			}
+			m.final(&stats, n, from, time.Now())
+			stats.TCP = timer.tcpInfo()
+			stats.WireBytes, stats.BodyBytes = n, downloaded.Load()
+			if counter == &decoded {
+				stats.BodyBytes = decoded.Load()
+			}
+			if out != nil {
+				out.done(&stats)
+			}
+			e.send(stats)
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				stop()
+				e.interrupt(base, downloaded.Load(), start)
+				return
+			case <-deadline.C:
+				stop()
+				truncated = streaming
+				finish()
+				return
+			case now := <-ticker.C:
+				n := downloaded.Load()
+				if !ticker.due(now, m, n) {
+					continue
+				}
+				stats := progress(base, m, n, lastDownloaded, start, lastTick, now)
+				if !e.progress(stats) {
+					stop()
+					e.interrupt(base, downloaded.Load(), start)
+					return
+				}
+				lastDownloaded, lastTick = n, now
+				if err := cmp.Or(m.stall.aborted(), m.floor.aborted()); err != nil {
+					stop()
+					stats := base
+					stats.Error = err
+					var slow *SlowError
+					stats.SlowAborted = errors.As(err, &slow)
+					m.final(&stats, downloaded.Load(), start, time.Now())
+					stats.TCP = timer.tcpInfo()
+					e.send(stats)
+					return
+				}
+				if mbps, ok := st.add(stats); ok {
+					stop()
+					base.StableMbps, base.StableAfter = mbps, now.Sub(start)
+					finish()
+					return
+				}
+			case err := <-done:
+				n := downloaded.Load()
+				switch {
+				case errors.Is(err, errLimitReached):
+					err = nil
+				case err == io.EOF:
+					err = checkLength(n, base.ExpectedBytes)
+					if err == nil && sum != nil {
+						err = sum.verify()
+					}
+					if err == nil {
+						err = target.checkSize(target.resumeFrom + counter.Load())
+					}
+				case err == io.ErrUnexpectedEOF && base.ExpectedBytes > 0:
+					err = shortRead(n, base.ExpectedBytes)
+				}
+				switch {
+				case err == nil:
+					finish()
+				case ctx.Err() != nil:
+					e.interrupt(base, n, start)
+				default:
+					stats := base
+					stats.Error = err
+					stats.setSpeed(n, time.Since(start))
+					e.send(stats)
+				}
+				return
+			}
+		}
+	}()
+
+	return e.ch
+}
+
+// tooLate reports whether a target should no longer be started under ctx.
+func (t *Tester) tooLate(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) < t.opts.MinBudget
+}
+
+// skipped is the only snapshot of a target that was never started, for
+// its skipReason or because the run is out of time.
+func (t *Tester) skipped(ctx context.Context, target Target) Stats {
+	stats := Stats{URL: target.URL, Direction: target.Direction(), Skipped: true, SkipReason: cmp.Or(target.skipReason, SkipOutOfTime)}
+	t.newEmitter(ctx, target).stamp(&stats)
+	return stats
+}
+
+// streamCap bounds downloads of unknown length that set no limits. Tests
+// shorten it.
+var streamCap = 15 * time.Second
+
+// Run tests targets with up to concurrency transfers in flight and merges
+// their snapshots onto the returned channel, which is closed once every
+// transfer has finished. Targets not started before ctx is done, or while
+// less than MinBudget of its deadline is left, get a Skipped snapshot.
+// Targets with ResolveAll are tested once per address of their host, and
+// those with DualstackCompare once per address family and those with a
+// SizeSweep once per size. With PerHostConcurrency set, targets of a pool
+// busy with that many transfers wait their turn while others start.
+func (t *Tester) Run(ctx context.Context, targets []Target, concurrency int) <-chan Stats {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	out := make(chan Stats)
+	jobs := newPacer(ctx, t.opts.PerHostConcurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				target, held, ok := jobs.next()
+				if !ok {
+					return
+				}
+				if t.opts.Hold != nil {
+					t.opts.Hold(ctx)
+				}
+				if target.skipReason == "" && t.opts.Breaker.tripped() {
+					target.skipReason = SkipLinkDown
+				}
+				if target.skipReason != "" || t.tooLate(ctx) {
+					stats := t.skipped(ctx, target)
+					t.opts.Breaker.observe(target.order, &stats)
+					out <- stats
+				} else {
+					target.queueWait = held
+					for stats := range t.Test(ctx, target) {
+						if t.opts.Breaker.observe(target.order, &stats) {
+							t.log().Warn("link down, skipping the rest of the pass", "url", stats.URL, "err", stats.Error)
+						}
+						out <- stats
+					}
+				}
+				jobs.release(target)
+			}
+		}()
+	}
+
+	t.opts.Breaker.startPass()
+	go func() {
+		defer jobs.close()
+		jobs.add(t.expand(ctx, targets))
+	}()
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
+// buffer returns a read buffer of BufferSize bytes from the Tester's pool
+// and the func that gives it back once the read loop is done with it.
+func (t *Tester) buffer() ([]byte, func()) {
+	buf := t.buffers.Get().(*[]byte)
+	return *buf, func() { t.buffers.Put(buf) }
+}
+
+// drain reads body until EOF, an error, or until count reaches maxBytes
+// (when positive), adding every byte read to count. It returns io.EOF at the
+// end of the body and errLimitReached when stopped by maxBytes.
+func drain(body io.Reader, buf []byte, maxBytes int64, count *atomic.Int64) error {
+	for {
+		b := buf
+		if maxBytes > 0 {
+			if remaining := maxBytes - count.Load(); remaining < int64(len(b)) {
+				b = b[:max(remaining, 1)]
+			}
+		}
+		n, err := body.Read(b)
+		if total := count.Add(int64(n)); maxBytes > 0 && total >= maxBytes {
+			return errLimitReached
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (t *Tester) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if t.opts.Timeout > 0 {
+		return context.WithTimeout(ctx, t.opts.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func recordResponse(stats *Stats, resp *http.Response, capture HeaderNames) {
+	stats.StatusCode = resp.StatusCode
+	stats.Headers, stats.HeadersTruncated = capture.capture(resp.Header)
+	stats.Protocol = resp.Proto
+	stats.ContentEncoding = contentEncoding(resp)
+	if state := resp.TLS; state != nil {
+		stats.TLSVersion = tls.VersionName(state.Version)
+		stats.Cipher = tls.CipherSuiteName(state.CipherSuite)
+		stats.ALPN = state.NegotiatedProtocol
+	}
+}
+
+// StatusError reports a response outside 2xx.
+type StatusError struct {
+	Code   int
+	Status string
+	// Location is the redirect target of a 3xx that was not followed.
+	Location string
+	// Body is the start of the response body, to tell error pages apart.
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	msg := "unexpected status " + e.Status
+	if e.Location != "" {
+		msg += " (Location: " + e.Location + ")"
+	}
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+// checkStatus rejects responses outside 2xx. It reads a bounded amount of
+// the body into the error instead of measuring it.
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	err := &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	if resp.StatusCode >= 300 && resp.StatusCode <= 399 {
+		err.Location = resp.Header.Get("Location")
+	}
+	if snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 200)); utf8.Valid(snippet) {
+		line, _, _ := strings.Cut(strings.TrimSpace(string(snippet)), "\n")
+		err.Body = strings.TrimSpace(line)
+	}
+	return err
+}
+
+// countingReader adds every byte read from r to n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// gzipBody inflates r, reading the gzip header on first use so a bad header
+// surfaces as a read error like any other.
+type gzipBody struct {
+	r  io.Reader
+	gz *gzip.Reader
+}
+
+func (g *gzipBody) Read(b []byte) (int, error) {
+	if g.gz == nil {
+		gz, err := gzip.NewReader(g.r)
+		if err != nil {
+			return 0, fmt.Errorf("gzip: %w", err)
+		}
+		g.gz = gz
+	}
+	return g.gz.Read(b)
+}
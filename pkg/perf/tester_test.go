@@ -0,0 +1,701 @@
+package perf
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// payloadServer serves /bytes/{n}, n zero bytes written in chunks of
+// chunk with a pause between them, and /status/{code}.
+func payloadServer(t testing.TB, chunk int, pause time.Duration) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /bytes/{n}", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.PathValue("n"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(n))
+		buf := make([]byte, chunk)
+		for n > 0 {
+			m := min(n, chunk)
+			if _, err := w.Write(buf[:m]); err != nil {
+				return
+			}
+			n -= m
+			if pause > 0 {
+				w.(http.Flusher).Flush()
+				select {
+				case <-time.After(pause):
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+	})
+	mux.HandleFunc("GET /status/{code}", func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(r.PathValue("code"))
+		w.WriteHeader(code)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// collect reads ch to the end and returns its snapshots.
+func collect(ch <-chan Stats) []Stats {
+	var all []Stats
+	for s := range ch {
+		all = append(all, s)
+	}
+	return all
+}
+
+// settleGoroutines waits for the goroutine count to fall back to at most
+// want, and returns the count it saw last.
+func settleGoroutines(want int) int {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= want || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDownloadLeavesNoGoroutines(t *testing.T) {
+	srv := payloadServer(t, 64<<10, 20*time.Millisecond)
+	tester := New(Options{ProgressInterval: 10 * time.Millisecond})
+
+	tests := []struct {
+		name   string
+		cancel time.Duration
+		read   int
+	}{
+		{name: "drained", read: -1},
+		{name: "cancelled", cancel: 50 * time.Millisecond, read: -1},
+		{name: "abandoned after one snapshot", cancel: 50 * time.Millisecond, read: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := runtime.NumGoroutine()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel > 0 {
+				time.AfterFunc(tt.cancel, cancel)
+			}
+			ch := tester.Download(ctx, srv.URL+"/bytes/1000000")
+			if tt.read < 0 {
+				collect(ch)
+			} else {
+				for range tt.read {
+					<-ch
+				}
+				<-ctx.Done()
+			}
+			srv.CloseClientConnections()
+			if n := settleGoroutines(base); n > base {
+				buf := make([]byte, 1<<16)
+				t.Fatalf("%d goroutines left running, %d before:\n%s", n, base, buf[:runtime.Stack(buf, true)])
+			}
+		})
+	}
+}
+
+func TestDownloadCancelsPromptly(t *testing.T) {
+	srv := payloadServer(t, 32<<10, 0)
+	tester := New(Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var cancelled time.Time
+	time.AfterFunc(100*time.Millisecond, func() {
+		cancelled = time.Now()
+		cancel()
+	})
+	last, err := tester.DownloadAndWait(ctx, srv.URL+"/bytes/1000000000000")
+	if wait := time.Since(cancelled); wait > 200*time.Millisecond {
+		t.Errorf("download ended %v after the cancel", wait)
+	}
+	if last.Kind != KindCancelled || !errors.Is(err, context.Canceled) {
+		t.Errorf("kind = %q, err = %v, want a cancelled result", last.Kind, err)
+	}
+	if last.SizeBytes == 0 {
+		t.Error("cancelled result lost the bytes read")
+	}
+}
+
+func BenchmarkDownload(b *testing.B) {
+	const size = 64 << 20
+	srv := payloadServer(b, 1<<20, 0)
+	for _, buf := range []int{4 << 10, 32 << 10, 256 << 10} {
+		b.Run(fmt.Sprintf("buffer=%dKiB", buf>>10), func(b *testing.B) {
+			tester := New(Options{BufferSize: buf, ProgressInterval: -1})
+			b.SetBytes(size)
+			for b.Loop() {
+				if _, err := tester.DownloadAndWait(context.Background(), srv.URL+"/bytes/"+strconv.Itoa(size)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentDownloadsRace(t *testing.T) {
+	srv := httptest.NewUnstartedServer(payloadServer(t, 16<<10, 0).Config.Handler)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	tester := New(Options{TLSConfig: &tls.Config{RootCAs: roots}, ProgressInterval: time.Millisecond})
+
+	var targets []Target
+	for i := range 32 {
+		targets = append(targets, Target{URL: fmt.Sprintf("%s/bytes/%d", srv.URL, 200000+i)})
+	}
+	finals := map[string]int{}
+	for s := range tester.Run(context.Background(), targets, 16) {
+		// Snapshots are values: changing one must not touch another.
+		s.SizeBytes, s.Labels = -1, nil
+		if s.Final() {
+			finals[s.URL]++
+			if s.Error != nil {
+				t.Errorf("%s: %v", s.URL, s.Error)
+			}
+		}
+	}
+	for _, target := range targets {
+		if n := finals[target.URL]; n != 1 {
+			t.Errorf("%s: %d final results, want 1", target.URL, n)
+		}
+	}
+}
+
+// zeros reads as an endless run of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// BenchmarkDownloadLoop compares the read loop with buffers from the
+// Tester's pool against a buffer allocated per transfer.
+func BenchmarkDownloadLoop(b *testing.B) {
+	const size = 1 << 20
+	tester := New(Options{})
+	for _, bb := range []struct {
+		name   string
+		buffer func() ([]byte, func())
+	}{
+		{"pooled", tester.buffer},
+		{"fresh", func() ([]byte, func()) { return make([]byte, 32<<10), func() {} }},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(size)
+			for b.Loop() {
+				var count atomic.Int64
+				buf, release := bb.buffer()
+				if err := drain(zeros{}, buf, size, &count); !errors.Is(err, errLimitReached) {
+					b.Fatal(err)
+				}
+				release()
+			}
+		})
+	}
+}
+
+func TestCancelledDownloadReportsPartial(t *testing.T) {
+	srv := payloadServer(t, 16<<10, 10*time.Millisecond)
+	// slow holds the response headers back until the request is gone.
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	tests := []struct {
+		name string
+		url  string
+		// idle is how long the stream goes unread before the cancel.
+		idle  time.Duration
+		bytes bool
+	}{
+		{"before the response", slow.URL, 0, false},
+		{"mid body", srv.URL + "/bytes/1000000000", 0, true},
+		{"mid body, unread", srv.URL + "/bytes/1000000000", 200 * time.Millisecond, true},
+	}
+	tester := New(Options{ProgressInterval: 20 * time.Millisecond})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := tester.Test(ctx, Target{URL: tt.url})
+			if tt.idle > 0 {
+				time.Sleep(tt.idle)
+				cancel()
+			} else {
+				time.AfterFunc(150*time.Millisecond, cancel)
+			}
+			all := collect(ch)
+			var finals int
+			for _, s := range all {
+				if s.Final() {
+					finals++
+				}
+			}
+			last := all[len(all)-1]
+			if finals != 1 || last.Kind != KindCancelled || !last.Cancelled || !errors.Is(last.Error, context.Canceled) {
+				t.Fatalf("%d finals, last %+v, want one cancelled result last", finals, last)
+			}
+			if got := last.SizeBytes > 0 && last.SpeedMbps > 0 && last.Elapsed > 0; got != tt.bytes {
+				t.Errorf("partial %d bytes at %v Mbps over %v", last.SizeBytes, last.SpeedMbps, last.Elapsed)
+			}
+		})
+	}
+}
+
+func TestDownloadTimeout(t *testing.T) {
+	srv := payloadServer(t, 1<<10, 20*time.Millisecond)
+	// silent accepts the request and never answers it.
+	silent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer silent.Close()
+	tests := []struct {
+		name  string
+		url   string
+		phase string
+		bytes bool
+	}{
+		{"trickling body", srv.URL + "/bytes/1000000000", PhaseBody, true},
+		{"no response", silent.URL, PhaseHeaders, false},
+	}
+	tester := New(Options{Timeout: 200 * time.Millisecond, ProgressInterval: -1})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := time.Now()
+			last, err := tester.DownloadAndWait(context.Background(), tt.url)
+			if took := time.Since(started); took > 2*time.Second {
+				t.Errorf("download ran %v past a 200ms timeout", took)
+			}
+			var timeout *PhaseTimeoutError
+			if !errors.As(err, &timeout) || !errors.Is(err, context.DeadlineExceeded) || timeout.Phase != tt.phase || timeout.Budget != 200*time.Millisecond {
+				t.Fatalf("err = %v, want a timeout in %s", err, tt.phase)
+			}
+			if last.Cancelled || last.Kind != KindError || last.ErrorKind != ErrorTimeout {
+				t.Errorf("result kind %s, error kind %s, cancelled %v", last.Kind, last.ErrorKind, last.Cancelled)
+			}
+			if (last.SizeBytes > 0) != tt.bytes {
+				t.Errorf("partial result of %d bytes", last.SizeBytes)
+			}
+		})
+	}
+}
+
+// countingTransport counts the requests it passes on to http.DefaultTransport.
+type countingTransport struct{ requests atomic.Int32 }
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestTesterPublicAPI(t *testing.T) {
+	srv := payloadServer(t, 16<<10, 20*time.Millisecond)
+	transport := &countingTransport{}
+	tester := New(Options{Client: &http.Client{Transport: transport}, ProgressInterval: 10 * time.Millisecond})
+	ctx := context.Background()
+
+	// Download reports progress, then one final snapshot, then closes.
+	all := collect(tester.Download(ctx, srv.URL+"/bytes/100000"))
+	last := all[len(all)-1]
+	if len(all) < 2 || !last.Done || last.Kind != KindFinal || last.Error != nil {
+		t.Fatalf("%d snapshots ending in %+v, want progress and a final", len(all), last)
+	}
+	for _, s := range all[:len(all)-1] {
+		if s.Done || s.Kind != KindProgress {
+			t.Errorf("snapshot before the final is %q, done %v", s.Kind, s.Done)
+		}
+	}
+	if last.URL != srv.URL+"/bytes/100000" || last.SizeBytes != 100000 || last.SpeedMbps <= 0 || last.Elapsed <= 0 {
+		t.Errorf("final %+v", last)
+	}
+
+	// DownloadWithProgress hands the final to the callback too.
+	var seen []Stats
+	got, err := tester.DownloadWithProgress(ctx, srv.URL+"/bytes/50000", func(s Stats) { seen = append(seen, s) })
+	if err != nil || !got.Done || len(seen) == 0 || !seen[len(seen)-1].Done {
+		t.Errorf("final %+v, err %v, %d snapshots seen", got, err, len(seen))
+	}
+
+	// A failed download returns its error as well as the final Stats.
+	got, err = tester.DownloadAndWait(ctx, srv.URL+"/status/404")
+	var status *StatusError
+	if !errors.As(err, &status) || status.Code != http.StatusNotFound || got.Error == nil || got.Kind != KindError {
+		t.Errorf("404: kind %q, err %v, want a StatusError", got.Kind, err)
+	}
+	if n := transport.requests.Load(); n != 3 {
+		t.Errorf("the given client made %d requests, want 3", n)
+	}
+}
+
+func TestProgressCallback(t *testing.T) {
+	srv := payloadServer(t, 10000, 10*time.Millisecond)
+	tester := New(Options{ProgressInterval: 5 * time.Millisecond})
+	ctx := context.Background()
+
+	// Snapshots arrive one at a time, in order, the final last.
+	var calls, running atomic.Int32
+	var seen []Stats
+	got, err := tester.DownloadWithProgress(ctx, srv.URL+"/bytes/300000", func(s Stats) {
+		if running.Add(1) > 1 {
+			t.Error("callback called concurrently")
+		}
+		calls.Add(1)
+		seen = append(seen, s)
+		running.Add(-1)
+	})
+	if err != nil || !got.Done || got.SizeBytes != 300000 {
+		t.Fatalf("final %+v, err %v", got, err)
+	}
+	if len(seen) < 3 || seen[len(seen)-1].Kind != KindFinal || seen[len(seen)-1].SizeBytes != got.SizeBytes {
+		t.Fatalf("%d snapshots, want progress then the final", len(seen))
+	}
+	for i, s := range seen[1:] {
+		if s.SizeBytes < seen[i].SizeBytes || s.Elapsed < seen[i].Elapsed {
+			t.Errorf("snapshot %d went back from %d bytes at %v to %d at %v", i+1, seen[i].SizeBytes, seen[i].Elapsed, s.SizeBytes, s.Elapsed)
+		}
+	}
+
+	// A callback that blocks skips progress rather than holding up the
+	// download, and still gets the final.
+	calls.Store(0)
+	var final Stats
+	start := time.Now()
+	got, err = tester.DownloadWithProgress(ctx, srv.URL+"/bytes/300000", func(s Stats) {
+		calls.Add(1)
+		if s.Kind == KindFinal {
+			final = s
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	})
+	if err != nil || !got.Done {
+		t.Fatalf("final %+v, err %v", got, err)
+	}
+	if final.Kind != KindFinal || final.SizeBytes != 300000 {
+		t.Errorf("blocking callback got final %+v", final)
+	}
+	// The body takes some 300ms to arrive.
+	if got.Elapsed > time.Second {
+		t.Errorf("download took %v behind a blocking callback", got.Elapsed)
+	}
+	if n := calls.Load(); n > 4 {
+		t.Errorf("blocking callback called %d times in %v, want snapshots skipped", n, time.Since(start))
+	}
+
+	// Cancelling ctx returns its error.
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := tester.DownloadWithProgress(cctx, srv.URL+"/bytes/100000000", func(Stats) {}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("cancelled download: %v", err)
+	}
+}
+
+func TestDownloadLimits(t *testing.T) {
+	// The server streams without end and reports when its writes stop.
+	stopped := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() { stopped <- struct{}{} }()
+		w.Header().Set("Content-Length", "1000000000000")
+		buf := make([]byte, 32<<10)
+		for {
+			if _, err := w.Write(buf); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	tester := New(Options{ProgressInterval: -1})
+
+	tests := []struct {
+		name   string
+		limits Limits
+	}{
+		{"max bytes", Limits{MaxBytes: 10e6}},
+		{"max duration", Limits{MaxDuration: 300 * time.Millisecond}},
+		{"bytes first", Limits{MaxBytes: 1e6, MaxDuration: time.Minute}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			all := collect(tester.Test(context.Background(), Target{URL: srv.URL, Limits: tt.limits}))
+			last := all[len(all)-1]
+			if last.Kind != KindFinal || last.Error != nil {
+				t.Fatalf("kind %q, err %v, want a normal completion", last.Kind, last.Error)
+			}
+			if limit := int64(tt.limits.MaxBytes); limit > 0 && last.SizeBytes != limit {
+				t.Errorf("read %d bytes, want %d", last.SizeBytes, limit)
+			}
+			if limit := tt.limits.MaxDuration; limit > 0 && limit < time.Minute && (last.Elapsed < limit || last.Elapsed > limit+200*time.Millisecond) {
+				t.Errorf("read for %v, want %v", last.Elapsed, limit)
+			}
+			// Closing the body ends the response on the server.
+			select {
+			case <-stopped:
+			case <-time.After(time.Second):
+				t.Error("the server is still streaming")
+			}
+		})
+	}
+}
+
+func TestStatusAndRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such file", http.StatusNotFound)
+	})
+	mux.HandleFunc("/busy", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("  <h1>Try again later</h1>\n" + strings.Repeat("<p>padding</p>\n", 1000)))
+	})
+	mux.Handle("/r1", http.RedirectHandler("/r2", http.StatusFound))
+	mux.Handle("/r2", http.RedirectHandler("/file", http.StatusMovedPermanently))
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 100))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	off := false
+
+	tests := []struct {
+		path   string
+		follow *bool
+		status int
+		err    string
+		hops   string
+	}{
+		{"/missing", nil, 404, "unexpected status 404 Not Found: no such file", ""},
+		// Only the start of an error page is quoted.
+		{"/busy", nil, 503, "unexpected status 503 Service Unavailable: <h1>Try again later</h1>", ""},
+		{"/r1", nil, 200, "", "/r1 302, /r2 301"},
+		{"/r1", &off, 302, "unexpected status 302 Found (Location: /r2): <a href=\"/r2\">Found</a>.", ""},
+	}
+	for _, tt := range tests {
+		all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL + tt.path, FollowRedirects: tt.follow}))
+		last := all[len(all)-1]
+		if last.StatusCode != tt.status || fmt.Sprint(last.Error) != cmp.Or(tt.err, "<nil>") {
+			t.Errorf("%s: status %d, err %v, want %d and %q", tt.path, last.StatusCode, last.Error, tt.status, tt.err)
+		}
+		var hops []string
+		for _, h := range last.Redirects {
+			hops = append(hops, fmt.Sprintf("%s %d", strings.TrimPrefix(h.URL, srv.URL), h.Status))
+		}
+		if got := strings.Join(hops, ", "); got != tt.hops {
+			t.Errorf("%s: redirects %q, want %q", tt.path, got, tt.hops)
+		}
+		if tt.err != "" && (last.SizeBytes != 0 || last.SpeedMbps != 0) {
+			t.Errorf("%s: error page measured as %d bytes at %v Mbps", tt.path, last.SizeBytes, last.SpeedMbps)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	body := bytes.Repeat([]byte("yaperf "), 20000)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(body)
+	zw.Close()
+	var accepted atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted.Store(r.Header.Get("Accept-Encoding"))
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gz.Bytes())
+			return
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+	wire := int64(gz.Len())
+	tests := []struct {
+		mode       string
+		accept     string
+		encoding   string
+		wire, body int64
+	}{
+		{"", "identity", "identity", int64(len(body)), int64(len(body))},
+		{CompressionIdentity, "identity", "identity", int64(len(body)), int64(len(body))},
+		// The speed is of the compressed bytes that crossed the wire.
+		{CompressionAccept, "gzip", "gzip", wire, int64(len(body))},
+	}
+	for _, tt := range tests {
+		all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: srv.URL, Compression: tt.mode}))
+		last := all[len(all)-1]
+		if last.Error != nil {
+			t.Fatalf("compression %q: %v", tt.mode, last.Error)
+		}
+		if got := accepted.Load(); got != tt.accept || last.ContentEncoding != tt.encoding {
+			t.Errorf("compression %q: sent Accept-Encoding %q and got %q, want %q and %q", tt.mode, got, last.ContentEncoding, tt.accept, tt.encoding)
+		}
+		if last.WireBytes != tt.wire || last.BodyBytes != tt.body || last.SizeBytes != tt.wire {
+			t.Errorf("compression %q: %d bytes, %d on the wire and %d decoded, want %d and %d", tt.mode, last.SizeBytes, last.WireBytes, last.BodyBytes, tt.wire, tt.body)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	srv := flakyServer(t, 1)
+	mux := http.NewServeMux()
+	mux.Handle("/", srv.Config.Handler)
+	mux.Handle("/r", http.RedirectHandler("/a", http.StatusFound))
+	srv.Config.Handler = mux
+	for _, tt := range []struct {
+		level slog.Level
+		want  []string
+	}{
+		{slog.LevelDebug, []string{
+			`level=DEBUG msg="got connection" url=` + srv.URL + `/r remote=` + srv.Listener.Addr().String() + ` reused=false`,
+			`level=DEBUG msg=retrying url=` + srv.URL + `/r attempt=1 of=2`,
+			`level=DEBUG msg="following redirect" from=` + srv.URL + `/r to=` + srv.URL + `/a`,
+			`reused=true`,
+		}},
+		{slog.LevelWarn, nil},
+	} {
+		var logs bytes.Buffer
+		tester := New(Options{
+			Retries: 1, RetryBackoff: time.Millisecond, ProgressInterval: -1,
+			Logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: tt.level})),
+		})
+		all := collect(tester.Test(context.Background(), Target{URL: srv.URL + "/r"}))
+		if err := all[len(all)-1].Error; err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(logs.String(), want) {
+				t.Errorf("%v: no %q in\n%s", tt.level, want, logs.String())
+			}
+		}
+		if tt.want == nil && logs.Len() != 0 {
+			t.Errorf("%v: logged\n%s", tt.level, logs.String())
+		}
+	}
+}
+
+func TestStreamCap(t *testing.T) {
+	defer func(cap time.Duration) { streamCap = cap }(streamCap)
+	streamCap = 300 * time.Millisecond
+	// /endless streams chunks without a length and without end, /chunked
+	// ends after a few of them.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 32<<10)
+		for i := 0; r.URL.Path == "/endless" || i < 3; i++ {
+			if _, err := w.Write(buf); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+	tests := []struct {
+		name      string
+		path      string
+		limits    Limits
+		capped    bool
+		truncated bool
+	}{
+		{"endless", "/endless", Limits{}, true, true},
+		{"ends on its own", "/chunked", Limits{}, true, false},
+		// A limit of the target's own replaces the cap.
+		{"max bytes", "/endless", Limits{MaxBytes: 1e6}, false, false},
+		{"max duration", "/endless", Limits{MaxDuration: 100 * time.Millisecond}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			tester := New(Options{ProgressInterval: -1, Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+			all := collect(tester.Test(context.Background(), Target{URL: srv.URL + tt.path, Limits: tt.limits}))
+			last := all[len(all)-1]
+			if last.Kind != KindFinal || last.Error != nil || last.Truncated != tt.truncated {
+				t.Fatalf("kind %q, err %v, truncated %v, want a completion truncated %v", last.Kind, last.Error, last.Truncated, tt.truncated)
+			}
+			capped := strings.Contains(logs.String(), `msg="response has no length, stopping it after the stream cap"`)
+			if capped != tt.capped {
+				t.Errorf("logged the cap %v, want %v:\n%s", capped, tt.capped, logs.String())
+			}
+			if tt.truncated && (last.Elapsed < streamCap || last.Elapsed > streamCap+200*time.Millisecond) {
+				t.Errorf("read for %v, want the %v cap", last.Elapsed, streamCap)
+			}
+		})
+	}
+}
+
+func TestCookiesAndRedirectChain(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1"})
+		http.Redirect(w, r, "/hop", http.StatusFound)
+	})
+	mux.Handle("/hop", http.RedirectHandler("/file", http.StatusFound))
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err != nil || c.Value != "s1" {
+			http.Error(w, "no session", http.StatusForbidden)
+			return
+		}
+		w.Write(make([]byte, 1000))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		target Target
+		err    string
+	}{
+		{"cookies", Target{Cookies: true}, ""},
+		{"no cookies", Target{}, "unexpected status 403 Forbidden: no session"},
+		{"too many redirects", Target{Cookies: true, MaxRedirects: 1}, "stopped after 1 redirects"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.target.URL = srv.URL + "/login"
+			all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), tt.target))
+			last := all[len(all)-1]
+			if tt.err != "" {
+				if last.Error == nil || !strings.Contains(last.Error.Error(), tt.err) {
+					t.Errorf("err %v, want %q", last.Error, tt.err)
+				}
+				return
+			}
+			if last.Error != nil || last.SizeBytes != 1000 {
+				t.Fatalf("read %d bytes, err %v", last.SizeBytes, last.Error)
+			}
+			var hops []string
+			for _, h := range last.Redirects {
+				hops = append(hops, fmt.Sprintf("%s %d", strings.TrimPrefix(h.URL, srv.URL), h.Status))
+				if h.Latency <= 0 {
+					t.Errorf("hop %s took %v", h.URL, h.Latency)
+				}
+			}
+			if want := "/login 302, /hop 302"; strings.Join(hops, ", ") != want {
+				t.Errorf("chain %q, want %q", strings.Join(hops, ", "), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package perf
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// phaseTimer records connection setup timings from httptrace callbacks,
+// which may fire on transport goroutines.
+type phaseTimer struct {
+	mu           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	dns          time.Duration
+	connect      time.Duration
+	tls          time.Duration
+	ttfb         time.Duration
+	reused       bool
+	remote       net.Addr
+	local        net.Addr
+	conn         net.Conn
+	tcp          *TCPInfo
+	dnsFailed    bool
+	tlsFailed    bool
+	resolved     net.IP
+	hops         []Hop
+	hopStart     time.Time
+	log          *slog.Logger
+}
+
+// Hop is one redirect a request went through.
+type Hop struct {
+	URL    string
+	Status int
+	// Latency is the time from sending the request for URL to receiving
+	// its redirect.
+	Latency time.Duration
+}
+
+func (t *Tester) phaseTimer(url string) *phaseTimer {
+	now := time.Now()
+	return &phaseTimer{start: now, hopStart: now, log: t.log().With("url", url)}
+}
+
+type timerKey struct{}
+
+// context returns ctx traced by p, which also lets the client's redirect
+// policy record hops on p.
+func (p *phaseTimer) context(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(context.WithValue(ctx, timerKey{}, p), p.trace())
+}
+
+// redirected records that the request for from was answered with a
+// redirect carrying status.
+func (p *phaseTimer) redirected(from string, status int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.hops = append(p.hops, Hop{URL: from, Status: status, Latency: now.Sub(p.hopStart)})
+	p.hopStart = now
+}
+
+func (p *phaseTimer) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			p.mu.Lock()
+			p.dnsStart = time.Now()
+			p.mu.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			p.mu.Lock()
+			p.dns = time.Since(p.dnsStart)
+			p.dnsFailed = info.Err != nil
+			if len(info.Addrs) > 0 {
+				p.resolved = info.Addrs[0].IP
+			}
+			p.mu.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			p.mu.Lock()
+			if p.connectStart.IsZero() {
+				p.connectStart = time.Now()
+			}
+			p.mu.Unlock()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			p.mu.Lock()
+			if err == nil && p.connect == 0 {
+				p.connect = time.Since(p.connectStart)
+			}
+			p.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			p.mu.Lock()
+			p.tlsStart = time.Now()
+			p.mu.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			p.mu.Lock()
+			p.tls = time.Since(p.tlsStart)
+			p.tlsFailed = err != nil
+			p.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			p.mu.Lock()
+			p.reused = info.Reused
+			p.remote = info.Conn.RemoteAddr()
+			p.local = info.Conn.LocalAddr()
+			p.conn = info.Conn
+			p.mu.Unlock()
+			p.log.Debug("got connection", "remote", info.Conn.RemoteAddr(), "reused", info.Reused, "idle", info.IdleTime)
+		},
+		GotFirstResponseByte: func() {
+			p.mu.Lock()
+			p.ttfb = time.Since(p.start)
+			p.mu.Unlock()
+		},
+	}
+}
+
+// Phases of a request, as PhaseTimeoutError names them.
+const (
+	PhaseDNS     = "dns"
+	PhaseConnect = "connect"
+	PhaseTLS     = "tls"
+	PhaseHeaders = "headers"
+	PhaseBody    = "body"
+)
+
+var phaseNames = map[string]string{
+	PhaseDNS:     "DNS lookup",
+	PhaseConnect: "TCP connect",
+	PhaseTLS:     "TLS handshake",
+	PhaseHeaders: "response headers",
+	PhaseBody:    "body",
+}
+
+// PhaseTimeoutError reports a request that ran out of time, naming the
+// phase it was in and the time that phase was allowed.
+type PhaseTimeoutError struct {
+	Phase  string
+	Budget time.Duration
+	Err    error
+}
+
+func (e *PhaseTimeoutError) Error() string {
+	return fmt.Sprintf("%s exceeded %v", phaseNames[e.Phase], e.Budget)
+}
+
+func (e *PhaseTimeoutError) Unwrap() error { return e.Err }
+
+// phase is the phase the request is in, or was in when it failed.
+func (p *phaseTimer) phase() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.ttfb > 0:
+		return PhaseBody
+	case p.tlsFailed, !p.tlsStart.IsZero() && p.tls == 0:
+		return PhaseTLS
+	case p.conn != nil, p.tls > 0, p.connect > 0:
+		return PhaseHeaders
+	case p.dnsFailed, !p.dnsStart.IsZero() && p.dns == 0:
+		return PhaseDNS
+	}
+	return PhaseConnect
+}
+
+// timedOut wraps err, which ended a request before its body, in a
+// PhaseTimeoutError when it is the timeout opts sets for the phase the
+// request was in, and returns it as is otherwise.
+func (p *phaseTimer) timedOut(err error, opts *Options) error {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return err
+	}
+	phase := p.phase()
+	budget := map[string]time.Duration{
+		PhaseDNS:     opts.ConnectTimeout,
+		PhaseConnect: opts.ConnectTimeout,
+		PhaseTLS:     opts.TLSTimeout,
+		PhaseHeaders: opts.HeaderTimeout,
+	}[phase]
+	if budget == 0 {
+		return err
+	}
+	return &PhaseTimeoutError{Phase: phase, Budget: budget, Err: err}
+}
+
+// tcpInfo reads TCP_INFO from the connection the request went out on, or
+// returns what keepTCP saved once that connection is closed. It is nil off
+// Linux, over HTTP/3, and before a connection was made.
+func (p *phaseTimer) tcpInfo() *TCPInfo {
+	p.mu.Lock()
+	conn, kept := p.conn, p.tcp
+	p.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	if info := readTCPInfo(conn); info != nil {
+		return info
+	}
+	return kept
+}
+
+// keepTCP saves the connection's TCP_INFO for a connection that may be
+// closed before the final snapshot is taken.
+func (p *phaseTimer) keepTCP() {
+	info := p.tcpInfo()
+	p.mu.Lock()
+	p.tcp = info
+	p.mu.Unlock()
+}
+
+func (p *phaseTimer) apply(s *Stats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.Started = p.start
+	s.DNSLookup = p.dns
+	s.TCPConnect = p.connect
+	s.TLSHandshake = p.tls
+	s.TTFB = p.ttfb
+	s.Reused = p.reused
+	s.Redirects = append([]Hop(nil), p.hops...)
+	if p.resolved != nil {
+		s.ResolvedIP = p.resolved.String()
+	}
+	if p.local != nil {
+		s.LocalAddr = p.local.String()
+	}
+	if tcp, ok := p.remote.(*net.TCPAddr); ok {
+		s.RemoteAddr = tcp.String()
+		s.IPVersion = 6
+		if tcp.IP.To4() != nil {
+			s.IPVersion = 4
+		}
+	}
+}
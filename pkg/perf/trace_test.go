@@ -0,0 +1,241 @@
+package perf
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPhaseTimings(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 10000))
+	}))
+	defer srv.Close()
+	// localhost makes the first download look its host up.
+	url := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	tester := New(Options{TLSConfig: &tls.Config{InsecureSkipVerify: true}, ProgressInterval: -1})
+
+	first, err := tester.DownloadAndWait(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Reused || first.DNSLookup <= 0 || first.TCPConnect <= 0 || first.TLSHandshake <= 0 {
+		t.Errorf("new connection: reused %v, dns %v, connect %v, tls %v", first.Reused, first.DNSLookup, first.TCPConnect, first.TLSHandshake)
+	}
+	checkTTFB(t, first)
+
+	// The next download of the same target runs on the idle connection.
+	second, err := tester.DownloadAndWait(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Reused || second.DNSLookup != 0 || second.TCPConnect != 0 || second.TLSHandshake != 0 {
+		t.Errorf("reused connection: reused %v, dns %v, connect %v, tls %v", second.Reused, second.DNSLookup, second.TCPConnect, second.TLSHandshake)
+	}
+	checkTTFB(t, second)
+}
+
+// checkTTFB fails unless the first byte of s arrived after its start and
+// before its body was read.
+func checkTTFB(t *testing.T, s Stats) {
+	t.Helper()
+	// Elapsed counts from the headers, so the two make up the transfer.
+	if total := time.Since(s.Started); s.Started.IsZero() || s.TTFB <= 0 || s.TTFB+s.Elapsed > total {
+		t.Errorf("ttfb %v and elapsed %v, %v since the start", s.TTFB, s.Elapsed, total)
+	}
+}
+
+func TestConnectionDetails(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	})
+	tls12 := httptest.NewUnstartedServer(handler)
+	tls12.TLS = &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}}
+	tls12.StartTLS()
+	defer tls12.Close()
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+
+	tests := []struct {
+		name                  string
+		srv                   *httptest.Server
+		version, cipher, alpn string
+	}{
+		{"tls 1.2", tls12, "TLS 1.2", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "http/1.1"},
+		{"tls 1.3 with h2", h2, "TLS 1.3", "", "h2"},
+		{"plain http", plain, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tester := New(Options{TLSConfig: &tls.Config{InsecureSkipVerify: true}, ProgressInterval: -1})
+			s, err := tester.DownloadAndWait(context.Background(), tt.srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.RemoteAddr != tt.srv.Listener.Addr().String() {
+				t.Errorf("remote %q, want %q", s.RemoteAddr, tt.srv.Listener.Addr())
+			}
+			if s.TLSVersion != tt.version || s.ALPN != tt.alpn {
+				t.Errorf("version %q, alpn %q, want %q and %q", s.TLSVersion, s.ALPN, tt.version, tt.alpn)
+			}
+			// TLS 1.3 picks its cipher by the hardware.
+			switch {
+			case tt.cipher != "" && s.Cipher != tt.cipher:
+				t.Errorf("cipher %q, want %q", s.Cipher, tt.cipher)
+			case tt.version == "TLS 1.3" && !strings.HasPrefix(s.Cipher, "TLS_"):
+				t.Errorf("cipher %q", s.Cipher)
+			case tt.version == "" && s.Cipher != "":
+				t.Errorf("cipher %q over plain http", s.Cipher)
+			}
+		})
+	}
+}
+
+// stalledListener accepts connections and never writes to them.
+func stalledListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	return l
+}
+
+func TestPhaseTimeouts(t *testing.T) {
+	// A name server that never answers holds the lookup.
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	resolver, err := NewResolver(silent.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stalled := stalledListener(t).Addr().String()
+	// A server that never answers holds the response headers.
+	headers := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer func() {
+		headers.CloseClientConnections()
+		headers.Close()
+	}()
+	body, _ := slowServer(t)
+
+	tests := []struct {
+		name  string
+		opts  Options
+		url   string
+		phase string
+		err   string
+	}{
+		{"dns", Options{Resolver: resolver, ConnectTimeout: 200 * time.Millisecond}, "http://mirror.example/", PhaseDNS, "DNS lookup exceeded 200ms"},
+		{"tls", Options{TLSTimeout: 200 * time.Millisecond}, "https://" + stalled + "/", PhaseTLS, "TLS handshake exceeded 200ms"},
+		{"headers", Options{HeaderTimeout: 200 * time.Millisecond}, headers.URL, PhaseHeaders, "response headers exceeded 200ms"},
+		// The test's own timeout names the phase it stopped too.
+		{"body", Options{Timeout: 300 * time.Millisecond}, body.URL, PhaseBody, "body exceeded 300ms"},
+		{"timeout before headers", Options{Timeout: 300 * time.Millisecond}, headers.URL, PhaseHeaders, "response headers exceeded 300ms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.ProgressInterval = -1
+			start := time.Now()
+			all := collect(New(tt.opts).Test(context.Background(), Target{URL: tt.url}))
+			last := all[len(all)-1]
+			if took := time.Since(start); took > 3*time.Second {
+				t.Errorf("took %v", took)
+			}
+			if last.TimeoutPhase != tt.phase || last.ErrorKind != ErrorTimeout || fmt.Sprint(last.Error) != tt.err {
+				t.Errorf("%s phase %q (%v), want %s %q", last.ErrorKind, last.TimeoutPhase, last.Error, tt.phase, tt.err)
+			}
+		})
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// A dial to an address that drops packets runs into connect_timeout,
+	// where the network lets it.
+	all := collect(New(Options{ProgressInterval: -1, ConnectTimeout: 200 * time.Millisecond}).Test(context.Background(), Target{URL: "http://10.255.255.1/"}))
+	last := all[len(all)-1]
+	if last.ErrorKind != ErrorTimeout {
+		t.Skipf("blackholed address answered: %v", last.Error)
+	}
+	if last.TimeoutPhase != PhaseConnect || last.Error.Error() != "TCP connect exceeded 200ms" {
+		t.Errorf("blackholed dial: phase %q (%v)", last.TimeoutPhase, last.Error)
+	}
+}
+
+func TestTimedOut(t *testing.T) {
+	opts := Options{ConnectTimeout: time.Second}
+	var timeout net.Error = &net.DNSError{Err: "timeout", IsTimeout: true}
+	refused := errors.New("connection refused")
+	tests := []struct {
+		name string
+		p    *phaseTimer
+		err  error
+		want string
+	}{
+		{"dial", &phaseTimer{}, timeout, "TCP connect exceeded 1s"},
+		{"lookup", &phaseTimer{dnsStart: time.Now()}, timeout, "DNS lookup exceeded 1s"},
+		{"failed lookup", &phaseTimer{dnsStart: time.Now(), dns: time.Millisecond, dnsFailed: true}, timeout, "DNS lookup exceeded 1s"},
+		{"not a timeout", &phaseTimer{}, refused, "connection refused"},
+		// A phase without a budget of its own keeps the error as it came.
+		{"no budget", &phaseTimer{connect: time.Millisecond}, timeout, timeout.Error()},
+	}
+	for _, tt := range tests {
+		if got := tt.p.timedOut(tt.err, &opts).Error(); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		p    *phaseTimer
+		want string
+	}{
+		{&phaseTimer{}, PhaseConnect},
+		{&phaseTimer{dnsStart: time.Now()}, PhaseDNS},
+		{&phaseTimer{dnsStart: time.Now(), dns: time.Millisecond}, PhaseConnect},
+		{&phaseTimer{connect: time.Millisecond}, PhaseHeaders},
+		{&phaseTimer{connect: time.Millisecond, tlsStart: time.Now()}, PhaseTLS},
+		{&phaseTimer{tlsStart: time.Now(), tls: time.Millisecond, tlsFailed: true}, PhaseTLS},
+		{&phaseTimer{tlsStart: time.Now(), tls: time.Millisecond}, PhaseHeaders},
+		{&phaseTimer{tls: time.Millisecond, ttfb: time.Millisecond}, PhaseBody},
+	} {
+		if got := tt.p.phase(); got != tt.want {
+			t.Errorf("phase of %+v = %s, want %s", tt.p, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package perf
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// client returns a new HTTP client for target and a func that releases
+// its connections, or the injected Client.
+func (t *Tester) client(target Target) (*http.Client, func()) {
+	if t.opts.Client != nil {
+		return t.opts.Client, func() {}
+	}
+	// Accept-Encoding is set per request by Target.prepare, so the transport
+	// never decompresses on its own and the counted bytes are wire bytes.
+	// Every transport gets a config of its own: net/http writes to it.
+	tlsConfig := cmp.Or(t.opts.TLSConfig, &tls.Config{}).Clone()
+	if name := target.serverName(); name != "" {
+		tlsConfig.ServerName = name
+	}
+	idle := cmp.Or(t.opts.IdleConnTimeout, 90*time.Second)
+	if t.opts.CacheMode == CacheWarm && t.opts.IdleConnTimeout == 0 {
+		idle = 0
+	}
+	tr := &http.Transport{
+		DisableCompression:    true,
+		TLSClientConfig:       tlsConfig,
+		DialContext:           dialContext(target, t.opts.Resolver, t.opts.ConnectTimeout),
+		Proxy:                 http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost:   t.opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:       idle,
+		TLSHandshakeTimeout:   t.opts.TLSTimeout,
+		ResponseHeaderTimeout: t.opts.HeaderTimeout,
+	}
+	if u := t.opts.Proxy; u != nil {
+		if isSOCKS(u) {
+			tr.Proxy = nil
+			tr.DialContext = socksDialer(u, tr.DialContext)
+		} else {
+			tr.Proxy = http.ProxyURL(u)
+		}
+	}
+	client := &http.Client{Transport: tr}
+	if target.Cookies {
+		client.Jar, _ = cookiejar.New(nil)
+	}
+	release := tr.CloseIdleConnections
+	protocols := new(http.Protocols)
+	switch target.Protocol {
+	case ProtocolH1:
+		protocols.SetHTTP1(true)
+	case ProtocolH2:
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	case ProtocolH3:
+		h3, closeH3 := newHTTP3Transport(tlsConfig)
+		client.Transport = h3
+		if t.opts.Fallback {
+			client.Transport = &fallbackTransport{primary: h3, secondary: tr}
+		}
+		release = func() {
+			closeH3()
+			tr.CloseIdleConnections()
+		}
+		fallthrough
+	default:
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	}
+	tr.Protocols = protocols
+	follow := target.FollowRedirects == nil || *target.FollowRedirects
+	limit := target.MaxRedirects
+	if limit == 0 {
+		limit = 10
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		from := via[len(via)-1].URL
+		if !follow {
+			t.log().Debug("not following redirect", "from", from, "to", req.URL)
+			return http.ErrUseLastResponse
+		}
+		if timer, ok := req.Context().Value(timerKey{}).(*phaseTimer); ok && req.Response != nil {
+			timer.redirected(from.String(), req.Response.StatusCode)
+		}
+		if len(via) > limit {
+			return fmt.Errorf("stopped after %d redirects", limit)
+		}
+		t.log().Debug("following redirect", "from", from, "to", req.URL)
+		return nil
+	}
+	return client, release
+}
+
+// Protocols accepted by the protocol option.
+const (
+	ProtocolAuto = "auto"
+	ProtocolH1   = "h1"
+	ProtocolH2   = "h2"
+	ProtocolH3   = "h3"
+)
+
+func checkProtocol(protocol string) error {
+	switch protocol {
+	case "", ProtocolAuto, ProtocolH1, ProtocolH2:
+		return nil
+	case ProtocolH3:
+		if !http3Supported {
+			return errors.New("protocol h3 needs a build with -tags http3")
+		}
+		return nil
+	}
+	return fmt.Errorf("protocol must be h1, h2, h3 or auto, got %q", protocol)
+}
+
+// fallbackTransport retries a request over secondary when primary fails,
+// as long as the request has no body that primary may have consumed.
+type fallbackTransport struct {
+	primary, secondary http.RoundTripper
+}
+
+func (f *fallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := f.primary.RoundTrip(req)
+	if err == nil || req.Context().Err() != nil || req.Body != nil && req.Body != http.NoBody {
+		return resp, err
+	}
+	return f.secondary.RoundTrip(req)
+}
+
+// proxyFor reports the host of the proxy a request to rawURL goes through,
+// or "" when it is sent directly. It cannot see inside an injected Client.
+func (t *Tester) proxyFor(rawURL string) string {
+	if t.opts.Client != nil {
+		return ""
+	}
+	if t.opts.Proxy != nil {
+		return t.opts.Proxy.Host
+	}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return ""
+	}
+	if u, err := http.ProxyFromEnvironment(req); err == nil && u != nil {
+		return u.Host
+	}
+	return ""
+}
+
+// ParseProxy parses a proxy URL. The http, https, socks5 and socks5h
+// schemes are supported; credentials may be given as user info.
+func ParseProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("proxy: unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy: missing host in %q", raw)
+	}
+	return u, nil
+}
+
+func isSOCKS(u *url.URL) bool {
+	return u.Scheme == "socks5" || u.Scheme == "socks5h"
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (d dialFunc) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d dialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+// socksDialer dials through the SOCKS5 proxy at u, reaching the proxy with
+// forward so source binding and address family still apply.
+func socksDialer(u *url.URL, forward dialFunc) dialFunc {
+	d, err := proxy.FromURL(u, forward)
+	if err != nil {
+		return func(context.Context, string, string) (net.Conn, error) {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+	}
+	return d.(proxy.ContextDialer).DialContext
+}
+
+// network maps an ip_version setting to the network passed to the dialer.
+func network(ipVersion string) (string, error) {
+	switch ipVersion {
+	case "", "auto":
+		return "tcp", nil
+	case "4":
+		return "tcp4", nil
+	case "6":
+		return "tcp6", nil
+	default:
+		return "", fmt.Errorf("ip_version must be 4, 6 or auto, got %q", ipVersion)
+	}
+}
+
+// dialContext returns the dial function for target, forcing its address
+// family, binding to its source_ip or interface and dialing its pinned
+// addresses when set, or its connect_to in place of its host. Other hosts
+// are looked up with resolver. A non-zero timeout bounds the lookup and
+// dial together.
+func dialContext(target Target, resolver *net.Resolver, timeout time.Duration) dialFunc {
+	dialer := &net.Dialer{Resolver: resolver, Timeout: timeout}
+	if target.SourceIP != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(target.SourceIP)}
+	}
+	if target.Interface != "" {
+		dialer.Control = bindToDevice(target.Interface)
+	}
+	dial := dialFunc(dialer.DialContext)
+	if forced, err := network(target.IPVersion); err == nil && forced != "tcp" {
+		dial = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, forced, addr)
+			var addrErr *net.AddrError
+			if errors.As(err, &addrErr) && addrErr.Err == "no suitable address found" {
+				host, _, _ := net.SplitHostPort(addr)
+				return nil, fmt.Errorf("%s has no IPv%s address", host, target.IPVersion)
+			}
+			return conn, err
+		}
+	}
+	if len(target.Resolve) > 0 {
+		dial = pinned(target.Resolve, dial)
+	}
+	if target.ConnectTo != "" {
+		dial = connectTo(urlAddr(target.URL), target.ConnectTo, dial)
+	}
+	return counted(timedWrites(dial))
+}
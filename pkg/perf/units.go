@@ -0,0 +1,198 @@
+package perf
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ByteSize is a number of bytes. In YAML it may be written as a plain
+// integer or with a unit suffix such as "100MB" or "1GiB". A bare prefix
+// such as "100M" is rejected, as it could be either.
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"kB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// ParseByteSize parses sizes such as "512", "100MB" or "1.5GiB".
+func ParseByteSize(s string) (ByteSize, error) {
+	text := strings.TrimSpace(s)
+	scale := 1.0
+	for _, u := range byteUnits {
+		if strings.HasSuffix(text, u.suffix) {
+			text, scale = strings.TrimSpace(strings.TrimSuffix(text, u.suffix)), u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(text, 64)
+	switch {
+	case err != nil && ambiguous(text):
+		prefix := strings.ToUpper(text)
+		return 0, fmt.Errorf("ambiguous size %q, write %sB for decimal or %siB for binary units", s, prefix, prefix)
+	case err != nil || n < 0 || !finite(n):
+		return 0, fmt.Errorf("invalid size %q, want bytes or a size such as 100MB or 1.5GiB", s)
+	}
+	return ByteSize(n * scale), nil
+}
+
+// ambiguous reports whether text is a number ending in a bare SI prefix,
+// such as 100M, which could be bits or bytes, decimal or binary.
+func ambiguous(text string) bool {
+	if text == "" || !strings.ContainsAny(text[len(text)-1:], "kKmMgGtT") {
+		return false
+	}
+	_, err := strconv.ParseFloat(strings.TrimSpace(text[:len(text)-1]), 64)
+	return err == nil
+}
+
+// finite reports whether n is neither NaN nor infinite, which ParseFloat
+// accepts as "NaN" and "Inf".
+func finite(n float64) bool {
+	return !math.IsNaN(n) && !math.IsInf(n, 0)
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (b *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	size, err := ParseByteSize(node.Value)
+	if err != nil {
+		return decodeError(node, err)
+	}
+	*b = size
+	return nil
+}
+
+func (b ByteSize) String() string {
+	return fmt.Sprintf("%.2f MB", float64(b)/1e6)
+}
+
+// Rate is a bandwidth in bits per second. In YAML it is written with a unit
+// such as "500Kbps", "50Mbps", "1.5Gbit" or, in bytes, "80MB/s". A bare
+// prefix such as "50M" is rejected, as it could be either.
+type Rate float64
+
+// rateUnits are matched in any case, byteRateUnits only as written, so
+// "MB/s" is never read as megabits.
+var rateUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"gbps", 1e9}, {"mbps", 1e6}, {"kbps", 1e3}, {"bps", 1},
+	{"gbit/s", 1e9}, {"mbit/s", 1e6}, {"kbit/s", 1e3}, {"bit/s", 1},
+	{"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1},
+}
+
+var byteRateUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"GB/s", 8e9}, {"MB/s", 8e6}, {"KB/s", 8e3}, {"kB/s", 8e3}, {"B/s", 8},
+}
+
+// ParseRate parses rates such as "50Mbps" or "12.5MB/s"; a plain number is
+// bits per second. Rate limits, speed floors and speed thresholds all go
+// through it.
+func ParseRate(s string) (Rate, error) {
+	text := strings.TrimSpace(s)
+	scale := 0.0
+	for _, u := range byteRateUnits {
+		if strings.HasSuffix(text, u.suffix) {
+			text, scale = strings.TrimSpace(strings.TrimSuffix(text, u.suffix)), u.scale
+			break
+		}
+	}
+	for _, u := range rateUnits {
+		if scale == 0 && strings.HasSuffix(strings.ToLower(text), u.suffix) {
+			text, scale = strings.TrimSpace(text[:len(text)-len(u.suffix)]), u.scale
+		}
+	}
+	if scale == 0 {
+		scale = 1
+	}
+	n, err := strconv.ParseFloat(text, 64)
+	switch {
+	case err != nil && ambiguous(text):
+		return 0, fmt.Errorf("ambiguous rate %q, write %sbps for bits or %sB/s for bytes per second", s, text, strings.ToUpper(text))
+	case err != nil || n < 0 || !finite(n):
+		return 0, fmt.Errorf("invalid rate %q, want bits per second or a rate such as 50Mbps, 1.5Gbit or 12.5MB/s", s)
+	}
+	return Rate(n * scale), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (r *Rate) UnmarshalYAML(node *yaml.Node) error {
+	rate, err := ParseRate(node.Value)
+	if err != nil {
+		return decodeError(node, err)
+	}
+	*r = rate
+	return nil
+}
+
+func (r Rate) String() string {
+	return fmt.Sprintf("%.2f Mbps", float64(r)/1e6)
+}
+
+// Percent is a share in percent. In YAML it is written as "0.5%" or as a
+// plain number of percent.
+type Percent float64
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (p *Percent) UnmarshalYAML(node *yaml.Node) error {
+	text := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(node.Value), "%"))
+	n, err := strconv.ParseFloat(text, 64)
+	if err != nil || !(n >= 0 && n <= 100) {
+		return decodeError(node, fmt.Errorf("invalid percentage %q", node.Value))
+	}
+	*p = Percent(n)
+	return nil
+}
+
+func (p Percent) String() string {
+	return strconv.FormatFloat(float64(p), 'g', -1, 64) + "%"
+}
+
+// Units picks the units of human-readable output. Results written as JSON
+// or CSV keep Mbps and bytes whatever it says.
+type Units struct {
+	// Speed is mbps, MBps, gbps, or auto for the bit unit that keeps a
+	// speed between 1 and 999. Unset, results show MB/s and Mbps both.
+	Speed string `yaml:"speed"`
+	// Size is decimal (MB, the default) or binary (MiB).
+	Size string `yaml:"size"`
+}
+
+// Speed units accepted by Units.Speed.
+const (
+	SpeedMbps = "mbps"
+	SpeedMBps = "MBps"
+	SpeedGbps = "gbps"
+	SpeedAuto = "auto"
+)
+
+// Size units accepted by Units.Size.
+const (
+	SizeDecimal = "decimal"
+	SizeBinary  = "binary"
+)
+
+func (u Units) problems(ps *Problems) {
+	switch u.Speed {
+	case "", SpeedMbps, SpeedMBps, SpeedGbps, SpeedAuto:
+	default:
+		ps.Addf("units.speed", "must be mbps, MBps, gbps or auto, got %q", u.Speed)
+	}
+	switch u.Size {
+	case "", SizeDecimal, SizeBinary:
+	default:
+		ps.Addf("units.size", "must be decimal or binary, got %q", u.Size)
+	}
+}
@@ -0,0 +1,194 @@
+package perf
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ByteSize
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"512B", 512},
+		{"100kB", 100e3},
+		{"100KB", 100e3},
+		{"100MB", 100e6},
+		{"1.5GB", 1.5e9},
+		{"2TB", 2e12},
+		{"1KiB", 1 << 10},
+		{"100MiB", 100 << 20},
+		{"1.5GiB", 3 << 29},
+		{"1TiB", 1 << 40},
+		{" 10 MB ", 10e6},
+		{"100.00 MB", 100e6},
+	}
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseByteSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseByteSizeErrors(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"100M", `ambiguous size "100M", write 100MB for decimal or 100MiB for binary units`},
+		{"1.5g", `ambiguous size "1.5g", write 1.5GB for decimal or 1.5GiB for binary units`},
+		{"", `invalid size ""`},
+		{"MB", `invalid size "MB"`},
+		{"ten MB", `invalid size "ten MB"`},
+		{"-1MB", `invalid size "-1MB"`},
+		{"NaN", `invalid size "NaN"`},
+		{"InfGB", `invalid size "InfGB"`},
+		{"1e400", `invalid size "1e400"`},
+		{"100Mb", `invalid size "100Mb"`},
+	}
+	for _, tt := range tests {
+		_, err := ParseByteSize(tt.in)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("ParseByteSize(%q) error = %v, want %s", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Rate
+	}{
+		{"1000", 1000},
+		{"500Kbps", 500e3},
+		{"50Mbps", 50e6},
+		{"50mbps", 50e6},
+		{"1.5Gbps", 1.5e9},
+		{"1.5Gbit", 1.5e9},
+		{"200mbit/s", 200e6},
+		{"64kbit/s", 64e3},
+		{"800bit", 800},
+		{"12.5MB/s", 100e6},
+		{"100kB/s", 800e3},
+		{"100KB/s", 800e3},
+		{"1GB/s", 8e9},
+		{"10B/s", 80},
+		{" 50 Mbps ", 50e6},
+		{"50.00 Mbps", 50e6},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseRate(%q) = %v, %v, want %v", tt.in, float64(got), err, float64(tt.want))
+		}
+	}
+}
+
+func TestParseRateErrors(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"50M", `ambiguous rate "50M", write 50Mbps for bits or 50MB/s for bytes per second`},
+		{"10k", `ambiguous rate "10k", write 10kbps for bits or 10KB/s for bytes per second`},
+		{"", `invalid rate ""`},
+		{"fast", `invalid rate "fast"`},
+		{"-5Mbps", `invalid rate "-5Mbps"`},
+		{"NaN", `invalid rate "NaN"`},
+		{"NaNMbps", `invalid rate "NaNMbps"`},
+		{"Inf", `invalid rate "Inf"`},
+		{"+InfMB/s", `invalid rate "+InfMB/s"`},
+		{"12.5mb/s", `invalid rate "12.5mb/s"`},
+	}
+	for _, tt := range tests {
+		_, err := ParseRate(tt.in)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("ParseRate(%q) error = %v, want %s", tt.in, err, tt.want)
+		}
+	}
+}
+
+// TestUnitsRoundTrip parses what String prints back to the same value.
+func TestUnitsRoundTrip(t *testing.T) {
+	for _, size := range []ByteSize{0, 1e6, 100e6, 1.25e9} {
+		if got, err := ParseByteSize(size.String()); err != nil || got != size {
+			t.Errorf("ParseByteSize(%q) = %d, %v, want %d", size.String(), got, err, size)
+		}
+	}
+	for _, rate := range []Rate{0, 640e3, 50e6, 1.5e9} {
+		if got, err := ParseRate(rate.String()); err != nil || got != rate {
+			t.Errorf("ParseRate(%q) = %v, %v, want %v", rate.String(), float64(got), err, float64(rate))
+		}
+	}
+}
+
+func TestDecodeUnits(t *testing.T) {
+	var c Config
+	doc := `
+buffer_size: 256KiB
+warmup: 2s
+rate_limit: 12.5MB/s
+urls:
+  - url: http://example.com/
+    max_bytes: 100kB
+    simulate: {bandwidth: 50Mbps, latency: 20ms}
+`
+	if err := yaml.Unmarshal([]byte(doc), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.BufferSize != 256<<10 || c.Warmup != 2*time.Second || c.RateLimit != 100e6 {
+		t.Errorf("buffer_size %d, warmup %v, rate_limit %v", c.BufferSize, c.Warmup, float64(c.RateLimit))
+	}
+	u := c.URLs[0]
+	if u.MaxBytes != 100e3 || u.Simulate == nil || u.Simulate.Bandwidth != 50e6 || u.Simulate.Latency != 20*time.Millisecond {
+		t.Errorf("max_bytes %d, simulate %+v", u.MaxBytes, u.Simulate)
+	}
+}
+
+// TestDecodeErrorsNameTheSetting checks that every bad value is reported
+// at its setting and line, and that decoding goes on past it. Those of a
+// url are kept for Problems, so the other urls keep their index.
+func TestDecodeErrorsNameTheSetting(t *testing.T) {
+	doc := `buffer_size: 100M
+warmup: 2
+urls:
+  - url: http://example.com/
+    max_bytes: NaN
+    simulate: {latency: 20ms, bandwidth: 10M}
+`
+	var node yaml.Node
+	if err := yaml.Unmarshal([]byte(doc), &node); err != nil {
+		t.Fatal(err)
+	}
+	var c Config
+	var typeErr *yaml.TypeError
+	if err := node.Decode(&c); !errors.As(err, &typeErr) {
+		t.Fatalf("decode error = %v, want a yaml.TypeError", err)
+	}
+	NameFields(&node, typeErr)
+	want := []string{
+		`line 1: buffer_size: ambiguous size "100M", write 100MB for decimal or 100MiB for binary units`,
+		"line 2: warmup: invalid duration `2`, want one with a unit such as 30s or 1m30s",
+	}
+	if !slices.Equal(typeErr.Errors, want) {
+		t.Errorf("errors:\n%s\nwant:\n%s", strings.Join(typeErr.Errors, "\n"), strings.Join(want, "\n"))
+	}
+	var problems []string
+	for _, p := range c.Problems() {
+		problems = append(problems, p.Error())
+	}
+	for _, want := range []string{
+		`line 5: urls[0].max_bytes: invalid size "NaN", want bytes or a size such as 100MB or 1.5GiB`,
+		`line 6: urls[0].simulate.bandwidth: ambiguous rate "10M", write 10Mbps for bits or 10MB/s for bytes per second`,
+	} {
+		if !slices.Contains(problems, want) {
+			t.Errorf("problems:\n%s\nwant %s", strings.Join(problems, "\n"), want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package perf
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// payload generates size zero bytes without holding them in memory and
+// counts how many the transport has consumed.
+type payload struct {
+	size  int64
+	sent  atomic.Int64
+	start instant
+}
+
+func (p *payload) Read(b []byte) (int, error) {
+	remaining := p.size - p.sent.Load()
+	if remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+	p.start.mark()
+	clear(b)
+	p.sent.Add(int64(len(b)))
+	return len(b), nil
+}
+
+func (p *payload) started() time.Time {
+	return p.start.time()
+}
+
+// Upload POSTs size generated bytes to url and reports the upload speed on
+// the returned channel with the same semantics as Download.
+func (t *Tester) Upload(ctx context.Context, url string, size int64) <-chan Stats {
+	target := t.resolve(Target{URL: url, Method: MethodUpload, UploadSize: ByteSize(size)})
+	return t.terminate(ctx, target, t.upload(ctx, target))
+}
+
+func (t *Tester) upload(ctx context.Context, target Target) <-chan Stats {
+	url, size, limits := target.URL, int64(target.UploadSize), target.Limits
+	if limits.MaxBytes > 0 && int64(limits.MaxBytes) < size {
+		size = int64(limits.MaxBytes)
+	}
+	ctx, cancel := t.withTimeout(ctx)
+	e := t.newEmitter(ctx, target)
+
+	go func() {
+		defer close(e.ch)
+		defer cancel()
+
+		client, release := t.session(target)
+		defer release()
+
+		base := Stats{URL: url, Direction: Upload, Proxy: t.proxyFor(url)}
+		body := &payload{size: size}
+		timer := t.phaseTimer(url)
+		writes := &writeTimer{}
+		defer writes.detach()
+		reqCtx, stopRequest := context.WithCancel(ctx)
+		defer stopRequest()
+		req, err := http.NewRequestWithContext(writes.context(timer.context(reqCtx)), http.MethodPost, url, t.throttle(reqCtx, body, newLimiter(target.RateLimit)))
+		if err != nil {
+			base.Error = err
+			e.send(base)
+			return
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		target.prepare(req)
+
+		var response atomic.Pointer[http.Response]
+		done := make(chan error, 1)
+		go func() {
+			resp, err := client.Do(req)
+			if err == nil {
+				// The server may close the connection once it has answered.
+				timer.keepTCP()
+				response.Store(resp)
+				if err = checkStatus(resp); err == nil {
+					_, err = io.Copy(io.Discard, resp.Body)
+				}
+				resp.Body.Close()
+			}
+			done <- err
+		}()
+
+		var lastSent int64
+		var lastTick time.Time
+		ticker := t.ticker(target)
+		defer ticker.Stop()
+		deadline := limits.deadline()
+		defer deadline.Stop()
+		limited := false
+		m := t.newMeter(target)
+
+		for {
+			select {
+			case <-deadline.C:
+				limited = true
+				stopRequest()
+			case now := <-ticker.C:
+				start := body.started()
+				if start.IsZero() {
+					continue
+				}
+				if lastTick.IsZero() {
+					lastTick = start
+				}
+				sent := body.sent.Load()
+				if !ticker.due(now, m, sent) {
+					continue
+				}
+				if !e.progress(progress(base, m, sent, lastSent, start, lastTick, now)) {
+					<-done
+					e.interrupt(base, sent, start)
+					return
+				}
+				lastSent, lastTick = sent, now
+				if err := cmp.Or(m.stall.aborted(), m.floor.aborted()); err != nil {
+					stopRequest()
+					<-done
+					timer.apply(&base)
+					base.Error = err
+					var slow *SlowError
+					base.SlowAborted = errors.As(err, &slow)
+					m.final(&base, body.sent.Load(), start, time.Now())
+					base.TCP = timer.tcpInfo()
+					base.WritePacing = writes.pacing()
+					e.send(base)
+					return
+				}
+			case err := <-done:
+				timer.apply(&base)
+				if resp := response.Load(); resp != nil {
+					recordResponse(&base, resp, target.CaptureHeaders)
+				}
+				start := body.started()
+				sent := body.sent.Load()
+				switch {
+				case ctx.Err() != nil:
+					e.interrupt(base, sent, start)
+				case err != nil && !limited:
+					base.Error = timer.timedOut(err, &t.opts)
+					base.SizeBytes = sent
+					e.send(base)
+				default:
+					base.Done = true
+					m.final(&base, sent, start, time.Now())
+					base.TCP = timer.tcpInfo()
+					base.WritePacing = writes.pacing()
+					e.send(base)
+				}
+				return
+			}
+		}
+	}()
+
+	return e.ch
+}
@@ -0,0 +1,80 @@
+package perf
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// sinkServer discards what is posted to it, reading 64KB at a time with
+// a pause between reads, and sends the number of bytes it received on the
+// returned channel once a request ends.
+func sinkServer(t *testing.T, pause time.Duration) (*httptest.Server, <-chan int64) {
+	t.Helper()
+	received := make(chan int64, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n int64
+		defer func() { received <- n }()
+		for {
+			m, err := io.CopyN(io.Discard, r.Body, 64<<10)
+			n += m
+			if err != nil {
+				return
+			}
+			if pause > 0 {
+				time.Sleep(pause)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+func TestUploadReportsWhatTheServerReceived(t *testing.T) {
+	srv, received := sinkServer(t, time.Millisecond)
+	tester := New(Options{ProgressInterval: 10 * time.Millisecond})
+	all := collect(tester.Upload(context.Background(), srv.URL, 5e6))
+	last := all[len(all)-1]
+	if last.Error != nil || last.Kind != KindFinal || last.Direction != Upload {
+		t.Fatalf("final %+v, want a completed upload", last)
+	}
+	if got := <-received; last.SizeBytes != got || got != 5e6 {
+		t.Errorf("reported %d bytes, the server received %d, want 5000000", last.SizeBytes, got)
+	}
+	if last.SpeedMbps <= 0 {
+		t.Errorf("speed %v", last.SpeedMbps)
+	}
+	// Progress ticks count up to the final like a download's.
+	if len(all) < 2 {
+		t.Fatalf("%d snapshots, want progress before the final", len(all))
+	}
+	var sent int64
+	for _, s := range all[:len(all)-1] {
+		if s.Kind != KindProgress || s.Direction != Upload || s.SizeBytes < sent || s.SizeBytes > last.SizeBytes {
+			t.Errorf("progress %q %s at %d bytes after %d", s.Kind, s.Direction, s.SizeBytes, sent)
+		}
+		sent = s.SizeBytes
+	}
+}
+
+func TestUploadCancelled(t *testing.T) {
+	srv, received := sinkServer(t, 10*time.Millisecond)
+	tester := New(Options{ProgressInterval: -1})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	var last Stats
+	for s := range tester.Upload(ctx, srv.URL, 1e12) {
+		last = s
+	}
+	if last.Kind != KindCancelled || !errors.Is(last.Error, context.Canceled) {
+		t.Errorf("kind %q, err %v, want a cancelled upload", last.Kind, last.Error)
+	}
+	got := <-received
+	if last.SizeBytes == 0 || last.SizeBytes < got {
+		t.Errorf("cancelled upload reported %d bytes, the server received %d", last.SizeBytes, got)
+	}
+}
@@ -0,0 +1,99 @@
+package perf
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Redacted stands in for the signatures of an expanded URL in output.
+const Redacted = "REDACTED"
+
+var templateAction = regexp.MustCompile(`\{\{.*?\}\}`)
+
+// Templated reports whether url is a template to expand before each pass.
+func Templated(url string) bool {
+	return strings.Contains(url, "{{")
+}
+
+// urlData is what a URL template may refer to: the path and host of the
+// URL with its actions left out.
+type urlData struct {
+	Path string
+	Host string
+}
+
+// ExpandURL expands the URL template raw at now. It offers timestamp, the
+// Unix time of now; uuid, a random UUID; and hmac, the hex HMAC-SHA256
+// under key of its arguments written one after another, as in
+// {{hmac .Path (timestamp)}}. shown is the expansion with every hmac
+// replaced by Redacted.
+func ExpandURL(raw, key string, now time.Time) (expanded, shown string, err error) {
+	var signatures []string
+	funcs := template.FuncMap{
+		"timestamp": func() int64 { return now.Unix() },
+		"uuid":      NewRunID,
+		"hmac": func(args ...any) (string, error) {
+			if key == "" {
+				return "", errors.New("hmac needs a signing_key")
+			}
+			mac := hmac.New(sha256.New, []byte(key))
+			for _, arg := range args {
+				fmt.Fprint(mac, arg)
+			}
+			sig := hex.EncodeToString(mac.Sum(nil))
+			signatures = append(signatures, sig)
+			return sig, nil
+		},
+	}
+	tmpl, err := template.New("url").Option("missingkey=error").Funcs(funcs).Parse(raw)
+	if err != nil {
+		return "", "", err
+	}
+	var data urlData
+	if u, err := url.Parse(templateAction.ReplaceAllString(raw, "")); err == nil {
+		data = urlData{Path: cmp.Or(u.EscapedPath(), "/"), Host: u.Host}
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	expanded, shown = b.String(), b.String()
+	for _, sig := range signatures {
+		shown = strings.ReplaceAll(shown, sig, Redacted)
+	}
+	return expanded, shown, nil
+}
+
+// ExpandTargets returns targets with their URL templates expanded at now,
+// signing with key. The results of an expanded target keep its template
+// as their URL, so they add up across passes, and carry the expansion,
+// redacted, as their ExpandedURL.
+func ExpandTargets(targets []Target, key string, now time.Time) ([]Target, error) {
+	out := make([]Target, len(targets))
+	for i, target := range targets {
+		if Templated(target.URL) {
+			expanded, shown, err := ExpandURL(target.URL, key, now)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", target.URL, err)
+			}
+			target.template, target.URL, target.shown = target.URL, expanded, shown
+		}
+		out[i] = target
+	}
+	return out, nil
+}
+
+// configuredURL is target's URL as configured, which identifies it across
+// passes.
+func (t Target) configuredURL() string {
+	return cmp.Or(t.template, t.URL)
+}
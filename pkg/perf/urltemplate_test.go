@@ -0,0 +1,80 @@
+package perf
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandURL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name, raw, key string
+		want, shown    string
+	}{
+		// RFC 4231, test case 2, with its data split across two arguments.
+		{"known vector", `https://example.com/f?sig={{hmac "what do ya want " "for nothing?"}}`, "Jefe",
+			"https://example.com/f?sig=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843",
+			"https://example.com/f?sig=" + Redacted},
+		{"path and timestamp", "https://cdn.example/v1/file.bin?ts={{timestamp}}&sig={{hmac .Path (timestamp)}}", "secret",
+			"https://cdn.example/v1/file.bin?ts=1700000000&sig=dc313151ac9cb48f86ac5f56a96d9eaca448aab58740f58acace63352593aca6",
+			"https://cdn.example/v1/file.bin?ts=1700000000&sig=" + Redacted},
+		{"host", "https://cdn.example/{{.Host}}", "", "https://cdn.example/cdn.example", "https://cdn.example/cdn.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expanded, shown, err := ExpandURL(tt.raw, tt.key, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expanded != tt.want || shown != tt.shown {
+				t.Errorf("expanded %s\nshown %s\nwant %s\nand %s", expanded, shown, tt.want, tt.shown)
+			}
+		})
+	}
+
+	expanded, _, err := ExpandURL("https://example.com/{{uuid}}", "", now)
+	if err != nil || !regexp.MustCompile(`^https://example.com/[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(expanded) {
+		t.Errorf("uuid: %s, %v", expanded, err)
+	}
+	if _, _, err := ExpandURL(`https://example.com/?sig={{hmac "x"}}`, "", now); err == nil || !strings.Contains(err.Error(), "signing_key") {
+		t.Errorf("hmac without a key: %v", err)
+	}
+	if _, _, err := ExpandURL("https://example.com/{{.Nope}}", "", now); err == nil {
+		t.Error("expanded an unknown field")
+	}
+}
+
+func TestExpandTargetsEveryPass(t *testing.T) {
+	raw := "https://example.com/f?ts={{timestamp}}&sig={{hmac .Path (timestamp)}}"
+	config := []Target{{URL: raw}, {URL: "https://example.com/plain"}}
+	start := time.Unix(1700000000, 0)
+	var sigs []string
+	for pass := range 3 {
+		targets, err := ExpandTargets(config, "secret", start.Add(time.Duration(pass)*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := targets[0]
+		if Templated(got.URL) || got.configuredURL() != raw || !strings.Contains(got.shown, Redacted) {
+			t.Fatalf("pass %d: URL %s, configured %s, shown %s", pass, got.URL, got.configuredURL(), got.shown)
+		}
+		for _, sig := range sigs {
+			if strings.Contains(got.URL, sig) {
+				t.Errorf("pass %d reused the signature %s of an earlier pass", pass, sig)
+			}
+		}
+		sigs = append(sigs, got.URL[strings.LastIndex(got.URL, "=")+1:])
+		if targets[1].URL != "https://example.com/plain" || targets[1].template != "" {
+			t.Errorf("plain target became %+v", targets[1])
+		}
+	}
+	// The config keeps its templates for the next pass.
+	if config[0].URL != raw || config[0].template != "" {
+		t.Errorf("config target changed to %+v", config[0])
+	}
+	if _, err := ExpandTargets([]Target{{URL: `https://example.com/{{hmac "x"}}`}}, "", start); err == nil || !strings.Contains(err.Error(), "https://example.com/") {
+		t.Errorf("err = %v, want it to name the URL", err)
+	}
+}
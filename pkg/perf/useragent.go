@@ -0,0 +1,79 @@
+package perf
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// presets are the request headers of common browsers and clients that the
+// preset option sends, for CDNs that serve or shape by client. net/http
+// writes headers in its own order, so only their values can be mimicked.
+var presets = map[string]map[string]string{
+	"chrome": {
+		"User-Agent":                "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/130.0.0.0 Safari/537.36",
+		"Accept":                    "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7",
+		"Accept-Language":           "en-US,en;q=0.9",
+		"Sec-Ch-Ua":                 `"Chromium";v="130", "Google Chrome";v="130", "Not?A_Brand";v="99"`,
+		"Sec-Ch-Ua-Mobile":          "?0",
+		"Sec-Ch-Ua-Platform":        `"Windows"`,
+		"Sec-Fetch-Dest":            "document",
+		"Sec-Fetch-Mode":            "navigate",
+		"Sec-Fetch-Site":            "none",
+		"Sec-Fetch-User":            "?1",
+		"Upgrade-Insecure-Requests": "1",
+	},
+	"firefox": {
+		"User-Agent":                "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:131.0) Gecko/20100101 Firefox/131.0",
+		"Accept":                    "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		"Accept-Language":           "en-US,en;q=0.5",
+		"Sec-Fetch-Dest":            "document",
+		"Sec-Fetch-Mode":            "navigate",
+		"Sec-Fetch-Site":            "none",
+		"Sec-Fetch-User":            "?1",
+		"Upgrade-Insecure-Requests": "1",
+	},
+	"safari": {
+		"User-Agent":      "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/18.0 Safari/605.1.15",
+		"Accept":          "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		"Accept-Language": "en-US,en;q=0.9",
+	},
+	"curl": {
+		"User-Agent": "curl/8.10.1",
+		"Accept":     "*/*",
+	},
+}
+
+func checkPreset(name string) error {
+	if _, ok := presets[name]; name != "" && !ok {
+		return fmt.Errorf("must be one of %s, got %q", strings.Join(slices.Sorted(maps.Keys(presets)), ", "), name)
+	}
+	return nil
+}
+
+// identify sets the preset headers and user agent of t on req. Headers set
+// explicitly come later and override them.
+func (t Target) identify(req *http.Request) {
+	for name, value := range presets[t.Preset] {
+		req.Header.Set(name, value)
+	}
+	if t.UserAgent != "" {
+		req.Header.Set("User-Agent", t.UserAgent)
+	}
+}
+
+// userAgent is the User-Agent t's requests carry, or "" when it is left to
+// net/http's default.
+func (t Target) userAgent() string {
+	for name, value := range t.Headers {
+		if strings.EqualFold(name, "User-Agent") {
+			return value
+		}
+	}
+	if t.UserAgent != "" {
+		return t.UserAgent
+	}
+	return presets[t.Preset]["User-Agent"]
+}
@@ -0,0 +1,98 @@
+package perf
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUserAgent(t *testing.T) {
+	var mu sync.Mutex
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		mu.Lock()
+		got = r.Header.Clone()
+		mu.Unlock()
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	chrome := presets["chrome"]["User-Agent"]
+
+	tests := []struct {
+		name   string
+		opts   Options
+		target Target
+		// sent is what the server is sent and want what the result says
+		// was.
+		sent, want string
+		headers    map[string]string
+	}{
+		{"default", Options{}, Target{}, "Go-http-client/1.1", "", nil},
+		{"explicit", Options{}, Target{UserAgent: "probe/1.0"}, "probe/1.0", "probe/1.0", nil},
+		{"global", Options{UserAgent: "fleet/2.0"}, Target{}, "fleet/2.0", "fleet/2.0", nil},
+		{"target over global", Options{UserAgent: "fleet/2.0"}, Target{UserAgent: "probe/1.0"}, "probe/1.0", "probe/1.0", nil},
+		{"preset", Options{}, Target{Preset: "chrome"}, chrome, chrome, map[string]string{
+			"Accept":           presets["chrome"]["Accept"],
+			"Accept-Language":  "en-US,en;q=0.9",
+			"Sec-Ch-Ua-Mobile": "?0",
+			"Sec-Fetch-Mode":   "navigate",
+		}},
+		{"global preset", Options{Preset: "curl"}, Target{}, "curl/8.10.1", "curl/8.10.1", map[string]string{"Accept": "*/*"}},
+		// An explicit user agent replaces the preset's, and keeps the rest.
+		{"preset and user agent", Options{}, Target{Preset: "firefox", UserAgent: "probe/1.0"}, "probe/1.0", "probe/1.0", map[string]string{
+			"Accept-Language": "en-US,en;q=0.5",
+		}},
+		// Headers override both.
+		{"headers", Options{}, Target{Preset: "chrome", UserAgent: "probe/1.0", Headers: map[string]string{"User-Agent": "hdr/3.0", "Accept": "application/octet-stream"}},
+			"hdr/3.0", "hdr/3.0", map[string]string{"Accept": "application/octet-stream"}},
+		{"upload", Options{}, Target{Method: MethodUpload, UploadSize: 1000, Preset: "safari"}, presets["safari"]["User-Agent"], presets["safari"]["User-Agent"], map[string]string{
+			"Accept-Language": "en-US,en;q=0.9",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.ProgressInterval = -1
+			tt.target.URL = srv.URL
+			all := collect(New(tt.opts).Test(context.Background(), tt.target))
+			last := all[len(all)-1]
+			if last.Error != nil {
+				t.Fatal(last.Error)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if ua := got.Get("User-Agent"); ua != tt.sent {
+				t.Errorf("sent User-Agent %q, want %q", ua, tt.sent)
+			}
+			if last.UserAgent != tt.want {
+				t.Errorf("result says User-Agent %q, want %q", last.UserAgent, tt.want)
+			}
+			for name, want := range tt.headers {
+				if v := got.Get(name); v != want {
+					t.Errorf("sent %s %q, want %q", name, v, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckPreset(t *testing.T) {
+	for _, name := range []string{"", "chrome", "firefox", "safari", "curl"} {
+		if err := checkPreset(name); err != nil {
+			t.Errorf("checkPreset(%q) = %v", name, err)
+		}
+	}
+	err := checkPreset("edge")
+	if err == nil || err.Error() != `must be one of chrome, curl, firefox, safari, got "edge"` {
+		t.Errorf("checkPreset(edge) = %v", err)
+	}
+	for name, headers := range presets {
+		if !strings.HasPrefix(headers["User-Agent"], "Mozilla/5.0") && name != "curl" {
+			t.Errorf("preset %s sends User-Agent %q", name, headers["User-Agent"])
+		}
+	}
+}
@@ -0,0 +1,862 @@
+package perf
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is one invalid setting, named by its YAML path such as
+// urls[2].auth.token. Line is filled in by Locate.
+type Problem struct {
+	Path string
+	Line int
+	Err  error
+}
+
+func (p Problem) Error() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %v", p.Line, p.Path, p.Err)
+	}
+	return fmt.Sprintf("%s: %v", p.Path, p.Err)
+}
+
+func (p Problem) Unwrap() error { return p.Err }
+
+// Problems collects settings that cannot be used.
+type Problems []Problem
+
+// Add records err at path unless it is nil.
+func (ps *Problems) Add(path string, err error) {
+	if err != nil {
+		*ps = append(*ps, Problem{Path: path, Err: err})
+	}
+}
+
+// Addf records a formatted problem at path.
+func (ps *Problems) Addf(path, format string, args ...any) {
+	ps.Add(path, fmt.Errorf(format, args...))
+}
+
+// Problems reports every setting in c that cannot be used. It reads the
+// TLS files c names but does not touch the network.
+func (c Config) Problems() Problems {
+	var ps Problems
+	if len(c.URLs) == 0 && c.Serve == "" && !c.Speedtest.On() && c.Experiment == nil {
+		ps.Addf("urls", "no urls to test")
+	}
+	for i, target := range c.URLs {
+		if !c.targetProblems(&ps, target, fmt.Sprintf("urls[%d].", i)) {
+			continue
+		}
+		if target.ResolveAll && c.Proxy != "" {
+			ps.Addf(fmt.Sprintf("urls[%d].resolve_all", i), "cannot be used with a proxy, which resolves the host itself")
+		}
+		if target.ConnectTo != "" && c.Proxy != "" {
+			ps.Addf(fmt.Sprintf("urls[%d].connect_to", i), "cannot be used with a proxy, which connects to the host itself")
+		}
+		if fresh := target.FreshConnection; fresh != nil && *fresh && c.Warm {
+			ps.Addf(fmt.Sprintf("urls[%d].fresh_connection", i), "cannot be used with warm, which keeps connections")
+		} else if fresh != nil && !*fresh && c.ColdStart {
+			ps.Addf(fmt.Sprintf("urls[%d].fresh_connection", i), "cannot keep connections with cold_start")
+		}
+		if target.DualstackCompare && c.Proxy != "" {
+			ps.Addf(fmt.Sprintf("urls[%d].dualstack_compare", i), "cannot be used with a proxy, which picks the address family itself")
+		}
+		if c.LinkCapacity.For(target.Direction()) == 0 {
+			side := "down"
+			if target.Direction() == Upload {
+				side = "up"
+			}
+			for _, l := range []struct {
+				name  string
+				limit SpeedLimit
+			}{{"min_speed", target.MinSpeed}, {"warn_speed", target.WarnSpeed}} {
+				if l.limit.Share > 0 {
+					ps.Addf(fmt.Sprintf("urls[%d].%s", i, l.name), "%v needs link_capacity.%s", l.limit, side)
+				}
+			}
+		}
+	}
+	if e := c.Experiment; e != nil {
+		if len(c.URLs) > 0 {
+			ps.Addf("experiment", "cannot be used with urls; list them under a and b")
+		}
+		for _, arm := range []struct {
+			name    string
+			targets []Target
+		}{{ArmA, e.A}, {ArmB, e.B}} {
+			if len(arm.targets) == 0 {
+				ps.Addf("experiment."+arm.name, "needs at least one url")
+			}
+			for i, target := range arm.targets {
+				c.targetProblems(&ps, target, fmt.Sprintf("experiment.%s[%d].", arm.name, i))
+			}
+		}
+		if e.Passes < 0 || e.Passes == 1 {
+			ps.Addf("experiment.passes", "must be at least 2 to compare the arms, got %d", e.Passes)
+		}
+		ps.Add("experiment.order", checkExperimentOrder(e.Order))
+	}
+	if c.Concurrency < 0 {
+		ps.Addf("concurrency", "must not be negative")
+	}
+	if c.MaxIdleConnsPerHost < 0 {
+		ps.Addf("max_idle_conns_per_host", "must not be negative")
+	}
+	if c.IdleConnTimeout < 0 {
+		ps.Addf("idle_conn_timeout", "must not be negative, got %v", c.IdleConnTimeout)
+	}
+	if c.PerHostConcurrency < 0 {
+		ps.Addf("per_host_concurrency", "must not be negative")
+	}
+	if c.RegressionTolerance < 0 || c.RegressionTolerance >= 100 {
+		ps.Addf("regression_tolerance", "must be at least 0 and below 100, got %v", c.RegressionTolerance)
+	}
+	if c.Iterations != nil && *c.Iterations < 0 {
+		ps.Addf("iterations", "must not be negative")
+	}
+	if c.Streams < 0 {
+		ps.Addf("streams", "must not be negative")
+	}
+	if c.Trend.History < 0 {
+		ps.Addf("trend.history", "must not be negative")
+	}
+	if c.Trend.Window < 0 {
+		ps.Addf("trend.window", "must not be negative")
+	}
+	ps.Add("order", checkOrder(c.Order))
+	if s := c.Sweep; s != nil {
+		if s.Concurrency < 0 {
+			ps.Addf("sweep.concurrency", "must not be negative")
+		}
+		if s.Timeout < 0 {
+			ps.Addf("sweep.timeout", "must not be negative, got %v", s.Timeout)
+		}
+	}
+	if s := c.Score; s != nil {
+		if s.Failed != "" && s.Failed != ScoreSkip && s.Failed != ScoreZero {
+			ps.Addf("score.failed", "must be skip or zero, got %q", s.Failed)
+		}
+		if s.LatencyTarget < 0 {
+			ps.Addf("score.latency_target", "must not be negative, got %v", s.LatencyTarget)
+		}
+	}
+	if b := c.DataBudget; b != nil {
+		if b.PerDay <= 0 {
+			ps.Addf("data_budget.per_day", "must be positive")
+		}
+		switch b.Timezone {
+		case "", BudgetLocal, BudgetUTC:
+		default:
+			ps.Addf("data_budget.timezone", "must be local or utc, got %q", b.Timezone)
+		}
+	}
+	if h := c.Heatmap; h != nil {
+		if h.Dir == "" {
+			ps.Addf("heatmap.dir", "heatmap needs a dir to write to")
+		}
+		switch h.Layout {
+		case "", HeatmapTimeOfDay, HeatmapPass:
+		default:
+			ps.Addf("heatmap.layout", "must be time_of_day or pass, got %q", h.Layout)
+		}
+		if h.Column < 0 || h.Column > 0 && 24*time.Hour%h.Column != 0 {
+			ps.Addf("heatmap.column", "must divide a day, got %v", h.Column)
+		}
+		if h.Row < 0 {
+			ps.Addf("heatmap.row", "must not be negative, got %v", h.Row)
+		}
+		if h.SpeedStep < 0 {
+			ps.Addf("heatmap.speed_step", "must not be negative")
+		}
+		if h.MaxSpeed < 0 || h.MaxSpeed > 0 && h.MaxSpeed < h.SpeedStep {
+			ps.Addf("heatmap.max_speed", "must not be below speed_step")
+		}
+	}
+	if c.Rollup < 0 {
+		ps.Addf("rollup", "must not be negative, got %v", c.Rollup)
+	}
+	if c.RunDeadline < 0 {
+		ps.Addf("run_deadline", "must not be negative, got %v", c.RunDeadline)
+	}
+	if c.MinBudget < 0 {
+		ps.Addf("min_budget", "must not be negative, got %v", c.MinBudget)
+	}
+	if c.StallThreshold < 0 {
+		ps.Addf("stall_threshold", "must not be negative, got %v", c.StallThreshold)
+	}
+	if c.FloorGrace < 0 {
+		ps.Addf("floor_grace", "must not be negative, got %v", c.FloorGrace)
+	}
+	if c.ProgressInterval != nil && *c.ProgressInterval < 0 {
+		ps.Addf("progress_interval", "must not be negative, got %v", *c.ProgressInterval)
+	}
+	if c.MaxRedirects < 0 {
+		ps.Addf("max_redirects", "must not be negative")
+	}
+	if c.RotateKeep < 0 {
+		ps.Addf("rotate_keep", "must not be negative")
+	}
+	if (c.RotateSize > 0 || c.RotateKeep > 0) && c.ResultsFile.Path == "" {
+		ps.Addf("rotate_size", "needs a results_file")
+	}
+	if c.Retries < 0 {
+		ps.Addf("retries", "must not be negative")
+	}
+	for _, d := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"timeout", c.Timeout},
+		{"connect_timeout", c.ConnectTimeout},
+		{"tls_timeout", c.TLSTimeout},
+		{"header_timeout", c.HeaderTimeout},
+		{"interval", c.Interval},
+		{"schedule_jitter", c.ScheduleJitter},
+		{"pass_jitter", c.PassJitter},
+		{"warmup", c.Warmup},
+		{"retry_backoff", c.RetryBackoff},
+		{"max_duration", c.MaxDuration},
+	} {
+		if d.d < 0 {
+			ps.Addf(d.name, "must not be negative, got %v", d.d)
+		}
+	}
+	switch jitter := c.ScheduleJitter + c.PassJitter; {
+	case c.Interval == 0 && c.Cron == "":
+		if c.ScheduleJitter > 0 {
+			ps.Addf("schedule_jitter", "needs an interval or cron to offset")
+		}
+		if c.PassJitter > 0 {
+			ps.Addf("pass_jitter", "needs an interval or cron to offset")
+		}
+	case c.Interval > 0 && jitter >= c.Interval:
+		ps.Addf("schedule_jitter", "schedule_jitter and pass_jitter must add up to less than interval %v, got %v", c.Interval, jitter)
+	}
+	_, err := network(c.IPVersion)
+	ps.Add("ip_version", err)
+	ps.Add("protocol", checkProtocol(c.Protocol))
+	ps.Add("compression", checkCompression(c.Compression))
+	if c.NormalizeEncoding && c.Compression == CompressionAccept {
+		ps.Addf("normalize_encoding", "cannot be used with compression: accept")
+	}
+	ps.Add("preset", checkPreset(c.Preset))
+	ps.Add("count", checkCount(c.Count))
+	ps.Add("mode", checkMode(c.Mode))
+	if c.Adaptive.Window < 0 || c.Adaptive.Window == 1 {
+		ps.Addf("adaptive.window", "must be at least 2, got %d", c.Adaptive.Window)
+	}
+	if c.Adaptive.MaxCV < 0 {
+		ps.Addf("adaptive.max_cv", "must not be negative, got %v", c.Adaptive.MaxCV)
+	}
+	if d := c.ShiftDetection; d.MinChange < 0 || d.MinChange >= 1 {
+		ps.Addf("shift_detection.min_change", "must be between 0 and 1, got %v", d.MinChange)
+	}
+	if c.ShiftDetection.MinSamples < 0 {
+		ps.Addf("shift_detection.min_samples", "must not be negative, got %d", c.ShiftDetection.MinSamples)
+	}
+	if c.ShiftDetection.MinScore < 0 {
+		ps.Addf("shift_detection.min_score", "must not be negative, got %v", c.ShiftDetection.MinScore)
+	}
+	c.outputProblems(&ps)
+	c.breakerProblems(&ps)
+	_, err = c.Level()
+	ps.Add("log_level", err)
+	switch c.LogFormat {
+	case "", LogText, LogJournal:
+	default:
+		ps.Addf("log_format", "must be text or journal, got %q", c.LogFormat)
+	}
+	if c.MetricsListen != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsListen); err != nil {
+			ps.Add("metrics_listen", err)
+		}
+		if c.MetricsListen == c.Serve {
+			ps.Addf("serve", "must differ from metrics_listen")
+		}
+		for _, name := range slices.Sorted(maps.Keys(c.Labels)) {
+			ps.Add("labels."+name, checkLabel(name))
+		}
+	}
+	_, err = c.ProxyURL()
+	ps.Add("proxy", err)
+	_, err = NewResolver(c.Resolver)
+	ps.Add("resolver", err)
+	switch {
+	case c.ColdStart && c.Warm:
+		ps.Addf("warm", "cannot be used with cold_start")
+	case c.Warm && c.FreshConnection:
+		ps.Addf("warm", "cannot be used with fresh_connection, which dials every transfer afresh")
+	}
+	SinkConfig{Influx: c.Influx, OTel: c.OTel, StatsD: c.StatsD, Webhook: c.Webhook}.settingProblems(&ps, "")
+	c.LatencyGrading.problems(&ps)
+	if o := c.Outbox; o != nil {
+		delivers := c.Influx != nil || c.Webhook != nil
+		for _, name := range c.NamedSinks() {
+			delivers = delivers || c.Sinks[name].Influx != nil || c.Sinks[name].Webhook != nil
+		}
+		if !delivers {
+			ps.Addf("outbox", "needs influx or webhook to deliver to")
+		}
+		if o.MaxEntries < 0 {
+			ps.Addf("outbox.max_entries", "must not be negative")
+		}
+		if o.RetryBackoff < 0 {
+			ps.Addf("outbox.retry_backoff", "must not be negative, got %v", o.RetryBackoff)
+		}
+		if o.MaxBackoff < 0 {
+			ps.Addf("outbox.max_backoff", "must not be negative, got %v", o.MaxBackoff)
+		} else if o.MaxBackoff > 0 && o.MaxBackoff < o.RetryBackoff {
+			ps.Addf("outbox.max_backoff", "must not be less than retry_backoff %v", o.RetryBackoff)
+		}
+	}
+	c.sinkProblems(&ps)
+	if c.Serve != "" {
+		if _, _, err := net.SplitHostPort(c.Serve); err != nil {
+			ps.Add("serve", err)
+		}
+	}
+	for i, origin := range c.ServeOrigins {
+		path := fmt.Sprintf("serve_origins[%d]", i)
+		u, err := url.Parse(origin)
+		switch {
+		case c.Serve == "":
+			ps.Addf(path, "needs serve")
+		case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/"):
+			ps.Addf(path, "want an origin such as https://dash.example.com, got %q", origin)
+		}
+	}
+	c.agentProblems(&ps)
+	c.profileProblems(&ps)
+	c.Units.problems(&ps)
+	if c.Speedtest.On() {
+		if c.Speedtest.Servers < 0 {
+			ps.Addf("speedtest.servers", "must not be negative")
+		}
+		if c.Speedtest.ListURL != "" {
+			ps.Add("speedtest.list_url", checkURL(c.Speedtest.ListURL))
+		}
+		if c.Speedtest.DownloadSize < 0 {
+			ps.Addf("speedtest.download_size", "must not be negative")
+		}
+		if c.Speedtest.UploadSize < 0 {
+			ps.Addf("speedtest.upload_size", "must not be negative")
+		}
+		if c.Speedtest.CacheTTL < 0 {
+			ps.Addf("speedtest.cache_ttl", "must not be negative, got %v", c.Speedtest.CacheTTL)
+		}
+	}
+	if c.AlertThreshold < 0 {
+		ps.Addf("alert_threshold", "must not be negative, got %d", c.AlertThreshold)
+	}
+	if c.AlertWindow < 0 {
+		ps.Addf("alert_window", "must not be negative, got %v", c.AlertWindow)
+	}
+	if c.AlertClearAfter < 0 {
+		ps.Addf("alert_clear_after", "must not be negative, got %d", c.AlertClearAfter)
+	}
+	if c.AlertThreshold == 0 && (c.AlertWindow != 0 || c.AlertClearAfter != 0) {
+		ps.Addf("alert_threshold", "is needed by alert_window and alert_clear_after")
+	}
+	if _, err := c.TLSConfig(); err != nil {
+		if msg, ok := strings.CutPrefix(err.Error(), "ca_file: "); ok {
+			ps.Addf("ca_file", "%s", msg)
+		} else {
+			ps.Add("client_cert", err)
+		}
+	}
+	return ps
+}
+
+// Problems reports every setting in t that cannot be used, with paths
+// relative to the entry.
+func (t Target) Problems() Problems {
+	var ps Problems
+	t.problems(&ps, "")
+	return ps
+}
+
+// problems adds the problems of one urls entry, with prefix naming it.
+func (t Target) problems(ps *Problems, prefix string) {
+	for _, p := range t.decodeErrs {
+		p.Path = strings.TrimSuffix(prefix+p.Path, ".")
+		*ps = append(*ps, p)
+	}
+	switch scheme(t.URL) {
+	case SchemeFTP, SchemeTCP, SchemeFile:
+		ps.Add(prefix+"url", checkRawURL(t.URL))
+		if t.Method != "" && t.Method != MethodDownload {
+			ps.Addf(prefix+"method", "%s URLs only support download", scheme(t.URL))
+		}
+		if t.Streams > 1 {
+			ps.Addf(prefix+"streams", "%s URLs use a single stream", scheme(t.URL))
+		}
+	default:
+		ps.Add(prefix+"url", checkURL(t.URL))
+	}
+	if scheme(t.URL) == SchemeFile {
+		if t.ResolveAll {
+			ps.Addf(prefix+"resolve_all", "does not apply to file URLs")
+		}
+		if t.DualstackCompare {
+			ps.Addf(prefix+"dualstack_compare", "does not apply to file URLs")
+		}
+	}
+	switch {
+	case t.DirectIO && scheme(t.URL) != SchemeFile:
+		ps.Addf(prefix+"direct_io", "only applies to file URLs")
+	case t.DirectIO && !directIOSupported:
+		ps.Addf(prefix+"direct_io", "only supported on Linux")
+	}
+	switch t.Method {
+	case "", MethodDownload:
+	case MethodUpload:
+		if t.UploadSize <= 0 {
+			ps.Addf(prefix+"upload_size", "upload needs a positive upload_size")
+		}
+	case MethodLatency:
+		if t.Probes < 0 {
+			ps.Addf(prefix+"probes", "must not be negative")
+		}
+	default:
+		ps.Addf(prefix+"method", "unknown method %q", t.Method)
+	}
+	download := t.Method == "" || t.Method == MethodDownload
+	if t.Streams < 0 {
+		ps.Addf(prefix+"streams", "must not be negative")
+	}
+	if t.MaxRedirects < 0 {
+		ps.Addf(prefix+"max_redirects", "must not be negative")
+	}
+	ps.Add(prefix+"sink", checkSink(t))
+	if t.Bufferbloat && (t.Direction() == Latency || scheme(t.URL) != "http" && scheme(t.URL) != "https") {
+		ps.Addf(prefix+"bufferbloat", "only applies to http(s) downloads and uploads")
+	}
+	if t.ProbeURL != "" {
+		ps.Add(prefix+"probe_url", checkURL(t.ProbeURL))
+	}
+	if t.StallThreshold < 0 {
+		ps.Addf(prefix+"stall_threshold", "must not be negative, got %v", t.StallThreshold)
+	}
+	if t.FloorGrace < 0 {
+		ps.Addf(prefix+"floor_grace", "must not be negative, got %v", t.FloorGrace)
+	}
+	if t.Weight < 0 {
+		ps.Addf(prefix+"weight", "must not be negative")
+	}
+	if t.MaxDuration < 0 {
+		ps.Addf(prefix+"max_duration", "must not be negative, got %v", t.MaxDuration)
+	}
+	_, err := network(t.IPVersion)
+	ps.Add(prefix+"ip_version", err)
+	if t.DualstackCompare {
+		switch {
+		case t.ResolveAll:
+			ps.Addf(prefix+"dualstack_compare", "cannot be used with resolve_all")
+		case t.IPVersion == "4" || t.IPVersion == "6":
+			ps.Addf(prefix+"dualstack_compare", "cannot be used with ip_version %s, it tests both", t.IPVersion)
+		}
+	}
+	t.connectToProblems(ps, prefix)
+	if t.SizeSweep != nil {
+		t.sizeSweepProblems(ps, prefix)
+	}
+	if t.Ramp != nil {
+		t.rampProblems(ps, prefix)
+	}
+	if t.OffsetSamples != 0 || t.SampleSize != 0 {
+		t.offsetProblems(ps, prefix)
+	}
+	if t.Bidirectional {
+		t.bidiProblems(ps, prefix)
+	} else if t.UploadURL != "" {
+		ps.Addf(prefix+"upload_url", "only applies to bidirectional tests")
+	}
+	ps.Add(prefix+"protocol", checkProtocol(t.Protocol))
+	ps.Add(prefix+"compression", checkCompression(t.Compression))
+	if t.NormalizeEncoding != nil && *t.NormalizeEncoding && t.Compression == CompressionAccept {
+		ps.Addf(prefix+"normalize_encoding", "cannot be used with compression: accept")
+	}
+	ps.Add(prefix+"preset", checkPreset(t.Preset))
+	ps.Add(prefix+"count", checkCount(t.Count))
+	if len(t.CaptureHeaders) > 0 {
+		ps.Add(prefix+"capture_headers", checkCaptureHeaders(t.CaptureHeaders))
+		if s := scheme(t.URL); s != "http" && s != "https" {
+			ps.Addf(prefix+"capture_headers", "only applies to http(s) URLs")
+		}
+	}
+	if t.Count == CountWire {
+		switch {
+		case !download || scheme(t.URL) != "http" && scheme(t.URL) != "https":
+			ps.Addf(prefix+"count", "wire only applies to http(s) downloads")
+		case t.Protocol == ProtocolH3:
+			ps.Addf(prefix+"count", "wire cannot count HTTP/3, which does not run over TCP")
+		}
+	}
+	ps.Add(prefix+"mode", checkMode(t.Mode))
+	if t.Mode == ModeAdaptive && !download {
+		ps.Addf(prefix+"mode", "adaptive only applies to downloads")
+	}
+	ps.Add(prefix+"sha256", checkDigest("sha256", t.SHA256, sha256.Size))
+	ps.Add(prefix+"md5", checkDigest("md5", t.MD5, md5.Size))
+	if t.SHA256 != "" && !download {
+		ps.Addf(prefix+"sha256", "checksums only apply to downloads")
+	}
+	if t.MD5 != "" && !download {
+		ps.Addf(prefix+"md5", "checksums only apply to downloads")
+	}
+	if t.VerifyPattern != nil && !download {
+		ps.Addf(prefix+"verify_pattern", "only applies to downloads")
+	}
+	if t.Resume {
+		switch {
+		case !download || scheme(t.URL) != "http" && scheme(t.URL) != "https":
+			ps.Addf(prefix+"resume", "only applies to http(s) downloads")
+		case t.Streams > 1:
+			ps.Addf(prefix+"resume", "cannot be used with streams, which split the body already")
+		case t.SHA256 != "" || t.MD5 != "":
+			ps.Addf(prefix+"resume", "cannot verify a checksum across the parts of a resumed body")
+		case t.Sink == SinkFile:
+			ps.Addf(prefix+"resume", "cannot be used with sink: file")
+		case t.ReuseProbe:
+			ps.Addf(prefix+"resume", "cannot be used with reuse_probe")
+		}
+	}
+	if sim := t.Simulate; sim != nil {
+		switch {
+		case !download:
+			ps.Addf(prefix+"simulate", "only applies to downloads")
+		case sim.Latency < 0:
+			ps.Addf(prefix+"simulate.latency", "must not be negative, got %v", sim.Latency)
+		case sim.Jitter < 0:
+			ps.Addf(prefix+"simulate.jitter", "must not be negative, got %v", sim.Jitter)
+		case sim.Loss >= 100:
+			ps.Addf(prefix+"simulate.loss", "must be below 100%%, got %v", sim.Loss)
+		}
+	}
+	if t.MaxResumes < 0 {
+		ps.Addf(prefix+"max_resumes", "must not be negative")
+	}
+	if t.ReuseProbe && !download {
+		ps.Addf(prefix+"reuse_probe", "only applies to downloads")
+	}
+	if t.SourceIP != "" && net.ParseIP(t.SourceIP) == nil {
+		ps.Addf(prefix+"source_ip", "invalid address %q", t.SourceIP)
+	}
+	if t.Interface != "" && !bindSupported {
+		ps.Addf(prefix+"interface", "only supported on Linux")
+	}
+	if t.Auth != nil {
+		switch t.Auth.Type {
+		case AuthBearer:
+			if t.Auth.Token == "" {
+				ps.Addf(prefix+"auth.token", "bearer auth needs a token")
+			}
+		case AuthBasic:
+			if t.Auth.User == "" {
+				ps.Addf(prefix+"auth.user", "basic auth needs a user")
+			}
+		default:
+			ps.Addf(prefix+"auth.type", "unknown auth type %q", t.Auth.Type)
+		}
+	}
+	if t.S3 != nil {
+		t.s3Problems(ps, prefix)
+	}
+	if t.Expect != nil {
+		t.expectProblems(ps, prefix)
+	}
+	t.Thresholds.problems(ps, prefix)
+}
+
+// targetProblems checks target at prefix, expanding its URL template
+// first. It reports false when the template does not expand.
+func (c Config) targetProblems(ps *Problems, target Target, prefix string) bool {
+	c.routeProblems(ps, target.Sinks, prefix+"sinks")
+	if Templated(target.URL) {
+		expanded, _, err := ExpandURL(target.URL, c.SigningKey, time.Now())
+		if err != nil {
+			ps.Add(prefix+"url", err)
+			return false
+		}
+		target.URL = expanded
+	}
+	target.problems(ps, prefix)
+	return true
+}
+
+func (t Thresholds) problems(ps *Problems, prefix string) {
+	for _, v := range []struct {
+		name  string
+		value float64
+	}{
+		{"min_speed_mbps", t.MinSpeedMbps},
+		{"warn_speed_mbps", t.WarnSpeedMbps},
+		{"max_latency_ms", t.MaxLatencyMs},
+		{"warn_latency_ms", t.WarnLatencyMs},
+	} {
+		if v.value < 0 {
+			ps.Addf(prefix+v.name, "must not be negative, got %v", v.value)
+		}
+	}
+	if t.MinSpeedMbps > 0 && t.MinSpeed != (SpeedLimit{}) {
+		ps.Addf(prefix+"min_speed", "cannot be set with min_speed_mbps")
+	}
+	if t.WarnSpeedMbps > 0 && t.WarnSpeed != (SpeedLimit{}) {
+		ps.Addf(prefix+"warn_speed", "cannot be set with warn_speed_mbps")
+	}
+	if t.MinSpeedMbps > 0 && t.WarnSpeedMbps > 0 && t.MinSpeedMbps > t.WarnSpeedMbps {
+		ps.Addf(prefix+"min_speed_mbps", "%v is above warn_speed_mbps %v", t.MinSpeedMbps, t.WarnSpeedMbps)
+	}
+	if t.MaxLatencyMs > 0 && t.WarnLatencyMs > 0 && t.WarnLatencyMs > t.MaxLatencyMs {
+		ps.Addf(prefix+"warn_latency_ms", "%v is above max_latency_ms %v", t.WarnLatencyMs, t.MaxLatencyMs)
+	}
+}
+
+// decodeError reports err at node as a yaml.TypeError, which lets decoding
+// go on and collect the errors of later fields too.
+func decodeError(node *yaml.Node, err error) error {
+	return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: %v", node.Line, err)}}
+}
+
+// NameFields puts the setting each error of err is about in front of it,
+// found by its line in doc, so "line 3: invalid size" reads "line 3:
+// max_bytes: invalid size".
+func NameFields(doc *yaml.Node, err *yaml.TypeError) {
+	for i, e := range err.Errors {
+		if p := decodeProblem(doc, e); p.Path != "" {
+			err.Errors[i] = p.Error()
+		}
+	}
+}
+
+// decodeProblem turns e, an error of decoding node, into a Problem at the
+// setting under node it is about, with what YAML says of durations put
+// plainly.
+func decodeProblem(node *yaml.Node, e string) Problem {
+	var line int
+	fmt.Sscanf(e, "line %d:", &line)
+	_, msg, _ := strings.Cut(e, ": ")
+	if rest, ok := strings.CutSuffix(msg, " into time.Duration"); ok {
+		value := rest[strings.LastIndex(rest, " ")+1:]
+		msg = fmt.Sprintf("invalid duration %s, want one with a unit such as 30s or 1m30s", value)
+	}
+	// Of several settings on the line, as in a flow mapping, the one holding
+	// the value quoted in the message is meant.
+	path := ""
+	if _, quoted, ok := strings.Cut(msg, "`"); ok {
+		quoted, _, _ = strings.Cut(quoted, "`")
+		path = fieldAt(node, line, quoted)
+	} else if _, quoted, ok := strings.Cut(msg, `"`); ok {
+		quoted, _, _ = strings.Cut(quoted, `"`)
+		path = fieldAt(node, line, quoted)
+	}
+	if path == "" {
+		path = fieldAt(node, line, "")
+	}
+	return Problem{Path: path, Line: line, Err: errors.New(msg)}
+}
+
+// fieldAt returns the path under node of the setting whose value is on
+// line, such as "simulate.bandwidth", or "" when none is. A value other
+// than "" only matches a setting holding it.
+func fieldAt(node *yaml.Node, line int, value string) string {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	dotted := func(sub string) string {
+		if strings.HasPrefix(sub, "[") {
+			return sub
+		}
+		return "." + sub
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, item := node.Content[i].Value, node.Content[i+1]
+			if sub := fieldAt(item, line, value); sub != "" {
+				return key + dotted(sub)
+			}
+			if item.Line == line && (value == "" || item.Value == value) {
+				return key
+			}
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			if sub := fieldAt(item, line, value); sub != "" {
+				return fmt.Sprintf("[%d]%s", i, dotted(sub))
+			}
+			if item.Line == line && (value == "" || item.Value == value) {
+				return fmt.Sprintf("[%d]", i)
+			}
+		}
+	}
+	return ""
+}
+
+// outputProblems adds the problems of the outputs setting: each names a
+// format, and no two write to the same file.
+func (c Config) outputProblems(ps *Problems) {
+	if len(c.Outputs) > 0 && len(c.Reporters) > 0 {
+		ps.Addf("outputs", "cannot be used with reporters")
+	}
+	files := map[string]int{}
+	for i, o := range c.Outputs {
+		prefix := fmt.Sprintf("outputs[%d].", i)
+		switch o.Format {
+		case "text", "json", "csv":
+		case "":
+			ps.Addf(prefix+"format", "is required, want text, json or csv")
+		default:
+			ps.Addf(prefix+"format", "must be text, json or csv, got %q", o.Format)
+		}
+		if o.To == "" || o.To == Stdout || o.To == Stderr {
+			continue
+		}
+		if j, ok := files[o.To]; ok {
+			ps.Addf(prefix+"to", "%s is written by outputs[%d] already", o.To, j)
+			continue
+		}
+		files[o.To] = i
+	}
+}
+
+// agentProblems checks the agents and that the urls are ones the test API
+// of an agent can run.
+func (c Config) agentProblems(ps *Problems) {
+	if len(c.Agents) == 0 {
+		return
+	}
+	switch {
+	case c.Serve != "":
+		ps.Addf("agents", "cannot be used with serve")
+	case c.Sweep != nil:
+		ps.Addf("agents", "cannot be used with sweep, which would run here")
+	}
+	labels := map[string]bool{}
+	for i, a := range c.Agents {
+		prefix := fmt.Sprintf("agents[%d].", i)
+		switch {
+		case a.Label == "":
+			ps.Addf(prefix+"label", "is required")
+		case labels[a.Label]:
+			ps.Addf(prefix+"label", "%q is used by another agent", a.Label)
+		}
+		labels[a.Label] = true
+		ps.Add(prefix+"url", checkURL(a.URL))
+	}
+	lists := map[string][]Target{"urls": c.URLs}
+	if e := c.Experiment; e != nil {
+		lists["experiment.a"], lists["experiment.b"] = e.A, e.B
+	}
+	for _, name := range slices.Sorted(maps.Keys(lists)) {
+		for i, t := range lists[name] {
+			if t.Direction() != Download || scheme(t.URL) != "http" && scheme(t.URL) != "https" {
+				ps.Addf(fmt.Sprintf("%s[%d].url", name, i), "agents only run http(s) downloads")
+			}
+			if t.S3 != nil {
+				ps.Addf(fmt.Sprintf("%s[%d].s3", name, i), "agents cannot sign s3 requests")
+			}
+		}
+	}
+	if c.AgentTimeout < 0 {
+		ps.Addf("agent_timeout", "must not be negative, got %v", c.AgentTimeout)
+	}
+	if c.AgentConcurrency < 0 {
+		ps.Addf("agent_concurrency", "must not be negative")
+	}
+}
+
+func checkURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("want an absolute http or https URL, got %q", raw)
+	}
+	return nil
+}
+
+// checkRawURL checks an ftp, tcp or file URL.
+func checkRawURL(raw string) error {
+	if scheme(raw) == SchemeFile {
+		_, err := filePath(raw)
+		return err
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host in %q", raw)
+	}
+	if u.Scheme == SchemeTCP {
+		_, _, err = parseTCP(raw)
+	}
+	return err
+}
+
+// Err joins the problems into one error, or returns nil when there are none.
+func (ps Problems) Err() error {
+	errs := make([]error, len(ps))
+	for i, p := range ps {
+		errs[i] = p
+	}
+	return errors.Join(errs...)
+}
+
+// Locate sets the line of each problem that has none from doc, the
+// document the config was decoded from. Paths that run past the document
+// get the line of the deepest node that exists.
+func (ps Problems) Locate(doc *yaml.Node) {
+	if doc == nil {
+		return
+	}
+	for i := range ps {
+		if ps[i].Line == 0 {
+			ps[i].Line = lookup(doc, ps[i].Path).Line
+		}
+	}
+}
+
+func lookup(node *yaml.Node, path string) *yaml.Node {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, part := range strings.Split(strings.NewReplacer("[", ".", "]", "").Replace(path), ".") {
+		next := child(node, part)
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node
+}
+
+func child(node *yaml.Node, key string) *yaml.Node {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				return node.Content[i+1]
+			}
+		}
+	case yaml.SequenceNode:
+		if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(node.Content) {
+			return node.Content[i]
+		}
+	}
+	return nil
+}
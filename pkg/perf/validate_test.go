@@ -0,0 +1,202 @@
+package perf
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// problems decodes doc as a config and lists its problems, one per line,
+// the way yaperf check prints them.
+func problems(t *testing.T, doc string) string {
+	t.Helper()
+	var node yaml.Node
+	if err := yaml.Unmarshal([]byte(doc), &node); err != nil {
+		t.Fatal(err)
+	}
+	var c Config
+	var lines []string
+	if err := node.Decode(&c); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			t.Fatal(err)
+		}
+		NameFields(&node, typeErr)
+		lines = append(lines, typeErr.Errors...)
+	}
+	ps := c.Problems()
+	ps.Locate(&node)
+	for _, p := range ps {
+		lines = append(lines, p.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestProblems(t *testing.T) {
+	dir := t.TempDir()
+	badCA := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(badCA, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{"valid", "urls:\n  - https://example.com/\n  - url: http://example.com/up\n    method: upload\n    upload_size: 1MB\n", ""},
+		{"no urls", "concurrency: 2\n", "line 1: urls: no urls to test"},
+		{"url syntax", "urls:\n  - https://example.com/\n  - example.com/file\n  - url: ftp://\n",
+			"line 3: urls[1].url: want an absolute http or https URL, got \"example.com/file\"\n" +
+				"line 4: urls[2].url: missing host in \"ftp://\""},
+		{"duration", "timeout: 30\nurls:\n  - url: https://example.com/\n    max_duration: 5x\n",
+			"line 1: timeout: invalid duration `30`, want one with a unit such as 30s or 1m30s\n" +
+				"line 4: urls[0].max_duration: invalid duration `5x`, want one with a unit such as 30s or 1m30s"},
+		{"negative duration", "retry_backoff: -1s\nurls: [https://example.com/]\n", "line 1: retry_backoff: must not be negative, got -1s"},
+		{"thresholds", "urls:\n  - url: https://example.com/\n    min_speed_mbps: 100\n    warn_speed_mbps: 50\n  - url: https://example.com/b\n    max_latency_ms: 10\n    warn_latency_ms: 20\n    min_speed_mbps: -1\n",
+			"line 3: urls[0].min_speed_mbps: 100 is above warn_speed_mbps 50\n" +
+				"line 8: urls[1].min_speed_mbps: must not be negative, got -1\n" +
+				"line 7: urls[1].warn_latency_ms: 20 is above max_latency_ms 10"},
+		{"ca file", "ca_file: " + badCA + "\nurls: [https://example.com/]\n", "line 1: ca_file: no PEM certificates found in " + badCA},
+		{"labels", "metrics_listen: :9100\nlabels:\n  site: lab\n  bad-name: x\nurls: [https://example.com/]\n",
+			"line 4: labels.bad-name: label \"bad-name\" is not a valid Prometheus label name"},
+		{"method", "urls:\n  - url: https://example.com/\n    method: put\n  - url: https://example.com/\n    method: upload\n",
+			"line 3: urls[0].method: unknown method \"put\"\n" +
+				// A missing setting is located at the entry.
+				"line 4: urls[1].upload_size: upload needs a positive upload_size"},
+		{"count", "count: tcp\nurls:\n  - url: https://example.com/up\n    method: upload\n    upload_size: 1MB\n    count: wire\n  - url: ftp://example.com/file\n    count: wire\n",
+			"line 6: urls[0].count: wire only applies to http(s) downloads\n" +
+				"line 8: urls[1].count: wire only applies to http(s) downloads\n" +
+				"line 1: count: count must be body or wire, got \"tcp\""},
+		{"dualstack", "proxy: http://proxy.example:3128\nurls:\n  - url: https://example.com/a\n    dualstack_compare: true\n    resolve_all: true\n  - url: https://example.com/b\n    dualstack_compare: true\n    ip_version: \"6\"\n",
+			"line 4: urls[0].dualstack_compare: cannot be used with resolve_all\n" +
+				"line 5: urls[0].resolve_all: cannot be used with a proxy, which resolves the host itself\n" +
+				"line 4: urls[0].dualstack_compare: cannot be used with a proxy, which picks the address family itself\n" +
+				"line 7: urls[1].dualstack_compare: cannot be used with ip_version 6, it tests both\n" +
+				"line 7: urls[1].dualstack_compare: cannot be used with a proxy, which picks the address family itself"},
+		{"resume", "urls:\n  - url: ftp://example.com/file\n    resume: true\n  - url: https://example.com/a\n    resume: true\n    streams: 4\n    max_resumes: -1\n",
+			"line 3: urls[0].resume: only applies to http(s) downloads\n" +
+				"line 5: urls[1].resume: cannot be used with streams, which split the body already\n" +
+				"line 7: urls[1].max_resumes: must not be negative"},
+		{"link capacity", "link_capacity: {down: 1Gbps}\nurls:\n  - url: https://example.com/a\n    min_speed: 70%\n  - url: https://example.com/b\n    method: upload\n    upload_size: 1000\n    warn_speed: 50%\n  - url: https://example.com/c\n    min_speed: 700Mbps\n    min_speed_mbps: 700\n",
+			"line 8: urls[1].warn_speed: 50% needs link_capacity.up\n" +
+				"line 10: urls[2].min_speed: cannot be set with min_speed_mbps"},
+		{"normalize encoding", "compression: accept\nnormalize_encoding: true\nurls:\n  - url: https://example.com/a\n    compression: accept\n    normalize_encoding: true\n  - url: https://example.com/b\n    normalize_encoding: false\n",
+			"line 6: urls[0].normalize_encoding: cannot be used with compression: accept\n" +
+				"line 2: normalize_encoding: cannot be used with compression: accept"},
+		{"verify pattern", "urls:\n  - url: https://example.com/a\n    method: upload\n    upload_size: 1000\n    verify_pattern: {seed: 42}\n  - url: https://example.com/b\n    verify_pattern: {seed: 42}\n",
+			"line 5: urls[0].verify_pattern: only applies to downloads"},
+		{"sweep", "sweep: {concurrency: -1, timeout: -1s}\nurls: [https://example.com/]\n",
+			"line 1: sweep.concurrency: must not be negative\n" +
+				"line 1: sweep.timeout: must not be negative, got -1s"},
+		{"simulate", "urls:\n  - url: https://example.com/a\n    method: upload\n    upload_size: 1000\n    simulate: {bandwidth: 10Mbps}\n  - url: https://example.com/b\n    simulate: {latency: -1ms}\n  - url: https://example.com/c\n    simulate: {jitter: -2ms}\n  - url: https://example.com/d\n    simulate: {loss: 100%, seed: 1}\n  - url: https://example.com/e\n    simulate: {bandwidth: 10Mbps, latency: 20ms, loss: 0.5%}\n",
+			"line 5: urls[0].simulate: only applies to downloads\n" +
+				"line 7: urls[1].simulate.latency: must not be negative, got -1ms\n" +
+				"line 9: urls[2].simulate.jitter: must not be negative, got -2ms\n" +
+				"line 11: urls[3].simulate.loss: must be below 100%, got 100%"},
+		{"agents", "agents:\n  - {label: east, url: https://east.example:8080}\n  - {label: east, url: https://west.example:8080}\n  - {url: https://south.example:8080}\nagent_timeout: -1s\nagent_concurrency: -1\nurls:\n  - https://example.com/a\n  - url: https://example.com/b\n    method: upload\n    upload_size: 1000\n  - ftp://ftp.example.com/c\n",
+			"line 3: agents[1].label: \"east\" is used by another agent\n" +
+				"line 4: agents[2].label: is required\n" +
+				"line 9: urls[1].url: agents only run http(s) downloads\n" +
+				"line 12: urls[2].url: agents only run http(s) downloads\n" +
+				"line 5: agent_timeout: must not be negative, got -1s\n" +
+				"line 6: agent_concurrency: must not be negative"},
+		{"agents with serve", "serve: :8080\nagents: [{label: east, url: https://east.example:8080}]\nurls: [https://example.com/]\n",
+			"line 2: agents: cannot be used with serve"},
+		{"profiles", "profiles:\n  quick:\n    urls: [a, z]\n    iterations: -1\n  cdn:\n    groups: [edge]\n    concurrency: -1\n  empty: {}\nurls:\n  - url: https://example.com/a\n    name: a\n    group: cdn\n  - url: https://example.com/b\n    name: b\n",
+			"line 6: profiles.cdn.groups[0]: no url is in group \"edge\"; groups are cdn\n" +
+				"line 7: profiles.cdn.concurrency: must not be negative\n" +
+				"line 8: profiles.empty: picks no urls; list url names under urls or groups under groups\n" +
+				"line 3: profiles.quick.urls[1]: no url is named \"z\"; url names are a, b\n" +
+				"line 4: profiles.quick.iterations: must not be negative"},
+		{"heatmap", "heatmap:\n  layout: grid\n  column: 7m\n  row: -1s\n  speed_step: 100Mbps\n  max_speed: 50Mbps\nurls: [https://example.com/]\n",
+			"line 2: heatmap.dir: heatmap needs a dir to write to\n" +
+				"line 2: heatmap.layout: must be time_of_day or pass, got \"grid\"\n" +
+				"line 3: heatmap.column: must divide a day, got 7m0s\n" +
+				"line 4: heatmap.row: must not be negative, got -1s\n" +
+				"line 6: heatmap.max_speed: must not be below speed_step"},
+		{"expect", "urls:\n  - url: https://example.com/a\n    method: upload\n    upload_size: 1000\n    expect: {content_type: image/}\n  - url: https://example.com/b\n    expect: {}\n  - url: ftp://ftp.example.com/c\n    expect: {min_size: 1MB}\n  - url: https://example.com/d\n    expect: {content_type: application/octet-stream, min_size: 10MB}\n",
+			"line 5: urls[0].expect: only applies to http(s) downloads\n" +
+				"line 7: urls[1].expect: needs a content_type or a min_size\n" +
+				"line 9: urls[2].expect: only applies to http(s) downloads"},
+		{"units", "units:\n  speed: mibps\n  size: si\nurls: [https://example.com/]\n",
+			"line 2: units.speed: must be mbps, MBps, gbps or auto, got \"mibps\"\n" +
+				"line 3: units.size: must be decimal or binary, got \"si\""},
+		{"connect_to", "urls:\n  - url: https://example.com/a\n    connect_to: 10.0.0.1\n  - url: file:///tmp/a\n    connect_to: 10.0.0.1:443\n  - url: http://example.com/b\n    resolve_all: true\n    connect_to: 10.0.0.1:80\n    sni: example.com\n  - url: ftp://ftp.example.com/c\n    host_header: origin/internal\n  - url: https://example.com/d\n    host_header: origin internal\n    sni: origin:443\n",
+			"line 3: urls[0].connect_to: want host:port, got \"10.0.0.1\"\n" +
+				"line 5: urls[1].connect_to: does not apply to file URLs\n" +
+				"line 8: urls[2].connect_to: cannot be used with resolve_all\n" +
+				"line 9: urls[2].sni: only applies to https URLs\n" +
+				"line 11: urls[3].host_header: only applies to http(s) URLs\n" +
+				"line 13: urls[4].host_header: want host[:port], got \"origin internal\"\n" +
+				"line 14: urls[4].sni: want a host name, got \"origin:443\""},
+		{"connect_to with a proxy", "proxy: http://proxy.example:3128\nurls:\n  - url: https://example.com/a\n    connect_to: 10.0.0.1:443\n    host_header: example.com\n",
+			"line 4: urls[0].connect_to: cannot be used with a proxy, which connects to the host itself"},
+		{"cache modes", "cold_start: true\nwarm: true\nurls:\n  - url: https://example.com/a\n    fresh_connection: true\n",
+			"line 5: urls[0].fresh_connection: cannot be used with warm, which keeps connections\n" +
+				"line 2: warm: cannot be used with cold_start"},
+		{"cold start", "cold_start: true\nurls:\n  - url: https://example.com/a\n    fresh_connection: false\n",
+			"line 4: urls[0].fresh_connection: cannot keep connections with cold_start"},
+		{"warm", "warm: true\nfresh_connection: true\nurls: [https://example.com/a]\n",
+			"line 1: warm: cannot be used with fresh_connection, which dials every transfer afresh"},
+		{"sink routes", "sinks:\n  prod: {influx: {url: 'https://influx.example', bucket: prod}}\n  influx: {required: false, csv_file: x.csv}\n  both: {csv_file: a.csv, samples_file: b.jsonl}\n  nothing: {required: true}\n  bad: {statsd: {address: nohost}}\ncsv_file: all.csv\ngroup_sinks:\n  staging: [staging]\nurls:\n  - url: https://example.com/a\n    sinks: [prod, csv_file, report]\n  - url: https://example.com/b\n    sinks: [influx, both, typo]\n  - url: https://example.com/c\n    sinks: []\n",
+			"line 14: urls[1].sinks[0]: \"influx\" is not a sink set up by the config\n" +
+				"line 14: urls[1].sinks[1]: \"both\" is not a sink set up by the config\n" +
+				"line 14: urls[1].sinks[2]: \"typo\" is not a sink set up by the config\n" +
+				"line 16: urls[2].sinks: must name at least one sink; leave it out to route to every sink\n" +
+				"line 6: sinks.bad.statsd.address: address nohost: missing port in address\n" +
+				"line 4: sinks.both: sets csv_file and samples_file; a named sink sets one of them\n" +
+				"line 3: sinks.influx.csv_file: cannot be set under influx, which the influx key sets up\n" +
+				"line 5: sinks.nothing: is not a sink, want one of metrics, csv_file, influx, otel, statsd, webhook, samples_file, heatmap, socket, results_file, history_db, flent_output, report, or a sink of its own setting one of csv_file, influx, otel, statsd, webhook, samples_file, socket, results_file\n" +
+				"line 9: group_sinks.staging[0]: \"staging\" is not a sink set up by the config"},
+		{"ramp", "urls:\n  - url: https://example.com/a\n    ramp: {resolution: -1s, window: -1s}\n  - url: https://example.com/b\n    ramp: {resolution: 5s}\n  - url: https://example.com/c\n    method: latency\n    ramp: {resolution: 1s, window: 2s}\n",
+			"line 3: urls[0].ramp.resolution: must not be negative, got -1s\n" +
+				"line 3: urls[0].ramp.window: must not be negative, got -1s\n" +
+				"line 5: urls[1].ramp.resolution: must be shorter than the window, 5s\n" +
+				"line 8: urls[2].ramp: only applies to downloads and uploads"},
+		{"offset samples", "urls:\n  - url: https://example.com/a\n    offset_samples: 1\n  - url: https://example.com/b\n    sample_size: 1MB\n  - url: https://example.com/c\n    method: upload\n    upload_size: 1MB\n    resume: true\n    offset_samples: 3\n",
+			"line 3: urls[0].offset_samples: needs at least 2 samples, got 1\n" +
+				"line 5: urls[1].sample_size: only applies with offset_samples\n" +
+				"line 10: urls[2].offset_samples: only applies to http(s) downloads\n" +
+				"line 10: urls[2].offset_samples: cannot be used with resume\n" +
+				"line 9: urls[2].resume: only applies to http(s) downloads"},
+		{"size sweep", "urls:\n  - url: https://example.com/a\n    sweep: {sizes: [64KB, 0, 1MB, 64KB]}\n  - url: https://example.com/b\n    method: upload\n    upload_size: 1MB\n    streams: 4\n    sweep: {sizes: []}\n  - url: https://example.com/c\n    resolve_all: true\n    sweep: {sizes: [1MB]}\n",
+			"line 3: urls[0].sweep.sizes[1]: must be positive\n" +
+				"line 3: urls[0].sweep.sizes[3]: 64KB is listed twice\n" +
+				"line 8: urls[1].sweep: only applies to http(s) downloads\n" +
+				"line 8: urls[1].sweep.sizes: needs at least one size\n" +
+				"line 8: urls[1].sweep: cannot be used with streams\n" +
+				"line 11: urls[2].sweep: cannot be used with resolve_all"},
+		{"bidirectional", "urls:\n  - url: https://example.com/a\n    bidirectional: true\n    upload_url: example.com/up\n  - url: ftp://ftp.example.com/b\n    bidirectional: true\n    upload_size: 1MB\n    bufferbloat: true\n",
+			"line 2: urls[0].upload_size: bidirectional needs a positive upload_size\n" +
+				"line 4: urls[0].upload_url: want an absolute http or https URL, got \"example.com/up\"\n" +
+				"line 8: urls[1].bufferbloat: only applies to http(s) downloads and uploads\n" +
+				"line 6: urls[1].bidirectional: only applies to http(s) downloads\n" +
+				"line 6: urls[1].bidirectional: cannot be used with bufferbloat"},
+		{"jitter without a schedule", "schedule_jitter: 90s\npass_jitter: 5s\nurls: [https://example.com/]\n",
+			"line 1: schedule_jitter: needs an interval or cron to offset\n" +
+				"line 2: pass_jitter: needs an interval or cron to offset"},
+		{"jitter past the interval", "interval: 1m\nschedule_jitter: 50s\npass_jitter: 10s\nurls: [https://example.com/]\n",
+			"line 2: schedule_jitter: schedule_jitter and pass_jitter must add up to less than interval 1m0s, got 1m0s"},
+		{"jitter", "cron: \"*/15 * * * *\"\nschedule_jitter: 90s\npass_jitter: -1s\nurls: [https://example.com/]\n",
+			"line 3: pass_jitter: must not be negative, got -1s"},
+		{"units ok", "units: {speed: MBps, size: binary}\nurls: [https://example.com/]\n", ""},
+		{"log format", "log_format: syslog\nurls: [https://example.com/]\n", "line 1: log_format: must be text or journal, got \"syslog\""},
+		{"log level", "log_level: loud\nurls: [https://example.com/]\n", "line 1: log_level: log_level must be debug, info, warn or error, got \"loud\""},
+		// Every problem is reported, not just the first.
+		{"several", "concurrency: -1\nretries: -2\nprotocol: h4\nurls: [https://example.com/]\n",
+			"line 1: concurrency: must not be negative\n" +
+				"line 2: retries: must not be negative\n" +
+				"line 3: protocol: protocol must be h1, h2, h3 or auto, got \"h4\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := problems(t, tt.doc); got != tt.want {
+				t.Errorf("problems\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
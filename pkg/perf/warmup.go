@@ -0,0 +1,52 @@
+package perf
+
+import "time"
+
+// warmup leaves the first part of a transfer out of its reported speed. It
+// is fed the running byte count at every tick and interpolates the count at
+// the moment the window closed.
+type warmup struct {
+	d      time.Duration
+	lastN  int64
+	lastAt time.Time
+	bytes  int64
+	closed bool
+}
+
+func (w *warmup) observe(n int64, start, now time.Time) {
+	if w.d <= 0 || w.closed || start.IsZero() {
+		return
+	}
+	if w.lastAt.IsZero() {
+		w.lastAt = start
+	}
+	end := start.Add(w.d)
+	if now.Before(end) {
+		w.lastN, w.lastAt = n, now
+		return
+	}
+	frac := 1.0
+	if span := now.Sub(w.lastAt); span > 0 {
+		frac = float64(end.Sub(w.lastAt)) / float64(span)
+	}
+	w.bytes = w.lastN + int64(float64(n-w.lastN)*frac)
+	w.closed = true
+}
+
+// apply sets the speed of s from n bytes moved between start and now. Once
+// the window has closed its bytes and time are excluded; until then s is
+// marked Warmup and covers the whole transfer.
+func (w *warmup) apply(s *Stats, n int64, start, now time.Time) {
+	w.observe(n, start, now)
+	switch {
+	case w.d <= 0:
+		s.setSpeed(n, now.Sub(start))
+	case !w.closed:
+		s.setSpeed(n, now.Sub(start))
+		s.Warmup = true
+	default:
+		s.setSpeed(n-w.bytes, now.Sub(start)-w.d)
+		s.SizeBytes, s.Elapsed = n, now.Sub(start)
+		s.WarmupBytes = w.bytes
+	}
+}
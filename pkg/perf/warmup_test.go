@@ -0,0 +1,73 @@
+package perf
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWarmupAccounting(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	type tick struct {
+		ms int
+		n  int64
+	}
+	tests := []struct {
+		name   string
+		warmup time.Duration
+		// ticks are the byte counts of the progress snapshots and the last
+		// that of the final one.
+		ticks       []tick
+		warming     bool
+		warmupBytes int64
+		mbps        float64
+	}{
+		// The count at 2s is interpolated between the ticks either side,
+		// which put 1.5MB in the window and 2MB in the 2s after it.
+		{"excluded", 2 * time.Second, []tick{{1000, 500000}, {3000, 2500000}, {4000, 3500000}}, false, 1500000, 8},
+		{"closed at a tick", time.Second, []tick{{1000, 500000}, {2000, 1500000}}, false, 500000, 8},
+		// Finishing inside the window falls back to the whole transfer.
+		{"inside the window", 5 * time.Second, []tick{{1000, 500000}, {2000, 1500000}}, true, 0, 6},
+		{"no warmup", 0, []tick{{1000, 500000}, {2000, 1500000}}, false, 0, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &warmup{d: tt.warmup}
+			var s Stats
+			for _, tk := range tt.ticks {
+				s = Stats{}
+				w.apply(&s, tk.n, start, at(tk.ms))
+			}
+			last := tt.ticks[len(tt.ticks)-1]
+			if s.Warmup != tt.warming || s.WarmupBytes != tt.warmupBytes || !near(s.SpeedMbps, tt.mbps) {
+				t.Errorf("warmup %v, %d warm-up bytes at %v Mbps, want %v, %d at %v", s.Warmup, s.WarmupBytes, s.SpeedMbps, tt.warming, tt.warmupBytes, tt.mbps)
+			}
+			// Nothing is hidden: the size and time are of the whole transfer.
+			if s.SizeBytes != last.n || s.Elapsed != at(last.ms).Sub(start) {
+				t.Errorf("%d bytes in %v, want %d in %v", s.SizeBytes, s.Elapsed, last.n, at(last.ms).Sub(start))
+			}
+		})
+	}
+}
+
+func TestWarmupProgress(t *testing.T) {
+	srv := payloadServer(t, 16<<10, 20*time.Millisecond)
+	tester := New(Options{Warmup: 150 * time.Millisecond, ProgressInterval: 10 * time.Millisecond})
+	all := collect(tester.Download(context.Background(), srv.URL+"/bytes/300000"))
+	last := all[len(all)-1]
+	if last.Warmup || last.WarmupBytes <= 0 || last.WarmupBytes >= last.SizeBytes {
+		t.Errorf("final warmup %v with %d of %d bytes", last.Warmup, last.WarmupBytes, last.SizeBytes)
+	}
+	// Ticks are marked while the window is open, and not after.
+	open := true
+	for _, s := range all[:len(all)-1] {
+		if s.Warmup && !open {
+			t.Errorf("tick at %v marked warm-up after one that was not", s.Elapsed)
+		}
+		open = s.Warmup
+	}
+	if !all[0].Warmup {
+		t.Error("the first tick is not marked warm-up")
+	}
+}
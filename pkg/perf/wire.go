@@ -0,0 +1,61 @@
+package perf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// Byte counts accepted by the count option. Body counts the response body
+// as read; wire counts everything read off the connection, headers and TLS
+// records included.
+const (
+	CountBody = "body"
+	CountWire = "wire"
+)
+
+func checkCount(count string) error {
+	switch count {
+	case "", CountBody, CountWire:
+		return nil
+	}
+	return fmt.Errorf("count must be body or wire, got %q", count)
+}
+
+type wireKey struct{}
+
+// countWire returns ctx carrying n. Every connection dialed for a request
+// made with it adds the bytes read from it to n. Each wire-counted test gets
+// a transport of its own, so a connection reused or multiplexed within it
+// is only ever shared by that test's requests.
+func countWire(ctx context.Context, n *atomic.Int64) context.Context {
+	return context.WithValue(ctx, wireKey{}, n)
+}
+
+// wireConn counts the bytes read from a connection.
+type wireConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c *wireConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// NetConn returns the wrapped connection, as tls.Conn does.
+func (c *wireConn) NetConn() net.Conn { return c.Conn }
+
+// counted wraps the connections dial returns in a wireConn when the dial's
+// context carries a counter.
+func counted(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if n, ok := ctx.Value(wireKey{}).(*atomic.Int64); ok && err == nil {
+			conn = &wireConn{Conn: conn, n: n}
+		}
+		return conn, err
+	}
+}
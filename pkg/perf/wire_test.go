@@ -0,0 +1,97 @@
+package perf
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWireCount(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		w.Header().Set("Content-Length", strconv.Itoa(n))
+		w.Header().Set("X-Padding", strings.Repeat("p", 500))
+		w.Write(make([]byte, n))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewUnstartedServer(handler)
+	secure.EnableHTTP2 = true
+	secure.StartTLS()
+	defer secure.Close()
+	roots := &tls.Config{RootCAs: secure.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+
+	tests := []struct {
+		name     string
+		url      string
+		protocol string
+		want     string
+	}{
+		{"h1", plain.URL, "", "HTTP/1.1"},
+		{"h1 tls", secure.URL, ProtocolH1, "HTTP/1.1"},
+		{"h2", secure.URL, ProtocolH2, "HTTP/2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tester := New(Options{ProgressInterval: -1, TLSConfig: roots, Count: CountWire})
+			// Two tests of the same url, one after the other and then side
+			// by side, each count only their own bytes.
+			targets := []Target{
+				{URL: tt.url + "/?n=100000", Protocol: tt.protocol},
+				{URL: tt.url + "/?n=100000", Protocol: tt.protocol},
+			}
+			results := 0
+			for _, concurrency := range []int{1, 2} {
+				for s := range tester.Run(context.Background(), targets, concurrency) {
+					if !s.Final() {
+						continue
+					}
+					if s.Error != nil {
+						t.Fatal(s.Error)
+					}
+					if s.Protocol != tt.want {
+						t.Errorf("protocol %s, want %s", s.Protocol, tt.want)
+					}
+					if !s.WireCounted || s.BodyBytes != 100000 || s.SizeBytes != s.WireBytes {
+						t.Errorf("wire counted %v, %d body bytes, size %d of %d on the wire", s.WireCounted, s.BodyBytes, s.SizeBytes, s.WireBytes)
+					}
+					// The headers, framing and TLS records come on top of
+					// the body, but not a second body.
+					if s.WireBytes <= s.BodyBytes+500 || s.WireBytes > s.BodyBytes+20000 {
+						t.Errorf("%d wire bytes for a %d byte body", s.WireBytes, s.BodyBytes)
+					}
+					results++
+				}
+			}
+			if results != 4 {
+				t.Fatalf("%d results, want 4", results)
+			}
+		})
+	}
+
+	// By default the body alone counts.
+	all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: plain.URL + "/?n=100000"}))
+	if s := all[len(all)-1]; s.WireCounted || s.WireBytes != 100000 || s.BodyBytes != 100000 || s.SizeBytes != 100000 {
+		t.Errorf("body count: wire counted %v, %d wire and %d body bytes", s.WireCounted, s.WireBytes, s.BodyBytes)
+	}
+	// The Target overrides the option.
+	all = collect(New(Options{ProgressInterval: -1, Count: CountWire}).Test(context.Background(), Target{URL: plain.URL + "/?n=100000", Count: CountBody}))
+	if s := all[len(all)-1]; s.WireCounted || s.SizeBytes != 100000 {
+		t.Errorf("count: body target counted %d bytes, wire %v", s.SizeBytes, s.WireCounted)
+	}
+}
+
+func TestCheckCount(t *testing.T) {
+	for _, count := range []string{"", CountBody, CountWire} {
+		if err := checkCount(count); err != nil {
+			t.Errorf("checkCount(%q) = %v", count, err)
+		}
+	}
+	if err := checkCount("tcp"); err == nil || err.Error() != `count must be body or wire, got "tcp"` {
+		t.Errorf("checkCount(tcp) = %v", err)
+	}
+}
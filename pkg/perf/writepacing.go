@@ -0,0 +1,199 @@
+package perf
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptrace"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// paceInterval is the width of the intervals an upload's write throughput
+// is measured over, short enough to tell a shaper's bursts apart.
+const paceInterval = 100 * time.Millisecond
+
+// WritePacing describes how an upload went out on its connection, from
+// timing every Write the transport made to it. A shaper that lets uploads
+// through in bursts shows as a high Burstiness and long stalls while the
+// average speed looks steady.
+type WritePacing struct {
+	// Writes counts the Write calls and Blocked is the time spent in them.
+	Writes  int
+	Blocked time.Duration
+	// P50 and P95 are the median and 95th percentile time in one Write,
+	// and LongestStall the longest.
+	P50          time.Duration
+	P95          time.Duration
+	LongestStall time.Duration
+	// MeanMbps, MedianMbps and P95Mbps describe the throughput of the
+	// writes over each paceInterval. Burstiness is P95Mbps over MeanMbps:
+	// near 1 for a steady upload and higher the burstier it is. The mean
+	// rather than the median is taken so an upload idle more often than
+	// not still has one.
+	MeanMbps   float64
+	MedianMbps float64
+	P95Mbps    float64
+	Burstiness float64
+
+	writes    []time.Duration
+	intervals []float64
+}
+
+// MarshalJSON encodes the durations in milliseconds.
+func (w *WritePacing) MarshalJSON() ([]byte, error) {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return json.Marshal(struct {
+		Writes       int     `json:"writes"`
+		Blocked      float64 `json:"blocked_ms"`
+		P50          float64 `json:"write_p50_ms"`
+		P95          float64 `json:"write_p95_ms"`
+		LongestStall float64 `json:"longest_write_stall_ms"`
+		MeanMbps     float64 `json:"mean_interval_mbps"`
+		MedianMbps   float64 `json:"median_interval_mbps"`
+		P95Mbps      float64 `json:"p95_interval_mbps"`
+		Burstiness   float64 `json:"burstiness"`
+	}{w.Writes, ms(w.Blocked), ms(w.P50), ms(w.P95), ms(w.LongestStall), w.MeanMbps, w.MedianMbps, w.P95Mbps, w.Burstiness})
+}
+
+func newWritePacing(writes []time.Duration, intervals []float64) *WritePacing {
+	w := &WritePacing{Writes: len(writes), writes: writes, intervals: intervals}
+	if len(writes) == 0 {
+		return w
+	}
+	sorted := make([]float64, len(writes))
+	for i, d := range writes {
+		sorted[i] = float64(d)
+		w.Blocked += d
+	}
+	slices.Sort(sorted)
+	w.P50 = time.Duration(Percentile(sorted, 50))
+	w.P95 = time.Duration(Percentile(sorted, 95))
+	w.LongestStall = time.Duration(sorted[len(sorted)-1])
+	if len(intervals) > 0 {
+		speeds := slices.Sorted(slices.Values(intervals))
+		w.MeanMbps = mean(speeds)
+		w.MedianMbps = Percentile(speeds, 50)
+		w.P95Mbps = Percentile(speeds, 95)
+		if w.MeanMbps > 0 {
+			w.Burstiness = w.P95Mbps / w.MeanMbps
+		}
+	}
+	return w
+}
+
+// writeTimer times the writes of one upload.
+type writeTimer struct {
+	mu     sync.Mutex
+	start  time.Time
+	writes []time.Duration
+	// bytes are the bytes written in each paceInterval from start.
+	bytes []int64
+	conn  *timedConn
+}
+
+// wrote records a Write of n bytes that began at start and took took. Its
+// bytes count in the interval it returned in.
+func (p *writeTimer) wrote(n int, start time.Time, took time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.start.IsZero() {
+		p.start = start
+	}
+	p.writes = append(p.writes, took)
+	i := int(start.Add(took).Sub(p.start) / paceInterval)
+	for len(p.bytes) <= i {
+		p.bytes = append(p.bytes, 0)
+	}
+	p.bytes[i] += int64(n)
+}
+
+// context returns ctx with a trace that has the connection a request made
+// with it gets time its writes for p, until detach.
+func (p *writeTimer) context(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn := info.Conn
+			for {
+				if c, ok := conn.(*timedConn); ok {
+					c.timer.Store(p)
+					p.mu.Lock()
+					p.conn = c
+					p.mu.Unlock()
+					return
+				}
+				wrapped, ok := conn.(interface{ NetConn() net.Conn })
+				if !ok {
+					return
+				}
+				conn = wrapped.NetConn()
+			}
+		},
+	})
+}
+
+// detach stops timing writes, so a kept connection does not time those of
+// a later request.
+func (p *writeTimer) detach() {
+	p.mu.Lock()
+	conn := p.conn
+	p.mu.Unlock()
+	if conn != nil {
+		conn.timer.CompareAndSwap(p, nil)
+	}
+}
+
+// pacing returns what the writes so far describe, or nil when none were
+// timed, as over HTTP/3.
+func (p *writeTimer) pacing() *WritePacing {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.writes) == 0 {
+		return nil
+	}
+	// The last interval is cut short by the end of the upload, so it only
+	// counts when it is the only one.
+	bytes := p.bytes
+	if len(bytes) > 1 {
+		bytes = bytes[:len(bytes)-1]
+	}
+	intervals := make([]float64, len(bytes))
+	for i, n := range bytes {
+		intervals[i] = float64(n) * 8 / 1e6 / paceInterval.Seconds()
+	}
+	return newWritePacing(slices.Clone(p.writes), intervals)
+}
+
+// timedConn times its writes for the writeTimer of the upload using it, if
+// any.
+type timedConn struct {
+	net.Conn
+	timer atomic.Pointer[writeTimer]
+}
+
+func (c *timedConn) Write(b []byte) (int, error) {
+	p := c.timer.Load()
+	if p == nil {
+		return c.Conn.Write(b)
+	}
+	start := time.Now()
+	n, err := c.Conn.Write(b)
+	p.wrote(n, start, time.Since(start))
+	return n, err
+}
+
+// NetConn returns the wrapped connection, as tls.Conn does.
+func (c *timedConn) NetConn() net.Conn { return c.Conn }
+
+// timedWrites wraps the connections dial returns in a timedConn.
+func timedWrites(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err == nil {
+			conn = &timedConn{Conn: conn}
+		}
+		return conn, err
+	}
+}
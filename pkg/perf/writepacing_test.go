@@ -0,0 +1,141 @@
+package perf
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// smallWindow shrinks the receive buffer of the connections it accepts, so
+// a client's writes block on how fast the server reads rather than filling
+// the socket buffers.
+type smallWindow struct{ net.Listener }
+
+func (l smallWindow) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetReadBuffer(64 << 10)
+	}
+	return conn, err
+}
+
+// burstServer reads what is posted to it burst bytes at a time as fast as
+// it can, resting for rest between bursts.
+func burstServer(t *testing.T, burst int64, rest time.Duration) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for {
+			if _, err := io.CopyN(io.Discard, r.Body, burst); err != nil {
+				return
+			}
+			time.Sleep(rest)
+		}
+	}))
+	srv.Listener = smallWindow{srv.Listener}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestUploadWritePacing(t *testing.T) {
+	upload := func(srv *httptest.Server, target Target) Stats {
+		t.Helper()
+		target.URL, target.Method, target.UploadSize = srv.URL, MethodUpload, 4e6
+		all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), target))
+		last := all[len(all)-1]
+		if last.Error != nil || last.WritePacing == nil {
+			t.Fatalf("upload %v with pacing %+v", last.Error, last.WritePacing)
+		}
+		return last
+	}
+	bursty := upload(burstServer(t, 512<<10, 200*time.Millisecond), Target{}).WritePacing
+	steady := upload(burstServer(t, 1<<30, 0), Target{RateLimit: 20e6}).WritePacing
+	// Writes the server leaves waiting show as a long stall and intervals
+	// far apart, where a steady upload of the same size has neither.
+	if bursty.LongestStall < 150*time.Millisecond || bursty.Burstiness < 2 || bursty.MedianMbps >= bursty.MeanMbps {
+		t.Errorf("bursty upload: longest stall %v, burstiness %.2f, median %.2f mean %.2f Mbps", bursty.LongestStall, bursty.Burstiness, bursty.MedianMbps, bursty.MeanMbps)
+	}
+	if steady.LongestStall > 50*time.Millisecond || steady.Burstiness > 1.6 || steady.MeanMbps < 15 || steady.MeanMbps > 25 {
+		t.Errorf("steady upload: longest stall %v, burstiness %.2f at %.2f Mbps", steady.LongestStall, steady.Burstiness, steady.MeanMbps)
+	}
+	for _, p := range []*WritePacing{bursty, steady} {
+		if p.Writes < 2 || p.Blocked < p.LongestStall || p.P50 > p.P95 || p.P95 > p.LongestStall {
+			t.Errorf("%d writes blocked %v, p50 %v p95 %v longest %v", p.Writes, p.Blocked, p.P50, p.P95, p.LongestStall)
+		}
+	}
+
+	// The summary takes the writes of every upload together.
+	c := NewCollector()
+	srv := burstServer(t, 1<<30, 0)
+	first, second := upload(srv, Target{}), upload(srv, Target{})
+	c.Add(first)
+	c.Add(second)
+	if got := c.Summaries()[0].WritePacing; got == nil || got.Writes != first.WritePacing.Writes+second.WritePacing.Writes {
+		t.Errorf("summary pacing %+v of %d and %d writes", got, first.WritePacing.Writes, second.WritePacing.Writes)
+	}
+
+	// A download writes no body, and its writes are not timed.
+	all := collect(New(Options{ProgressInterval: -1}).Test(context.Background(), Target{URL: payloadServer(t, 1000, 0).URL + "/bytes/1000"}))
+	if last := all[len(all)-1]; last.Error != nil || last.WritePacing != nil {
+		t.Errorf("download with pacing %+v (%v)", last.WritePacing, last.Error)
+	}
+}
+
+func TestNewWritePacing(t *testing.T) {
+	ms := func(n ...int) []time.Duration {
+		var ds []time.Duration
+		for _, i := range n {
+			ds = append(ds, time.Duration(i)*time.Millisecond)
+		}
+		return ds
+	}
+	p := newWritePacing(ms(1, 1, 1, 1, 1, 1, 1, 1, 1, 400), []float64{0, 0, 80, 0, 0, 80, 0, 0, 80, 0})
+	if p.Writes != 10 || p.Blocked != 409*time.Millisecond || p.P50 != time.Millisecond || p.LongestStall != 400*time.Millisecond {
+		t.Errorf("writes %d blocked %v p50 %v longest %v", p.Writes, p.Blocked, p.P50, p.LongestStall)
+	}
+	if !near(p.MeanMbps, 24) || p.MedianMbps != 0 || !near(p.P95Mbps, 80) || !near(p.Burstiness, 80.0/24) {
+		t.Errorf("mean %.2f median %.2f p95 %.2f burstiness %.2f", p.MeanMbps, p.MedianMbps, p.P95Mbps, p.Burstiness)
+	}
+	if p := newWritePacing(ms(2, 2), []float64{40, 40, 40}); !near(p.Burstiness, 1) || p.P95 != 2*time.Millisecond {
+		t.Errorf("steady burstiness %.2f, p95 %v", p.Burstiness, p.P95)
+	}
+	// Intervals with nothing written have no burstiness to speak of.
+	if p := newWritePacing(ms(5), []float64{0}); p.Burstiness != 0 || p.LongestStall != 5*time.Millisecond {
+		t.Errorf("idle burstiness %.2f, longest %v", p.Burstiness, p.LongestStall)
+	}
+	if p := newWritePacing(nil, nil); p.Writes != 0 || p.LongestStall != 0 || p.MeanMbps != 0 {
+		t.Errorf("no writes %+v", p)
+	}
+}
+
+func TestWriteTimer(t *testing.T) {
+	var w writeTimer
+	if w.pacing() != nil {
+		t.Error("pacing before any write")
+	}
+	start := time.Now()
+	// 125000 bytes in the first 100ms is 10 Mbps; writes count in the
+	// interval they return in.
+	w.wrote(100000, start, time.Millisecond)
+	w.wrote(25000, start.Add(50*time.Millisecond), 10*time.Millisecond)
+	w.wrote(250000, start.Add(90*time.Millisecond), 20*time.Millisecond)
+	w.wrote(1000, start.Add(250*time.Millisecond), time.Millisecond)
+	p := w.pacing()
+	// The cut-short last interval is left out.
+	if p.Writes != 4 || len(p.intervals) != 2 || !near(p.intervals[0], 10) || !near(p.intervals[1], 20) {
+		t.Errorf("%d writes over intervals %v Mbps", p.Writes, p.intervals)
+	}
+	if p.LongestStall != 20*time.Millisecond || p.Blocked != 32*time.Millisecond {
+		t.Errorf("longest %v blocked %v", p.LongestStall, p.Blocked)
+	}
+
+	// An upload within one interval keeps it.
+	var short writeTimer
+	short.wrote(12500, start, time.Millisecond)
+	if p := short.pacing(); len(p.intervals) != 1 || !near(p.intervals[0], 1) {
+		t.Errorf("short upload intervals %v", p.intervals)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// quickURLsEnv replaces the built-in quick URLs with its own, separated by
+// commas or spaces.
+const quickURLsEnv = "YAPERF_QUICK_URLS"
+
+// quickPrefix starts the name of every quick target, so its results are
+// not mistaken for those of configured ones.
+const quickPrefix = "quick:"
+
+// quickURLs are well-known public test files, each at least 100MB.
+var quickURLs = []string{
+	"https://speed.cloudflare.com/__down?bytes=100000000",
+	"https://proof.ovh.net/files/100Mb.dat",
+	"http://speedtest.tele2.net/100MB.zip",
+}
+
+// quickConfig is the config of -quick: one pass over the quick URLs, each
+// stopped after 10s or 100MB.
+func quickConfig() perf.Config {
+	urls := quickURLs
+	if env := strings.FieldsFunc(os.Getenv(quickURLsEnv), func(r rune) bool { return r == ',' || r == ' ' }); len(env) > 0 {
+		urls = env
+	}
+	once := 1
+	config := perf.Config{Iterations: &once, Limits: perf.Limits{MaxBytes: 100e6, MaxDuration: 10 * time.Second}}
+	for _, raw := range urls {
+		name := raw
+		if u, err := url.Parse(raw); err == nil && u.Host != "" {
+			name = u.Hostname()
+		}
+		config.URLs = append(config.URLs, perf.Target{URL: raw, Name: quickPrefix + name})
+	}
+	return config
+}
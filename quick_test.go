@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQuickConfig(t *testing.T) {
+	t.Setenv(quickURLsEnv, "")
+	config := quickConfig()
+	if len(config.URLs) != len(quickURLs) || config.URLs[0].URL != quickURLs[0] || config.URLs[0].Name != "quick:speed.cloudflare.com" {
+		t.Errorf("built-in urls %+v", config.URLs)
+	}
+	if config.Iterations == nil || *config.Iterations != 1 || config.Limits.MaxBytes != 100e6 || config.Limits.MaxDuration != 10*time.Second {
+		t.Errorf("defaults: iterations %v, limits %+v", config.Iterations, config.Limits)
+	}
+	if problems := config.Problems(); len(problems) > 0 {
+		t.Errorf("quick config does not validate: %v", problems.Err())
+	}
+
+	// The variable replaces the list, keeping the labels.
+	t.Setenv(quickURLsEnv, "https://mirror.example/100MB.bin, http://10.0.0.2:8080/f  file:///tmp/big")
+	config = quickConfig()
+	var names []string
+	for _, u := range config.URLs {
+		names = append(names, u.Name)
+	}
+	if got := strings.Join(names, " "); got != "quick:mirror.example quick:10.0.0.2 quick:file:///tmp/big" {
+		t.Errorf("names %s", got)
+	}
+}
+
+func TestQuickMode(t *testing.T) {
+	// An endless body shows the 100MB cap taking over.
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		chunk := make([]byte, 1<<20)
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	quick := func(dir string, args ...string) (int, string, string) {
+		t.Helper()
+		var stdout, stderr strings.Builder
+		cmd := yaperf(dir, args...)
+		cmd.Env = append(cmd.Env, quickURLsEnv+"="+srv.URL+"/a,"+srv.URL+"/b")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		return exitCode(t, cmd, time.Minute), stdout.String(), stderr.String()
+	}
+
+	dir := t.TempDir()
+	for _, args := range [][]string{{"-quick"}, nil} {
+		requests.Store(0)
+		code, stdout, stderr := quick(dir, args...)
+		if code != 0 {
+			t.Fatalf("%v: exit code %d\n%s", args, code, stderr)
+		}
+		// One pass, labelled as quick, each capped and summed up.
+		if n := requests.Load(); n != 2 {
+			t.Errorf("%v: %d requests, want one per url", args, n)
+		}
+		for _, want := range []string{"✓ quick:127.0.0.1", "  Size:     100.00 MB\n", "Summary (Mbps)"} {
+			if !strings.Contains(stdout, want) {
+				t.Errorf("%v: no %q in\n%s", args, want, stdout)
+			}
+		}
+		if !strings.Contains(stderr, `msg="quick mode, testing built-in urls"`) {
+			t.Errorf("%v: stderr\n%s", args, stderr)
+		}
+		// Without -quick it is the missing config that calls for one.
+		if noticed := strings.Contains(stderr, "no urls.yaml found, running a quick test"); noticed != (args == nil) {
+			t.Errorf("%v: stderr\n%s", args, stderr)
+		}
+	}
+
+	// A config there is used as ever.
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer other.Close()
+	if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte("urls:\n  - "+other.URL+"/c\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	requests.Store(0)
+	if code, stdout, _ := quick(dir); code != 0 || strings.Contains(stdout, "quick:") || requests.Load() != 0 {
+		t.Errorf("with a config: exit code %d\n%s", code, stdout)
+	}
+	// A missing config named on purpose is an error, not a quick test.
+	if code, _, stderr := quick(dir, "-config", "missing.yaml"); code == 0 || requests.Load() != 0 {
+		t.Errorf("missing -config: exit code %d\n%s", code, stderr)
+	}
+	if code, _, stderr := quick(dir, "-quick", other.URL+"/c"); code == 0 || !strings.Contains(stderr, "-quick tests built-in urls and cannot be used with urls given as arguments") {
+		t.Errorf("-quick with urls: exit code %d\n%s", code, stderr)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+
+	"yaperf/pkg/perf"
+)
+
+// fixedSettings are the config keys set up once at startup: the listeners,
+// sinks and output. A reload that changes them warns and keeps the values
+// in use.
+var fixedSettings = []string{
+	"output", "reporters", "outputs", "emit_progress", "template", "trend", "log_level", "log_format", "labels", "run_deadline", "iterations",
+	"metrics_listen", "serve", "serve_origins", "csv_file", "influx", "otel", "webhook", "outbox", "statsd", "history_db", "samples_file", "flent_output", "heatmap",
+	"socket", "rollup", "data_budget", "experiment", "results_file", "rotate_size", "rotate_keep", "alert_threshold", "alert_window", "alert_clear_after",
+	"manifest", "sinks", "probe_failures_threshold", "units", "latency_grading", "cold_start", "warm",
+}
+
+// reloadConfig rereads and validates the config at path for the passes
+// after a SIGHUP. labels are the -label overrides, profiles the -profile
+// flags and args the URLs given on the command line, applied as at
+// startup. On error current stays in use.
+func reloadConfig(path string, args []string, labels labelFlags, profiles profileFlags, current perf.Config) (perf.Config, error) {
+	next, doc, err := loadConfig(path, args)
+	if err != nil {
+		return current, err
+	}
+	applyLabels(&next, labels)
+	if problems := next.Problems(); len(problems) > 0 {
+		problems.Locate(doc)
+		return current, problems.Err()
+	}
+	if err := useProfiles(&next, profiles); err != nil {
+		return current, err
+	}
+	if err := checkTableSort(next.TableSort); err != nil {
+		return current, fmt.Errorf("table_sort: %w", err)
+	}
+	keepFixed(current, &next)
+	if len(args) == 0 {
+		if err := useSpeedtest(context.Background(), &next); err != nil {
+			return current, err
+		}
+	}
+	return next, nil
+}
+
+// keepFixed copies the fixedSettings of current into next, warning about
+// each one the reloaded config tried to change.
+func keepFixed(current perf.Config, next *perf.Config) {
+	cur, nxt := reflect.ValueOf(current), reflect.ValueOf(next).Elem()
+	for i := range cur.NumField() {
+		key := cur.Type().Field(i).Tag.Get("yaml")
+		if !slices.Contains(fixedSettings, key) {
+			continue
+		}
+		if !reflect.DeepEqual(cur.Field(i).Interface(), nxt.Field(i).Interface()) {
+			slog.Warn("setting cannot change while running, ignoring the new value", "setting", key)
+		}
+		nxt.Field(i).Set(cur.Field(i))
+	}
+}
+
+// applyLabels merges the -label overrides into config.
+func applyLabels(config *perf.Config, labels labelFlags) {
+	if len(labels) > 0 && config.Labels == nil {
+		config.Labels = map[string]string{}
+	}
+	for k, v := range labels {
+		config.Labels[k] = v
+	}
+}
+
+// useProfiles narrows config to the urls of the -profile flags and labels
+// its results with them, unless a profile label is set already.
+func useProfiles(config *perf.Config, profiles profileFlags) error {
+	if len(profiles) == 0 {
+		return nil
+	}
+	next, err := config.UseProfiles(profiles)
+	if err != nil {
+		return fmt.Errorf("-profile: %w", err)
+	}
+	*config = next
+	if _, ok := config.Labels["profile"]; !ok {
+		applyLabels(config, labelFlags{"profile": strings.Join(profiles, ",")})
+	}
+	return nil
+}
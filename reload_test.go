@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// captureLog sends what slog logs to the returned buffer until the test
+// ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+	return &buf
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.yaml")
+	write := func(doc string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("metrics_listen: 127.0.0.1:9100\nconcurrency: 1\nlabels:\n  site: nyc\nprofiles:\n  quick:\n    urls: [a]\nurls:\n  - url: https://example.com/a\n    name: a\n")
+	current, _, err := loadConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := captureLog(t)
+
+	// A new url and setting apply; the listen address and labels set up
+	// at startup stay, with a warning.
+	write("metrics_listen: 127.0.0.1:9200\nconcurrency: 4\nlabels:\n  site: lab\nurls:\n  - url: https://example.com/a\n    name: a\n  - https://example.com/b\n")
+	next, err := reloadConfig(path, nil, labelFlags{"rack": "7"}, nil, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next.URLs) != 2 || next.URLs[1].URL != "https://example.com/b" || next.Concurrency != 4 {
+		t.Errorf("reloaded %d urls, concurrency %d", len(next.URLs), next.Concurrency)
+	}
+	if next.MetricsListen != "127.0.0.1:9100" || next.Labels["site"] != "nyc" || next.Labels["rack"] != "" {
+		t.Errorf("fixed settings changed: metrics_listen %s, labels %v", next.MetricsListen, next.Labels)
+	}
+	for _, want := range []string{
+		"level=WARN msg=\"setting cannot change while running, ignoring the new value\" setting=labels",
+		"level=WARN msg=\"setting cannot change while running, ignoring the new value\" setting=metrics_listen",
+	} {
+		if !strings.Contains(log.String(), want) {
+			t.Errorf("log lacks %q:\n%s", want, log.String())
+		}
+	}
+	if strings.Contains(log.String(), "setting=concurrency") {
+		t.Errorf("warned about a setting that can change:\n%s", log.String())
+	}
+
+	// Configs that fail to parse or validate keep the current one.
+	for _, bad := range []struct{ doc, err string }{
+		{"urls: [", "yaml"},
+		{"urls:\n  - url: https://example.com/a\n    max_duration: -1s\n", "max_duration"},
+		{"table_sort: colour\nurls:\n  - https://example.com/a\n", "table_sort"},
+	} {
+		write(bad.doc)
+		got, err := reloadConfig(path, nil, nil, nil, next)
+		if err == nil || !strings.Contains(err.Error(), bad.err) {
+			t.Errorf("%q: err %v, want one about %s", bad.doc, err, bad.err)
+		}
+		if len(got.URLs) != 2 || got.Concurrency != 4 {
+			t.Errorf("%q: config replaced by %d urls", bad.doc, len(got.URLs))
+		}
+	}
+	os.Remove(path)
+	if _, err := reloadConfig(path, nil, nil, nil, next); !os.IsNotExist(err) {
+		t.Errorf("missing config: %v", err)
+	}
+
+	// Profiles apply again to the reloaded urls.
+	write("profiles:\n  quick:\n    urls: [b]\nurls:\n  - url: https://example.com/a\n    name: a\n  - url: https://example.com/b\n    name: b\n")
+	got, err := reloadConfig(path, nil, nil, profileFlags{"quick"}, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.URLs) != 1 || got.URLs[0].Name != "b" {
+		t.Errorf("profile quick picked %+v", got.URLs)
+	}
+	if _, err := reloadConfig(path, nil, nil, profileFlags{"nightly"}, next); err == nil || !strings.HasPrefix(err.Error(), "-profile: ") {
+		t.Errorf("unknown profile: %v", err)
+	}
+}
+
+func TestKeepFixed(t *testing.T) {
+	// Every fixed setting names a config key.
+	keys := map[string]bool{}
+	config := reflect.TypeFor[perf.Config]()
+	for i := range config.NumField() {
+		keys[config.Field(i).Tag.Get("yaml")] = true
+	}
+	for _, key := range fixedSettings {
+		if !keys[key] {
+			t.Errorf("fixed setting %q is not a config key", key)
+		}
+	}
+	current := perf.Config{Output: "json", RunDeadline: time.Minute, Concurrency: 2}
+	next := perf.Config{Output: "text", Concurrency: 3}
+	keepFixed(current, &next)
+	if next.Output != "json" || next.RunDeadline != time.Minute || next.Concurrency != 3 {
+		t.Errorf("kept %+v", next)
+	}
+}
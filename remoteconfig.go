@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// isRemote reports whether a config path is an http(s) URL.
+func isRemote(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// configSource fetches the configs readConfig is given as URLs. The flags
+// in run set its header, timeout and cache directory.
+var configSource = &remoteSource{timeout: 10 * time.Second, etags: map[string]string{}}
+
+// remoteSource fetches configs over HTTP(S) and keeps the last good copy of
+// each on disk, so a probe keeps working while the config server is down.
+// Refetches send the ETag of the cached copy and reuse it on a 304.
+type remoteSource struct {
+	header   string
+	timeout  time.Duration
+	cacheDir string
+
+	mu    sync.Mutex
+	etags map[string]string
+}
+
+// read returns the config at rawURL, or its cached copy when the server
+// cannot be reached or fails.
+func (s *remoteSource) read(rawURL string) ([]byte, error) {
+	raw, err := s.fetch(rawURL)
+	if err == nil {
+		return raw, nil
+	}
+	cache := s.cachePath(rawURL)
+	if cache == "" {
+		return nil, err
+	}
+	cached, cacheErr := os.ReadFile(cache)
+	if cacheErr != nil {
+		return nil, err
+	}
+	slog.Warn("config server unavailable, running on cached config", "url", rawURL, "cache", cache, "err", err)
+	return cached, nil
+}
+
+func (s *remoteSource) fetch(rawURL string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.header != "" {
+		name, value, _ := strings.Cut(s.header, ":")
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	cache := s.cachePath(rawURL)
+	s.mu.Lock()
+	etag := s.etags[rawURL]
+	s.mu.Unlock()
+	if etag != "" && cache != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := (&http.Client{Timeout: s.timeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if raw, err := os.ReadFile(cache); err == nil {
+			slog.Debug("config not modified", "url", rawURL)
+			return raw, nil
+		}
+		// The cached copy is gone; ask again without the ETag.
+		s.mu.Lock()
+		delete(s.etags, rawURL)
+		s.mu.Unlock()
+		return s.fetch(rawURL)
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("fetching config %s: %s", rawURL, resp.Status)
+	}
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetching config %s: %w", rawURL, err)
+	}
+	if cache != "" {
+		if err := writeCache(cache, raw); err != nil {
+			slog.Warn("caching config", "url", rawURL, "err", err)
+		} else {
+			s.mu.Lock()
+			s.etags[rawURL] = resp.Header.Get("ETag")
+			s.mu.Unlock()
+		}
+	}
+	return raw, nil
+}
+
+// refreshURLs rereads the remote config at path between passes and returns
+// its urls, those of profiles if any, or current when it cannot be read or
+// no longer validates. Other settings keep the values they had at startup.
+func refreshURLs(path string, profiles profileFlags, current []perf.Target) []perf.Target {
+	fresh, doc, err := loadConfig(path, nil)
+	if err == nil {
+		if problems := fresh.Problems(); len(problems) > 0 {
+			problems.Locate(doc)
+			err = problems.Err()
+		}
+	}
+	if err == nil {
+		err = useProfiles(&fresh, profiles)
+	}
+	if err != nil {
+		slog.Warn("refreshing config, keeping the current urls", "url", path, "err", err)
+		return current
+	}
+	if !reflect.DeepEqual(fresh.URLs, current) {
+		slog.Info("urls updated from config", "url", path, "urls", len(fresh.URLs))
+	}
+	return fresh.URLs
+}
+
+// cachePath names the cached copy of rawURL, or returns "" when there is
+// no cache directory.
+func (s *remoteSource) cachePath(rawURL string) string {
+	if s.cacheDir == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(rawURL))
+	return filepath.Join(s.cacheDir, hex.EncodeToString(sum[:8])+".yaml")
+}
+
+// writeCache replaces path with raw through a temporary file, so a crash
+// never leaves half a config behind.
+func writeCache(path string, raw []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".config-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// defaultCacheDir is where remote configs are cached unless
+// -config-cache says otherwise.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "yaperf")
+}
+
+// resolveInclude resolves an include named by the config at path against
+// it, so remote configs can include files next to them on the server.
+func resolveInclude(path, inc string) string {
+	if isRemote(path) {
+		base, err := url.Parse(path)
+		ref, refErr := url.Parse(inc)
+		if err == nil && refErr == nil {
+			return base.ResolveReference(ref).String()
+		}
+		return inc
+	}
+	if path != "-" && !filepath.IsAbs(inc) && !isRemote(inc) {
+		return filepath.Join(filepath.Dir(path), inc)
+	}
+	return inc
+}
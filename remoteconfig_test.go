@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// configServer serves a config with an ETag, answering a matching
+// If-None-Match with 304, or fails every request while down.
+type configServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	body     string
+	down     bool
+	requests []http.Header
+}
+
+func newConfigServer(t *testing.T, body string) *configServer {
+	s := &configServer{body: body}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, r.Header.Clone())
+		if s.down {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(s.body)))
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, s.body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *configServer) set(body string, down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body, s.down = body, down
+}
+
+// last returns the headers of the latest request.
+func (s *configServer) last() http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+func TestRemoteSource(t *testing.T) {
+	srv := newConfigServer(t, "urls:\n  - https://example.com/a\n")
+	src := &remoteSource{header: "Authorization: Bearer k", timeout: 5 * time.Second, cacheDir: t.TempDir(), etags: map[string]string{}}
+	url := srv.URL + "/probe.yaml"
+	read := func(want string) {
+		t.Helper()
+		raw, err := src.read(url)
+		if err != nil || string(raw) != want {
+			t.Fatalf("read %q, %v; want %q", raw, err, want)
+		}
+	}
+
+	read("urls:\n  - https://example.com/a\n")
+	if h := srv.last(); h.Get("Authorization") != "Bearer k" || h.Get("If-None-Match") != "" {
+		t.Errorf("first fetch sent %v", h)
+	}
+	if cached, err := os.ReadFile(src.cachePath(url)); err != nil || string(cached) != "urls:\n  - https://example.com/a\n" {
+		t.Errorf("cache holds %q, %v", cached, err)
+	}
+
+	// A refresh asks for changes only, and reuses the cache on a 304.
+	read("urls:\n  - https://example.com/a\n")
+	if h := srv.last(); h.Get("If-None-Match") == "" {
+		t.Error("refresh sent no If-None-Match")
+	}
+	srv.set("urls:\n  - https://example.com/b\n", false)
+	read("urls:\n  - https://example.com/b\n")
+
+	// With the server down the last good copy stands in.
+	srv.set("", true)
+	read("urls:\n  - https://example.com/b\n")
+
+	// A 304 for a cache that has gone missing is asked again in full.
+	srv.set("urls:\n  - https://example.com/b\n", false)
+	os.Remove(src.cachePath(url))
+	read("urls:\n  - https://example.com/b\n")
+	if h := srv.last(); h.Get("If-None-Match") != "" {
+		t.Errorf("refetch after a lost cache sent If-None-Match %q", h.Get("If-None-Match"))
+	}
+
+	// Without a cache a failure is an error, and no ETag is sent.
+	bare := &remoteSource{timeout: 5 * time.Second, etags: map[string]string{}}
+	if _, err := bare.read(url); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bare.read(url); err != nil || srv.last().Get("If-None-Match") != "" {
+		t.Errorf("uncached refresh: %v, If-None-Match %q", err, srv.last().Get("If-None-Match"))
+	}
+	srv.set("", true)
+	if _, err := bare.read(url); err == nil || err.Error() != "fetching config "+url+": 503 Service Unavailable" {
+		t.Errorf("server down without a cache: %v", err)
+	}
+}
+
+func TestRemoteSourceTimeout(t *testing.T) {
+	srv, _ := hangingServer(t, 0)
+	src := &remoteSource{timeout: 100 * time.Millisecond, etags: map[string]string{}}
+	start := time.Now()
+	if _, err := src.read(srv.URL); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("read of a hanging server: %v after %v", err, time.Since(start))
+	}
+}
+
+func TestRefreshURLs(t *testing.T) {
+	srv := newConfigServer(t, "urls:\n  - https://example.com/a\n")
+	saved := configSource
+	configSource = &remoteSource{timeout: 5 * time.Second, cacheDir: t.TempDir(), etags: map[string]string{}}
+	defer func() { configSource = saved }()
+
+	current := []perf.Target{{URL: "https://example.com/old"}}
+	urls := refreshURLs(srv.URL, nil, current)
+	if len(urls) != 1 || urls[0].URL != "https://example.com/a" {
+		t.Fatalf("refreshed to %+v", urls)
+	}
+	srv.set("urls:\n  - https://example.com/b\n  - https://example.com/c\n", false)
+	if urls = refreshURLs(srv.URL, nil, urls); len(urls) != 2 || urls[1].URL != "https://example.com/c" {
+		t.Errorf("refreshed to %+v", urls)
+	}
+	// A list that no longer validates keeps the current one.
+	srv.set("urls:\n  - url: https://example.com/d\n    max_duration: -1s\n", false)
+	if again := refreshURLs(srv.URL, nil, urls); len(again) != 2 || again[0].URL != "https://example.com/b" {
+		t.Errorf("invalid config refreshed to %+v", again)
+	}
+	// The -profile flags pick from the refreshed urls, and a profile the
+	// refreshed config lacks keeps the current ones.
+	srv.set("profiles:\n  quick:\n    urls: [d]\nurls:\n  - https://example.com/c\n  - url: https://example.com/d\n    name: d\n", false)
+	if again := refreshURLs(srv.URL, profileFlags{"quick"}, urls); len(again) != 1 || again[0].URL != "https://example.com/d" {
+		t.Errorf("profile quick refreshed to %+v", again)
+	}
+	if again := refreshURLs(srv.URL, profileFlags{"nightly"}, urls); len(again) != 2 || again[0].URL != "https://example.com/b" {
+		t.Errorf("unknown profile refreshed to %+v", again)
+	}
+}
+
+func TestResolveInclude(t *testing.T) {
+	tests := []struct{ path, inc, want string }{
+		{"https://config.example/fleet/probe.yaml", "common.yaml", "https://config.example/fleet/common.yaml"},
+		{"https://config.example/fleet/probe.yaml", "/shared/base.yaml", "https://config.example/shared/base.yaml"},
+		{"https://config.example/fleet/probe.yaml", "https://other.example/x.yaml", "https://other.example/x.yaml"},
+		{"conf/probe.yaml", "common.yaml", filepath.Join("conf", "common.yaml")},
+		{"conf/probe.yaml", "https://config.example/x.yaml", "https://config.example/x.yaml"},
+		{"-", "common.yaml", "common.yaml"},
+	}
+	for _, tt := range tests {
+		if got := resolveInclude(tt.path, tt.inc); got != tt.want {
+			t.Errorf("resolveInclude(%q, %q) = %q, want %q", tt.path, tt.inc, got, tt.want)
+		}
+	}
+}
+
+func TestRemoteConfigFallback(t *testing.T) {
+	data := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer data.Close()
+	srv := newConfigServer(t, "urls:\n  - "+data.URL+"/a\n")
+	dir, cache := t.TempDir(), t.TempDir()
+	for _, down := range []bool{false, true} {
+		srv.set("urls:\n  - "+data.URL+"/a\n", down)
+		var stdout, stderr strings.Builder
+		cmd := yaperf(dir, "-config", srv.URL+"/probe.yaml", "-config-cache", cache, "-config-header", "X-Probe:edge-1")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if code := exitCode(t, cmd, time.Minute); code != 0 {
+			t.Fatalf("server down %v: exit code %d\n%s", down, code, stderr.String())
+		}
+		if !strings.Contains(stdout.String(), "✓ "+data.URL+"/a") {
+			t.Errorf("server down %v: stdout\n%s", down, stdout.String())
+		}
+		if cached := strings.Contains(stderr.String(), "running on cached config"); cached != down {
+			t.Errorf("server down %v: stderr\n%s", down, stderr.String())
+		}
+		if got := srv.last().Get("X-Probe"); got != "edge-1" {
+			t.Errorf("header X-Probe %q", got)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func TestReplay(t *testing.T) {
+	fixture, err := filepath.Abs(filepath.Join("testdata", "replay.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replayed twice, the recorded passes give the same summary.
+	var outputs []string
+	for range 2 {
+		var stdout, stderr strings.Builder
+		cmd := yaperf(t.TempDir(), "replay", "-q", fixture)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		// The refused connection fails the run, as it did when recorded.
+		if code := exitCode(t, cmd, time.Minute); code != 1 {
+			t.Fatalf("exit code %d\n%s", code, stderr.String())
+		}
+		outputs = append(outputs, stdout.String())
+	}
+	if outputs[0] != outputs[1] {
+		t.Errorf("replays differ:\n%s\n%s", outputs[0], outputs[1])
+	}
+	golden(t, "replay.golden.txt", []byte(outputs[0]))
+
+	// The config applies as in a live run: thresholds grade the replayed
+	// results.
+	dir := t.TempDir()
+	config := "urls:\n  - url: https://mirror.example.com/100MB.bin\n    name: mirror\n    min_speed_mbps: 90\n"
+	if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout strings.Builder
+	cmd := yaperf(dir, "replay", "-q", fixture)
+	cmd.Stdout = &stdout
+	if code := exitCode(t, cmd, time.Minute); code == 0 || !strings.Contains(stdout.String(), "mirror") {
+		t.Errorf("replay under a threshold: exit code %d\n%s", code, stdout.String())
+	}
+
+	for _, tt := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"replay", "-quick", fixture}, "-quick tests built-in urls and cannot be used with replay"},
+		{[]string{"replay", filepath.Join(dir, "missing.ndjson")}, "replay: open "},
+	} {
+		var stderr strings.Builder
+		cmd := yaperf(dir, tt.args...)
+		cmd.Stderr = &stderr
+		if code := exitCode(t, cmd, time.Minute); code == 0 || !strings.Contains(stderr.String(), tt.err) {
+			t.Errorf("%v: exit code %d\n%s", tt.args, code, stderr.String())
+		}
+	}
+}
+
+func TestOpenReplay(t *testing.T) {
+	r, err := openReplay([]string{filepath.Join("testdata", "replay.ndjson")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A pass ends before a url's second result.
+	if len(r.passes) != 2 || len(r.passes[0]) != 3 || len(r.passes[1]) != 3 {
+		t.Fatalf("passes %v", r.passes)
+	}
+	first, second := r.passes[0][0], r.passes[1][0]
+	if first.RunID != "run-1" || first.Name != "mirror" || first.SpeedMbps != 100 || first.Elapsed != 8*time.Second || first.Host != "edge-1" {
+		t.Errorf("first result %+v", first)
+	}
+	// The samples go with the transfer they were taken in.
+	if len(first.Samples) != 2 || first.Samples[1].Mbps != 120 || len(second.Samples) != 0 {
+		t.Errorf("samples %v and %v", first.Samples, second.Samples)
+	}
+	if failed := r.passes[1][1]; failed.Kind != perf.KindError || failed.ErrorKind != perf.ErrorConnect || failed.Error == nil {
+		t.Errorf("failed result %s %v (%s)", failed.Kind, failed.Error, failed.ErrorKind)
+	}
+
+	// Results come out in order, timed as recorded.
+	var got []perf.Stats
+	for s := range r.pass(context.Background(), 1, nil) {
+		got = append(got, s)
+		if want := time.Date(2024, 5, 1, 13, 0, 10, 0, time.UTC); len(got) == 1 && !r.now(s).Equal(want) {
+			t.Errorf("first result of pass 2 at %v, want %v", r.now(s), want)
+		}
+	}
+	if len(got) != 3 || got[2].Direction != perf.Upload {
+		t.Fatalf("pass 2 gave %d results", len(got))
+	}
+	// A result of no time, as rollups close with, takes the latest.
+	if at := r.now(perf.Stats{}); !at.Equal(got[0].Timestamp) {
+		t.Errorf("no time given as %v, want %v", at, got[0].Timestamp)
+	}
+
+	// Compressed files read the same, and a change of run starts a pass.
+	raw, _ := os.ReadFile(filepath.Join("testdata", "replay.ndjson"))
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(raw[:bytes.IndexByte(raw, '\n')+1])
+	w.Close()
+	path := filepath.Join(t.TempDir(), "results.ndjson.gz")
+	os.WriteFile(path, gz.Bytes(), 0o644)
+	other := filepath.Join(t.TempDir(), "other.ndjson")
+	os.WriteFile(other, bytes.Replace(raw[:bytes.IndexByte(raw, '\n')+1], []byte("run-1"), []byte("run-2"), 1), 0o644)
+	r, err = openReplay([]string{path, other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.passes) != 2 || r.passes[1][0].RunID != "run-2" {
+		t.Errorf("passes %v", r.passes)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.ndjson")
+	os.WriteFile(bad, append(raw[:bytes.IndexByte(raw, '\n')+1], "{not json\n"...), 0o644)
+	empty := filepath.Join(t.TempDir(), "empty.ndjson")
+	os.WriteFile(empty, []byte("\n"), 0o644)
+	for path, want := range map[string]string{
+		bad:   "replay: " + bad + ":2: ",
+		empty: "replay: no results in " + empty,
+	} {
+		if _, err := openReplay([]string{path}); err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("openReplay(%s) = %v, want %q", path, err, want)
+		}
+	}
+}
+
+func TestReplayConfigure(t *testing.T) {
+	fixture := filepath.Join("testdata", "replay.ndjson")
+	r, err := openReplay([]string{fixture})
+	if err != nil {
+		t.Fatal(err)
+	}
+	once := 3
+	config := perf.Config{Interval: time.Minute, Iterations: &once, Agents: []perf.Agent{{Label: "east"}}, Serve: ":8080", CSVFile: "out.csv"}
+	if err := r.configure(&config); err != nil {
+		t.Fatal(err)
+	}
+	// Only what reports on results is kept, and the recorded urls are
+	// summed up in the order first seen.
+	if config.Interval != 0 || config.Iterations != nil || config.Agents != nil || config.Serve != "" || config.CSVFile != "out.csv" {
+		t.Errorf("configured %+v", config)
+	}
+	if len(config.URLs) != 2 || config.URLs[0].Name != "mirror" || config.URLs[1].URL != "https://cdn.example.com/50MB.bin" {
+		t.Errorf("urls %+v", config.URLs)
+	}
+	// Urls in the config stand.
+	config = perf.Config{URLs: []perf.Target{{URL: "https://mirror.example.com/100MB.bin"}}}
+	r.configure(&config)
+	if len(config.URLs) != 1 {
+		t.Errorf("urls %+v", config.URLs)
+	}
+
+	// Writing to a file replayed would lose it.
+	if err := r.configure(&perf.Config{ResultsFile: perf.SinkPath{Path: fixture}}); err == nil || err.Error() != "replay: "+fixture+" is the results_file the replay would write to" {
+		t.Errorf("results_file replayed: %v", err)
+	}
+}
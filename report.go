@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// reporter receives everything a run produces. The run loop calls it from
+// a single goroutine, so implementations need no locking unless they hand
+// work to goroutines of their own.
+type reporter interface {
+	// OnProgress receives progress ticks and failed attempts that will be
+	// retried.
+	OnProgress(perf.Stats)
+	// OnComplete receives the final result of every transfer.
+	OnComplete(perf.Stats)
+	// OnPass receives the results of each pass that tested several URLs
+	// once the pass is over.
+	OnPass(resultTable)
+	// OnSummary receives the per-URL summaries once the run is over.
+	OnSummary([]perf.Summary)
+}
+
+// report passes result to the reporter method it belongs to.
+func report(r reporter, result perf.Stats) {
+	if result.Kind.Terminal() {
+		r.OnComplete(result)
+	} else {
+		r.OnProgress(result)
+	}
+}
+
+// multiReporter fans every call out to its reporters in order.
+type multiReporter []reporter
+
+func (m multiReporter) OnProgress(result perf.Stats) {
+	for _, r := range m {
+		r.OnProgress(result)
+	}
+}
+
+func (m multiReporter) OnComplete(result perf.Stats) {
+	for _, r := range m {
+		r.OnComplete(result)
+	}
+}
+
+func (m multiReporter) OnPass(table resultTable) {
+	for _, r := range m {
+		r.OnPass(table)
+	}
+}
+
+func (m multiReporter) OnSummary(summaries []perf.Summary) {
+	for _, r := range m {
+		r.OnSummary(summaries)
+	}
+}
+
+// newReporters builds the named display reporters. Only the first one
+// shows progress, so running several does not repeat it on stderr. With
+// quiet set they show only failed results and the summary.
+func newReporters(names []string, live, quiet, stream bool, trend *trends) (multiReporter, error) {
+	var reporters multiReporter
+	trendOf := sharedTrend(trend)
+	for i, name := range names {
+		r, err := newReporter(name, os.Stdout, i == 0 && !quiet, live, quiet, stream, trendOf)
+		if err != nil {
+			return nil, err
+		}
+		reporters = append(reporters, r)
+	}
+	return reporters, nil
+}
+
+// newOutputs builds a reporter for each of outputs, writing in its format
+// to its destination, and returns the files it opened for them. Progress
+// shows on stderr as with newReporters, by the first output that is not
+// csv, unless an output writes to stderr itself.
+func newOutputs(outputs []perf.Destination, live, quiet, stream bool, trend *trends) (multiReporter, []*os.File, error) {
+	var reporters multiReporter
+	var files []*os.File
+	fail := func(err error) (multiReporter, []*os.File, error) {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, nil, err
+	}
+	progress := !quiet && !slices.ContainsFunc(outputs, func(o perf.Destination) bool { return o.To == perf.Stderr })
+	trendOf := sharedTrend(trend)
+	for i, o := range outputs {
+		out := os.Stdout
+		switch o.To {
+		case "", perf.Stdout:
+		case perf.Stderr:
+			out = os.Stderr
+		default:
+			f, err := os.OpenFile(o.To, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+			if err != nil {
+				return fail(fmt.Errorf("outputs[%d]: %w", i, err))
+			}
+			files = append(files, f)
+			out = f
+		}
+		r, err := newReporter(o.Format, out, progress && o.Format != "csv", live, quiet, stream, trendOf)
+		if err != nil {
+			return fail(fmt.Errorf("outputs[%d]: %w", i, err))
+		}
+		if o.Format != "csv" {
+			progress = false
+		}
+		reporters = append(reporters, r)
+	}
+	return reporters, files, nil
+}
+
+// newReporter builds the reporter of format name writing to out. With
+// progress set it shows progress on stderr, redrawn in place when live is
+// set.
+func newReporter(name string, out *os.File, progress, live, quiet, stream bool, trendOf func(perf.Stats) string) (reporter, error) {
+	switch name {
+	case "", "console", "text":
+		print := func(result perf.Stats) { printText(out, result, trendOf(result)) }
+		c := &consoleReporter{out: out, print: print, progress: progress, quiet: quiet}
+		if progress && live {
+			c.print = newLiveRenderer(os.Stderr, print).print
+		}
+		return c, nil
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetEscapeHTML(false)
+		return &jsonReporter{out: out, enc: enc, progress: progress, quiet: quiet, stream: stream}, nil
+	case "csv":
+		l, err := newCSVLog("csv", out)
+		if err != nil {
+			return nil, err
+		}
+		return csvReporter{l}, nil
+	}
+	return nil, fmt.Errorf("unknown reporter %q", name)
+}
+
+// sharedTrend renders the trend of each result once, however many text
+// reporters print it, as adding a result again would count it twice.
+func sharedTrend(t *trends) func(perf.Stats) string {
+	type key struct {
+		series seriesKey
+		at     time.Time
+	}
+	var last key
+	var text string
+	return func(result perf.Stats) string {
+		if k := (key{seriesKey{result.URL, result.Direction, result.Family, result.Agent}, stampedAt(result)}); k != last || !result.Done {
+			last, text = k, t.add(result)
+		}
+		return text
+	}
+}
+
+// consoleReporter prints results and the summary as text on out and
+// progress on stderr.
+type consoleReporter struct {
+	out             io.Writer
+	print           func(perf.Stats)
+	progress, quiet bool
+}
+
+func (c *consoleReporter) OnProgress(result perf.Stats) {
+	if c.progress {
+		c.print(result)
+	}
+}
+
+func (c *consoleReporter) OnComplete(result perf.Stats) {
+	if !c.quiet || failed(result) {
+		c.print(result)
+	}
+}
+
+func (c *consoleReporter) OnPass(table resultTable) {
+	table.render(c.out)
+}
+
+func (c *consoleReporter) OnSummary(summaries []perf.Summary) {
+	printSummary(c.out, "text", summaries)
+}
+
+// jsonReporter prints one JSON object per result, one per pass table and
+// one for the summary on out, and progress as text on stderr.
+type jsonReporter struct {
+	out             io.Writer
+	enc             *json.Encoder
+	progress, quiet bool
+	// stream writes progress snapshots as JSON lines too, in place of the
+	// text progress on stderr.
+	stream bool
+}
+
+func (j *jsonReporter) OnProgress(result perf.Stats) {
+	switch {
+	case j.stream && !result.Retrying:
+		if err := j.enc.Encode(newJSONResult(result)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	case j.progress:
+		printStatus(result)
+	}
+}
+
+// printStatus prints a progress tick or retried attempt as text on stderr.
+func printStatus(result perf.Stats) {
+	if result.Retrying {
+		printRetry(os.Stderr, result)
+	} else {
+		printProgress(os.Stderr, result)
+	}
+}
+
+func (j *jsonReporter) OnComplete(result perf.Stats) {
+	if j.quiet && !failed(result) {
+		return
+	}
+	if err := j.enc.Encode(newJSONResult(result)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func (j *jsonReporter) OnPass(table resultTable) {
+	if err := j.enc.Encode(struct {
+		Table resultTable `json:"results_table"`
+	}{table}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func (j *jsonReporter) OnSummary(summaries []perf.Summary) {
+	printSummary(j.out, "json", summaries)
+}
+
+// csvReporter writes a CSV row per final result, in the columns of
+// csv_file.
+type csvReporter struct {
+	log *csvLog
+}
+
+func (c csvReporter) OnProgress(perf.Stats) {}
+
+func (c csvReporter) OnComplete(result perf.Stats) {
+	if err := c.log.Write(result); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func (c csvReporter) OnPass(resultTable) {}
+
+func (c csvReporter) OnSummary([]perf.Summary) {}
+
+// failed reports a final result that ended in an error other than being
+// cancelled.
+func failed(result perf.Stats) bool {
+	return result.Error != nil && !result.Cancelled
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func TestOutputsWriteEachFormat(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath, csvPath, textPath := filepath.Join(dir, "results.json"), filepath.Join(dir, "results.csv"), filepath.Join(dir, "results.txt")
+	reporters, files, err := newOutputs([]perf.Destination{
+		{Format: "json", To: jsonPath},
+		{Format: "csv", To: csvPath},
+		{Format: "text", To: textPath},
+	}, false, false, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reporters) != 3 || len(files) != 3 {
+		t.Fatalf("%d reporters and %d files, want 3 of each", len(reporters), len(files))
+	}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	progress := func(url string, n int64) perf.Stats {
+		return perf.Stats{Kind: perf.KindProgress, URL: url, Direction: perf.Download, SizeBytes: n, Timestamp: at}
+	}
+	final := func(url string) perf.Stats {
+		return perf.Stats{Kind: perf.KindFinal, URL: url, Direction: perf.Download, Done: true, SizeBytes: 3000, SpeedMbps: 24, Elapsed: time.Second, Timestamp: at}
+	}
+	// Two transfers running at once.
+	reporters.OnProgress(progress("https://example.com/a", 1000))
+	reporters.OnProgress(progress("https://example.com/b", 1000))
+	reporters.OnComplete(final("https://example.com/a"))
+	reporters.OnProgress(progress("https://example.com/b", 2000))
+	reporters.OnComplete(final("https://example.com/b"))
+	reporters.OnSummary(perf.NewCollector().Summaries())
+	for _, f := range files {
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("json line %q: %v", sc.Text(), err)
+		}
+		if kind, ok := line["kind"]; ok {
+			got = append(got, kind.(string)+" "+line["url"].(string))
+		}
+	}
+	// Every record is whole, and each transfer's final follows its
+	// progress.
+	want := "progress https://example.com/a,progress https://example.com/b,final https://example.com/a,progress https://example.com/b,final https://example.com/b"
+	if strings.Join(got, ",") != want {
+		t.Errorf("json records\n%s\nwant\n%s", strings.Join(got, ","), want)
+	}
+
+	c, err := os.Open(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	rows, err := csv.NewReader(c).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || strings.Join(rows[0], ",") != strings.Join(csvHeader, ",") || rows[1][1] != "https://example.com/a" || rows[2][1] != "https://example.com/b" || rows[2][5] != "24.00" {
+		t.Errorf("csv rows %q", rows)
+	}
+
+	text, err := os.ReadFile(textPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The text output prints the finals alone; progress belongs to the
+	// json output before it.
+	a, b := strings.Index(string(text), "✓ https://example.com/a\n"), strings.Index(string(text), "✓ https://example.com/b\n")
+	if strings.Count(string(text), "✓") != 2 || a < 0 || b < a || !strings.Contains(string(text), "(24.00 Mbps)") {
+		t.Errorf("text output\n%s", text)
+	}
+}
+
+func TestOutputsAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.csv")
+	for range 2 {
+		reporters, files, err := newOutputs([]perf.Destination{{Format: "csv", To: path}}, false, false, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reporters.OnComplete(perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/", Direction: perf.Download, Done: true})
+		files[0].Close()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 3 {
+		t.Errorf("%d lines after two runs, want a header and two rows:\n%s", n, data)
+	}
+}
+
+func TestOutputsErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		outputs []perf.Destination
+		want    string
+	}{
+		{[]perf.Destination{{Format: "json", To: filepath.Join(dir, "a.json")}, {Format: "xml"}}, `outputs[1]: unknown reporter "xml"`},
+		{[]perf.Destination{{Format: "json", To: filepath.Join(dir, "missing", "a.json")}}, "outputs[0]: open "},
+	}
+	for _, tt := range tests {
+		reporters, files, err := newOutputs(tt.outputs, false, false, false, nil)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) || reporters != nil || files != nil {
+			t.Errorf("%+v: err = %v, want %s", tt.outputs, err, tt.want)
+		}
+	}
+}
+
+// eventLog records the calls of reporters named after their place in it.
+type eventLog struct {
+	name   string
+	events *[]string
+}
+
+func (l eventLog) OnProgress(s perf.Stats) {
+	*l.events = append(*l.events, l.name+" progress "+string(s.Kind)+" "+s.URL)
+}
+
+func (l eventLog) OnComplete(s perf.Stats) {
+	*l.events = append(*l.events, l.name+" complete "+string(s.Kind)+" "+s.URL)
+}
+
+func (l eventLog) OnPass(table resultTable) {
+	*l.events = append(*l.events, l.name+" pass")
+}
+
+func (l eventLog) OnSummary(summaries []perf.Summary) {
+	*l.events = append(*l.events, l.name+" summary "+summaries[0].URL)
+}
+
+func TestMultiReporterOrder(t *testing.T) {
+	var events []string
+	m := multiReporter{eventLog{"a", &events}, eventLog{"b", &events}}
+	for _, s := range []perf.Stats{
+		{Kind: perf.KindProgress, URL: "/1"},
+		{Kind: perf.KindRetry, URL: "/1"},
+		{Kind: perf.KindFinal, URL: "/1"},
+		{Kind: perf.KindError, URL: "/2"},
+		{Kind: perf.KindCancelled, URL: "/3"},
+		{Kind: perf.KindSkipped, URL: "/4"},
+	} {
+		report(m, s)
+	}
+	m.OnPass(resultTable{})
+	m.OnSummary([]perf.Summary{{URL: "/1"}})
+	// Each call reaches every reporter in order before the next call.
+	want := []string{
+		"a progress progress /1", "b progress progress /1",
+		"a progress retry /1", "b progress retry /1",
+		"a complete final /1", "b complete final /1",
+		"a complete error /2", "b complete error /2",
+		"a complete cancelled /3", "b complete cancelled /3",
+		"a complete skipped /4", "b complete skipped /4",
+		"a pass", "b pass",
+		"a summary /1", "b summary /1",
+	}
+	if strings.Join(events, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events\n%s\nwant\n%s", strings.Join(events, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestNewReporters(t *testing.T) {
+	reporters, err := newReporters([]string{"console", "json", "text"}, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the first reporter shows progress.
+	if c := reporters[0].(*consoleReporter); !c.progress {
+		t.Error("the first reporter shows no progress")
+	}
+	if j := reporters[1].(*jsonReporter); j.progress {
+		t.Error("the second reporter shows progress")
+	}
+	if _, err := newReporters([]string{"console", "xml"}, false, false, false, nil); err == nil || err.Error() != `unknown reporter "xml"` {
+		t.Errorf("unknown reporter: %v", err)
+	}
+}
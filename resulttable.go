@@ -0,0 +1,192 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"yaperf/pkg/perf"
+)
+
+// tableSorts orders the rows of a result table by the table_sort key, the
+// faster, bigger or more troubled row first. Ties keep the order the
+// transfers finished in.
+var tableSorts = map[string]func(a, b tableRow) int{
+	"speed":  func(a, b tableRow) int { return cmp.Compare(b.AvgMbps, a.AvgMbps) },
+	"peak":   func(a, b tableRow) int { return cmp.Compare(b.PeakMbps, a.PeakMbps) },
+	"ttfb":   func(a, b tableRow) int { return cmp.Compare(a.ttfb, b.ttfb) },
+	"time":   func(a, b tableRow) int { return cmp.Compare(a.elapsed, b.elapsed) },
+	"size":   func(a, b tableRow) int { return cmp.Compare(b.SizeBytes, a.SizeBytes) },
+	"name":   func(a, b tableRow) int { return cmp.Compare(a.Name, b.Name) },
+	"errors": func(a, b tableRow) int { return cmp.Compare(b.Errors, a.Errors) },
+}
+
+func checkTableSort(key string) error {
+	if _, ok := tableSorts[key]; !ok && key != "" {
+		return fmt.Errorf("must be one of speed, peak, ttfb, time, size, name or errors, got %q", key)
+	}
+	return nil
+}
+
+// resultTable is the final results of one pass laid out side by side:
+// completed transfers sorted by Sort, then the failed ones.
+type resultTable struct {
+	Pass   int        `json:"pass"`
+	Sort   string     `json:"sort"`
+	Rows   []tableRow `json:"rows"`
+	Failed []tableRow `json:"failed,omitempty"`
+	// Sweep counts the URLs the availability sweep before the pass
+	// reached.
+	Sweep *sweepCount `json:"sweep,omitempty"`
+	// Score is the composite score of the pass, when one is configured.
+	Score *compositeScore `json:"score,omitempty"`
+}
+
+// tableRow is one transfer of a resultTable. Errors counts its failed
+// attempts.
+type tableRow struct {
+	Name      string  `json:"name"`
+	SizeBytes int64   `json:"size_bytes"`
+	ElapsedMs int64   `json:"elapsed_ms"`
+	AvgMbps   float64 `json:"avg_mbps"`
+	PeakMbps  float64 `json:"peak_mbps"`
+	TTFBMs    float64 `json:"ttfb_ms"`
+	Errors    int     `json:"errors"`
+	Error     string  `json:"error,omitempty"`
+
+	elapsed, ttfb time.Duration
+}
+
+// newResultTable builds the table of pass from its final results, leaving
+// out latency probes and TOTAL snapshots. sortKey defaults to speed.
+func newResultTable(pass int, results []perf.Stats, sortKey string) resultTable {
+	if sortKey == "" {
+		sortKey = "speed"
+	}
+	t := resultTable{Pass: pass, Sort: sortKey, Rows: []tableRow{}}
+	for _, result := range results {
+		if result.Direction == perf.Latency || result.URL == perf.TotalURL {
+			continue
+		}
+		row := tableRow{
+			Name:      label(result),
+			SizeBytes: result.SizeBytes,
+			ElapsedMs: result.Elapsed.Milliseconds(),
+			AvgMbps:   result.SpeedMbps,
+			PeakMbps:  result.PeakMbps,
+			TTFBMs:    ms(result.TTFB),
+			Errors:    max(result.Attempt-1, 0),
+			elapsed:   result.Elapsed,
+			ttfb:      result.TTFB,
+		}
+		switch result.Kind {
+		case perf.KindSkipped:
+			row.Error = "skipped, " + result.SkipReason
+		case perf.KindCancelled:
+			row.Error = "cancelled"
+		case perf.KindError:
+			row.Error = result.Error.Error()
+			row.Errors = max(result.Attempt, 1)
+		}
+		if row.Error != "" {
+			t.Failed = append(t.Failed, row)
+		} else {
+			t.Rows = append(t.Rows, row)
+		}
+	}
+	slices.SortStableFunc(t.Rows, tableSorts[sortKey])
+	return t
+}
+
+// len is the number of transfers in the table.
+func (t resultTable) len() int {
+	return len(t.Rows) + len(t.Failed)
+}
+
+// render writes t as text, each column as wide as its widest cell with
+// numbers right-aligned. A failed row gives its error in place of the
+// numbers, cut short to end where the table does.
+func (t resultTable) render(w io.Writer) {
+	u := columnUnit(t.Rows, func(row tableRow) float64 { return row.PeakMbps })
+	header := []string{"Name", "Size", "Time", "Avg " + u.name, "Peak " + u.name, "TTFB", "Errors"}
+	cells := [][]string{header}
+	for _, row := range t.Rows {
+		cells = append(cells, []string{
+			row.Name,
+			showSize(row.SizeBytes),
+			row.elapsed.Round(time.Millisecond).String(),
+			u.number(row.AvgMbps),
+			u.number(row.PeakMbps),
+			millis(row.ttfb),
+			strconv.Itoa(row.Errors),
+		})
+	}
+	widths := make([]int, len(header))
+	for _, line := range cells {
+		for i, cell := range line {
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+	for _, row := range t.Failed {
+		widths[0] = max(widths[0], utf8.RuneCountInString(row.Name))
+	}
+	// The error of a failed row spans every column after the name.
+	span := -2
+	for _, width := range widths[1:] {
+		span += width + 2
+	}
+
+	rule := make([]string, len(widths))
+	for i, width := range widths {
+		rule[i] = strings.Repeat("-", width)
+	}
+	cells = slices.Insert(cells, 1, rule)
+	fmt.Fprintf(w, "Results, pass %d (by %s)\n", t.Pass, t.Sort)
+	for _, line := range cells {
+		parts := make([]string, len(line))
+		for i, cell := range line {
+			if i == 0 {
+				parts[i] = pad(cell, widths[i], false)
+			} else {
+				parts[i] = pad(cell, widths[i], true)
+			}
+		}
+		fmt.Fprintln(w, strings.Join(parts, "  "))
+	}
+	for _, row := range t.Failed {
+		fmt.Fprintf(w, "%s  %s\n", pad(row.Name, widths[0], false), truncate(row.Error, span))
+	}
+	if s := t.Sweep; s != nil {
+		fmt.Fprintf(w, "Sweep: %d of %d URLs reachable\n", s.Reachable, s.Reachable+s.Unreachable)
+	}
+	if t.Score != nil {
+		fmt.Fprintf(w, "Score: %s\n", t.Score)
+	}
+	fmt.Fprintln(w)
+}
+
+// pad fills s with spaces to width, on the left when right is set.
+func pad(s string, width int, right bool) string {
+	fill := strings.Repeat(" ", max(width-utf8.RuneCountInString(s), 0))
+	if right {
+		return fill + s
+	}
+	return s + fill
+}
+
+// truncate cuts s to at most width runes, marking the cut with "...".
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	if width <= 3 {
+		return string(runes[:max(width, 0)])
+	}
+	return string(runes[:width-3]) + "..."
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// passResults are the final results of a pass, in the order they finished.
+func passResults() []perf.Stats {
+	ms := time.Millisecond
+	return []perf.Stats{
+		{Kind: perf.KindFinal, URL: "https://slow.example.com/10MB.bin", Direction: perf.Download, Done: true, Attempt: 1,
+			SizeBytes: 10000000, Elapsed: 8 * time.Second, SpeedMbps: 10, PeakMbps: 12.5, TTFB: 120 * ms},
+		{Kind: perf.KindFinal, URL: "https://mirror.example.com/100MB.bin", Name: "mirror", Direction: perf.Download, Done: true, Attempt: 3,
+			SizeBytes: 100000000, Elapsed: 8 * time.Second, SpeedMbps: 100, PeakMbps: 140.25, TTFB: 35 * ms},
+		{Kind: perf.KindError, URL: "https://broken.example.com/file", Direction: perf.Download, Done: true, Attempt: 2,
+			Error: errors.New("read tcp 192.0.2.1:51234->198.51.100.7:443: connection reset by peer after 4.20 MB of 100.00 MB")},
+		{Kind: perf.KindFinal, URL: "https://upload.example.com/", Direction: perf.Upload, Done: true, Attempt: 1,
+			SizeBytes: 20000000, Elapsed: 4 * time.Second, SpeedMbps: 40, PeakMbps: 45, TTFB: 60 * ms},
+		// Latency probes and the TOTAL are not transfers of their own.
+		{Kind: perf.KindFinal, URL: "https://mirror.example.com/", Direction: perf.Latency, Done: true, TTFB: 20 * ms},
+		{Kind: perf.KindFinal, URL: perf.TotalURL, Direction: perf.Download, Done: true, SizeBytes: 110000000, SpeedMbps: 110},
+		{Kind: perf.KindCancelled, URL: "https://cut.example.com/", Direction: perf.Download, Cancelled: true, SizeBytes: 500},
+		{Kind: perf.KindSkipped, URL: "https://late.example.com/", Direction: perf.Download, Skipped: true, SkipReason: perf.SkipOutOfTime},
+	}
+}
+
+func TestResultTableGolden(t *testing.T) {
+	table := newResultTable(3, passResults(), "")
+	var out bytes.Buffer
+	table.render(&out)
+	golden(t, "table.golden.txt", out.Bytes())
+
+	// The JSON reporter emits the same table as an object of its own.
+	out.Reset()
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	(&jsonReporter{out: &out, enc: enc}).OnPass(table)
+	golden(t, "table.golden.json", out.Bytes())
+}
+
+func TestResultTableSort(t *testing.T) {
+	tests := []struct{ key, want string }{
+		{"speed", "mirror, https://upload.example.com/ (upload), https://slow.example.com/10MB.bin"},
+		{"peak", "mirror, https://upload.example.com/ (upload), https://slow.example.com/10MB.bin"},
+		{"ttfb", "mirror, https://upload.example.com/ (upload), https://slow.example.com/10MB.bin"},
+		{"size", "mirror, https://upload.example.com/ (upload), https://slow.example.com/10MB.bin"},
+		{"name", "https://slow.example.com/10MB.bin, https://upload.example.com/ (upload), mirror"},
+		{"errors", "mirror, https://slow.example.com/10MB.bin, https://upload.example.com/ (upload)"},
+		// Ties keep the order the transfers finished in.
+		{"time", "https://upload.example.com/ (upload), https://slow.example.com/10MB.bin, mirror"},
+	}
+	for _, tt := range tests {
+		table := newResultTable(1, passResults(), tt.key)
+		var names []string
+		for _, row := range table.Rows {
+			names = append(names, row.Name)
+		}
+		if got := strings.Join(names, ", "); got != tt.want {
+			t.Errorf("by %s: %s, want %s", tt.key, got, tt.want)
+		}
+		// Failed transfers come last whatever the key.
+		if len(table.Failed) != 3 || table.Failed[0].Errors != 2 || table.Failed[2].Error != "skipped, "+perf.SkipOutOfTime {
+			t.Errorf("by %s: failed %+v", tt.key, table.Failed)
+		}
+	}
+	if err := checkTableSort("colour"); err == nil || !strings.Contains(err.Error(), `got "colour"`) {
+		t.Errorf("checkTableSort(colour) = %v", err)
+	}
+	if err := checkTableSort(""); err != nil {
+		t.Errorf("checkTableSort() = %v", err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"connection reset", 20, "connection reset"},
+		{"connection reset", 16, "connection reset"},
+		{"connection reset", 10, "connect..."},
+		{"résumé", 5, "ré..."},
+		{"reset", 3, "res"},
+		{"reset", -1, ""},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.width); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.width, got, tt.want)
+		}
+	}
+	if got := pad("⚠ x", 5, true); got != "  ⚠ x" {
+		t.Errorf("pad counts bytes: %q", got)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// rollup is the results of one URL over one rollup window: how many
+// transfers completed and failed, and their speeds. Partial marks the
+// window still open when the run ended.
+type rollup struct {
+	Start     time.Time      `json:"start"`
+	End       time.Time      `json:"end"`
+	Partial   bool           `json:"partial,omitempty"`
+	URL       string         `json:"url"`
+	Name      string         `json:"name,omitempty"`
+	Direction perf.Direction `json:"direction"`
+	IP        string         `json:"ip,omitempty"`
+	Family    string         `json:"family,omitempty"`
+	Agent     string         `json:"agent,omitempty"`
+	Count     int            `json:"count"`
+	Errors    int            `json:"errors"`
+	MeanMbps  float64        `json:"mean_mbps"`
+	MinMbps   float64        `json:"min_mbps"`
+	MaxMbps   float64        `json:"max_mbps"`
+	P95Mbps   float64        `json:"p95_mbps"`
+}
+
+// rollupReporter is a reporter that also takes the rollups of a window
+// once it closes.
+type rollupReporter interface {
+	OnRollup([]rollup)
+}
+
+// rollupKey tells apart the series of a window the way summaries do.
+type rollupKey struct {
+	url       string
+	direction perf.Direction
+	ip        string
+	family    string
+	agent     string
+}
+
+// rollupSeries is the running aggregate of one series in the open window.
+// It keeps no samples, so a window holds the same memory however many
+// passes it spans.
+type rollupSeries struct {
+	name     string
+	count    int
+	errors   int
+	sum      float64
+	min, max float64
+	p95      *quantile
+}
+
+// rollups aggregates the final results of continuous runs per URL over
+// windows of width, aligned to the clock so an hourly window starts on the
+// hour. A window's rollups go to the reporters with the first result or
+// tick after it ends, and on close.
+type rollups struct {
+	width  time.Duration
+	out    rollupReporter
+	start  time.Time
+	series map[rollupKey]*rollupSeries
+	order  []rollupKey
+}
+
+func newRollups(width time.Duration, out rollupReporter) *rollups {
+	return &rollups{width: width, out: out, series: map[rollupKey]*rollupSeries{}}
+}
+
+// add counts result, a final result of a transfer, in the window of now.
+func (r *rollups) add(result perf.Stats, now time.Time) {
+	if !result.Final() || result.Skipped || result.Direction == perf.Latency || result.URL == perf.TotalURL {
+		return
+	}
+	r.tick(now)
+	if r.start.IsZero() {
+		r.start = now.Truncate(r.width)
+	}
+	key := rollupKey{result.URL, result.Direction, result.PinnedIP, result.Family, result.Agent}
+	s := r.series[key]
+	if s == nil {
+		s = &rollupSeries{name: result.Name, p95: newQuantile(0.95)}
+		r.series[key] = s
+		r.order = append(r.order, key)
+	}
+	if !result.Done || result.Error != nil {
+		s.errors++
+		return
+	}
+	mbps := result.SpeedMbps
+	if s.count == 0 {
+		s.min, s.max = mbps, mbps
+	}
+	s.count++
+	s.sum += mbps
+	s.min, s.max = min(s.min, mbps), max(s.max, mbps)
+	s.p95.add(mbps)
+}
+
+// tick emits the open window if it ended before now.
+func (r *rollups) tick(now time.Time) {
+	if !r.start.IsZero() && !now.Before(r.start.Add(r.width)) {
+		r.emit(r.start.Add(r.width), false)
+	}
+}
+
+// close emits the window still open, as partial.
+func (r *rollups) close(now time.Time) {
+	if !r.start.IsZero() {
+		r.emit(now, true)
+	}
+}
+
+func (r *rollups) emit(end time.Time, partial bool) {
+	out := make([]rollup, 0, len(r.order))
+	for _, key := range r.order {
+		s := r.series[key]
+		ru := rollup{
+			Start: r.start, End: end, Partial: partial,
+			URL: key.url, Name: s.name, Direction: key.direction, IP: key.ip, Family: key.family, Agent: key.agent,
+			Count: s.count, Errors: s.errors, MinMbps: s.min, MaxMbps: s.max, P95Mbps: s.p95.value(),
+		}
+		if s.count > 0 {
+			ru.MeanMbps = s.sum / float64(s.count)
+		}
+		out = append(out, ru)
+	}
+	r.start, r.series, r.order = time.Time{}, map[rollupKey]*rollupSeries{}, nil
+	r.out.OnRollup(out)
+}
+
+func (m multiReporter) OnRollup(rollups []rollup) {
+	for _, r := range m {
+		if rr, ok := r.(rollupReporter); ok {
+			rr.OnRollup(rollups)
+		}
+	}
+}
+
+// OnRollup passes rollups on to sinks that record them.
+func (s *sinkReporter) OnRollup(rollups []rollup) {
+	if rr, ok := s.sink.(rollupReporter); ok {
+		s.queue <- func() { rr.OnRollup(rollups) }
+	}
+}
+
+func (c *consoleReporter) OnRollup(rollups []rollup) {
+	printRollups(os.Stdout, rollups)
+}
+
+func (j *jsonReporter) OnRollup(rollups []rollup) {
+	for _, ru := range rollups {
+		if err := j.enc.Encode(struct {
+			Rollup rollup `json:"rollup"`
+		}{ru}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+func printRollups(f *os.File, rollups []rollup) {
+	if len(rollups) == 0 {
+		return
+	}
+	ru := rollups[0]
+	clock := "15:04"
+	if ru.Start.Second() != 0 || ru.End.Second() != 0 {
+		clock = "15:04:05"
+	}
+	u := columnUnit(rollups, func(ru rollup) float64 { return ru.MaxMbps })
+	title := fmt.Sprintf("Rollup %s to %s in %s", ru.Start.Local().Format("2006-01-02 "+clock), ru.End.Local().Format(clock), u)
+	if ru.Partial {
+		title += " (partial)"
+	}
+	fmt.Fprintln(f, title)
+	w := tabwriter.NewWriter(f, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "URL\tRuns\tErrors\tMin\tMean\tP95\tMax")
+	for _, ru := range rollups {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n", label(perf.Stats{URL: ru.URL, Name: ru.Name, Direction: ru.Direction, PinnedIP: ru.IP, Family: ru.Family, Agent: ru.Agent}),
+			ru.Count, ru.Errors, u.number(ru.MinMbps), u.number(ru.MeanMbps), u.number(ru.P95Mbps), u.number(ru.MaxMbps))
+	}
+	w.Flush()
+	fmt.Fprintln(f)
+}
+
+// rollupLines encodes rollups as JSON lines for the sinks that write
+// them.
+func rollupLines(rollups []rollup) ([]byte, error) {
+	var b strings.Builder
+	for _, ru := range rollups {
+		line, err := marshal(struct {
+			Rollup rollup `json:"rollup"`
+		}{ru})
+		if err != nil {
+			return nil, err
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	return []byte(b.String()), nil
+}
+
+// quantile estimates the p quantile of a stream with the P² algorithm of
+// Jain and Chlamtac: five markers track the minimum, the p/2, p and
+// (1+p)/2 quantiles and the maximum, and are nudged towards their ideal
+// positions as values arrive, using a parabola through their neighbours.
+// P² is far off over the first few dozen values, so the first
+// quantileExact are kept and the quantile is exact over them; the markers
+// then start from those values at their ideal ranks. Past that it keeps
+// five values whatever the length of the stream.
+type quantile struct {
+	p     float64
+	count int
+	// exact holds the values until the markers take over.
+	exact []float64
+	// q are the marker heights, n their positions, and want the ideal
+	// positions, which move by step with each value.
+	q, n, want, step [5]float64
+}
+
+// quantileExact is how many values a quantile is exact over.
+const quantileExact = 64
+
+func newQuantile(p float64) *quantile {
+	return &quantile{p: p, exact: make([]float64, 0, quantileExact), step: [5]float64{0, p / 2, p, (1 + p) / 2, 1}}
+}
+
+func (e *quantile) add(x float64) {
+	if e.exact != nil && len(e.exact) < quantileExact {
+		e.exact = append(e.exact, x)
+		e.count++
+		return
+	}
+	if e.exact != nil {
+		e.seed()
+	}
+	e.count++
+
+	// k is the cell x falls in, between markers k and k+1.
+	var k int
+	switch {
+	case x < e.q[0]:
+		e.q[0] = x
+	case x >= e.q[4]:
+		e.q[4] = x
+		k = 3
+	default:
+		for k < 3 && x >= e.q[k+1] {
+			k++
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		e.n[i]++
+	}
+	for i := range e.want {
+		e.want[i] += e.step[i]
+	}
+	for i := 1; i < 4; i++ {
+		d := e.want[i] - e.n[i]
+		if d >= 1 && e.n[i+1]-e.n[i] > 1 || d <= -1 && e.n[i-1]-e.n[i] < -1 {
+			s := math.Copysign(1, d)
+			q := e.parabolic(i, s)
+			if e.q[i-1] >= q || q >= e.q[i+1] {
+				q = e.linear(i, s)
+			}
+			e.q[i] = q
+			e.n[i] += s
+		}
+	}
+}
+
+// seed places the markers on the values kept so far, at the ranks nearest
+// their ideal positions, and lets the values go.
+func (e *quantile) seed() {
+	sorted := e.exact
+	slices.Sort(sorted)
+	m := float64(len(sorted))
+	for i, step := range e.step {
+		e.want[i] = 1 + (m-1)*step
+		e.n[i] = math.Round(e.want[i])
+	}
+	// Markers need positions of their own.
+	e.n[0], e.n[4] = 1, m
+	for i := 3; i > 0; i-- {
+		e.n[i] = min(e.n[i], e.n[i+1]-1)
+	}
+	for i := 1; i < 4; i++ {
+		e.n[i] = max(e.n[i], e.n[i-1]+1)
+	}
+	for i, n := range e.n {
+		e.q[i] = sorted[int(n)-1]
+	}
+	e.exact = nil
+}
+
+func (e *quantile) parabolic(i int, s float64) float64 {
+	q, n := e.q, e.n
+	return q[i] + s/(n[i+1]-n[i-1])*((n[i]-n[i-1]+s)*(q[i+1]-q[i])/(n[i+1]-n[i])+(n[i+1]-n[i]-s)*(q[i]-q[i-1])/(n[i]-n[i-1]))
+}
+
+func (e *quantile) linear(i int, s float64) float64 {
+	j := i + int(s)
+	return e.q[i] + s*(e.q[j]-e.q[i])/(e.n[j]-e.n[i])
+}
+
+// value is the estimate, or 0 before any value arrived.
+func (e *quantile) value() float64 {
+	if e.exact != nil {
+		sorted := slices.Clone(e.exact)
+		slices.Sort(sorted)
+		return perf.Percentile(sorted, e.p*100)
+	}
+	return e.q[2]
+}
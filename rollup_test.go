@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func TestQuantileAccuracy(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	tests := []struct {
+		name string
+		draw func(i int) float64
+	}{
+		{"uniform", func(int) float64 { return rng.Float64() * 1000 }},
+		{"normal", func(int) float64 { return 500 + 50*rng.NormFloat64() }},
+		{"exponential", func(int) float64 { return 100 * rng.ExpFloat64() }},
+		// Speeds mostly near 900 with a tail of slow passes.
+		{"bimodal", func(int) float64 {
+			if rng.IntN(10) == 0 {
+				return 50 + 10*rng.NormFloat64()
+			}
+			return 900 + 20*rng.NormFloat64()
+		}},
+		{"ascending", func(i int) float64 { return float64(i) }},
+		{"descending", func(i int) float64 { return float64(-i) }},
+	}
+	for _, tt := range tests {
+		for _, p := range []float64{0.5, 0.95, 0.99} {
+			for _, n := range []int{100, 10000} {
+				q := newQuantile(p)
+				values := make([]float64, n)
+				for i := range values {
+					values[i] = tt.draw(i)
+					q.add(values[i])
+				}
+				slices.Sort(values)
+				// The estimate must rank within a hundredth of the stream,
+				// or five values for short ones, of the exact quantile.
+				slack := max(0.01, 5/float64(n)) * 100
+				low, high := perf.Percentile(values, p*100-slack), perf.Percentile(values, p*100+slack)
+				if got := q.value(); got < low || got > high {
+					t.Errorf("%s, p%v of %d: %v, want %v to %v around the exact %v", tt.name, p*100, n, got, low, high, perf.Percentile(values, p*100))
+				}
+			}
+		}
+	}
+}
+
+func TestQuantileExactWhenShort(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	values := make([]float64, quantileExact)
+	for i := range values {
+		values[i] = rng.Float64() * 1000
+	}
+	for n := range len(values) + 1 {
+		q := newQuantile(0.95)
+		for _, v := range values[:n] {
+			q.add(v)
+		}
+		sorted := slices.Sorted(slices.Values(values[:n]))
+		if got, want := q.value(), perf.Percentile(sorted, 95); got != want {
+			t.Errorf("%d values: p95 %v, want %v", n, got, want)
+		}
+	}
+	q := newQuantile(0.5)
+	for range 100 {
+		q.add(7)
+	}
+	if q.value() != 7 {
+		t.Errorf("median of a constant stream %v", q.value())
+	}
+}
+
+// rollupRecorder keeps the rollups it is given, a window at a time.
+type rollupRecorder struct {
+	windows [][]rollup
+}
+
+func (r *rollupRecorder) OnRollup(rollups []rollup) {
+	r.windows = append(r.windows, rollups)
+}
+
+func TestRollupWindows(t *testing.T) {
+	out := &rollupRecorder{}
+	r := newRollups(time.Hour, out)
+	hour := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	a := perf.Stats{URL: "https://example.com/a", Name: "a", Direction: perf.Download, Done: true}
+	b := perf.Stats{URL: "https://example.com/b", Direction: perf.Upload, Done: true}
+	at := func(s perf.Stats, mbps float64, minute int) {
+		s.SpeedMbps = mbps
+		r.add(s, hour.Add(time.Duration(minute)*time.Minute))
+	}
+	at(a, 100, 5)
+	at(b, 40, 6)
+	at(a, 300, 20)
+	failed := a
+	failed.Error = errors.New("reset")
+	at(failed, 0, 30)
+	// Progress, skipped and latency results do not count.
+	progress := a
+	progress.Done = false
+	at(progress, 5, 31)
+	skipped := a
+	skipped.Skipped = true
+	at(skipped, 0, 32)
+	at(perf.Stats{URL: "https://example.com/a", Direction: perf.Latency, Done: true}, 0, 33)
+	at(a, 200, 59)
+	if len(out.windows) != 0 {
+		t.Fatalf("emitted %v before the window ended", out.windows)
+	}
+
+	// The first result of the next hour closes the window on the hour.
+	at(a, 500, 65)
+	if len(out.windows) != 1 {
+		t.Fatalf("%d windows, want 1", len(out.windows))
+	}
+	first := out.windows[0]
+	if len(first) != 2 {
+		t.Fatalf("rollups %+v, want a and b", first)
+	}
+	ra, rb := first[0], first[1]
+	if !ra.Start.Equal(hour) || !ra.End.Equal(hour.Add(time.Hour)) || ra.Partial {
+		t.Errorf("window %v to %v, partial %v", ra.Start, ra.End, ra.Partial)
+	}
+	if ra.Name != "a" || ra.Count != 3 || ra.Errors != 1 || ra.MinMbps != 100 || ra.MaxMbps != 300 || ra.MeanMbps != 200 || ra.P95Mbps != 290 {
+		t.Errorf("a rolled up as %+v", ra)
+	}
+	if rb.Direction != perf.Upload || rb.Count != 1 || rb.MeanMbps != 40 || rb.P95Mbps != 40 {
+		t.Errorf("b rolled up as %+v", rb)
+	}
+
+	// A tick past the end closes a window with no later result, and close
+	// emits what is open as partial.
+	r.tick(hour.Add(2 * time.Hour))
+	r.add(a, hour.Add(150*time.Minute))
+	r.close(hour.Add(160 * time.Minute))
+	if len(out.windows) != 3 {
+		t.Fatalf("%d windows, want 3", len(out.windows))
+	}
+	if second := out.windows[1]; len(second) != 1 || second[0].Count != 1 || !second[0].Start.Equal(hour.Add(time.Hour)) {
+		t.Errorf("second window %+v", second)
+	}
+	if last := out.windows[2][0]; !last.Partial || !last.Start.Equal(hour.Add(2*time.Hour)) || !last.End.Equal(hour.Add(160*time.Minute)) {
+		t.Errorf("last window %+v", last)
+	}
+	r.close(hour.Add(3 * time.Hour))
+	if len(out.windows) != 3 {
+		t.Error("close emitted an empty window")
+	}
+	if math.IsNaN(out.windows[2][0].MeanMbps) {
+		t.Error("mean of the partial window is NaN")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+var samplesHeader = []string{"run_id", "url", "direction", "time", "interval_ms", "bytes", "mbps", "run_offset_ms"}
+
+// sampleFile appends the per-interval samples of every completed transfer,
+// as CSV rows when the path ends in .csv and as one JSON object per
+// transfer otherwise. Rows carry the run ID so several runs can share a file.
+type sampleFile struct {
+	mu  sync.Mutex
+	f   *os.File
+	csv *csv.Writer
+}
+
+func openSampleFile(path string) (*sampleFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("samples_file: %w", err)
+	}
+	s := &sampleFile{f: f}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("samples_file: %w", err)
+		}
+		s.csv = csv.NewWriter(f)
+		if info.Size() == 0 {
+			s.csv.Write(samplesHeader)
+		}
+	}
+	return s, nil
+}
+
+func (s *sampleFile) Write(result perf.Stats) error {
+	if !result.Final() || len(result.Samples) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.csv != nil {
+		for _, sample := range result.Samples {
+			s.csv.Write([]string{
+				result.RunID,
+				result.URL,
+				string(result.Direction),
+				sample.Time.UTC().Format(time.RFC3339Nano),
+				strconv.FormatInt(sample.Interval.Milliseconds(), 10),
+				strconv.FormatInt(sample.Bytes, 10),
+				strconv.FormatFloat(sample.Mbps, 'f', 2, 64),
+				strconv.FormatFloat(ms(sample.RunOffset), 'f', 3, 64),
+			})
+		}
+		s.csv.Flush()
+		if err := s.csv.Error(); err != nil {
+			return fmt.Errorf("samples_file: %w", err)
+		}
+		return nil
+	}
+	enc := json.NewEncoder(s.f)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(struct {
+		RunID     string         `json:"run_id"`
+		URL       string         `json:"url"`
+		Direction perf.Direction `json:"direction"`
+		Samples   []perf.Sample  `json:"samples"`
+	}{result.RunID, result.URL, result.Direction, result.Samples}); err != nil {
+		return fmt.Errorf("samples_file: %w", err)
+	}
+	return nil
+}
+
+func (s *sampleFile) Close() error {
+	return s.f.Close()
+}
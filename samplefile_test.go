@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func TestSampleFile(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	result := perf.Stats{
+		URL: "https://example.com/a", RunID: "run-1", Direction: perf.Download, Done: true,
+		Samples: []perf.Sample{
+			{Time: at, RunOffset: 1500 * time.Millisecond, Interval: time.Second, Bytes: 125000, Mbps: 1},
+			{Time: at.Add(time.Second), RunOffset: 2500 * time.Millisecond, Interval: time.Second, Bytes: 250000, Mbps: 2},
+		},
+	}
+	progress := result
+	progress.Done = false
+	dir := t.TempDir()
+
+	// Appending twice writes the CSV header once.
+	csvPath := filepath.Join(dir, "samples.csv")
+	for range 2 {
+		s, err := openSampleFile(csvPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range []perf.Stats{progress, result} {
+			if err := s.Write(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.Close()
+	}
+	got, _ := os.ReadFile(csvPath)
+	row := "run-1,https://example.com/a,download,2024-05-01T12:00:00Z,1000,125000,1.00,1500.000\n" +
+		"run-1,https://example.com/a,download,2024-05-01T12:00:01Z,1000,250000,2.00,2500.000\n"
+	if want := strings.Join(samplesHeader, ",") + "\n" + row + row; string(got) != want {
+		t.Errorf("csv\n%s\nwant\n%s", got, want)
+	}
+
+	// Anything else gets one JSON object per transfer.
+	jsonPath := filepath.Join(dir, "samples.ndjson")
+	s, err := openSampleFile(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write(result)
+	s.Write(perf.Stats{URL: "https://example.com/none", Done: true})
+	s.Close()
+	got, _ = os.ReadFile(jsonPath)
+	var doc struct {
+		RunID   string        `json:"run_id"`
+		URL     string        `json:"url"`
+		Samples []perf.Sample `json:"samples"`
+	}
+	if lines := strings.Split(strings.TrimSpace(string(got)), "\n"); len(lines) != 1 {
+		t.Fatalf("%d lines, want one for the transfer with samples:\n%s", len(lines), got)
+	}
+	if err := json.Unmarshal(got, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.RunID != "run-1" || doc.URL != "https://example.com/a" || len(doc.Samples) != 2 || doc.Samples[1].Bytes != 250000 {
+		t.Errorf("json %+v", doc)
+	}
+
+	if _, err := openSampleFile(filepath.Join(dir, "missing", "samples.csv")); err == nil || !strings.HasPrefix(err.Error(), "samples_file: ") {
+		t.Errorf("err %v, want a samples_file error", err)
+	}
+}
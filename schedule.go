@@ -0,0 +1,285 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// schedule decides when the next pass starts.
+type schedule interface {
+	next(after time.Time) time.Time
+}
+
+// newSchedule returns the schedule configured by interval or cron, or nil
+// when passes should run back to back.
+func newSchedule(interval time.Duration, cron string) (schedule, error) {
+	switch {
+	case interval > 0 && cron != "":
+		return nil, fmt.Errorf("interval and cron are mutually exclusive")
+	case interval > 0:
+		return every(interval), nil
+	case interval < 0:
+		return nil, fmt.Errorf("interval must be positive, got %v", interval)
+	case cron != "":
+		return parseCron(cron)
+	}
+	return nil, nil
+}
+
+// every starts passes on multiples of the interval so runs on different
+// hosts line up.
+type every time.Duration
+
+func (e every) next(after time.Time) time.Time {
+	return after.Truncate(time.Duration(e)).Add(time.Duration(e))
+}
+
+// wait sleeps until the pass after the one that started at started. When
+// that start is already past it logs the overrun and returns at once. It
+// returns false if ctx is cancelled first.
+func wait(ctx context.Context, s schedule, started time.Time) bool {
+	next := s.next(started)
+	delay := time.Until(next)
+	if delay <= 0 {
+		slog.Warn("pass overran its slot, starting the next one now", "by", (-delay).Round(time.Millisecond))
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Back-off of the probes of a link that is down: the first after
+// link_down_retry, or defaultLinkDownRetry, and each failed one doubling
+// the wait up to maxLinkDownRetry, or the interval when that is shorter.
+const (
+	defaultLinkDownRetry = 5 * time.Second
+	maxLinkDownRetry     = time.Minute
+)
+
+// awaitLink holds the next pass, in place of the schedule, while breaker
+// has the link down: it probes the hosts of targets, backing off, until
+// one answers and the link is back. It returns false if ctx is cancelled
+// first.
+func awaitLink(ctx context.Context, tester *perf.Tester, breaker *perf.Breaker, targets []perf.Target, retry, interval time.Duration) bool {
+	delay, limit := cmp.Or(retry, defaultLinkDownRetry), maxLinkDownRetry
+	if interval > 0 {
+		limit = min(limit, interval)
+	}
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+		err := tester.ProbeLink(ctx, targets)
+		if err == nil {
+			slog.Info("link is back, starting the next pass", "down_for", time.Since(breaker.State().Since).Round(time.Second))
+			breaker.Reset()
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		delay = max(min(2*delay, limit), delay)
+		slog.Warn("link still down", "err", err, "next_probe", delay)
+	}
+}
+
+// cronSchedule is a five-field cron expression: minute, hour, day of month,
+// month and day of week. Fields accept *, lists, ranges and steps.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: want 5 fields, got %d", expr, len(fields))
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %w", expr, err)
+		}
+		sets[i] = set
+	}
+	c := &cronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		// As in Vixie cron, a field starting with * such as */2 counts as
+		// unrestricted.
+		domAny: strings.HasPrefix(fields[2], "*"), dowAny: strings.HasPrefix(fields[4], "*"),
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	// Every date comes round within the years searched, leap days too, so
+	// finding none now means there is none, as with 0 0 31 2 *.
+	if _, ok := c.find(time.Now()); !ok {
+		return nil, fmt.Errorf("cron %q never matches", expr)
+	}
+	return c, nil
+}
+
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+		}
+		first, last := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if first, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value in %q", part)
+			}
+			last = first
+			if isRange {
+				if last, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad value in %q", part)
+				}
+			} else if hasStep {
+				last = hi
+			}
+		}
+		if first < lo || last > hi || first > last {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, lo, hi)
+		}
+		for v := first; v <= last; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if !c.domAny && !c.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+func (c *cronSchedule) next(after time.Time) time.Time {
+	t, _ := c.find(after)
+	return t
+}
+
+// find returns the first minute after after that matches, in the location
+// of after, or reports false when none does in the next five years. A
+// minute whose wall clock does not come after that of after, as when the
+// clock falls back an hour, does not count: a slot is not run twice.
+func (c *cronSchedule) find(after time.Time) (time.Time, bool) {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		prev := t
+		switch {
+		case !wallClock(t).After(wallClock(after)):
+			t = t.Add(time.Minute)
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+		// A time the clock skips, such as 02:00 when it springs forward,
+		// may come out before the one it was asked after.
+		if !t.After(prev) {
+			t = prev.Add(time.Minute)
+		}
+	}
+	return limit, false
+}
+
+// wallClock is the date and time t reads in its location, as a UTC time
+// that can be compared across offset changes.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// jittered offsets the passes of a schedule by offset, which is the same
+// on every start of a probe, plus a random delay of up to random drawn for
+// each pass from rng.
+type jittered struct {
+	schedule
+	offset, random time.Duration
+	rng            *rand.Rand
+}
+
+func (j jittered) next(after time.Time) time.Time {
+	// after is the start of a pass, offset included, so the slot it
+	// started in is found without it.
+	next := j.schedule.next(after.Add(-j.offset)).Add(j.offset)
+	if j.random > 0 {
+		delay := time.Duration(j.rng.Int64N(int64(j.random)))
+		slog.Debug("pass jitter", "delay", delay.Round(time.Millisecond))
+		next = next.Add(delay)
+	}
+	return next
+}
+
+// withJitter applies the schedule_jitter and pass_jitter of config to s,
+// logging the offset this probe got.
+func withJitter(s schedule, config perf.Config, host string) schedule {
+	if s == nil || config.ScheduleJitter <= 0 && config.PassJitter <= 0 {
+		return s
+	}
+	id, offset := scheduleOffset(config, host)
+	if config.ScheduleJitter > 0 {
+		slog.Info("offsetting scheduled passes", "probe_id", id, "offset", offset, "schedule_jitter", config.ScheduleJitter)
+	}
+	// Seeded by the probe ID, probes started together still draw apart.
+	sum := probeHash(id)
+	return jittered{schedule: s, offset: offset, random: config.PassJitter, rng: rand.New(rand.NewPCG(sum, ^sum))}
+}
+
+// scheduleOffset is the probe ID of config, its hostname unless probe_id
+// is set, and the offset of its passes: the FNV-1a hash of the ID modulo
+// schedule_jitter, which spreads IDs evenly across it.
+func scheduleOffset(config perf.Config, host string) (string, time.Duration) {
+	id := cmp.Or(config.ProbeID, host)
+	if config.ScheduleJitter <= 0 {
+		return id, 0
+	}
+	return id, time.Duration(probeHash(id) % uint64(config.ScheduleJitter))
+}
+
+// probeHash is the FNV-1a hash of a probe ID.
+func probeHash(id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return h.Sum64()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func TestCronNext(t *testing.T) {
+	// A Wednesday.
+	after := time.Date(2024, 5, 1, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"* * * * *", []string{"2024-05-01 10:08", "2024-05-01 10:09"}},
+		{"*/15 * * * *", []string{"2024-05-01 10:15", "2024-05-01 10:30", "2024-05-01 10:45", "2024-05-01 11:00"}},
+		{"5,50 * * * *", []string{"2024-05-01 10:50", "2024-05-01 11:05"}},
+		{"0 9-11 * * *", []string{"2024-05-01 11:00", "2024-05-02 09:00"}},
+		{"10-40/15 * * * *", []string{"2024-05-01 10:10", "2024-05-01 10:25", "2024-05-01 10:40", "2024-05-01 11:10"}},
+		{"0 0 1 * *", []string{"2024-06-01 00:00", "2024-07-01 00:00"}},
+		{"0 0 29 2 *", []string{"2028-02-29 00:00"}},
+		{"0 12 * * 1-5", []string{"2024-05-01 12:00", "2024-05-02 12:00", "2024-05-03 12:00", "2024-05-06 12:00"}},
+		{"0 12 * * 7", []string{"2024-05-05 12:00", "2024-05-12 12:00"}},
+		// With both restricted, either day matches.
+		{"0 0 13 * 5", []string{"2024-05-03 00:00", "2024-05-10 00:00", "2024-05-13 00:00", "2024-05-17 00:00"}},
+		// A field starting with * leaves the other one alone.
+		{"0 0 */10 * 5", []string{"2024-05-31 00:00", "2024-06-21 00:00", "2024-10-11 00:00"}},
+		{"0 0 1 1,7 *", []string{"2024-07-01 00:00", "2025-01-01 00:00"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			c, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			at := after
+			for _, want := range tt.want {
+				at = c.next(at)
+				if got := at.Format("2006-01-02 15:04"); got != want {
+					t.Fatalf("next = %s, want %s", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCronDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		name  string
+		expr  string
+		after time.Time
+		want  []string
+	}{
+		// 02:30 does not exist on 10 March 2024, so that day is skipped.
+		{"spring forward", "30 2 * * *", time.Date(2024, 3, 8, 12, 0, 0, 0, loc), []string{"2024-03-09 02:30 EST", "2024-03-11 02:30 EDT"}},
+		{"across spring forward", "0 * * * *", time.Date(2024, 3, 10, 0, 30, 0, 0, loc), []string{"2024-03-10 01:00 EST", "2024-03-10 03:00 EDT"}},
+		// 01:30 happens twice on 3 November 2024 but runs once.
+		{"fall back", "30 1 * * *", time.Date(2024, 11, 3, 0, 0, 0, 0, loc), []string{"2024-11-03 01:30 EDT", "2024-11-04 01:30 EST"}},
+		{"across fall back", "0 * * * *", time.Date(2024, 11, 3, 0, 30, 0, 0, loc), []string{"2024-11-03 01:00 EDT", "2024-11-03 02:00 EST"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			at := tt.after
+			for _, want := range tt.want {
+				at = c.next(at)
+				if got := at.Format("2006-01-02 15:04 MST"); got != want {
+					t.Fatalf("next = %s, want %s", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"* * * *", "want 5 fields, got 4"},
+		{"60 * * * *", `"60" is outside 0-59`},
+		{"* 5-2 * * *", `"5-2" is outside 0-23`},
+		{"*/0 * * * *", `bad step in "*/0"`},
+		{"x * * * *", `bad value in "x"`},
+		{"0 0 31 2 *", "never matches"},
+		{"0 0 30,31 2 *", "never matches"},
+		{"0 0 31 4,6,9,11 *", "never matches"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if _, err := parseCron(tt.expr); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+	// Restricting the day of the week too makes it possible again.
+	if _, err := parseCron("0 0 31 2 1"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEveryNext(t *testing.T) {
+	s := every(15 * time.Minute)
+	at := time.Date(2024, 5, 1, 10, 7, 30, 0, time.UTC)
+	for _, want := range []string{"10:15", "10:30", "10:45"} {
+		at = s.next(at)
+		if got := at.Format("15:04"); got != want {
+			t.Fatalf("next = %s, want %s", got, want)
+		}
+	}
+}
+
+func TestScheduleOffset(t *testing.T) {
+	config := perf.Config{ScheduleJitter: 90 * time.Second}
+	// The offset is a function of the ID alone, so it survives restarts,
+	// and probe_id stands in for the hostname.
+	id, offset := scheduleOffset(config, "edge-1")
+	if _, again := scheduleOffset(config, "edge-1"); id != "edge-1" || again != offset || offset < 0 || offset >= 90*time.Second {
+		t.Errorf("offset of edge-1: %v, then %v", offset, again)
+	}
+	config.ProbeID = "edge-1"
+	if byID, viaID := scheduleOffset(config, "other-host"); byID != "edge-1" || viaID != offset {
+		t.Errorf("probe_id edge-1 on other-host gave %s at %v, want %v", byID, viaID, offset)
+	}
+	if _, none := scheduleOffset(perf.Config{PassJitter: time.Second}, "edge-1"); none != 0 {
+		t.Errorf("offset %v without schedule_jitter", none)
+	}
+
+	// Across a fleet the offsets spread evenly over the jitter.
+	config.ProbeID = ""
+	const probes, buckets = 10000, 10
+	counts := make([]int, buckets)
+	for i := range probes {
+		_, offset := scheduleOffset(config, fmt.Sprintf("probe-%d.example.net", i))
+		counts[offset*buckets/config.ScheduleJitter]++
+	}
+	for i, n := range counts {
+		if n < probes/buckets*85/100 || n > probes/buckets*115/100 {
+			t.Errorf("%d of %d probes offset into the %s-%s slice: %v", n, probes, config.ScheduleJitter*time.Duration(i)/buckets, config.ScheduleJitter*time.Duration(i+1)/buckets, counts)
+		}
+	}
+}
+
+func TestJitteredNext(t *testing.T) {
+	s := jittered{schedule: every(15 * time.Minute), offset: 40 * time.Second}
+	at := time.Date(2024, 5, 1, 10, 7, 30, 0, time.UTC)
+	for _, want := range []string{"10:15:40", "10:30:40", "10:45:40"} {
+		at = s.next(at)
+		if got := at.Format("15:04:05"); got != want {
+			t.Fatalf("next = %s, want %s", got, want)
+		}
+	}
+	// A start inside the offset of its slot still belongs to that slot.
+	if got := s.next(time.Date(2024, 5, 1, 10, 15, 20, 0, time.UTC)).Format("15:04:05"); got != "10:15:40" {
+		t.Errorf("next after 10:15:20 = %s, want 10:15:40", got)
+	}
+
+	// Pass jitter delays each pass on its own and never drifts the slots.
+	s.random, s.rng = 5*time.Second, rand.New(rand.NewPCG(1, 2))
+	at = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	slot := time.Date(2024, 5, 1, 10, 0, 40, 0, time.UTC)
+	delays := map[time.Duration]bool{}
+	for range 50 {
+		at = s.next(at)
+		if delay := at.Sub(slot); delay < 0 || delay >= s.random {
+			t.Fatalf("pass at %v, %v after its slot", at.Format("15:04:05.000"), delay)
+		} else {
+			delays[delay] = true
+		}
+		slot = slot.Add(15 * time.Minute)
+	}
+	if len(delays) < 40 {
+		t.Errorf("%d distinct delays over 50 passes", len(delays))
+	}
+}
+
+func TestWithJitter(t *testing.T) {
+	logs := captureLog(t)
+	if s := withJitter(nil, perf.Config{ScheduleJitter: time.Minute}, "edge-1"); s != nil {
+		t.Errorf("back to back passes got schedule %v", s)
+	}
+	if s := withJitter(every(time.Hour), perf.Config{}, "edge-1"); s != every(time.Hour) {
+		t.Errorf("unjittered schedule %v", s)
+	}
+	config := perf.Config{ScheduleJitter: 90 * time.Second, PassJitter: 10 * time.Second, ProbeID: "probe-7"}
+	_, offset := scheduleOffset(config, "")
+	s, ok := withJitter(every(time.Hour), config, "edge-1").(jittered)
+	if !ok || s.offset != offset || s.random != 10*time.Second {
+		t.Fatalf("jittered schedule %+v, want offset %v", s, offset)
+	}
+	if want := "probe_id=probe-7 offset=" + offset.String(); !strings.Contains(logs.String(), want) {
+		t.Errorf("log lacks %q:\n%s", want, logs.String())
+	}
+
+	// The delays are drawn from the probe ID, alike on every start and
+	// apart from those of other probes.
+	passes := func(id string) []time.Time {
+		config.ProbeID = id
+		s := withJitter(every(time.Hour), config, "")
+		at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+		var starts []time.Time
+		for range 5 {
+			at = s.next(at)
+			starts = append(starts, at)
+		}
+		return starts
+	}
+	if first, again, other := passes("probe-7"), passes("probe-7"), passes("probe-8"); !slices.Equal(first, again) || slices.Equal(first, other) {
+		t.Errorf("passes %v, on a restart %v, of another probe %v", first, again, other)
+	}
+}
+
+func TestManifestSchedule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	config := perf.Config{Interval: time.Hour, ScheduleJitter: 90 * time.Second, PassJitter: 5 * time.Second}
+	if _, err := openManifest(path, "run-1", "edge-1", time.Now(), config, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, offset := scheduleOffset(config, "edge-1")
+	s := readManifest(t, path).Schedule
+	if s == nil || s.ProbeID != "edge-1" || s.OffsetMs != ms(offset) || s.PassJitterMs != 5000 {
+		t.Errorf("schedule %+v, want edge-1 offset by %v", s, offset)
+	}
+	// Without jitter the manifest has no schedule.
+	if _, err := openManifest(path, "run-2", "edge-1", time.Now(), perf.Config{Interval: time.Hour}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := readManifest(t, path).Schedule; s != nil {
+		t.Errorf("schedule %+v without jitter", s)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// compositeScore is a pass summed up in one number, in Mbps.
+type compositeScore struct {
+	Score float64 `json:"score"`
+	// URLs is how many transfers the mean covers, and Skipped how many
+	// failed ones were left out of it.
+	URLs    int `json:"urls"`
+	Skipped int `json:"skipped,omitempty"`
+	// Errors is the failed attempts penalized, and LoadedP95Ms the worst
+	// loaded p95 round trip the latency target was held against.
+	Errors      int     `json:"errors,omitempty"`
+	LoadedP95Ms float64 `json:"loaded_p95_ms,omitempty"`
+}
+
+// targetWeights maps each URL of targets to its weight.
+func targetWeights(targets []perf.Target) map[string]float64 {
+	weights := map[string]float64{}
+	for _, t := range targets {
+		weights[t.URL] = cmp.Or(t.Weight, 1)
+	}
+	return weights
+}
+
+// newCompositeScore scores the transfers among finals, leaving out latency
+// tests, TOTAL snapshots and URLs the pass skipped. It returns nil when no
+// transfer is left to score.
+//
+// The score is computed in three steps, each order-independent so the same
+// results always give the same score:
+//
+//  1. The weighted geometric mean of the average speeds,
+//     exp(Σ wᵢ·ln(sᵢ) / Σ wᵢ), with wᵢ the URL's weight (1 when unset). A
+//     failed transfer is left out with failed: skip, or counts as 0 Mbps
+//     with failed: zero, which makes the mean 0.
+//  2. Times (1 - error_penalty)ⁿ, with n the failed attempts of all
+//     transfers, retried ones included.
+//  3. Times latency_target / p95 when the worst loaded p95 round trip of
+//     a bufferbloat test is over latency_target.
+func newCompositeScore(cfg perf.Score, finals []perf.Stats, weights map[string]float64) *compositeScore {
+	var (
+		s          compositeScore
+		sum, total float64
+		zero       bool
+		loaded     time.Duration
+	)
+	for _, result := range finals {
+		if result.Direction == perf.Latency || result.URL == perf.TotalURL || result.Skipped {
+			continue
+		}
+		s.Errors += max(result.Attempt-1, 0)
+		if b := result.Bufferbloat; b != nil && b.Loaded != nil {
+			loaded = max(loaded, b.Loaded.P95)
+		}
+		w := cmp.Or(weights[result.URL], 1)
+		if !result.Done || result.Error != nil {
+			s.Errors++
+			if cfg.Failed != perf.ScoreZero {
+				s.Skipped++
+				continue
+			}
+		}
+		s.URLs++
+		speed := result.SpeedMbps
+		if !result.Done || result.Error != nil {
+			speed = 0
+		}
+		if speed <= 0 {
+			zero = true
+			continue
+		}
+		sum += w * math.Log(speed)
+		total += w
+	}
+	if s.URLs == 0 {
+		return nil
+	}
+	if !zero && total > 0 {
+		s.Score = math.Exp(sum / total)
+	}
+	s.Score *= math.Pow(1-float64(cfg.ErrorPenalty)/100, float64(s.Errors))
+	if loaded > 0 {
+		s.LoadedP95Ms = ms(loaded)
+		if cfg.LatencyTarget > 0 && loaded > cfg.LatencyTarget {
+			s.Score *= float64(cfg.LatencyTarget) / float64(loaded)
+		}
+	}
+	return &s
+}
+
+func (s compositeScore) String() string {
+	parts := []string{fmt.Sprintf("%.2f over %d URLs", s.Score, s.URLs)}
+	if s.Skipped > 0 {
+		parts = append(parts, fmt.Sprintf("%d failed left out", s.Skipped))
+	}
+	if s.Errors > 0 {
+		parts = append(parts, fmt.Sprintf("%d errors", s.Errors))
+	}
+	if s.LoadedP95Ms > 0 {
+		parts = append(parts, fmt.Sprintf("loaded p95 %.1f ms", s.LoadedP95Ms))
+	}
+	return strings.Join(parts, ", ")
+}
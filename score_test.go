@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func TestCompositeScore(t *testing.T) {
+	done := func(url string, mbps float64) perf.Stats {
+		return perf.Stats{URL: url, Direction: perf.Download, Done: true, Attempt: 1, SpeedMbps: mbps}
+	}
+	failed := perf.Stats{URL: "c", Direction: perf.Download, Done: true, Attempt: 1, Error: errors.New("reset")}
+	retried := done("b", 400)
+	retried.Attempt = 3
+	loaded := func(p95 time.Duration) perf.Stats {
+		s := done("a", 100)
+		s.Bufferbloat = &perf.Bufferbloat{Loaded: &perf.LatencyStats{P95: p95}}
+		return s
+	}
+	tests := []struct {
+		name    string
+		cfg     perf.Score
+		finals  []perf.Stats
+		weights map[string]float64
+		want    *compositeScore
+	}{
+		{"geometric mean", perf.Score{}, []perf.Stats{done("a", 100), done("b", 400)}, nil, &compositeScore{Score: 200, URLs: 2}},
+		// (4 · 32²)^⅓ = 16.
+		{"weighted", perf.Score{}, []perf.Stats{done("a", 4), done("b", 32)}, map[string]float64{"b": 2}, &compositeScore{Score: 16, URLs: 2}},
+		{"upload too", perf.Score{}, []perf.Stats{done("a", 100), {URL: "a", Direction: perf.Upload, Done: true, SpeedMbps: 25}}, nil, &compositeScore{Score: 50, URLs: 2}},
+		{"failed skipped", perf.Score{}, []perf.Stats{done("a", 100), failed}, nil, &compositeScore{Score: 100, URLs: 1, Skipped: 1, Errors: 1}},
+		{"failed as zero", perf.Score{Failed: perf.ScoreZero}, []perf.Stats{done("a", 100), failed}, nil, &compositeScore{Score: 0, URLs: 2, Errors: 1}},
+		{"cancelled as zero", perf.Score{Failed: perf.ScoreZero}, []perf.Stats{done("a", 100), {URL: "b", Direction: perf.Download, Cancelled: true, SpeedMbps: 50}}, nil, &compositeScore{Score: 0, URLs: 2, Errors: 1}},
+		// Two retries and a failure at 10% each: 200 × 0.9³.
+		{"error penalty", perf.Score{ErrorPenalty: 10}, []perf.Stats{done("a", 100), retried, failed}, nil, &compositeScore{Score: 145.8, URLs: 2, Skipped: 1, Errors: 3}},
+		{"over the latency target", perf.Score{LatencyTarget: 100 * time.Millisecond}, []perf.Stats{loaded(200 * time.Millisecond)}, nil, &compositeScore{Score: 50, URLs: 1, LoadedP95Ms: 200}},
+		{"within the latency target", perf.Score{LatencyTarget: 100 * time.Millisecond}, []perf.Stats{loaded(80 * time.Millisecond)}, nil, &compositeScore{Score: 100, URLs: 1, LoadedP95Ms: 80}},
+		{"no latency target", perf.Score{}, []perf.Stats{loaded(200 * time.Millisecond)}, nil, &compositeScore{Score: 100, URLs: 1, LoadedP95Ms: 200}},
+		{"ignored", perf.Score{}, []perf.Stats{
+			done("a", 100),
+			{URL: "a", Direction: perf.Latency, Done: true},
+			{URL: perf.TotalURL, Direction: perf.Download, Done: true, SpeedMbps: 5000},
+			{URL: "b", Direction: perf.Download, Skipped: true},
+		}, nil, &compositeScore{Score: 100, URLs: 1}},
+		{"nothing to score", perf.Score{}, []perf.Stats{failed, {URL: "b", Skipped: true}}, nil, nil},
+		{"no results", perf.Score{}, nil, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newCompositeScore(tt.cfg, tt.finals, tt.weights)
+			// The score does not depend on the order of the results.
+			reversed := slices.Clone(tt.finals)
+			slices.Reverse(reversed)
+			again := newCompositeScore(tt.cfg, reversed, tt.weights)
+			switch {
+			case got == nil && tt.want == nil:
+			case got == nil || tt.want == nil:
+				t.Fatalf("score %v, want %v", got, tt.want)
+			default:
+				if math.Abs(got.Score-tt.want.Score) > 1e-9 {
+					t.Errorf("score %v, want %v", got.Score, tt.want.Score)
+				}
+				score := *got
+				score.Score = tt.want.Score
+				if score != *tt.want {
+					t.Errorf("score %+v, want %+v", *got, *tt.want)
+				}
+				if *again != *got {
+					t.Errorf("reversed results scored %+v, not %+v", *again, *got)
+				}
+			}
+		})
+	}
+}
+
+func TestTargetWeights(t *testing.T) {
+	weights := targetWeights([]perf.Target{{URL: "a"}, {URL: "b", Weight: 2.5}})
+	if weights["a"] != 1 || weights["b"] != 2.5 {
+		t.Errorf("weights %v", weights)
+	}
+}
+
+func TestCompositeScoreString(t *testing.T) {
+	tests := []struct {
+		s    compositeScore
+		want string
+	}{
+		{compositeScore{Score: 200, URLs: 2}, "200.00 over 2 URLs"},
+		{compositeScore{Score: 145.8, URLs: 2, Skipped: 1, Errors: 3, LoadedP95Ms: 212.34}, "145.80 over 2 URLs, 1 failed left out, 3 errors, loaded p95 212.3 ms"},
+	}
+	for _, tt := range tests {
+		if got := tt.s.String(); got != tt.want {
+			t.Errorf("String = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// notifier tells systemd how the service is doing over the datagram
+// socket in NOTIFY_SOCKET, for units of Type=notify. Outside systemd it
+// does nothing.
+type notifier struct {
+	addr *net.UnixAddr
+	// watchdog is WatchdogSec when the unit sets it; pings are sent at
+	// twice that rate, and lastPing keeps them from going out more often.
+	watchdog time.Duration
+	mu       sync.Mutex
+	lastPing time.Time
+	stopped  sync.Once
+}
+
+// newNotifier reads the socket and the watchdog interval systemd passes in
+// the environment.
+func newNotifier() *notifier {
+	n := &notifier{}
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return n
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	n.addr = &net.UnixAddr{Name: path, Net: "unixgram"}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return n
+	}
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		n.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	return n
+}
+
+// notify sends state, such as "READY=1", to systemd.
+func (n *notifier) notify(state string) {
+	if n.addr == nil {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, n.addr)
+	if err != nil {
+		slog.Debug("notifying systemd", "state", state, "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Debug("notifying systemd", "state", state, "err", err)
+	}
+}
+
+// ready reports that the config is valid and the sinks are open.
+func (n *notifier) ready() {
+	n.notify("READY=1")
+}
+
+// stopping reports that the service is shutting down, once.
+func (n *notifier) stopping() {
+	n.stopped.Do(func() { n.notify("STOPPING=1") })
+}
+
+// ping tells the watchdog the run loop is alive. It sends at most one ping
+// per half watchdog interval, so it can be called for every result.
+func (n *notifier) ping() {
+	if n.watchdog == 0 {
+		return
+	}
+	n.mu.Lock()
+	due := time.Since(n.lastPing) >= n.watchdog/2
+	if due {
+		n.lastPing = time.Now()
+	}
+	n.mu.Unlock()
+	if due {
+		n.notify("WATCHDOG=1")
+	}
+}
+
+// waiting keeps pinging the watchdog while the run loop waits for its next
+// pass, until the returned func is called.
+func (n *notifier) waiting(ctx context.Context) func() {
+	if n.watchdog == 0 {
+		return func() {}
+	}
+	ctx, stop := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(n.watchdog / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n.ping()
+			}
+		}
+	}()
+	return stop
+}
+
+// journalHandler writes log lines to a stream systemd sends to the journal,
+// each starting with the <N> syslog priority of its level and without a
+// time, which the journal records itself.
+type journalHandler struct {
+	slog.Handler
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+	out io.Writer
+}
+
+func newJournalHandler(out io.Writer, level slog.Leveler) *journalHandler {
+	buf := new(bytes.Buffer)
+	return &journalHandler{
+		Handler: slog.NewTextHandler(buf, &slog.HandlerOptions{Level: level, ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			return a
+		}}),
+		mu:  new(sync.Mutex),
+		buf: buf,
+		out: out,
+	}
+}
+
+func (h *journalHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	if err := h.Handler.Handle(ctx, r); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(h.out, "<%d>%s", journalPriority(r.Level), h.buf.Bytes())
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &journalHandler{Handler: h.Handler.WithAttrs(attrs), mu: h.mu, buf: h.buf, out: h.out}
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	return &journalHandler{Handler: h.Handler.WithGroup(name), mu: h.mu, buf: h.buf, out: h.out}
+}
+
+// journalPriority maps level to its syslog priority: err, warning, info or
+// debug.
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
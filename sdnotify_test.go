@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// notifySocket listens where systemd would for notifications, returning
+// its path and a func reading what arrived within wait.
+func notifySocket(t *testing.T, name string) (string, func(wait time.Duration) []string) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return name, func(wait time.Duration) []string {
+		var got []string
+		buf := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(wait))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return got
+			}
+			got = append(got, string(buf[:n]))
+		}
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	path, read := notifySocket(t, filepath.Join(t.TempDir(), "notify"))
+	t.Setenv("NOTIFY_SOCKET", path)
+	t.Setenv("WATCHDOG_USEC", "200000")
+	t.Setenv("WATCHDOG_PID", "")
+	n := newNotifier()
+	if n.watchdog != 200*time.Millisecond {
+		t.Fatalf("watchdog %v", n.watchdog)
+	}
+	n.ready()
+	// Pings go out at most once per half interval, however often asked.
+	for range 10 {
+		n.ping()
+	}
+	n.stopping()
+	n.stopping()
+	if got := read(50 * time.Millisecond); strings.Join(got, " ") != "READY=1 WATCHDOG=1 STOPPING=1" {
+		t.Errorf("sent %q", got)
+	}
+
+	// While waiting for the next pass the watchdog keeps being pinged.
+	stop := n.waiting(context.Background())
+	time.Sleep(350 * time.Millisecond)
+	stop()
+	pings := read(100 * time.Millisecond)
+	if len(pings) < 2 || len(pings) > 4 {
+		t.Errorf("%d pings over 350ms with a 200ms watchdog: %q", len(pings), pings)
+	}
+	if after := read(150 * time.Millisecond); len(after) != 0 {
+		t.Errorf("pinged %q after waiting", after)
+	}
+
+	// The watchdog is another process's to ping when WATCHDOG_PID says so.
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if n := newNotifier(); n.watchdog != 0 || n.addr == nil {
+		t.Errorf("watchdog %v for another pid", n.watchdog)
+	}
+}
+
+func TestNotifierAbstract(t *testing.T) {
+	name := fmt.Sprintf("yaperf-test-%d", os.Getpid())
+	_, read := notifySocket(t, "\x00"+name)
+	t.Setenv("NOTIFY_SOCKET", "@"+name)
+	newNotifier().ready()
+	if got := read(50 * time.Millisecond); len(got) != 1 || got[0] != "READY=1" {
+		t.Errorf("sent %q", got)
+	}
+}
+
+func TestNotifierOff(t *testing.T) {
+	// Outside systemd nothing is sent and nothing waits.
+	t.Setenv("NOTIFY_SOCKET", "")
+	t.Setenv("WATCHDOG_USEC", "200000")
+	n := newNotifier()
+	n.ready()
+	n.ping()
+	n.waiting(context.Background())()
+	n.stopping()
+	if n.addr != nil || n.watchdog != 0 {
+		t.Errorf("notifier %+v outside systemd", n)
+	}
+	// A socket that has gone away is not an error.
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "gone"))
+	newNotifier().ready()
+}
+
+func TestJournalHandler(t *testing.T) {
+	var out bytes.Buffer
+	level := new(slog.LevelVar)
+	logger := slog.New(newJournalHandler(&out, level))
+	logger.Debug("hidden")
+	logger.Info("pass done", "pass", 1)
+	logger.Warn("slow", "url", "https://example.com/")
+	logger.With("run", "r1").WithGroup("tcp").Error("failed", "retrans", 3)
+	level.Set(slog.LevelDebug)
+	logger.Debug("shown")
+	want := "<6>msg=\"pass done\" pass=1\n" +
+		"<4>msg=slow url=https://example.com/\n" +
+		"<3>msg=failed run=r1 tcp.retrans=3\n" +
+		"<7>msg=shown\n"
+	if out.String() != want {
+		t.Errorf("journal lines\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestServiceNotify(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	config := "log_format: journal\nurls:\n  - " + srv.URL + "/a\n  - " + srv.URL + "/b\n"
+	if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path, read := notifySocket(t, filepath.Join(dir, "notify"))
+	var stderr strings.Builder
+	cmd := yaperf(dir, "-v")
+	cmd.Env = append(cmd.Env, "NOTIFY_SOCKET="+path, "WATCHDOG_USEC=60000000", "WATCHDOG_PID=")
+	cmd.Stderr = &stderr
+	if code := exitCode(t, cmd, time.Minute); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, stderr.String())
+	}
+	// Ready before the first result, a ping for it, stopping on the way
+	// out.
+	if got := read(100 * time.Millisecond); strings.Join(got, " ") != "READY=1 WATCHDOG=1 STOPPING=1" {
+		t.Errorf("sent %q", got)
+	}
+	if !strings.Contains(stderr.String(), "\n<7>msg=") {
+		t.Errorf("stderr has no journal lines:\n%s", stderr.String())
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// selftestDelay is how long the self test's server holds each latency
+// probe, the round trip the latency check expects.
+const selftestDelay = 25 * time.Millisecond
+
+// selftestCheck is one check of yaperf selftest: it tests the target
+// made for the address of the local server and holds the value measure
+// takes of its final result within tolerance, a share of want, of want.
+type selftestCheck struct {
+	name      string
+	target    func(base string) perf.Target
+	measure   func(perf.Stats) float64
+	want      float64
+	tolerance float64
+	unit      string
+}
+
+// selftestChecks are the checks yaperf selftest runs, in order.
+var selftestChecks = []selftestCheck{
+	{
+		name: "download rate",
+		target: func(base string) perf.Target {
+			return perf.Target{URL: base + "/download/10MB", Simulate: &perf.Simulate{Bandwidth: perf.Rate(40e6)}}
+		},
+		measure:   func(s perf.Stats) float64 { return s.SpeedMbps },
+		want:      40,
+		tolerance: 0.1,
+		unit:      "Mbps",
+	},
+	{
+		name: "samples",
+		target: func(base string) perf.Target {
+			return perf.Target{URL: base + "/download/5MB", Simulate: &perf.Simulate{Bandwidth: perf.Rate(40e6)}}
+		},
+		measure: func(s perf.Stats) float64 {
+			var n int64
+			for _, sample := range s.Samples {
+				n += sample.Bytes
+			}
+			return float64(n)
+		},
+		want:      5e6,
+		tolerance: 0.01,
+		unit:      "bytes",
+	},
+	{
+		name: "upload",
+		target: func(base string) perf.Target {
+			return perf.Target{URL: base + "/upload", Method: perf.MethodUpload, UploadSize: 4e6}
+		},
+		measure: func(s perf.Stats) float64 { return float64(s.SizeBytes) },
+		want:    4e6,
+		unit:    "bytes",
+	},
+	{
+		name: "latency",
+		target: func(base string) perf.Target {
+			return perf.Target{URL: base + "/slow", Method: perf.MethodLatency, Probes: 5}
+		},
+		measure: func(s perf.Stats) float64 {
+			if s.Latency == nil {
+				return 0
+			}
+			return ms(s.Latency.P50)
+		},
+		want:      ms(selftestDelay),
+		tolerance: 0.5,
+		unit:      "ms",
+	},
+	{
+		name: "checksum",
+		target: func(base string) perf.Target {
+			return perf.Target{URL: base + "/download/1MB", SHA256: patternSHA256(1e6)}
+		},
+		measure: func(s perf.Stats) float64 { return float64(s.SizeBytes) },
+		want:    1e6,
+		unit:    "bytes verified",
+	},
+	{
+		name: "checksum mismatch",
+		target: func(base string) perf.Target {
+			return perf.Target{URL: base + "/download/1MB", SHA256: patternSHA256(1e6 - 1)}
+		},
+		measure: func(s perf.Stats) float64 {
+			var mismatch *perf.ChecksumError
+			if errors.As(s.Error, &mismatch) {
+				return 1
+			}
+			return 0
+		},
+		want: 1,
+		unit: "mismatch found",
+	},
+	{
+		name: "json output",
+		target: func(base string) perf.Target {
+			return perf.Target{URL: base + "/download/1MB"}
+		},
+		measure: func(s perf.Stats) float64 {
+			data, err := json.Marshal(newJSONResult(s))
+			var back jsonResult
+			if err != nil || json.Unmarshal(data, &back) != nil || s.SpeedMbps == 0 {
+				return 0
+			}
+			return back.stats().SpeedMbps / s.SpeedMbps
+		},
+		want:      1,
+		tolerance: 0.001,
+		unit:      "of the speed",
+	},
+}
+
+// patternSHA256 is the SHA-256 of the first n bytes the payload server
+// sends with seed 0.
+func patternSHA256(n int) string {
+	body := make([]byte, n)
+	perf.NewPattern(0).Fill(body, 0)
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// selftestValue formats v whole when it is, and to two places otherwise.
+func selftestValue(v float64) string {
+	if v == math.Trunc(v) {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.2f", v)
+}
+
+// passes reports whether got is within the tolerance of the check.
+func (c selftestCheck) passes(got float64) bool {
+	return math.Abs(got-c.want) <= c.tolerance*math.Abs(c.want)
+}
+
+// runSelftest implements "yaperf selftest": it serves payloads on
+// localhost, runs every check against them in this process and prints
+// PASS or FAIL for each, exiting 1 if any failed.
+func runSelftest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	timeout := fs.Duration("timeout", time.Minute, "time allowed for all checks")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: yaperf selftest [-timeout d]")
+		fmt.Fprintln(fs.Output(), "checks the measurements of yaperf against a payload server on localhost")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "selftest:", err)
+		return 1
+	}
+	mux := payloadMux(perf.NewPattern(0))
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(selftestDelay)
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	defer srv.Close()
+	base := "http://" + ln.Addr().String()
+
+	config := perf.Config{}
+	for _, c := range selftestChecks {
+		config.URLs = append(config.URLs, c.target(base))
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "selftest:", err)
+		return 1
+	}
+	tester, err := newTester(config, perf.NewRunID(), "selftest", time.Now(), nil, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "selftest:", err)
+		return 1
+	}
+	defer tester.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for i, c := range selftestChecks {
+		var final perf.Stats
+		for s := range tester.Test(ctx, config.URLs[i]) {
+			if s.Final() {
+				final = s
+			}
+		}
+		got := c.measure(final)
+		status, detail := "PASS", fmt.Sprintf("%s %s, want %s", selftestValue(got), c.unit, selftestValue(c.want))
+		if c.tolerance > 0 {
+			detail += fmt.Sprintf(" ±%g%%", c.tolerance*100)
+		}
+		if !c.passes(got) {
+			status = "FAIL"
+			failed++
+			if final.Error != nil {
+				detail += ": " + final.Error.Error()
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", status, c.name, detail)
+	}
+	w.Flush()
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, len(selftestChecks))
+		return 1
+	}
+	fmt.Printf("all %d checks passed\n", len(selftestChecks))
+	return 0
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func TestSelftestCheckPasses(t *testing.T) {
+	rate := selftestCheck{want: 40, tolerance: 0.1}
+	exact := selftestCheck{want: 4e6}
+	tests := []struct {
+		check selftestCheck
+		got   float64
+		want  bool
+	}{
+		{rate, 40, true},
+		{rate, 36, true},
+		{rate, 44, true},
+		{rate, 35.9, false},
+		{rate, 44.1, false},
+		{rate, 0, false},
+		{exact, 4e6, true},
+		{exact, 4e6 - 1, false},
+	}
+	for _, tt := range tests {
+		if got := tt.check.passes(tt.got); got != tt.want {
+			t.Errorf("%v±%g%%: passes(%v) = %v, want %v", tt.check.want, tt.check.tolerance*100, tt.got, got, tt.want)
+		}
+	}
+}
+
+func TestSelftestValue(t *testing.T) {
+	for v, want := range map[float64]string{4e6: "4000000", 39.987: "39.99", 0: "0", 0.5: "0.50"} {
+		if got := selftestValue(v); got != want {
+			t.Errorf("selftestValue(%v) = %q, want %q", v, got, want)
+		}
+	}
+}
+
+// TestSelftestMeasures feeds every check the result its truth should
+// yield, and one well off it.
+func TestSelftestMeasures(t *testing.T) {
+	truth := map[string]perf.Stats{
+		"download rate":     {SpeedMbps: 40},
+		"samples":           {Samples: []perf.Sample{{Bytes: 3e6}, {Bytes: 2e6}}},
+		"upload":            {SizeBytes: 4e6},
+		"latency":           {Latency: &perf.LatencyStats{P50: selftestDelay}},
+		"checksum":          {SizeBytes: 1e6},
+		"checksum mismatch": {Error: &perf.ChecksumError{Algorithm: "sha256"}},
+		"json output":       {SpeedMbps: 123.456, Elapsed: time.Second, Done: true},
+	}
+	off := map[string]perf.Stats{
+		"download rate":     {SpeedMbps: 20},
+		"samples":           {Samples: []perf.Sample{{Bytes: 3e6}}},
+		"upload":            {SizeBytes: 1e6},
+		"latency":           {},
+		"checksum":          {},
+		"checksum mismatch": {Done: true},
+		"json output":       {},
+	}
+	for _, c := range selftestChecks {
+		s, ok := truth[c.name]
+		if !ok {
+			t.Errorf("no truth for check %q", c.name)
+			continue
+		}
+		if got := c.measure(s); !c.passes(got) {
+			t.Errorf("%s: measured %v from its truth, want %v", c.name, got, c.want)
+		}
+		if got := c.measure(off[c.name]); c.passes(got) {
+			t.Errorf("%s: measured %v from a wrong result, and passed", c.name, got)
+		}
+	}
+}
+
+func TestSelftest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs every check against a local server")
+	}
+	if code := runSelftest(nil); code != 0 {
+		t.Errorf("selftest exited %d", code)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// maxRecentTests bounds how many tests the API remembers.
+const maxRecentTests = 100
+
+// testRunner runs the tests of the API; *perf.Tester is one.
+type testRunner interface {
+	Test(ctx context.Context, target perf.Target) <-chan perf.Stats
+}
+
+// apiServer runs tests on demand for the HTTP control API. Results also go
+// to the reporters, one at a time since reporters are not safe for
+// concurrent use.
+type apiServer struct {
+	ctx    context.Context
+	tester testRunner
+	pause  *pauser
+	slots  chan struct{}
+	// origins are the browser origins allowed to open /ws besides the
+	// API's own host.
+	origins []string
+	wg      sync.WaitGroup
+
+	reportMu  sync.Mutex
+	reporters multiReporter
+	// hub streams what the reporters see to the clients of /ws.
+	hub *wsHub
+
+	mu    sync.Mutex
+	tests map[string]*apiTest
+	order []string
+	// closing is set once the server shuts down, after which no test may
+	// join wg.
+	closing bool
+}
+
+// apiTest is one test started through the API.
+type apiTest struct {
+	id      string
+	started time.Time
+	cancel  context.CancelFunc
+
+	mu   sync.Mutex
+	last perf.Stats
+}
+
+// testRequest is the body of POST /tests.
+type testRequest struct {
+	URL      string `json:"url"`
+	Name     string `json:"name"`
+	MaxBytes int64  `json:"max_bytes"`
+	Streams  int    `json:"streams"`
+}
+
+// testStatus describes a test in API responses.
+type testStatus struct {
+	ID      string      `json:"id"`
+	State   string      `json:"state"`
+	Started time.Time   `json:"started"`
+	Result  *jsonResult `json:"result,omitempty"`
+}
+
+// serveAPI serves the control API on addr until ctx is cancelled, running
+// up to concurrency tests at a time, and none while pause is paused.
+// Running tests are cancelled on the way out and their results still
+// reported. Browsers may open /ws from the API's own host or from origins.
+func serveAPI(ctx context.Context, addr string, origins []string, tester testRunner, reporters multiReporter, concurrency int, pause *pauser) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("serve: %w", err)
+	}
+	hub := newWSHub()
+	s := &apiServer{
+		ctx:       ctx,
+		tester:    tester,
+		pause:     pause,
+		slots:     make(chan struct{}, max(concurrency, 1)),
+		origins:   origins,
+		reporters: append(slices.Clip(reporters), hub),
+		hub:       hub,
+		tests:     map[string]*apiTest{},
+	}
+	slog.Info("serving the test API", "addr", ln.Addr())
+	return s.serve(ln)
+}
+
+// handler routes the requests of the API.
+func (s *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /tests", s.start)
+	mux.HandleFunc("GET /tests", s.list)
+	mux.HandleFunc("GET /tests/{id}", s.get)
+	mux.HandleFunc("DELETE /tests/{id}", s.cancel)
+	mux.HandleFunc("GET /status", s.status)
+	mux.HandleFunc("GET /ws", s.ws)
+	return mux
+}
+
+// serve serves the API on ln until s.ctx is cancelled, then waits for the
+// tests it started.
+func (s *apiServer) serve(ln net.Listener) error {
+	srv := &http.Server{Handler: s.handler()}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-s.ctx.Done()
+		s.mu.Lock()
+		s.closing = true
+		s.mu.Unlock()
+		s.hub.close()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	err := srv.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		// Serve returns as soon as the listener closes, while handlers
+		// may still be starting tests.
+		<-stopped
+		err = nil
+	}
+	s.wg.Wait()
+	return err
+}
+
+// serverStatus is the body of GET /status.
+type serverStatus struct {
+	Paused bool   `json:"paused"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (s *apiServer) status(w http.ResponseWriter, _ *http.Request) {
+	s.pause.check()
+	paused, reason := s.pause.paused()
+	writeJSON(w, http.StatusOK, serverStatus{Paused: paused, Reason: reason})
+}
+
+func (s *apiServer) start(w http.ResponseWriter, r *http.Request) {
+	s.pause.check()
+	if paused, reason := s.pause.paused(); paused {
+		http.Error(w, "paused by "+reason, http.StatusServiceUnavailable)
+		return
+	}
+	// A JSON body cannot be sent across sites without a CORS preflight,
+	// which the API never grants, so web pages cannot start tests.
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "want Content-Type: application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var req testRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	target := perf.Target{URL: req.URL, Name: req.Name, Streams: req.Streams}
+	target.MaxBytes = perf.ByteSize(req.MaxBytes)
+	if req.MaxBytes < 0 {
+		http.Error(w, "max_bytes must not be negative", http.StatusBadRequest)
+		return
+	}
+	// Anyone who can reach the API could otherwise read local files or
+	// open connections to any port.
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		http.Error(w, "url must be http or https", http.StatusBadRequest)
+		return
+	}
+	if err := target.Problems().Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		http.Error(w, "too many tests running", http.StatusTooManyRequests)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	test := &apiTest{id: perf.NewRunID(), started: time.Now(), cancel: cancel}
+	test.last = perf.Stats{URL: target.URL, Name: target.Name}
+	if !s.remember(test) {
+		cancel()
+		<-s.slots
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	go func() {
+		defer s.wg.Done()
+		defer func() { <-s.slots }()
+		defer cancel()
+		for result := range s.tester.Test(ctx, target) {
+			test.mu.Lock()
+			test.last = result
+			test.mu.Unlock()
+			s.reportMu.Lock()
+			report(s.reporters, result)
+			s.reportMu.Unlock()
+		}
+	}()
+
+	w.Header().Set("Location", "/tests/"+test.id)
+	writeJSON(w, http.StatusAccepted, test.status())
+}
+
+// remember adds test to the index, forgetting the oldest finished ones
+// past maxRecentTests, and counts it in wg. It reports false once the
+// server is shutting down.
+func (s *apiServer) remember(test *apiTest) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.wg.Add(1)
+	s.tests[test.id] = test
+	s.order = append(s.order, test.id)
+	for len(s.order) > maxRecentTests {
+		oldest := s.tests[s.order[0]]
+		if oldest.status().State == "running" {
+			break
+		}
+		delete(s.tests, s.order[0])
+		s.order = s.order[1:]
+	}
+	return true
+}
+
+func (s *apiServer) list(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	statuses := make([]testStatus, 0, len(s.order))
+	for i := len(s.order) - 1; i >= 0; i-- {
+		statuses = append(statuses, s.tests[s.order[i]].status())
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (s *apiServer) lookup(w http.ResponseWriter, r *http.Request) *apiTest {
+	s.mu.Lock()
+	test := s.tests[r.PathValue("id")]
+	s.mu.Unlock()
+	if test == nil {
+		http.Error(w, "no such test", http.StatusNotFound)
+	}
+	return test
+}
+
+func (s *apiServer) get(w http.ResponseWriter, r *http.Request) {
+	if test := s.lookup(w, r); test != nil {
+		writeJSON(w, http.StatusOK, test.status())
+	}
+}
+
+func (s *apiServer) cancel(w http.ResponseWriter, r *http.Request) {
+	if test := s.lookup(w, r); test != nil {
+		test.cancel()
+		writeJSON(w, http.StatusAccepted, test.status())
+	}
+}
+
+// status reports the test's latest snapshot. A test stays "running" until
+// its final snapshot arrives, which follows shortly after a cancel.
+func (t *apiTest) status() testStatus {
+	t.mu.Lock()
+	last := t.last
+	t.mu.Unlock()
+	status := testStatus{ID: t.id, State: "running", Started: t.started}
+	switch last.Kind {
+	case perf.KindCancelled:
+		status.State = "cancelled"
+	case perf.KindError:
+		status.State = "failed"
+	case perf.KindFinal, perf.KindSkipped:
+		status.State = "done"
+	}
+	if last.Direction != "" {
+		result := newJSONResult(last)
+		status.Result = &result
+	}
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// fakeRunner reports a download in progress until release is closed, when
+// it finishes, or until it is cancelled.
+type fakeRunner struct {
+	release chan struct{}
+}
+
+func (f fakeRunner) Test(ctx context.Context, target perf.Target) <-chan perf.Stats {
+	ch := make(chan perf.Stats)
+	go func() {
+		defer close(ch)
+		s := perf.Stats{URL: target.URL, Name: target.Name, Direction: perf.Download, Kind: perf.KindProgress, SizeBytes: 1000}
+		ch <- s
+		select {
+		case <-ctx.Done():
+			s.Kind, s.Cancelled, s.Error = perf.KindCancelled, true, ctx.Err()
+		case <-f.release:
+			s.Kind, s.Done, s.SizeBytes = perf.KindFinal, true, 1e6
+		}
+		ch <- s
+	}()
+	return ch
+}
+
+// newTestAPI returns an apiServer that runs up to concurrency tests with
+// runner.
+func newTestAPI(t *testing.T, runner testRunner, concurrency int) *apiServer {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	hub := newWSHub()
+	return &apiServer{
+		ctx:       ctx,
+		tester:    runner,
+		pause:     newPauser(""),
+		slots:     make(chan struct{}, concurrency),
+		reporters: multiReporter{hub},
+		hub:       hub,
+		tests:     map[string]*apiTest{},
+	}
+}
+
+// call sends a request to srv and decodes its JSON answer into v, if any.
+func call(t *testing.T, srv *httptest.Server, method, path, body string, v any) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp
+}
+
+// awaitState polls the test at path until it is in state.
+func awaitState(t *testing.T, srv *httptest.Server, path, state string) testStatus {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var status testStatus
+		call(t, srv, "GET", path, "", &status)
+		if status.State == state {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is %q, want %q", path, status.State, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAPITestLifecycle(t *testing.T) {
+	runner := fakeRunner{release: make(chan struct{})}
+	s := newTestAPI(t, runner, 2)
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+
+	var first, second testStatus
+	resp := call(t, srv, "POST", "/tests", `{"url": "https://example.com/a", "name": "a", "max_bytes": 1000}`, &first)
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get("Location") != "/tests/"+first.ID || first.State != "running" {
+		t.Fatalf("POST: %d, Location %q, %+v", resp.StatusCode, resp.Header.Get("Location"), first)
+	}
+	call(t, srv, "POST", "/tests", `{"url": "https://example.com/b"}`, &second)
+	status := awaitState(t, srv, "/tests/"+first.ID, "running")
+	if status.Result == nil || status.Result.URL != "https://example.com/a" {
+		t.Errorf("running result = %+v", status.Result)
+	}
+
+	// A third one finds both slots taken.
+	if resp := call(t, srv, "POST", "/tests", `{"url": "https://example.com/c"}`, nil); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("third POST: %d, want 429", resp.StatusCode)
+	}
+
+	if resp := call(t, srv, "DELETE", "/tests/"+second.ID, "", nil); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("DELETE: %d", resp.StatusCode)
+	}
+	awaitState(t, srv, "/tests/"+second.ID, "cancelled")
+	close(runner.release)
+	if status := awaitState(t, srv, "/tests/"+first.ID, "done"); status.Result.SizeBytes != 1e6 {
+		t.Errorf("done result = %+v", status.Result)
+	}
+
+	var list []testStatus
+	call(t, srv, "GET", "/tests", "", &list)
+	if len(list) != 2 || list[0].ID != second.ID || list[1].ID != first.ID {
+		t.Errorf("GET /tests = %+v, want the two tests newest first", list)
+	}
+	if resp := call(t, srv, "GET", "/tests/nope", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of an unknown test: %d", resp.StatusCode)
+	}
+	if resp := call(t, srv, "DELETE", "/tests/nope", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("DELETE of an unknown test: %d", resp.StatusCode)
+	}
+}
+
+func TestAPIRejects(t *testing.T) {
+	s := newTestAPI(t, fakeRunner{release: make(chan struct{})}, 1)
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		code        int
+	}{
+		{"no content type", "", `{"url": "https://example.com/"}`, http.StatusUnsupportedMediaType},
+		{"form", "application/x-www-form-urlencoded", `url=https://example.com/`, http.StatusUnsupportedMediaType},
+		{"bad JSON", "application/json", `{"url": `, http.StatusBadRequest},
+		{"negative max_bytes", "application/json", `{"url": "https://example.com/", "max_bytes": -1}`, http.StatusBadRequest},
+		{"bad streams", "application/json", `{"url": "https://example.com/", "streams": -2}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", srv.URL+"/tests", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.code {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.code)
+			}
+		})
+	}
+	if len(s.tests) != 0 {
+		t.Errorf("%d tests started", len(s.tests))
+	}
+}
+
+func TestAPIRejectsLocalSchemes(t *testing.T) {
+	s := newTestAPI(t, fakeRunner{release: make(chan struct{})}, 1)
+	for _, url := range []string{
+		"file:///etc/passwd",
+		"FILE:///etc/passwd",
+		"tcp://127.0.0.1:22?bytes=100",
+		"ftp://127.0.0.1/file",
+		"127.0.0.1:22",
+	} {
+		t.Run(url, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/tests", strings.NewReader(`{"url": "`+url+`"}`))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			s.start(w, req)
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "http or https") {
+				t.Errorf("status %d %q, want 400", w.Code, w.Body)
+			}
+			if len(s.tests) != 0 {
+				t.Errorf("%d tests started", len(s.tests))
+			}
+		})
+	}
+}
+
+func TestAPIPaused(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pause")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestAPI(t, fakeRunner{release: make(chan struct{})}, 1)
+	s.pause = newPauser(file)
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+	if resp := call(t, srv, "POST", "/tests", `{"url": "https://example.com/"}`, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("POST while paused: %d, want 503", resp.StatusCode)
+	}
+	var status serverStatus
+	call(t, srv, "GET", "/status", "", &status)
+	if !status.Paused || status.Reason == "" {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+// TestAPIShutdown starts tests while the server shuts down; run it with
+// -race.
+func TestAPIShutdown(t *testing.T) {
+	s := newTestAPI(t, fakeRunner{release: make(chan struct{})}, 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.ctx = ctx
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.serve(ln) }()
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				resp, err := http.Post("http://"+ln.Addr().String()+"/tests", "application/json", strings.NewReader(`{"url": "https://example.com/"}`))
+				if err != nil {
+					return
+				}
+				resp.Body.Close()
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return")
+	}
+	wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tests) == 0 {
+		t.Fatal("no tests started")
+	}
+	// serve waited for every test it started to report its end.
+	for _, test := range s.tests {
+		if state := test.status().State; state != "cancelled" {
+			t.Errorf("test %s is %q after serve returned", test.id, state)
+		}
+	}
+	if resp, err := http.Get("http://" + ln.Addr().String() + "/status"); err == nil {
+		resp.Body.Close()
+		t.Error("still serving after shutdown")
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"yaperf/pkg/perf"
+)
+
+// sinkBuffer is how many snapshots a sink may fall behind before the
+// progress snapshots that do not fit are dropped for it.
+const sinkBuffer = 256
+
+// sink stores or forwards snapshots. Write errors are logged and never stop
+// the test run. A sink that is an io.Closer is closed at the end of the
+// run.
+type sink interface {
+	Write(perf.Stats) error
+}
+
+// sinkReporter feeds every snapshot routed to a sink to it as a reporter.
+// The sink is written from a goroutine of its own through a bounded queue,
+// so a sink that is slow never holds up the transfers: a progress snapshot
+// that does not fit is dropped and counted, while final results, passes
+// and rollups wait for room, keeping their order.
+type sinkReporter struct {
+	sink
+	name    string
+	queue   chan func()
+	dropped atomic.Int64
+	done    sync.WaitGroup
+	once    sync.Once
+}
+
+func newSinkReporter(name string, s sink) *sinkReporter {
+	r := &sinkReporter{sink: s, name: name, queue: make(chan func(), sinkBuffer)}
+	r.done.Add(1)
+	go func() {
+		defer r.done.Done()
+		for job := range r.queue {
+			job()
+		}
+	}()
+	return r
+}
+
+func (s *sinkReporter) write(result perf.Stats) {
+	if err := s.Write(result); err != nil {
+		slog.Error("writing result", "sink", s.name, "err", err)
+	}
+}
+
+// takes reports whether result is routed to the sink: it is unless the
+// sinks of its target leave the sink out.
+func (s *sinkReporter) takes(result perf.Stats) bool {
+	return result.Sinks == nil || slices.Contains(result.Sinks, s.name)
+}
+
+func (s *sinkReporter) OnProgress(result perf.Stats) {
+	if !s.takes(result) {
+		return
+	}
+	select {
+	case s.queue <- func() { s.write(result) }:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *sinkReporter) OnComplete(result perf.Stats) {
+	if s.takes(result) {
+		s.queue <- func() { s.write(result) }
+	}
+}
+
+func (s *sinkReporter) OnSummary([]perf.Summary) {}
+
+// OnPass passes the table on to sinks that keep something of each pass.
+func (s *sinkReporter) OnPass(table resultTable) {
+	if p, ok := s.sink.(interface{ OnPass(resultTable) }); ok {
+		s.queue <- func() { p.OnPass(table) }
+	}
+}
+
+// drain writes what is still queued and stops the sink's goroutine. The
+// sink takes no more snapshots after it.
+func (s *sinkReporter) drain() {
+	s.once.Do(func() {
+		close(s.queue)
+		s.done.Wait()
+		if n := s.dropped.Load(); n > 0 {
+			slog.Warn("sink fell behind, dropped progress snapshots", "sink", s.name, "dropped", n)
+		}
+	})
+}
+
+// sinkReporters are the sinks of a run, drained together before the run
+// reads back what they wrote and before they are closed.
+type sinkReporters []*sinkReporter
+
+func (ss sinkReporters) drain() {
+	for _, s := range ss {
+		s.drain()
+	}
+}
+
+// States of a sink, as the manifest gives them.
+const (
+	sinkOK          = "ok"
+	sinkDegraded    = "degraded"
+	sinkCloseFailed = "close_failed"
+)
+
+// sinkState is how a sink of the run fared.
+type sinkState struct {
+	Name     string `json:"name"`
+	Required bool   `json:"required"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// sinkSet sets up the sinks of a run under their policies and closes them
+// at its end.
+type sinkSet struct {
+	policies  map[string]perf.SinkConfig
+	reporters sinkReporters
+
+	mu     sync.Mutex
+	states []sinkState
+}
+
+func newSinkSet(policies map[string]perf.SinkConfig) *sinkSet {
+	return &sinkSet{policies: policies}
+}
+
+// open takes on s, the sink called name, whose setup returned err. When
+// that failed, open returns the error for a required sink, and logs it and
+// returns no reporter for any other, which the run goes on without.
+func (ss *sinkSet) open(name string, s sink, err error) (*sinkReporter, error) {
+	required := ss.policies[name].IsRequired()
+	if err != nil {
+		if required {
+			return nil, err
+		}
+		slog.Warn("sink is not required, running without it", "sink", name, "err", err)
+		ss.set(sinkState{Name: name, Status: sinkDegraded, Error: err.Error()})
+		return nil, nil
+	}
+	ss.set(sinkState{Name: name, Required: required, Status: sinkOK})
+	r := newSinkReporter(name, s)
+	ss.reporters = append(ss.reporters, r)
+	return r, nil
+}
+
+func (ss *sinkSet) set(state sinkState) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for i := range ss.states {
+		if ss.states[i].Name == state.Name {
+			ss.states[i] = state
+			return
+		}
+	}
+	ss.states = append(ss.states, state)
+}
+
+// list returns the states of the sinks, in the order they were set up.
+func (ss *sinkSet) list() []sinkState {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return append([]sinkState(nil), ss.states...)
+}
+
+// close drains the sinks and closes them, the last set up first. Every
+// sink is closed; the error is that of the first required one that
+// failed.
+func (ss *sinkSet) close() error {
+	ss.reporters.drain()
+	var failed error
+	for i := len(ss.reporters) - 1; i >= 0; i-- {
+		r := ss.reporters[i]
+		c, ok := r.sink.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := c.Close(); err != nil {
+			required := ss.policies[r.name].IsRequired()
+			slog.Error("closing sink", "sink", r.name, "err", err)
+			ss.set(sinkState{Name: r.name, Required: required, Status: sinkCloseFailed, Error: err.Error()})
+			if required && failed == nil {
+				failed = fmt.Errorf("closing %s: %w", r.name, err)
+			}
+		}
+	}
+	return failed
+}
+
+// openNamedSink sets up the sink def defines under name in sinks, as the
+// top-level key of the same kind would.
+func openNamedSink(name string, def perf.SinkConfig, config perf.Config, runID, host string, box *outbox) (sink, error) {
+	var s sink
+	var err error
+	switch {
+	case def.CSVFile != "":
+		s, err = opened(openCSVLog(def.CSVFile))
+	case def.Influx != nil:
+		s, err = opened(newInfluxSink(name, *def.Influx, box))
+	case def.OTel != nil:
+		s, err = opened(newOTelSink(*def.OTel, runID, host))
+	case def.StatsD != nil:
+		s, err = opened(newStatsdSink(*def.StatsD))
+	case def.Webhook != nil:
+		s, err = opened(newWebhook(name, *def.Webhook, config.URLs, box))
+	case def.SamplesFile != "":
+		s, err = opened(openSampleFile(def.SamplesFile))
+	case def.Socket.Path != "":
+		s, err = opened(openSocketSink(def.Socket.Path, def.Socket.EmitProgress))
+	default:
+		s, err = opened(openResultArchive(def.ResultsFile.Path, def.ResultsFile.EmitProgress, int64(config.RotateSize), config.RotateKeep))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sinks.%s: %w", name, err)
+	}
+	return s, nil
+}
+
+// opened is the sink a constructor returned, or no sink when it failed.
+func opened[S sink](s S, err error) (sink, error) {
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
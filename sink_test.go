@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// slowSink holds every write until it is let go, telling when the first
+// one arrives.
+type slowSink struct {
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+	got     []perf.Stats
+}
+
+func newSlowSink() *slowSink {
+	return &slowSink{entered: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (s *slowSink) Write(result perf.Stats) error {
+	s.once.Do(func() { close(s.entered) })
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.got = append(s.got, result)
+	return nil
+}
+
+func TestSinkReporterQueue(t *testing.T) {
+	s := newSlowSink()
+	set := newSinkSet(nil)
+	r, err := set.open("slow", s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMetrics("run-1", "edge-1", nil)
+	m.watch(set)
+	progress := func(n int64) perf.Stats {
+		return perf.Stats{Kind: perf.KindProgress, URL: "https://example.com/a", Direction: perf.Download, SizeBytes: n, IntervalSpeedMbps: 50}
+	}
+
+	// One snapshot is being written, the queue fills behind it, and what
+	// does not fit is dropped without holding up the sender.
+	r.OnProgress(progress(0))
+	<-s.entered
+	start := time.Now()
+	for i := range sinkBuffer + 10 {
+		r.OnProgress(progress(int64(i + 1)))
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("progress to a stuck sink took %v", took)
+	}
+	if n := r.dropped.Load(); n != 10 {
+		t.Errorf("%d dropped, want 10", n)
+	}
+	if body := scrape(t, m); !strings.Contains(body, `yaperf_sink_dropped_total{sink="slow",host="edge-1"} 10`+"\n") {
+		t.Errorf("no dropped count in\n%s", body)
+	}
+	// Another sink's snapshot is not queued at all.
+	other := progress(-1)
+	other.Sinks = []string{"influx"}
+	r.OnProgress(other)
+
+	// A final result waits for room rather than being dropped.
+	final := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/a", Direction: perf.Download, Done: true, SizeBytes: 1000}
+	sent := make(chan struct{})
+	go func() {
+		r.OnComplete(final)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("final result queued past a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(s.release)
+	<-sent
+	if err := set.close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.got) != sinkBuffer+2 {
+		t.Fatalf("%d written, want %d", len(s.got), sinkBuffer+2)
+	}
+	for i, got := range s.got[:sinkBuffer+1] {
+		if got.Kind != perf.KindProgress || got.SizeBytes != int64(i) {
+			t.Fatalf("write %d is %s of %d bytes", i, got.Kind, got.SizeBytes)
+		}
+	}
+	if last := s.got[len(s.got)-1]; last.Kind != perf.KindFinal {
+		t.Errorf("last write is %s", last.Kind)
+	}
+}
+
+// closingSink counts its writes and adds its name to closed when closed,
+// failing with err.
+type closingSink struct {
+	name   string
+	err    error
+	closed *[]string
+	writes atomic.Int32
+}
+
+func (s *closingSink) Write(perf.Stats) error {
+	s.writes.Add(1)
+	return nil
+}
+
+func (s *closingSink) Close() error {
+	*s.closed = append(*s.closed, s.name)
+	return s.err
+}
+
+func TestSinkSet(t *testing.T) {
+	logs := captureLog(t)
+	off := false
+	set := newSinkSet(map[string]perf.SinkConfig{"influx": {SinkPolicy: perf.SinkPolicy{Required: &off}}, "webhook": {SinkPolicy: perf.SinkPolicy{Required: &off}}})
+	var closed []string
+	sinks := map[string]*closingSink{}
+	for _, name := range []string{"csv_file", "influx", "statsd", "webhook"} {
+		sinks[name] = &closingSink{name: name, closed: &closed}
+	}
+
+	// A required sink that cannot be set up stops the run, an optional one
+	// is left out of it.
+	if r, err := set.open("otel", nil, errors.New("no collector")); r != nil || err == nil || err.Error() != "no collector" {
+		t.Errorf("required sink failing: %v, %v", r, err)
+	}
+	if r, err := set.open("influx", sinks["influx"], errors.New("connection refused")); r != nil || err != nil {
+		t.Errorf("optional sink failing: %v, %v", r, err)
+	}
+	if !strings.Contains(logs.String(), "sink is not required, running without it") || !strings.Contains(logs.String(), "sink=influx") {
+		t.Errorf("log:\n%s", logs)
+	}
+	for _, name := range []string{"csv_file", "statsd", "webhook"} {
+		r, err := set.open(name, sinks[name], nil)
+		if r == nil || err != nil {
+			t.Fatalf("%s: %v, %v", name, r, err)
+		}
+		r.OnComplete(perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/a", Done: true})
+	}
+
+	// Every sink is drained and closed, the last first, and only a
+	// required one failing to close fails the run.
+	sinks["webhook"].err = errors.New("flush failed")
+	sinks["statsd"].err = errors.New("socket closed")
+	err := set.close()
+	if err == nil || err.Error() != "closing statsd: socket closed" {
+		t.Errorf("close: %v", err)
+	}
+	if !slices.Equal(closed, []string{"webhook", "statsd", "csv_file"}) {
+		t.Errorf("closed %v", closed)
+	}
+	if n := sinks["csv_file"].writes.Load(); n != 1 {
+		t.Errorf("%d writes before closing, want 1", n)
+	}
+	want := []sinkState{
+		{Name: "influx", Status: sinkDegraded, Error: "connection refused"},
+		{Name: "csv_file", Required: true, Status: sinkOK},
+		{Name: "statsd", Required: true, Status: sinkCloseFailed, Error: "socket closed"},
+		{Name: "webhook", Status: sinkCloseFailed, Error: "flush failed"},
+	}
+	if got := set.list(); !slices.Equal(got, want) {
+		t.Errorf("states\n%+v\nwant\n%+v", got, want)
+	}
+
+	// The metrics flag every sink that is not ok.
+	m := newMetrics("run-1", "edge-1", nil)
+	m.watch(set)
+	body := scrape(t, m)
+	for _, line := range []string{
+		`yaperf_sink_degraded{sink="influx",required="false",host="edge-1"} 1`,
+		`yaperf_sink_degraded{sink="csv_file",required="true",host="edge-1"} 0`,
+		`yaperf_sink_degraded{sink="statsd",required="true",host="edge-1"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("no %s in\n%s", line, body)
+		}
+	}
+}
+
+func TestSinkPolicies(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	for _, required := range []bool{true, false} {
+		dir := t.TempDir()
+		config := "manifest: manifest.json\ncsv_file: missing/out.csv\nurls:\n  - " + srv.URL + "/a\n"
+		if !required {
+			config = "sinks:\n  csv_file: {required: false}\n" + config
+		}
+		if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var stderr strings.Builder
+		cmd := yaperf(dir)
+		cmd.Stderr = &stderr
+		before := requests.Load()
+		code := exitCode(t, cmd, time.Minute)
+		if required {
+			// The run stops before the first transfer.
+			if code != 1 || requests.Load() != before || !strings.Contains(stderr.String(), "out.csv") {
+				t.Errorf("required csv_file failing: exit code %d after %d requests\n%s", code, requests.Load()-before, stderr.String())
+			}
+			continue
+		}
+		if code != 0 || requests.Load() != before+1 || !strings.Contains(stderr.String(), "running without it") {
+			t.Errorf("optional csv_file failing: exit code %d after %d requests\n%s", code, requests.Load()-before, stderr.String())
+		}
+		doc := readManifest(t, filepath.Join(dir, "manifest.json"))
+		if len(doc.Sinks) != 1 || doc.Sinks[0].Name != "csv_file" || doc.Sinks[0].Status != sinkDegraded || doc.Sinks[0].Required {
+			t.Errorf("manifest sinks %+v", doc.Sinks)
+		}
+	}
+}
+
+// urlSink records the URL and kind of each write.
+type urlSink struct {
+	mu  sync.Mutex
+	got []string
+}
+
+func (s *urlSink) Write(result perf.Stats) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.got = append(s.got, string(result.Kind)+" "+result.URL)
+	return nil
+}
+
+func TestSinkRouting(t *testing.T) {
+	set := newSinkSet(nil)
+	prod, staging := &urlSink{}, &urlSink{}
+	for name, s := range map[string]*urlSink{"prod_influx": prod, "staging_csv": staging} {
+		if _, err := set.open(name, s, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results := []perf.Stats{
+		{URL: "https://prod/a", Sinks: []string{"prod_influx"}},
+		{URL: "https://staging/a", Sinks: []string{"staging_csv"}},
+		{URL: "https://both/a", Sinks: []string{"staging_csv", "prod_influx"}},
+		// Unrouted results go everywhere, and an empty route nowhere.
+		{URL: "https://all/a"},
+		{URL: "https://none/a", Sinks: []string{}},
+	}
+	for _, r := range set.reporters {
+		for _, result := range results {
+			result.Kind = perf.KindProgress
+			r.OnProgress(result)
+			result.Kind = perf.KindFinal
+			r.OnComplete(result)
+		}
+	}
+	if err := set.close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		sink *urlSink
+		urls []string
+	}{
+		{prod, []string{"https://prod/a", "https://both/a", "https://all/a"}},
+		{staging, []string{"https://staging/a", "https://both/a", "https://all/a"}},
+	} {
+		var want []string
+		for _, url := range tt.urls {
+			want = append(want, "progress "+url, "final "+url)
+		}
+		if !slices.Equal(tt.sink.got, want) {
+			t.Errorf("sink got %q, want %q", tt.sink.got, want)
+		}
+	}
+}
+
+func TestRoutedSinks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	// The staging URL takes the sinks of its group, the prod one names its
+	// own over those of the defaults, and the last takes the defaults'.
+	config := "sinks:\n  prod_csv: {csv_file: prod.csv}\n  staging_csv: {csv_file: staging.csv}\n" +
+		"csv_file: all.csv\ngroup_sinks:\n  staging: [staging_csv]\ndefaults:\n  sinks: [csv_file]\n" +
+		"urls:\n  - url: " + srv.URL + "/prod\n    sinks: [prod_csv, csv_file]\n  - url: " + srv.URL + "/staging\n    group: staging\n  - " + srv.URL + "/other\n"
+	if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stderr strings.Builder
+	cmd := yaperf(dir, "-q")
+	cmd.Stderr = &stderr
+	if code := exitCode(t, cmd, time.Minute); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, stderr.String())
+	}
+	for _, tt := range []struct {
+		file    string
+		in, out []string
+	}{
+		{"prod.csv", []string{"/prod"}, []string{"/staging", "/other"}},
+		{"staging.csv", []string{"/staging"}, []string{"/prod", "/other"}},
+		{"all.csv", []string{"/prod", "/other"}, []string{"/staging"}},
+	} {
+		raw, err := os.ReadFile(filepath.Join(dir, tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range tt.in {
+			if !strings.Contains(string(raw), srv.URL+path+",") {
+				t.Errorf("%s lacks %s:\n%s", tt.file, path, raw)
+			}
+		}
+		for _, path := range tt.out {
+			if strings.Contains(string(raw), srv.URL+path+",") {
+				t.Errorf("%s has %s:\n%s", tt.file, path, raw)
+			}
+		}
+	}
+}
+
+func TestArchiveEmitProgress(t *testing.T) {
+	records := []perf.Stats{
+		{Kind: perf.KindProgress, URL: "https://example.com/a", Direction: perf.Download, SizeBytes: 500, IntervalSpeedMbps: 40},
+		{Kind: perf.KindRetry, URL: "https://example.com/a", Direction: perf.Download, Retrying: true},
+		{Kind: perf.KindFinal, URL: "https://example.com/a", Direction: perf.Download, Done: true, SizeBytes: 1000, SpeedMbps: 50, IntervalSpeedMbps: 60},
+	}
+	for _, progress := range []bool{false, true} {
+		dir := t.TempDir()
+		a, err := openResultArchive(dir+"/results.jsonl", progress, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range records {
+			if err := a.Write(s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := readArchive(t, dir, "results.jsonl")
+		// Retried attempts are never streamed, and only progress carries
+		// the interval speed.
+		want := 1
+		if progress {
+			want = 2
+		}
+		if len(got) != want {
+			t.Fatalf("emit_progress %v: %d records, want %d", progress, len(got), want)
+		}
+		if progress && (got[0].Final || got[0].IntervalMbps != 40) {
+			t.Errorf("progress record %+v", got[0])
+		}
+		if last := got[len(got)-1]; !last.Final || last.IntervalMbps != 0 || last.SpeedMbps != 50 {
+			t.Errorf("final record %+v", last)
+		}
+	}
+}
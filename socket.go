@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// socketBuffer is how many lines a client may fall behind before the lines
+// that do not fit are dropped for it.
+const socketBuffer = 256
+
+// socketFlush bounds how long Close waits for a client to take the lines
+// still buffered for it.
+const socketFlush = time.Second
+
+// socketSink streams every final result, and with progress every progress
+// snapshot, as a JSON line to each client of a unix socket it listens on
+// at path, or into the named pipe already at path. Every client has its own buffer and writer, so one that reads
+// slowly or not at all loses lines, counted in dropped, rather than
+// holding up the run.
+type socketSink struct {
+	path     string
+	progress bool
+	ln       net.Listener // nil for a named pipe
+
+	mu      sync.Mutex
+	clients map[*socketClient]struct{}
+	closed  bool
+	dropped atomic.Int64
+	wg      sync.WaitGroup
+}
+
+type socketClient struct {
+	w     io.WriteCloser
+	lines chan []byte
+}
+
+func openSocketSink(path string, progress bool) (*socketSink, error) {
+	s := &socketSink{path: path, progress: progress, clients: map[*socketClient]struct{}{}}
+	info, err := os.Lstat(path)
+	switch {
+	case err == nil && info.Mode()&fs.ModeNamedPipe != 0:
+		// Opened for reading too, the pipe neither blocks the open until a
+		// reader comes nor fails writes while there is none.
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return nil, fmt.Errorf("socket: %w", err)
+		}
+		s.add(f)
+		return s, nil
+	case err == nil && info.Mode()&fs.ModeSocket != 0:
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket: %s is in use", path)
+		}
+		// Nothing listens on it: it was left by a run that did not exit
+		// cleanly.
+		os.Remove(path)
+	case err == nil:
+		return nil, fmt.Errorf("socket: %s exists and is not a socket or named pipe", path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("socket: %w", err)
+	}
+	s.ln = ln
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+func (s *socketSink) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("socket: accepting client", "err", err)
+			}
+			return
+		}
+		s.add(conn)
+	}
+}
+
+// add starts streaming lines to w, unless the sink is already closed.
+func (s *socketSink) add(w io.WriteCloser) {
+	c := &socketClient{w: w, lines: make(chan []byte, socketBuffer)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		w.Close()
+		return
+	}
+	s.clients[c] = struct{}{}
+	s.wg.Add(1)
+	go s.serve(c)
+}
+
+// serve writes c's lines until its buffer is closed or a write fails.
+func (s *socketSink) serve(c *socketClient) {
+	defer s.wg.Done()
+	defer c.w.Close()
+	for line := range c.lines {
+		if _, err := c.w.Write(line); err != nil {
+			slog.Debug("socket: client went away", "err", err)
+			s.mu.Lock()
+			if _, ok := s.clients[c]; ok {
+				delete(s.clients, c)
+				close(c.lines)
+			}
+			s.mu.Unlock()
+			// Drain what is left so nothing waits on the buffer.
+			for range c.lines {
+			}
+			return
+		}
+	}
+}
+
+func (s *socketSink) Write(result perf.Stats) error {
+	if !result.Final() && (!s.progress || result.Retrying) {
+		return nil
+	}
+	line, err := marshal(newJSONResult(result))
+	if err != nil {
+		return fmt.Errorf("socket: %w", err)
+	}
+	line = append(line, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		select {
+		case c.lines <- line:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+	return nil
+}
+
+// OnRollup streams rollups to the clients like results.
+func (s *socketSink) OnRollup(rollups []rollup) {
+	lines, err := rollupLines(rollups)
+	if err != nil {
+		slog.Error("socket: encoding rollup", "err", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		select {
+		case c.lines <- lines:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Close stops accepting clients, gives each up to socketFlush to take its
+// buffered lines, and removes the socket file.
+func (s *socketSink) Close() error {
+	if s.ln != nil {
+		s.ln.Close()
+		os.Remove(s.path)
+	}
+	s.mu.Lock()
+	s.closed = true
+	deadline := time.Now().Add(socketFlush)
+	for c := range s.clients {
+		if d, ok := c.w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+			d.SetWriteDeadline(deadline)
+		}
+		delete(s.clients, c)
+		close(c.lines)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	if n := s.dropped.Load(); n > 0 {
+		slog.Warn("socket: dropped results for clients that fell behind", "dropped", n)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// awaitClients waits for s to have n clients.
+func awaitClients(t *testing.T, s *socketSink, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		got := len(s.clients)
+		s.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients, want %d", got, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func socketResults() []perf.Stats {
+	final := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/a", Direction: perf.Download, Done: true, SizeBytes: 1000, SpeedMbps: 8}
+	progress := perf.Stats{Kind: perf.KindProgress, URL: "https://example.com/a", Direction: perf.Download, SizeBytes: 500}
+	retry := perf.Stats{Kind: perf.KindRetry, URL: "https://example.com/b", Direction: perf.Download, Retrying: true}
+	return []perf.Stats{progress, retry, final}
+}
+
+// readLines reads JSON lines from r until it is closed, keeping their
+// kinds.
+func readLines(t *testing.T, r *bufio.Scanner) []string {
+	t.Helper()
+	var kinds []string
+	for r.Scan() {
+		var line struct {
+			Kind string `json:"kind"`
+			URL  string `json:"url"`
+		}
+		if err := json.Unmarshal(r.Bytes(), &line); err != nil {
+			t.Fatalf("line %q: %v", r.Text(), err)
+		}
+		kinds = append(kinds, line.Kind+" "+line.URL)
+	}
+	return kinds
+}
+
+func TestSocketSinkStreams(t *testing.T) {
+	for _, progress := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "yaperf.sock")
+		s, err := openSocketSink(path, progress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var scanners []*bufio.Scanner
+		for range 2 {
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			scanners = append(scanners, bufio.NewScanner(conn))
+		}
+		awaitClients(t, s, 2)
+		for _, r := range socketResults() {
+			if err := s.Write(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Close flushes each client before hanging up.
+		s.Close()
+		want := "final https://example.com/a"
+		if progress {
+			want = "progress https://example.com/a,final https://example.com/a"
+		}
+		for i, sc := range scanners {
+			if got := strings.Join(readLines(t, sc), ","); got != want {
+				t.Errorf("progress %v, client %d read %q, want %q", progress, i, got, want)
+			}
+		}
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("socket file left behind: %v", err)
+		}
+	}
+}
+
+func TestSocketSinkSlowClient(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "yaperf.sock")
+	s, err := openSocketSink(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A client that never reads.
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	awaitClients(t, s, 1)
+	progress := socketResults()[0]
+	progress.URL = "https://example.com/" + strings.Repeat("x", 2000)
+	started := time.Now()
+	for range 2000 {
+		s.Write(progress)
+	}
+	if took := time.Since(started); took > 2*time.Second {
+		t.Errorf("writes held up for %v by a client that does not read", took)
+	}
+	started = time.Now()
+	s.Close()
+	if took := time.Since(started); took > socketFlush+time.Second {
+		t.Errorf("Close waited %v", took)
+	}
+	if s.dropped.Load() == 0 {
+		t.Error("no lines dropped for the client that fell behind")
+	}
+	// Written after Close, a result goes nowhere.
+	if err := s.Write(progress); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenSocketSink(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "yaperf.sock")
+	s, err := openSocketSink(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openSocketSink(path, false); err == nil || !strings.Contains(err.Error(), "is in use") {
+		t.Errorf("second sink on a live socket: %v", err)
+	}
+	s.Close()
+
+	// A socket left behind by a run that did not exit cleanly is replaced.
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	s, err = openSocketSink(path, false)
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	s.Close()
+
+	file := filepath.Join(dir, "results.json")
+	os.WriteFile(file, nil, 0o644)
+	if _, err := openSocketSink(file, false); err == nil || !strings.Contains(err.Error(), "is not a socket or named pipe") {
+		t.Errorf("regular file: %v", err)
+	}
+}
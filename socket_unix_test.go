@@ -0,0 +1,40 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSocketSinkNamedPipe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "yaperf.fifo")
+	if err := syscall.Mkfifo(path, 0o600); err != nil {
+		t.Skip(err)
+	}
+	s, err := openSocketSink(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range socketResults() {
+		s.Write(r)
+	}
+	// The sink holds the pipe open for reading as well, so opening the
+	// read end does not block.
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	go s.Close()
+	sc := bufio.NewScanner(f)
+	if got := readLines(t, sc); len(got) != 1 || got[0] != "final https://example.com/a" {
+		t.Errorf("read %q from the pipe", got)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("named pipe removed: %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// source produces the results of each pass, which the run loop hands to
+// the reporters, the summary and the checks alike whether they were
+// measured just now or recorded by an earlier run.
+type source interface {
+	// pass returns the results of pass over targets on a channel closed
+	// once the pass is over.
+	pass(ctx context.Context, pass int, targets []perf.Target) <-chan perf.Stats
+	// now is the time result came in at.
+	now(result perf.Stats) time.Time
+}
+
+// liveSource tests the targets, on this machine or on the agents.
+type liveSource struct {
+	tester      *perf.Tester
+	coord       *coordinator
+	concurrency int
+	trimRagged  bool
+}
+
+// use makes later passes run with config, tester and coord, as after a
+// reload.
+func (l *liveSource) use(config perf.Config, tester *perf.Tester, coord *coordinator) {
+	l.tester, l.coord, l.concurrency, l.trimRagged = tester, coord, config.Concurrency, config.TrimRagged
+}
+
+func (l *liveSource) pass(ctx context.Context, _ int, targets []perf.Target) <-chan perf.Stats {
+	switch {
+	case l.coord != nil:
+		return l.coord.Run(ctx, targets)
+	case l.concurrency > 1:
+		return perf.Aggregate(l.tester.Run(ctx, targets, l.concurrency), l.trimRagged)
+	}
+	return l.tester.Run(ctx, targets, l.concurrency)
+}
+
+func (l *liveSource) now(perf.Stats) time.Time { return time.Now() }
+
+// replayLine is one line of a file replayed: a result as results_file and
+// -format json write it, or the samples of a transfer as samples_file
+// writes them.
+type replayLine struct {
+	jsonResult
+	Samples []perf.Sample `json:"samples"`
+}
+
+// replayKey names the transfers of one URL in one run.
+type replayKey struct {
+	runID, url, agent string
+	direction         perf.Direction
+}
+
+// replaySource plays back the results recorded by earlier runs, split into
+// the passes they were measured in: a pass ends before a URL's second
+// final result, or when the run changes.
+type replaySource struct {
+	files  []string
+	passes [][]perf.Stats
+	// last is the recorded time of the latest result asked about.
+	last time.Time
+}
+
+// openReplay reads the results and samples in files, which may be
+// gzip-compressed. Samples are attached to the final results of their
+// transfers in the order both were written.
+func openReplay(files []string) (*replaySource, error) {
+	var lines []replayLine
+	samples := map[replayKey][][]perf.Sample{}
+	for _, path := range files {
+		read, err := readReplay(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range read {
+			if line.Kind == "" && len(line.Samples) > 0 {
+				key := replayKey{line.RunID, line.URL, "", perf.Direction(line.Direction)}
+				samples[key] = append(samples[key], line.Samples)
+				continue
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	r := &replaySource{files: files}
+	var pass []perf.Stats
+	seen := map[replayKey]bool{}
+	runID := ""
+	for _, line := range lines {
+		s := line.stats()
+		key := replayKey{line.RunID, line.URL, line.Agent, s.Direction}
+		if s.Final() {
+			transfer := replayKey{line.RunID, line.URL, "", s.Direction}
+			if queue := samples[transfer]; len(queue) > 0 && !sampled(queue[0], line.Timestamp) {
+				s.Samples, samples[transfer] = queue[0], queue[1:]
+			}
+			if seen[key] || line.RunID != runID && len(pass) > 0 {
+				r.passes = append(r.passes, pass)
+				pass, seen = nil, map[replayKey]bool{}
+			}
+			seen[key] = true
+			runID = line.RunID
+		}
+		pass = append(pass, s)
+	}
+	if len(pass) > 0 {
+		r.passes = append(r.passes, pass)
+	}
+	if len(r.passes) == 0 {
+		return nil, fmt.Errorf("replay: no results in %s", strings.Join(files, ", "))
+	}
+	return r, nil
+}
+
+// stats converts line back to the result it was written from, as far as
+// the line records it.
+func (line replayLine) stats() perf.Stats {
+	s := line.jsonResult.stats()
+	s.RunID, s.Agent, s.Family, s.Proxy = line.RunID, line.Agent, line.Family, line.Proxy
+	s.Utilization, s.IntervalSpeedMbps = line.Utilization, line.IntervalMbps
+	s.Retrying = s.Kind == perf.KindRetry
+	s.Stalled, s.Shift = line.Stalled, line.Shift
+	s.Latency, s.Bufferbloat, s.WritePacing = line.Latency, line.Bloat, line.Pacing
+	return s
+}
+
+// sampled reports whether samples were taken after a result recorded at
+// at, so they belong to a later transfer.
+func sampled(samples []perf.Sample, at time.Time) bool {
+	return !at.IsZero() && samples[len(samples)-1].Time.After(at.Add(time.Second))
+}
+
+// readReplay reads the lines of the file at path.
+func readReplay(path string) ([]replayLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("replay: %s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	var lines []replayLine
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var line replayLine
+		if err := json.Unmarshal([]byte(text), &line); err != nil {
+			return nil, fmt.Errorf("replay: %s:%d: %w", path, n, err)
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("replay: %s: %w", path, err)
+	}
+	return lines, nil
+}
+
+// configure leaves out of config what only applies to testing, such as
+// schedules, agents and sweeps, and gives it the recorded urls when it has
+// none, so the summary and checks cover them. The files config writes must
+// not be those replayed.
+func (r *replaySource) configure(config *perf.Config) error {
+	outs := []struct{ name, path string }{
+		{"results_file", config.ResultsFile.Path},
+		{"samples_file", config.SamplesFile},
+		{"csv_file", config.CSVFile},
+	}
+	for _, name := range config.NamedSinks() {
+		outs = append(outs, struct{ name, path string }{"sink " + name, config.Sinks[name].File()})
+	}
+	for _, path := range r.files {
+		for _, out := range outs {
+			if out.path != "" && sameFile(path, out.path) {
+				return fmt.Errorf("replay: %s is the %s the replay would write to", path, out.name)
+			}
+		}
+	}
+	config.Interval, config.Cron, config.Iterations = 0, "", nil
+	config.Agents, config.Experiment, config.Sweep, config.DataBudget = nil, nil, nil, nil
+	config.Speedtest, config.Serve = nil, ""
+	if len(config.URLs) > 0 {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, pass := range r.passes {
+		for _, s := range pass {
+			if !seen[s.URL] {
+				seen[s.URL] = true
+				config.URLs = append(config.URLs, perf.Target{URL: s.URL, Name: s.Name, Group: s.Group})
+			}
+		}
+	}
+	return nil
+}
+
+// sameFile reports whether paths a and b name the same file.
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	return err == nil && os.SameFile(ai, bi)
+}
+
+func (r *replaySource) pass(ctx context.Context, pass int, _ []perf.Target) <-chan perf.Stats {
+	out := make(chan perf.Stats)
+	go func() {
+		defer close(out)
+		for _, s := range r.passes[pass] {
+			select {
+			case out <- s:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// now is the time result was recorded at, or for a result of no time that
+// of the latest one asked about. It is only called from the run loop, so
+// last needs no lock.
+func (r *replaySource) now(result perf.Stats) time.Time {
+	if !result.Timestamp.IsZero() {
+		r.last = result.Timestamp
+	}
+	if r.last.IsZero() {
+		return time.Now()
+	}
+	return r.last
+}
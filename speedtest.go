@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// speedtestListURL is speedtest.net's list of the servers nearest the
+// caller, closest first.
+const speedtestListURL = "https://www.speedtest.net/api/js/servers?engine=js&https_functional=true&limit=10"
+
+// speedtestProbes is how many latency requests each listed server gets; the
+// fastest answer counts.
+const speedtestProbes = 3
+
+// speedtestServer is one entry of a server list, in either the JSON or the
+// XML format.
+type speedtestServer struct {
+	ID      serverID `json:"id" xml:"id,attr"`
+	URL     string   `json:"url" xml:"url,attr"`
+	Host    string   `json:"host" xml:"host,attr"`
+	Name    string   `json:"name" xml:"name,attr"`
+	Country string   `json:"country" xml:"country,attr"`
+	Sponsor string   `json:"sponsor" xml:"sponsor,attr"`
+
+	latency time.Duration
+}
+
+// serverID reads a server id given as a JSON string or number.
+type serverID string
+
+func (id *serverID) UnmarshalJSON(data []byte) error {
+	*id = serverID(strings.Trim(string(data), `"`))
+	return nil
+}
+
+// base is the scheme and host the server's test paths hang off.
+func (s speedtestServer) base() (string, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil || u.Host == "" {
+		if s.Host == "" {
+			return "", fmt.Errorf("server %s has no url or host", s.ID)
+		}
+		return "http://" + s.Host, nil
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// label names the server as "Sponsor (City)".
+func (s speedtestServer) label() string {
+	switch {
+	case s.Sponsor == "":
+		return cmp.Or(s.Name, s.Host)
+	case s.Name == "":
+		return s.Sponsor
+	}
+	return fmt.Sprintf("%s (%s)", s.Sponsor, s.Name)
+}
+
+// useSpeedtest replaces config's URLs with a download and an upload for
+// each of the nearest speedtest servers when speedtest is on. When no
+// server can be found the configured URLs stay, or an error is returned if
+// there are none.
+func useSpeedtest(ctx context.Context, config *perf.Config) error {
+	if !config.Speedtest.On() {
+		return nil
+	}
+	targets, err := discoverSpeedtest(ctx, *config.Speedtest)
+	if err != nil {
+		if len(config.URLs) == 0 {
+			return fmt.Errorf("speedtest: %w", err)
+		}
+		slog.Warn("finding speedtest servers, testing the configured urls", "err", err)
+		return nil
+	}
+	config.URLs = targets
+	return nil
+}
+
+// discoverSpeedtest fetches the server list, measures the latency of each
+// server on it and returns the targets of the s.Servers quickest.
+func discoverSpeedtest(ctx context.Context, s perf.Speedtest) ([]perf.Target, error) {
+	servers, err := speedtestServers(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	var wg sync.WaitGroup
+	for i := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			servers[i].latency = probeSpeedtest(ctx, servers[i])
+		}()
+	}
+	wg.Wait()
+	servers = slices.DeleteFunc(servers, func(s speedtestServer) bool { return s.latency == 0 })
+	if len(servers) == 0 {
+		return nil, errors.New("no server on the list answered")
+	}
+	slices.SortStableFunc(servers, func(a, b speedtestServer) int { return cmp.Compare(a.latency, b.latency) })
+	servers = servers[:min(len(servers), cmp.Or(s.Servers, 3))]
+
+	download := cmp.Or(s.DownloadSize, 25*perf.ByteSize(1e6))
+	upload := cmp.Or(s.UploadSize, 10*perf.ByteSize(1e6))
+	var targets []perf.Target
+	for _, server := range servers {
+		base, _ := server.base()
+		slog.Info("testing speedtest server", "server", server.label(), "id", server.ID, "latency", server.latency.Round(time.Millisecond))
+		targets = append(targets,
+			perf.Target{URL: fmt.Sprintf("%s/download?size=%d", base, download), Name: server.label(), Group: "speedtest"},
+			perf.Target{URL: base + "/upload", Name: server.label(), Group: "speedtest", Method: perf.MethodUpload, UploadSize: upload},
+		)
+	}
+	return targets, nil
+}
+
+// probeSpeedtest returns the quickest of speedtestProbes latency requests to
+// server, or zero when none succeeded.
+func probeSpeedtest(ctx context.Context, server speedtestServer) time.Duration {
+	base, err := server.base()
+	if err != nil {
+		return 0
+	}
+	var best time.Duration
+	for range speedtestProbes {
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		started := time.Now()
+		err := getSpeedtest(ctx, fmt.Sprintf("%s/hello?nocache=%d", base, started.UnixNano()), io.Discard)
+		cancel()
+		if err != nil {
+			slog.Debug("speedtest latency probe", "server", server.label(), "err", err)
+			continue
+		}
+		if rtt := time.Since(started); best == 0 || rtt < best {
+			best = rtt
+		}
+	}
+	return best
+}
+
+// speedtestServers returns the server list, from the cache while it is
+// younger than s.CacheTTL. A stale cached list is used when the list cannot
+// be fetched.
+func speedtestServers(ctx context.Context, s perf.Speedtest) ([]speedtestServer, error) {
+	listURL := cmp.Or(s.ListURL, speedtestListURL)
+	cache := speedtestCachePath(listURL)
+	cached, cacheErr := readSpeedtestCache(cache, cmp.Or(s.CacheTTL, 24*time.Hour))
+	if cacheErr == nil {
+		return cached, nil
+	}
+
+	var raw bytes.Buffer
+	err := getSpeedtest(ctx, listURL, &raw)
+	var servers []speedtestServer
+	if err == nil {
+		servers, err = parseSpeedtestServers(raw.Bytes())
+	}
+	if err != nil {
+		if cached != nil {
+			slog.Warn("fetching speedtest server list, using the cached one", "url", listURL, "err", err)
+			return cached, nil
+		}
+		return nil, fmt.Errorf("fetching server list: %w", err)
+	}
+	if cache != "" {
+		if err := writeCache(cache, raw.Bytes()); err != nil {
+			slog.Warn("caching speedtest server list", "cache", cache, "err", err)
+		}
+	}
+	return servers, nil
+}
+
+// readSpeedtestCache reads the cached list at path. It returns the list
+// with an error when it is older than ttl, so it can still be fallen back
+// on.
+func readSpeedtestCache(path string, ttl time.Duration) ([]speedtestServer, error) {
+	if path == "" {
+		return nil, errors.New("no cache")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	servers, err := parseSpeedtestServers(raw)
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(info.ModTime()) > ttl {
+		return servers, errors.New("cache expired")
+	}
+	return servers, nil
+}
+
+// speedtestCachePath names the cached copy of the list at listURL next to
+// the cached remote configs, or returns "" when there is no cache
+// directory.
+func speedtestCachePath(listURL string) string {
+	if configSource.cacheDir == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(listURL))
+	return filepath.Join(configSource.cacheDir, "speedtest-"+hex.EncodeToString(sum[:8])+".list")
+}
+
+// parseSpeedtestServers reads a server list as JSON or, when it starts
+// with a "<", as the XML of speedtest.net's older list.
+func parseSpeedtestServers(raw []byte) ([]speedtestServer, error) {
+	var servers []speedtestServer
+	if trimmed := bytes.TrimSpace(raw); bytes.HasPrefix(trimmed, []byte("<")) {
+		var doc struct {
+			Servers []speedtestServer `xml:"servers>server"`
+		}
+		if err := xml.Unmarshal(trimmed, &doc); err != nil {
+			return nil, fmt.Errorf("parsing server list: %w", err)
+		}
+		servers = doc.Servers
+	} else if err := json.Unmarshal(trimmed, &servers); err != nil {
+		return nil, fmt.Errorf("parsing server list: %w", err)
+	}
+	servers = slices.DeleteFunc(servers, func(s speedtestServer) bool {
+		_, err := s.base()
+		return err != nil
+	})
+	if len(servers) == 0 {
+		return nil, errors.New("server list is empty")
+	}
+	return servers, nil
+}
+
+// getSpeedtest GETs rawURL into w, failing on any status but 200.
+func getSpeedtest(ctx context.Context, rawURL string, w io.Writer) error {
+	ctx, cancel := context.WithTimeout(ctx, configSource.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+	_, err = io.Copy(w, io.LimitReader(resp.Body, 1<<20))
+	return err
+}
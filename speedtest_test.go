@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// newSpeedtestServer answers latency probes after delay and serves the
+// download and upload paths of a speedtest server.
+func newSpeedtestServer(t *testing.T, delay time.Duration) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hello":
+			time.Sleep(delay)
+			fmt.Fprint(w, "hello 2.9 (2.9.0) 2024-05-01.1200.abcdef")
+		case "/download":
+			n, _ := strconv.Atoi(r.URL.Query().Get("size"))
+			w.Write(make([]byte, n))
+		case "/upload":
+			io.Copy(io.Discard, r.Body)
+			fmt.Fprint(w, "size=", r.ContentLength)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// listServer serves a server list, failing every request while down, and
+// counts requests.
+type listServer struct {
+	*httptest.Server
+	body     atomic.Value
+	down     atomic.Bool
+	requests atomic.Int32
+}
+
+func newListServer(t *testing.T, body string) *listServer {
+	s := &listServer{}
+	s.body.Store(body)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		if s.down.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, s.body.Load())
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// useCache points configSource at a fresh cache directory for the test.
+func useCache(t *testing.T) string {
+	saved := configSource
+	configSource = &remoteSource{timeout: 5 * time.Second, cacheDir: t.TempDir(), etags: map[string]string{}}
+	t.Cleanup(func() { configSource = saved })
+	return configSource.cacheDir
+}
+
+func TestParseSpeedtestServers(t *testing.T) {
+	servers, err := parseSpeedtestServers([]byte(`[
+		{"id": "101", "url": "https://st1.example.net:8080/speedtest/upload.php", "name": "Paris", "sponsor": "Fibre Co"},
+		{"id": 102, "host": "st2.example.net:8080", "name": "Lyon"},
+		{"id": 103, "name": "nowhere"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Servers with neither a url nor a host are dropped.
+	if len(servers) != 2 || servers[0].ID != "101" || servers[1].ID != "102" {
+		t.Fatalf("servers %+v", servers)
+	}
+	for i, want := range []string{"https://st1.example.net:8080", "http://st2.example.net:8080"} {
+		if base, err := servers[i].base(); err != nil || base != want {
+			t.Errorf("server %s base %q, %v; want %q", servers[i].ID, base, err, want)
+		}
+	}
+	if got := servers[0].label(); got != "Fibre Co (Paris)" {
+		t.Errorf("label %q", got)
+	}
+	if got := servers[1].label(); got != "Lyon" {
+		t.Errorf("label without a sponsor %q", got)
+	}
+
+	servers, err = parseSpeedtestServers([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<settings><servers>
+<server url="http://st3.example.net:8080/speedtest/upload.php" name="Lille" country="France" sponsor="Net SA" id="201" host="st3.example.net:8080"/>
+</servers></settings>`))
+	if err != nil || len(servers) != 1 || servers[0].ID != "201" || servers[0].Country != "France" || servers[0].label() != "Net SA (Lille)" {
+		t.Errorf("XML list: %+v, %v", servers, err)
+	}
+
+	for _, bad := range []string{"", "[]", `[{"id": 1}]`, "{", "<settings>"} {
+		if _, err := parseSpeedtestServers([]byte(bad)); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestDiscoverSpeedtest(t *testing.T) {
+	useCache(t)
+	near, mid, far := newSpeedtestServer(t, 0), newSpeedtestServer(t, 40*time.Millisecond), newSpeedtestServer(t, 80*time.Millisecond)
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	// The list is in no particular order, and one server is gone.
+	list := newListServer(t, fmt.Sprintf(`[
+		{"id": 3, "url": "%s/speedtest/upload.php", "name": "Far"},
+		{"id": 4, "url": "%s/speedtest/upload.php", "name": "Dead"},
+		{"id": 1, "url": "%s/speedtest/upload.php", "name": "Near", "sponsor": "ISP"},
+		{"id": 2, "url": "%s/speedtest/upload.php", "name": "Mid"}
+	]`, far.URL, dead.URL, near.URL, mid.URL))
+
+	s := perf.Speedtest{Enabled: true, Servers: 2, ListURL: list.URL, DownloadSize: 2000, UploadSize: 1000}
+	targets, err := discoverSpeedtest(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []perf.Target{
+		{URL: near.URL + "/download?size=2000", Name: "ISP (Near)", Group: "speedtest"},
+		{URL: near.URL + "/upload", Name: "ISP (Near)", Group: "speedtest", Method: perf.MethodUpload, UploadSize: 1000},
+		{URL: mid.URL + "/download?size=2000", Name: "Mid", Group: "speedtest"},
+		{URL: mid.URL + "/upload", Name: "Mid", Group: "speedtest", Method: perf.MethodUpload, UploadSize: 1000},
+	}
+	if fmt.Sprint(targets) != fmt.Sprint(want) {
+		t.Errorf("targets\n%+v\nwant\n%+v", targets, want)
+	}
+
+	// The targets are ordinary downloads and uploads.
+	for r := range perf.New(perf.Options{ProgressInterval: -1}).Run(context.Background(), targets, 1) {
+		if r.Final() && (r.Error != nil || r.SizeBytes == 0 || r.Name == "") {
+			t.Errorf("%s %s: %d bytes, %v", r.Name, r.Direction, r.SizeBytes, r.Error)
+		}
+	}
+
+	// With no server answering there is nothing to test.
+	list.body.Store(fmt.Sprintf(`[{"id": 4, "url": "%s/"}]`, dead.URL))
+	s.ListURL = list.URL + "/other"
+	if _, err := discoverSpeedtest(context.Background(), s); err == nil || err.Error() != "no server on the list answered" {
+		t.Errorf("no server answering: %v", err)
+	}
+}
+
+func TestSpeedtestCache(t *testing.T) {
+	cache := useCache(t)
+	st := newSpeedtestServer(t, 0)
+	list := newListServer(t, fmt.Sprintf(`[{"id": 1, "url": "%s/"}]`, st.URL))
+	s := perf.Speedtest{Enabled: true, ListURL: list.URL}
+	servers := func() []speedtestServer {
+		t.Helper()
+		servers, err := speedtestServers(context.Background(), s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return servers
+	}
+
+	// The list is fetched once while the cache is fresh.
+	servers()
+	servers()
+	if n := list.requests.Load(); n != 1 {
+		t.Errorf("%d list requests within the ttl, want 1", n)
+	}
+	path := speedtestCachePath(list.URL)
+	if filepath.Dir(path) != cache {
+		t.Errorf("cache at %s, want in %s", path, cache)
+	}
+
+	// An expired cache is refetched, and stands in while the list is down.
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(path, old, old)
+	servers()
+	if n := list.requests.Load(); n != 2 {
+		t.Errorf("%d list requests past the ttl, want 2", n)
+	}
+	os.Chtimes(path, old, old)
+	list.down.Store(true)
+	if got := servers(); len(got) != 1 || got[0].ID != "1" {
+		t.Errorf("stale cache gave %+v", got)
+	}
+
+	// Without a cache a list that is down is an error.
+	os.Remove(path)
+	if _, err := speedtestServers(context.Background(), s); err == nil || !strings.HasPrefix(err.Error(), "fetching server list: ") {
+		t.Errorf("list down without a cache: %v", err)
+	}
+}
+
+func TestUseSpeedtestFallback(t *testing.T) {
+	useCache(t)
+	list := newListServer(t, "")
+	list.down.Store(true)
+	configured := []perf.Target{{URL: "https://example.com/a"}}
+	config := perf.Config{URLs: configured, Speedtest: &perf.Speedtest{Enabled: true, ListURL: list.URL}}
+	if err := useSpeedtest(context.Background(), &config); err != nil || len(config.URLs) != 1 || config.URLs[0].URL != "https://example.com/a" {
+		t.Errorf("fallback: %v, urls %+v", err, config.URLs)
+	}
+	config.URLs = nil
+	if err := useSpeedtest(context.Background(), &config); err == nil || !strings.HasPrefix(err.Error(), "speedtest: fetching server list: ") {
+		t.Errorf("fallback without urls: %v", err)
+	}
+	// Disabled, the list is never asked for.
+	config.Speedtest.Enabled = false
+	list.requests.Store(0)
+	if err := useSpeedtest(context.Background(), &config); err != nil || list.requests.Load() != 0 {
+		t.Errorf("disabled: %v, %d list requests", err, list.requests.Load())
+	}
+}
+
+func TestSpeedtestRun(t *testing.T) {
+	st := newSpeedtestServer(t, 0)
+	list := newListServer(t, fmt.Sprintf(`[{"id": 1, "url": "%s/", "name": "Paris", "sponsor": "Fibre Co"}]`, st.URL))
+	dir := t.TempDir()
+	config := fmt.Sprintf("speedtest:\n  enabled: true\n  list_url: %s\n  download_size: 2000\n  upload_size: 1000\n", list.URL)
+	if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr strings.Builder
+	cmd := yaperf(dir, "-config-cache", t.TempDir())
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if code := exitCode(t, cmd, time.Minute); code != 0 {
+		t.Fatalf("exit code %d\n%s", code, stderr.String())
+	}
+	for _, want := range []string{"✓ Fibre Co (Paris) [", "✓ Fibre Co (Paris) (upload) ["} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("stdout lacks %q:\n%s", want, stdout.String())
+		}
+	}
+}
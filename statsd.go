@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"yaperf/pkg/perf"
+)
+
+// statsdTagEscaper drops the characters that delimit DogStatsD tags.
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// statsdSink sends one UDP datagram per metric and never waits for or
+// reports delivery. It emits the current speed of every progress tick as a
+// gauge, the duration of every completed transfer as a timing and failures
+// as a counter.
+type statsdSink struct {
+	cfg  perf.StatsD
+	conn net.Conn
+}
+
+func newStatsdSink(cfg perf.StatsD) (*statsdSink, error) {
+	if cfg.Prefix == "" {
+		cfg.Prefix = "yaperf"
+	}
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %w", err)
+	}
+	return &statsdSink{cfg: cfg, conn: conn}, nil
+}
+
+func (s *statsdSink) Write(result perf.Stats) error {
+	switch result.Kind {
+	case perf.KindError:
+		s.send(result, "errors", "1|c")
+	case perf.KindFinal:
+		s.send(result, "duration", strconv.FormatInt(result.Elapsed.Milliseconds(), 10)+"|ms")
+	case perf.KindProgress:
+		if result.Direction != perf.Latency {
+			s.send(result, "speed_mbps", strconv.FormatFloat(result.IntervalSpeedMbps, 'f', 3, 64)+"|g")
+		}
+	}
+	return nil
+}
+
+func (s *statsdSink) send(result perf.Stats, name, value string) {
+	s.conn.Write([]byte(s.line(result, name, value)))
+}
+
+// line renders one metric. Plain StatsD has no tags, so the direction goes
+// into the name; with DogStatsD it is a tag next to the URL (or name),
+// group, host, run labels and the configured tags.
+func (s *statsdSink) line(result perf.Stats, name, value string) string {
+	if !s.cfg.DogStatsD {
+		return fmt.Sprintf("%s.%s.%s:%s", s.cfg.Prefix, result.Direction, name, value)
+	}
+	tags := map[string]string{"url": result.DisplayName(), "direction": string(result.Direction)}
+	if result.Group != "" {
+		tags["group"] = result.Group
+	}
+	if result.Host != "" {
+		tags["host"] = result.Host
+	}
+	maps.Copy(tags, result.Labels)
+	maps.Copy(tags, s.cfg.Tags)
+	pairs := make([]string, 0, len(tags))
+	for _, k := range slices.Sorted(maps.Keys(tags)) {
+		pairs = append(pairs, statsdTagEscaper.Replace(k)+":"+statsdTagEscaper.Replace(tags[k]))
+	}
+	return fmt.Sprintf("%s.%s:%s|#%s", s.cfg.Prefix, name, value, strings.Join(pairs, ","))
+}
+
+func (s *statsdSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// statsdAgent listens for datagrams on a local UDP port.
+func statsdAgent(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// datagrams reads n datagrams from conn.
+func datagrams(t *testing.T, conn net.PacketConn, n int) []string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got []string
+	buf := make([]byte, 2048)
+	for range n {
+		m, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("after %q: %v", got, err)
+		}
+		got = append(got, string(buf[:m]))
+	}
+	return got
+}
+
+func statsdResults() []perf.Stats {
+	base := perf.Stats{URL: "https://mirror.example.com/100MB.bin", Name: "mirror", Group: "cdn", Host: "edge-1", Labels: map[string]string{"site": "lab,eu", "rack": "7"}, Direction: perf.Download}
+	progress, final, failed, retry := base, base, base, base
+	progress.Kind, progress.IntervalSpeedMbps = perf.KindProgress, 93.25
+	final.Kind, final.Done, final.Elapsed = perf.KindFinal, true, 8123*time.Millisecond
+	failed.Kind, failed.Error = perf.KindError, errors.New("reset")
+	retry.Kind, retry.Error = perf.KindRetry, errors.New("reset")
+	latency := perf.Stats{URL: "https://mirror.example.com/", Direction: perf.Latency, Kind: perf.KindProgress}
+	return []perf.Stats{progress, retry, latency, final, failed}
+}
+
+func TestStatsdDatagrams(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  perf.StatsD
+		want []string
+	}{
+		{"statsd", perf.StatsD{}, []string{
+			"yaperf.download.speed_mbps:93.250|g",
+			"yaperf.download.duration:8123|ms",
+			"yaperf.download.errors:1|c",
+		}},
+		{"dogstatsd", perf.StatsD{Prefix: "net", DogStatsD: true, Tags: map[string]string{"env": "prod", "site": "override"}}, []string{
+			"net.speed_mbps:93.250|g|#direction:download,env:prod,group:cdn,host:edge-1,rack:7,site:override,url:mirror",
+			"net.duration:8123|ms|#direction:download,env:prod,group:cdn,host:edge-1,rack:7,site:override,url:mirror",
+			"net.errors:1|c|#direction:download,env:prod,group:cdn,host:edge-1,rack:7,site:override,url:mirror",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := statsdAgent(t)
+			tt.cfg.Address = agent.LocalAddr().String()
+			s, err := newStatsdSink(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			for _, r := range statsdResults() {
+				s.Write(r)
+			}
+			// Retries and the progress of latency probes send nothing.
+			if got := datagrams(t, agent, len(tt.want)); !slices.Equal(got, tt.want) {
+				t.Errorf("datagrams\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatsdTagEscaping(t *testing.T) {
+	s := &statsdSink{cfg: perf.StatsD{Prefix: "yaperf", DogStatsD: true}}
+	r := perf.Stats{URL: "https://example.com/a?x=1,2|3#frag", Direction: perf.Upload, Labels: map[string]string{"no#te": "a\nb"}}
+	want := "yaperf.errors:1|c|#direction:upload,no_te:a_b,url:https://example.com/a?x=1_2_3_frag"
+	if got := s.line(r, "errors", "1|c"); got != want {
+		t.Errorf("line %q, want %q", got, want)
+	}
+	if _, err := newStatsdSink(perf.StatsD{Address: "no port"}); err == nil || !strings.HasPrefix(err.Error(), "statsd: ") {
+		t.Errorf("err = %v, want a statsd error", err)
+	}
+}
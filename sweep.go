@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"yaperf/pkg/perf"
+)
+
+type jsonSweep struct {
+	URL        string  `json:"url"`
+	Name       string  `json:"name,omitempty"`
+	Method     string  `json:"method"`
+	Reachable  bool    `json:"reachable"`
+	StatusCode int     `json:"status_code,omitempty"`
+	TTFBMs     float64 `json:"ttfb_ms,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	ErrorKind  string  `json:"error_kind,omitempty"`
+}
+
+type jsonSweepPass struct {
+	Pass int         `json:"pass"`
+	URLs []jsonSweep `json:"urls"`
+}
+
+// sweepCount is how a pass's sweep went, for its results table.
+type sweepCount struct {
+	Reachable   int `json:"reachable"`
+	Unreachable int `json:"unreachable"`
+}
+
+func newSweepCount(results []perf.SweepResult) *sweepCount {
+	var c sweepCount
+	for _, r := range results {
+		if r.Reachable() {
+			c.Reachable++
+		} else {
+			c.Unreachable++
+		}
+	}
+	return &c
+}
+
+// printSweep prints the sweep before pass as a table, or as one JSON
+// object. With quiet set only a sweep that found unreachable URLs is
+// printed.
+func printSweep(output string, pass int, results []perf.SweepResult, quiet bool) {
+	if quiet && newSweepCount(results).Unreachable == 0 {
+		return
+	}
+	if output == "json" {
+		rows := make([]jsonSweep, len(results))
+		for i, r := range results {
+			rows[i] = jsonSweep{URL: r.URL, Name: r.Name, Method: r.Method, Reachable: r.Reachable(), StatusCode: r.StatusCode, TTFBMs: ms(r.TTFB)}
+			if r.Error != nil {
+				rows[i].Error, rows[i].ErrorKind = r.Error.Error(), string(r.ErrorKind)
+			}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(struct {
+			Sweep jsonSweepPass `json:"sweep"`
+		}{jsonSweepPass{pass, rows}}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	}
+
+	fmt.Printf("Sweep, pass %d\n", pass)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  \tURL\tStatus\tTTFB\tError")
+	for _, r := range results {
+		state, status, ttfb, errText := "ok", "-", "-", ""
+		if r.StatusCode > 0 {
+			status, ttfb = strconv.Itoa(r.StatusCode), millis(r.TTFB)
+		}
+		if r.Method != http.MethodHead {
+			status += " via " + r.Method
+		}
+		if !r.Reachable() {
+			state, errText = "DOWN", fmt.Sprintf("%v (%s)", r.Error, r.ErrorKind)
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", state, label(perf.Stats{URL: r.URL, Name: r.Name}), status, ttfb, errText)
+	}
+	w.Flush()
+	fmt.Println()
+}
+
+// logSweep reports unreachable URLs as warnings, for when the screen is
+// the dashboard's.
+func logSweep(results []perf.SweepResult) {
+	for _, r := range results {
+		if !r.Reachable() {
+			slog.Warn("unreachable in sweep", "url", r.URL, "err", r.Error)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func TestSweepCount(t *testing.T) {
+	results := []perf.SweepResult{
+		{URL: "https://a.example.com/", StatusCode: 200},
+		{URL: "https://b.example.com/", StatusCode: 404, Error: errors.New("unexpected status 404 Not Found")},
+		{URL: "https://c.example.com/", Error: errors.New("connection refused")},
+	}
+	if c := newSweepCount(results); c.Reachable != 1 || c.Unreachable != 2 {
+		t.Errorf("counted %+v", c)
+	}
+	table := newResultTable(1, passResults(), "")
+	table.Sweep = newSweepCount(results)
+	var out bytes.Buffer
+	table.render(&out)
+	if !strings.Contains(out.String(), "\nSweep: 1 of 3 URLs reachable\n") {
+		t.Errorf("table:\n%s", out.String())
+	}
+	doc, err := json.Marshal(table)
+	if err != nil || !bytes.Contains(doc, []byte(`"sweep":{"reachable":1,"unreachable":2}`)) {
+		t.Errorf("table JSON %s (%v)", doc, err)
+	}
+}
+
+func TestSweepRun(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	refused := "http://" + l.Addr().String() + "/"
+	dir := t.TempDir()
+	for _, output := range []string{"text", "json"} {
+		config := "output: " + output + "\nsweep: {timeout: 2s, skip_unreachable: true}\nurls:\n  - " + srv.URL + "/a\n  - " + refused + "\n"
+		if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var stdout, stderr strings.Builder
+		cmd := yaperf(dir)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		exitCode(t, cmd, time.Minute)
+		got := stdout.String()
+		if output == "text" {
+			for _, want := range []string{"Sweep, pass 1\n", "ok    " + srv.URL + "/a", "DOWN  " + refused, "(connect)", "✓ " + srv.URL + "/a",
+				"- " + refused + " (skipped, " + perf.SkipUnreachableReason + ")", "Sweep: 1 of 2 URLs reachable\n"} {
+				if !strings.Contains(got, want) {
+					t.Errorf("text output lacks %q:\n%s\n%s", want, got, stderr.String())
+				}
+			}
+			continue
+		}
+		// The sweep is a line of its own ahead of the pass's results.
+		var first struct {
+			Sweep struct {
+				Pass int
+				URLs []struct {
+					URL        string
+					Reachable  bool
+					StatusCode int    `json:"status_code"`
+					ErrorKind  string `json:"error_kind"`
+				}
+			}
+		}
+		line, _, _ := strings.Cut(got, "\n")
+		if err := json.Unmarshal([]byte(line), &first); err != nil {
+			t.Fatalf("first JSON line %q: %v", line, err)
+		}
+		urls := first.Sweep.URLs
+		if first.Sweep.Pass != 1 || len(urls) != 2 || !urls[0].Reachable || urls[0].StatusCode != 200 || urls[1].Reachable || urls[1].ErrorKind != "connect" {
+			t.Errorf("sweep %+v", first.Sweep)
+		}
+		if !strings.Contains(got, `"skip_reason":"`+perf.SkipUnreachableReason+`"`) {
+			t.Errorf("no unreachable skip in\n%s", got)
+		}
+	}
+}
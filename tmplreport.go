@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// builtinTemplates are the named formats -format-template and template
+// accept in place of a template of their own.
+var builtinTemplates = map[string]string{
+	"short": `{{.DisplayName}} {{if .Error}}failed: {{.Error}}{{else}}{{speed .SpeedMbps}}, {{humanBytes .SizeBytes}} in {{round .Elapsed}}{{end}}`,
+	"tsv":   "{{rfc3339 .Time}}\t{{.URL}}\t{{.Direction}}\t{{.SizeBytes}}\t{{.Elapsed.Milliseconds}}\t{{mbps .SpeedMbps}}\t{{with .Error}}{{.}}{{end}}",
+}
+
+// parseResultTemplate parses text, or the built-in template it names, as
+// the format of one result line.
+func parseResultTemplate(text string) (*template.Template, error) {
+	if builtin, ok := builtinTemplates[text]; ok {
+		text = builtin
+	}
+	return template.New("result").Funcs(template.FuncMap{
+		"mbps":       func(v float64) string { return fmt.Sprintf("%.2f", v) },
+		"humanBytes": humanBytes,
+		"speed":      showSpeed,
+		"size":       showSize,
+		"rfc3339":    func(t time.Time) string { return t.Format(time.RFC3339) },
+		"round":      func(d time.Duration) time.Duration { return d.Round(time.Millisecond) },
+	}).Parse(text)
+}
+
+// humanBytes formats n in decimal units, such as "2.50 MB".
+func humanBytes(n int64) string {
+	v := float64(n)
+	for _, unit := range []string{"B", "kB", "MB", "GB"} {
+		if v < 1000 || unit == "GB" {
+			if unit == "B" {
+				return fmt.Sprintf("%d B", n)
+			}
+			return fmt.Sprintf("%.2f %s", v, unit)
+		}
+		v /= 1000
+	}
+	return ""
+}
+
+// templateResult is what a result template is executed against: the final
+// Stats and the time it arrived.
+type templateResult struct {
+	perf.Stats
+	Time time.Time
+}
+
+// templateReporter prints one line per final result through a template on
+// stdout, and progress as text on stderr. It prints no summaries, so its
+// output stays one line per result for log pipelines.
+type templateReporter struct {
+	tmpl            *template.Template
+	w               io.Writer
+	progress, quiet bool
+	// broken is set once a result failed to render, so the error is
+	// logged once rather than for every line.
+	broken bool
+}
+
+func (t *templateReporter) OnProgress(result perf.Stats) {
+	if t.progress {
+		printStatus(result)
+	}
+}
+
+func (t *templateReporter) OnComplete(result perf.Stats) {
+	if t.quiet && !failed(result) {
+		return
+	}
+	var b bytes.Buffer
+	if err := t.tmpl.Execute(&b, templateResult{Stats: result, Time: time.Now().UTC()}); err != nil {
+		if !t.broken {
+			slog.Error("rendering result template, skipping results it fails on", "err", err)
+			t.broken = true
+		}
+		return
+	}
+	if !strings.HasSuffix(b.String(), "\n") {
+		b.WriteByte('\n')
+	}
+	t.w.Write(b.Bytes())
+}
+
+func (t *templateReporter) OnPass(resultTable)       {}
+func (t *templateReporter) OnSummary([]perf.Summary) {}
+
+// newTemplateReporter returns a reporter formatting results with text, a
+// template or the name of a built-in one.
+func newTemplateReporter(text string, progress, quiet bool) (*templateReporter, error) {
+	tmpl, err := parseResultTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	return &templateReporter{tmpl: tmpl, w: os.Stdout, progress: progress, quiet: quiet}, nil
+}
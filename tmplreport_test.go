@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func TestHumanBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{999, "999 B"},
+		{1000, "1.00 kB"},
+		{2500000, "2.50 MB"},
+		{3e9, "3.00 GB"},
+		{4e12, "4000.00 GB"},
+	}
+	for _, tt := range tests {
+		if got := humanBytes(tt.n); got != tt.want {
+			t.Errorf("humanBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestResultTemplate(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ok := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/a", Name: "a", Direction: perf.Download, Done: true,
+		SizeBytes: 2500000, Elapsed: 2000400 * time.Microsecond, SpeedMbps: 10}
+	bad := perf.Stats{Kind: perf.KindError, URL: "https://example.com/b", Direction: perf.Upload, Done: true, Error: errors.New("reset")}
+	tests := []struct {
+		text   string
+		result perf.Stats
+		want   string
+	}{
+		{"short", ok, "a 10.00 Mbps, 2.50 MB in 2s"},
+		{"short", bad, "https://example.com/b failed: reset"},
+		{"tsv", ok, "2024-05-01T12:00:00Z\thttps://example.com/a\tdownload\t2500000\t2000\t10.00\t"},
+		{"tsv", bad, "2024-05-01T12:00:00Z\thttps://example.com/b\tupload\t0\t0\t0.00\treset"},
+		{`{{.URL}} {{.SpeedMbps | printf "%.1f"}}Mbps {{.Elapsed}}`, ok, "https://example.com/a 10.0Mbps 2.0004s"},
+		{"{{mbps .SpeedMbps}} {{speed .SpeedMbps}} {{size .SizeBytes}} {{humanBytes .SizeBytes}} {{round .Elapsed}} {{rfc3339 .Time}}", ok,
+			"10.00 10.00 Mbps 2.50 MB 2.50 MB 2s 2024-05-01T12:00:00Z"},
+	}
+	for _, tt := range tests {
+		tmpl, err := parseResultTemplate(tt.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, templateResult{Stats: tt.result, Time: at}); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tt.want {
+			t.Errorf("%s of %s:\n%q\nwant\n%q", tt.text, tt.result.URL, out.String(), tt.want)
+		}
+	}
+	if _, err := parseResultTemplate("{{.URL"); err == nil {
+		t.Error("parsed an unclosed action")
+	}
+	if _, err := parseResultTemplate("{{nosuch .URL}}"); err == nil || !strings.Contains(err.Error(), `function "nosuch" not defined`) {
+		t.Errorf("unknown function: %v", err)
+	}
+}
+
+func TestTemplateReporter(t *testing.T) {
+	ok := perf.Stats{Kind: perf.KindFinal, URL: "https://example.com/a", Direction: perf.Download, Done: true, SizeBytes: 1000}
+	bad := perf.Stats{Kind: perf.KindError, URL: "https://example.com/b", Direction: perf.Download, Done: true, Error: errors.New("reset")}
+
+	// Each result is a line, ended with a newline when the template has
+	// none; quiet keeps the failures.
+	for _, tt := range []struct {
+		text  string
+		quiet bool
+		want  string
+	}{
+		{"{{.URL}}", false, "https://example.com/a\nhttps://example.com/b\n"},
+		{"{{.URL}}\n", false, "https://example.com/a\nhttps://example.com/b\n"},
+		{"{{.URL}}", true, "https://example.com/b\n"},
+	} {
+		r, err := newTemplateReporter(tt.text, false, tt.quiet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		r.w = &out
+		r.OnComplete(ok)
+		r.OnComplete(bad)
+		r.OnSummary(nil)
+		if out.String() != tt.want {
+			t.Errorf("%q, quiet %v: %q, want %q", tt.text, tt.quiet, out.String(), tt.want)
+		}
+	}
+
+	// A template failing on every result says so once, and prints the
+	// results it can.
+	log := captureLog(t)
+	r, err := newTemplateReporter("{{.URL}} {{.Cold.SizeBytes}}", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	r.w = &out
+	warm := ok
+	warm.Cold = &perf.Stats{SizeBytes: 500}
+	for _, s := range []perf.Stats{ok, bad, warm, ok} {
+		r.OnComplete(s)
+	}
+	if n := strings.Count(log.String(), "rendering result template"); n != 1 {
+		t.Errorf("logged the template error %d times:\n%s", n, log.String())
+	}
+	if out.String() != "https://example.com/a 500\n" {
+		t.Errorf("printed %q", out.String())
+	}
+}
+
+func TestFormatTemplateFlag(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte("template: '{{.URL}}'\nurls:\n  - "+srv.URL+"/a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The flag overrides the config, and its lines are all stdout holds.
+	var stdout strings.Builder
+	cmd := yaperf(dir, "-format-template", "{{.SizeBytes}}")
+	cmd.Stdout = &stdout
+	if code := exitCode(t, cmd, time.Minute); code != 0 || stdout.String() != "1000\n" {
+		t.Errorf("exit code %d, stdout %q", code, stdout.String())
+	}
+	// A template that does not parse stops yaperf before any transfer.
+	var stderr strings.Builder
+	cmd = yaperf(dir, "-format-template", "{{.URL")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	stdout.Reset()
+	if code := exitCode(t, cmd, time.Minute); code != 1 || stdout.Len() > 0 || !strings.Contains(stderr.String(), "unclosed action") {
+		t.Errorf("exit code %d, stdout %q, stderr %s", code, stdout.String(), stderr.String())
+	}
+}
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseTOML parses a TOML document into the YAML node tree the config is
+// decoded from, keeping the line and column of every value. It covers
+// TOML 1.0: tables, arrays of tables, dotted keys, inline tables, arrays,
+// all four kinds of string, and numbers, booleans and dates, which are
+// kept as strings.
+func parseTOML(raw []byte) (*yaml.Node, error) {
+	p := &tomlParser{src: string(raw), root: newMapping(1, 1)}
+	p.table = p.root
+	if err := p.document(); err != nil {
+		return nil, err
+	}
+	return &yaml.Node{Kind: yaml.DocumentNode, Line: 1, Column: 1, Content: []*yaml.Node{p.root}}, nil
+}
+
+type tomlParser struct {
+	src  string
+	pos  int
+	root *yaml.Node
+	// table receives the keys that follow the last table header.
+	table *yaml.Node
+	// inline marks the tables and arrays written inline, which later
+	// keys and headers may not add to.
+	inline map[*yaml.Node]bool
+	// defined marks the tables that had a header of their own, which may
+	// not have another.
+	defined map[*yaml.Node]bool
+	// dotted marks the tables made by dotted keys, which may not have a
+	// header; only dotted keys of the same table add to them.
+	dotted map[*yaml.Node]bool
+}
+
+func newMapping(line, col int) *yaml.Node {
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: line, Column: col}
+}
+
+// errorf reports a problem at offset at.
+func (p *tomlParser) errorf(at int, format string, args ...any) error {
+	line, col := position([]byte(p.src), int64(at))
+	return fmt.Errorf("line %d, column %d: %s", line, col, fmt.Sprintf(format, args...))
+}
+
+func (p *tomlParser) where(at int) (int, int) {
+	return position([]byte(p.src), int64(at))
+}
+
+func (p *tomlParser) eof() bool { return p.pos >= len(p.src) }
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *tomlParser) has(prefix string) bool {
+	return strings.HasPrefix(p.src[p.pos:], prefix)
+}
+
+// space skips spaces and tabs.
+func (p *tomlParser) space() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+// blank skips whitespace, newlines and comments.
+func (p *tomlParser) blank() {
+	for {
+		p.space()
+		switch {
+		case p.peek() == '#':
+			p.comment()
+		case p.has("\r\n"):
+			p.pos += 2
+		case p.peek() == '\n':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) comment() {
+	for !p.eof() && p.peek() != '\n' {
+		p.pos++
+	}
+}
+
+// endOfLine expects nothing but a comment before the next line.
+func (p *tomlParser) endOfLine() error {
+	p.space()
+	if p.peek() == '#' {
+		p.comment()
+	}
+	switch {
+	case p.eof():
+	case p.has("\r\n"):
+		p.pos += 2
+	case p.peek() == '\n':
+		p.pos++
+	default:
+		return p.errorf(p.pos, "expected the end of the line, found %q", p.peek())
+	}
+	return nil
+}
+
+func (p *tomlParser) document() error {
+	p.inline, p.defined, p.dotted = map[*yaml.Node]bool{}, map[*yaml.Node]bool{}, map[*yaml.Node]bool{}
+	for {
+		p.blank()
+		if p.eof() {
+			return nil
+		}
+		var err error
+		if p.peek() == '[' {
+			err = p.header()
+		} else {
+			err = p.keyValue(p.table)
+		}
+		if err == nil {
+			err = p.endOfLine()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// header reads a [table] or [[array of tables]] header and makes its
+// table the one keys go to.
+func (p *tomlParser) header() error {
+	start := p.pos
+	array := p.has("[[")
+	if array {
+		p.pos += 2
+	} else {
+		p.pos++
+	}
+	p.space()
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.space()
+	if array {
+		if !p.has("]]") {
+			return p.errorf(p.pos, "expected ]] to close the table header")
+		}
+		p.pos += 2
+	} else {
+		if p.peek() != ']' {
+			return p.errorf(p.pos, "expected ] to close the table header")
+		}
+		p.pos++
+	}
+
+	parent, err := p.descend(p.root, keys[:len(keys)-1], start, false)
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	line, col := p.where(start)
+	value := lookup(parent, last.Value)
+	switch {
+	case array && value == nil:
+		value = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: line, Column: col}
+		parent.Content = append(parent.Content, last, value)
+		fallthrough
+	case array && value.Kind == yaml.SequenceNode && !p.inline[value]:
+		table := newMapping(line, col)
+		value.Content = append(value.Content, table)
+		p.table = table
+	case !array && value == nil:
+		table := newMapping(line, col)
+		parent.Content = append(parent.Content, last, table)
+		p.table = table
+	case !array && value.Kind == yaml.MappingNode && !p.inline[value] && !p.defined[value] && !p.dotted[value]:
+		p.table = value
+	default:
+		return p.errorf(start, "%s is already defined", joinKeys(keys))
+	}
+	p.defined[p.table] = true
+	return nil
+}
+
+// descend follows keys down from table, making the tables missing on the
+// way. Through an array of tables it goes to its last table. The keys of
+// a dotted key, dotted set, may only go through tables dotted keys made.
+func (p *tomlParser) descend(table *yaml.Node, keys []*yaml.Node, at int, dotted bool) (*yaml.Node, error) {
+	for i, k := range keys {
+		value := lookup(table, k.Value)
+		switch {
+		case value == nil:
+			value = newMapping(k.Line, k.Column)
+			table.Content = append(table.Content, k, value)
+			p.dotted[value] = dotted
+		case dotted && value.Kind != yaml.ScalarNode && !p.inline[value] && !p.dotted[value]:
+			return nil, p.errorf(at, "%s is already defined", joinKeys(keys[:i+1]))
+		}
+		if value.Kind == yaml.SequenceNode && len(value.Content) > 0 && !p.inline[value] {
+			value = value.Content[len(value.Content)-1]
+		}
+		if value.Kind != yaml.MappingNode || p.inline[value] {
+			return nil, p.errorf(at, "%s is not a table", joinKeys(keys[:i+1]))
+		}
+		table = value
+	}
+	return table, nil
+}
+
+// keyValue reads key = value into table.
+func (p *tomlParser) keyValue(table *yaml.Node) error {
+	start := p.pos
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.space()
+	if p.peek() != '=' {
+		return p.errorf(p.pos, "expected = after %s", joinKeys(keys))
+	}
+	p.pos++
+	p.space()
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+	parent, err := p.descend(table, keys[:len(keys)-1], start, true)
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if lookup(parent, last.Value) != nil {
+		return p.errorf(start, "%s is already defined", joinKeys(keys))
+	}
+	parent.Content = append(parent.Content, last, value)
+	return nil
+}
+
+// key reads a dotted key as its parts.
+func (p *tomlParser) key() ([]*yaml.Node, error) {
+	var keys []*yaml.Node
+	for {
+		start := p.pos
+		line, col := p.where(start)
+		var name string
+		switch c := p.peek(); {
+		case c == '"':
+			s, err := p.basicString()
+			if err != nil {
+				return nil, err
+			}
+			name = s
+		case c == '\'':
+			s, err := p.literalString()
+			if err != nil {
+				return nil, err
+			}
+			name = s
+		default:
+			for !p.eof() && isBareKey(p.peek()) {
+				p.pos++
+			}
+			if p.pos == start {
+				return nil, p.errorf(start, "expected a key, found %s", p.found())
+			}
+			name = p.src[start:p.pos]
+		}
+		keys = append(keys, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name, Line: line, Column: col})
+		p.space()
+		if p.peek() != '.' {
+			return keys, nil
+		}
+		p.pos++
+		p.space()
+	}
+}
+
+func isBareKey(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// found describes what is at the current position, for errors.
+func (p *tomlParser) found() string {
+	if p.eof() {
+		return "the end of the file"
+	}
+	r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+	if r == '\n' || r == '\r' {
+		return "the end of the line"
+	}
+	return strconv.QuoteRune(r)
+}
+
+func (p *tomlParser) value() (*yaml.Node, error) {
+	start := p.pos
+	line, col := p.where(start)
+	scalar := func(tag, value string) *yaml.Node {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value, Line: line, Column: col}
+	}
+	switch c := p.peek(); {
+	case c == '"':
+		s, err := p.basicString()
+		return scalar("!!str", s), err
+	case c == '\'':
+		s, err := p.literalString()
+		return scalar("!!str", s), err
+	case c == '[':
+		return p.array(line, col)
+	case c == '{':
+		return p.inlineTable(line, col)
+	}
+
+	// Everything else is one token: a boolean, number or date. A date may
+	// have its time after a space.
+	for !p.eof() && strings.IndexByte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_+-.:", p.peek()) >= 0 {
+		p.pos++
+	}
+	token := p.src[start:p.pos]
+	if isDate(token) && p.peek() == ' ' && p.pos+1 < len(p.src) && p.src[p.pos+1] >= '0' && p.src[p.pos+1] <= '9' {
+		p.pos++
+		for !p.eof() && strings.IndexByte("0123456789+-.:Zz", p.peek()) >= 0 {
+			p.pos++
+		}
+		token = p.src[start:p.pos]
+	}
+	switch {
+	case token == "":
+		return nil, p.errorf(start, "expected a value, found %s", p.found())
+	case token == "true" || token == "false":
+		return scalar("!!bool", token), nil
+	case isDate(token):
+		return scalar("!!str", token), nil
+	}
+	if n, err := tomlInt(token); err == nil {
+		return scalar("!!int", n), nil
+	}
+	if f, err := tomlFloat(token); err == nil {
+		return scalar("!!float", f), nil
+	}
+	return nil, p.errorf(start, "invalid value %q", token)
+}
+
+// isDate reports a token that starts like a date, 1979-05-27, or a time,
+// 07:32:00.
+func isDate(token string) bool {
+	digits := func(s string) bool {
+		for i := range len(s) {
+			if s[i] < '0' || s[i] > '9' {
+				return false
+			}
+		}
+		return true
+	}
+	switch {
+	case len(token) >= 10 && digits(token[:4]) && token[4] == '-' && digits(token[5:7]) && token[7] == '-' && digits(token[8:10]):
+		return true
+	case len(token) >= 8 && digits(token[:2]) && token[2] == ':' && digits(token[3:5]) && token[5] == ':':
+		return true
+	}
+	return false
+}
+
+// tomlInt converts an integer, in decimal or with a 0x, 0o or 0b prefix,
+// to decimal.
+func tomlInt(token string) (string, error) {
+	if strings.Contains(token, "__") || strings.HasPrefix(token, "_") || strings.HasSuffix(token, "_") {
+		return "", strconv.ErrSyntax
+	}
+	s := strings.ReplaceAll(token, "_", "")
+	base := 10
+	switch {
+	case strings.HasPrefix(s, "0x"):
+		base, s = 16, s[2:]
+	case strings.HasPrefix(s, "0o"):
+		base, s = 8, s[2:]
+	case strings.HasPrefix(s, "0b"):
+		base, s = 2, s[2:]
+	case len(strings.TrimLeft(s, "+-")) > 1 && strings.TrimLeft(s, "+-")[0] == '0':
+		// Leading zeros are not allowed.
+		return "", strconv.ErrSyntax
+	}
+	if base != 10 && strings.ContainsAny(s, "+-") {
+		return "", strconv.ErrSyntax
+	}
+	n, err := strconv.ParseInt(s, base, 64)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+// tomlFloat converts a float to the YAML spelling of its value.
+func tomlFloat(token string) (string, error) {
+	switch strings.TrimLeft(token, "+") {
+	case "inf":
+		return ".inf", nil
+	case "-inf":
+		return "-.inf", nil
+	case "nan", "-nan":
+		return ".nan", nil
+	}
+	if strings.Contains(token, "__") || strings.HasPrefix(token, "_") || strings.HasSuffix(token, "_") {
+		return "", strconv.ErrSyntax
+	}
+	s := strings.ReplaceAll(token, "_", "")
+	if !strings.ContainsAny(s, ".eE") || strings.HasPrefix(strings.TrimLeft(s, "+-"), ".") || strings.HasSuffix(s, ".") {
+		return "", strconv.ErrSyntax
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64), nil
+}
+
+func (p *tomlParser) array(line, col int) (*yaml.Node, error) {
+	seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: line, Column: col}
+	p.inline[seq] = true
+	p.pos++ // [
+	for {
+		p.blank()
+		if p.peek() == ']' {
+			p.pos++
+			return seq, nil
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		seq.Content = append(seq.Content, value)
+		p.blank()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+			p.pos++
+			return seq, nil
+		default:
+			return nil, p.errorf(p.pos, "expected , or ] in the array, found %s", p.found())
+		}
+	}
+}
+
+func (p *tomlParser) inlineTable(line, col int) (*yaml.Node, error) {
+	table := newMapping(line, col)
+	p.pos++ // {
+	p.space()
+	if p.peek() == '}' {
+		p.pos++
+		p.inline[table] = true
+		return table, nil
+	}
+	for {
+		p.space()
+		if err := p.keyValue(table); err != nil {
+			return nil, err
+		}
+		p.space()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			// Sealed only now, so its own dotted keys could make tables.
+			p.inline[table] = true
+			return table, nil
+		default:
+			return nil, p.errorf(p.pos, "expected , or } in the inline table, found %s", p.found())
+		}
+	}
+}
+
+// basicString reads a "string" or """multi-line string""", applying its
+// escapes.
+func (p *tomlParser) basicString() (string, error) {
+	start := p.pos
+	multi := p.has(`"""`)
+	if multi {
+		p.pos += 3
+		p.skipNewline()
+	} else {
+		p.pos++
+	}
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return "", p.errorf(start, "unterminated string")
+		}
+		c := p.peek()
+		switch {
+		case multi && p.has(`"""`):
+			p.pos += 3
+			// Up to two quotes may end the content right before the close.
+			for i := 0; i < 2 && p.peek() == '"'; i++ {
+				b.WriteByte('"')
+				p.pos++
+			}
+			return b.String(), nil
+		case !multi && c == '"':
+			p.pos++
+			return b.String(), nil
+		case !multi && (c == '\n' || c == '\r'):
+			return "", p.errorf(start, "unterminated string")
+		case c == '\\':
+			if multi && p.lineEndingBackslash() {
+				continue
+			}
+			r, err := p.escape()
+			if err != nil {
+				return "", err
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+// lineEndingBackslash skips a backslash that ends a line, with the
+// whitespace and newlines after it.
+func (p *tomlParser) lineEndingBackslash() bool {
+	i := p.pos + 1
+	for i < len(p.src) && (p.src[i] == ' ' || p.src[i] == '\t') {
+		i++
+	}
+	if i >= len(p.src) || p.src[i] != '\n' && p.src[i] != '\r' {
+		return false
+	}
+	for i < len(p.src) && strings.IndexByte(" \t\r\n", p.src[i]) >= 0 {
+		i++
+	}
+	p.pos = i
+	return true
+}
+
+func (p *tomlParser) escape() (rune, error) {
+	start := p.pos
+	p.pos++ // backslash
+	if p.eof() {
+		return 0, p.errorf(start, "unterminated escape")
+	}
+	c := p.peek()
+	p.pos++
+	switch c {
+	case 'b':
+		return '\b', nil
+	case 't':
+		return '\t', nil
+	case 'n':
+		return '\n', nil
+	case 'f':
+		return '\f', nil
+	case 'r':
+		return '\r', nil
+	case 'e':
+		return 0x1b, nil
+	case '"':
+		return '"', nil
+	case '\\':
+		return '\\', nil
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.src) {
+			return 0, p.errorf(start, "short unicode escape")
+		}
+		code, err := strconv.ParseUint(p.src[p.pos:p.pos+n], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return 0, p.errorf(start, "invalid unicode escape %q", p.src[start:p.pos+n])
+		}
+		p.pos += n
+		return rune(code), nil
+	}
+	return 0, p.errorf(start, "invalid escape \\%c", c)
+}
+
+// literalString reads a literal string, single-line or multi-line, as it
+// is.
+func (p *tomlParser) literalString() (string, error) {
+	start := p.pos
+	if p.has("'''") {
+		p.pos += 3
+		p.skipNewline()
+		end := strings.Index(p.src[p.pos:], "'''")
+		if end < 0 {
+			return "", p.errorf(start, "unterminated string")
+		}
+		end += p.pos
+		// Up to two quotes may end the content right before the close.
+		for i := 0; i < 2 && end+3 < len(p.src) && p.src[end+3] == '\''; i++ {
+			end++
+		}
+		s := p.src[p.pos:end]
+		p.pos = end + 3
+		return s, nil
+	}
+	p.pos++
+	end := strings.IndexAny(p.src[p.pos:], "'\n")
+	if end < 0 || p.src[p.pos+end] != '\'' {
+		return "", p.errorf(start, "unterminated string")
+	}
+	s := p.src[p.pos : p.pos+end]
+	p.pos += end + 1
+	return s, nil
+}
+
+// skipNewline drops the newline right after the opening quotes of a
+// multi-line string.
+func (p *tomlParser) skipNewline() {
+	switch {
+	case p.has("\r\n"):
+		p.pos += 2
+	case p.peek() == '\n':
+		p.pos++
+	}
+}
+
+// lookup returns the value of key in mapping, or nil.
+func lookup(mapping *yaml.Node, key string) *yaml.Node {
+	if i := keyIndex(mapping, key); i >= 0 {
+		return mapping.Content[i+1]
+	}
+	return nil
+}
+
+func joinKeys(keys []*yaml.Node) string {
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k.Value
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"yaperf/pkg/perf"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		// want is the document as JSON, or err what its error says.
+		want string
+		err  string
+	}{
+		{"scalars", "a = 1\nb = 0x10\nc = 1_000\nd = 1.5e3\ne = true\nf = 1979-05-27T07:32:00Z", `{"a":1,"b":16,"c":1000,"d":1500,"e":true,"f":"1979-05-27T07:32:00Z"}`, ""},
+		{"hex sign", "a = -0x10", "", "invalid value"},
+		{"date with a space", "a = 1979-05-27 07:32:00", `{"a":"1979-05-27 07:32:00"}`, ""},
+		{"leading zero", "a = 01", "", "invalid value"},
+
+		{"escapes", `a = "tab\tquote\"back\\slash\u00e9\U0001F600"`, `{"a":"tab\tquote\"back\\slash\u00e9\ud83d\ude00"}`, ""},
+		{"literal", `a = 'C:\path\n'`, `{"a":"C:\\path\\n"}`, ""},
+		{"multi-line", "a = \"\"\"\none \\\n   two\"\"\"", `{"a":"one two"}`, ""},
+		{"multi-line quotes", `a = """"x"""""`, `{"a":"\"x\"\""}`, ""},
+		{"multi-line literal", "a = '''\nraw\\n'''", `{"a":"raw\\n"}`, ""},
+		{"bad escape", `a = "\q"`, "", `invalid escape \q`},
+		{"bad unicode", `a = "\uD800"`, "", "invalid unicode escape"},
+		{"unterminated", `a = "x`, "", "unterminated string"},
+
+		{"dotted keys", "a.b = 1\na.c = 2\n\"a\".'d' = 3", `{"a":{"b":1,"c":2,"d":3}}`, ""},
+		{"tables", "[a]\nx = 1\n[a.b]\ny = 2\n[c]", `{"a":{"b":{"y":2},"x":1},"c":{}}`, ""},
+		{"implicit table defined later", "[a.b]\nx = 1\n[a]\ny = 2", `{"a":{"b":{"x":1},"y":2}}`, ""},
+		{"sub-table of a dotted table", "a.b.c = 1\n[a.b.d]\nx = 2", `{"a":{"b":{"c":1,"d":{"x":2}}}}`, ""},
+
+		{"duplicate key", "a = 1\na = 2", "", "a is already defined"},
+		{"table twice", "[a]\n[a]", "", "a is already defined"},
+		{"table over a key", "a = 1\n[a]", "", "a is already defined"},
+		{"table over a dotted table", "a.b = 1\n[a]", "", "a is already defined"},
+		{"nested table over a dotted table", "[x]\na.b = 1\n[x.a]", "", "x.a is already defined"},
+		{"dotted keys into a header table", "[a.b]\nx = 1\n[a]\nb.y = 2", "", "b is already defined"},
+		{"dotted key over a scalar", "a = 1\na.b = 2", "", "a is not a table"},
+
+		{"inline table", "a = { b = 1, c.d = 'x', e = {} }", `{"a":{"b":1,"c":{"d":"x"},"e":{}}}`, ""},
+		{"inline table added to", "a = { b = 1 }\na.c = 2", "", "a is not a table"},
+		{"inline table reopened", "a = { b = 1 }\n[a]", "", "a is already defined"},
+		{"inline table sub-table", "a = { b = 1 }\n[a.c]", "", "a is not a table"},
+		{"inline table newline", "a = { b = 1,\nc = 2 }", "", "expected a key"},
+
+		{"arrays", "a = [1, [2, 'x'], { b = 3 },\n  # comment\n]", `{"a":[1,[2,"x"],{"b":3}]}`, ""},
+		{"array unclosed", "a = [1 2]", "", "expected , or ]"},
+
+		{"arrays of tables", "[[a]]\nx = 1\n[[a]]\nx = 2\n[a.b]\ny = 3\n[[a.c]]\nz = 4", `{"a":[{"x":1},{"b":{"y":3},"c":[{"z":4}],"x":2}]}`, ""},
+		{"array of tables over a table", "[a]\n[[a]]", "", "a is already defined"},
+		{"array of tables over an inline array", "a = []\n[[a]]", "", "a is already defined"},
+		{"table over an array of tables", "[[a]]\n[a]", "", "a is already defined"},
+
+		{"junk after a value", "a = 1 b", "", "line 1, column 7: expected the end of the line"},
+		{"error position", "a = 1\n\nb = @", "", "line 3, column 5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parseTOML([]byte(tt.in))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var v any
+			if err := doc.Decode(&v); err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want any
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if wantJSON, _ := json.Marshal(want); string(got) != string(wantJSON) {
+				t.Errorf("got %s, want %s", got, wantJSON)
+			}
+		})
+	}
+}
+
+// TestConfigFormatParity loads the same config written in each format.
+func TestConfigFormatParity(t *testing.T) {
+	var configs []perf.Config
+	for _, name := range []string{"config.yaml", "config.json", "config.toml"} {
+		doc, err := readConfig(filepath.Join("testdata", name), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var config perf.Config
+		if err := doc.Decode(&config); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(config.URLs) != 2 || config.URLs[0].Name != `edge "one"` || config.Labels["rack"] != "7" {
+			t.Fatalf("%s: decoded %+v", name, config)
+		}
+		configs = append(configs, config)
+	}
+	for i, name := range []string{"config.json", "config.toml"} {
+		if !reflect.DeepEqual(configs[i+1], configs[0]) {
+			t.Errorf("%s differs from config.yaml:\n%+v\nwant:\n%+v", name, configs[i+1], configs[0])
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+
+	"yaperf/pkg/perf"
+)
+
+// ring holds the last cap values pushed, overwriting the oldest.
+type ring struct {
+	values []float64
+	start  int
+	size   int
+}
+
+func newRing(size int) *ring {
+	return &ring{values: make([]float64, 0, size), size: size}
+}
+
+func (r *ring) push(v float64) {
+	if len(r.values) < r.size {
+		r.values = append(r.values, v)
+		return
+	}
+	r.values[r.start] = v
+	r.start = (r.start + 1) % r.size
+}
+
+// list returns the values from oldest to newest.
+func (r *ring) list() []float64 {
+	return append(append([]float64(nil), r.values[r.start:]...), r.values[:r.start]...)
+}
+
+// trends remembers the recent speeds of every URL across passes. A nil
+// *trends renders no trends.
+type trends struct {
+	history, window int
+	speeds          map[seriesKey]*ring
+}
+
+func newTrends(cfg perf.Trend) *trends {
+	t := &trends{history: cfg.History, window: cfg.Window, speeds: map[seriesKey]*ring{}}
+	if t.history == 0 {
+		t.history = 10
+	}
+	if t.window == 0 {
+		t.window = 5
+	}
+	return t
+}
+
+// add records a completed transfer and renders its trend, or returns "" for
+// anything else and for a URL's first result.
+func (t *trends) add(result perf.Stats) string {
+	if t == nil || !result.Done || result.Direction == perf.Latency || result.URL == perf.TotalURL {
+		return ""
+	}
+	key := seriesKey{result.URL, result.Direction, result.Family, result.Agent}
+	r := t.speeds[key]
+	if r == nil {
+		// One more than the window so the mean can leave out the newest.
+		r = newRing(max(t.history, t.window+1))
+		t.speeds[key] = r
+	}
+	r.push(result.SpeedMbps)
+	speeds := r.list()
+	if len(speeds) < 2 {
+		return ""
+	}
+	recent := speeds[max(0, len(speeds)-t.history):]
+	return sparkline(recent, len(recent)) + " " + change(speeds, t.window)
+}
+
+// change compares the newest of speeds with the mean of up to window
+// speeds before it, as an arrow and a percentage.
+func change(speeds []float64, window int) string {
+	newest := speeds[len(speeds)-1]
+	prior := speeds[max(0, len(speeds)-1-window) : len(speeds)-1]
+	var sum float64
+	for _, v := range prior {
+		sum += v
+	}
+	mean := sum / float64(len(prior))
+	if mean == 0 {
+		return "-"
+	}
+	pct := (newest - mean) / mean * 100
+	arrow := "→"
+	switch {
+	case pct >= 1:
+		arrow = "▲"
+	case pct <= -1:
+		arrow = "▼"
+	}
+	return fmt.Sprintf("%s %+.0f%%", arrow, pct)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+func TestRing(t *testing.T) {
+	r := newRing(3)
+	var got []string
+	for v := range 5 {
+		r.push(float64(v))
+		got = append(got, fmt.Sprint(r.list()))
+	}
+	if want := "[[0] [0 1] [0 1 2] [1 2 3] [2 3 4]]"; fmt.Sprint(got) != want {
+		t.Errorf("ring lists %v, want %v", got, want)
+	}
+}
+
+func TestChange(t *testing.T) {
+	tests := []struct {
+		speeds []float64
+		window int
+		want   string
+	}{
+		{[]float64{100, 108}, 5, "▲ +8%"},
+		{[]float64{100, 50}, 5, "▼ -50%"},
+		{[]float64{100, 100.5}, 5, "→ +0%"},
+		{[]float64{100, 99.5}, 5, "→ -0%"},
+		// The mean leaves out the newest speed and looks back window speeds.
+		{[]float64{10, 100, 200, 165}, 2, "▲ +10%"},
+		{[]float64{10, 100, 200, 165}, 5, "▲ +60%"},
+		{[]float64{0, 0, 50}, 5, "-"},
+	}
+	for _, tt := range tests {
+		if got := change(tt.speeds, tt.window); got != tt.want {
+			t.Errorf("change(%v, %d) = %q, want %q", tt.speeds, tt.window, got, tt.want)
+		}
+	}
+}
+
+func TestTrends(t *testing.T) {
+	done := func(url string, mbps float64) perf.Stats {
+		return perf.Stats{URL: url, Direction: perf.Download, Done: true, SpeedMbps: mbps}
+	}
+	tr := newTrends(perf.Trend{History: 4, Window: 2})
+	var got []string
+	for _, mbps := range []float64{10, 30, 50, 70, 90, 20} {
+		got = append(got, tr.add(done("a", mbps)))
+	}
+	// A URL's first result has no trend, and the sparkline shows the last
+	// four speeds.
+	want := []string{"", "▃█ ▲ +200%", "▂▅█ ▲ +150%", "▂▄▆█ ▲ +75%", "▃▄▆█ ▲ +50%", "▄▆█▂ ▼ -75%"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("trends\n%q\nwant\n%q", got, want)
+	}
+	// Other URLs start over; progress, latency and totals have none.
+	if s := tr.add(done("b", 5)); s != "" {
+		t.Errorf("first result of b has trend %q", s)
+	}
+	for _, s := range []perf.Stats{
+		{URL: "a", Direction: perf.Download, SpeedMbps: 5},
+		{URL: "a", Direction: perf.Latency, Done: true},
+		{URL: perf.TotalURL, Direction: perf.Download, Done: true, SpeedMbps: 5},
+	} {
+		if trend := tr.add(s); trend != "" {
+			t.Errorf("%+v has trend %q", s, trend)
+		}
+	}
+	var off *trends
+	if s := off.add(done("a", 5)); s != "" {
+		t.Errorf("nil trends rendered %q", s)
+	}
+}
+
+func TestNoTrendFlag(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "urls.yaml"), []byte("iterations: 3\nurls:\n  - "+srv.URL+"/a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		args  []string
+		lines int
+	}{
+		// The second and third passes have a trend.
+		{nil, 2},
+		{[]string{"-no-trend"}, 0},
+	} {
+		var stdout strings.Builder
+		cmd := yaperf(dir, tt.args...)
+		cmd.Stdout = &stdout
+		if code := exitCode(t, cmd, time.Minute); code != 0 {
+			t.Fatalf("%v: exit code %d", tt.args, code)
+		}
+		if got := strings.Count(stdout.String(), "\n  Trend:    "); got != tt.lines {
+			t.Errorf("%v: %d trend lines, want %d:\n%s", tt.args, got, tt.lines, stdout.String())
+		}
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"yaperf/pkg/perf"
+)
+
+// dashRefresh is how often the dashboard redraws.
+const dashRefresh = 200 * time.Millisecond
+
+// dashLogLines is how many of the latest log lines the dashboard shows.
+const dashLogLines = 3
+
+// dashKey tells the dashboard's rows apart, the way summaries are.
+type dashKey struct {
+	url       string
+	direction perf.Direction
+	ip        string
+	family    string
+	agent     string
+}
+
+// dashRow is the state of one URL on the dashboard.
+type dashRow struct {
+	key     dashKey
+	label   string
+	running bool
+	nowMbps float64
+	samples []float64
+	// runs counts completed transfers; sumMbps and peakMbps are over them
+	// and the progress seen since.
+	runs     int
+	sumMbps  float64
+	peakMbps float64
+	bytes    int64
+	errors   int
+	lastErr  perf.ErrorKind
+	failing  bool
+}
+
+func (r *dashRow) avgMbps() float64 {
+	if r.runs == 0 {
+		return 0
+	}
+	return r.sumMbps / float64(r.runs)
+}
+
+// dashModel is what the dashboard shows, kept apart from the terminal so
+// it can be driven by results and keys alone.
+type dashModel struct {
+	started  time.Time
+	rows     []*dashRow
+	index    map[dashKey]*dashRow
+	selected int
+	paused   bool
+	finished bool
+	status   string
+	logs     []string
+}
+
+func newDashModel(started time.Time) *dashModel {
+	return &dashModel{started: started, index: map[dashKey]*dashRow{}}
+}
+
+// update folds a result into its row. The TOTAL snapshots of concurrent
+// runs are left out; the footer sums the rows instead.
+func (m *dashModel) update(result perf.Stats) {
+	if result.URL == perf.TotalURL {
+		return
+	}
+	key := dashKey{result.URL, result.Direction, result.PinnedIP, result.Family, result.Agent}
+	row, ok := m.index[key]
+	if !ok {
+		row = &dashRow{key: key, label: label(result)}
+		if result.PinnedIP != "" {
+			row.label += " @" + result.PinnedIP
+		}
+		m.index[key] = row
+		m.rows = append(m.rows, row)
+	}
+	switch result.Kind {
+	case perf.KindRetry:
+		row.lastErr = result.ErrorKind
+	case perf.KindProgress:
+		row.running = true
+		row.nowMbps = result.IntervalSpeedMbps
+		row.peakMbps = max(row.peakMbps, result.IntervalSpeedMbps)
+		row.samples = append(row.samples, result.IntervalSpeedMbps)
+		// Keep enough for the widest graph a terminal will show.
+		if len(row.samples) > 512 {
+			row.samples = row.samples[len(row.samples)-512:]
+		}
+	default:
+		row.running, row.nowMbps = false, 0
+		switch result.Kind {
+		case perf.KindSkipped, perf.KindCancelled:
+		case perf.KindError:
+			row.errors++
+			row.lastErr, row.failing = result.ErrorKind, true
+		default:
+			row.runs++
+			row.sumMbps += result.SpeedMbps
+			row.peakMbps = max(row.peakMbps, result.PeakMbps, result.SpeedMbps)
+			row.bytes += result.SizeBytes
+			row.failing = false
+		}
+	}
+}
+
+// dashAction is what a key asks of the dashboard beyond redrawing.
+type dashAction int
+
+const (
+	dashNone dashAction = iota
+	dashQuit
+	dashRestart
+)
+
+// key applies one key press. Arrow keys arrive as their escape sequence.
+func (m *dashModel) key(k string) dashAction {
+	switch k {
+	case "q", "Q", "\x03":
+		return dashQuit
+	case "p", "P", " ":
+		m.paused = !m.paused
+	case "r", "R":
+		if m.selectedRow() != nil && !m.finished {
+			return dashRestart
+		}
+	case "k", "\x1b[A":
+		m.selected = max(0, m.selected-1)
+	case "j", "\x1b[B":
+		m.selected = min(len(m.rows)-1, m.selected+1)
+	}
+	return dashNone
+}
+
+func (m *dashModel) selectedRow() *dashRow {
+	if m.selected < 0 || m.selected >= len(m.rows) {
+		return nil
+	}
+	return m.rows[m.selected]
+}
+
+func (m *dashModel) log(line string) {
+	m.logs = append(m.logs, line)
+	if len(m.logs) > dashLogLines {
+		m.logs = m.logs[len(m.logs)-dashLogLines:]
+	}
+}
+
+// render lays the dashboard out in width columns and at most height
+// lines: a header, a line per URL, and a footer with the totals, the
+// latest log lines and the keys.
+func (m *dashModel) render(width, height int, now time.Time) []string {
+	header := fmt.Sprintf("yaperf  %d urls  %s", len(m.rows), clock(now.Sub(m.started)))
+	switch {
+	case m.finished:
+		header += "  run finished, press q to exit"
+	case m.paused:
+		header += "  PAUSED"
+	}
+	lines := []string{bold(fit(header, width)), ""}
+
+	nameWidth := 4
+	for _, row := range m.rows {
+		nameWidth = max(nameWidth, utf8.RuneCountInString(row.label))
+	}
+	nameWidth = min(nameWidth, max(12, width/3))
+	const fixed = "  %-*s  %-7s  %9s  %9s  %9s  %4s  %-16s  "
+	graphWidth := max(0, width-len(fmt.Sprintf(fixed, nameWidth, "", "", "", "", "", "", "")))
+	u := columnUnit(m.rows, func(row *dashRow) float64 { return row.peakMbps })
+	lines = append(lines, dim(fit(fmt.Sprintf(fixed+"%s", nameWidth, "URL", "State", "Now "+u.name, "Avg "+u.name, "Peak "+u.name, "Runs", "Errors", "Graph"), width)))
+
+	var nowMbps float64
+	var runs, errs int
+	var total int64
+	body := max(0, height-len(lines)-3-len(m.logs))
+	first := 0
+	if m.selected >= body {
+		first = m.selected - body + 1
+	}
+	for i, row := range m.rows {
+		nowMbps += row.nowMbps
+		runs += row.runs
+		errs += row.errors
+		total += row.bytes
+		if i < first || i >= first+body {
+			continue
+		}
+		state := "waiting"
+		switch {
+		case row.running:
+			state = "running"
+		case row.failing:
+			state = "failed"
+		case row.runs > 0:
+			state = "done"
+		}
+		badge := "-"
+		if row.errors > 0 || row.lastErr != "" {
+			badge = fmt.Sprintf("✗ %d %s", row.errors, row.lastErr)
+		}
+		line := fit(fmt.Sprintf(fixed+"%s", nameWidth, truncate(row.label, nameWidth), state,
+			speedCell(u, row.nowMbps, row.running), speedCell(u, row.avgMbps(), row.runs > 0), speedCell(u, row.peakMbps, row.peakMbps > 0),
+			fmt.Sprint(row.runs), truncate(badge, 16), sparkline(row.samples, graphWidth)), width)
+		if i == m.selected {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		} else if row.failing {
+			line = "\x1b[31m" + line + "\x1b[0m"
+		}
+		lines = append(lines, line)
+	}
+
+	lines = append(lines, "", bold(fit(fmt.Sprintf("Total  now %s  %d runs  %d errors  %s transferred", showSpeed(nowMbps), runs, errs, showSize(total)), width)))
+	for _, l := range m.logs {
+		lines = append(lines, dim(fit(l, width)))
+	}
+	keys := "q quit  p pause  r restart  ↑↓ select"
+	if m.status != "" {
+		keys += "  " + m.status
+	}
+	return append(lines, dim(fit(keys, width)))
+}
+
+// speedCell is v in u, or "-" when it is not known yet.
+func speedCell(u speedUnit, v float64, ok bool) string {
+	if !ok {
+		return "-"
+	}
+	return u.number(v)
+}
+
+func bold(s string) string { return "\x1b[1m" + s + "\x1b[0m" }
+
+func dim(s string) string { return "\x1b[2m" + s + "\x1b[0m" }
+
+// fit truncates or pads s to exactly width runes.
+func fit(s string, width int) string {
+	s = truncate(s, width)
+	return s + strings.Repeat(" ", max(0, width-utf8.RuneCountInString(s)))
+}
+
+// dashboard shows a dashModel full screen on a terminal and reads its
+// keys. It is a reporter, so it sees the run only through its results.
+type dashboard struct {
+	in, out *os.File
+	restore func()
+
+	mu      sync.Mutex
+	model   *dashModel
+	dirty   bool
+	quit    func()
+	restart func(perf.Stats) error
+
+	keys chan string
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// openDashboard takes over the terminal in and out, or returns an error
+// when they are not a terminal that can be put into raw mode. quit is
+// called when q is pressed.
+func openDashboard(in, out *os.File, quit func()) (*dashboard, error) {
+	if !isTerminal(in) || !isTerminal(out) {
+		return nil, fmt.Errorf("stdin and stdout must be a terminal")
+	}
+	if _, _, err := terminalSize(out); err != nil {
+		return nil, err
+	}
+	restore, err := rawTerminal(in)
+	if err != nil {
+		return nil, err
+	}
+	d := &dashboard{
+		in: in, out: out, restore: restore,
+		model: newDashModel(time.Now()), dirty: true, quit: quit,
+		keys: make(chan string, 8), done: make(chan struct{}),
+	}
+	// Switch to the alternate screen and hide the cursor.
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	go d.readKeys()
+	d.wg.Add(1)
+	go d.loop()
+	return d, nil
+}
+
+// setRestart sets how the r key restarts the test of a row, given its
+// last result.
+func (d *dashboard) setRestart(restart func(perf.Stats) error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.restart = restart
+}
+
+func (d *dashboard) readKeys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := d.in.Read(buf)
+		if err != nil {
+			return
+		}
+		d.keys <- string(buf[:n])
+	}
+}
+
+func (d *dashboard) loop() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(dashRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case k := <-d.keys:
+			d.press(k)
+		case <-ticker.C:
+		}
+		d.draw()
+	}
+}
+
+func (d *dashboard) press(k string) {
+	d.mu.Lock()
+	action := d.model.key(k)
+	row := d.model.selectedRow()
+	restart, finished := d.restart, d.model.finished
+	d.model.status = ""
+	d.dirty = true
+	d.mu.Unlock()
+
+	switch action {
+	case dashQuit:
+		if !finished {
+			d.quit()
+		}
+		d.mu.Lock()
+		d.model.finished = true
+		d.mu.Unlock()
+		select {
+		case <-d.done:
+		default:
+			close(d.done)
+		}
+	case dashRestart:
+		var err error
+		if restart != nil {
+			err = restart(perf.Stats{URL: row.key.url, Direction: row.key.direction, PinnedIP: row.key.ip, Family: row.key.family})
+		}
+		d.mu.Lock()
+		d.model.status = "restarted " + row.label
+		if err != nil {
+			d.model.status = err.Error()
+		}
+		d.mu.Unlock()
+	}
+}
+
+// draw redraws the screen. While the display is paused it is only
+// redrawn after a key press.
+func (d *dashboard) draw() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.model.paused && !d.dirty {
+		return
+	}
+	d.dirty = false
+	width, height, err := terminalSize(d.out)
+	if err != nil || width == 0 || height == 0 {
+		width, height = 80, 24
+	}
+	var b bytes.Buffer
+	b.WriteString("\x1b[H")
+	for i, line := range d.model.render(width, height, time.Now()) {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line)
+		b.WriteString("\x1b[K")
+	}
+	b.WriteString("\x1b[J")
+	d.out.Write(b.Bytes())
+}
+
+// Write takes the lines the logger writes while the dashboard has the
+// screen, showing the latest in the footer.
+func (d *dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimSpace(string(p)), "\n") {
+		d.model.log(line)
+	}
+	d.dirty = true
+	return len(p), nil
+}
+
+func (d *dashboard) add(result perf.Stats) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.model.paused {
+		d.dirty = true
+	}
+	d.model.update(result)
+}
+
+func (d *dashboard) OnProgress(result perf.Stats) { d.add(result) }
+
+func (d *dashboard) OnComplete(result perf.Stats) { d.add(result) }
+
+func (d *dashboard) OnPass(resultTable) {}
+
+func (d *dashboard) OnSummary([]perf.Summary) {}
+
+// close waits for q once the run is over, gives the terminal back and
+// prints summaries, so the run leaves its results behind on stdout.
+// Logging goes back to stderr through handler.
+func (d *dashboard) close(summaries []perf.Summary, handler slog.Handler) {
+	d.mu.Lock()
+	d.model.finished, d.model.paused, d.dirty = true, false, true
+	d.mu.Unlock()
+	d.wg.Wait()
+
+	fmt.Fprint(d.out, "\x1b[?25h\x1b[?1049l")
+	d.restore()
+	slog.SetDefault(slog.New(handler))
+	if len(summaries) > 0 {
+		printSummary(os.Stdout, "text", summaries)
+	}
+}
+
+// restarter returns how the dashboard restarts a row: by testing the
+// configured target it came from once more, outside the pass, so its
+// results show on the dashboard only. URL templates are expanded afresh,
+// signed with key.
+func restarter(ctx context.Context, d *dashboard, tester *perf.Tester, targets []perf.Target, key string) func(perf.Stats) error {
+	return func(row perf.Stats) error {
+		if row.PinnedIP != "" || row.Family != "" {
+			return errors.New("copies made by resolve_all or dualstack_compare cannot be restarted")
+		}
+		for _, target := range targets {
+			if target.URL == row.URL && target.Direction() == row.Direction {
+				expanded, err := perf.ExpandTargets([]perf.Target{target}, key, time.Now())
+				if err != nil {
+					return err
+				}
+				target := expanded[0]
+				go func() {
+					for result := range tester.Test(ctx, target) {
+						d.add(result)
+					}
+				}()
+				return nil
+			}
+		}
+		return fmt.Errorf("%s is not in the config", row.URL)
+	}
+}
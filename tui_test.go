@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+var ansi = regexp.MustCompile("\x1b\\[[0-9;?]*[A-Za-z]")
+
+// screen is what render shows, without the escape sequences.
+func screen(m *dashModel, width, height int) []string {
+	lines := m.render(width, height, m.started.Add(65*time.Second))
+	for i, l := range lines {
+		lines[i] = ansi.ReplaceAllString(l, "")
+	}
+	return lines
+}
+
+func TestDashModelUpdate(t *testing.T) {
+	m := newDashModel(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	a := perf.Stats{URL: "https://example.com/a", Direction: perf.Download}
+	progress := func(s perf.Stats, mbps float64) perf.Stats {
+		s.Kind, s.IntervalSpeedMbps = perf.KindProgress, mbps
+		return s
+	}
+	final := func(s perf.Stats, mbps, peak float64) perf.Stats {
+		s.Kind, s.Done, s.SpeedMbps, s.PeakMbps, s.SizeBytes = perf.KindFinal, true, mbps, peak, 1000
+		return s
+	}
+	m.update(progress(a, 80))
+	m.update(progress(a, 120))
+	row := m.rows[0]
+	if !row.running || row.nowMbps != 120 || row.peakMbps != 120 || len(row.samples) != 2 || row.avgMbps() != 0 {
+		t.Errorf("after progress %+v", *row)
+	}
+	m.update(final(a, 100, 130))
+	m.update(final(a, 200, 0))
+	if row.running || row.nowMbps != 0 || row.runs != 2 || row.avgMbps() != 150 || row.peakMbps != 200 || row.bytes != 2000 {
+		t.Errorf("after finals %+v", *row)
+	}
+
+	// A retry marks the error kind; a failure counts and marks the row
+	// failing until the next success.
+	retry := a
+	retry.Kind, retry.ErrorKind = perf.KindRetry, perf.ErrorTimeout
+	m.update(retry)
+	if row.errors != 0 || row.lastErr != perf.ErrorTimeout || row.failing {
+		t.Errorf("after retry %+v", *row)
+	}
+	failed := a
+	failed.Kind, failed.ErrorKind, failed.Error = perf.KindError, perf.ErrorHTTPStatus, errors.New("unexpected status 503")
+	m.update(failed)
+	if row.errors != 1 || row.lastErr != perf.ErrorHTTPStatus || !row.failing || row.runs != 2 {
+		t.Errorf("after failure %+v", *row)
+	}
+	m.update(final(a, 150, 0))
+	if row.failing || row.runs != 3 {
+		t.Errorf("after recovery %+v", *row)
+	}
+	// Skipped and cancelled runs stop the row without counting.
+	for _, kind := range []perf.Kind{perf.KindSkipped, perf.KindCancelled} {
+		m.update(progress(a, 10))
+		s := a
+		s.Kind = kind
+		m.update(s)
+		if row.running || row.runs != 3 || row.errors != 1 {
+			t.Errorf("after %s %+v", kind, *row)
+		}
+	}
+
+	// Each direction and pinned address is a row; TOTAL is not.
+	up := a
+	up.Direction, up.Kind = perf.Upload, perf.KindProgress
+	pinned := a
+	pinned.PinnedIP, pinned.Kind = "192.0.2.1", perf.KindProgress
+	m.update(up)
+	m.update(pinned)
+	m.update(perf.Stats{URL: perf.TotalURL, Direction: perf.Download, Kind: perf.KindFinal, Done: true})
+	if len(m.rows) != 3 || m.rows[1].label != "https://example.com/a (upload)" || m.rows[2].label != "https://example.com/a @192.0.2.1" {
+		t.Errorf("%d rows, labels %q and %q", len(m.rows), m.rows[1].label, m.rows[2].label)
+	}
+
+	for range 600 {
+		m.update(progress(a, 1))
+	}
+	if len(row.samples) != 512 {
+		t.Errorf("kept %d samples, want 512", len(row.samples))
+	}
+}
+
+func TestDashModelKeys(t *testing.T) {
+	m := newDashModel(time.Now())
+	if m.key("r") != dashNone {
+		t.Error("restart with no rows")
+	}
+	for _, url := range []string{"a", "b", "c"} {
+		m.update(perf.Stats{URL: url, Direction: perf.Download, Kind: perf.KindProgress})
+	}
+	tests := []struct {
+		key      string
+		action   dashAction
+		selected int
+		paused   bool
+	}{
+		{"j", dashNone, 1, false},
+		{"\x1b[B", dashNone, 2, false},
+		{"j", dashNone, 2, false},
+		{"\x1b[A", dashNone, 1, false},
+		{"k", dashNone, 0, false},
+		{"k", dashNone, 0, false},
+		{"p", dashNone, 0, true},
+		{" ", dashNone, 0, false},
+		{"r", dashRestart, 0, false},
+		{"x", dashNone, 0, false},
+		{"q", dashQuit, 0, false},
+		{"\x03", dashQuit, 0, false},
+	}
+	for _, tt := range tests {
+		if got := m.key(tt.key); got != tt.action || m.selected != tt.selected || m.paused != tt.paused {
+			t.Errorf("key %q: action %v, selected %d, paused %v; want %v, %d, %v", tt.key, got, m.selected, m.paused, tt.action, tt.selected, tt.paused)
+		}
+	}
+	m.finished = true
+	if m.key("r") != dashNone {
+		t.Error("restart after the run finished")
+	}
+}
+
+func TestDashModelRender(t *testing.T) {
+	m := newDashModel(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	for _, url := range []string{"https://example.com/a", "https://example.com/b"} {
+		m.update(perf.Stats{URL: url, Direction: perf.Download, Kind: perf.KindFinal, Done: true, SpeedMbps: 100, SizeBytes: 125000000})
+	}
+	m.update(perf.Stats{URL: "https://example.com/b", Direction: perf.Download, Kind: perf.KindError, ErrorKind: perf.ErrorTimeout})
+	m.update(perf.Stats{URL: "https://example.com/a", Direction: perf.Download, Kind: perf.KindProgress, IntervalSpeedMbps: 50})
+	m.log("first")
+	m.log("second")
+
+	lines := screen(m, 120, 24)
+	for i, l := range lines {
+		if n := len([]rune(l)); l != "" && n != 120 {
+			t.Errorf("line %d is %d runes wide: %q", i, n, l)
+		}
+	}
+	want := []string{"yaperf  2 urls  01:05", "", "URL", "https://example.com/a", "https://example.com/b", "", "Total  now 50.00 Mbps  2 runs  1 errors  250.00 MB transferred", "first", "second", "q quit  p pause  r restart"}
+	if len(lines) != len(want) {
+		t.Fatalf("%d lines, want %d:\n%s", len(lines), len(want), strings.Join(lines, "\n"))
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(strings.TrimSpace(lines[i]), w) {
+			t.Errorf("line %d = %q, want it to start with %q", i, lines[i], w)
+		}
+	}
+	if row := lines[3]; !strings.Contains(row, "running") || !strings.Contains(row, "50.00") {
+		t.Errorf("running row %q", row)
+	}
+	if row := lines[4]; !strings.Contains(row, "failed") || !strings.Contains(row, "✗ 1 timeout") {
+		t.Errorf("failed row %q", row)
+	}
+
+	m.paused = true
+	if lines := screen(m, 120, 24); !strings.Contains(lines[0], "PAUSED") {
+		t.Errorf("header %q while paused", lines[0])
+	}
+	m.finished = true
+	if lines := screen(m, 120, 24); !strings.Contains(lines[0], "run finished") {
+		t.Errorf("header %q once finished", lines[0])
+	}
+
+	// A short screen scrolls to keep the selected row in view.
+	m.logs = nil
+	for _, url := range []string{"c", "d", "e", "f"} {
+		m.update(perf.Stats{URL: url, Direction: perf.Download, Kind: perf.KindProgress})
+	}
+	m.selected = 5
+	lines = screen(m, 80, 8)
+	if len(lines) != 8 || !strings.HasPrefix(strings.TrimSpace(lines[3]), "e") || !strings.HasPrefix(strings.TrimSpace(lines[4]), "f") {
+		t.Errorf("scrolled screen:\n%s", strings.Join(lines, "\n"))
+	}
+}
+
+func TestDashboardPress(t *testing.T) {
+	quits := 0
+	d := &dashboard{model: newDashModel(time.Now()), quit: func() { quits++ }, done: make(chan struct{})}
+	d.add(perf.Stats{URL: "https://example.com/a", Direction: perf.Upload, Kind: perf.KindProgress})
+	d.add(perf.Stats{URL: "https://example.com/a", Direction: perf.Download, PinnedIP: "192.0.2.1", Kind: perf.KindProgress})
+
+	var restarted []perf.Stats
+	d.setRestart(func(row perf.Stats) error {
+		restarted = append(restarted, row)
+		if row.PinnedIP != "" {
+			return errors.New("cannot restart a pinned copy")
+		}
+		return nil
+	})
+	d.press("r")
+	if len(restarted) != 1 || restarted[0].URL != "https://example.com/a" || restarted[0].Direction != perf.Upload {
+		t.Errorf("restarted %+v", restarted)
+	}
+	if d.model.status != "restarted https://example.com/a (upload)" {
+		t.Errorf("status %q", d.model.status)
+	}
+	d.press("j")
+	if d.model.status != "" {
+		t.Errorf("status %q kept after another key", d.model.status)
+	}
+	d.press("r")
+	if d.model.status != "cannot restart a pinned copy" {
+		t.Errorf("status %q, want the restart error", d.model.status)
+	}
+
+	d.Write([]byte("level=INFO msg=one\nlevel=INFO msg=two\n"))
+	if len(d.model.logs) != 2 || d.model.logs[1] != "level=INFO msg=two" {
+		t.Errorf("logs %q", d.model.logs)
+	}
+
+	// Paused, results are kept but do not ask for a redraw.
+	d.press("p")
+	d.dirty = false
+	d.add(perf.Stats{URL: "https://example.com/b", Direction: perf.Download, Kind: perf.KindProgress})
+	if d.dirty || len(d.model.rows) != 3 {
+		t.Errorf("paused add: dirty %v, %d rows", d.dirty, len(d.model.rows))
+	}
+
+	d.press("q")
+	d.press("q")
+	if quits != 1 || !d.model.finished {
+		t.Errorf("quit %d times, finished %v", quits, d.model.finished)
+	}
+	select {
+	case <-d.done:
+	default:
+		t.Error("q left the loop running")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+
+	"yaperf/pkg/perf"
+)
+
+// units picks the units the console, the results tables, the dashboard
+// and the HTML report show speeds and sizes in. Everything shown to people
+// is formatted here, so they never disagree; JSON and CSV keep Mbps and
+// bytes.
+var units perf.Units
+
+// speedUnit is a unit speeds are shown in.
+type speedUnit struct {
+	name string
+	// perMbps is the value of 1 Mbps in the unit.
+	perMbps float64
+}
+
+var (
+	unitBps  = speedUnit{"bps", 1e6}
+	unitKbps = speedUnit{"Kbps", 1e3}
+	unitMbps = speedUnit{"Mbps", 1}
+	unitGbps = speedUnit{"Gbps", 1e-3}
+	unitTbps = speedUnit{"Tbps", 1e-6}
+)
+
+// autoUnits are the units auto picks from, smallest first.
+var autoUnits = []speedUnit{unitBps, unitKbps, unitMbps, unitGbps, unitTbps}
+
+// speedUnitFor is the unit mbps is shown in: the configured one, or with
+// auto the one putting it between 1 and 999. Zero is shown in Mbps.
+func speedUnitFor(mbps float64) speedUnit {
+	switch units.Speed {
+	case perf.SpeedMBps:
+		if units.Size == perf.SizeBinary {
+			return speedUnit{"MiB/s", 1e6 / 8 / (1 << 20)}
+		}
+		return speedUnit{"MB/s", 1.0 / 8}
+	case perf.SpeedGbps:
+		return unitGbps
+	case perf.SpeedAuto:
+		if mbps <= 0 {
+			return unitMbps
+		}
+		for _, u := range autoUnits {
+			if mbps*u.perMbps < 999.995 {
+				return u
+			}
+		}
+		return unitTbps
+	}
+	return unitMbps
+}
+
+// columnUnit is the unit the speeds mbps gives of rows are shown in side by
+// side, which auto picks for the fastest of them.
+func columnUnit[T any](rows []T, mbps func(T) float64) speedUnit {
+	fastest := 0.0
+	for _, row := range rows {
+		fastest = max(fastest, mbps(row))
+	}
+	return speedUnitFor(fastest)
+}
+
+func (u speedUnit) String() string { return u.name }
+
+// number is mbps in u, without the unit.
+func (u speedUnit) number(mbps float64) string {
+	return fmt.Sprintf("%.2f", mbps*u.perMbps)
+}
+
+// showSpeed is mbps with its unit, as "94.21 Mbps".
+func showSpeed(mbps float64) string {
+	u := speedUnitFor(mbps)
+	return u.number(mbps) + " " + u.name
+}
+
+// showSpeeds is the speed of a result on its Speed line: in MB/s and Mbps
+// both, unless units picks one.
+func showSpeeds(result perf.Stats) string {
+	if units.Speed == "" {
+		return fmt.Sprintf("%.2f MB/s (%.2f Mbps%s)", result.SpeedMBps, result.SpeedMbps, ofPlan(result.Utilization))
+	}
+	return showSpeed(result.SpeedMbps) + ofPlan(result.Utilization)
+}
+
+// showSize is a number of bytes in MB, or MiB with binary sizes.
+func showSize(bytes int64) string {
+	if units.Size == perf.SizeBinary {
+		return fmt.Sprintf("%.2f MiB", float64(bytes)/(1<<20))
+	}
+	return fmt.Sprintf("%.2f MB", float64(bytes)/1e6)
+}
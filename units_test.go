@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// setUnits shows output in u for the rest of the test.
+func setUnits(t *testing.T, u perf.Units) {
+	saved := units
+	units = u
+	t.Cleanup(func() { units = saved })
+}
+
+func TestShowSpeed(t *testing.T) {
+	tests := []struct {
+		units perf.Units
+		mbps  float64
+		want  string
+	}{
+		{perf.Units{}, 0, "0.00 Mbps"},
+		{perf.Units{}, 94.214, "94.21 Mbps"},
+		{perf.Units{}, 25000, "25000.00 Mbps"},
+		{perf.Units{Speed: perf.SpeedMbps}, 0.001, "0.00 Mbps"},
+		{perf.Units{Speed: perf.SpeedMBps}, 100, "12.50 MB/s"},
+		{perf.Units{Speed: perf.SpeedMBps, Size: perf.SizeBinary}, 100, "11.92 MiB/s"},
+		{perf.Units{Speed: perf.SpeedGbps}, 940, "0.94 Gbps"},
+		{perf.Units{Speed: perf.SpeedGbps}, 0, "0.00 Gbps"},
+		// Auto keeps the number between 1 and 999, and shows zero in Mbps.
+		{perf.Units{Speed: perf.SpeedAuto}, 0, "0.00 Mbps"},
+		{perf.Units{Speed: perf.SpeedAuto}, 0.0000005, "0.50 bps"},
+		{perf.Units{Speed: perf.SpeedAuto}, 0.0005, "500.00 bps"},
+		{perf.Units{Speed: perf.SpeedAuto}, 0.5, "500.00 Kbps"},
+		{perf.Units{Speed: perf.SpeedAuto}, 1, "1.00 Mbps"},
+		{perf.Units{Speed: perf.SpeedAuto}, 999.99, "999.99 Mbps"},
+		// A speed that would round up to 1000 goes to the next unit.
+		{perf.Units{Speed: perf.SpeedAuto}, 999.999, "1.00 Gbps"},
+		{perf.Units{Speed: perf.SpeedAuto}, 9400, "9.40 Gbps"},
+		{perf.Units{Speed: perf.SpeedAuto}, 4.2e6, "4.20 Tbps"},
+		{perf.Units{Speed: perf.SpeedAuto}, 4.2e9, "4200.00 Tbps"},
+	}
+	for _, tt := range tests {
+		setUnits(t, tt.units)
+		if got := showSpeed(tt.mbps); got != tt.want {
+			t.Errorf("showSpeed(%v) with %+v = %q, want %q", tt.mbps, tt.units, got, tt.want)
+		}
+	}
+}
+
+func TestShowSize(t *testing.T) {
+	tests := []struct {
+		size  string
+		bytes int64
+		want  string
+	}{
+		{"", 0, "0.00 MB"},
+		{"", 1, "0.00 MB"},
+		{perf.SizeDecimal, 100e6, "100.00 MB"},
+		{perf.SizeDecimal, 2e12, "2000000.00 MB"},
+		{perf.SizeBinary, 100e6, "95.37 MiB"},
+		{perf.SizeBinary, 1 << 20, "1.00 MiB"},
+		{perf.SizeBinary, 0, "0.00 MiB"},
+	}
+	for _, tt := range tests {
+		setUnits(t, perf.Units{Size: tt.size})
+		if got := showSize(tt.bytes); got != tt.want {
+			t.Errorf("showSize(%d) with size %q = %q, want %q", tt.bytes, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestShowSpeeds(t *testing.T) {
+	result := perf.Stats{SpeedMbps: 800, SpeedMBps: 100}
+	// Unset, a result shows both units, as before there were settings.
+	setUnits(t, perf.Units{})
+	if got := showSpeeds(result); got != "100.00 MB/s (800.00 Mbps)" {
+		t.Errorf("default speeds %q", got)
+	}
+	setUnits(t, perf.Units{Speed: perf.SpeedAuto})
+	if got := showSpeeds(result); got != "800.00 Mbps" {
+		t.Errorf("auto speeds %q", got)
+	}
+
+	// Speeds side by side share the unit auto picks for the fastest.
+	rows := []float64{0.5, 20, 1500}
+	if u := columnUnit(rows, func(mbps float64) float64 { return mbps }); u != unitGbps || u.number(0.5) != "0.00" {
+		t.Errorf("column unit %s", u)
+	}
+	if u := columnUnit([]float64{}, func(mbps float64) float64 { return mbps }); u != unitMbps {
+		t.Errorf("empty column unit %s", u)
+	}
+}
+
+func TestUnitsOutput(t *testing.T) {
+	result := perf.Stats{
+		Kind: perf.KindFinal, URL: "https://example.com/a", Direction: perf.Download, Done: true,
+		SizeBytes: 1 << 30, BodyBytes: 1 << 30, WireBytes: 1 << 30, Elapsed: 4 * time.Second, SpeedMbps: 2147.48, SpeedMBps: 268.44,
+	}
+	summaries := []perf.Summary{{URL: "https://example.com/a", Direction: perf.Download, Runs: 2, MinMbps: 900, MeanMbps: 1500, MedianMbps: 1500, P95Mbps: 2000, MaxMbps: 2100}}
+
+	setUnits(t, perf.Units{Speed: perf.SpeedAuto, Size: perf.SizeBinary})
+	var out bytes.Buffer
+	printText(&out, result, "")
+	printSummary(&out, "", summaries)
+	for _, want := range []string{"  Size:     1024.00 MiB\n", "  Speed:    2.15 Gbps\n", "Summary (Gbps)\n", "  0.90  1.50  1.50    2.00  2.10  0.00\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	// Results written for tools keep Mbps and bytes.
+	if r := newJSONResult(result); r.SpeedMbps != 2147.48 || r.SizeBytes != 1<<30 {
+		t.Errorf("JSON result %v Mbps, %d bytes", r.SpeedMbps, r.SizeBytes)
+	}
+}
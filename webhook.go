@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// alert is the webhook payload, and the data a custom template sees.
+type alert struct {
+	URL           string            `json:"url"`
+	Direction     perf.Direction    `json:"direction"`
+	SpeedMbps     float64           `json:"speed_mbps"`
+	ThresholdMbps float64           `json:"threshold_mbps,omitempty"`
+	Error         string            `json:"error,omitempty"`
+	Timestamp     time.Time         `json:"timestamp"`
+	RunID         string            `json:"run_id"`
+	Host          string            `json:"host,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	// State and Failures are the URL's error budget state and failures in
+	// alert_window, on alerts sent as it becomes alerting or ok again.
+	State    perf.AlertState `json:"state,omitempty"`
+	Failures int             `json:"failures,omitempty"`
+	// LinkDown is set on the one alert sent as probe_failures_threshold
+	// takes the link down.
+	LinkDown bool `json:"link_down,omitempty"`
+}
+
+// webhook notifies an HTTP endpoint when a transfer fails or is slower
+// than its min_speed_mbps. Each URL alerts at most once per cooldown, and
+// requests are sent in the background so a slow endpoint never holds up
+// the run. With alert_threshold set, failures alert only as the URL
+// becomes alerting, and again as it is ok once more. With outbox set,
+// alerts are queued there instead and redelivered until the endpoint
+// accepts them, each with an Idempotency-Key header that stays the same
+// across retries. They are queued under name, the key that set it up.
+type webhook struct {
+	name       string
+	cfg        perf.Webhook
+	template   *template.Template
+	client     *http.Client
+	outbox     *outbox
+	thresholds map[seriesKey]float64
+
+	mu   sync.Mutex
+	last map[seriesKey]time.Time
+	wg   sync.WaitGroup
+}
+
+func newWebhook(name string, cfg perf.Webhook, targets []perf.Target, box *outbox) (*webhook, error) {
+	if u, err := url.Parse(cfg.URL); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("webhook: invalid url %q", cfg.URL)
+	}
+	if cfg.Method == "" {
+		cfg.Method = http.MethodPost
+	}
+	if cfg.Cooldown == 0 {
+		cfg.Cooldown = 10 * time.Minute
+	}
+	w := &webhook{
+		name:       name,
+		cfg:        cfg,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		outbox:     box,
+		thresholds: make(map[seriesKey]float64),
+		last:       make(map[seriesKey]time.Time),
+	}
+	if box != nil {
+		box.register(name, w.send)
+	}
+	if cfg.Template != "" {
+		tmpl, err := parseTemplate(cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("webhook: %w", err)
+		}
+		w.template = tmpl
+	}
+	for _, target := range targets {
+		if target.MinSpeedMbps > 0 {
+			w.thresholds[seriesKey{url: target.URL, direction: target.Direction()}] = target.MinSpeedMbps
+		}
+	}
+	return w, nil
+}
+
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Funcs(template.FuncMap{"json": jsonString}).Parse(text)
+}
+
+// jsonString quotes s for use inside a JSON template.
+func jsonString(s string) (string, error) {
+	b, err := marshal(s)
+	return string(b), err
+}
+
+// marshal encodes v as JSON without escaping HTML characters, which are
+// common in URLs.
+func marshal(v any) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+func (w *webhook) Write(result perf.Stats) error {
+	if !result.Final() || result.Cancelled || result.Skipped {
+		return nil
+	}
+	key := seriesKey{url: result.URL, direction: result.Direction}
+	threshold := w.thresholds[key]
+	a := alert{
+		URL: result.URL, Direction: result.Direction, SpeedMbps: result.SpeedMbps, ThresholdMbps: threshold,
+		Timestamp: time.Now(), RunID: result.RunID, Host: result.Host, Labels: result.Labels,
+	}
+	if result.Error != nil {
+		a.Error = result.Error.Error()
+	}
+	changed := result.Alert != nil && (result.Alert.Raised || result.Alert.Cleared) || result.LinkDown
+	a.LinkDown = result.LinkDown
+	switch {
+	case result.LinkDown:
+	case changed:
+		a.State, a.Failures = result.Alert.State, result.Alert.Failures
+	case result.Error != nil && result.Alert != nil:
+		// The failure is within the error budget.
+		return nil
+	case result.Error != nil:
+	case result.Direction != perf.Latency && threshold > 0 && result.SpeedMbps < threshold:
+	default:
+		return nil
+	}
+
+	// Changes of state are rare already, and a recovery must not be held
+	// back by the alert before it.
+	if !changed {
+		w.mu.Lock()
+		if last, ok := w.last[key]; ok && a.Timestamp.Sub(last) < w.cfg.Cooldown {
+			w.mu.Unlock()
+			return nil
+		}
+		w.last[key] = a.Timestamp
+		w.mu.Unlock()
+	}
+
+	body, err := w.body(a)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	if w.outbox != nil {
+		return w.outbox.add(w.name, body)
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		if err := w.send("", body); err != nil {
+			slog.Error("webhook: alert not sent", "url", a.URL, "err", err)
+		}
+	}()
+	return nil
+}
+
+func (w *webhook) body(a alert) ([]byte, error) {
+	if w.template == nil {
+		return marshal(a)
+	}
+	var b bytes.Buffer
+	if err := w.template.Execute(&b, a); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// send delivers body, sending id as its Idempotency-Key when it has one.
+func (w *webhook) send(id string, body []byte) error {
+	req, err := http.NewRequest(strings.ToUpper(w.cfg.Method), w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if id != "" {
+		req.Header.Set("Idempotency-Key", id)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Close waits for alerts still being sent.
+func (w *webhook) Close() error {
+	w.wg.Wait()
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// hookReceiver records the requests a webhook sends.
+type hookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	bodies   []string
+	requests []*http.Request
+}
+
+func newHookReceiver(t *testing.T) *hookReceiver {
+	h := &hookReceiver{}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.bodies = append(h.bodies, string(body))
+		h.requests = append(h.requests, r)
+	}))
+	t.Cleanup(h.Close)
+	return h
+}
+
+func TestWebhookPayload(t *testing.T) {
+	receiver := newHookReceiver(t)
+	targets := []perf.Target{{URL: "https://example.com/a", Thresholds: perf.Thresholds{MinSpeedMbps: 100}}}
+	w, err := newWebhook("webhook", perf.Webhook{URL: receiver.URL + "/hook", Headers: map[string]string{"X-Token": "k"}}, targets, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	for _, r := range []perf.Stats{
+		// Progress, fast, cancelled and skipped results send nothing.
+		{URL: "https://example.com/a", Direction: perf.Download, SpeedMbps: 5, SizeBytes: 10},
+		{URL: "https://example.com/a", Direction: perf.Download, Done: true, SpeedMbps: 150},
+		{URL: "https://example.com/a", Direction: perf.Download, Done: true, Cancelled: true, SpeedMbps: 5},
+		{URL: "https://example.com/a", Direction: perf.Download, Done: true, Skipped: true},
+		{URL: "https://example.com/a", Direction: perf.Download, Done: true, SpeedMbps: 42.5, RunID: "run-1", Labels: map[string]string{"site": "lab"}},
+		{URL: "https://example.com/b?x=1&y=2", Direction: perf.Download, Done: true, Error: errors.New("connection reset")},
+	} {
+		if err := w.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.bodies) != 2 {
+		t.Fatalf("sent %q, want the slow and the failed transfer", receiver.bodies)
+	}
+	for _, r := range receiver.requests {
+		if r.Method != http.MethodPost || r.URL.Path != "/hook" || r.Header.Get("X-Token") != "k" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s with headers %v", r.Method, r.URL.Path, r.Header)
+		}
+	}
+	got := map[string]alert{}
+	for _, body := range receiver.bodies {
+		var a alert
+		if err := json.Unmarshal([]byte(body), &a); err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		if a.Timestamp.Before(before.Truncate(time.Second)) || a.Timestamp.After(time.Now()) {
+			t.Errorf("timestamp %v", a.Timestamp)
+		}
+		got[a.URL] = a
+	}
+	if a := got["https://example.com/a"]; a.SpeedMbps != 42.5 || a.ThresholdMbps != 100 || a.Error != "" || a.RunID != "run-1" || a.Labels["site"] != "lab" {
+		t.Errorf("slow alert %+v", a)
+	}
+	if a := got["https://example.com/b?x=1&y=2"]; a.Error != "connection reset" || a.ThresholdMbps != 0 {
+		t.Errorf("failure alert %+v", a)
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	receiver := newHookReceiver(t)
+	w, err := newWebhook("webhook", perf.Webhook{URL: receiver.URL, Method: "put", Template: `{"text": {{json .URL}}, "error": {{json .Error}}}`}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(perf.Stats{URL: `https://example.com/"a"`, Direction: perf.Download, Done: true, Error: errors.New("reset")})
+	w.Close()
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	want := `{"text": "https://example.com/\"a\"", "error": "reset"}`
+	if len(receiver.bodies) != 1 || receiver.bodies[0] != want || receiver.requests[0].Method != http.MethodPut {
+		t.Errorf("sent %q, want %s as a PUT", receiver.bodies, want)
+	}
+	if _, err := newWebhook("webhook", perf.Webhook{URL: receiver.URL, Template: "{{"}, nil, nil); err == nil {
+		t.Error("accepted an invalid template")
+	}
+	if _, err := newWebhook("webhook", perf.Webhook{URL: "not a url"}, nil, nil); err == nil || err.Error() != `webhook: invalid url "not a url"` {
+		t.Errorf("invalid url: %v", err)
+	}
+}
+
+func TestWebhookCooldown(t *testing.T) {
+	receiver := newHookReceiver(t)
+	w, err := newWebhook("webhook", perf.Webhook{URL: receiver.URL}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := func(url string, dir perf.Direction) perf.Stats {
+		return perf.Stats{URL: url, Direction: dir, Done: true, Error: errors.New("reset")}
+	}
+	// A flapping link alerts once in the ten minute default; other URLs
+	// and directions have cooldowns of their own.
+	for range 20 {
+		w.Write(failed("https://example.com/a", perf.Download))
+	}
+	w.Write(failed("https://example.com/b", perf.Download))
+	w.Write(failed("https://example.com/a", perf.Upload))
+	// An alert as the URL's state changes is never held back.
+	cleared := perf.Stats{URL: "https://example.com/a", Direction: perf.Download, Done: true, Alert: &perf.Alert{State: perf.AlertOK, Cleared: true}}
+	w.Write(cleared)
+	w.Close()
+	receiver.mu.Lock()
+	if len(receiver.bodies) != 4 {
+		t.Errorf("sent %d alerts, want 4:\n%q", len(receiver.bodies), receiver.bodies)
+	}
+	receiver.mu.Unlock()
+
+	// Once the cooldown has passed the URL alerts again.
+	w.mu.Lock()
+	for key, last := range w.last {
+		w.last[key] = last.Add(-10 * time.Minute)
+	}
+	w.mu.Unlock()
+	w.Write(failed("https://example.com/a", perf.Download))
+	w.Write(failed("https://example.com/a", perf.Download))
+	w.Close()
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.bodies) != 5 {
+		t.Errorf("sent %d alerts after the cooldown, want 5", len(receiver.bodies))
+	}
+}
+
+func TestWebhookFailuresAreNotFatal(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	for _, endpoint := range []string{failing.URL, down.URL} {
+		w, err := newWebhook("webhook", perf.Webhook{URL: endpoint}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write(perf.Stats{URL: "https://example.com/", Direction: perf.Download, Done: true, Error: errors.New("reset")}); err != nil {
+			t.Errorf("%s: Write = %v", endpoint, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("%s: Close = %v", endpoint, err)
+		}
+	}
+	failing.Close()
+	if err := (&webhook{cfg: perf.Webhook{URL: down.URL}, client: http.DefaultClient}).send("", nil); err == nil {
+		t.Error("send to a closed server succeeded")
+	}
+}
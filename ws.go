@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// WebSocket opcodes of RFC 6455.
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xa
+)
+
+// wsGUID is what RFC 6455 appends to a client's key to accept it.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Timing and bounds of /ws clients: they are pinged every wsPingInterval
+// and dropped after wsPongWait without a frame, or once a write takes
+// longer than wsWriteWait. Progress beyond wsQueue events waiting for a
+// client is dropped; final results always wait.
+const (
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsWriteWait    = 10 * time.Second
+	wsQueue        = 64
+	// wsMaxFrame bounds the frames read from clients, which have nothing
+	// to send but control frames.
+	wsMaxFrame = 4096
+)
+
+// wsHub is the reporter of the test API's /ws endpoint: it streams every
+// snapshot the reporters see, as the JSON lines of -format json, to the
+// WebSocket clients whose filter it matches.
+type wsHub struct {
+	mu      sync.Mutex
+	clients map[*wsClient]bool
+	closed  bool
+}
+
+func newWSHub() *wsHub {
+	return &wsHub{clients: map[*wsClient]bool{}}
+}
+
+func (h *wsHub) OnProgress(result perf.Stats) {
+	if !result.Retrying {
+		h.send(result, false)
+	}
+}
+
+func (h *wsHub) OnComplete(result perf.Stats) { h.send(result, true) }
+
+func (h *wsHub) OnPass(resultTable) {}
+
+func (h *wsHub) OnSummary([]perf.Summary) {}
+
+func (h *wsHub) send(result perf.Stats, final bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var line []byte
+	for c := range h.clients {
+		if !c.filter.matches(result) {
+			continue
+		}
+		if line == nil {
+			b, err := marshal(newJSONResult(result))
+			if err != nil {
+				slog.Error("ws: encoding result", "err", err)
+				return
+			}
+			line = append(b, '\n')
+		}
+		c.queue(line, final)
+	}
+}
+
+// close says goodbye to every client, as the server shuts down.
+func (h *wsHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for c := range h.clients {
+		c.stop()
+	}
+}
+
+// wsFilter picks the results a client streams: those of any of urls, by
+// URL or name, and with every one of labels. An empty filter takes all.
+type wsFilter struct {
+	urls   []string
+	labels map[string]string
+}
+
+// parseWSFilter reads the url and label query parameters of /ws, labels
+// given as key=value.
+func parseWSFilter(r *http.Request) (wsFilter, error) {
+	q := r.URL.Query()
+	f := wsFilter{urls: q["url"], labels: map[string]string{}}
+	for _, l := range q["label"] {
+		k, v, ok := strings.Cut(l, "=")
+		if !ok || k == "" {
+			return f, fmt.Errorf("label %q: want key=value", l)
+		}
+		f.labels[k] = v
+	}
+	return f, nil
+}
+
+func (f wsFilter) matches(result perf.Stats) bool {
+	if len(f.urls) > 0 && !slices.Contains(f.urls, result.URL) && !slices.Contains(f.urls, result.Name) {
+		return false
+	}
+	for k, v := range f.labels {
+		if got, ok := result.Labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// wsClient is one /ws connection. Events wait in pending for its writer;
+// progress is dropped while wsQueue of them wait, final results never.
+type wsClient struct {
+	conn   net.Conn
+	filter wsFilter
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending []wsEvent
+	waiting int
+	dropped int
+	wake    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+type wsEvent struct {
+	line  []byte
+	final bool
+}
+
+func (c *wsClient) queue(line []byte, final bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !final && c.waiting >= wsQueue {
+		c.dropped++
+		return
+	}
+	if !final {
+		c.waiting++
+	}
+	c.pending = append(c.pending, wsEvent{line, final})
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the events waiting, and how many progress events were
+// dropped since the last call.
+func (c *wsClient) next() ([]wsEvent, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	events, dropped := c.pending, c.dropped
+	c.pending, c.waiting, c.dropped = nil, 0, 0
+	return events, dropped
+}
+
+// stop ends the client's writer, which closes the connection.
+func (c *wsClient) stop() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// ws serves GET /ws: it upgrades to a WebSocket and streams results until
+// the client goes away or the server shuts down.
+func (s *apiServer) ws(w http.ResponseWriter, r *http.Request) {
+	if !s.allowOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	filter, err := parseWSFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := wsUpgrade(w, r)
+	if err != nil {
+		slog.Debug("ws: upgrade failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	c := &wsClient{conn: conn, filter: filter, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	s.hub.mu.Lock()
+	if s.hub.closed {
+		s.hub.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.hub.clients[c] = true
+	// serveAPI waits for the client to be told the server is going away.
+	s.wg.Add(1)
+	s.hub.mu.Unlock()
+	defer s.wg.Done()
+	defer func() {
+		s.hub.mu.Lock()
+		delete(s.hub.clients, c)
+		s.hub.mu.Unlock()
+	}()
+	slog.Debug("ws: client connected", "remote", r.RemoteAddr)
+	go c.read()
+	c.write()
+}
+
+// allowOrigin reports whether r may open a WebSocket: browsers always send
+// their page's Origin, which must be the API's own host or one of
+// serve_origins. Other clients send none.
+func (s *apiServer) allowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return slices.ContainsFunc(s.origins, func(allowed string) bool {
+		return strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin)
+	})
+}
+
+// wsUpgrade completes the opening handshake of RFC 6455 and takes over the
+// connection.
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case !headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket"):
+		http.Error(w, "want a WebSocket upgrade", http.StatusUpgradeRequired)
+		return nil, errors.New("not an upgrade request")
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported version")
+	case key == "":
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing key")
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if rw.Reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: rw.Reader}, nil
+	}
+	return conn, nil
+}
+
+// headerHas reports whether the comma-separated header name lists token,
+// in any case.
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bufferedConn reads what the HTTP server buffered before the connection
+// was taken over first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) { return b.r.Read(p) }
+
+// write sends the client's events and pings until it is stopped or a
+// write fails, then closes the connection.
+func (c *wsClient) write() {
+	defer c.conn.Close()
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-c.done:
+			// Results queued before the server went away still go out.
+			if c.flush() == nil {
+				c.frame(wsClose, binary.BigEndian.AppendUint16(nil, 1001))
+			}
+			return
+		case <-ping.C:
+			if c.frame(wsPing, nil) != nil {
+				return
+			}
+		case <-c.wake:
+			if err := c.flush(); err != nil {
+				slog.Debug("ws: client gone", "remote", c.conn.RemoteAddr(), "err", err)
+				return
+			}
+		}
+	}
+}
+
+// flush writes the events waiting.
+func (c *wsClient) flush() error {
+	events, dropped := c.next()
+	if dropped > 0 {
+		slog.Debug("ws: slow client, progress dropped", "remote", c.conn.RemoteAddr(), "dropped", dropped)
+	}
+	for _, e := range events {
+		if err := c.frame(wsText, e.line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read answers the client's pings and close, and stops the client once it
+// closes, errs or stays silent past wsPongWait. What else it sends is
+// ignored.
+func (c *wsClient) read() {
+	defer c.stop()
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		op, payload, err := readFrame(c.conn)
+		if err != nil {
+			return
+		}
+		switch op {
+		case wsPing:
+			if c.frame(wsPong, payload) != nil {
+				return
+			}
+		case wsClose:
+			return
+		}
+	}
+}
+
+// frame writes one unfragmented frame, unmasked as a server's are.
+func (c *wsClient) frame(op byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	header := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = binary.BigEndian.AppendUint16(append(header, 126), uint16(n))
+	default:
+		header = binary.BigEndian.AppendUint64(append(header, 127), uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	_, err := (&net.Buffers{header, payload}).WriteTo(c.conn)
+	return err
+}
+
+// readFrame reads one frame of a client, which must be masked, and returns
+// its opcode and unmasked payload.
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	if head[1]&0x80 == 0 {
+		return 0, nil, errors.New("unmasked client frame")
+	}
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > wsMaxFrame {
+		return 0, nil, fmt.Errorf("client frame of %d bytes", n)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return head[0] & 0x0f, payload, nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"yaperf/pkg/perf"
+)
+
+// wsDial opens a WebSocket to path on srv with the extra headers, and
+// returns the connection, its reader and the handshake's response.
+func wsDial(t *testing.T, srv *httptest.Server, path string, headers map[string]string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var req strings.Builder
+	fmt.Fprintf(&req, "GET %s HTTP/1.1\r\nHost: %s\r\n", path, srv.Listener.Addr())
+	h := map[string]string{
+		"Connection":            "keep-alive, Upgrade",
+		"Upgrade":               "websocket",
+		"Sec-WebSocket-Version": "13",
+		// The sample nonce of RFC 6455.
+		"Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==",
+	}
+	for k, v := range headers {
+		h[k] = v
+	}
+	for k, v := range h {
+		if v != "" {
+			fmt.Fprintf(&req, "%s: %s\r\n", k, v)
+		}
+	}
+	req.WriteString("\r\n")
+	if _, err := io.WriteString(conn, req.String()); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, resp
+}
+
+// clientFrame is a frame as a client sends it, masked.
+func clientFrame(op byte, payload []byte) []byte {
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 0x80|127), uint64(n))
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// serverFrame reads a frame of the server, unmasked.
+func serverFrame(r io.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	if head[0]&0x80 == 0 || head[1]&0x80 != 0 {
+		return 0, nil, fmt.Errorf("frame header %x", head)
+	}
+	n := uint64(head[1])
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, n)
+	_, err := io.ReadFull(r, payload)
+	return head[0] & 0x0f, payload, err
+}
+
+func TestWSHandshake(t *testing.T) {
+	s := newTestAPI(t, fakeRunner{}, 1)
+	s.origins = []string{"https://dash.example/"}
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+	defer s.hub.close()
+	tests := []struct {
+		name    string
+		headers map[string]string
+		code    int
+	}{
+		{"upgrade", nil, http.StatusSwitchingProtocols},
+		{"same origin", map[string]string{"Origin": srv.URL}, http.StatusSwitchingProtocols},
+		{"allowed origin", map[string]string{"Origin": "https://dash.example"}, http.StatusSwitchingProtocols},
+		{"other origin", map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"bad origin", map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"not an upgrade", map[string]string{"Upgrade": ""}, http.StatusUpgradeRequired},
+		{"old version", map[string]string{"Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+		{"no key", map[string]string{"Sec-WebSocket-Key": ""}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, resp := wsDial(t, srv, "/ws", tt.headers)
+			if resp.StatusCode != tt.code {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.code)
+			}
+			if tt.code != http.StatusSwitchingProtocols {
+				return
+			}
+			// The accept value of the sample nonce, from RFC 6455.
+			if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+				t.Errorf("Sec-WebSocket-Accept %q", got)
+			}
+		})
+	}
+	if _, _, resp := wsDial(t, srv, "/ws?label=nokey", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad label filter: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestWSFrames(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 4096, 70000} {
+		t.Run(fmt.Sprint(n, " bytes"), func(t *testing.T) {
+			payload := bytes.Repeat([]byte{'x'}, n)
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+			c := &wsClient{conn: server}
+			go c.frame(wsText, payload)
+			op, got, err := serverFrame(client)
+			if err != nil || op != wsText || !bytes.Equal(got, payload) {
+				t.Fatalf("server frame: op %x, %d bytes, err %v", op, len(got), err)
+			}
+
+			op, got, err = readFrame(bytes.NewReader(clientFrame(wsPing, payload)))
+			switch {
+			case n > wsMaxFrame:
+				if err == nil {
+					t.Error("read a client frame over wsMaxFrame")
+				}
+			case err != nil || op != wsPing || !bytes.Equal(got, payload):
+				t.Errorf("client frame: op %x, %d bytes, err %v", op, len(got), err)
+			}
+		})
+	}
+	unmasked := []byte{0x80 | wsText, 1, 'x'}
+	if _, _, err := readFrame(bytes.NewReader(unmasked)); err == nil {
+		t.Error("read an unmasked client frame")
+	}
+}
+
+func TestWSPingAndClose(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &wsClient{conn: server, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	go c.read()
+	go c.write()
+
+	go client.Write(clientFrame(wsPing, []byte("hi")))
+	if op, payload, err := serverFrame(client); err != nil || op != wsPong || string(payload) != "hi" {
+		t.Fatalf("op %x %q, err %v, want a pong", op, payload, err)
+	}
+	// A close from the client stops it, and the server says goodbye.
+	go client.Write(clientFrame(wsClose, nil))
+	if op, payload, err := serverFrame(client); err != nil || op != wsClose || binary.BigEndian.Uint16(payload) != 1001 {
+		t.Fatalf("op %x %x, err %v, want a close", op, payload, err)
+	}
+}
+
+func TestWSFilter(t *testing.T) {
+	result := perf.Stats{URL: "https://example.com/a", Name: "a", Labels: map[string]string{"site": "lab", "rack": "7"}}
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"", true},
+		{"url=https://example.com/a", true},
+		{"url=a", true},
+		{"url=b&url=a", true},
+		{"url=b", false},
+		{"label=site=lab", true},
+		{"label=site=lab&label=rack=7", true},
+		{"label=site=lab&label=rack=8", false},
+		{"label=zone=", false},
+		{"url=a&label=site=prod", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			f, err := parseWSFilter(httptest.NewRequest("GET", "/ws?"+tt.query, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.matches(result); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWSStream(t *testing.T) {
+	s := newTestAPI(t, fakeRunner{}, 1)
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+	conn, r, resp := wsDial(t, srv, "/ws?url=wanted", nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.hub.mu.Lock()
+		n := len(s.hub.clients)
+		s.hub.mu.Unlock()
+		if n == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	other := perf.Stats{URL: "https://example.com/other", Kind: perf.KindProgress, Direction: perf.Download}
+	wanted := perf.Stats{URL: "https://example.com/a", Name: "wanted", Kind: perf.KindProgress, Direction: perf.Download, SizeBytes: 10}
+	report(s.reporters, other)
+	report(s.reporters, wanted)
+	wanted.Kind, wanted.Done, wanted.SizeBytes = perf.KindFinal, true, 20
+	report(s.reporters, wanted)
+	s.hub.close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var got []jsonResult
+	for {
+		op, payload, err := serverFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op == wsClose {
+			break
+		}
+		var result jsonResult
+		if err := json.Unmarshal(payload, &result); err != nil {
+			t.Fatalf("%q: %v", payload, err)
+		}
+		got = append(got, result)
+	}
+	if len(got) != 2 || got[0].SizeBytes != 10 || got[1].SizeBytes != 20 || got[1].URL != wanted.URL {
+		t.Errorf("streamed %+v, want the two snapshots of the wanted URL", got)
+	}
+}
+
+func TestWSSlowClient(t *testing.T) {
+	c := &wsClient{wake: make(chan struct{}, 1)}
+	for range wsQueue + 10 {
+		c.queue([]byte("progress\n"), false)
+	}
+	c.queue([]byte("final\n"), true)
+	events, dropped := c.next()
+	if len(events) != wsQueue+1 || dropped != 10 || !events[wsQueue].final {
+		t.Fatalf("%d events, %d dropped, want %d and 10 with the final one kept", len(events), dropped, wsQueue+1)
+	}
+	if events, dropped := c.next(); len(events) != 0 || dropped != 0 {
+		t.Errorf("second next: %d events, %d dropped", len(events), dropped)
+	}
+
+	// A client that stops reading is dropped once a write times out.
+	server, client := net.Pipe()
+	defer client.Close()
+	slow := &wsClient{conn: expiredConn{server}, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	finished := make(chan struct{})
+	go func() {
+		slow.write()
+		close(finished)
+	}()
+	slow.queue([]byte("final\n"), true)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("the writer of a client that does not read kept going")
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read %v, want the connection closed", err)
+	}
+}
+
+// expiredConn times writes out at once, whatever deadline they are given,
+// as if wsWriteWait had passed.
+type expiredConn struct {
+	net.Conn
+}
+
+func (c expiredConn) SetWriteDeadline(time.Time) error {
+	return c.Conn.SetWriteDeadline(time.Now())
+}